@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/server"
+)
+
+// 进程退出码，systemd 和部署脚本据此区分退出原因，而不是都按 1 处理
+const (
+	exitOK            = 0 // 收到停止信号后正常退出
+	exitRuntime       = 1 // 运行中的其他致命错误，包括 panic
+	exitConfig        = 2 // 参数、配置文件或启动自检错误，与 flag 包解析参数失败时相同
+	exitBind          = 3 // 无法监听端口
+	exitTLS           = 4 // 无法加载TLS证书
+	exitAuthRejected  = 5 // 服务器拒绝隧道注册 (client模式)
+	exitMaxReconnects = 6 // 连续连接失败达到 -max-reconnects (client模式)
+)
+
+// exitReasons 退出报告中各退出码对应的 reason
+var exitReasons = map[int]string{
+	exitOK:            "clean_shutdown",
+	exitRuntime:       "runtime_fatal",
+	exitConfig:        "config_error",
+	exitBind:          "bind_failure",
+	exitTLS:           "tls_failure",
+	exitAuthRejected:  "auth_rejected",
+	exitMaxReconnects: "max_reconnects",
+}
+
+// exitCode 按 run 返回的错误选择退出码
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, server.ErrListen):
+		return exitBind
+	case errors.Is(err, server.ErrTLS):
+		return exitTLS
+	case errors.Is(err, client.ErrRegistrationRejected):
+		return exitAuthRejected
+	case errors.Is(err, client.ErrMaxReconnects):
+		return exitMaxReconnects
+	}
+	return exitRuntime
+}
+
+// shutdownTotals 退出报告中按模式汇总的指标: 日志字段名和指标名
+var shutdownTotals = map[string][][2]string{
+	"server": {
+		{"requests", "singleproxy_server_public_requests_total"},
+		{"bytes_in", "singleproxy_server_public_request_bytes_total"},
+		{"bytes_out", "singleproxy_server_public_response_bytes_total"},
+		{"tunnel_connections", "singleproxy_server_tunnel_connections_total"},
+	},
+	"client": {
+		{"requests", "singleproxy_client_requests_total"},
+		{"bytes_out", "singleproxy_client_sent_bytes_total"},
+		{"reconnects", "singleproxy_client_reconnects_total"},
+	},
+}
+
+var (
+	startTime = time.Now()
+	// runMode 解析配置后设置，决定退出报告包含哪些汇总
+	runMode string
+)
+
+// logShutdown 输出进程退出前的最后一条日志
+func logShutdown(code int, reason string) {
+	args := []any{
+		"reason", reason,
+		"exit_code", code,
+		"mode", runMode,
+		"uptime", time.Since(startTime).Round(time.Millisecond),
+	}
+	for _, total := range shutdownTotals[runMode] {
+		if n, ok := metrics.Value(total[1]); ok {
+			args = append(args, total[0], n)
+		}
+	}
+	logger.Info("shutdown", args...)
+}
+
+// recoverPanic 在 defer 中调用，记录 panic 和调用栈后以 exitRuntime 退出
+func recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	logger.Error("Unrecovered panic",
+		"panic", fmt.Sprint(r),
+		"stack", string(debug.Stack()))
+	logShutdown(exitRuntime, "panic")
+	os.Exit(exitRuntime)
+}
@@ -1,27 +1,54 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"singleproxy/pkg/client"
 	"singleproxy/pkg/config"
+	"singleproxy/pkg/dnscache"
+	"singleproxy/pkg/doctor"
 	"singleproxy/pkg/logger"
 	"singleproxy/pkg/server"
+	"singleproxy/pkg/utils"
 )
 
 func main() {
-	// 先定义生成配置的flag
-	generateConfig := flag.Bool("generate-config", false, "生成示例配置文件")
+	defer recoverPanic()
+	logger.SetExitHook(func(code int) { logShutdown(code, exitReasons[code]) })
+
+	// service 子命令：安装、卸载、启停系统服务 (Linux 下输出 systemd unit)
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		os.Exit(serviceCommand(os.Args[2:]))
+	}
+
+	// test 子命令：以公网用户身份请求隧道，检查整条链路
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(smokeCommand(os.Args[2:]))
+	}
+
+	// routes 子命令：检查配置并输出生效的路由表，不启动服务
+	if len(os.Args) > 1 && os.Args[1] == "routes" {
+		os.Exit(routesCommand(os.Args[2:]))
+	}
+
+	// check 子命令：执行完整自检后退出，其余参数与正常启动相同
+	checkMode := len(os.Args) > 1 && os.Args[1] == "check"
+	if checkMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 
 	// 解析命令行参数
 	cfg := config.ParseFlags()
 
 	// 如果用户请求生成示例配置，则生成并退出
-	if *generateConfig {
+	if cfg.GenerateConfig {
 		filename := "singleproxy.yaml"
 		if err := config.GenerateExampleConfig(filename); err != nil {
-			logger.Fatal("生成配置文件失败", "error", err)
+			logger.Fatal(exitRuntime, "生成配置文件失败", "error", err)
 		}
 		logger.Info("示例配置文件已生成", "file", filename)
 		os.Exit(0)
@@ -31,7 +58,7 @@ func main() {
 	if cfg.ConfigFile != "" {
 		loadedCfg, err := config.LoadWithFile(cfg.ConfigFile, cfg)
 		if err != nil {
-			logger.Fatal("加载配置文件失败", "file", cfg.ConfigFile, "error", err)
+			logger.Fatal(exitConfig, "加载配置文件失败", "file", cfg.ConfigFile, "error", err)
 		}
 		cfg = loadedCfg
 	} else {
@@ -42,32 +69,94 @@ func main() {
 		}
 	}
 
+	runMode = cfg.Mode
+
+	if checkMode {
+		report := doctor.Run(cfg, doctor.Options{Network: true, CheckKey: cfg.CheckKey})
+		report.Write(os.Stdout)
+		if report.Failed() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// 作为系统服务运行时没有控制台，未指定日志文件时写入配置文件所在目录
+	asService := runningAsService()
+	if asService && cfg.LogFile == "" {
+		cfg.LogFile = serviceLogFile(cfg)
+	}
+
 	// 初始化日志系统
 	if err := logger.InitLogger(cfg); err != nil {
-		logger.Fatal("初始化日志系统失败", "error", err)
+		logger.Fatal(exitConfig, "初始化日志系统失败", "error", err)
 	}
 
 	// 验证配置
 	if err := cfg.Validate(); err != nil {
-		logger.Fatal("配置验证失败", "error", err)
+		logger.Fatal(exitConfig, "配置验证失败", "error", err)
+	}
+
+	// 启动时执行不涉及网络的轻量自检，失败项直接退出
+	for _, res := range doctor.Run(cfg, doctor.Options{}).Results {
+		switch res.Status {
+		case doctor.Warn:
+			logger.Warn("启动自检警告", "check", res.Name, "message", res.Message)
+		case doctor.Fail:
+			code := exitConfig
+			if res.Name == "tls" {
+				code = exitTLS
+			}
+			logger.Fatal(code, "启动自检失败", "check", res.Name, "message", res.Message)
+		}
 	}
 
+	// 设置日志和抓包中的头部脱敏策略
+	utils.ConfigureRedaction(cfg.LogRedactHeaders, cfg.LogHeaders)
+
+	// 出站连接共用的DNS缓存
+	dnscache.Configure(dnscache.Options{
+		Size:        cfg.DNSCacheSize,
+		MinTTL:      cfg.DNSMinTTL,
+		MaxTTL:      cfg.DNSMaxTTL,
+		NegativeTTL: cfg.DNSNegativeTTL,
+		Prefer:      cfg.DNSPrefer,
+		Server:      cfg.DNSServer,
+	})
+
 	logger.Info("应用启动",
 		"mode", cfg.Mode,
 		"log_level", cfg.LogLevel,
 		"log_format", cfg.LogFormat)
 
-	// 根据模式启动相应服务
-	if cfg.Mode == "server" {
+	if asService {
+		if err := runService(cfg); err != nil {
+			logger.Fatal(exitCode(err), "服务运行失败", "error", err)
+		}
+		logShutdown(exitOK, exitReasons[exitOK])
+		return
+	}
+
+	// 收到 Ctrl+C 或 SIGTERM (systemd stop) 时优雅停止
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, cfg); err != nil {
+		logger.Fatal(exitCode(err), "运行失败", "error", err)
+	}
+	logShutdown(exitOK, exitReasons[exitOK])
+}
+
+// run 根据模式启动相应服务，ctx 取消时停止服务并等待其退出
+func run(ctx context.Context, cfg *config.Config) error {
+	switch cfg.Mode {
+	case "server":
 		srv := server.NewSinglePortProxy(cfg)
 		logger.Info("启动服务器", "port", cfg.ListenPort)
-		if err := srv.Start(); err != nil {
-			logger.Fatal("服务器启动失败", "error", err)
-		}
-	} else if cfg.Mode == "client" {
+		return runUntilDone(ctx, srv.Start, func() { _ = srv.Stop() }, "服务器启动失败")
+
+	case "client":
 		cli, err := client.NewTunnelClient(cfg)
 		if err != nil {
-			logger.Fatal("创建WebSocket客户端失败", "error", err)
+			return fmt.Errorf("创建WebSocket客户端失败: %w", err)
 		}
 
 		logger.Info("启动WebSocket客户端",
@@ -75,11 +164,12 @@ func main() {
 			"target", cfg.TargetAddr,
 			"key", cfg.Key)
 
-		cli.Run()
-	} else if cfg.Mode == "http-client" {
+		return runUntilDone(ctx, cli.Run, cli.Stop, "WebSocket客户端运行失败")
+
+	case "http-client":
 		httpCli, err := client.NewHTTPTunnelClient(cfg)
 		if err != nil {
-			logger.Fatal("创建HTTP长轮询客户端失败", "error", err)
+			return fmt.Errorf("创建HTTP长轮询客户端失败: %w", err)
 		}
 
 		logger.Info("启动HTTP长轮询客户端",
@@ -87,8 +177,30 @@ func main() {
 			"target", cfg.TargetAddr,
 			"key", cfg.Key)
 
-		if err := httpCli.Run(); err != nil {
-			logger.Fatal("HTTP长轮询客户端运行失败", "error", err)
-		}
+		return runUntilDone(ctx, httpCli.Run, httpCli.Stop, "HTTP长轮询客户端运行失败")
+	}
+	return nil
+}
+
+// runUntilDone 在后台执行 start，ctx 取消时调用 stop 并等待 start 返回
+func runUntilDone(ctx context.Context, start func() error, stop func(), errPrefix string) error {
+	errCh := make(chan error, 1)
+	go func() {
+		defer recoverPanic()
+		errCh <- start()
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		logger.Info("收到停止信号，正在退出")
+		stop()
+		err = <-errCh
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", errPrefix, err)
 	}
+	logger.Info("已停止")
+	return nil
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// routesCommand 处理 singleproxy routes，检查配置文件并输出生效的路由表，不启动服务。
+// 配置验证失败时返回 1
+func routesCommand(args []string) int {
+	fs := flag.NewFlagSet("routes", flag.ContinueOnError)
+	configFile := fs.String("config", "", "配置文件路径 (为空则在常见位置查找)")
+	asJSON := fs.Bool("json", false, "以JSON输出")
+	match := fs.String("match", "", "评估一个假设的请求, e.g. \"GET https://app.example.com/foo\"")
+	key := fs.String("key", "", "假设的请求携带的 X-Tunnel-Key 头 (-match 时使用)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// 未在配置文件中设置的项使用与正常启动相同的默认值
+	base, _ := config.ParseFlagsFrom(flag.NewFlagSet("singleproxy", flag.ContinueOnError), nil)
+	base.ConfigFile = *configFile
+	cfg, err := config.LoadWithFile(*configFile, base)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "加载配置文件失败:", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "配置验证失败:", err)
+		return 1
+	}
+
+	resolver := server.NewRouteResolver(cfg)
+	var out interface{ WriteText(w io.Writer) }
+	if *match != "" {
+		header := make(http.Header)
+		if *key != "" {
+			header.Set("X-Tunnel-Key", *key)
+		}
+		m, err := resolver.Match(*match, header)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		out = m
+	} else {
+		out = resolver.Table()
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(out)
+		return 0
+	}
+	out.WriteText(os.Stdout)
+	return 0
+}
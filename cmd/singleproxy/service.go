@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"singleproxy/pkg/config"
+)
+
+// 默认服务名
+const defaultServiceName = "singleproxy"
+
+// serviceOptions service 子命令的参数
+type serviceOptions struct {
+	name       string // 服务名
+	configFile string // 配置文件绝对路径，写入服务启动参数
+	exe        string // 当前可执行文件绝对路径
+}
+
+// serviceCommand 处理 singleproxy service install|uninstall|start|stop，返回退出码
+func serviceCommand(args []string) int {
+	usage := "用法: singleproxy service install|uninstall|start|stop [-name singleproxy] [-config singleproxy.yaml]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("service "+action, flag.ContinueOnError)
+	name := fs.String("name", defaultServiceName, "服务名")
+	configFile := fs.String("config", "", "配置文件路径 (install时必填, 写入服务启动参数)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	opts := serviceOptions{name: *name}
+
+	var err error
+	switch action {
+	case "install":
+		if opts, err = resolveInstallOptions(opts, *configFile); err == nil {
+			err = installService(opts)
+		}
+	case "uninstall":
+		err = uninstallService(opts)
+	case "start":
+		err = startService(opts)
+	case "stop":
+		err = stopService(opts)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "service %s 失败: %v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+// resolveInstallOptions 将可执行文件和配置文件解析为绝对路径，服务运行时的工作目录不确定
+func resolveInstallOptions(opts serviceOptions, configFile string) (serviceOptions, error) {
+	if configFile == "" {
+		return opts, fmt.Errorf("需要使用 -config 指定配置文件")
+	}
+	abs, err := filepath.Abs(configFile)
+	if err != nil {
+		return opts, err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return opts, fmt.Errorf("无法读取配置文件: %w", err)
+	}
+	opts.configFile = abs
+
+	exe, err := os.Executable()
+	if err != nil {
+		return opts, fmt.Errorf("无法确定可执行文件路径: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	opts.exe = exe
+	return opts, nil
+}
+
+// serviceLogFile 服务模式下未配置日志文件时使用的默认路径
+func serviceLogFile(cfg *config.Config) string {
+	dir := filepath.Dir(os.Args[0])
+	if cfg.ConfigFile != "" {
+		dir = filepath.Dir(cfg.ConfigFile)
+	}
+	return filepath.Join(dir, "singleproxy.log")
+}
+
+// systemdUnit 生成指向当前可执行文件和配置文件的 systemd unit
+func systemdUnit(opts serviceOptions) string {
+	return fmt.Sprintf(`[Unit]
+Description=Single Proxy (%s)
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart=%s -config %s
+WorkingDirectory=%s
+Restart=on-failure
+RestartSec=5
+# SIGTERM 触发优雅停止：关闭监听器并通知隧道对端
+KillSignal=SIGTERM
+TimeoutStopSec=30
+LimitNOFILE=65535
+
+[Install]
+WantedBy=multi-user.target
+`, opts.name, systemdQuote(opts.exe), systemdQuote(opts.configFile), systemdQuote(filepath.Dir(opts.configFile)))
+}
+
+// systemdQuote 为包含空格的路径加引号
+func systemdQuote(s string) string {
+	if strings.ContainsAny(s, " \t\"") {
+		return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+	}
+	return s
+}
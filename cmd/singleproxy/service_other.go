@@ -0,0 +1,43 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"singleproxy/pkg/config"
+)
+
+// runningAsService 非 Windows 平台由 systemd 等直接启动进程，不需要特殊处理
+func runningAsService() bool {
+	return false
+}
+
+// runService 仅在 Windows 服务控制管理器下使用
+func runService(cfg *config.Config) error {
+	return fmt.Errorf("service mode is only supported on Windows")
+}
+
+// installService 输出 systemd unit 到标准输出，安装步骤提示输出到标准错误
+func installService(opts serviceOptions) error {
+	fmt.Print(systemdUnit(opts))
+	fmt.Fprintf(os.Stderr, `
+# 保存并启用服务:
+#   singleproxy service install -config %s > /etc/systemd/system/%s.service
+#   systemctl daemon-reload && systemctl enable --now %s
+`, opts.configFile, opts.name, opts.name)
+	return nil
+}
+
+func uninstallService(opts serviceOptions) error {
+	return fmt.Errorf("请使用: systemctl disable --now %s && rm /etc/systemd/system/%s.service", opts.name, opts.name)
+}
+
+func startService(opts serviceOptions) error {
+	return fmt.Errorf("请使用: systemctl start %s", opts.name)
+}
+
+func stopService(opts serviceOptions) error {
+	return fmt.Errorf("请使用: systemctl stop %s", opts.name)
+}
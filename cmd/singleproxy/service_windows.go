@@ -0,0 +1,165 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+)
+
+// 停止服务时等待其退出的最长时间
+const serviceStopTimeout = 30 * time.Second
+
+// runningAsService 判断当前进程是否由服务控制管理器启动
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// runService 在服务控制管理器下运行，收到停止或关机请求时优雅停止
+func runService(cfg *config.Config) error {
+	return svc.Run(defaultServiceName, &serviceHandler{cfg: cfg})
+}
+
+// serviceHandler 实现 svc.Handler
+type serviceHandler struct {
+	cfg *config.Config
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- run(ctx, h.cfg) }()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				logger.Error("服务异常退出", "error", err)
+				return false, uint32(exitCode(err))
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				logger.Info("收到服务停止请求")
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				if err := <-errCh; err != nil {
+					logger.Error("服务停止时出错", "error", err)
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// installService 注册为自动启动的 Windows 服务，配置文件路径写入启动参数
+func installService(opts serviceOptions) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("无法连接服务管理器 (需要管理员权限): %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(opts.name); err == nil {
+		s.Close()
+		return fmt.Errorf("服务 %s 已存在", opts.name)
+	}
+
+	s, err := m.CreateService(opts.name, opts.exe, mgr.Config{
+		DisplayName: "Single Proxy (" + opts.name + ")",
+		Description: "Single Proxy tunnel service, config: " + opts.configFile,
+		StartType:   mgr.StartAutomatic,
+	}, "-config", opts.configFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// 异常退出后5秒自动重启
+	_ = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+
+	fmt.Printf("服务 %s 已安装: %s -config %s\n", opts.name, opts.exe, opts.configFile)
+	return nil
+}
+
+func uninstallService(opts serviceOptions) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("无法连接服务管理器 (需要管理员权限): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(opts.name)
+	if err != nil {
+		return fmt.Errorf("服务 %s 不存在: %w", opts.name, err)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	fmt.Printf("服务 %s 已卸载\n", opts.name)
+	return nil
+}
+
+func startService(opts serviceOptions) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("无法连接服务管理器 (需要管理员权限): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(opts.name)
+	if err != nil {
+		return fmt.Errorf("服务 %s 不存在: %w", opts.name, err)
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+// stopService 发送停止请求并等待服务进入已停止状态
+func stopService(opts serviceOptions) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("无法连接服务管理器 (需要管理员权限): %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(opts.name)
+	if err != nil {
+		return fmt.Errorf("服务 %s 不存在: %w", opts.name, err)
+	}
+	defer s.Close()
+
+	st, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for st.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("等待服务 %s 停止超时", opts.name)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if st, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"singleproxy/pkg/doctor"
+)
+
+// smokeCommand 处理 singleproxy test，以公网用户身份请求已注册的隧道，失败时返回非零退出码
+func smokeCommand(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var opts doctor.SmokeOptions
+	fs.StringVar(&opts.Server, "server", "", "服务器公网地址, e.g. https://example.com")
+	fs.StringVar(&opts.Key, "key", "", "隧道key (通过 X-Tunnel-Key 头路由)")
+	fs.StringVar(&opts.Path, "path", "/", "请求路径, e.g. /healthz")
+	fs.StringVar(&opts.Host, "host", "", "覆盖 Host 头, 测试主机名绑定时使用")
+	fs.BoolVar(&opts.Insecure, "insecure", false, "跳过服务器证书验证")
+	fs.DurationVar(&opts.Timeout, "timeout", 10*time.Second, "请求超时")
+	fs.BoolVar(&opts.TunnelSide, "tunnel-side", false, "同时要求已连接的客户端检查能否访问目标服务 (需要 -admin-token)")
+	fs.StringVar(&opts.AdminToken, "admin-token", "", "管理API令牌 (-tunnel-side 时使用)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.Server == "" {
+		fmt.Fprintln(os.Stderr, "用法: singleproxy test -server https://example.com -key mykey [-path /healthz] [-tunnel-side -admin-token TOKEN]")
+		return 2
+	}
+
+	report := doctor.Smoke(opts)
+	report.Write(os.Stdout)
+	if report.Failed() {
+		return 1
+	}
+	return 0
+}
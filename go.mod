@@ -8,4 +8,6 @@ require (
 	golang.org/x/time v0.14.0
 )
 
-require gopkg.in/yaml.v2 v2.4.0 // indirect
+require gopkg.in/yaml.v2 v2.4.0
+
+require golang.org/x/sys v0.33.0
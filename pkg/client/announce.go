@@ -0,0 +1,64 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+)
+
+// announcePublicURL 根据注册响应打印公网访问地址及示例命令
+func (c *TunnelClient) announcePublicURL(header http.Header) {
+	c.publicBase = c.derivePublicBase(header.Get(protocol.HeaderPublicURL))
+	publicURL := strings.TrimSuffix(c.publicBase.String(), "/")
+
+	logger.Info(fmt.Sprintf("Public URL: %s (routes to %s)", publicURL, c.targetAddr),
+		"key", c.key,
+		"route", header.Get(protocol.HeaderRoute))
+
+	if header.Get(protocol.HeaderRoute) != protocol.RouteDefault {
+		logger.Info(fmt.Sprintf("Example: curl -H '%s: %s' %s/", protocol.HeaderTunnelKey, c.key, publicURL))
+	}
+}
+
+// derivePublicBase 优先使用服务器告知的对外地址，否则从服务器地址推导 (ws->http, wss->https)
+func (c *TunnelClient) derivePublicBase(advertised string) *url.URL {
+	if advertised != "" {
+		if u, err := url.Parse(advertised); err == nil && u.Host != "" {
+			return u
+		}
+		logger.Warn("Ignoring invalid public URL from server", "public_url", advertised)
+	}
+
+	u := *c.serverAddr
+	if u.Scheme == "wss" {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	u.RawQuery = ""
+	return &u
+}
+
+// bindingURL 返回已授予绑定对应的公网地址
+func bindingURL(base *url.URL, b protocol.Binding) string {
+	if base == nil {
+		return ""
+	}
+	switch b.Type {
+	case protocol.BindTypeHost:
+		host := b.Host
+		if port := base.Port(); port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		return base.Scheme + "://" + host
+	case protocol.BindTypePort:
+		return base.Scheme + "://" + net.JoinHostPort(base.Hostname(), strconv.Itoa(b.Port))
+	}
+	return ""
+}
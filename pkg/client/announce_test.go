@@ -0,0 +1,47 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+
+	"singleproxy/pkg/protocol"
+)
+
+func TestDerivePublicBase(t *testing.T) {
+	tests := []struct {
+		server     string
+		advertised string
+		want       string
+	}{
+		{server: "wss://tunnel.example.com", want: "https://tunnel.example.com"},
+		{server: "ws://127.0.0.1:8080/tunnel", want: "http://127.0.0.1:8080/tunnel"},
+		{server: "wss://internal:8443", advertised: "https://app.example.com", want: "https://app.example.com"},
+		{server: "wss://internal:8443", advertised: "not a url", want: "https://internal:8443"},
+	}
+
+	for _, tt := range tests {
+		serverURL, _ := url.Parse(tt.server)
+		c := &TunnelClient{serverAddr: serverURL}
+		if got := c.derivePublicBase(tt.advertised).String(); got != tt.want {
+			t.Errorf("derivePublicBase(%q, %q) = %q, want %q", tt.server, tt.advertised, got, tt.want)
+		}
+	}
+}
+
+func TestBindingURL(t *testing.T) {
+	base, _ := url.Parse("https://tunnel.example.com:8443")
+
+	host := bindingURL(base, protocol.Binding{Type: protocol.BindTypeHost, Host: "app.example.com"})
+	if host != "https://app.example.com:8443" {
+		t.Errorf("Unexpected host binding URL: %s", host)
+	}
+
+	port := bindingURL(base, protocol.Binding{Type: protocol.BindTypePort, Port: 2222})
+	if port != "https://tunnel.example.com:2222" {
+		t.Errorf("Unexpected port binding URL: %s", port)
+	}
+
+	if bindingURL(nil, protocol.Binding{Type: protocol.BindTypePort, Port: 2222}) != "" {
+		t.Error("Expected empty URL without base")
+	}
+}
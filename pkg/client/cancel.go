@@ -0,0 +1,146 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/utils"
+
+	"golang.org/x/time/rate"
+)
+
+// 中止事件通知目标服务的速率上限，大量用户同时断开时多余的事件只记录日志
+const (
+	abortEventRate  = 10
+	abortEventBurst = 20
+)
+
+// inflightRequest 正在处理的请求，收到 MSG_TYPE_CANCEL 时取消
+type inflightRequest struct {
+	start  time.Time
+	method string
+	url    string
+	cancel context.CancelFunc
+}
+
+// abortEvent 中止事件，以 JSON POST 到目标服务的 AbortWebhook 路径
+type abortEvent struct {
+	RequestID uint64 `json:"request_id"`
+	Reason    string `json:"reason"`
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// trackRequest 登记正在处理的请求，返回的 context 在公网请求中止时取消
+func (c *TunnelClient) trackRequest(requestID uint64, req *http.Request) context.Context {
+	ctx, cancel := context.WithCancel(req.Context())
+	c.inflightMu.Lock()
+	c.inflight[requestID] = &inflightRequest{
+		start:  time.Now(),
+		method: req.Method,
+		url:    utils.SanitizeURL(req.URL),
+		cancel: cancel,
+	}
+	c.inflightMu.Unlock()
+	return ctx
+}
+
+// untrackRequest 请求处理结束后注销
+func (c *TunnelClient) untrackRequest(requestID uint64) {
+	c.inflightMu.Lock()
+	r, ok := c.inflight[requestID]
+	delete(c.inflight, requestID)
+	c.inflightMu.Unlock()
+	if ok {
+		r.cancel()
+	}
+}
+
+// handleCancel 处理服务器发来的中止通知：记录日志、停止转发，并按配置通知目标服务
+func (c *TunnelClient) handleCancel(msg protocol.TunnelMessage) {
+	reason := string(msg.Payload)
+	c.inflightMu.Lock()
+	r, ok := c.inflight[msg.ID]
+	c.inflightMu.Unlock()
+	if !ok {
+		logger.Debug("Received cancel for finished request",
+			"key", c.key,
+			"request_id", msg.ID,
+			"reason", reason)
+		return
+	}
+
+	elapsed := time.Since(r.start)
+	canceledRequestsCounter.Inc()
+	logger.Info("Public request aborted",
+		"key", c.key,
+		"request_id", msg.ID,
+		"reason", reason,
+		"elapsed", elapsed,
+		"method", r.method,
+		"url", r.url)
+	r.cancel()
+
+	if c.abortWebhook == "" {
+		return
+	}
+	if !c.abortLimiter.Allow() {
+		droppedAbortEventsCounter.Inc()
+		return
+	}
+	go c.postAbortEvent(abortEvent{
+		RequestID: msg.ID,
+		Reason:    reason,
+		Method:    r.method,
+		URL:       r.url,
+		ElapsedMs: elapsed.Milliseconds(),
+	})
+}
+
+// postAbortEvent 将中止事件 POST 到目标服务
+func (c *TunnelClient) postAbortEvent(event abortEvent) {
+	body, _ := json.Marshal(event)
+	req, err := http.NewRequest(http.MethodPost, "http://"+c.targetAddr+c.abortWebhook, bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("Failed to build abort event request",
+			"key", c.key,
+			"request_id", event.RequestID,
+			"error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.requestIDHeader != "" {
+		req.Header.Set(c.requestIDHeader, strconv.FormatUint(event.RequestID, 10))
+	}
+
+	resp, err := c.forwardToTarget(req)
+	if err != nil {
+		logger.Warn("Failed to deliver abort event to target",
+			"key", c.key,
+			"request_id", event.RequestID,
+			"webhook", c.abortWebhook,
+			"error", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warn("Target rejected abort event",
+			"key", c.key,
+			"request_id", event.RequestID,
+			"webhook", c.abortWebhook,
+			"status_code", resp.StatusCode)
+	}
+}
+
+func newAbortLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(abortEventRate), abortEventBurst)
+}
@@ -2,10 +2,21 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"singleproxy/pkg/config"
@@ -14,22 +25,122 @@ import (
 	"singleproxy/pkg/utils"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// tunnelReadTimeout 超过该时间没有收到任何消息或pong时断开连接
+	tunnelReadTimeout          = 90 * time.Second
+	defaultKeepAliveInterval   = 15 * time.Second
+	defaultWriteSegmentTimeout = 30 * time.Second
+	// writeSegmentSize 单次写入 gorilla 的最大字节数，段之间可以插入ping
+	writeSegmentSize = 32 * 1024
+	// maxWriteBufferSize 写缓冲区上限，gorilla 按写缓冲区大小切分数据帧
+	maxWriteBufferSize = 64 * 1024
+	// responseChunkSize 响应体数据块的数据大小，协商的消息上限更小时以上限为准
+	responseChunkSize = 32 * 1024
+)
+
+// Run 因以下原因停止重连时返回的错误包装了对应的哨兵错误，调用方据此区分进程退出码
+var (
+	// ErrRegistrationRejected 服务器以 400/401/403 拒绝注册，例如key不符合服务器的格式要求，重试也不会成功
+	ErrRegistrationRejected = errors.New("registration rejected by server")
+	// ErrMaxReconnects 连续连接失败达到 -max-reconnects
+	ErrMaxReconnects = errors.New("max reconnect attempts reached")
 )
 
 // TunnelClient 是客户端组件
 type TunnelClient struct {
 	serverAddr *url.URL
-	targetAddr string
-	key        string
-	wsConn     *websocket.Conn
-	tlsConfig  *tls.Config
-	writeChan  chan []byte
-	closeChan  chan struct{}
+	// 配置的服务器地址，重定向后的地址连接失败时回到这里
+	originalAddr *url.URL
+	// 接受服务器重定向的地址模式 (-redirect-allow)
+	redirectAllow []string
+	targetAddr    string
+	// 与目标服务之间的协议 (h1、h2c 或 auto)
+	targetProtocol string
+	key            string
+	autoKey        bool // 由服务器分配key
+	bindings       []protocol.Binding
+	publicBase     *url.URL // 服务器对外访问地址
+	tlsConfig      *tls.Config
+	wsReadBuf      int // WebSocket 读写缓冲区大小 (0为默认)
+	wsWriteBuf     int
+	// 当前的隧道会话，每次连接成功后替换
+	session atomic.Pointer[session]
+
+	keepAliveInterval time.Duration
+	// 单段数据的写入超时，大消息分段写入，每段单独计时
+	writeSegmentTimeout time.Duration
+	// 建立到服务器的TCP连接，为nil时使用默认拨号
+	netDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// 并发请求上限，在 readLoop 启动请求协程前获取
+	requestSem     chan struct{}
+	activeRequests atomic.Int64
+	metricsListen  string
+
+	// 单个连接允许的未知类型消息数
+	maxUnknownMessages int
+
+	// 消息签名: 配置的共享密钥、允许的校验失败次数，是否启用见 session.messageAuth
+	messageAuthKey  []byte
+	maxAuthFailures int
+
+	// 小于该大小的响应合并为一条完整消息 (负数表示总是流式发送)
+	fullResponseThreshold int
+
+	// 合并目标服务响应体的小读取，累计达到该字节数或等待 chunkCoalesceDelay 后发送一个数据块 (0表示每次读取发送一个)
+	chunkCoalesceBytes int
+	chunkCoalesceDelay time.Duration
+
+	// 是否在客户端跟随目标服务的重定向，以及原样返回时 Location 的改写规则 (未配置时为nil)
+	followRedirects bool
+	locationRewrite *locationRewrite
+
+	// 注册时声明的单条消息大小上限，实际上限为与服务器协商的结果 (见 session.maxFrameSize)
+	maxFrameSize int
 
 	// 连接健康状态监控
-	lastPingTime   time.Time
-	lastPongTime   time.Time
 	reconnectCount int
+	// 连续连接失败达到该次数时 Run 返回 ErrMaxReconnects (0为一直重试)
+	maxReconnects int
+
+	// 正在处理的请求，公网请求中止时由 MSG_TYPE_CANCEL 取消
+	inflightMu      sync.Mutex
+	inflight        map[uint64]*inflightRequest
+	abortWebhook    string
+	requestIDHeader string
+	abortLimiter    *rate.Limiter
+
+	// 服务器转发的请求头部超出限制时以431拒绝，不转发给目标服务
+	headerLimits protocol.HeaderLimits
+
+	// 同一key有多个客户端时的负载均衡权重 (0为服务器默认)
+	weight int
+	// 目标服务是否不可用，变化时通知服务器
+	targetDown atomic.Bool
+
+	// 服务器要求的重连等待时间 (来自 1013 关闭原因或 Retry-After 头)
+	retryAfter atomic.Int64
+	// MSG_TYPE_GOAWAY 中通过 -redirect-allow 检查的备用服务器地址，下次重连前替换 serverAddr
+	redirect atomic.Pointer[url.URL]
+
+	// 注册前等待目标服务可用 (未启用时为nil)
+	targetWaiter *targetWaiter
+
+	// 本地监听地址 (-local-listen) 和本地请求默认携带的key (-local-key，为空时使用 key)，
+	// 本地请求ID从 nextLocalID 递增并设置 protocol.LocalRequestIDFlag
+	localListen string
+	localKey    string
+	nextLocalID atomic.Uint64
+
+	// 实例ID，转发到目标服务前写入 X-SingleProxy-Hop 用于检测代理环路
+	instanceID string
+
+	// Stop 关闭 stopChan 通知 Run 断开连接并返回
+	stopChan chan struct{}
+	stopOnce sync.Once
 }
 
 // NewTunnelClient 创建一个新的客户端实例
@@ -42,75 +153,275 @@ func NewTunnelClient(config *config.Config) (*TunnelClient, error) {
 		return nil, fmt.Errorf("server address scheme must be 'ws' or 'wss'")
 	}
 
+	bindings := make([]protocol.Binding, 0, len(config.Bindings))
+	for _, s := range config.Bindings {
+		b, err := protocol.ParseBinding(s)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, b)
+	}
+
 	tlsConfig := &tls.Config{InsecureSkipVerify: config.Insecure}
 
+	key := config.Key
+	if config.AutoKey {
+		// key 将在首次注册时由服务器分配
+		key = ""
+	} else if key != "" {
+		// 空key留给服务器在注册时拒绝
+		keyValidator, err := protocol.NewKeyValidator(config.KeyPattern)
+		if err != nil {
+			return nil, err
+		}
+		if err := keyValidator.Validate(key); err != nil {
+			return nil, err
+		}
+	}
+	if config.LocalKey != "" {
+		keyValidator, err := protocol.NewKeyValidator(config.KeyPattern)
+		if err != nil {
+			return nil, err
+		}
+		if err := keyValidator.Validate(config.LocalKey); err != nil {
+			return nil, fmt.Errorf("invalid local key: %w", err)
+		}
+	}
+
+	maxConcurrent := config.MaxConcurrentRequests
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentRequests
+	}
+	fullThreshold := config.FullResponseThreshold
+	if fullThreshold == 0 {
+		fullThreshold = defaultFullResponseThreshold
+	}
+	// 超出范围的 -max-frame-size 会被限制到支持的范围内，提示实际使用的值
+	if n := config.MaxFrameSize; n > 0 && protocol.ClampFrameSize(n) != n {
+		logger.Warn("Configured max frame size is outside the supported range, using the nearest supported value",
+			"max_frame_size", n,
+			"effective_max_frame_size", protocol.ClampFrameSize(n),
+			"min_frame_size", protocol.MinFrameSize,
+			"max_frame_size_limit", protocol.MaxFrameSizeLimit)
+	}
+	targetProtocol := config.TargetProtocol
+	if targetProtocol == "" {
+		targetProtocol = utils.TargetProtocolAuto
+	}
+	maxUnknown := config.MaxUnknownMessages
+	if maxUnknown <= 0 {
+		maxUnknown = protocol.DefaultMaxUnknownMessages
+	}
+	maxAuthFailures := config.MessageAuthMaxFailures
+	if maxAuthFailures <= 0 {
+		maxAuthFailures = protocol.DefaultMaxAuthFailures
+	}
+	var messageAuthKey []byte
+	if config.MessageAuthKey != "" {
+		messageAuthKey = []byte(config.MessageAuthKey)
+	}
+
 	return &TunnelClient{
-		serverAddr: serverURL,
-		targetAddr: config.TargetAddr,
-		key:        config.Key,
-		tlsConfig:  tlsConfig,
-		writeChan:  make(chan []byte, 256),
-		// closeChan 将在连接时创建
+		serverAddr:    serverURL,
+		originalAddr:  serverURL,
+		redirectAllow: config.RedirectAllow,
+		targetAddr:    config.TargetAddr,
+		key:           key,
+		autoKey:       config.AutoKey,
+		bindings:      bindings,
+		tlsConfig:     tlsConfig,
+		wsReadBuf:     config.WSReadBufferSize,
+		wsWriteBuf:    config.WSWriteBufferSize,
+		requestSem:    make(chan struct{}, maxConcurrent),
+		metricsListen: config.MetricsListen,
+
+		maxUnknownMessages:    maxUnknown,
+		messageAuthKey:        messageAuthKey,
+		maxAuthFailures:       maxAuthFailures,
+		fullResponseThreshold: fullThreshold,
+		chunkCoalesceBytes:    config.ChunkCoalesceBytes,
+		chunkCoalesceDelay:    config.ChunkCoalesceDelay,
+		maxFrameSize:          protocol.ClampFrameSize(config.MaxFrameSize),
+		weight:                config.Weight,
+		maxReconnects:         config.MaxReconnects,
+		targetProtocol:        targetProtocol,
+		followRedirects:       config.FollowTargetRedirects,
+		locationRewrite:       newLocationRewrite(config.TargetLocationRewrite),
+		inflight:              make(map[uint64]*inflightRequest),
+		abortWebhook:          config.AbortWebhook,
+		requestIDHeader:       config.RequestIDHeader,
+		headerLimits:          protocol.NewHeaderLimits(config.MaxHeaderCount, config.MaxHeaderFieldBytes, config.MaxHeaderBytes),
+		abortLimiter:          newAbortLimiter(),
+		instanceID:            protocol.NewInstanceID(),
+		targetWaiter:          newTargetWaiter(config),
+		localListen:           config.LocalListen,
+		localKey:              config.LocalKey,
+		stopChan:              make(chan struct{}),
+		keepAliveInterval:     defaultKeepAliveInterval,
+		writeSegmentTimeout:   defaultWriteSegmentTimeout,
 	}, nil
 }
 
-// writer 是唯一的写入器，通过 channel 接收所有待发送的数据
-func (c *TunnelClient) writer() {
-	defer c.wsConn.Close()
+// Stop 通知 Run 以正常关闭 (1000) 断开当前连接并停止重连
+func (c *TunnelClient) Stop() {
+	c.stopOnce.Do(func() { close(c.stopChan) })
+}
+
+// sleepOrStop 等待指定时间，期间调用 Stop 时返回 false
+func (c *TunnelClient) sleepOrStop(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.stopChan:
+		return false
+	}
+}
+
+// Key 返回当前使用的隧道key (自动分配时在首次注册成功后可用)
+func (c *TunnelClient) Key() string {
+	return c.key
+}
+
+// ActiveRequests 返回正在处理的隧道请求数
+func (c *TunnelClient) ActiveRequests() int64 {
+	return c.activeRequests.Load()
+}
+
+// writer 是会话唯一的写入器，通过 channel 接收所有待发送的数据和ping请求
+func (c *TunnelClient) writer(s *session) {
+	defer s.conn.Close()
 
 	for {
 		select {
-		case message := <-c.writeChan:
-			if err := c.wsConn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+		case message := <-s.writeChan:
+			if message == nil {
+				// handleGoAway 的断开请求排在已入队的响应之后，保证响应完整发出
+				logger.Info("Drain complete, closing tunnel connection",
+					"key", c.key)
+				_ = s.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, protocol.CloseReasonClientDraining),
+					time.Now().Add(time.Second))
+				return
+			}
+			if s.messageAuth {
+				message = s.authOut.Sign(message)
+			}
+			if err := c.writeTunnelMessage(s, message); err != nil {
 				logger.Error("Error writing to WebSocket",
 					"key", c.key,
+					"message_size", len(message),
 					"error", err)
 				return
 			}
-		case <-c.closeChan:
+		case <-s.pingChan:
+			if err := c.writePing(s); err != nil {
+				return
+			}
+		case <-s.closeChan:
 			return
 		}
 	}
 }
 
-// readLoop 是唯一的读取器，处理来自服务器的所有消息 (修改版)
-func (c *TunnelClient) readLoop() {
+// writeTunnelMessage 将一条隧道消息分段写入。gorilla 按写缓冲区大小切分数据帧，
+// 段之间处理待发送的ping，慢速上行链路上传输大响应时ping也能按时到达服务器
+func (c *TunnelClient) writeTunnelMessage(s *session, message []byte) error {
+	w, err := s.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	for len(message) > 0 {
+		n := min(len(message), writeSegmentSize)
+		_ = s.conn.SetWriteDeadline(time.Now().Add(c.writeSegmentTimeout))
+		if _, err := w.Write(message[:n]); err != nil {
+			return err
+		}
+		message = message[n:]
+		if len(message) == 0 {
+			break
+		}
+		select {
+		case <-s.pingChan:
+			if err := c.writePing(s); err != nil {
+				return err
+			}
+		default:
+		}
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(c.writeSegmentTimeout))
+	return w.Close()
+}
+
+// writePing 发送ping，只在 writer 协程中调用
+func (c *TunnelClient) writePing(s *session) error {
+	if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+		logger.Error("Keep-alive failed",
+			"key", c.key,
+			"error", err)
+		return err
+	}
+	logger.Debug("Sent ping to server",
+		"key", c.key)
+	return nil
+}
+
+// readLoop 是会话唯一的读取器，处理来自服务器的所有消息，退出时关闭会话
+func (c *TunnelClient) readLoop(s *session) {
 	logger.Info("Starting client read loop",
 		"key", c.key,
 		"server_addr", c.serverAddr.String(),
-		"target_addr", c.targetAddr)
+		"target_addr", c.targetAddr,
+		"target_protocol", c.targetProtocol)
 
 	defer func() {
 		logger.Info("Exiting client read loop",
 			"key", c.key)
-		close(c.closeChan) // 通知 writer 和 keepAlive 退出
+		s.close() // 通知 writer、keepAlive 和请求处理协程退出
 	}()
 
-	c.wsConn.SetReadLimit(10 * 1024 * 1024)
+	// 读取上限由 readMessage 按消息检查，超限的消息只影响它所属的请求，不使用 SetReadLimit 断开连接
 	// 增加读取超时时间，避免过早断开连接
-	readTimeout := 90 * time.Second
-	_ = c.wsConn.SetReadDeadline(time.Now().Add(readTimeout))
+	_ = s.conn.SetReadDeadline(time.Now().Add(tunnelReadTimeout))
 
 	logger.Debug("Set WebSocket read configuration",
 		"key", c.key,
-		"read_limit", "10MB",
-		"read_timeout", readTimeout)
+		"read_limit", s.maxFrameSize,
+		"read_timeout", tunnelReadTimeout)
 
-	c.wsConn.SetPongHandler(func(string) error {
-		c.lastPongTime = time.Now()
-		_ = c.wsConn.SetReadDeadline(time.Now().Add(readTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		now := time.Now()
+		s.markPong(now)
+		_ = s.conn.SetReadDeadline(now.Add(tunnelReadTimeout))
 		logger.Debug("Received pong from server, connection healthy",
 			"key", c.key,
-			"last_pong_time", c.lastPongTime)
+			"last_pong_time", now)
 		return nil
 	})
 
+	unknownCount := 0
+	authFailures := 0
 	messageCount := 0
 	for {
-		_, data, err := c.wsConn.ReadMessage()
+		data, err := s.readMessage()
+		var tooLarge *protocol.FrameTooLargeError
+		if errors.As(err, &tooLarge) {
+			if !c.handleOversizedFrame(s, tooLarge) {
+				return
+			}
+			continue
+		}
 		if err != nil {
 			// 区分不同的错误类型提供更详细的日志
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == websocket.CloseTryAgainLater {
+				wait, _ := protocol.ParseRetryAfterReason(closeErr.Text)
+				c.retryAfter.Store(int64(wait))
+				logger.Warn("Server asked to retry later",
+					"key", c.key,
+					"reason", closeErr.Text,
+					"retry_after", wait)
+			} else if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				logger.Info("WebSocket connection closed normally",
 					"key", c.key,
 					"error", err,
@@ -135,6 +446,29 @@ func (c *TunnelClient) readLoop() {
 			"message_size", len(data),
 			"total_messages", messageCount)
 
+		if s.messageAuth {
+			if data, err = s.authIn.Verify(data); err != nil {
+				authFailures++
+				messageAuthFailuresCounter.Inc()
+				logger.Warn("Dropping tunnel message with invalid signature",
+					"key", c.key,
+					"auth_failures", authFailures,
+					"error", err)
+				if authFailures >= c.maxAuthFailures {
+					// 消息被篡改或路由错误，以协议错误关闭并交由重连逻辑处理
+					logger.Error("Too many tunnel messages with invalid signature, closing connection",
+						"key", c.key,
+						"auth_failures", authFailures)
+					_ = s.conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.CloseReasonMessageAuthFailed),
+						time.Now().Add(time.Second))
+					return
+				}
+				continue
+			}
+		}
+
+		// data 在下一次读取时被覆盖，反序列化时复制 Payload，消息可以安全地交给请求处理协程
 		msg, err := protocol.DeserializeTunnelMessage(data)
 		if err != nil {
 			logger.Error("Failed to deserialize tunnel message",
@@ -150,276 +484,630 @@ func (c *TunnelClient) readLoop() {
 			"message_type", msg.Type,
 			"payload_size", len(msg.Payload))
 
-		if msg.Type == protocol.MSG_TYPE_HTTP_REQ {
+		switch msg.Type {
+		case protocol.MSG_TYPE_HTTP_REQ:
+			// 请求头在读取协程中按收到的顺序还原，动态表才能与服务器保持一致
+			if s.headerDecoder != nil {
+				if msg.Payload, err = s.headerDecoder.Decode(msg.Payload); err != nil {
+					// 无法还原后续请求，以协议错误关闭，重连后双方从空表开始
+					logger.Error("Failed to decode request headers, closing connection",
+						"key", c.key,
+						"request_id", msg.ID,
+						"error", err)
+					_ = s.conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.CloseReasonHeaderTable),
+						time.Now().Add(time.Second))
+					return
+				}
+			}
 			logger.Debug("Processing HTTP request",
 				"key", c.key,
 				"request_id", msg.ID,
 				"payload_size", len(msg.Payload))
-			// 将完整的消息（包含ID）传递给处理函数
-			go c.handleHTTPRequest(msg)
+			// 在启动协程前获取并发配额，保证协程数量有真实上限
+			select {
+			case c.requestSem <- struct{}{}:
+				c.activeRequests.Add(1)
+				activeRequestsGauge.Inc()
+				requestsCounter.Inc()
+				go c.handleHTTPRequest(s, msg)
+			default:
+				rejectedRequestsCounter.Inc()
+				logger.Warn("Concurrent request limit reached, rejecting request",
+					"key", c.key,
+					"request_id", msg.ID,
+					"limit", cap(c.requestSem))
+				c.rejectRequest(s, msg.ID, http.StatusServiceUnavailable)
+			}
+		case protocol.MSG_TYPE_BIND_RES:
+			c.handleBindResponse(msg)
+		case protocol.MSG_TYPE_CANCEL:
+			if protocol.IsLocalRequestID(msg.ID) {
+				// 服务器转发本地请求的响应中途失败
+				s.deliverLocal(msg)
+			} else {
+				c.handleCancel(msg)
+			}
+		case protocol.MSG_TYPE_LOCAL_RES, protocol.MSG_TYPE_LOCAL_RES_CHUNK:
+			if !s.deliverLocal(msg) {
+				logger.Debug("Dropping response for finished local request",
+					"key", c.key,
+					"request_id", msg.ID,
+					"message_type", msg.Type)
+			}
+		case protocol.MSG_TYPE_TARGET_CHECK:
+			go c.handleTargetCheck(s, msg)
+		case protocol.MSG_TYPE_GOAWAY:
+			go c.handleGoAway(s, msg)
+		default:
+			unknownCount++
+			unknownMessagesCounter.Inc()
+			logger.Warn("Received unknown message type from server",
+				"key", c.key,
+				"message_id", msg.ID,
+				"message_type", msg.Type,
+				"unknown_count", unknownCount)
+			if unknownCount >= c.maxUnknownMessages {
+				// 认为对端协议不兼容，以协议错误关闭并交由重连逻辑处理
+				logger.Error("Too many unknown message types, closing incompatible connection",
+					"key", c.key,
+					"unknown_count", unknownCount)
+				_ = s.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.CloseReasonUnknownMessages),
+					time.Now().Add(time.Second))
+				return
+			}
 		}
 	}
 }
 
-// handleHTTPRequest 处理单个HTTP请求 (流式传输版 - 修复竞态条件)
-func (c *TunnelClient) handleHTTPRequest(reqMsg protocol.TunnelMessage) {
+// requestBindings 向服务器申请配置的公网绑定
+func (c *TunnelClient) requestBindings(s *session) {
+	if len(c.bindings) == 0 {
+		return
+	}
+
+	payload, err := protocol.EncodeBindRequest(protocol.BindRequest{Bindings: c.bindings})
+	if err != nil {
+		logger.Error("Failed to encode bind request",
+			"key", c.key,
+			"error", err)
+		return
+	}
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{Type: protocol.MSG_TYPE_BIND_REQ, Payload: payload})
+
+	if s.send(data) {
+		logger.Info("Requested public bindings",
+			"key", c.key,
+			"bindings", len(c.bindings))
+	}
+}
+
+// handleBindResponse 记录服务器对绑定申请的处理结果
+func (c *TunnelClient) handleBindResponse(msg protocol.TunnelMessage) {
+	resp, err := protocol.DecodeBindResponse(msg.Payload)
+	if err != nil {
+		logger.Error("Failed to decode bind response",
+			"key", c.key,
+			"error", err)
+		return
+	}
+
+	for _, result := range resp.Results {
+		if result.Granted {
+			logger.Info("Public binding granted",
+				"key", c.key,
+				"binding", result.Binding.String())
+			if u := bindingURL(c.publicBase, result.Binding); u != "" {
+				logger.Info(fmt.Sprintf("Public URL: %s (routes to %s)", u, c.targetAddr))
+			}
+		} else {
+			logger.Warn("Public binding refused",
+				"key", c.key,
+				"binding", result.Binding.String(),
+				"reason", result.Reason)
+		}
+	}
+}
+
+// forwardToTarget 按配置的协议和重定向策略转发请求到目标服务，并按实际使用的协议计数
+func (c *TunnelClient) forwardToTarget(req *http.Request) (*http.Response, error) {
+	resp, err := utils.ForwardToTargetProtocol(req, c.targetAddr, c.targetProtocol, c.followRedirects)
+	if err != nil {
+		return nil, err
+	}
+	c.locationRewrite.apply(resp.Header)
+	utils.RemoveResponseHopByHop(resp.Header)
+	if resp.ProtoMajor == 2 {
+		targetHTTP2ResponsesCounter.Inc()
+	} else {
+		targetHTTP1ResponsesCounter.Inc()
+	}
+	return resp, nil
+}
+
+// handleHTTPRequest 处理单个HTTP请求 (流式传输版 - 修复竞态条件)。
+// 处理协程带有key和请求ID的 pprof 标签，不继承读取循环的标签
+func (c *TunnelClient) handleHTTPRequest(s *session, reqMsg protocol.TunnelMessage) {
+	defer func() {
+		<-c.requestSem
+		c.activeRequests.Add(-1)
+		activeRequestsGauge.Dec()
+	}()
+
+	pprof.Do(context.Background(), utils.RequestProfileLabels(c.key, reqMsg.ID, "forward"), func(ctx context.Context) {
+		c.serveHTTPRequest(ctx, s, reqMsg)
+	})
+}
+
+// serveHTTPRequest 转发请求到目标服务并把响应发回服务器，ctx 是请求的上下文
+func (c *TunnelClient) serveHTTPRequest(ctx context.Context, s *session, reqMsg protocol.TunnelMessage) {
 	startTime := time.Now()
 	logger.Debug("Starting HTTP request processing",
 		"key", c.key,
 		"request_id", reqMsg.ID,
 		"payload_size", len(reqMsg.Payload))
 
-	req, err := protocol.ParseHTTPRequest(reqMsg.Payload)
+	req, err := protocol.ParseHTTPRequest(reqMsg.Payload, c.headerLimits)
 	if err != nil {
-		logger.Error("Failed to parse HTTP request",
-			"key", c.key,
-			"request_id", reqMsg.ID,
+		logger.RequestLogger(logger.TransportWebSocket, c.key, reqMsg.ID, "", "").Error("Failed to parse HTTP request",
 			"error", err)
+		var limitErr *protocol.HeaderLimitError
+		if errors.As(err, &limitErr) {
+			c.rejectRequest(s, reqMsg.ID, http.StatusRequestHeaderFieldsTooLarge)
+		}
 		return
 	}
 
-	logger.Debug("Parsed HTTP request",
-		"key", c.key,
-		"request_id", reqMsg.ID,
-		"method", req.Method,
-		"url", req.URL.String(),
+	rl := logger.RequestLogger(logger.TransportWebSocket, c.key, reqMsg.ID, req.Method, req.URL.Path)
+	rl.Debug("Parsed HTTP request",
 		"target_addr", c.targetAddr,
 		"content_length", req.ContentLength,
-		"headers", utils.SanitizeHeaders(req.Header))
+		"headers", utils.LazyHeaders(req.Header))
+	if !checkProxyLoop(rl, req, c.instanceID, c.targetAddr) {
+		c.rejectRequest(s, reqMsg.ID, http.StatusLoopDetected)
+		return
+	}
+
+	// 公网请求中止时取消对目标服务的转发
+	ctx = c.trackRequest(reqMsg.ID, req.WithContext(ctx))
+	defer c.untrackRequest(reqMsg.ID)
+	// 公网调用方声明了超时时，服务器届时已放弃该请求，目标服务的调用随之取消
+	if timeout, ok := protocol.ParseRequestTimeout(req.Header.Get(protocol.HeaderRequestTimeout)); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+	if c.requestIDHeader != "" {
+		req.Header.Set(c.requestIDHeader, strconv.FormatUint(reqMsg.ID, 10))
+	}
+
+	// 转发目标服务的 1xx 临时响应。回调在收到最终响应前同步执行，临时响应总是先于响应头入队；
+	// 100 Continue 已由服务器在读取公网请求体时发送，不再重复
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code != http.StatusContinue {
+				c.sendInterimResponse(s, reqMsg.ID, code, http.Header(header))
+			}
+			return nil
+		},
+	}))
 
 	forwardStart := time.Now()
-	resp, err := utils.ForwardToTarget(req, c.targetAddr)
+	resp, err := c.forwardToTarget(req)
 	forwardDuration := time.Since(forwardStart)
+	if ctx.Err() != nil {
+		// 公网请求已中止，服务器不再需要响应
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return
+	}
+	c.observeTarget(err)
 
 	if err != nil {
-		logger.Error("Failed to forward request to target",
-			"key", c.key,
-			"request_id", reqMsg.ID,
+		kind := classifyTargetError(err)
+		rl.Error("Failed to forward request to target",
 			"target_addr", c.targetAddr,
-			"method", req.Method,
-			"url", req.URL.String(),
 			"duration", forwardDuration,
+			"target_error", kind,
 			"error", err)
+		// 立即返回错误，服务器无需等到请求超时
+		c.rejectTargetError(s, reqMsg.ID, kind)
 		return
 	}
 
-	logger.Debug("Successfully forwarded request to target",
-		"key", c.key,
-		"request_id", reqMsg.ID,
+	rl.Debug("Successfully forwarded request to target",
 		"target_addr", c.targetAddr,
-		"method", req.Method,
-		"url", req.URL.String(),
-		"status", resp.Status,
-		"status_code", resp.StatusCode,
+		"status", resp.StatusCode,
+		"proto", resp.Proto,
+		"content_length", resp.ContentLength,
+		"close_delimited", closeDelimited(resp),
 		"duration", forwardDuration,
-		"response_headers", utils.SanitizeHeaders(resp.Header))
+		"response_headers", utils.LazyHeaders(resp.Header))
+	defer resp.Body.Close()
+
+	// 小响应合并为一条消息发送，保留 Content-Length 且减少消息数量
+	prefix, complete, err := readSmallBody(req.Method, resp, c.fullResponseThreshold)
+	if err != nil {
+		rl.Error("Failed to read response body from target",
+			"target_addr", c.targetAddr,
+			"duration", time.Since(startTime),
+			"error", err)
+		c.rejectTargetError(s, reqMsg.ID, protocol.TargetErrRead)
+		return
+	}
+	var full []byte
+	if complete {
+		payload := fullResponsePayload(req.Method, resp, prefix)
+		full, _ = protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: reqMsg.ID, Type: protocol.MSG_TYPE_HTTP_RES_FULL, Payload: payload})
+		if !s.fits(full) {
+			// -full-response-threshold 大于协商的消息上限时改为分块发送
+			rl.Debug("Full response exceeds the frame size limit, streaming instead",
+				"size", len(full),
+				"max_frame_size", s.maxFrameSize)
+			full = nil
+		}
+	}
+	if full != nil {
+		if s.send(full) {
+			rl.Completed("Request completed", resp.StatusCode, time.Since(startTime), int64(len(prefix)),
+				"full_response", true)
+		} else {
+			rl.Warn("Connection closed before full response was queued",
+				"duration", time.Since(startTime))
+		}
+		return
+	}
 
 	// 1. 先发送响应头
 	headerBuf := new(bytes.Buffer)
-	fmt.Fprintf(headerBuf, "HTTP/1.1 %s\r\n", resp.Status)
+	headerBuf.WriteString(protocol.StatusLine(resp.StatusCode, resp.Status))
 	_ = resp.Header.Write(headerBuf)
 	headerBuf.WriteString("\r\n")
 
 	headerMsg := protocol.TunnelMessage{ID: reqMsg.ID, Type: protocol.MSG_TYPE_HTTP_RES, Payload: headerBuf.Bytes()}
 	headerData, _ := protocol.SerializeTunnelMessage(headerMsg)
 
-	logger.Debug("Sending response header to server",
-		"key", c.key,
-		"request_id", reqMsg.ID,
+	rl.Debug("Sending response header to server",
 		"header_size", len(headerData))
 
-	select {
-	case c.writeChan <- headerData:
-		logger.Debug("Response header successfully queued for writing",
-			"key", c.key,
-			"request_id", reqMsg.ID)
-	case <-time.After(10 * time.Second):
-		logger.Error("Failed to queue response header for writing",
-			"key", c.key,
-			"request_id", reqMsg.ID,
-			"timeout", "10s")
+	if !s.fits(headerData) {
+		// 响应头超过协商的消息上限，服务器只会丢弃它并以 frame_too_large 结束请求，改为返回转发失败
+		rl.Error("Response header exceeds the frame size limit",
+			"header_size", len(headerData),
+			"max_frame_size", s.maxFrameSize)
+		c.rejectTargetError(s, reqMsg.ID, protocol.TargetErrFailed)
+		return
+	}
+	if !s.send(headerData) {
+		rl.Warn("Connection closed before response header was queued",
+			"duration", time.Since(startTime))
 		return // 如果头都发不出去，后面的也没意义了
 	}
 
-	// 2. 流式发送响应体
-	logger.Debug("Starting response body streaming",
-		"key", c.key,
-		"request_id", reqMsg.ID,
-		"total_duration", time.Since(startTime))
+	// 2. 在同一协程中流式发送响应体，避免每个请求额外启动协程
+	var body io.Reader = resp.Body
+	if len(prefix) > 0 {
+		body = io.MultiReader(bytes.NewReader(prefix), resp.Body)
+	}
+	// 逐行输出的目标服务合并为较大的数据块发送，事件流仍逐条发送
+	if c.chunkCoalesceBytes > 0 && !utils.IsEventStream(resp.Header) && !utils.AcceptsEventStream(req.Header) {
+		threshold := min(c.chunkCoalesceBytes, responseChunkSize, protocol.MaxChunkData(s.maxFrameSize))
+		cr := newCoalescingReader(body, threshold, c.chunkCoalesceDelay)
+		defer cr.Close()
+		body = cr
+	}
+	var chunks, n int64
+	var ok bool
+	pprof.Do(ctx, pprof.Labels(utils.ProfileLabelStage, "stream_body"), func(context.Context) {
+		chunks, n, ok = c.streamResponseBody(ctx, s, body, rl, reqMsg.ID)
+	})
+	if ok {
+		rl.Completed("Request completed", resp.StatusCode, time.Since(startTime), n,
+			"chunks", chunks)
+	}
+}
 
-	// streamResponseBody 函数内部会负责关闭 resp.Body
-	go c.streamResponseBody(resp.Body, reqMsg.ID)
+// sendInterimResponse 向服务器发送 1xx 临时响应
+func (c *TunnelClient) sendInterimResponse(s *session, requestID uint64, code int, header http.Header) {
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_HTTP_RES_INTERIM, Payload: interimResponsePayload(code, header)})
+	if s.send(data) {
+		logger.Debug("Interim response queued for writing",
+			"key", c.key,
+			"request_id", requestID,
+			"status_code", code)
+	}
 }
 
-// streamResponseBody 流式地读取响应体并发送数据块
-func (c *TunnelClient) streamResponseBody(body io.ReadCloser, requestID uint64) {
-	defer body.Close()
+// rejectRequest 直接向服务器返回错误响应，不启动处理协程
+func (c *TunnelClient) rejectRequest(s *session, requestID uint64, statusCode int) {
+	payload := protocol.StatusLine(statusCode, "") + "Content-Length: 0\r\n\r\n"
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_HTTP_RES_FULL, Payload: []byte(payload)})
+	s.send(data)
+}
 
-	logger.Debug("Starting response body streaming",
+// rejectTargetError 转发目标服务失败时返回带原因的错误响应，服务器据此选择 502 或 504
+func (c *TunnelClient) rejectTargetError(s *session, requestID uint64, kind string) {
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_HTTP_RES_FULL, Payload: protocol.TargetErrorResponse(kind)})
+	s.send(data)
+}
+
+// streamResponseBody 流式地读取响应体并发送数据块，body 由调用方关闭。
+// 返回发送的数据块数和字节数，连接在发出结束标记前关闭、公网请求中止 (ctx 取消) 或读取目标响应体失败而中止响应时 ok 为 false
+func (c *TunnelClient) streamResponseBody(ctx context.Context, s *session, body io.Reader, rl *logger.RequestLog, requestID uint64) (chunks, total int64, ok bool) {
+	rl.Debug("Starting response body streaming")
+
+	buf := make([]byte, min(responseChunkSize, protocol.MaxChunkData(s.maxFrameSize)))
+	var seq uint32 // 启用序号时下一个数据块的序号
+	// 逐块日志只在 SINGLEPROXY_TRACE 下输出，调试级别按数据量和时间汇总输出进度
+	progress := logger.NewStreamProgress("Response body streaming progress",
 		"key", c.key,
 		"request_id", requestID)
-
-	buf := make([]byte, 32*1024) // 32KB 的缓冲区
-	totalBytes := 0
-	chunkCount := 0
+	defer func() {
+		streamedChunksCounter.Add(progress.Chunks)
+		streamedBytesCounter.Add(progress.Bytes)
+	}()
 
 	for {
 		n, err := body.Read(buf)
+		if ctx.Err() != nil {
+			// 服务器已放弃该请求 (公网调用方断开或超时)，停止读取目标服务，也不再发送结束标记
+			rl.Info("Stopped streaming response body, public request aborted",
+				"chunks", progress.Chunks,
+				"bytes", progress.Bytes)
+			return progress.Chunks, progress.Bytes, false
+		}
 		if n > 0 {
-			chunkCount++
-			totalBytes += n
-
-			logger.Debug("Read response body chunk",
+			progress.Add(n)
+			logger.Trace("Read response body chunk",
 				"key", c.key,
 				"request_id", requestID,
 				"chunk_size", n,
-				"chunk_count", chunkCount,
-				"total_bytes", totalBytes)
+				"chunk_count", progress.Chunks,
+				"total_bytes", progress.Bytes)
 
-			chunkMsg := protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK, Payload: buf[:n]}
+			payload := buf[:n]
+			if s.chunkSeq {
+				payload = protocol.EncodeResponseChunk(protocol.ResponseChunk{Seq: seq, Data: payload})
+				seq++
+			}
+			chunkMsg := protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK, Payload: payload}
 			chunkData, _ := protocol.SerializeTunnelMessage(chunkMsg)
 
-			select {
-			case c.writeChan <- chunkData:
-				logger.Debug("Response body chunk queued for writing",
-					"key", c.key,
-					"request_id", requestID,
-					"chunk_count", chunkCount,
-					"chunk_size", n)
-			case <-c.closeChan:
+			if !s.send(chunkData) {
 				// 连接已关闭，退出
-				logger.Warn("Connection closed while streaming body",
-					"key", c.key,
-					"request_id", requestID,
-					"chunks_sent", chunkCount,
-					"total_bytes", totalBytes)
-				return
+				rl.Warn("Connection closed while streaming body",
+					"chunks", progress.Chunks,
+					"bytes", progress.Bytes)
+				return progress.Chunks, progress.Bytes, false
 			}
 		}
 
+		if err == io.EOF {
+			break // 读取完毕，退出循环
+		}
 		if err != nil {
-			if err != io.EOF {
-				logger.Error("Error while reading response body",
-					"key", c.key,
-					"request_id", requestID,
-					"chunks_sent", chunkCount,
-					"total_bytes", totalBytes,
-					"error", err)
-			} else {
-				logger.Debug("Finished reading response body",
-					"key", c.key,
-					"request_id", requestID,
-					"chunks_sent", chunkCount,
-					"total_bytes", totalBytes)
+			// 响应头已发出，读取响应体的任何错误都归为 target_read_failed
+			rl.Error("Error while reading response body",
+				"chunks", progress.Chunks,
+				"bytes", progress.Bytes,
+				"target_error", protocol.TargetErrRead,
+				"error", err)
+			if s.responseAbort {
+				// 不发送结束标记，服务器据此截断响应，公网用户不会把不完整的响应体当作完整响应
+				abortData, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_CANCEL, Payload: []byte(protocol.TargetErrRead)})
+				s.send(abortData)
+				return progress.Chunks, progress.Bytes, false
 			}
-			break // 读取完毕或出错，退出循环
+			break // 旧服务器只能以结束标记结束响应
 		}
 	}
 
-	// 发送空数据块表示流结束
-	logger.Debug("Sending end-of-stream marker",
-		"key", c.key,
-		"request_id", requestID,
-		"total_chunks", chunkCount,
-		"total_bytes", totalBytes)
-
-	endMsg := protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK, Payload: []byte{}}
+	// 发送空数据块表示流结束，启用序号时发送附带总长度的结束标记
+	endPayload := []byte{}
+	if s.chunkSeq {
+		endPayload = protocol.EncodeResponseChunk(protocol.ResponseChunk{Seq: seq, End: true, TotalLength: progress.Bytes})
+	}
+	endMsg := protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK, Payload: endPayload}
 	endData, _ := protocol.SerializeTunnelMessage(endMsg)
 
-	select {
-	case c.writeChan <- endData:
-		logger.Info("Response body streaming completed",
-			"key", c.key,
-			"request_id", requestID,
-			"total_chunks", chunkCount,
-			"total_bytes", totalBytes)
-	case <-c.closeChan:
-		logger.Warn("Connection closed while sending end marker",
-			"key", c.key,
-			"request_id", requestID,
-			"total_chunks", chunkCount,
-			"total_bytes", totalBytes)
+	if !s.send(endData) {
+		rl.Warn("Connection closed while sending end marker",
+			"chunks", progress.Chunks,
+			"bytes", progress.Bytes)
+		return progress.Chunks, progress.Bytes, false
 	}
+	return progress.Chunks, progress.Bytes, true
 }
 
-func (c *TunnelClient) keepAlive() {
-	ticker := time.NewTicker(15 * time.Second)
+// keepAlive 定时请求 writer 发送ping，检查最近一次pong的时间，并在系统时钟跳变时刷新读取超时
+func (c *TunnelClient) keepAlive(s *session) {
+	ticker := time.NewTicker(c.keepAliveInterval)
 	defer ticker.Stop()
+	clock := newClockJumpDetector(time.Now())
 
 	for {
 		select {
 		case <-ticker.C:
-			c.lastPingTime = time.Now()
-			// 使用 WriteControl 来发送 Ping，它是线程安全的，不会与 writer goroutine 冲突
-			if err := c.wsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
-				logger.Error("Keep-alive failed",
+			// 上一个ping尚未发出时不重复请求
+			select {
+			case s.pingChan <- struct{}{}:
+			default:
+			}
+
+			now := time.Now()
+			if jump := clock.check(now); jump >= clockJumpThreshold || jump <= -clockJumpThreshold {
+				// 超时按单调时钟计算，这里重新设置一次，避免以墙上时间换算的超时在跳变后立即到期
+				logger.Warn("System clock jumped, refreshing tunnel read deadline",
 					"key", c.key,
-					"error", err)
-				return
+					"jump", jump)
+				_ = s.conn.SetReadDeadline(now.Add(tunnelReadTimeout))
 			}
-			logger.Debug("Sent ping to server at %s", c.lastPingTime.Format("15:04:05"))
 
 			// 检查连接健康状态
-			if !c.lastPongTime.IsZero() && time.Since(c.lastPongTime) > 45*time.Second {
-				logger.Warn("WARNING: No pong received for %v, connection may be unhealthy", time.Since(c.lastPongTime))
+			if since, ok := s.sincePong(now); ok && since > 3*c.keepAliveInterval {
+				logger.Warn("No pong received recently, connection may be unhealthy",
+					"key", c.key,
+					"since_last_pong", since)
 			}
-		case <-c.closeChan:
+		case <-s.closeChan:
 			return
 		}
 	}
 }
 
-// Connect 连接到服务器并建立隧道 (修改为非阻塞)
+// Connect 连接到服务器并建立新的隧道会话 (非阻塞)，会话的协程在连接断开后退出
 func (c *TunnelClient) Connect() error {
-	// 确保 closeChan 已初始化
-	if c.closeChan == nil {
-		c.closeChan = make(chan struct{})
-	}
+	_, err := c.connect()
+	return err
+}
 
+// connect 建立连接并启动新会话的协程，返回新会话
+func (c *TunnelClient) connect() (*session, error) {
 	logger.Info("Attempting to connect to server",
 		"server_addr", c.serverAddr.String(),
 		"key", c.key,
 		"target_addr", c.targetAddr,
 		"reconnect_count", c.reconnectCount)
 
-	// 在建立新连接前，确保旧的连接已关闭
-	if c.wsConn != nil {
+	// 在建立新连接前，确保旧的连接已关闭，旧会话的协程随后自行退出
+	if old := c.session.Load(); old != nil {
 		logger.Debug("Closing existing WebSocket connection")
-		c.wsConn.Close()
+		old.conn.Close()
 	}
 
 	connURL := *c.serverAddr
-	// 保留原始路径，并正确构造WebSocket端点路径
-	basePath := connURL.Path
-	if basePath == "" || basePath == "/" {
-		connURL.Path = "/ws/" + c.key
-	} else {
-		// 移除末尾的斜杠，然后附加WebSocket路径
-		if basePath[len(basePath)-1] == '/' {
-			basePath = basePath[:len(basePath)-1]
-		}
-		connURL.Path = basePath + "/ws/" + c.key
+	// 保留原始路径，在其后附加WebSocket端点路径
+	connURL.Path = protocol.JoinTunnelPath(connURL.Path, protocol.WebSocketPathSegment, c.key)
+	if c.key == "" && c.autoKey {
+		query := connURL.Query()
+		query.Set(protocol.QueryAutoKey, "1")
+		connURL.RawQuery = query.Encode()
 	}
 
 	logger.Debug("Preparing WebSocket connection",
 		"url", connURL.String(),
 		"tls_enabled", c.tlsConfig != nil)
 
-	dialer := websocket.DefaultDialer
+	// 复制默认 Dialer，避免修改全局实例
+	dialer := *websocket.DefaultDialer
 	dialer.TLSClientConfig = c.tlsConfig
+	dialer.ReadBufferSize = c.wsReadBuf
+	// 数据帧不超过写缓冲区大小，限制上限避免单个帧长时间占用连接
+	dialer.WriteBufferSize = min(c.wsWriteBuf, maxWriteBufferSize)
+	dialer.NetDialContext = c.netDial
 
 	connectStart := time.Now()
-	wsConn, response, err := dialer.Dial(connURL.String(), nil)
+	features := protocol.FeatureCancel + "," + protocol.FeatureTargetCheck + "," + protocol.FeatureChunkSeq + "," + protocol.FeatureGoAway + "," + protocol.FeatureHeaderTable + "," + protocol.FeatureResponseAbort
+	if c.messageAuthKey != nil {
+		features += "," + protocol.FeatureMessageAuth + "," + protocol.FeatureMessageAuthSeq
+	}
+	if c.localListen != "" {
+		features += "," + protocol.FeatureLocalForward
+	}
+	header := http.Header{protocol.HeaderFeatures: {features}}
+	header.Set(protocol.HeaderMaxFrameSize, strconv.Itoa(c.maxFrameSize))
+	header.Set(protocol.HeaderHeaderTableSize, strconv.Itoa(protocol.MaxHeaderTableSize))
+	if c.weight > 0 {
+		header.Set(protocol.HeaderWeight, strconv.Itoa(c.weight))
+	}
+	wsConn, response, err := dialer.Dial(connURL.String(), header)
 	if err != nil {
 		logger.Error("Failed to connect to server",
 			"server_addr", c.serverAddr.String(),
 			"key", c.key,
 			"duration", time.Since(connectStart),
 			"error", err)
-		return fmt.Errorf("failed to connect to server: %v", err)
+		if c.autoKey && response != nil && response.StatusCode == http.StatusGone {
+			// 自动key已过期，下次重连时申请新的key
+			logger.Warn("Assigned tunnel key expired, requesting a new one on next attempt",
+				"key", c.key)
+			c.key = ""
+		}
+		if response != nil {
+			if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+				c.retryAfter.Store(int64(time.Duration(seconds) * time.Second))
+			}
+			switch response.StatusCode {
+			case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+				return nil, fmt.Errorf("%w: %s", ErrRegistrationRejected, response.Status)
+			}
+		}
+		return nil, fmt.Errorf("failed to connect to server: %v", err)
 	}
 
-	c.wsConn = wsConn
+	if c.key == "" {
+		c.key = response.Header.Get(protocol.HeaderTunnelKey)
+		logger.Info("Tunnel key assigned by server",
+			"key", c.key,
+			"expires_at", response.Header.Get(protocol.HeaderKeyExpires))
+	}
+	c.announcePublicURL(response.Header)
+	// 服务器确认后才签名，未配置密钥的服务器仍以不签名的方式工作
+	// 支持计数器的服务器返回本连接的随机数，旧服务器退回不防重放的 hmac-sha256
+	var authNonce []byte
+	messageAuth := false
+	if c.messageAuthKey != nil {
+		switch response.Header.Get(protocol.HeaderMessageAuth) {
+		case protocol.MessageAuthHMACSHA256Seq:
+			authNonce, err = hex.DecodeString(response.Header.Get(protocol.HeaderMessageAuthNonce))
+			if err != nil || len(authNonce) == 0 {
+				wsConn.Close()
+				return nil, fmt.Errorf("invalid %s from server: %q", protocol.HeaderMessageAuthNonce, response.Header.Get(protocol.HeaderMessageAuthNonce))
+			}
+			messageAuth = true
+		case protocol.MessageAuthHMACSHA256:
+			messageAuth = true
+			logger.Warn("Server does not support message counters, replayed messages will not be detected",
+				"key", c.key,
+				"server_addr", c.serverAddr.String())
+		default:
+			logger.Warn("Server does not support message authentication, messages will not be signed",
+				"key", c.key,
+				"server_addr", c.serverAddr.String())
+		}
+	}
+	// 旧服务器不认识带序号的数据块，只在服务器确认后使用
+	serverFeatures := response.Header.Get(protocol.HeaderServerFeatures)
+	chunkSeq := protocol.HasFeature(serverFeatures, protocol.FeatureChunkSeq)
+	// 请求头索引表由服务器决定是否启用，确认后请求消息都经过编码
+	headerTableSize := 0
+	if protocol.HasFeature(serverFeatures, protocol.FeatureHeaderTable) {
+		headerTableSize = protocol.NegotiateHeaderTableSize(protocol.MaxHeaderTableSize, response.Header.Get(protocol.HeaderHeaderTableSize))
+	}
+
+	// 旧服务器不返回协商结果，按其固定的 10MB 读取上限
+	maxFrameSize := protocol.NegotiateFrameSize(c.maxFrameSize, response.Header.Get(protocol.HeaderMaxFrameSize))
+
+	if c.fullResponseThreshold > 0 && c.fullResponseThreshold+protocol.MessageOverhead > maxFrameSize {
+		// 接近阈值的响应合并后超过协商的上限，只能改为分块发送
+		logger.Warn("Full response threshold exceeds the negotiated frame size, larger responses will be streamed in chunks",
+			"key", c.key,
+			"full_response_threshold", c.fullResponseThreshold,
+			"message_overhead", protocol.MessageOverhead,
+			"max_frame_size", maxFrameSize)
+	}
+
+	s := newSession(wsConn, messageAuth, chunkSeq, maxFrameSize)
+	if messageAuth {
+		s.authOut = protocol.NewMessageAuth(c.messageAuthKey, authNonce, protocol.MessageAuthClientToServer)
+		s.authIn = protocol.NewMessageAuth(c.messageAuthKey, authNonce, protocol.MessageAuthServerToClient)
+	}
+	if headerTableSize > 0 {
+		s.headerDecoder = protocol.NewHeaderDecoder(headerTableSize)
+	}
+	// 旧服务器把客户端发来的 MSG_TYPE_CANCEL 计为未知消息，确认后才用它中止响应
+	s.responseAbort = protocol.HasFeature(serverFeatures, protocol.FeatureResponseAbort)
+	// 旧服务器不认识本地请求，确认前本地监听直接返回501
+	s.localForward = c.localListen != "" && protocol.HasFeature(serverFeatures, protocol.FeatureLocalForward)
+	if c.localListen != "" && !s.localForward {
+		logger.Warn("Server does not support local forwarding, local requests will be rejected",
+			"key", c.key,
+			"server_addr", c.serverAddr.String())
+	}
+	c.session.Store(s)
 	connectDuration := time.Since(connectStart)
 	c.reconnectCount++
 
@@ -429,48 +1117,142 @@ func (c *TunnelClient) Connect() error {
 		"target_addr", c.targetAddr,
 		"duration", connectDuration,
 		"response_status", response.Status,
-		"reconnect_count", c.reconnectCount)
+		"max_frame_size", maxFrameSize,
+		"reconnect_count", c.reconnectCount,
+		"instance_id", c.instanceID)
 
 	// 启动后台goroutines
 	logger.Debug("Starting background goroutines",
 		"key", c.key,
 		"goroutines", []string{"readLoop", "writer", "keepAlive"})
-	go c.readLoop()
-	go c.writer()
-	go c.keepAlive()
+	// goroutine profile 中按key区分各连接的读写循环
+	go pprof.Do(context.Background(), utils.LoopProfileLabels(c.key, "read"), func(context.Context) { c.readLoop(s) })
+	go pprof.Do(context.Background(), utils.LoopProfileLabels(c.key, "write"), func(context.Context) { c.writer(s) })
+	go pprof.Do(context.Background(), utils.LoopProfileLabels(c.key, "keepalive"), func(context.Context) { c.keepAlive(s) })
 
-	return nil
+	c.requestBindings(s)
+	if c.targetDown.Load() {
+		// 新连接默认目标服务可用，重新报告不可用状态
+		c.sendTargetHealth()
+	}
+
+	return s, nil
 }
 
-// Run 启动客户端并保持运行，支持自动重连 (修复版 - 添加指数退避)
-func (c *TunnelClient) Run() {
-	for {
-		// 在每次尝试连接前，都创建一个新的 closeChan
-		c.closeChan = make(chan struct{})
+// Run 启动客户端并保持运行，支持自动重连 (修复版 - 添加指数退避)，调用 Stop 后返回nil。
+// 启用 -wait-for-target-exit 且等待目标服务超时时返回错误
+func (c *TunnelClient) Run() error {
+	if c.metricsListen != "" {
+		go serveMetrics(c.metricsListen)
+	}
+	if c.localListen != "" {
+		// 监听失败时立即退出，不在没有本地入口的情况下运行
+		ln, err := net.Listen("tcp", c.localListen)
+		if err != nil {
+			return fmt.Errorf("failed to listen on local address %s: %w", c.localListen, err)
+		}
+		defer c.serveLocal(ln).Close()
+	}
+
+	// 首次注册前等待目标服务，重连前是否等待由 -wait-for-target-reconnect 决定
+	waitForTarget := c.targetWaiter != nil
+	// 连续失败的连接次数，连接成功后清零
+	failures := 0
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-c.stopChan:
+			logger.Info("Client stopped", "key", c.key)
+			return nil
+		default:
+		}
+
+		if waitForTarget {
+			if err := c.targetWaiter.wait(c.stopChan); err != nil {
+				return err
+			}
+			waitForTarget = c.targetWaiter.reconnect
+		}
+		if u := c.redirect.Swap(nil); u != nil {
+			logger.Info("Switching to server address from goaway",
+				"key", c.key,
+				"old_server_addr", c.serverAddr.String(),
+				"server_addr", u.String())
+			c.serverAddr = u
+		}
+
+		if attempt > 0 {
+			reconnectsCounter.Inc()
+		}
 		logger.Info("Attempting to connect to the server... (attempt #%d)", c.reconnectCount+1)
-		err := c.Connect()
+		s, err := c.connect()
+		if err != nil && c.serverAddr != c.originalAddr {
+			// 重定向的地址不可用时立即回到配置的服务器
+			redirectsCounter.WithLabelValue("fallback").Inc()
+			logger.Warn("Redirected server unreachable, falling back to configured server address",
+				"key", c.key,
+				"redirect_addr", c.serverAddr.String(),
+				"server_addr", c.originalAddr.String(),
+				"error", err)
+			c.serverAddr = c.originalAddr
+			s, err = c.connect()
+		}
+		if errors.Is(err, ErrRegistrationRejected) {
+			logger.Error("Server rejected tunnel registration, not retrying",
+				"key", c.key,
+				"server_addr", c.serverAddr.String(),
+				"error", err)
+			return err
+		}
 		if err != nil {
+			failures++
+			if c.maxReconnects > 0 && failures >= c.maxReconnects {
+				logger.Error("Giving up after consecutive connection failures",
+					"key", c.key,
+					"server_addr", c.serverAddr.String(),
+					"failures", failures,
+					"error", err)
+				return fmt.Errorf("%w after %d attempts: %v", ErrMaxReconnects, failures, err)
+			}
 			c.reconnectCount++
 			// 指数退避：最小5秒，最大60秒
 			delay := time.Duration(5+utils.Min(c.reconnectCount*2, 55)) * time.Second
+			if wait := time.Duration(c.retryAfter.Swap(0)); wait > delay {
+				delay = wait
+			}
 			logger.Error("Connection failed: %v. Retrying in %v... (failed attempts: %d)", err, delay, c.reconnectCount)
-			time.Sleep(delay)
+			c.sleepOrStop(delay)
 			continue
 		}
 
 		// 连接成功，重置重连计数器
+		failures = 0
 		if c.reconnectCount > 0 {
 			logger.Info("Successfully reconnected after %d failed attempts", c.reconnectCount)
 			c.reconnectCount = 0
 		}
 
 		logger.Info("Client is running. Waiting for disconnection...")
-		// 阻塞，直到连接断开
-		<-c.closeChan
+		// 阻塞，直到连接断开或调用 Stop
+		select {
+		case <-s.closeChan:
+		case <-c.stopChan:
+			logger.Info("Stopping client, closing tunnel connection", "key", c.key)
+			_ = s.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, protocol.CloseReasonClientShutdown),
+				time.Now().Add(time.Second))
+			s.conn.Close()
+			<-s.closeChan
+			continue
+		}
 		logger.Info("Connection lost. Preparing to reconnect...")
 		c.reconnectCount++
 
-		// 短暂延迟后重连
-		time.Sleep(3 * time.Second)
+		// 短暂延迟后重连，服务器要求等待更久时以服务器为准
+		delay := 3 * time.Second
+		if wait := time.Duration(c.retryAfter.Swap(0)); wait > delay {
+			logger.Info("Delaying reconnect as requested by server", "retry_after", wait)
+			delay = wait
+		}
+		c.sleepOrStop(delay)
 	}
 }
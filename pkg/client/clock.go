@@ -0,0 +1,29 @@
+package client
+
+import "time"
+
+// clockJumpThreshold 墙上时钟相对单调时钟的跳变超过该值时视为系统时钟被调整
+// (如没有RTC的设备在NTP同步后向前跳数小时)
+const clockJumpThreshold = time.Minute
+
+// clockJumpDetector 比较相邻两次检查之间墙上时间和单调时间的差，发现系统时钟跳变
+type clockJumpDetector struct {
+	base     time.Time     // 创建时间，带单调时钟读数
+	lastWall time.Time     // 上次检查时的墙上时间 (去掉单调时钟读数)
+	lastMono time.Duration // 上次检查时距 base 的单调时长
+}
+
+func newClockJumpDetector(now time.Time) *clockJumpDetector {
+	return &clockJumpDetector{base: now, lastWall: now.Round(0)}
+}
+
+// check 返回自上次检查以来墙上时钟相对单调时钟的跳变，正数表示向前跳
+func (d *clockJumpDetector) check(now time.Time) time.Duration {
+	return d.observe(now.Round(0), now.Sub(d.base))
+}
+
+func (d *clockJumpDetector) observe(wall time.Time, mono time.Duration) time.Duration {
+	jump := wall.Sub(d.lastWall) - (mono - d.lastMono)
+	d.lastWall, d.lastMono = wall, mono
+	return jump
+}
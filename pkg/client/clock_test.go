@@ -0,0 +1,49 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockJumpDetector(t *testing.T) {
+	wall := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := &clockJumpDetector{lastWall: wall}
+
+	steps := []struct {
+		wall time.Duration // 距起点的墙上时间
+		mono time.Duration // 距起点的单调时间
+		jump time.Duration
+	}{
+		{15 * time.Second, 15 * time.Second, 0},
+		// NTP 同步后墙上时钟向前跳数十年，单调时钟只走了15秒
+		{56*365*24*time.Hour + 30*time.Second, 30 * time.Second, 56 * 365 * 24 * time.Hour},
+		{56*365*24*time.Hour + 45*time.Second, 45 * time.Second, 0},
+		// 向后跳
+		{56*365*24*time.Hour - time.Hour + time.Minute, time.Minute, -time.Hour},
+	}
+	for i, s := range steps {
+		if got := d.observe(wall.Add(s.wall), s.mono); got != s.jump {
+			t.Errorf("Step %d: expected jump %v, got %v", i, s.jump, got)
+		}
+	}
+
+	// 实际读数没有跳变
+	live := newClockJumpDetector(time.Now())
+	time.Sleep(10 * time.Millisecond)
+	if jump := live.check(time.Now()); jump >= clockJumpThreshold || jump <= -clockJumpThreshold {
+		t.Errorf("Unexpected jump %v without clock change", jump)
+	}
+}
+
+func TestSessionSincePongMonotonic(t *testing.T) {
+	s := newSession(nil, false, false, 0)
+	if _, ok := s.sincePong(time.Now()); ok {
+		t.Error("Expected no pong before the first one is received")
+	}
+
+	s.markPong(s.created.Add(10 * time.Second))
+	// 按单调时长记录，与墙上时间无关
+	if since, ok := s.sincePong(s.created.Add(40 * time.Second)); !ok || since != 30*time.Second {
+		t.Errorf("Expected 30s since pong, got %v %v", since, ok)
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"io"
+	"time"
+)
+
+// defaultChunkCoalesceDelay 合并的读取结果最长等待时间
+const defaultChunkCoalesceDelay = 5 * time.Millisecond
+
+// coalescingReader 合并目标服务响应体的多次小读取: Read 在累计达到 threshold、
+// 最早缓冲的数据等待超过 delay 或响应体结束时返回，逐行输出的目标服务因此不会每行产生一条隧道消息。
+// 底层读取在单独的协程中进行，等待时间到期时不必等到下一次读取返回
+type coalescingReader struct {
+	threshold int
+	delay     time.Duration
+
+	data chan []byte   // 读取协程交给 Read 的数据，读取结束时关闭
+	ack  chan struct{} // Read 已复制数据，读取协程可以复用缓冲区
+	done chan struct{} // Close 后读取协程退出
+	err  error         // 底层读取的错误，data 关闭之后可读
+
+	ended   bool // data 已关闭
+	pending []byte
+	since   time.Time // pending 中最早的数据到达的时间
+	timer   *time.Timer
+}
+
+func newCoalescingReader(src io.Reader, threshold int, delay time.Duration) *coalescingReader {
+	if delay <= 0 {
+		delay = defaultChunkCoalesceDelay
+	}
+	r := &coalescingReader{
+		threshold: threshold,
+		delay:     delay,
+		data:      make(chan []byte),
+		ack:       make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go r.readLoop(src)
+	return r
+}
+
+func (r *coalescingReader) readLoop(src io.Reader) {
+	buf := make([]byte, r.threshold)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			select {
+			case r.data <- buf[:n]:
+			case <-r.done:
+				return
+			}
+			select {
+			case <-r.ack:
+			case <-r.done:
+				return
+			}
+		}
+		if err != nil {
+			r.err = err
+			close(r.data)
+			return
+		}
+	}
+}
+
+func (r *coalescingReader) Read(p []byte) (int, error) {
+	limit := min(len(p), r.threshold)
+wait:
+	for len(r.pending) < limit && !r.ended {
+		var expired <-chan time.Time
+		if len(r.pending) > 0 {
+			remaining := r.delay - time.Since(r.since)
+			if remaining <= 0 {
+				break
+			}
+			if r.timer == nil {
+				r.timer = time.NewTimer(remaining)
+			} else {
+				r.timer.Reset(remaining)
+			}
+			expired = r.timer.C
+		}
+		select {
+		case b, ok := <-r.data:
+			if !ok {
+				r.ended = true
+				break
+			}
+			if len(r.pending) == 0 {
+				r.since = time.Now()
+			}
+			r.pending = append(r.pending, b...)
+			r.ack <- struct{}{}
+		case <-expired:
+			break wait
+		}
+	}
+	if len(r.pending) == 0 && r.ended {
+		return 0, r.err
+	}
+	n := copy(p, r.pending)
+	r.pending = append(r.pending[:0], r.pending[n:]...)
+	return n, nil
+}
+
+// Close 停止读取协程，不关闭底层的响应体
+func (r *coalescingReader) Close() {
+	close(r.done)
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoalescingReaderBatches(t *testing.T) {
+	src, w := io.Pipe()
+	go func() {
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(w, "line %04d\n", i) // 每行10字节
+		}
+		w.Close()
+	}()
+	r := newCoalescingReader(src, 256, time.Hour)
+	defer r.Close()
+
+	buf := make([]byte, 1024)
+	var reads []int
+	var got strings.Builder
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			reads = append(reads, n)
+			got.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if got.Len() != 1000 || !strings.HasPrefix(got.String(), "line 0000\n") || !strings.HasSuffix(got.String(), "line 0099\n") {
+		t.Fatalf("Expected 100 lines in order, got %d bytes", got.Len())
+	}
+	// 100 次小写入合并为 4 次读取: 3 次各达到 256 字节阈值 (260 字节)，剩余的在结束时返回
+	if len(reads) != 4 || reads[0] != 260 {
+		t.Errorf("Expected 4 coalesced reads of ~256 bytes, got %v", reads)
+	}
+}
+
+func TestCoalescingReaderFlushesAfterDelay(t *testing.T) {
+	src, w := io.Pipe()
+	defer w.Close()
+	r := newCoalescingReader(src, 16<<10, 20*time.Millisecond)
+	defer r.Close()
+
+	go w.Write([]byte("data: tick\n\n"))
+	start := time.Now()
+	buf := make([]byte, 32<<10)
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "data: tick\n\n" {
+		t.Fatalf("Expected buffered data after the delay, got %q (%v)", buf[:n], err)
+	}
+	// 目标服务之后不再输出，已读到的数据不等待下一次读取
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected flush after the coalesce delay, took %s", elapsed)
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxLoggedRequestIDs 超限日志中最多列出的进行中请求ID数
+const maxLoggedRequestIDs = 32
+
+var frameLimitViolationsCounter = metrics.NewCounterVec("singleproxy_client_frame_limit_violations_total",
+	"Tunnel messages from the server larger than the negotiated frame size, by action (request_rejected, dropped, connection_closed)", "action")
+
+// inflightRequestIDs 返回正在处理的请求ID，按ID排序
+func (c *TunnelClient) inflightRequestIDs() []uint64 {
+	c.inflightMu.Lock()
+	ids := make([]uint64, 0, len(c.inflight))
+	for id := range c.inflight {
+		ids = append(ids, id)
+	}
+	c.inflightMu.Unlock()
+	slices.Sort(ids)
+	return ids
+}
+
+// handleOversizedFrame 处理服务器发来的超过协商上限的消息。消息已丢弃时超限的请求以413拒绝，
+// 会话上的其他请求不受影响；消息过大无法丢弃时以协议错误关闭连接并返回 false，读取循环随即退出
+func (c *TunnelClient) handleOversizedFrame(s *session, tooLarge *protocol.FrameTooLargeError) bool {
+	ids := c.inflightRequestIDs()
+	args := []any{
+		"key", c.key,
+		"server_addr", c.serverAddr.String(),
+		"request_id", tooLarge.ID,
+		"message_type", tooLarge.Type,
+		"message_size", tooLarge.Size,
+		"read_limit", s.maxFrameSize,
+		"message_auth", s.messageAuth,
+		"chunk_seq", s.chunkSeq,
+		"active_requests", len(ids),
+		"active_request_ids", ids[:min(len(ids), maxLoggedRequestIDs)],
+	}
+
+	if !tooLarge.Drained {
+		frameLimitViolationsCounter.WithLabelValue("connection_closed").Inc()
+		logger.Error("Tunnel message exceeded the negotiated frame size, closing connection", args...)
+		_ = s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.FormatFrameTooLargeReason(s.maxFrameSize)),
+			time.Now().Add(time.Second))
+		return false
+	}
+
+	if tooLarge.Type != protocol.MSG_TYPE_HTTP_REQ {
+		frameLimitViolationsCounter.WithLabelValue("dropped").Inc()
+		logger.Warn("Dropped tunnel message exceeding the negotiated frame size", args...)
+		return true
+	}
+	// 请求没有读入，直接回应413，公网用户不必等到超时
+	frameLimitViolationsCounter.WithLabelValue("request_rejected").Inc()
+	logger.Warn("Tunnel request exceeded the negotiated frame size, rejecting it", args...)
+	c.rejectRequest(s, tooLarge.ID, http.StatusRequestEntityTooLarge)
+	return true
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"net/url"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+)
+
+// goAwayPollInterval 收到迁移通知后检查进行中请求的间隔
+const goAwayPollInterval = 50 * time.Millisecond
+
+// handleGoAway 服务器要求迁移: 等待进行中的请求完成 (最多到宽限期结束) 后以正常关闭断开，
+// 随后由 Run 重连，通知中带 -redirect-allow 允许的备用地址时改为连接该地址
+func (c *TunnelClient) handleGoAway(s *session, msg protocol.TunnelMessage) {
+	g, err := protocol.DecodeGoAway(msg.Payload)
+	if err != nil {
+		logger.Error("Failed to decode goaway",
+			"key", c.key,
+			"error", err)
+		return
+	}
+	if g.ReconnectTo != "" {
+		u, err := url.Parse(g.ReconnectTo)
+		switch {
+		case err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "":
+			redirectsCounter.WithLabelValue("rejected").Inc()
+			logger.Warn("Ignoring invalid reconnect address from server",
+				"key", c.key,
+				"reconnect_to", g.ReconnectTo)
+		case !c.redirectAllowed(u):
+			redirectsCounter.WithLabelValue("rejected").Inc()
+			logger.Warn("Ignoring reconnect address not allowed by -redirect-allow",
+				"key", c.key,
+				"reconnect_to", g.ReconnectTo,
+				"reason", g.Reason,
+				"server_addr", c.originalAddr.String())
+			// 负载均衡的重定向不强制断开，不接受备用地址时留在当前服务器，重连回来只会再次被重定向
+			if g.Reason == protocol.GoAwayReasonRebalance {
+				return
+			}
+		default:
+			redirectsCounter.WithLabelValue("accepted").Inc()
+			logger.Info("Server redirected client to alternate address",
+				"key", c.key,
+				"reconnect_to", g.ReconnectTo,
+				"reason", g.Reason)
+			c.redirect.Store(u)
+		}
+	}
+	logger.Info("Server requested drain, finishing active requests before reconnecting",
+		"key", c.key,
+		"grace", g.Grace(),
+		"reconnect_to", g.ReconnectTo,
+		"reason", g.Reason,
+		"active_requests", c.activeRequests.Load())
+
+	deadline := time.Now().Add(g.Grace())
+	ticker := time.NewTicker(goAwayPollInterval)
+	defer ticker.Stop()
+	for c.activeRequests.Load() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ticker.C:
+		case <-s.closeChan:
+			return
+		}
+	}
+	if n := c.activeRequests.Load(); n > 0 {
+		logger.Warn("Drain grace period ended with requests in flight",
+			"key", c.key,
+			"active_requests", n)
+	}
+	// 由 writer 在写完已入队的数据后关闭连接
+	s.send(nil)
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+)
+
+// targetProbeInterval 目标服务不可用时探测其恢复的间隔
+const targetProbeInterval = 5 * time.Second
+
+// observeTarget 根据转发结果更新目标服务的健康状态，只有连接目标失败才视为不可用
+func (c *TunnelClient) observeTarget(err error) {
+	var opErr *net.OpError
+	if err == nil {
+		c.setTargetDown(false)
+	} else if errors.As(err, &opErr) && opErr.Op == "dial" {
+		c.setTargetDown(true)
+	}
+}
+
+// setTargetDown 在健康状态变化时通知服务器，不可用期间后台探测目标服务
+func (c *TunnelClient) setTargetDown(down bool) {
+	if c.targetDown.Swap(down) == down {
+		return
+	}
+	if down {
+		logger.Warn("Target service unreachable, reporting to server",
+			"key", c.key,
+			"target_addr", c.targetAddr)
+		go c.probeTarget()
+	} else {
+		logger.Info("Target service recovered, reporting to server",
+			"key", c.key,
+			"target_addr", c.targetAddr)
+	}
+	c.sendTargetHealth()
+}
+
+// sendTargetHealth 向服务器发送当前的目标服务健康状态
+func (c *TunnelClient) sendTargetHealth() {
+	health := protocol.TargetHealthUp
+	if c.targetDown.Load() {
+		health = protocol.TargetHealthDown
+	}
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{Type: protocol.MSG_TYPE_TARGET_HEALTH, Payload: []byte(health)})
+	// 断开期间不发送，重连后由 Connect 重新报告
+	if s := c.session.Load(); s != nil {
+		s.send(data)
+	}
+}
+
+// probeTarget 定期尝试连接目标服务，恢复后标记为可用
+func (c *TunnelClient) probeTarget() {
+	for c.targetDown.Load() {
+		if !c.sleepOrStop(targetProbeInterval) {
+			return
+		}
+		conn, err := net.DialTimeout("tcp", c.targetAddr, targetProbeInterval)
+		if err == nil {
+			conn.Close()
+			c.setTargetDown(false)
+			return
+		}
+	}
+}
+
+// handleTargetCheck 响应服务器的目标服务检查：先检查TCP连接，指定路径时再发送一次 GET 请求
+func (c *TunnelClient) handleTargetCheck(s *session, msg protocol.TunnelMessage) {
+	start := time.Now()
+	res := protocol.TargetCheckResult{}
+	req, err := protocol.DecodeTargetCheckRequest(msg.Payload)
+	if err != nil {
+		res.Error = "invalid check request: " + err.Error()
+	} else {
+		res = c.checkTarget(req.Path)
+	}
+	res.TotalMs = float64(time.Since(start).Microseconds()) / 1000
+
+	logger.Info("Target check requested by server",
+		"key", c.key,
+		"target_addr", c.targetAddr,
+		"path", req.Path,
+		"ok", res.OK,
+		"error", res.Error)
+
+	payload, _ := protocol.EncodeTargetCheckResult(res)
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: msg.ID, Type: protocol.MSG_TYPE_TARGET_CHECK_RES, Payload: payload})
+	s.send(data)
+}
+
+func (c *TunnelClient) checkTarget(path string) protocol.TargetCheckResult {
+	var res protocol.TargetCheckResult
+	dialStart := time.Now()
+	conn, err := net.DialTimeout("tcp", c.targetAddr, targetProbeInterval)
+	res.ConnectMs = float64(time.Since(dialStart).Microseconds()) / 1000
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	conn.Close()
+	if path == "" {
+		res.OK = true
+		return res
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+c.targetAddr+path, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	resp, err := c.forwardToTarget(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	res.Status = resp.StatusCode
+	res.OK = resp.StatusCode < 500 // 只有5xx视为目标服务异常
+	return res
+}
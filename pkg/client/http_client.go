@@ -2,16 +2,22 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"runtime/pprof"
+	"strconv"
 	"time"
 
 	"singleproxy/pkg/config"
+	"singleproxy/pkg/dnscache"
 	"singleproxy/pkg/logger"
 	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/utils"
 )
 
 // HTTPTunnelClient HTTP长轮询隧道客户端
@@ -21,6 +27,24 @@ type HTTPTunnelClient struct {
 	target    string
 	client    *http.Client
 	insecure  bool
+	// bodyClient 读取流式请求体，与 client 共用连接但不受长轮询超时限制
+	bodyClient *http.Client
+	// 服务器转发的请求头部超出限制时以431拒绝
+	headerLimits protocol.HeaderLimits
+
+	// 注册前等待目标服务可用 (未启用时为nil)
+	targetWaiter *targetWaiter
+
+	// 是否在客户端跟随目标服务的重定向，以及原样返回时 Location 的改写规则 (未配置时为nil)
+	followRedirects bool
+	locationRewrite *locationRewrite
+
+	// 实例ID，转发到目标服务前写入 X-SingleProxy-Hop 用于检测代理环路
+	instanceID string
+
+	// Stop 取消 ctx 以中断正在进行的长轮询并结束 StartPolling
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewHTTPTunnelClient 创建HTTP长轮询客户端
@@ -31,8 +55,12 @@ func NewHTTPTunnelClient(cfg *config.Config) (*HTTPTunnelClient, error) {
 	if cfg.TargetAddr == "" {
 		return nil, fmt.Errorf("target address cannot be empty")
 	}
-	if cfg.Key == "" {
-		return nil, fmt.Errorf("tunnel key cannot be empty")
+	keyValidator, err := protocol.NewKeyValidator(cfg.KeyPattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := keyValidator.Validate(cfg.Key); err != nil {
+		return nil, err
 	}
 
 	// 解析服务器URL以确定是否使用HTTPS
@@ -66,20 +94,47 @@ func NewHTTPTunnelClient(cfg *config.Config) (*HTTPTunnelClient, error) {
 		Transport: transport,
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &HTTPTunnelClient{
-		serverURL: cfg.ServerAddr,
-		key:       cfg.Key,
-		target:    cfg.TargetAddr,
-		client:    httpClient,
-		insecure:  cfg.Insecure,
+		serverURL:    cfg.ServerAddr,
+		key:          cfg.Key,
+		target:       cfg.TargetAddr,
+		client:       httpClient,
+		insecure:     cfg.Insecure,
+		bodyClient:   &http.Client{Transport: transport},
+		headerLimits: protocol.NewHeaderLimits(cfg.MaxHeaderCount, cfg.MaxHeaderFieldBytes, cfg.MaxHeaderBytes),
+		targetWaiter: newTargetWaiter(cfg),
+
+		followRedirects: cfg.FollowTargetRedirects,
+		locationRewrite: newLocationRewrite(cfg.TargetLocationRewrite),
+		instanceID:      protocol.NewInstanceID(),
+
+		ctx:    ctx,
+		cancel: cancel,
 	}, nil
 }
 
+// Stop 中断长轮询，Run 随后返回
+func (c *HTTPTunnelClient) Stop() {
+	c.cancel()
+}
+
+// endpointURL 在服务器地址后拼接长轮询入口，服务器地址末尾的斜杠会被去掉
+func (c *HTTPTunnelClient) endpointURL(segments ...string) string {
+	return protocol.JoinTunnelPath(c.serverURL, append([]string{protocol.HTTPTunnelPathSegment}, segments...)...)
+}
+
 // Register 注册隧道
 func (c *HTTPTunnelClient) Register() error {
-	url := fmt.Sprintf("%s/http-tunnel/register/%s", c.serverURL, c.key)
+	url := c.endpointURL("register", c.key)
 
-	resp, err := c.client.Post(url, "application/json", nil)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create register request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(protocol.HeaderFeatures, protocol.FeatureBodyStream)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to register: %v", err)
 	}
@@ -100,10 +155,17 @@ func (c *HTTPTunnelClient) StartPolling() {
 
 	for {
 		err := c.pollOnce()
+		if c.ctx.Err() != nil {
+			logger.Info("HTTP tunnel polling stopped", "key", c.key)
+			return
+		}
 		if err != nil {
 			logger.Error("Polling error", "error", err, "key", c.key)
 			logger.Info("Retrying in 5 seconds...")
-			time.Sleep(5 * time.Second)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-c.ctx.Done():
+			}
 			continue
 		}
 	}
@@ -111,9 +173,13 @@ func (c *HTTPTunnelClient) StartPolling() {
 
 // pollOnce 执行一次轮询
 func (c *HTTPTunnelClient) pollOnce() error {
-	url := fmt.Sprintf("%s/http-tunnel/poll/%s", c.serverURL, c.key)
+	url := c.endpointURL("poll", c.key)
 
-	resp, err := c.client.Get(url)
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create poll request: %v", err)
+	}
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("poll request failed: %v", err)
 	}
@@ -132,8 +198,11 @@ func (c *HTTPTunnelClient) pollOnce() error {
 			return fmt.Errorf("failed to deserialize message: %v", err)
 		}
 
-		logger.Debug("Received message", "id", msg.ID, "type", msg.Type)
-		return c.handleMessage(msg)
+		logger.Debug("Received message",
+			"key", c.key,
+			"request_id", msg.ID,
+			"message_type", msg.Type)
+		return c.handleMessage(msg, resp.Header.Get(protocol.HeaderRequestBody) == protocol.RequestBodyStream)
 
 	case http.StatusNoContent:
 		// 轮询超时，正常情况
@@ -151,37 +220,76 @@ func (c *HTTPTunnelClient) pollOnce() error {
 	}
 }
 
-// handleMessage 处理收到的消息
-func (c *HTTPTunnelClient) handleMessage(msg protocol.TunnelMessage) error {
+// handleMessage 处理收到的消息，streamBody 表示请求体需要从 body 端点读取
+func (c *HTTPTunnelClient) handleMessage(msg protocol.TunnelMessage, streamBody bool) error {
 	switch msg.Type {
 	case protocol.MSG_TYPE_HTTP_REQ:
-		return c.handleHTTPRequest(msg)
+		var err error
+		pprof.Do(context.Background(), utils.RequestProfileLabels(c.key, msg.ID, "forward"), func(context.Context) {
+			err = c.handleHTTPRequest(msg, streamBody)
+		})
+		return err
 	default:
-		logger.Warn("Unknown message type", "type", msg.Type)
+		logger.Warn("Unknown message type",
+			"key", c.key,
+			"request_id", msg.ID,
+			"message_type", msg.Type)
 		return nil
 	}
 }
 
 // handleHTTPRequest 处理HTTP请求
-func (c *HTTPTunnelClient) handleHTTPRequest(msg protocol.TunnelMessage) error {
+func (c *HTTPTunnelClient) handleHTTPRequest(msg protocol.TunnelMessage, streamBody bool) error {
+	startTime := time.Now()
 	// 解析HTTP请求
-	req, err := protocol.ParseHTTPRequest(msg.Payload)
+	req, err := protocol.ParseHTTPRequest(msg.Payload, c.headerLimits)
 	if err != nil {
-		logger.Error("Failed to parse HTTP request", "error", err)
+		logger.RequestLogger(logger.TransportLongPoll, c.key, msg.ID, "", "").Error("Failed to parse HTTP request",
+			"error", err)
+		var limitErr *protocol.HeaderLimitError
+		if errors.As(err, &limitErr) {
+			return c.sendStatusResponse(msg.ID, http.StatusRequestHeaderFieldsTooLarge)
+		}
 		return c.sendErrorResponse(msg.ID, "Bad Request")
 	}
+	rl := logger.RequestLogger(logger.TransportLongPoll, c.key, msg.ID, req.Method, req.URL.Path)
+	if !checkProxyLoop(rl, req, c.instanceID, c.target) {
+		return c.sendStatusResponse(msg.ID, http.StatusLoopDetected)
+	}
+	if streamBody {
+		// 消息只含请求行和头部，请求体边读取边转发给目标服务
+		body, err := c.openRequestBody(msg.ID)
+		if err != nil {
+			rl.Error("Failed to open request body stream", "error", err)
+			return c.sendErrorResponse(msg.ID, "Bad Gateway")
+		}
+		defer body.Close()
+		req.Body = body
+	}
 
-	logger.Debug("Processing HTTP request", "method", req.Method, "path", req.URL.Path)
+	rl.Debug("Processing HTTP request", "stream_body", streamBody)
 
 	// 转发到本地目标服务
 	targetURL := fmt.Sprintf("http://%s%s", c.target, req.URL.RequestURI())
 
+	// 公网调用方声明了超时时，目标服务的调用在相同时间后取消
+	ctx := context.Background()
+	if timeout, ok := protocol.ParseRequestTimeout(req.Header.Get(protocol.HeaderRequestTimeout)); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	// 创建转发请求
-	targetReq, err := http.NewRequest(req.Method, targetURL, req.Body)
+	targetReq, err := http.NewRequestWithContext(ctx, req.Method, targetURL, req.Body)
 	if err != nil {
-		logger.Error("Failed to create target request", "error", err)
+		rl.Error("Failed to create target request", "error", err)
 		return c.sendErrorResponse(msg.ID, "Internal Server Error")
 	}
+	if streamBody {
+		// 保留公网请求声明的长度，未知时以分块编码发送
+		targetReq.ContentLength = req.ContentLength
+	}
 
 	// 复制头部
 	for key, values := range req.Header {
@@ -193,8 +301,10 @@ func (c *HTTPTunnelClient) handleHTTPRequest(msg protocol.TunnelMessage) error {
 	// 发送请求
 	// 创建专用的转发客户端，复用TLS配置
 	forwardClient := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout:       30 * time.Second,
+		CheckRedirect: utils.TargetCheckRedirect(c.followRedirects),
 		Transport: &http.Transport{
+			DialContext:         dnscache.DialContext,
 			TLSHandshakeTimeout: 10 * time.Second,
 			IdleConnTimeout:     30 * time.Second,
 			MaxIdleConns:        5,
@@ -204,28 +314,57 @@ func (c *HTTPTunnelClient) handleHTTPRequest(msg protocol.TunnelMessage) error {
 
 	resp, err := forwardClient.Do(targetReq)
 	if err != nil {
-		logger.Error("Failed to forward request", "error", err)
-		return c.sendErrorResponse(msg.ID, "Bad Gateway")
+		kind := classifyTargetError(err)
+		rl.Error("Failed to forward request to target",
+			"duration", time.Since(startTime),
+			"target_error", kind,
+			"error", err)
+		return c.sendResponse(msg.ID, protocol.TargetErrorResponse(kind))
 	}
 	defer resp.Body.Close()
-
-	logger.Debug("Response received", "status", resp.StatusCode, "status_text", resp.Status)
+	c.locationRewrite.apply(resp.Header)
+	utils.RemoveResponseHopByHop(resp.Header)
 
 	// 序列化响应
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "HTTP/1.1 %s\r\n", resp.Status)
+	buf.WriteString(protocol.StatusLine(resp.StatusCode, resp.Status))
 	resp.Header.Write(&buf)
 	buf.WriteString("\r\n")
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logger.Error("Failed to read response body", "error", err)
-		return c.sendErrorResponse(msg.ID, "Internal Server Error")
+		rl.Error("Failed to read response body from target",
+			"duration", time.Since(startTime),
+			"error", err)
+		return c.sendResponse(msg.ID, protocol.TargetErrorResponse(protocol.TargetErrRead))
 	}
 	buf.Write(body)
 
 	// 发送响应
-	return c.sendResponse(msg.ID, buf.Bytes())
+	if err := c.sendResponse(msg.ID, buf.Bytes()); err != nil {
+		return err
+	}
+	rl.Completed("Request completed", resp.StatusCode, time.Since(startTime), int64(len(body)))
+	return nil
+}
+
+// openRequestBody 从服务器的 body 端点读取请求体，调用方负责关闭
+func (c *HTTPTunnelClient) openRequestBody(requestID uint64) (io.ReadCloser, error) {
+	url := c.endpointURL("body", c.key, strconv.FormatUint(requestID, 10))
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.bodyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	return resp.Body, nil
 }
 
 // sendResponse 发送响应
@@ -241,7 +380,7 @@ func (c *HTTPTunnelClient) sendResponse(requestID uint64, respData []byte) error
 		return fmt.Errorf("failed to serialize response: %v", err)
 	}
 
-	url := fmt.Sprintf("%s/http-tunnel/response/%s", c.serverURL, c.key)
+	url := c.endpointURL("response", c.key)
 	resp, err := c.client.Post(url, "application/octet-stream", bytes.NewReader(msgData))
 	if err != nil {
 		return fmt.Errorf("failed to send response: %v", err)
@@ -253,7 +392,9 @@ func (c *HTTPTunnelClient) sendResponse(requestID uint64, respData []byte) error
 		return fmt.Errorf("response rejected: %s", body)
 	}
 
-	logger.Debug("Response sent", "request_id", requestID)
+	logger.Debug("Response sent",
+		"key", c.key,
+		"request_id", requestID)
 	return nil
 }
 
@@ -264,8 +405,20 @@ func (c *HTTPTunnelClient) sendErrorResponse(requestID uint64, errorMsg string)
 	return c.sendResponse(requestID, []byte(respData))
 }
 
+// sendStatusResponse 发送只有状态码的空响应
+func (c *HTTPTunnelClient) sendStatusResponse(requestID uint64, statusCode int) error {
+	respData := protocol.StatusLine(statusCode, "") + "Content-Length: 0\r\n\r\n"
+	return c.sendResponse(requestID, []byte(respData))
+}
+
 // Run 启动客户端
 func (c *HTTPTunnelClient) Run() error {
+	if c.targetWaiter != nil {
+		if err := c.targetWaiter.wait(c.ctx.Done()); err != nil {
+			return err
+		}
+	}
+
 	// 首先注册
 	if err := c.Register(); err != nil {
 		return err
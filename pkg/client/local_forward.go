@@ -0,0 +1,233 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/protocol"
+)
+
+// localReadHeaderTimeout 本地调用方发送请求头的超时
+const localReadHeaderTimeout = 10 * time.Second
+
+// localResponseBuffer 每个本地请求缓冲的响应消息数，本地调用方读取过慢时 readLoop 在投递时等待
+const localResponseBuffer = 16
+
+var localRequestsCounter = metrics.NewCounterVec("singleproxy_client_local_requests_total",
+	"Requests received on the local listener, by result", "result")
+
+// localResponse 一个等待服务器响应的本地请求
+type localResponse struct {
+	messages chan protocol.TunnelMessage
+	done     chan struct{} // 本地请求结束后关闭，readLoop 不再向 messages 投递
+}
+
+// registerLocal 登记等待响应的本地请求
+func (s *session) registerLocal(id uint64) *localResponse {
+	lr := &localResponse{messages: make(chan protocol.TunnelMessage, localResponseBuffer), done: make(chan struct{})}
+	s.localMu.Lock()
+	s.localPending[id] = lr
+	s.localMu.Unlock()
+	return lr
+}
+
+// unregisterLocal 注销本地请求，之后到达的响应消息被丢弃
+func (s *session) unregisterLocal(id uint64, lr *localResponse) {
+	s.localMu.Lock()
+	delete(s.localPending, id)
+	s.localMu.Unlock()
+	close(lr.done)
+}
+
+// deliverLocal 把服务器发回的响应消息交给等待的本地请求，请求已结束时返回 false。
+// 本地调用方读取过慢时在这里等待，与服务器把响应写给慢速公网调用方时一样暂停读取
+func (s *session) deliverLocal(msg protocol.TunnelMessage) bool {
+	s.localMu.Lock()
+	lr := s.localPending[msg.ID]
+	s.localMu.Unlock()
+	if lr == nil {
+		return false
+	}
+	select {
+	case lr.messages <- msg:
+		return true
+	case <-lr.done:
+		return false
+	case <-s.closeChan:
+		return false
+	}
+}
+
+// localKeyFor 返回本地请求携带的隧道key
+func (c *TunnelClient) localKeyFor() string {
+	if c.localKey != "" {
+		return c.localKey
+	}
+	return c.key
+}
+
+// serveLocal 在 -local-listen 上接受本地请求，直到 Run 返回时关闭监听
+func (c *TunnelClient) serveLocal(ln net.Listener) *http.Server {
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(c.handleLocalRequest),
+		ReadHeaderTimeout: localReadHeaderTimeout,
+	}
+	logger.Info("Serving local requests through the tunnel",
+		"listen_addr", ln.Addr().String(),
+		"local_key", c.localKeyFor())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Local listener stopped",
+				"listen_addr", ln.Addr().String(),
+				"error", err)
+		}
+	}()
+	return srv
+}
+
+// handleLocalRequest 把本地请求经当前隧道连接发给服务器，由服务器按公网请求路由，再把响应写回本地调用方。
+// 请求体随请求消息一起发送，不能超过与服务器协商的消息上限
+func (c *TunnelClient) handleLocalRequest(w http.ResponseWriter, r *http.Request) {
+	s := c.session.Load()
+	if s == nil || s.closed() {
+		localRequestsCounter.WithLabelValue("not_connected").Inc()
+		http.Error(w, "Tunnel not connected", http.StatusBadGateway)
+		return
+	}
+	if !s.localForward {
+		localRequestsCounter.WithLabelValue("unsupported").Inc()
+		http.Error(w, "Server does not support local forwarding", http.StatusNotImplemented)
+		return
+	}
+	if r.Header.Get("Upgrade") != "" {
+		localRequestsCounter.WithLabelValue("unsupported").Inc()
+		http.Error(w, "Protocol upgrades are not supported on the local listener", http.StatusNotImplemented)
+		return
+	}
+
+	limit := int64(s.maxFrameSize - protocol.MessageOverhead)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			localRequestsCounter.WithLabelValue("too_large").Inc()
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		localRequestsCounter.WithLabelValue("bad_request").Inc()
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	// 请求体已完整读出，以 Content-Length 发送，服务器按公网请求解析
+	r.Header.Del("Transfer-Encoding")
+	if len(body) > 0 {
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if r.Header.Get(protocol.HeaderTunnelKey) == "" {
+		r.Header.Set(protocol.HeaderTunnelKey, c.localKeyFor())
+	}
+	payload, err := protocol.SerializeHTTPRequest(r)
+	if err != nil {
+		localRequestsCounter.WithLabelValue("bad_request").Inc()
+		http.Error(w, "Failed to serialize request", http.StatusBadRequest)
+		return
+	}
+
+	id := c.nextLocalID.Add(1) | protocol.LocalRequestIDFlag
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_LOCAL_REQ, Payload: payload})
+	if !s.fits(data) {
+		// 请求头加上请求体超过协商的上限
+		localRequestsCounter.WithLabelValue("too_large").Inc()
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	lr := s.registerLocal(id)
+	defer s.unregisterLocal(id, lr)
+	if !s.send(data) {
+		localRequestsCounter.WithLabelValue("not_connected").Inc()
+		http.Error(w, "Tunnel not connected", http.StatusBadGateway)
+		return
+	}
+	logger.Debug("Forwarded local request through the tunnel",
+		"key", c.key,
+		"request_id", id,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"target_key", r.Header.Get(protocol.HeaderTunnelKey))
+	localRequestsCounter.WithLabelValue(c.relayLocalResponse(w, r, s, id, lr)).Inc()
+}
+
+// relayLocalResponse 把服务器发回的响应写给本地调用方，返回请求的结果
+func (c *TunnelClient) relayLocalResponse(w http.ResponseWriter, r *http.Request, s *session, id uint64, lr *localResponse) string {
+	flusher, _ := w.(http.Flusher)
+	wroteHeader := false
+	for {
+		select {
+		case msg := <-lr.messages:
+			switch msg.Type {
+			case protocol.MSG_TYPE_LOCAL_RES:
+				resp, err := protocol.DeserializeHTTPResponse(msg.Payload)
+				if err != nil {
+					logger.Error("Failed to parse local response header",
+						"key", c.key,
+						"request_id", id,
+						"error", err)
+					http.Error(w, "Bad Gateway", http.StatusBadGateway)
+					return "failed"
+				}
+				for name, values := range resp.Header {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(resp.StatusCode)
+				wroteHeader = true
+			case protocol.MSG_TYPE_LOCAL_RES_CHUNK:
+				if len(msg.Payload) == 0 {
+					return "completed"
+				}
+				if _, err := w.Write(msg.Payload); err != nil {
+					// 本地调用方已断开，由下一轮循环中的请求上下文通知服务器
+					continue
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case protocol.MSG_TYPE_CANCEL:
+				// 服务器转发的响应中途失败，中断本地连接，不让截断的响应看起来完整
+				logger.Warn("Local response aborted by server",
+					"key", c.key,
+					"request_id", id,
+					"reason", string(msg.Payload))
+				if !wroteHeader {
+					http.Error(w, "Bad Gateway", http.StatusBadGateway)
+					return "aborted"
+				}
+				localRequestsCounter.WithLabelValue("aborted").Inc()
+				panic(http.ErrAbortHandler)
+			}
+		case <-r.Context().Done():
+			// 本地调用方断开，通知服务器停止转发
+			data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_CANCEL, Payload: []byte(protocol.CancelReasonClientDisconnect)})
+			s.send(data)
+			return "canceled"
+		case <-s.closeChan:
+			logger.Warn("Tunnel connection lost while waiting for local response",
+				"key", c.key,
+				"request_id", id)
+			if !wroteHeader {
+				http.Error(w, "Tunnel connection lost", http.StatusBadGateway)
+				return "failed"
+			}
+			localRequestsCounter.WithLabelValue("failed").Inc()
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
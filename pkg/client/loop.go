@@ -0,0 +1,24 @@
+package client
+
+import (
+	"net/http"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+)
+
+// checkProxyLoop 在转发到目标服务之前检查请求是否已经过本客户端或经过的实例过多，返回 false 时调用方以 508 拒绝。
+// 未形成环路时在请求头中追加本客户端的实例ID，目标地址指回某个服务器的公网地址时，该服务器据此发现环路
+func checkProxyLoop(rl *logger.RequestLog, req *http.Request, instanceID, targetAddr string) bool {
+	hops := protocol.Hops(req.Header)
+	if !protocol.LoopDetected(hops, instanceID) {
+		protocol.AddHop(req.Header, instanceID)
+		return true
+	}
+	rl.Error("Proxy loop detected, refusing to forward request",
+		"target_addr", targetAddr,
+		"host", req.Host,
+		"instance_id", instanceID,
+		"hops", hops)
+	return false
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"net/http"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// defaultMaxConcurrentRequests 是未配置时客户端同时处理的请求上限
+const defaultMaxConcurrentRequests = 512
+
+var (
+	activeRequestsGauge = metrics.NewGauge("singleproxy_client_active_requests",
+		"Tunneled requests currently being handled by the client")
+	requestsCounter = metrics.NewCounter("singleproxy_client_requests_total",
+		"Tunneled requests accepted for forwarding to the target")
+	sentBytesCounter = metrics.NewCounter("singleproxy_client_sent_bytes_total",
+		"Bytes of tunnel messages queued for sending to the server")
+	reconnectsCounter = metrics.NewCounter("singleproxy_client_reconnects_total",
+		"Connection attempts to the server after the first one")
+	rejectedRequestsCounter = metrics.NewCounter("singleproxy_client_rejected_requests_total",
+		"Tunneled requests rejected because the concurrency limit was reached")
+	unknownMessagesCounter = metrics.NewCounter("singleproxy_client_unknown_messages_total",
+		"Tunnel messages received from the server with an unknown type")
+	messageAuthFailuresCounter = metrics.NewCounter("singleproxy_client_message_auth_failures_total",
+		"Tunnel messages from the server dropped because their signature was missing or invalid")
+	canceledRequestsCounter = metrics.NewCounter("singleproxy_client_canceled_requests_total",
+		"Tunneled requests canceled because the public request was aborted")
+	droppedAbortEventsCounter = metrics.NewCounter("singleproxy_client_abort_events_dropped_total",
+		"Abort events not delivered to the target because of the rate limit")
+	streamedChunksCounter = metrics.NewCounter("singleproxy_client_streamed_chunks_total",
+		"Response body chunks streamed to the server")
+	streamedBytesCounter = metrics.NewCounter("singleproxy_client_streamed_bytes_total",
+		"Response body bytes streamed to the server")
+	targetHTTP1ResponsesCounter = metrics.NewCounter("singleproxy_client_target_http1_responses_total",
+		"Responses received from the target over HTTP/1.x")
+	targetHTTP2ResponsesCounter = metrics.NewCounter("singleproxy_client_target_http2_responses_total",
+		"Responses received from the target over HTTP/2 (h2c or negotiated via ALPN)")
+)
+
+// serveMetrics 在配置的地址上导出客户端指标
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	logger.Info("Serving client metrics", "listen_addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("Metrics listener stopped",
+			"listen_addr", addr,
+			"error", err)
+	}
+}
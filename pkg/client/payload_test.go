@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestInterleavedRequestPayloads 服务器连续发送大小不同的请求帧，readLoop 复用读取缓冲区的同时
+// 请求处理协程仍在读取之前的请求体，每个响应必须与对应请求的请求体一致。配合 -race 运行
+func TestInterleavedRequestPayloads(t *testing.T) {
+	const requests = 200
+	bodyFor := func(id uint64) string {
+		return fmt.Sprintf("request-%d-", id) + strings.Repeat(string(rune('a'+id%26)), int(id%7)*1024)
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 稍后再读取请求体，使处理协程与后续帧的读取重叠
+		time.Sleep(time.Millisecond)
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(target.Close)
+
+	errs := make(chan error, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for id := uint64(1); id <= requests; id++ {
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/echo/%d", id), strings.NewReader(bodyFor(id)))
+			req.Header.Set("Content-Length", strconv.Itoa(len(bodyFor(id))))
+			payload, err := protocol.SerializeHTTPRequest(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_HTTP_REQ, Payload: payload})
+			if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				errs <- err
+				return
+			}
+		}
+
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for done := 0; done < requests; {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				errs <- fmt.Errorf("read response after %d of %d: %w", done, requests, err)
+				return
+			}
+			msg, err := protocol.DeserializeTunnelMessage(data)
+			if err != nil || msg.Type != protocol.MSG_TYPE_HTTP_RES_FULL {
+				continue
+			}
+			resp, err := protocol.DeserializeHTTPResponse(msg.Payload)
+			if err != nil {
+				errs <- fmt.Errorf("request %d: %w", msg.ID, err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, []byte(bodyFor(msg.ID))) {
+				errs <- fmt.Errorf("request %d: got status %d and a %d byte body that does not match the request", msg.ID, resp.StatusCode, len(body))
+				return
+			}
+			done++
+		}
+		errs <- nil
+	}))
+	t.Cleanup(server.Close)
+
+	c, err := NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "interleaved",
+		ServerAddr: "ws://" + server.Listener.Addr().String(),
+		TargetAddr: target.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { c.session.Load().conn.Close() })
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("Timed out waiting for responses")
+	}
+}
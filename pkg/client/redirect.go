@@ -0,0 +1,63 @@
+package client
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"singleproxy/pkg/metrics"
+)
+
+// redirectsCounter 服务器通过 MSG_TYPE_GOAWAY 给出的备用地址的处理结果:
+// accepted 接受并在下次重连时使用，rejected 不在 -redirect-allow 中被忽略，fallback 备用地址连接失败后回到 -server
+var redirectsCounter = metrics.NewCounterVec("singleproxy_client_redirects_total",
+	"Server redirects to an alternate address, by result (accepted, rejected, fallback)", "result")
+
+// redirectAllowed 检查服务器给出的备用地址是否可以连接: 与 -server 主机相同，或匹配 -redirect-allow 中的任一模式。
+// 模式写法与 -ws-allowed-origins 相同: "*"、"b.example.com"、"*.example.com"、"wss://*.example.com"。
+// 未指定 scheme 的模式忽略端口，但不允许从 wss 降级到 ws，防止被劫持的服务器把客户端引到任意地址
+func (c *TunnelClient) redirectAllowed(u *url.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	downgrade := scheme == "ws" && c.originalAddr.Scheme == "wss"
+	if host == strings.ToLower(c.originalAddr.Host) && !downgrade {
+		return true
+	}
+
+	for _, pattern := range c.redirectAllow {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if patternScheme, patternHost, ok := strings.Cut(pattern, "://"); ok {
+			if patternScheme == scheme && redirectHostMatches(patternHost, host) {
+				return true
+			}
+			continue
+		}
+		if downgrade {
+			continue
+		}
+		if pattern == "*" || redirectHostMatches(pattern, host) || redirectHostMatches(pattern, hostWithoutPort(host)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectHostMatches 比较主机名，"*.example.com" 匹配任意一级或多级子域名但不匹配 example.com 本身
+func redirectHostMatches(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return false
+}
+
+// hostWithoutPort 去掉地址中的端口
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedirectAllowed(t *testing.T) {
+	tests := []struct {
+		server   string
+		allow    []string
+		redirect string
+		want     bool
+	}{
+		{"wss://a.example.com", nil, "wss://a.example.com:8443", false},
+		{"wss://a.example.com", nil, "wss://a.example.com", true},
+		{"wss://a.example.com", nil, "wss://b.example.com", false},
+		{"wss://a.example.com", []string{"b.example.com"}, "wss://b.example.com:8443", true},
+		{"wss://a.example.com", []string{"*.example.com"}, "wss://b.example.com", true},
+		{"wss://a.example.com", []string{"*.example.com"}, "wss://example.com", false},
+		{"wss://a.example.com", []string{"*.example.com"}, "wss://evil.com", false},
+		{"wss://a.example.com", []string{"*.example.com"}, "wss://b.example.com.evil.com", false},
+		// 未指定 scheme 的模式不允许从 wss 降级到 ws
+		{"wss://a.example.com", []string{"*.example.com"}, "ws://b.example.com", false},
+		{"wss://a.example.com", nil, "ws://a.example.com", false},
+		{"wss://a.example.com", []string{"ws://b.example.com"}, "ws://b.example.com", true},
+		{"ws://a.example.com", []string{"b.example.com"}, "ws://b.example.com", true},
+		{"wss://a.example.com", []string{"wss://*.example.com"}, "ws://b.example.com", false},
+		{"wss://a.example.com", []string{"*"}, "wss://evil.com", true},
+	}
+
+	for _, tt := range tests {
+		server, _ := url.Parse(tt.server)
+		redirect, _ := url.Parse(tt.redirect)
+		c := &TunnelClient{originalAddr: server, redirectAllow: tt.allow}
+		if got := c.redirectAllowed(redirect); got != tt.want {
+			t.Errorf("redirectAllowed(%s) with server %s and allow %v = %v, want %v", tt.redirect, tt.server, tt.allow, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/utils"
+)
+
+// defaultFullResponseThreshold 是合并为单条 MSG_TYPE_HTTP_RES_FULL 消息的响应体上限
+const defaultFullResponseThreshold = 64 * 1024
+
+// bodyAllowed 判断该响应是否允许携带响应体
+func bodyAllowed(method string, statusCode int) bool {
+	if method == http.MethodHead {
+		return false
+	}
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+// readSmallBody 尝试完整读取小响应体。complete 为 true 时 body 即完整响应体；
+// 否则 body 是已读取的前缀，调用方需先发送它再继续流式读取剩余部分。
+// 读取失败时返回错误，此时尚未向服务器发送任何内容，调用方可以改为返回错误响应
+func readSmallBody(method string, resp *http.Response, threshold int) (body []byte, complete bool, err error) {
+	if threshold < 0 {
+		return nil, false, nil
+	}
+	if !bodyAllowed(method, resp.StatusCode) {
+		return nil, true, nil
+	}
+	// SSE 事件流需要立即发出响应头，再逐条转发事件
+	if utils.IsEventStream(resp.Header) {
+		return nil, false, nil
+	}
+
+	// Content-Length 已知且足够小
+	if resp.ContentLength >= 0 {
+		if resp.ContentLength > int64(threshold) {
+			return nil, false, nil
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, resp.ContentLength))
+		if err != nil {
+			return nil, false, err
+		}
+		if int64(len(body)) < resp.ContentLength {
+			return nil, false, io.ErrUnexpectedEOF
+		}
+		return body, true, nil
+	}
+
+	// 长度未知: 只读一次，首次读取即到达 EOF 才视为完整，避免阻塞 SSE 等流式响应
+	buf := make([]byte, min(threshold, 32*1024))
+	n, err := resp.Body.Read(buf)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	return buf[:n], err == io.EOF, nil
+}
+
+// interimResponsePayload 构造 1xx 临时响应的消息负载
+func interimResponsePayload(code int, header http.Header) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(protocol.StatusLine(code, ""))
+	_ = header.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// closeDelimited 判断响应体是否以目标服务关闭连接结束: 没有 Content-Length 也不是分块编码，
+// 常见于 HTTP/1.0 的老旧设备。读取到 EOF 即为完整响应体，之后按长度未知的响应转发
+func closeDelimited(resp *http.Response) bool {
+	return resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && resp.Close
+}
+
+// fullResponsePayload 构造包含响应头和完整响应体的消息负载，长度未知时补充 Content-Length
+func fullResponsePayload(method string, resp *http.Response, body []byte) []byte {
+	header := resp.Header.Clone()
+	if bodyAllowed(method, resp.StatusCode) {
+		header.Del("Transfer-Encoding")
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(protocol.StatusLine(resp.StatusCode, resp.Status))
+	_ = header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
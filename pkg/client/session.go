@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"singleproxy/pkg/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// session 一次成功建立的隧道连接。每次连接创建新的会话，readLoop、writer、keepAlive
+// 和请求处理协程只访问创建它们的会话，旧会话的协程退出前不会影响新会话
+type session struct {
+	conn      *websocket.Conn
+	writeChan chan []byte
+	// keepAlive 通过该通道请求 writer 发送ping，ping与数据帧由同一协程写入
+	pingChan  chan struct{}
+	closeChan chan struct{}
+	closeOnce sync.Once
+
+	// 服务器是否确认启用消息签名、带序号的响应体数据块
+	messageAuth bool
+	chunkSeq    bool
+	// 启用签名时发送和接收方向的签名状态，authOut 只在 writeLoop 中使用，authIn 只在 readLoop 中使用
+	authOut *protocol.MessageAuth
+	authIn  *protocol.MessageAuth
+	// 注册时协商的单条消息大小上限，用于读取限制和发送时的切分
+	maxFrameSize int
+	// 服务器确认启用请求头索引表时的解码器，只在 readLoop 中使用，随会话丢弃
+	headerDecoder *protocol.HeaderDecoder
+	// 服务器确认启用本地转发，以及等待响应的本地请求 (本地请求ID → 响应)，见 handleLocalRequest
+	localForward bool
+	localMu      sync.Mutex
+	localPending map[uint64]*localResponse
+	// 服务器确认读取目标响应体失败时可以用 MSG_TYPE_CANCEL 中止响应
+	responseAbort bool
+	// 会话创建时间 (带单调时钟读数)。最近一次收到pong的时间记为距创建时间的单调时长，
+	// 在 readLoop 中写入、keepAlive 中读取，不受系统时钟跳变影响
+	created  time.Time
+	lastPong atomic.Int64
+
+	// readBuf 由 readLoop 复用的读取缓冲区，readMessage 返回的数据在下一次读取时被覆盖
+	readBuf bytes.Buffer
+}
+
+// maxRetainedReadBuffer 超过该容量的读取缓冲区在读完后丢弃，避免偶发的大消息长期占用内存
+const maxRetainedReadBuffer = 1 << 20
+
+func newSession(conn *websocket.Conn, messageAuth, chunkSeq bool, maxFrameSize int) *session {
+	return &session{
+		conn:         conn,
+		writeChan:    make(chan []byte, 256),
+		pingChan:     make(chan struct{}, 1),
+		closeChan:    make(chan struct{}),
+		messageAuth:  messageAuth,
+		chunkSeq:     chunkSeq,
+		maxFrameSize: maxFrameSize,
+		localPending: make(map[uint64]*localResponse),
+		created:      time.Now(),
+	}
+}
+
+// markPong 记录收到pong的时间
+func (s *session) markPong(now time.Time) {
+	s.lastPong.Store(int64(now.Sub(s.created)))
+}
+
+// sincePong 返回距最近一次收到pong的时长，尚未收到pong时返回 false
+func (s *session) sincePong(now time.Time) (time.Duration, bool) {
+	last := s.lastPong.Load()
+	if last == 0 {
+		return 0, false
+	}
+	return now.Sub(s.created) - time.Duration(last), true
+}
+
+// fits 判断序列化后的消息加上签名后是否不超过协商的大小上限
+func (s *session) fits(data []byte) bool {
+	return len(data)+protocol.MessageAuthTagSize <= s.maxFrameSize
+}
+
+// readMessage 读取下一条完整消息到复用的缓冲区。返回的切片只在下一次调用前有效，
+// 交给其他协程的数据必须先复制，protocol.DeserializeTunnelMessage 已为 Payload 复制。
+// 超过协商上限的消息被读完丢弃并返回 *protocol.FrameTooLargeError
+func (s *session) readMessage() ([]byte, error) {
+	if s.readBuf.Cap() > maxRetainedReadBuffer {
+		s.readBuf = bytes.Buffer{}
+	}
+	s.readBuf.Reset()
+	_, r, err := s.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	if err := protocol.ReadFrame(&s.readBuf, r, s.maxFrameSize); err != nil {
+		return nil, err
+	}
+	return s.readBuf.Bytes(), nil
+}
+
+// close 通知会话的所有协程退出，可以重复调用
+func (s *session) close() {
+	s.closeOnce.Do(func() { close(s.closeChan) })
+}
+
+// closed 判断会话是否已关闭
+func (s *session) closed() bool {
+	select {
+	case <-s.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// send 将消息放入会话的写入队列，会话已关闭时返回 false
+func (s *session) send(data []byte) bool {
+	select {
+	case <-s.closeChan:
+		return false
+	default:
+	}
+	select {
+	case s.writeChan <- data:
+		sentBytesCounter.Add(int64(len(data)))
+		return true
+	case <-s.closeChan:
+		return false
+	}
+}
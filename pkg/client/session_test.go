@@ -0,0 +1,89 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRapidReconnect(t *testing.T) {
+	var conns atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 每隔一个连接由服务器立即断开，其余的由客户端重连时关闭
+		if conns.Add(1)%2 == 0 {
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	c, err := NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "reconnect",
+		ServerAddr: "ws://" + server.Listener.Addr().String(),
+		TargetAddr: "127.0.0.1:1",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	c.keepAliveInterval = time.Millisecond
+
+	// 重连的同时持续向当前会话发送消息
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.sendTargetHealth()
+			}
+		}
+	}()
+
+	var sessions []*session
+	for i := 0; i < 50; i++ {
+		if err := c.Connect(); err != nil {
+			t.Fatalf("Connect #%d failed: %v", i, err)
+		}
+		sessions = append(sessions, c.session.Load())
+	}
+	close(stop)
+	wg.Wait()
+
+	// 被替换的会话都已关闭且不再接受消息，重复关闭是安全的
+	for i, s := range sessions[:len(sessions)-1] {
+		select {
+		case <-s.closeChan:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Session #%d was not closed after reconnect", i)
+		}
+		s.close()
+		if s.send([]byte("stale")) {
+			t.Errorf("Session #%d accepted a message after it was closed", i)
+		}
+	}
+	if got := c.session.Load(); got != sessions[len(sessions)-1] {
+		t.Errorf("Expected the newest session to be current")
+	}
+}
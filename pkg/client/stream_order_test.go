@@ -0,0 +1,126 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/protocol/protocoltest"
+)
+
+// orderBody 第 i 个响应的内容，大小从空到数百KB不等
+func orderBody(i int) []byte {
+	rng := rand.New(rand.NewSource(int64(i)))
+	body := make([]byte, rng.Intn(384<<10))
+	if i%10 == 3 {
+		body = body[:0]
+	}
+	rng.Read(body)
+	return body
+}
+
+func TestConcurrentResponsesKeepMessageOrder(t *testing.T) {
+	const n = 50
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var i int
+		fmt.Sscanf(r.URL.Path, "/stream/%d", &i)
+		if i%4 == 1 {
+			// 临时响应必须先于最终响应头
+			w.Header().Set("Link", "</app.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+		}
+		body := orderBody(i)
+		// 分成大小不一的多次写入，让各个请求的数据块在写入队列中交错
+		rng := rand.New(rand.NewSource(int64(i)))
+		for len(body) > 0 {
+			k := min(len(body), 1+rng.Intn(48<<10))
+			w.Write(body[:k])
+			w.(http.Flusher).Flush()
+			body = body[k:]
+		}
+	}))
+	t.Cleanup(target.Close)
+
+	c, err := NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "order",
+		ServerAddr: "ws://127.0.0.1:1",
+		TargetAddr: strings.TrimPrefix(target.URL, "http://"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	for _, chunkSeq := range []bool{true, false} {
+		t.Run(fmt.Sprintf("chunk_seq=%v", chunkSeq), func(t *testing.T) {
+			s := newSession(nil, false, chunkSeq, protocol.DefaultMaxFrameSize)
+			// 代替 writer 按写入顺序取出消息，与服务器的读取顺序相同
+			checker := protocoltest.NewChecker(chunkSeq)
+			full := make(map[uint64][]byte)
+			drained := make(chan error, 1)
+			go func() {
+				var violation error
+				for data := range s.writeChan {
+					msg, err := protocol.DeserializeTunnelMessage(data)
+					if err != nil {
+						violation = err
+						continue
+					}
+					if err := checker.Observe(msg); err != nil && violation == nil {
+						violation = err
+					}
+					if msg.Type == protocol.MSG_TYPE_HTTP_RES_FULL {
+						full[msg.ID] = msg.Payload
+					}
+				}
+				drained <- violation
+			}()
+
+			requests := make([]protocol.TunnelMessage, n)
+			for i := range requests {
+				req, _ := http.NewRequest("GET", fmt.Sprintf("http://order/stream/%d", i), nil)
+				payload, _ := protocol.SerializeHTTPRequest(req)
+				requests[i] = protocol.TunnelMessage{ID: uint64(i + 1), Type: protocol.MSG_TYPE_HTTP_REQ, Payload: payload}
+			}
+			var wg sync.WaitGroup
+			for _, reqMsg := range requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.serveHTTPRequest(context.Background(), s, reqMsg)
+				}()
+			}
+			wg.Wait()
+			close(s.writeChan)
+			if err := <-drained; err != nil {
+				t.Fatalf("Client violated the response message order: %v", err)
+			}
+			if err := checker.Finish(); err != nil {
+				t.Fatal(err)
+			}
+			if checker.Requests() != n {
+				t.Fatalf("Expected responses for %d requests, got %d", n, checker.Requests())
+			}
+
+			for i := 0; i < n; i++ {
+				id, want := uint64(i+1), orderBody(i)
+				got := checker.Body(id)
+				if payload, ok := full[id]; ok {
+					// 小响应以完整响应发送，响应体在头部之后
+					_, got, _ = bytes.Cut(payload, []byte("\r\n\r\n"))
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("Request %d: body mismatch, expected %d bytes, got %d", i, len(want), len(got))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/utils"
+)
+
+// classifyTargetError 按失败阶段对转发到目标服务的错误分类。net/http 返回的错误经过
+// url.Error、net.OpError、os.SyscallError 多层包装，逐层用 errors.As/Is 判断
+func classifyTargetError(err error) string {
+	if errors.Is(err, utils.ErrTargetRedirectLoop) {
+		return protocol.TargetErrRedirectLoop
+	}
+	if isTLSError(err) {
+		return protocol.TargetErrTLS
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return protocol.TargetErrConnectRefused
+		case opErr.Timeout():
+			return protocol.TargetErrConnectTimeout
+		default:
+			return protocol.TargetErrConnectFailed
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return protocol.TargetErrConnectFailed
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return protocol.TargetErrConnectRefused
+	}
+
+	// TLS 握手超时在连接阶段，其余超时发生在已连接后等待响应头时 (ResponseHeaderTimeout 或 Client.Timeout)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		if netErr.Error() == "net/http: TLS handshake timeout" {
+			return protocol.TargetErrConnectTimeout
+		}
+		return protocol.TargetErrResponseHeaderTimeout
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		(opErr != nil && opErr.Op == "read") {
+		return protocol.TargetErrRead
+	}
+	return protocol.TargetErrFailed
+}
+
+// isTLSError 判断错误是否来自与目标服务的TLS握手或证书校验
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/utils"
+)
+
+func TestClassifyTargetError(t *testing.T) {
+	get := func(client *http.Client, u string) error {
+		resp, err := client.Get(u)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("Expected request to %s to fail", u)
+		}
+		return err
+	}
+
+	// 连接被拒绝: 监听后立即关闭的端口
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+	if kind := classifyTargetError(get(http.DefaultClient, "http://"+closedAddr)); kind != protocol.TargetErrConnectRefused {
+		t.Errorf("Expected %s for refused connection, got %s", protocol.TargetErrConnectRefused, kind)
+	}
+
+	// 证书不受信任
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	if kind := classifyTargetError(get(http.DefaultClient, tlsServer.URL)); kind != protocol.TargetErrTLS {
+		t.Errorf("Expected %s for untrusted certificate, got %s", protocol.TargetErrTLS, kind)
+	}
+
+	// 已连接但迟迟不返回响应头
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	headerTimeout := &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}}
+	if kind := classifyTargetError(get(headerTimeout, slow.URL)); kind != protocol.TargetErrResponseHeaderTimeout {
+		t.Errorf("Expected %s for slow response, got %s", protocol.TargetErrResponseHeaderTimeout, kind)
+	}
+
+	// 目标在返回响应前断开连接
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer reset.Close()
+	if kind := classifyTargetError(get(http.DefaultClient, reset.URL)); kind != protocol.TargetErrRead {
+		t.Errorf("Expected %s for dropped connection, got %s", protocol.TargetErrRead, kind)
+	}
+
+	// 包装在 url.Error 中的连接超时和DNS错误
+	dialTimeout := &url.Error{Op: "Get", URL: "http://target", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}}
+	if kind := classifyTargetError(dialTimeout); kind != protocol.TargetErrConnectTimeout {
+		t.Errorf("Expected %s for dial timeout, got %s", protocol.TargetErrConnectTimeout, kind)
+	}
+	dnsErr := &url.Error{Op: "Get", URL: "http://target", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "target", IsNotFound: true}}}
+	if kind := classifyTargetError(dnsErr); kind != protocol.TargetErrConnectFailed {
+		t.Errorf("Expected %s for DNS failure, got %s", protocol.TargetErrConnectFailed, kind)
+	}
+
+	loop := &url.Error{Op: "Get", URL: "http://target/loop", Err: utils.ErrTargetRedirectLoop}
+	if kind := classifyTargetError(loop); kind != protocol.TargetErrRedirectLoop {
+		t.Errorf("Expected %s for redirect loop, got %s", protocol.TargetErrRedirectLoop, kind)
+	}
+
+	if kind := classifyTargetError(errors.New("something else")); kind != protocol.TargetErrFailed {
+		t.Errorf("Expected %s for unknown error, got %s", protocol.TargetErrFailed, kind)
+	}
+}
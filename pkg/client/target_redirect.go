@@ -0,0 +1,45 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"singleproxy/pkg/config"
+)
+
+// locationRewrite 将目标服务响应中指向内部地址的 Location 改写为公网地址 (-target-location-rewrite)。
+// 不跟随重定向时 3xx 响应原样返回公网调用方，内部地址需要改写后调用方才能访问；相对地址不改写
+type locationRewrite struct {
+	from, to *url.URL
+}
+
+// newLocationRewrite 解析改写规则，未配置时返回nil (配置已在 Validate 中检查)
+func newLocationRewrite(spec string) *locationRewrite {
+	if spec == "" {
+		return nil
+	}
+	from, to, err := config.ParseLocationRewrite(spec)
+	if err != nil {
+		return nil
+	}
+	return &locationRewrite{from: from, to: to}
+}
+
+// apply 改写 scheme 和主机与内部地址相同的 Location，保留路径和查询参数
+func (r *locationRewrite) apply(h http.Header) {
+	if r == nil {
+		return
+	}
+	v := h.Get("Location")
+	if v == "" {
+		return
+	}
+	u, err := url.Parse(v)
+	if err != nil || !strings.EqualFold(u.Scheme, r.from.Scheme) || !strings.EqualFold(u.Host, r.from.Host) {
+		return
+	}
+	u.Scheme = r.to.Scheme
+	u.Host = r.to.Host
+	h.Set("Location", u.String())
+}
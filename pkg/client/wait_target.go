@@ -0,0 +1,117 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+)
+
+// 注册前等待目标服务时的默认超时、探测间隔和进度日志间隔
+const (
+	defaultWaitForTargetTimeout = 2 * time.Minute
+	waitForTargetProbeInterval  = 500 * time.Millisecond
+	waitForTargetLogInterval    = 5 * time.Second
+)
+
+// targetWaiter 在注册隧道前等待目标服务可用，避免目标服务启动完成前转发的请求全部返回 502
+type targetWaiter struct {
+	addr      string
+	path      string // 非空时还需 GET 该路径返回非5xx
+	timeout   time.Duration
+	exit      bool // 超时后返回错误而不是继续注册
+	reconnect bool // 重连前同样等待
+	client    *http.Client
+}
+
+// newTargetWaiter 按配置创建等待器，未启用 -wait-for-target 时返回nil
+func newTargetWaiter(cfg *config.Config) *targetWaiter {
+	if !cfg.WaitForTarget {
+		return nil
+	}
+	timeout := cfg.WaitForTargetTimeout
+	if timeout <= 0 {
+		timeout = defaultWaitForTargetTimeout
+	}
+	return &targetWaiter{
+		addr:      cfg.TargetAddr,
+		path:      cfg.WaitForTargetPath,
+		timeout:   timeout,
+		exit:      cfg.WaitForTargetExit,
+		reconnect: cfg.WaitForTargetReconnect,
+		client:    &http.Client{Timeout: waitForTargetLogInterval},
+	}
+}
+
+// wait 反复探测目标服务直到可用、超时或 stop 关闭。超时且配置为退出时返回错误，
+// 否则记录警告后返回nil，按原有行为继续注册
+func (w *targetWaiter) wait(stop <-chan struct{}) error {
+	start := time.Now()
+	deadline := start.Add(w.timeout)
+	lastLog := start
+	logger.Info("Waiting for target service before registering",
+		"target_addr", w.addr,
+		"path", w.path,
+		"timeout", w.timeout)
+	for {
+		err := w.probe()
+		if err == nil {
+			logger.Info("Target service is reachable",
+				"target_addr", w.addr,
+				"waited", time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		now := time.Now()
+		if !now.Before(deadline) {
+			if w.exit {
+				return fmt.Errorf("target %s not reachable after %v: %v", w.addr, w.timeout, err)
+			}
+			logger.Warn("Target service still unreachable, registering anyway",
+				"target_addr", w.addr,
+				"timeout", w.timeout,
+				"error", err)
+			return nil
+		}
+		if now.Sub(lastLog) >= waitForTargetLogInterval {
+			logger.Info("Still waiting for target service",
+				"target_addr", w.addr,
+				"waited", now.Sub(start).Round(time.Second),
+				"error", err)
+			lastLog = now
+		}
+
+		timer := time.NewTimer(min(waitForTargetProbeInterval, time.Until(deadline)))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// probe 检查目标端口能否连接，配置了路径时再发送一次 GET 请求
+func (w *targetWaiter) probe() error {
+	conn, err := net.DialTimeout("tcp", w.addr, waitForTargetLogInterval)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	if w.path == "" {
+		return nil
+	}
+	resp, err := w.client.Get("http://" + w.addr + w.path)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
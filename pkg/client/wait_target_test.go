@@ -0,0 +1,77 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestTargetWaiterWaitsForPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// 目标服务稍后才开始监听
+	started := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, _ := net.Listen("tcp", addr)
+		started <- l
+	}()
+	defer func() {
+		if l := <-started; l != nil {
+			l.Close()
+		}
+	}()
+
+	w := newTargetWaiter(&config.Config{TargetAddr: addr, WaitForTarget: true, WaitForTargetTimeout: 5 * time.Second, WaitForTargetExit: true})
+	start := time.Now()
+	if err := w.wait(make(chan struct{})); err != nil {
+		t.Fatalf("Expected target to become reachable, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected to wait for the target, returned after %v", elapsed)
+	}
+}
+
+func TestTargetWaiterHealthPath(t *testing.T) {
+	var ready atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+	addr := strings.TrimPrefix(target.URL, "http://")
+
+	// 端口已可连接，但健康检查返回 503，超时后按配置退出
+	w := newTargetWaiter(&config.Config{TargetAddr: addr, WaitForTarget: true, WaitForTargetTimeout: 300 * time.Millisecond, WaitForTargetPath: "/healthz", WaitForTargetExit: true})
+	if err := w.wait(make(chan struct{})); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected timeout error mentioning the health status, got %v", err)
+	}
+
+	// 未配置退出时超时后继续注册
+	w.exit = false
+	if err := w.wait(make(chan struct{})); err != nil {
+		t.Errorf("Expected to proceed after timeout, got %v", err)
+	}
+
+	ready.Store(true)
+	w.exit = true
+	if err := w.wait(make(chan struct{})); err != nil {
+		t.Errorf("Expected healthy target, got %v", err)
+	}
+
+	if newTargetWaiter(&config.Config{TargetAddr: addr}) != nil {
+		t.Error("Expected no waiter without -wait-for-target")
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// throttledConn 模拟慢速上行链路，写入按字节数限速
+type throttledConn struct {
+	net.Conn
+	bytesPerSecond int
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(len(p)) * time.Second / time.Duration(c.bytesPerSecond))
+	return c.Conn.Write(p)
+}
+
+func TestLargeWriteOverThrottledLink(t *testing.T) {
+	const readTimeout = 300 * time.Millisecond
+	type result struct {
+		size  int
+		pings int
+		err   error
+	}
+	results := make(chan result, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 只在收到ping时延长读取超时，大消息期间没有ping则连接被断开
+		pings := 0
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		conn.SetPingHandler(func(data string) error {
+			pings++
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		_, data, err := conn.ReadMessage()
+		results <- result{size: len(data), pings: pings, err: err}
+	}))
+	t.Cleanup(server.Close)
+
+	c, err := NewTunnelClient(&config.Config{
+		Mode:              "client",
+		Key:               "throttled",
+		ServerAddr:        "ws://" + server.Listener.Addr().String(),
+		TargetAddr:        "127.0.0.1:1",
+		WSWriteBufferSize: 4 << 20,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	c.keepAliveInterval = 20 * time.Millisecond
+	c.netDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &throttledConn{Conn: conn, bytesPerSecond: 512 * 1024}, nil
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	// 约2秒的传输，远超服务器端的读取超时
+	message := bytes.Repeat([]byte("x"), 1<<20)
+	c.session.Load().send(message)
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			t.Fatalf("Server dropped the tunnel during a large write: %v (pings=%d)", res.err, res.pings)
+		}
+		if res.size != len(message) {
+			t.Errorf("Expected %d bytes, got %d", len(message), res.size)
+		}
+		if res.pings < 5 {
+			t.Errorf("Expected pings to interleave with data frames, got %d", res.pings)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the message")
+	}
+}
@@ -3,6 +3,16 @@ package config
 import (
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"singleproxy/pkg/schedule"
 )
 
 // Config 结构体用于存储应用程序配置
@@ -16,38 +26,653 @@ type Config struct {
 	KeyFile    string // TLS key file for server
 	Insecure   bool   // Skip TLS certificate verification for client
 
+	// 未携带 X-Tunnel-Key 且没有按主机名路由的公网请求转发到的key (server模式)
+	DefaultKey string // 为空为 "default", "none" 关闭默认路由, 这类请求返回404
+
+	// 按主机名 (SNI) 选择证书和隧道key (server模式)
+	Hosts         map[string]*HostConfig // 每个主机名的证书和路由 (仅支持配置文件)
+	TLSUnknownSNI string                 // 未配置的SNI: default (使用 -cert 证书, 默认) 或 reject (中止握手)
+
+	TLSFingerprintDeny []string // 拒绝这些 JA3 指纹 (MD5) 的TLS连接, 只在本服务器终止TLS时生效
+	TLSClientCA        string   // 请求客户端证书并用该CA文件验证, 未提供证书的连接照常处理 (为空则不请求)
+
+	// 转发给目标服务的协议和客户端证书头部 (server模式)
+	ForwardedHeaders bool     // 按连接设置 X-Forwarded-Proto 和 X-SSL-Client-* 头, 移除公网请求自带的同名头部
+	TrustedProxies   []string // 在前面终止TLS的反向代理网段, 信任它们传入的 X-Forwarded-Proto 和客户端证书头部
+
 	IPRateLimit  int // 每个IP每秒的请求限制
 	KeyRateLimit int // 每个key每秒的请求限制
 
+	// key速率限制的突发容量和平滑等待 (server模式, 可在 keys.<key> 中单独设置)
+	KeyRateBurst     int           // 令牌桶容量, 允许瞬间通过的请求数 (0为默认 2×key-rate-limit)
+	KeyRateSmoothing time.Duration // 令牌不足时最多等待该时长再转发, 超出才返回429 (0为立即返回429)
+
+	// 屡次超过速率限制的IP先被拖延再返回429 (server模式)
+	TarpitDelay     time.Duration // 返回429前拖延的时间 (0为不拖延)
+	TarpitThreshold int           // 一分钟内被限频超过该次数的IP开始被拖延 (0为默认10)
+	TarpitMaxConns  int           // 同时拖延的请求上限, 超出时立即返回429 (0为默认100)
+
 	// 日志配置
-	LogLevel    string // 日志级别: debug, info, warn, error
-	LogFile     string // 日志文件路径
-	LogFormat   string // 日志格式: text, json
-	ConfigFile  string // 配置文件路径
+	LogLevel   string // 日志级别: debug, info, warn, error
+	LogFile    string // 日志文件路径
+	LogFormat  string // 日志格式: text, json
+	ConfigFile string // 配置文件路径
+
+	LogMaxSize    int // 日志文件超过该大小 (MB) 时轮转, 按key的访问日志使用相同设置 (0为不轮转)
+	LogMaxBackups int // 轮转后保留的旧文件数 (0为默认5)
+
+	LogHeaders       string   // 头部日志模式: none, redacted (默认), full
+	LogRedactHeaders []string // 在默认脱敏列表上增加的头部，以 "-" 开头表示移除
+
+	KeyPattern string // 隧道key的正则约束 (为空则使用默认规则 ^[a-zA-Z0-9._-]{1,64}$)
+
+	MaxUnknownMessages int // 单个连接允许的未知类型消息数，超出后以协议错误关闭 (0为默认10)
+
+	// 经隧道转发的请求头部限制，服务器超出时返回431，客户端收到超出的请求同样以431拒绝
+	MaxHeaderCount      int // 头部行数上限 (0为不限制)
+	MaxHeaderFieldBytes int // 单个头部行的字节上限 (0为默认1MB)
+	MaxHeaderBytes      int // 全部头部的字节上限 (0为默认1MB, 与 net/http 一致)
+
+	// 隧道消息签名，服务器和客户端配置相同的key时对每条消息附加 HMAC-SHA256
+	MessageAuthKey         string // 共享密钥 (为空则不签名)
+	MessageAuthMaxFailures int    // 单个连接允许的签名校验失败次数，超出后以协议错误关闭 (0为默认3)
+
+	// 出站DNS缓存，客户端转发目标、SOCKS5 和正向代理共用
+	DNSCacheSize   int           // 缓存条目上限 (0为默认1024, 负数禁用)
+	DNSMinTTL      time.Duration // 缓存时长下限 (0为默认5秒)
+	DNSMaxTTL      time.Duration // 缓存时长上限 (0为默认5分钟)
+	DNSNegativeTTL time.Duration // 域名不存在时的缓存时长 (0为默认5秒)
+	DNSPrefer      string        // 地址族偏好: ipv4, ipv6 (为空保持解析顺序)
+	DNSServer      string        // 自定义DNS服务器 host:port (为空使用系统解析器)
+
+	// WebSocket 参数
+	WSPathPrefix      string   // WebSocket 隧道注册入口的路径前缀, 长轮询入口与其同级 (server模式, 为空则为 /ws/)
+	WSAllowedOrigins  []string // 允许发起隧道升级的 Origin (server模式, 为空则不限制)
+	WSReadBufferSize  int      // WebSocket 读缓冲区大小 (0为gorilla默认4096)
+	WSWriteBufferSize int      // WebSocket 写缓冲区大小 (0为gorilla默认4096)
+	MaxFrameSize      int      // 单条隧道消息的大小上限，注册时与对端协商取较小值 (0为默认10MB, 限制在256KB到64MB之间)
+	HeaderTableSize   int      // 请求头索引表的大小，客户端支持时以表项序号代替重复的请求头 (server模式, 0为不启用)
+
+	// 管理API
+	AdminToken  string              // 管理API访问令牌, 拥有完整权限 (为空且未配置 AdminTokens 时禁用管理API)
+	AdminTokens []*AdminTokenConfig // 带权限范围的管理令牌 (server模式, 仅支持配置文件)
+	CaptureDir  string              // 调试抓包文件目录 (为空则使用系统临时目录)
+
+	TopResponses *TopResponsesConfig // 最大响应统计的路径归一化规则 (server模式, 仅支持配置文件, 为空使用默认规则)
+	Watchdog     *WatchdogConfig     // 内存看门狗 (server模式, 仅支持配置文件, 为空则不启用)
+
+	// 隧道注册限制
+	MaxTunnelKeys     int // 同时注册的不同key上限 (server模式, 0为不限制)
+	RegistrationRate  int // 每个key每分钟允许的注册次数 (server模式, 0为默认10, 负数不限制)
+	RegistrationBurst int // 每个key注册的突发次数 (server模式, 0为默认3)
+
+	FDWarnPercent int // 打开的连接数达到文件描述符软限制的该百分比时告警 (server模式, 0为默认80)
+
+	// 停止前先向隧道客户端发送迁移通知，最多等待该时长让进行中的请求完成 (server模式, 0为立即关闭)
+	DrainOnStop time.Duration
+
+	// 在线的WebSocket隧道连接数超过 RedirectThreshold 时，要求新注册的客户端改为连接 RedirectTo (server模式)
+	RedirectTo        string // 备用服务器地址, e.g. wss://b.example.com (为空不重定向)
+	RedirectThreshold int    // 连接数阈值 (0为不自动重定向)
+	// 客户端接受的重定向地址, 支持 "*.example.com"、"wss://*.example.com" (client模式, 为空只接受 -server 本身)
+	RedirectAllow []string
+
+	// 集群: 服务器之间共享 key→服务器 的映射，本机没有该key的隧道时把公网请求转发到拥有它的服务器 (server模式)
+	ClusterPeers        []string      // 其他服务器的地址, e.g. https://b.example.com (为空不转发)
+	ClusterToken        string        // 服务器之间认证的共享令牌, 所有服务器需一致 (为空不启用集群)
+	ClusterSyncInterval time.Duration // 从其他服务器拉取key列表的间隔 (0为默认5秒)
+
+	// 单个隧道连接上响应消息违反协议的次数 (重复的响应头、响应头之前的数据块) 达到该值时以协议错误关闭 (server模式, 0为默认5)
+	MaxResponseViolations int
+	// 每个隧道连接等待写入的消息数上限，队列已满时公网请求立即收到503而不是等待 (0为默认256)
+	TunnelSendQueue int
+
+	// 全局流量模式: normal (默认) 或 paused。暂停时隧道照常注册和保活，公网HTTP、/proxy/ 和SOCKS5请求直接返回503，
+	// 可通过 PUT /admin/traffic 切换 (server模式)
+	TrafficMode string
+	PausedPage  string // 暂停时返回的HTML页面文件 (为空使用内置页面)
+
+	// 已从隧道读入、尚未写给公网调用方的响应数据的总字节数上限，达到后暂停读取隧道连接直到回落 (server模式, 0为默认256MB)
+	MaxBufferedFrameBytes int
+
+	// 响应体数据块合并: 服务器合并写给公网调用方的连续小数据块，客户端合并读取目标服务响应体的多次小读取，
+	// 累计达到 ChunkCoalesceBytes 或等待 ChunkCoalesceDelay 后一次写出或发送。事件流不合并
+	ChunkCoalesceBytes int           // 0为不合并, 每个数据块立即写出
+	ChunkCoalesceDelay time.Duration // 缓冲数据最长等待时间 (0为默认5ms)
+
+	// 按key的访问日志 (server模式)。文件在该key第一次请求时打开，由 keys.<name>.access_log_file 配置
+	AccessLogMaxOpenFiles int // 同时打开的访问日志文件上限, 超过时关闭最久未写入的 (0为默认64)
+	AccessLogRing         int // 每个key在内存中保留的最近访问记录数, 供 GET /admin/keys/{key}/access 查询 (0为不保留)
+
+	// 公网请求中的key、主机名和路径写入日志字段和指标标签前的归一化 (server模式)
+	LogCardinality      string // enforce (默认): 未配置且不在线的key和主机名记为 <unregistered>, 其请求路径只保留模板; warn: 保留原值只告警; off: 不处理
+	LogCardinalityLimit int    // 每分钟出现的不同未登记值超过该数时告警 (0为默认100)
+
+	// 隧道注册入口 (/ws/ 与 /http-tunnel/) 的访问限制 (server模式)
+	RegistrationListen       string   // 单独接受隧道注册的监听地址, e.g. 10.8.0.1:8443; 设置后主端口不再接受注册
+	RegistrationAllowedCIDRs []string // 允许注册隧道的来源网段, 按直连地址检查 (为空则不限制)
+	// 隧道连接超过该时长没有请求也没有数据消息 (ping/pong 不算) 时关闭, 清理只完成握手的扫描器 (server模式, 0为不限制)
+	TunnelIdleMax time.Duration
+
+	// 公网请求等待隧道响应的超时 (server模式)
+	ResponseHeaderTimeout time.Duration // 等待响应头的超时 (0为默认30秒)
+	ResponseTimeout       time.Duration // 整个响应的超时, 响应头已发出时超时会直接断开连接 (0为默认90秒)
+	ProxyErrorHeader      bool          // 代理自身产生的错误响应携带 X-Proxy-Error 头说明原因
+	TruncatedResponse     string        // 响应中途失败时分块传输的响应如何结束: close (断开连接, 默认) 或 trailer (带 X-Proxy-Error 尾部字段正常结束)
+	// 读取公网请求体时，每个该时长内至少要收到 1KB (或请求体的剩余部分)，否则返回408 (server模式, 0为默认30秒)
+	ClientBodyReadTimeout time.Duration
+	// 公网请求通过 X-Request-Timeout 或上游代理的截止时间给出的超时会限制在此范围内
+	RequestTimeoutMin time.Duration // 请求级超时下限 (0为默认1秒)
+	RequestTimeoutMax time.Duration // 请求级超时上限 (0为与整个响应的超时相同)
+
+	// 每个key的用量统计
+	UsageFile          string // 按天汇总的用量持久化文件, 重启后继续累计 (server模式, 为空则只保存在内存)
+	UsageRetentionDays int    // 用量数据保留天数 (0为默认400天)
+
+	// 正向代理与SOCKS5的目标地址策略
+	ProxyAllowCIDRs    []string      // 允许访问的内网网段, 默认拒绝环回、链路本地和私有地址 (server模式)
+	ConnectIdleTimeout time.Duration // CONNECT 隧道两个方向都没有数据超过该时长时关闭 (server模式, 0为默认5分钟)
+
+	// 自动生成key
+	AutoKey       bool          // 客户端请求服务器分配key (client模式)
+	AutoKeyFormat string        // 自动key格式: words (默认), hex
+	AutoKeyTTL    time.Duration // 自动key的有效期 (0为默认1小时)
+	PublicBaseURL string        // 服务器对外可访问的基础URL, e.g. https://tunnel.example.com
+
+	// 公网绑定 (类似 ssh -R)
+	Bindings []string              // 客户端申请的公网绑定, e.g. "host=app.example.com", "port=2222"
+	Keys     map[string]*KeyConfig // 每个key的策略配置 (server模式, 仅支持配置文件)
+
+	// 客户端并发与监控
+	MaxConcurrentRequests int    // 客户端同时处理的最大请求数 (0为默认512)
+	MetricsListen         string // 客户端指标监听地址, e.g. 127.0.0.1:9100 (为空则不监听)
+	LocalListen           string // 客户端本地监听地址, 收到的请求经隧道交给服务器按公网请求路由, e.g. 127.0.0.1:9000 (为空则不监听)
+	LocalKey              string // 本地请求未携带 X-Tunnel-Key 时使用的key (为空使用客户端自己的key)
+	FullResponseThreshold int    // 小于该字节数的响应合并为单条消息发送 (0为默认64KB, 负数禁用)
+	Weight                int    // 同一key有多个客户端时的负载均衡权重 (0为默认1)
+	TargetProtocol        string // 与目标服务之间的协议: h1、h2c 或 auto (为空为auto)
+	FollowTargetRedirects bool   // 在客户端跟随目标服务的重定向 (默认不跟随, 3xx 响应原样返回给公网调用方)
+	TargetLocationRewrite string // 改写目标服务响应的 Location: "内部地址=公网地址", e.g. "http://10.0.0.5:8080=https://app.example.com"
+
+	// 注册前等待目标服务可用 (client模式)
+	WaitForTarget          bool          // 首次注册前探测目标服务, 可用后再注册
+	WaitForTargetTimeout   time.Duration // 等待的最长时间 (0为默认2分钟)
+	WaitForTargetPath      string        // 除TCP连接外还需 GET 该路径返回非5xx, e.g. /healthz (为空只检查端口)
+	WaitForTargetExit      bool          // 超时后退出而不是继续注册
+	WaitForTargetReconnect bool          // 断线重连前同样等待
+
+	// 连续连接失败达到该次数时退出, 交给进程管理器处理 (client模式, 0为一直重试)
+	MaxReconnects int
+
+	// 公网请求中止通知
+	AbortWebhook    string // 公网用户中止请求时向目标服务 POST 事件的路径, e.g. /tunnel-events/abort (为空则不通知)
+	RequestIDHeader string // 转发给目标服务的请求中携带隧道请求ID的头, 用于与中止事件关联 (为空则不添加)
+
+	// 命令行上的一次性操作, 不属于运行配置
+	GenerateConfig bool   // 生成示例配置文件后退出
+	CheckKey       string // check子命令握手使用的key (为空则随机生成)
+}
+
+// KeyConfig 单个隧道key的策略配置
+type KeyConfig struct {
+	AllowedHosts []string `yaml:"allowed_hosts"` // 允许客户端申请的主机名, 支持 "*.example.com" 通配
+	AllowedPorts []string `yaml:"allowed_ports"` // 允许客户端申请的端口或端口范围, e.g. "2222", "20000-20100"
+
+	Transforms []*TransformConfig `yaml:"transforms"` // 转发时对请求体或响应体的改写, 按顺序执行
+
+	Balance      string  `yaml:"balance"`        // 允许同一key注册多个客户端: round_robin (平均分发), weighted (按客户端声明的权重) (为空时新连接替换旧连接)
+	Affinity     string  `yaml:"affinity"`       // 会话保持: cookie (签名cookie固定到连接), ip_hash (按客户端IP一致性哈希), 需同时设置 balance
+	MaxErrorRate float64 `yaml:"max_error_rate"` // 最近一分钟5xx和超时比例超过该值的连接暂不分配流量 (0为默认0.5, 1为不限制)
+
+	OfflinePage string `yaml:"offline_page"` // 隧道离线时返回的HTML页面文件, "default" 使用内置模板 (为空时返回502)
+
+	SSE          bool     `yaml:"sse"`           // 该key的所有响应按SSE事件流处理, 不受 response_timeout 限制 (text/event-stream 响应总会自动识别)
+	SSEHeartbeat Duration `yaml:"sse_heartbeat"` // 事件流空闲超过该时长时注入 ": keepalive" 注释行 (0为不注入)
+
+	RateBurst     int      `yaml:"rate_burst"`     // 覆盖 -key-rate-burst, 页面并发加载大量静态资源时调大 (0为使用全局设置)
+	RateSmoothing Duration `yaml:"rate_smoothing"` // 覆盖 -key-rate-smoothing (0为使用全局设置)
+
+	AllowIdle bool `yaml:"allow_idle"` // 该key的连接不受 tunnel_idle_max 限制, 适合长时间没有流量的正常隧道
+
+	FallbackUpstream string `yaml:"fallback_upstream"` // 隧道离线或所有连接都被排除时直接转发到的地址, e.g. https://mirror.example.com (为空则不转发)
+
+	Idempotency *IdempotencyConfig `yaml:"idempotency"` // 携带 Idempotency-Key 头的重复提交返回第一次的响应, 不再转发 (为空则不去重)
+
+	Coalesce *CoalesceConfig `yaml:"coalesce"` // 相同的并发 GET/HEAD 请求只转发一次, 共享同一个响应 (为空则不合并)
+
+	AccessLogFile string `yaml:"access_log_file"` // 该key单独的访问日志文件, 每行一条JSON记录 (为空则不写)
+
+	Schedule *ScheduleConfig `yaml:"schedule"` // 开放时间, 时段外的公开请求返回维护页面 (为空则始终开放)
+}
+
+// ScheduleConfig 按星期和时段限制key的公开访问时间，注册和管理接口不受影响
+type ScheduleConfig struct {
+	Timezone     string   `yaml:"timezone"`      // IANA 时区名, e.g. Asia/Shanghai (为空使用服务器本地时区)
+	Windows      []string `yaml:"windows"`       // 开放时段, e.g. "Mon-Fri 09:00-18:00", "Sat,Sun 10:00-14:00", "* 22:00-06:00"
+	AffectsReady bool     `yaml:"affects_ready"` // 时段外 /admin/ready 返回503, 负载均衡器可据此摘除节点
 }
 
-// ParseFlags 解析命令行参数
+// IdempotencyConfig 按 Idempotency-Key 头对 POST/PUT/PATCH/DELETE 请求去重。
+// 同一key下 方法+路径+Idempotency-Key 相同的请求只转发一次，之后的请求重放保存的响应
+type IdempotencyConfig struct {
+	Paths        []string `yaml:"paths"`          // 只对这些路径前缀去重, e.g. "/api/payments" (为空则对所有路径去重)
+	TTL          Duration `yaml:"ttl"`            // 响应保留时长 (0为默认24小时)
+	MaxBodyBytes int      `yaml:"max_body_bytes"` // 保留的响应体上限, 超过时不保留, 重复提交收到409 (0为默认64KB)
+	MaxEntries   int      `yaml:"max_entries"`    // 最多保留的响应数, 超过时淘汰最早的 (0为默认1000)
+}
+
+// CoalesceConfig 合并相同的并发 GET/HEAD 请求，缓存过期时大量请求同时到达也只经隧道转发一次。
+// 方法、主机、路径和查询参数以及影响响应内容的请求头都相同的请求视为相同
+type CoalesceConfig struct {
+	Paths        []string `yaml:"paths"`          // 只合并这些路径前缀下的请求, e.g. "/assets" (为空则合并所有路径)
+	Headers      []string `yaml:"headers"`        // 除默认的 Accept、Accept-Encoding、Accept-Language、Authorization、Cookie、Range 之外区分请求的头部
+	MaxBodyBytes int      `yaml:"max_body_bytes"` // 共享的响应体上限, 超过时其余请求各自转发 (0为默认1MB)
+}
+
+// HostConfig 单个主机名的证书和隧道路由，主机名支持 "*.example.com" 通配一级子域名
+type HostConfig struct {
+	TunnelKey  string `yaml:"tunnel_key"`  // 该主机名的请求转发到的隧道key (为空则只提供证书)
+	DefaultKey string `yaml:"default_key"` // 该主机名未携带key的请求转发到的key, 覆盖全局 default_key, "none" 关闭 (为空使用全局设置)
+	CertFile   string `yaml:"cert_file"`   // 该主机名的TLS证书 (为空则使用默认证书)
+	KeyFile    string `yaml:"key_file"`    // 该主机名的TLS私钥
+}
+
+// TopResponsesConfig 最大响应统计中路径的归一化规则。查询参数总会去掉，
+// 然后依次执行改写规则、截取前 PathDepth 段、截断到 MaxPathLength
+type TopResponsesConfig struct {
+	MaxPathLength int            `yaml:"max_path_length"` // 路径最大长度 (0为默认128)
+	PathDepth     int            `yaml:"path_depth"`      // 只保留前几段路径, e.g. 2 时 /api/users/42 记为 /api/users (0为不限制)
+	Rewrites      []*PathRewrite `yaml:"rewrites"`        // 路径改写规则, 按顺序执行, e.g. 把数字ID替换为 :id
+}
+
+// WatchdogConfig 内存看门狗: 定期采样内存、协程数和内部表的大小，超过软阈值时记录快照，
+// 超过硬阈值时写入堆profile。阈值为0的项不检查
+type WatchdogConfig struct {
+	Interval     Duration           `yaml:"interval"`       // 采样间隔 (0为默认30秒)
+	DataDir      string             `yaml:"data_dir"`       // 堆profile写入目录 (为空则使用系统临时目录)
+	FreeOSMemory bool               `yaml:"free_os_memory"` // 超过硬阈值写入profile后调用 debug.FreeOSMemory 归还内存
+	Soft         WatchdogThresholds `yaml:"soft"`
+	Hard         WatchdogThresholds `yaml:"hard"`
+}
+
+// WatchdogThresholds 看门狗各采样项的阈值
+type WatchdogThresholds struct {
+	HeapBytes      int64 `yaml:"heap_bytes"`      // 堆上存活对象占用的字节数 (MemStats.HeapAlloc)
+	SysBytes       int64 `yaml:"sys_bytes"`       // 从系统获取的内存 (MemStats.Sys)，接近 RSS 上限
+	Goroutines     int64 `yaml:"goroutines"`      // 协程数
+	TunnelKeys     int64 `yaml:"tunnel_keys"`     // 有 WebSocket 隧道的key数
+	HTTPTunnels    int64 `yaml:"http_tunnels"`    // HTTP长轮询隧道数
+	StreamHandlers int64 `yaml:"stream_handlers"` // 等待隧道响应的请求数
+	RateLimiters   int64 `yaml:"rate_limiters"`   // 按key和按IP的速率限制器总数
+}
+
+// validate 检查阈值不为负数，name 为配置项前缀
+func (t WatchdogThresholds) validate(name string) error {
+	values := []struct {
+		field string
+		value int64
+	}{
+		{"heap_bytes", t.HeapBytes},
+		{"sys_bytes", t.SysBytes},
+		{"goroutines", t.Goroutines},
+		{"tunnel_keys", t.TunnelKeys},
+		{"http_tunnels", t.HTTPTunnels},
+		{"stream_handlers", t.StreamHandlers},
+		{"rate_limiters", t.RateLimiters},
+	}
+	for _, v := range values {
+		if v.value < 0 {
+			return fmt.Errorf("错误: %s.%s 不能为负数, 当前为 %d", name, v.field, v.value)
+		}
+	}
+	return nil
+}
+
+// PathRewrite 一条路径改写规则
+type PathRewrite struct {
+	Pattern     string `yaml:"pattern"`     // 正则表达式
+	Replacement string `yaml:"replacement"` // 替换内容, 支持 $1 引用分组
+}
+
+// TLSEnabled 判断服务器是否启用TLS: 配置了默认证书或任一主机名的证书
+func (c *Config) TLSEnabled() bool {
+	if c.CertFile != "" {
+		return true
+	}
+	for _, h := range c.Hosts {
+		if h != nil && h.CertFile != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultKeyNone 关闭默认路由，未指定key的公网请求返回404
+const DefaultKeyNone = "none"
+
+// DefaultRouteKey 返回未指定key的公网请求转发到的key，关闭默认路由时返回空
+func (c *Config) DefaultRouteKey() string {
+	switch c.DefaultKey {
+	case "":
+		return "default"
+	case DefaultKeyNone:
+		return ""
+	}
+	return c.DefaultKey
+}
+
+// DefaultWSPathPrefix 未配置 -ws-path-prefix 时 WebSocket 隧道注册入口的路径前缀
+const DefaultWSPathPrefix = "/ws/"
+
+// reservedPathPrefixes 服务器自身处理的路径，隧道注册入口不能与之重叠
+var reservedPathPrefixes = []string{"/admin/", "/proxy/"}
+
+// TunnelPathPrefixes 返回 WebSocket 隧道注册入口和 HTTP 长轮询入口的路径前缀，均以 / 开头和结尾。
+// 长轮询入口与 WebSocket 入口同级: /ws/ 对应 /http-tunnel/，/tunnel/ws/ 对应 /tunnel/http-tunnel/，
+// 与客户端在服务器地址路径后拼接 /ws/{key} 和 /http-tunnel/... 的规则一致
+func (c *Config) TunnelPathPrefixes() (ws, longPoll string) {
+	ws = DefaultWSPathPrefix
+	if c.WSPathPrefix != "" {
+		ws = path.Clean("/"+c.WSPathPrefix) + "/"
+		if ws == "//" {
+			ws = "/"
+		}
+	}
+	parent := path.Dir(strings.TrimSuffix(ws, "/"))
+	longPoll = strings.TrimSuffix(parent, "/") + "/http-tunnel/"
+	return ws, longPoll
+}
+
+// validateTunnelPaths 检查隧道入口不会吞掉公网请求或与服务器自身的路径冲突
+func (c *Config) validateTunnelPaths() error {
+	ws, longPoll := c.TunnelPathPrefixes()
+	if ws == "/" {
+		return fmt.Errorf("错误: -ws-path-prefix 不能是根路径, 否则所有公网请求都会被当作隧道注册")
+	}
+	if strings.HasPrefix(ws, longPoll) || strings.HasPrefix(longPoll, ws) {
+		return fmt.Errorf("错误: -ws-path-prefix %q 与长轮询入口 %q 重叠", c.WSPathPrefix, longPoll)
+	}
+	for _, reserved := range reservedPathPrefixes {
+		if strings.HasPrefix(ws, reserved) || strings.HasPrefix(reserved, ws) ||
+			strings.HasPrefix(longPoll, reserved) || strings.HasPrefix(reserved, longPoll) {
+			return fmt.Errorf("错误: -ws-path-prefix %q 与服务器路径 %s 冲突", c.WSPathPrefix, reserved)
+		}
+	}
+	return nil
+}
+
+// OfflinePageDefault 表示使用内置的离线页面模板
+const OfflinePageDefault = "default"
+
+// MaxOfflinePageBytes 离线页面文件的大小上限
+const MaxOfflinePageBytes = 1 << 20
+
+// ja3HashPattern JA3 指纹的MD5十六进制形式
+var ja3HashPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// minMessageAuthKeyLen 消息签名密钥的最小长度
+const minMessageAuthKeyLen = 16
+
+// MaxRateLimit 速率限制参数的上限，超出通常是把单位或数量级写错了
+const MaxRateLimit = 1000000
+
+// MaxKeyRateSmoothing 速率限制平滑等待的上限，更长的等待应当调大突发容量或速率
+const MaxKeyRateSmoothing = 5 * time.Second
+
+// MaxCoalesceBodyBytes 合并请求时缓冲的响应体上限，等待中的请求都持有同一份副本
+const MaxCoalesceBodyBytes = 64 << 20
+
+// MaxHeaderTableSize 请求头索引表大小的上限，与 protocol.MaxHeaderTableSize 相同
+const MaxHeaderTableSize = 64 << 10
+
+// MultiClient 判断该key是否允许同时注册多个客户端
+func (k *KeyConfig) MultiClient() bool {
+	return k != nil && k.Balance != ""
+}
+
+// TransformConfig 单条请求体/响应体改写规则
+type TransformConfig struct {
+	Type         string   `yaml:"type"`           // replace (字符串替换), regex (正则替换), url_rewrite (地址改写)
+	Direction    string   `yaml:"direction"`      // response (默认) 或 request
+	PathPrefix   string   `yaml:"path_prefix"`    // 只改写该路径前缀下的请求, 为空匹配所有路径
+	ContentTypes []string `yaml:"content_types"`  // 改写的内容类型, 支持 "text/*"、"*+json" (默认常见文本类型)
+	From         string   `yaml:"from"`           // 查找的字符串、正则表达式或内部地址
+	To           string   `yaml:"to"`             // 替换内容, 正则可引用分组 ${1}
+	MaxBodyBytes int      `yaml:"max_body_bytes"` // 正则替换缓冲的消息体上限, 超出时原样转发 (0为默认1MB)
+}
+
+// AdminTokenConfig 带权限范围的管理令牌
+type AdminTokenConfig struct {
+	Name  string   `yaml:"name"`  // 令牌名称, 用于审计日志
+	Token string   `yaml:"token"` // 令牌值
+	Full  bool     `yaml:"full"`  // 完整管理权限
+	Keys  []string `yaml:"keys"`  // 可管理的key模式, 支持 "team-a-*" 通配
+}
+
+// validate 检查改写规则的类型、方向和匹配内容
+func (t *TransformConfig) validate() error {
+	if t == nil {
+		return fmt.Errorf("不能为空")
+	}
+	switch t.Type {
+	case "replace", "url_rewrite":
+	case "regex":
+		if _, err := regexp.Compile(t.From); err != nil {
+			return fmt.Errorf("正则表达式不合法: %v", err)
+		}
+	default:
+		return fmt.Errorf("type 必须是 'replace'、'regex' 或 'url_rewrite'")
+	}
+	if t.Direction != "" && t.Direction != "request" && t.Direction != "response" {
+		return fmt.Errorf("direction 必须是 'request' 或 'response'")
+	}
+	if t.From == "" {
+		return fmt.Errorf("from 不能为空")
+	}
+	return nil
+}
+
+// KeyConfig 返回指定key的策略配置，不存在时返回nil
+func (c *Config) KeyConfig(key string) *KeyConfig {
+	if c.Keys == nil {
+		return nil
+	}
+	return c.Keys[key]
+}
+
+// ParseFlags 解析 os.Args 中的命令行参数，参数错误时打印用法并退出
 func ParseFlags() *Config {
+	// ExitOnError 在出错时以 2 退出、-h 时以 0 退出，不会返回错误
+	config, _ := ParseFlagsFrom(flag.NewFlagSet(os.Args[0], flag.ExitOnError), os.Args[1:])
+	return config
+}
+
+// ParseFlagsFrom 在 fs 上定义全部参数并解析 args。每次调用使用新的 FlagSet 即可重复解析，
+// 参数错误时返回错误而不是退出，由调用方决定如何处理 (fs 为 ContinueOnError 时 -h 返回 flag.ErrHelp)
+func ParseFlagsFrom(fs *flag.FlagSet, args []string) (*Config, error) {
 	config := &Config{}
-	flag.StringVar(&config.Mode, "mode", "server", "运行模式: server, client, 或 http-client")
-	flag.StringVar(&config.ListenPort, "port", "443", "服务器监听端口")
-	flag.StringVar(&config.ServerAddr, "server", "", "服务器地址, e.g. wss://yourdomain.com (client模式)")
-	flag.StringVar(&config.TargetAddr, "target", "", "目标服务地址, e.g. 127.0.0.1:8080 (client模式)")
-	flag.StringVar(&config.Key, "key", "default", "隧道密钥")
-	flag.StringVar(&config.CertFile, "cert", "", "TLS证书文件路径 (server模式)")
-	flag.StringVar(&config.KeyFile, "key-file", "", "TLS私钥文件路径 (server模式)")
-	flag.BoolVar(&config.Insecure, "insecure", false, "跳过TLS证书验证 (client模式)")
-	flag.IntVar(&config.IPRateLimit, "ip-rate-limit", 0, "每个IP每秒的请求限制 (0为无限制)")
-	flag.IntVar(&config.KeyRateLimit, "key-rate-limit", 0, "每个key每秒的请求限制 (0为无限制)")
-	
+	fs.StringVar(&config.Mode, "mode", "server", "运行模式: server, client, 或 http-client")
+	fs.StringVar(&config.ListenPort, "port", "443", "服务器监听端口")
+	fs.StringVar(&config.ServerAddr, "server", "", "服务器地址, e.g. wss://yourdomain.com (client模式)")
+	fs.StringVar(&config.TargetAddr, "target", "", "目标服务地址, e.g. 127.0.0.1:8080 (client模式)")
+	fs.StringVar(&config.Key, "key", "default", "隧道密钥")
+	fs.StringVar(&config.CertFile, "cert", "", "TLS证书文件路径 (server模式)")
+	fs.StringVar(&config.KeyFile, "key-file", "", "TLS私钥文件路径 (server模式)")
+	fs.BoolVar(&config.Insecure, "insecure", false, "跳过TLS证书验证 (client模式)")
+	fs.StringVar(&config.DefaultKey, "default-key", "", "未携带 X-Tunnel-Key 且未按主机名路由的公网请求转发到的key, none 关闭默认路由 (server模式, 默认default)")
+	fs.StringVar(&config.TLSClientCA, "tls-client-ca", "", "请求客户端证书并用该CA文件验证, 证书信息随 -forwarded-headers 转发给目标服务 (server模式)")
+	fs.BoolVar(&config.ForwardedHeaders, "forwarded-headers", false, "向目标服务设置 X-Forwarded-Proto 和 X-SSL-Client-* 头, 移除公网请求自带的同名头部 (server模式)")
+	fs.Func("trusted-proxies", "在前面终止TLS的反向代理网段, 逗号分隔, 信任其传入的 X-Forwarded-Proto 和客户端证书头部, e.g. 10.0.0.5,172.16.0.0/12 (server模式)", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.TrustedProxies = append(config.TrustedProxies, item)
+			}
+		}
+		return nil
+	})
+	fs.StringVar(&config.TLSUnknownSNI, "tls-unknown-sni", "", "未在 hosts 中配置的SNI: default 使用 -cert 证书, reject 中止握手 (server模式, 默认default)")
+	fs.Func("tls-fingerprint-deny", "拒绝的TLS客户端 JA3 指纹 (32位十六进制MD5), 逗号分隔 (server模式, 只在本服务器终止TLS时生效)", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.TLSFingerprintDeny = append(config.TLSFingerprintDeny, item)
+			}
+		}
+		return nil
+	})
+	fs.IntVar(&config.IPRateLimit, "ip-rate-limit", 0, "每个IP每秒的请求限制 (0为无限制)")
+	fs.DurationVar(&config.TarpitDelay, "tarpit-delay", 0, "屡次超过速率限制的IP在返回429前被拖延的时间 (server模式, 0为不拖延)")
+	fs.IntVar(&config.TarpitThreshold, "tarpit-threshold", 0, "一分钟内被限频超过该次数的IP开始被拖延 (server模式, 默认10)")
+	fs.IntVar(&config.TarpitMaxConns, "tarpit-max-conns", 0, "同时拖延的请求上限, 超出时立即返回429 (server模式, 默认100)")
+	fs.IntVar(&config.KeyRateLimit, "key-rate-limit", 0, "每个key每秒的请求限制 (0为无限制)")
+	fs.IntVar(&config.KeyRateBurst, "key-rate-burst", 0, "每个key允许瞬间通过的请求数 (server模式, 默认为 key-rate-limit 的2倍)")
+	fs.DurationVar(&config.KeyRateSmoothing, "key-rate-smoothing", 0, "key速率限制的令牌不足时最多等待该时长再转发, e.g. 200ms (server模式, 0为立即返回429)")
+
 	// 日志相关参数
-	flag.StringVar(&config.LogLevel, "log-level", "info", "日志级别: debug, info, warn, error")
-	flag.StringVar(&config.LogFile, "log-file", "", "日志文件路径 (空则输出到stdout)")
-	flag.StringVar(&config.LogFormat, "log-format", "text", "日志格式: text, json")
-	flag.StringVar(&config.ConfigFile, "config", "", "配置文件路径 (YAML格式)")
+	fs.StringVar(&config.LogLevel, "log-level", "info", "日志级别: debug, info, warn, error")
+	fs.StringVar(&config.LogFile, "log-file", "", "日志文件路径 (空则输出到stdout)")
+	fs.StringVar(&config.LogFormat, "log-format", "text", "日志格式: text, json")
+	fs.IntVar(&config.LogMaxSize, "log-max-size", 0, "日志文件超过该大小 (MB) 时轮转, 按key的访问日志使用相同设置 (0为不轮转)")
+	fs.IntVar(&config.LogMaxBackups, "log-max-backups", 0, "轮转后保留的旧日志文件数 (默认5)")
+	fs.StringVar(&config.LogHeaders, "log-headers", "", "头部日志模式: none, redacted, full (默认redacted)")
+	fs.Func("log-redact-headers", "额外脱敏的头部, 逗号分隔, 以-开头表示从默认列表移除, e.g. X-Api-Key,-Cookie", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.LogRedactHeaders = append(config.LogRedactHeaders, item)
+			}
+		}
+		return nil
+	})
+	fs.StringVar(&config.ConfigFile, "config", "", "配置文件路径 (YAML格式)")
+	fs.StringVar(&config.KeyPattern, "key-pattern", "", "隧道key的正则约束 (默认 ^[a-zA-Z0-9._-]{1,64}$)")
+	fs.IntVar(&config.MaxUnknownMessages, "max-unknown-messages", 0, "单个隧道连接允许的未知类型消息数, 超出后断开 (默认10)")
+	fs.IntVar(&config.MaxHeaderCount, "max-header-count", 0, "经隧道转发的请求头部行数上限, 超出返回431 (默认不限制)")
+	fs.IntVar(&config.MaxHeaderFieldBytes, "max-header-field-bytes", 0, "经隧道转发的单个请求头部字节上限, 超出返回431 (默认1MB)")
+	fs.IntVar(&config.MaxHeaderBytes, "max-header-bytes", 0, "经隧道转发的请求头部总字节上限, 超出返回431 (默认1MB)")
+	fs.StringVar(&config.MessageAuthKey, "message-auth-key", "", "隧道消息签名的共享密钥, 服务器和客户端需一致 (为空则不签名)")
+	fs.IntVar(&config.MessageAuthMaxFailures, "message-auth-max-failures", 0, "单个隧道连接允许的签名校验失败次数, 超出后断开 (默认3)")
+	fs.IntVar(&config.DNSCacheSize, "dns-cache-size", 0, "出站DNS缓存条目上限, 负数禁用 (默认1024)")
+	fs.DurationVar(&config.DNSMinTTL, "dns-min-ttl", 0, "DNS缓存时长下限 (默认5s)")
+	fs.DurationVar(&config.DNSMaxTTL, "dns-max-ttl", 0, "DNS缓存时长上限 (默认5m)")
+	fs.DurationVar(&config.DNSNegativeTTL, "dns-negative-ttl", 0, "域名不存在时的缓存时长 (默认5s)")
+	fs.StringVar(&config.DNSPrefer, "dns-prefer", "", "出站连接的地址族偏好: ipv4 或 ipv6 (默认保持解析顺序)")
+	fs.StringVar(&config.DNSServer, "dns-server", "", "出站连接使用的DNS服务器, e.g. 1.1.1.1:53 (默认系统解析器)")
+	fs.StringVar(&config.WSPathPrefix, "ws-path-prefix", "", "WebSocket隧道注册入口的路径前缀, e.g. /tunnel/ws/, 长轮询入口为同级的 http-tunnel/ (server模式, 默认/ws/)")
+	fs.Func("ws-allowed-origins", "允许发起隧道升级的Origin, 逗号分隔, 支持 *.example.com (server模式)", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.WSAllowedOrigins = append(config.WSAllowedOrigins, item)
+			}
+		}
+		return nil
+	})
+	fs.IntVar(&config.WSReadBufferSize, "ws-read-buffer-size", 0, "WebSocket读缓冲区大小, 字节 (默认4096)")
+	fs.IntVar(&config.WSWriteBufferSize, "ws-write-buffer-size", 0, "WebSocket写缓冲区大小, 字节 (默认4096)")
+	fs.IntVar(&config.MaxFrameSize, "max-frame-size", 0, "单条隧道消息的大小上限, 字节, 注册时与对端协商取较小值 (默认10MB, 范围256KB-64MB)")
+	fs.IntVar(&config.HeaderTableSize, "header-table-size", 0, "请求头索引表的大小, 字节, 客户端支持时重复的请求头只发送表项序号 (server模式, 0为不启用, 建议16384, 最大65536)")
+	fs.StringVar(&config.AdminToken, "admin-token", "", "管理API访问令牌 (server模式, 为空则禁用)")
+	fs.BoolVar(&config.AutoKey, "auto-key", false, "由服务器分配唯一key (client模式)")
+	fs.IntVar(&config.FDWarnPercent, "fd-warn-percent", 0, "打开的连接数达到文件描述符软限制的百分比时告警 (server模式, 默认80)")
+	fs.DurationVar(&config.DrainOnStop, "drain-on-stop", 0, "停止前通知隧道客户端迁移并等待进行中的请求完成的最长时间 (server模式, 0为立即关闭)")
+	fs.StringVar(&config.RedirectTo, "redirect-to", "", "连接数超过 -redirect-threshold 时新注册的客户端改为连接的备用服务器, e.g. wss://b.example.com (server模式)")
+	fs.Func("cluster-peers", "其他服务器的地址, 逗号分隔, 本机没有该key的隧道时转发到拥有它的服务器, e.g. https://b.example.com (server模式)", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.ClusterPeers = append(config.ClusterPeers, item)
+			}
+		}
+		return nil
+	})
+	fs.StringVar(&config.ClusterToken, "cluster-token", "", "服务器之间认证的共享令牌, 所有服务器需一致 (server模式, 为空不启用集群)")
+	fs.DurationVar(&config.ClusterSyncInterval, "cluster-sync-interval", 0, "从其他服务器拉取key列表的间隔 (server模式, 默认5s)")
+	fs.IntVar(&config.RedirectThreshold, "redirect-threshold", 0, "在线隧道连接数超过该值时重定向新注册的客户端 (server模式, 0为不重定向)")
+	fs.IntVar(&config.MaxResponseViolations, "max-response-violations", 0, "单个隧道连接允许的响应消息协议违规次数, 超出后断开 (server模式, 默认5)")
+	fs.IntVar(&config.TunnelSendQueue, "tunnel-send-queue", 0, "每个隧道连接等待写入的消息数上限, 队列已满时公网请求返回503 (server模式, 默认256)")
+	fs.StringVar(&config.TrafficMode, "traffic-mode", "", "启动时的流量模式: normal 或 paused (暂停公网HTTP和SOCKS5, 隧道照常注册) (server模式, 默认normal)")
+	fs.StringVar(&config.PausedPage, "paused-page", "", "流量暂停时返回的HTML页面文件 (server模式, 为空使用内置页面)")
+	fs.IntVar(&config.AccessLogMaxOpenFiles, "access-log-max-open-files", 0, "同时打开的按key访问日志文件上限, 超过时关闭最久未写入的 (server模式, 默认64)")
+	fs.IntVar(&config.AccessLogRing, "access-log-ring", 0, "每个key在内存中保留的最近访问记录数, 供 /admin/keys/{key}/access 查询 (server模式, 0为不保留)")
+	fs.StringVar(&config.LogCardinality, "log-cardinality", "", "公网请求的key/主机名/路径写入日志和指标标签的方式: enforce 未登记的值记为 <unregistered>, warn 日志保留原值, off 不处理 (server模式, 默认enforce)")
+	fs.IntVar(&config.LogCardinalityLimit, "log-cardinality-limit", 0, "每分钟出现的不同未登记key或主机名超过该数时告警 (server模式, 默认100)")
+	fs.IntVar(&config.ChunkCoalesceBytes, "chunk-coalesce-bytes", 0, "合并连续的小响应数据块, 累计达到该字节数后一次写出 (server模式) 或作为一个隧道数据块发送 (client模式), 0为不合并, 建议16384")
+	fs.DurationVar(&config.ChunkCoalesceDelay, "chunk-coalesce-delay", 0, "合并的数据块最长等待时间 (默认5ms)")
+	fs.IntVar(&config.MaxBufferedFrameBytes, "max-buffered-frame-bytes", 0, "已读入尚未写给公网调用方的隧道响应数据上限, 达到后暂停读取仍有积压的隧道连接 (server模式, 默认256MB)")
+	fs.Func("redirect-allow", "接受服务器重定向的地址, 逗号分隔, 支持 *.example.com、wss://*.example.com (client模式, 默认只接受 -server 本身)", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.RedirectAllow = append(config.RedirectAllow, item)
+			}
+		}
+		return nil
+	})
+	fs.IntVar(&config.MaxTunnelKeys, "max-tunnel-keys", 0, "同时注册的不同key上限, 超出时返回503 (server模式, 0为不限制)")
+	fs.IntVar(&config.RegistrationRate, "registration-rate", 0, "每个key每分钟允许的注册次数, 负数不限制 (server模式, 默认10)")
+	fs.IntVar(&config.RegistrationBurst, "registration-burst", 0, "每个key注册的突发次数 (server模式, 默认3)")
+	fs.StringVar(&config.RegistrationListen, "registration-listen", "", "单独接受隧道注册的监听地址, e.g. 10.8.0.1:8443, 设置后主端口不再接受注册 (server模式)")
+	fs.Func("registration-allowed-cidrs", "允许注册隧道的来源网段, 逗号分隔, e.g. 10.8.0.0/16 (server模式)", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.RegistrationAllowedCIDRs = append(config.RegistrationAllowedCIDRs, item)
+			}
+		}
+		return nil
+	})
+	fs.DurationVar(&config.ResponseHeaderTimeout, "response-header-timeout", 0, "等待隧道客户端返回响应头的超时, 超时返回504 (server模式, 默认30s)")
+	fs.DurationVar(&config.TunnelIdleMax, "tunnel-idle-max", 0, "隧道连接超过该时长没有请求和数据消息时关闭, keys.<key>.allow_idle 可豁免 (server模式, 0为不限制)")
+	fs.DurationVar(&config.ClientBodyReadTimeout, "client-body-read-timeout", 0, "读取公网请求体时每个该时长内至少收到1KB, 否则返回408 (server模式, 默认30s)")
+	fs.DurationVar(&config.ResponseTimeout, "response-timeout", 0, "整个响应的超时, 响应头已发出时超时直接断开连接 (server模式, 默认90s)")
+	fs.DurationVar(&config.RequestTimeoutMin, "request-timeout-min", 0, "公网请求通过 X-Request-Timeout 指定的超时下限 (server模式, 默认1s)")
+	fs.DurationVar(&config.RequestTimeoutMax, "request-timeout-max", 0, "公网请求通过 X-Request-Timeout 指定的超时上限 (server模式, 默认与 -response-timeout 相同)")
+	fs.BoolVar(&config.ProxyErrorHeader, "proxy-error-header", false, "代理自身产生的错误响应携带 X-Proxy-Error 头说明原因 (server模式)")
+	fs.StringVar(&config.TruncatedResponse, "truncated-response", "", "响应中途失败时分块传输的响应如何结束: close 断开连接, trailer 以 X-Proxy-Error 尾部字段结束 (server模式, 默认close)")
+	fs.DurationVar(&config.ConnectIdleTimeout, "connect-idle-timeout", 0, "CONNECT 隧道两个方向都没有数据超过该时长时关闭 (server模式, 默认5m)")
+	fs.Func("proxy-allow-cidrs", "正向代理/SOCKS5允许访问的内网网段, 逗号分隔, e.g. 10.0.0.0/8,127.0.0.1 (server模式)", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.ProxyAllowCIDRs = append(config.ProxyAllowCIDRs, item)
+			}
+		}
+		return nil
+	})
+	fs.StringVar(&config.UsageFile, "usage-file", "", "按天汇总的用量持久化文件 (server模式, 为空则只保存在内存)")
+	fs.IntVar(&config.UsageRetentionDays, "usage-retention-days", 0, "用量数据保留天数 (server模式, 默认400)")
+	fs.StringVar(&config.CaptureDir, "capture-dir", "", "调试抓包文件目录 (server模式, 默认系统临时目录)")
+	fs.StringVar(&config.AutoKeyFormat, "auto-key-format", "", "自动key格式: words 或 hex (server模式, 默认words)")
+	fs.DurationVar(&config.AutoKeyTTL, "auto-key-ttl", 0, "自动key的有效期 (server模式, 默认1h)")
+	fs.StringVar(&config.PublicBaseURL, "public-base-url", "", "服务器对外基础URL, e.g. https://tunnel.example.com (server模式)")
+	fs.IntVar(&config.MaxConcurrentRequests, "max-concurrent-requests", 0, "同时处理的最大请求数, 超出时返回503 (client模式, 默认512)")
+	fs.IntVar(&config.Weight, "weight", 0, "同一key有多个客户端且服务器按 weighted 分发时的权重 (client模式, 默认1)")
+	fs.BoolVar(&config.WaitForTarget, "wait-for-target", false, "首次注册前等待目标服务可用 (client模式)")
+	fs.DurationVar(&config.WaitForTargetTimeout, "wait-for-target-timeout", 0, "等待目标服务的最长时间 (client模式, 默认2m)")
+	fs.StringVar(&config.WaitForTargetPath, "wait-for-target-path", "", "等待时还需 GET 该路径返回非5xx, e.g. /healthz (client模式)")
+	fs.BoolVar(&config.WaitForTargetExit, "wait-for-target-exit", false, "等待超时后退出而不是继续注册 (client模式)")
+	fs.BoolVar(&config.WaitForTargetReconnect, "wait-for-target-reconnect", false, "断线重连前同样等待目标服务 (client模式)")
+	fs.IntVar(&config.MaxReconnects, "max-reconnects", 0, "连续连接服务器失败达到该次数时退出 (client模式, 0为一直重试)")
+	fs.StringVar(&config.TargetProtocol, "target-protocol", "", "与目标服务之间的协议: h1, h2c 或 auto (client模式, 默认auto)")
+	fs.BoolVar(&config.FollowTargetRedirects, "follow-target-redirects", false, "在客户端跟随目标服务的重定向, 默认3xx响应原样返回 (client模式)")
+	fs.StringVar(&config.TargetLocationRewrite, "target-location-rewrite", "", "改写目标服务响应的 Location, e.g. http://10.0.0.5:8080=https://app.example.com (client模式)")
+	fs.IntVar(&config.FullResponseThreshold, "full-response-threshold", 0, "小于该字节数的响应合并为单条消息发送, 负数禁用 (client模式, 默认65536)")
+	fs.StringVar(&config.MetricsListen, "metrics-listen", "", "指标监听地址, e.g. 127.0.0.1:9100 (client模式)")
+	fs.StringVar(&config.LocalListen, "local-listen", "", "本地监听地址, 收到的请求经隧道按公网请求路由, e.g. 127.0.0.1:9000 (client模式)")
+	fs.StringVar(&config.LocalKey, "local-key", "", "本地请求未携带 X-Tunnel-Key 时使用的key, 默认为 -key (client模式)")
+	fs.StringVar(&config.AbortWebhook, "abort-webhook", "", "公网用户中止请求时向目标服务 POST 事件的路径, e.g. /tunnel-events/abort (client模式)")
+	fs.StringVar(&config.RequestIDHeader, "request-id-header", "", "转发请求时携带隧道请求ID的头, e.g. X-Tunnel-Request-Id (client模式)")
+	fs.Func("bind", "申请公网绑定, 可重复或逗号分隔, e.g. host=app.example.com,port=2222 (client模式)", func(v string) error {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				config.Bindings = append(config.Bindings, item)
+			}
+		}
+		return nil
+	})
 
-	flag.Parse()
-	return config
+	// 不属于运行配置的一次性操作，与其他参数一起解析
+	fs.BoolVar(&config.GenerateConfig, "generate-config", false, "生成示例配置文件")
+	fs.StringVar(&config.CheckKey, "check-key", "", "check子命令握手使用的key (默认随机生成, 避免顶替运行中的隧道)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
 // Validate 验证配置的有效性
@@ -59,6 +684,505 @@ func (c *Config) Validate() error {
 		if c.ServerAddr == "" || c.TargetAddr == "" {
 			return fmt.Errorf("错误: %s模式需要指定 -server 和 -target 参数", c.Mode)
 		}
+		if err := c.validateClientAddrs(); err != nil {
+			return err
+		}
+	}
+	if c.ListenPort != "" {
+		if err := validatePort("-port", c.ListenPort, true); err != nil {
+			return err
+		}
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("错误: -cert 和 -key-file 必须同时指定, 当前 -cert=%q -key-file=%q", c.CertFile, c.KeyFile)
+	}
+	if err := c.validateNumbers(); err != nil {
+		return err
+	}
+	if err := c.validateHosts(); err != nil {
+		return err
+	}
+	if err := c.validateTopResponses(); err != nil {
+		return err
+	}
+	if err := c.validateTunnelPaths(); err != nil {
+		return err
+	}
+	if w := c.Watchdog; w != nil {
+		if w.Interval < 0 {
+			return fmt.Errorf("错误: watchdog.interval 不能为负数, 当前为 %s", time.Duration(w.Interval))
+		}
+		if err := w.Soft.validate("watchdog.soft"); err != nil {
+			return err
+		}
+		if err := w.Hard.validate("watchdog.hard"); err != nil {
+			return err
+		}
+	}
+	switch c.TrafficMode {
+	case "", "normal", "paused":
+	default:
+		return fmt.Errorf("错误: -traffic-mode 必须是 'normal' 或 'paused', 当前为 %q", c.TrafficMode)
+	}
+	if c.PausedPage != "" {
+		info, err := os.Stat(c.PausedPage)
+		if err != nil {
+			return fmt.Errorf("错误: -paused-page 文件 %q 不存在", c.PausedPage)
+		}
+		if info.Size() > MaxOfflinePageBytes {
+			return fmt.Errorf("错误: -paused-page 文件超过 %d 字节", MaxOfflinePageBytes)
+		}
+	}
+	switch c.TruncatedResponse {
+	case "", "close", "trailer":
+	default:
+		return fmt.Errorf("错误: -truncated-response 必须是 'close' 或 'trailer', 当前为 %q", c.TruncatedResponse)
+	}
+	switch c.LogCardinality {
+	case "", "enforce", "warn", "off":
+	default:
+		return fmt.Errorf("错误: -log-cardinality 必须是 'enforce'、'warn' 或 'off', 当前为 %q", c.LogCardinality)
+	}
+	switch c.LogHeaders {
+	case "", "none", "redacted", "full":
+	default:
+		return fmt.Errorf("错误: -log-headers 必须是 none、redacted 或 full")
+	}
+	if c.KeyPattern != "" {
+		if _, err := regexp.Compile(c.KeyPattern); err != nil {
+			return fmt.Errorf("错误: -key-pattern 不是合法的正则表达式: %v", err)
+		}
+	}
+	if c.MessageAuthKey != "" && len(c.MessageAuthKey) < minMessageAuthKeyLen {
+		return fmt.Errorf("错误: -message-auth-key 至少需要 %d 个字符, 当前为 %d", minMessageAuthKeyLen, len(c.MessageAuthKey))
+	}
+	for i, t := range c.AdminTokens {
+		if t == nil || t.Token == "" {
+			return fmt.Errorf("错误: admin_tokens[%d] 缺少 token", i)
+		}
+		if !t.Full && len(t.Keys) == 0 {
+			return fmt.Errorf("错误: admin_tokens[%d] 需要设置 full: true 或 keys", i)
+		}
+		for _, pattern := range t.Keys {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("错误: admin_tokens[%d] 的key模式 %q 不合法", i, pattern)
+			}
+		}
+	}
+	for _, cidr := range c.ProxyAllowCIDRs {
+		if _, err := ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("错误: -proxy-allow-cidrs 包含非法网段 %q", cidr)
+		}
+	}
+	for _, cidr := range c.RegistrationAllowedCIDRs {
+		if _, err := ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("错误: -registration-allowed-cidrs 包含非法网段 %q", cidr)
+		}
+	}
+	for _, cidr := range c.TrustedProxies {
+		if _, err := ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("错误: -trusted-proxies 包含非法网段 %q", cidr)
+		}
+	}
+	if c.RegistrationListen != "" {
+		if err := validateHostPort("-registration-listen", c.RegistrationListen, true); err != nil {
+			return err
+		}
+	}
+	if c.MetricsListen != "" {
+		if err := validateHostPort("-metrics-listen", c.MetricsListen, true); err != nil {
+			return err
+		}
+	}
+	if c.LocalListen != "" {
+		if err := validateHostPort("-local-listen", c.LocalListen, true); err != nil {
+			return err
+		}
+		// 本地请求复用WebSocket连接发送，长轮询没有客户端发起请求的通道
+		if c.Mode == "http-client" {
+			return fmt.Errorf("错误: -local-listen 只支持 client 模式")
+		}
+	}
+	for key, kc := range c.Keys {
+		if kc == nil {
+			continue
+		}
+		for i, t := range kc.Transforms {
+			if err := t.validate(); err != nil {
+				return fmt.Errorf("错误: keys.%s.transforms[%d] %v", key, i, err)
+			}
+		}
+		if kc.Balance != "" && kc.Balance != "round_robin" && kc.Balance != "weighted" {
+			return fmt.Errorf("错误: keys.%s.balance 必须是 'round_robin' 或 'weighted'", key)
+		}
+		if kc.MaxErrorRate < 0 || kc.MaxErrorRate > 1 {
+			return fmt.Errorf("错误: keys.%s.max_error_rate 必须在 0 到 1 之间", key)
+		}
+		if kc.Affinity != "" && kc.Affinity != "cookie" && kc.Affinity != "ip_hash" {
+			return fmt.Errorf("错误: keys.%s.affinity 必须是 'cookie' 或 'ip_hash'", key)
+		}
+		if kc.Affinity != "" && kc.Balance == "" {
+			return fmt.Errorf("错误: keys.%s.affinity 需要同时设置 balance", key)
+		}
+		if kc.SSEHeartbeat < 0 {
+			return fmt.Errorf("错误: keys.%s.sse_heartbeat 不能为负数, 当前为 %s", key, time.Duration(kc.SSEHeartbeat))
+		}
+		if kc.RateBurst < 0 || kc.RateBurst > MaxRateLimit {
+			return fmt.Errorf("错误: keys.%s.rate_burst 必须在 0 到 %d 之间, 当前为 %d", key, MaxRateLimit, kc.RateBurst)
+		}
+		if kc.RateSmoothing < 0 || time.Duration(kc.RateSmoothing) > MaxKeyRateSmoothing {
+			return fmt.Errorf("错误: keys.%s.rate_smoothing 必须在 0 到 %s 之间, 当前为 %s", key, MaxKeyRateSmoothing, time.Duration(kc.RateSmoothing))
+		}
+		if kc.OfflinePage != "" && kc.OfflinePage != OfflinePageDefault {
+			info, err := os.Stat(kc.OfflinePage)
+			if err != nil || info.IsDir() {
+				return fmt.Errorf("错误: keys.%s.offline_page 文件 %q 不存在", key, kc.OfflinePage)
+			}
+			if info.Size() > MaxOfflinePageBytes {
+				return fmt.Errorf("错误: keys.%s.offline_page 文件超过 %d 字节", key, MaxOfflinePageBytes)
+			}
+		}
+		if kc.Schedule != nil {
+			if _, err := schedule.Parse(kc.Schedule.Windows, kc.Schedule.Timezone); err != nil {
+				return fmt.Errorf("错误: keys.%s.schedule %v", key, err)
+			}
+		}
+		if kc.FallbackUpstream != "" {
+			u, err := url.Parse(kc.FallbackUpstream)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("错误: keys.%s.fallback_upstream 必须是 http:// 或 https:// 开头的地址, 当前为 %q", key, kc.FallbackUpstream)
+			}
+		}
+		if ic := kc.Idempotency; ic != nil {
+			if ic.TTL < 0 {
+				return fmt.Errorf("错误: keys.%s.idempotency.ttl 不能为负数, 当前为 %s", key, time.Duration(ic.TTL))
+			}
+			if ic.MaxBodyBytes < 0 {
+				return fmt.Errorf("错误: keys.%s.idempotency.max_body_bytes 不能为负数", key)
+			}
+			if ic.MaxEntries < 0 {
+				return fmt.Errorf("错误: keys.%s.idempotency.max_entries 不能为负数", key)
+			}
+			for _, path := range ic.Paths {
+				if !strings.HasPrefix(path, "/") {
+					return fmt.Errorf("错误: keys.%s.idempotency.paths 必须是以 / 开头的路径, 当前为 %q", key, path)
+				}
+			}
+		}
+		if cc := kc.Coalesce; cc != nil {
+			if cc.MaxBodyBytes < 0 || cc.MaxBodyBytes > MaxCoalesceBodyBytes {
+				return fmt.Errorf("错误: keys.%s.coalesce.max_body_bytes 必须在0到%d之间, 当前为 %d", key, MaxCoalesceBodyBytes, cc.MaxBodyBytes)
+			}
+			for _, path := range cc.Paths {
+				if !strings.HasPrefix(path, "/") {
+					return fmt.Errorf("错误: keys.%s.coalesce.paths 必须是以 / 开头的路径, 当前为 %q", key, path)
+				}
+			}
+			for _, name := range cc.Headers {
+				if name == "" || strings.ContainsAny(name, " :\t\r\n") {
+					return fmt.Errorf("错误: keys.%s.coalesce.headers 包含非法的头部名 %q", key, name)
+				}
+			}
+		}
+	}
+	if c.Weight < 0 {
+		return fmt.Errorf("错误: -weight 不能为负数")
+	}
+	if c.TargetProtocol != "" && c.TargetProtocol != "h1" && c.TargetProtocol != "h2c" && c.TargetProtocol != "auto" {
+		return fmt.Errorf("错误: -target-protocol 必须是 'h1'、'h2c' 或 'auto'")
+	}
+	if c.TargetLocationRewrite != "" {
+		if _, _, err := ParseLocationRewrite(c.TargetLocationRewrite); err != nil {
+			return fmt.Errorf("错误: -target-location-rewrite %v", err)
+		}
+	}
+	if c.AbortWebhook != "" && !strings.HasPrefix(c.AbortWebhook, "/") {
+		return fmt.Errorf("错误: -abort-webhook 必须是以 / 开头的路径")
+	}
+	if c.WaitForTargetPath != "" && !strings.HasPrefix(c.WaitForTargetPath, "/") {
+		return fmt.Errorf("错误: -wait-for-target-path 必须是以 / 开头的路径, 当前为 %q", c.WaitForTargetPath)
+	}
+	if c.UsageRetentionDays < 0 {
+		return fmt.Errorf("错误: -usage-retention-days 不能为负数")
+	}
+	if c.DNSPrefer != "" && c.DNSPrefer != "ipv4" && c.DNSPrefer != "ipv6" {
+		return fmt.Errorf("错误: -dns-prefer 必须是 'ipv4' 或 'ipv6'")
+	}
+	if c.DNSMinTTL > 0 && c.DNSMaxTTL > 0 && c.DNSMinTTL > c.DNSMaxTTL {
+		return fmt.Errorf("错误: -dns-min-ttl 不能大于 -dns-max-ttl")
+	}
+	if c.RedirectTo != "" {
+		u, err := url.Parse(c.RedirectTo)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return fmt.Errorf("错误: -redirect-to 必须是 ws:// 或 wss:// 开头的地址, 当前为 %q", c.RedirectTo)
+		}
+	}
+	if c.RedirectThreshold > 0 && c.RedirectTo == "" {
+		return fmt.Errorf("错误: -redirect-threshold 需要同时设置 -redirect-to")
+	}
+	if len(c.ClusterPeers) > 0 && c.ClusterToken == "" {
+		return fmt.Errorf("错误: -cluster-peers 需要同时设置 -cluster-token")
+	}
+	if c.ClusterToken != "" && len(c.ClusterToken) < minMessageAuthKeyLen {
+		return fmt.Errorf("错误: -cluster-token 至少需要 %d 个字符, 当前为 %d", minMessageAuthKeyLen, len(c.ClusterToken))
+	}
+	for _, peer := range c.ClusterPeers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("错误: -cluster-peers 必须是 http:// 或 https:// 开头的地址, 当前为 %q", peer)
+		}
+	}
+	if c.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(c.DNSServer); err != nil {
+			return fmt.Errorf("错误: -dns-server 必须是 host:port 格式")
+		}
+	}
+	return nil
+}
+
+// validateClientAddrs 检查客户端的服务器地址 scheme 与模式匹配、key 可以放进注册路径、目标地址为 host:port
+func (c *Config) validateClientAddrs() error {
+	schemes := []string{"ws", "wss"}
+	if c.Mode == "http-client" {
+		schemes = []string{"http", "https"}
+	}
+	u, err := url.Parse(c.ServerAddr)
+	if err != nil || u.Host == "" || (u.Scheme != schemes[0] && u.Scheme != schemes[1]) {
+		return fmt.Errorf("错误: %s模式的 -server 必须以 %s:// 或 %s:// 开头并包含主机, 当前为 %q", c.Mode, schemes[0], schemes[1], c.ServerAddr)
+	}
+	if !c.AutoKey {
+		if c.Key == "" {
+			return fmt.Errorf("错误: -key 不能为空")
+		}
+		if strings.ContainsAny(c.Key, "/?# ") {
+			return fmt.Errorf("错误: -key 不能包含 '/'、'?'、'#' 或空格, 当前为 %q", c.Key)
+		}
+	}
+	if strings.Contains(c.TargetAddr, "://") {
+		return fmt.Errorf("错误: -target 必须是不带 scheme 的 host:port, e.g. 127.0.0.1:8080, 当前为 %q", c.TargetAddr)
+	}
+	return validateHostPort("-target", c.TargetAddr, false)
+}
+
+// validateTopResponses 检查最大响应统计的长度参数和改写规则
+func (c *Config) validateTopResponses() error {
+	t := c.TopResponses
+	if t == nil {
+		return nil
+	}
+	if t.MaxPathLength < 0 {
+		return fmt.Errorf("错误: top_responses.max_path_length 不能为负数, 当前为 %d", t.MaxPathLength)
+	}
+	if t.PathDepth < 0 {
+		return fmt.Errorf("错误: top_responses.path_depth 不能为负数, 当前为 %d", t.PathDepth)
+	}
+	for i, r := range t.Rewrites {
+		if r == nil || r.Pattern == "" {
+			return fmt.Errorf("错误: top_responses.rewrites[%d] 缺少 pattern", i)
+		}
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("错误: top_responses.rewrites[%d] 的 pattern 不是合法的正则表达式: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// validateHosts 检查主机名配置的证书成对出现、至少配置了证书或隧道key，以及未知SNI的处理方式
+func (c *Config) validateHosts() error {
+	if c.TLSUnknownSNI != "" && c.TLSUnknownSNI != "default" && c.TLSUnknownSNI != "reject" {
+		return fmt.Errorf("错误: -tls-unknown-sni 必须是 'default' 或 'reject', 当前为 %q", c.TLSUnknownSNI)
+	}
+	for _, fp := range c.TLSFingerprintDeny {
+		if !ja3HashPattern.MatchString(fp) {
+			return fmt.Errorf("错误: -tls-fingerprint-deny 必须是32位十六进制的 JA3 指纹, 当前为 %q", fp)
+		}
+	}
+	if c.TLSClientCA != "" {
+		if info, err := os.Stat(c.TLSClientCA); err != nil || info.IsDir() {
+			return fmt.Errorf("错误: -tls-client-ca 文件 %q 不存在", c.TLSClientCA)
+		}
+	}
+	for host, h := range c.Hosts {
+		if h == nil || (h.TunnelKey == "" && h.CertFile == "" && h.DefaultKey == "") {
+			return fmt.Errorf("错误: hosts.%s 需要设置 tunnel_key、default_key 或 cert_file", host)
+		}
+		if h.TunnelKey != "" && h.DefaultKey != "" {
+			// tunnel_key 已路由该主机名的所有请求，default_key 不会生效
+			return fmt.Errorf("错误: hosts.%s 的 tunnel_key 和 default_key 不能同时设置", host)
+		}
+		if (h.CertFile == "") != (h.KeyFile == "") {
+			return fmt.Errorf("错误: hosts.%s 的 cert_file 和 key_file 必须同时指定", host)
+		}
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") || strings.ContainsAny(host, ":/ ") {
+			return fmt.Errorf("错误: hosts.%s 不是合法的主机名, 只支持 \"*.\" 开头的通配", host)
+		}
+	}
+	// 未知SNI使用默认证书时必须配置默认证书
+	if c.TLSEnabled() && c.CertFile == "" && c.TLSUnknownSNI != "reject" {
+		return fmt.Errorf("错误: 只配置了主机名证书时需要指定 -cert 和 -key-file 作为默认证书, 或设置 -tls-unknown-sni reject")
+	}
+	return nil
+}
+
+// validateNumbers 检查数值参数的范围和超时之间的先后关系
+func (c *Config) validateNumbers() error {
+	rateLimits := []struct {
+		flag  string
+		value int
+	}{
+		{"-ip-rate-limit", c.IPRateLimit},
+		{"-key-rate-limit", c.KeyRateLimit},
+		{"-key-rate-burst", c.KeyRateBurst},
+		{"-registration-burst", c.RegistrationBurst},
+	}
+	for _, r := range rateLimits {
+		if r.value < 0 || r.value > MaxRateLimit {
+			return fmt.Errorf("错误: %s 必须在 0 到 %d 之间, 当前为 %d", r.flag, MaxRateLimit, r.value)
+		}
+	}
+	// 注册频率的负数表示不限制
+	if c.RegistrationRate > MaxRateLimit {
+		return fmt.Errorf("错误: -registration-rate 不能超过 %d, 当前为 %d", MaxRateLimit, c.RegistrationRate)
+	}
+
+	counts := []struct {
+		flag  string
+		value int
+	}{
+		{"-max-unknown-messages", c.MaxUnknownMessages},
+		{"-max-header-count", c.MaxHeaderCount},
+		{"-max-header-field-bytes", c.MaxHeaderFieldBytes},
+		{"-max-header-bytes", c.MaxHeaderBytes},
+		{"-message-auth-max-failures", c.MessageAuthMaxFailures},
+		{"-ws-read-buffer-size", c.WSReadBufferSize},
+		{"-ws-write-buffer-size", c.WSWriteBufferSize},
+		{"-max-frame-size", c.MaxFrameSize},
+		{"-header-table-size", c.HeaderTableSize},
+		{"-max-tunnel-keys", c.MaxTunnelKeys},
+		{"-fd-warn-percent", c.FDWarnPercent},
+		{"-redirect-threshold", c.RedirectThreshold},
+		{"-max-response-violations", c.MaxResponseViolations},
+		{"-tunnel-send-queue", c.TunnelSendQueue},
+		{"-max-buffered-frame-bytes", c.MaxBufferedFrameBytes},
+		{"-chunk-coalesce-bytes", c.ChunkCoalesceBytes},
+		{"-log-max-size", c.LogMaxSize},
+		{"-log-max-backups", c.LogMaxBackups},
+		{"-access-log-max-open-files", c.AccessLogMaxOpenFiles},
+		{"-access-log-ring", c.AccessLogRing},
+		{"-log-cardinality-limit", c.LogCardinalityLimit},
+		{"-max-reconnects", c.MaxReconnects},
+		{"-tarpit-threshold", c.TarpitThreshold},
+		{"-tarpit-max-conns", c.TarpitMaxConns},
+		{"-max-concurrent-requests", c.MaxConcurrentRequests},
+	}
+	for _, n := range counts {
+		if n.value < 0 {
+			return fmt.Errorf("错误: %s 不能为负数, 当前为 %d", n.flag, n.value)
+		}
+	}
+	if c.HeaderTableSize > MaxHeaderTableSize {
+		return fmt.Errorf("错误: -header-table-size 不能超过 %d, 当前为 %d", MaxHeaderTableSize, c.HeaderTableSize)
+	}
+	if c.KeyRateSmoothing > MaxKeyRateSmoothing {
+		return fmt.Errorf("错误: -key-rate-smoothing 不能超过 %s, 当前为 %s", MaxKeyRateSmoothing, c.KeyRateSmoothing)
+	}
+	if c.FDWarnPercent > 100 {
+		return fmt.Errorf("错误: -fd-warn-percent 不能大于 100, 当前为 %d", c.FDWarnPercent)
+	}
+
+	durations := []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"-dns-min-ttl", c.DNSMinTTL},
+		{"-dns-max-ttl", c.DNSMaxTTL},
+		{"-dns-negative-ttl", c.DNSNegativeTTL},
+		{"-response-header-timeout", c.ResponseHeaderTimeout},
+		{"-client-body-read-timeout", c.ClientBodyReadTimeout},
+		{"-tunnel-idle-max", c.TunnelIdleMax},
+		{"-cluster-sync-interval", c.ClusterSyncInterval},
+		{"-response-timeout", c.ResponseTimeout},
+		{"-request-timeout-min", c.RequestTimeoutMin},
+		{"-request-timeout-max", c.RequestTimeoutMax},
+		{"-auto-key-ttl", c.AutoKeyTTL},
+		{"-wait-for-target-timeout", c.WaitForTargetTimeout},
+		{"-tarpit-delay", c.TarpitDelay},
+		{"-key-rate-smoothing", c.KeyRateSmoothing},
+		{"-drain-on-stop", c.DrainOnStop},
+		{"-chunk-coalesce-delay", c.ChunkCoalesceDelay},
+		{"-connect-idle-timeout", c.ConnectIdleTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return fmt.Errorf("错误: %s 不能为负数, 当前为 %s", d.flag, d.value)
+		}
+	}
+	if c.ResponseHeaderTimeout > 0 && c.ResponseTimeout > 0 && c.ResponseHeaderTimeout > c.ResponseTimeout {
+		return fmt.Errorf("错误: -response-header-timeout (%s) 不能大于 -response-timeout (%s)", c.ResponseHeaderTimeout, c.ResponseTimeout)
+	}
+	if c.RequestTimeoutMin > 0 && c.RequestTimeoutMax > 0 && c.RequestTimeoutMin > c.RequestTimeoutMax {
+		return fmt.Errorf("错误: -request-timeout-min (%s) 不能大于 -request-timeout-max (%s)", c.RequestTimeoutMin, c.RequestTimeoutMax)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// validatePort 检查端口是 1-65535 之间的数字，监听地址允许 0 表示由系统分配
+func validatePort(flag, port string, listen bool) error {
+	min := 1
+	if listen {
+		min = 0
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < min || n > 65535 {
+		return fmt.Errorf("错误: %s 的端口必须是 %d-65535 之间的数字, 当前为 %q", flag, min, port)
+	}
+	return nil
+}
+
+// validateHostPort 检查地址为 host:port 格式且端口合法
+func validateHostPort(flag, addr string, listen bool) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("错误: %s 必须是 host:port 格式, 当前为 %q", flag, addr)
+	}
+	return validatePort(flag, port, listen)
+}
+
+// ParseLocationRewrite 解析 "内部地址=公网地址" 形式的 Location 改写规则，两侧都只能是 scheme://host[:port]
+func ParseLocationRewrite(s string) (from, to *url.URL, err error) {
+	fromStr, toStr, ok := strings.Cut(s, "=")
+	if !ok {
+		return nil, nil, fmt.Errorf("必须是 \"内部地址=公网地址\" 格式, 当前为 %q", s)
+	}
+	parse := func(v string) (*url.URL, error) {
+		u, err := url.Parse(strings.TrimSpace(v))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return nil, fmt.Errorf("的两侧必须是 http:// 或 https:// 开头、不含路径的地址, 当前为 %q", v)
+		}
+		return u, nil
+	}
+	if from, err = parse(fromStr); err != nil {
+		return nil, nil, err
+	}
+	if to, err = parse(toStr); err != nil {
+		return nil, nil, err
+	}
+	return from, to, nil
+}
+
+// ParseCIDR 解析网段, 单个IP视为只包含该地址的网段
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
@@ -1,7 +1,15 @@
 package config
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseFlags(t *testing.T) {
@@ -21,6 +29,74 @@ func TestParseFlags(t *testing.T) {
 	}
 }
 
+// parseArgs 在新的 FlagSet 上解析参数，错误输出不打印到测试日志
+func parseArgs(args ...string) (*Config, error) {
+	fs := flag.NewFlagSet("singleproxy", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return ParseFlagsFrom(fs, args)
+}
+
+func TestParseFlagsFrom(t *testing.T) {
+	// 同一进程内多次解析，不会因重复定义参数而 panic
+	for i := 0; i < 2; i++ {
+		cfg, err := parseArgs()
+		if err != nil {
+			t.Fatalf("Failed to parse empty args: %v", err)
+		}
+		if cfg.Mode != "server" || cfg.ListenPort != "443" || cfg.Key != "default" || cfg.LogLevel != "info" {
+			t.Errorf("Unexpected defaults: mode=%q port=%q key=%q log_level=%q", cfg.Mode, cfg.ListenPort, cfg.Key, cfg.LogLevel)
+		}
+	}
+
+	args := []string{"-mode", "client", "-server", "wss://tunnel.example.com", "-target", "127.0.0.1:3000",
+		"-bind", "host=app.example.com,port=2222", "-follow-target-redirects", "-response-timeout", "45s"}
+	for i := 0; i < 2; i++ {
+		cfg, err := parseArgs(args...)
+		if err != nil {
+			t.Fatalf("Failed to parse client args: %v", err)
+		}
+		if cfg.Mode != "client" || cfg.ServerAddr != "wss://tunnel.example.com" || cfg.TargetAddr != "127.0.0.1:3000" {
+			t.Errorf("Unexpected client config: %+v", cfg)
+		}
+		// 列表参数每次解析都从空开始，不会累积上一次的结果
+		if len(cfg.Bindings) != 2 || cfg.Bindings[0] != "host=app.example.com" || cfg.Bindings[1] != "port=2222" {
+			t.Errorf("Unexpected bindings on parse %d: %v", i, cfg.Bindings)
+		}
+		if !cfg.FollowTargetRedirects || cfg.ResponseTimeout != 45*time.Second {
+			t.Errorf("Unexpected follow=%v response_timeout=%s", cfg.FollowTargetRedirects, cfg.ResponseTimeout)
+		}
+	}
+
+	cfg, err := parseArgs("-generate-config", "-check-key", "probe")
+	if err != nil {
+		t.Fatalf("Failed to parse one-off flags: %v", err)
+	}
+	if !cfg.GenerateConfig || cfg.CheckKey != "probe" {
+		t.Errorf("Expected generate-config and check-key to be parsed, got %v %q", cfg.GenerateConfig, cfg.CheckKey)
+	}
+}
+
+func TestParseFlagsFromErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"unknown flag", []string{"-no-such-flag"}},
+		{"bad duration", []string{"-tarpit-delay", "soon"}},
+		{"bad number", []string{"-ip-rate-limit", "many"}},
+		{"missing value", []string{"-mode"}},
+	}
+	for _, tt := range tests {
+		if cfg, err := parseArgs(tt.args...); err == nil {
+			t.Errorf("%s: expected an error, got %+v", tt.name, cfg)
+		}
+	}
+
+	if _, err := parseArgs("-h"); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Expected flag.ErrHelp for -h, got %v", err)
+	}
+}
+
 func TestValidate(t *testing.T) {
 	// 测试有效的 server 配置
 	config := &Config{
@@ -63,4 +139,475 @@ func TestValidate(t *testing.T) {
 	if err := incompleteClient.Validate(); err == nil {
 		t.Error("Expected incomplete client config to return error")
 	}
-}
\ No newline at end of file
+}
+func TestValidateAdminTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []*AdminTokenConfig
+		valid  bool
+	}{
+		{"full", []*AdminTokenConfig{{Token: "t", Full: true}}, true},
+		{"scoped", []*AdminTokenConfig{{Token: "t", Keys: []string{"team-a-*"}}}, true},
+		{"missing token", []*AdminTokenConfig{{Full: true}}, false},
+		{"no scope", []*AdminTokenConfig{{Token: "t"}}, false},
+		{"bad pattern", []*AdminTokenConfig{{Token: "t", Keys: []string{"team-["}}}, false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Mode: "server", AdminTokens: tt.tokens}
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateTransforms(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  *TransformConfig
+		valid bool
+	}{
+		{"replace", &TransformConfig{Type: "replace", From: "</head>", To: "<script></script></head>"}, true},
+		{"request regex", &TransformConfig{Type: "regex", Direction: "request", From: `v(\d+)`}, true},
+		{"unknown type", &TransformConfig{Type: "sed", From: "a"}, false},
+		{"bad direction", &TransformConfig{Type: "replace", Direction: "both", From: "a"}, false},
+		{"bad regex", &TransformConfig{Type: "regex", From: "("}, false},
+		{"empty from", &TransformConfig{Type: "url_rewrite", To: "https://app.example.com"}, false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Transforms: []*TransformConfig{tt.rule}}}}
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateKeyBalance(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   *KeyConfig
+		valid bool
+	}{
+		{"round robin", &KeyConfig{Balance: "round_robin"}, true},
+		{"cookie affinity", &KeyConfig{Balance: "round_robin", Affinity: "cookie"}, true},
+		{"ip hash", &KeyConfig{Balance: "round_robin", Affinity: "ip_hash"}, true},
+		{"unknown balance", &KeyConfig{Balance: "random"}, false},
+		{"unknown affinity", &KeyConfig{Balance: "round_robin", Affinity: "header"}, false},
+		{"affinity without balance", &KeyConfig{Affinity: "cookie"}, false},
+		{"weighted", &KeyConfig{Balance: "weighted", MaxErrorRate: 0.2}, true},
+		{"error rate disabled", &KeyConfig{Balance: "weighted", MaxErrorRate: 1}, true},
+		{"error rate out of range", &KeyConfig{Balance: "weighted", MaxErrorRate: 1.5}, false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Mode: "server", Keys: map[string]*KeyConfig{"web": tt.key}}
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tt.name, tt.valid, err)
+		}
+	}
+
+	if err := (&Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "localhost:3000", Key: "test", Weight: -1}).Validate(); err == nil {
+		t.Errorf("Expected negative weight to be rejected")
+	}
+}
+
+func TestValidateTargetProtocol(t *testing.T) {
+	for _, proto := range []string{"", "h1", "h2c", "auto"} {
+		if err := (&Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "localhost:3000", Key: "test", TargetProtocol: proto}).Validate(); err != nil {
+			t.Errorf("Expected target protocol %q to be valid, got %v", proto, err)
+		}
+	}
+	if err := (&Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "localhost:3000", Key: "test", TargetProtocol: "h2"}).Validate(); err == nil {
+		t.Errorf("Expected unknown target protocol to be rejected")
+	}
+}
+
+func TestValidateRegistrationAccess(t *testing.T) {
+	if err := (&Config{Mode: "server", RegistrationListen: "10.8.0.1:8443", RegistrationAllowedCIDRs: []string{"10.8.0.0/16", "127.0.0.1"}}).Validate(); err != nil {
+		t.Errorf("Expected registration access config to be valid, got %v", err)
+	}
+	if err := (&Config{Mode: "server", RegistrationAllowedCIDRs: []string{"10.8.0.0/33"}}).Validate(); err == nil {
+		t.Errorf("Expected invalid registration CIDR to be rejected")
+	}
+	if err := (&Config{Mode: "server", RegistrationListen: "8443"}).Validate(); err == nil {
+		t.Errorf("Expected registration listen address without host:port to be rejected")
+	}
+}
+
+func TestValidateOfflinePage(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "offline.html")
+	large := filepath.Join(dir, "large.html")
+	os.WriteFile(small, []byte("<h1>offline</h1>"), 0644)
+	os.WriteFile(large, make([]byte, MaxOfflinePageBytes+1), 0644)
+
+	for _, tt := range []struct {
+		page  string
+		valid bool
+	}{
+		{"default", true},
+		{small, true},
+		{large, false},
+		{filepath.Join(dir, "missing.html"), false},
+		{dir, false},
+	} {
+		cfg := &Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {OfflinePage: tt.page}}}
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tt.page, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateFallbackUpstream(t *testing.T) {
+	for _, tt := range []struct {
+		upstream string
+		valid    bool
+	}{
+		{"", true},
+		{"http://127.0.0.1:8080", true},
+		{"https://mirror.example.com/base", true},
+		{"mirror.example.com", false},
+		{"ftp://mirror.example.com", false},
+		{"http://", false},
+	} {
+		cfg := &Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {FallbackUpstream: tt.upstream}}}
+		if err := cfg.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%q: expected valid=%v, got %v", tt.upstream, tt.valid, err)
+		}
+	}
+}
+
+func TestDefaultRouteKey(t *testing.T) {
+	for _, tt := range []struct {
+		value, want string
+	}{
+		{"", "default"},
+		{"none", ""},
+		{"public-site", "public-site"},
+	} {
+		if got := (&Config{DefaultKey: tt.value}).DefaultRouteKey(); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestTunnelPathPrefixes(t *testing.T) {
+	for _, tt := range []struct {
+		value, ws, longPoll string
+	}{
+		{"", "/ws/", "/http-tunnel/"},
+		{"/ws/", "/ws/", "/http-tunnel/"},
+		{"/ws", "/ws/", "/http-tunnel/"},
+		{"tunnel/ws/", "/tunnel/ws/", "/tunnel/http-tunnel/"},
+		{"/tunnel/ws", "/tunnel/ws/", "/tunnel/http-tunnel/"},
+		{"/a/b//tunnel/ws/", "/a/b/tunnel/ws/", "/a/b/tunnel/http-tunnel/"},
+		{"/tunnel/", "/tunnel/", "/http-tunnel/"},
+	} {
+		ws, longPoll := (&Config{WSPathPrefix: tt.value}).TunnelPathPrefixes()
+		if ws != tt.ws || longPoll != tt.longPoll {
+			t.Errorf("%q: expected %q %q, got %q %q", tt.value, tt.ws, tt.longPoll, ws, longPoll)
+		}
+	}
+}
+
+func TestValidateTunnelPaths(t *testing.T) {
+	for _, prefix := range []string{"", "/ws/", "/tunnel/ws", "/a/b/tunnel/ws/"} {
+		if err := (&Config{Mode: "server", WSPathPrefix: prefix}).Validate(); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"/", "//", "/http-tunnel/", "/proxy/ws/", "/admin/ws", "/proxy"} {
+		if err := (&Config{Mode: "server", WSPathPrefix: prefix}).Validate(); err == nil || !strings.Contains(err.Error(), "-ws-path-prefix") {
+			t.Errorf("Expected %q to be rejected, got %v", prefix, err)
+		}
+	}
+}
+
+func TestValidateRanges(t *testing.T) {
+	client := func(c Config) Config {
+		c.Mode = "client"
+		if c.ServerAddr == "" {
+			c.ServerAddr = "ws://localhost:8080"
+		}
+		if c.TargetAddr == "" {
+			c.TargetAddr = "127.0.0.1:3000"
+		}
+		if c.Key == "" && !c.AutoKey {
+			c.Key = "web"
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		cfg      Config
+		contains string // 为空表示配置合法，否则错误中应包含的参数名
+	}{
+		{"listen port", Config{Mode: "server", ListenPort: "8443"}, ""},
+		{"listen port zero", Config{Mode: "server", ListenPort: "0"}, ""},
+		{"listen port out of range", Config{Mode: "server", ListenPort: "99999"}, "-port"},
+		{"listen port not numeric", Config{Mode: "server", ListenPort: "https"}, "-port"},
+		{"negative ip rate limit", Config{Mode: "server", IPRateLimit: -5}, "-ip-rate-limit"},
+		{"negative tarpit delay", Config{Mode: "server", TarpitDelay: -time.Second}, "-tarpit-delay"},
+		{"negative drain on stop", Config{Mode: "server", DrainOnStop: -time.Second}, "-drain-on-stop"},
+		{"redirect to", Config{Mode: "server", RedirectTo: "wss://b.example.com", RedirectThreshold: 100}, ""},
+		{"redirect to http", Config{Mode: "server", RedirectTo: "https://b.example.com"}, "-redirect-to"},
+		{"redirect threshold without address", Config{Mode: "server", RedirectThreshold: 100}, "-redirect-threshold"},
+		{"cluster peers", Config{Mode: "server", ClusterPeers: []string{"https://b.example.com"}, ClusterToken: "0123456789abcdef"}, ""},
+		{"cluster peers without token", Config{Mode: "server", ClusterPeers: []string{"https://b.example.com"}}, "-cluster-token"},
+		{"short cluster token", Config{Mode: "server", ClusterToken: "secret"}, "-cluster-token"},
+		{"cluster peer not http", Config{Mode: "server", ClusterPeers: []string{"wss://b.example.com"}, ClusterToken: "0123456789abcdef"}, "-cluster-peers"},
+		{"negative cluster sync interval", Config{Mode: "server", ClusterSyncInterval: -time.Second}, "-cluster-sync-interval"},
+		{"negative tarpit max conns", Config{Mode: "server", TarpitMaxConns: -1}, "-tarpit-max-conns"},
+		{"negative body read timeout", Config{Mode: "server", ClientBodyReadTimeout: -time.Second}, "-client-body-read-timeout"},
+		{"negative tunnel idle max", Config{Mode: "server", TunnelIdleMax: -time.Second}, "-tunnel-idle-max"},
+		{"negative buffered frame bytes", Config{Mode: "server", MaxBufferedFrameBytes: -1}, "-max-buffered-frame-bytes"},
+		{"negative max reconnects", Config{Mode: "server", MaxReconnects: -1}, "-max-reconnects"},
+		{"negative log max size", Config{Mode: "server", LogMaxSize: -1}, "-log-max-size"},
+		{"negative access log ring", Config{Mode: "server", AccessLogRing: -1}, "-access-log-ring"},
+		{"negative chunk coalesce delay", Config{Mode: "server", ChunkCoalesceDelay: -time.Millisecond}, "-chunk-coalesce-delay"},
+		{"paused traffic mode", Config{Mode: "server", TrafficMode: "paused"}, ""},
+		{"unknown traffic mode", Config{Mode: "server", TrafficMode: "maintenance"}, "-traffic-mode"},
+		{"missing paused page", Config{Mode: "server", PausedPage: "/nonexistent/paused.html"}, "-paused-page"},
+		{"negative response violations", Config{Mode: "server", MaxResponseViolations: -1}, "-max-response-violations"},
+		{"negative tunnel send queue", Config{Mode: "server", TunnelSendQueue: -1}, "-tunnel-send-queue"},
+		{"huge key rate limit", Config{Mode: "server", KeyRateLimit: MaxRateLimit + 1}, "-key-rate-limit"},
+		{"max key rate limit", Config{Mode: "server", KeyRateLimit: MaxRateLimit}, ""},
+		{"trusted proxies", Config{Mode: "server", ForwardedHeaders: true, TrustedProxies: []string{"10.0.0.5", "172.16.0.0/12"}}, ""},
+		{"invalid trusted proxy", Config{Mode: "server", TrustedProxies: []string{"10.0.0.0/33"}}, "-trusted-proxies"},
+		{"missing tls client ca", Config{Mode: "server", TLSClientCA: "/nonexistent/ca.pem"}, "-tls-client-ca"},
+		{"negative connect idle timeout", Config{Mode: "server", ConnectIdleTimeout: -time.Second}, "-connect-idle-timeout"},
+		{"negative key rate burst", Config{Mode: "server", KeyRateBurst: -1}, "-key-rate-burst"},
+		{"key rate smoothing", Config{Mode: "server", KeyRateLimit: 10, KeyRateBurst: 30, KeyRateSmoothing: 200 * time.Millisecond}, ""},
+		{"negative key rate smoothing", Config{Mode: "server", KeyRateSmoothing: -time.Millisecond}, "-key-rate-smoothing"},
+		{"long key rate smoothing", Config{Mode: "server", KeyRateSmoothing: MaxKeyRateSmoothing + time.Second}, "-key-rate-smoothing"},
+		{"per key rate burst", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {RateBurst: 40, RateSmoothing: Duration(time.Second)}}}, ""},
+		{"negative per key rate burst", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {RateBurst: -1}}}, "rate_burst"},
+		{"long per key rate smoothing", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {RateSmoothing: Duration(time.Minute)}}}, "rate_smoothing"},
+		{"unlimited registration rate", Config{Mode: "server", RegistrationRate: -1}, ""},
+		{"huge registration rate", Config{Mode: "server", RegistrationRate: MaxRateLimit + 1}, "-registration-rate"},
+		{"short message auth key", Config{Mode: "server", MessageAuthKey: "secret"}, "-message-auth-key"},
+		{"message auth key", Config{Mode: "server", MessageAuthKey: "0123456789abcdef"}, ""},
+		{"negative message auth failures", Config{Mode: "server", MessageAuthMaxFailures: -1}, "-message-auth-max-failures"},
+		{"top responses rewrite", Config{Mode: "server", TopResponses: &TopResponsesConfig{Rewrites: []*PathRewrite{{Pattern: "/[0-9]+", Replacement: "/:id"}}}}, ""},
+		{"invalid top responses rewrite", Config{Mode: "server", TopResponses: &TopResponsesConfig{Rewrites: []*PathRewrite{{Pattern: "("}}}}, "top_responses.rewrites[0]"},
+		{"negative top responses depth", Config{Mode: "server", TopResponses: &TopResponsesConfig{PathDepth: -1}}, "top_responses.path_depth"},
+		{"watchdog thresholds", Config{Mode: "server", Watchdog: &WatchdogConfig{Soft: WatchdogThresholds{HeapBytes: 1 << 30}, Hard: WatchdogThresholds{Goroutines: 10000}}}, ""},
+		{"negative watchdog threshold", Config{Mode: "server", Watchdog: &WatchdogConfig{Hard: WatchdogThresholds{SysBytes: -1}}}, "watchdog.hard.sys_bytes"},
+		{"negative watchdog interval", Config{Mode: "server", Watchdog: &WatchdogConfig{Interval: Duration(-time.Second)}}, "watchdog.interval"},
+		{"negative registration burst", Config{Mode: "server", RegistrationBurst: -1}, "-registration-burst"},
+		{"negative buffer size", Config{Mode: "server", WSReadBufferSize: -1}, "-ws-read-buffer-size"},
+		{"negative concurrency", client(Config{MaxConcurrentRequests: -1}), "-max-concurrent-requests"},
+		{"location rewrite", client(Config{TargetLocationRewrite: "http://10.0.0.5:8080=https://app.example.com"}), ""},
+		{"location rewrite without target", client(Config{TargetLocationRewrite: "http://10.0.0.5:8080"}), "-target-location-rewrite"},
+		{"location rewrite with path", client(Config{TargetLocationRewrite: "http://10.0.0.5:8080/app=https://app.example.com"}), "-target-location-rewrite"},
+		{"negative dns ttl", Config{Mode: "server", DNSNegativeTTL: -time.Second}, "-dns-negative-ttl"},
+		{"negative auto key ttl", Config{Mode: "server", AutoKeyTTL: -time.Minute}, "-auto-key-ttl"},
+		{"negative header count", Config{Mode: "server", MaxHeaderCount: -1}, "-max-header-count"},
+		{"fd warn percent", Config{Mode: "server", FDWarnPercent: 90}, ""},
+		{"fd warn percent above 100", Config{Mode: "server", FDWarnPercent: 101}, "-fd-warn-percent"},
+		{"negative header bytes", client(Config{MaxHeaderBytes: -1}), "-max-header-bytes"},
+		{"header timeout within response timeout", Config{Mode: "server", ResponseHeaderTimeout: 10 * time.Second, ResponseTimeout: time.Minute}, ""},
+		{"header timeout after response timeout", Config{Mode: "server", ResponseHeaderTimeout: 2 * time.Minute, ResponseTimeout: time.Minute}, "-response-header-timeout"},
+		{"request timeout range", Config{Mode: "server", RequestTimeoutMin: time.Second, RequestTimeoutMax: time.Minute}, ""},
+		{"request timeout min above max", Config{Mode: "server", RequestTimeoutMin: 2 * time.Minute, RequestTimeoutMax: time.Minute}, "-request-timeout-min"},
+		{"negative request timeout max", Config{Mode: "server", RequestTimeoutMax: -time.Second}, "-request-timeout-max"},
+		{"cert and key", Config{Mode: "server", CertFile: "server.crt", KeyFile: "server.key"}, ""},
+		{"cert without key", Config{Mode: "server", CertFile: "server.crt"}, "-key-file"},
+		{"key without cert", Config{Mode: "server", KeyFile: "server.key"}, "-cert"},
+		{"metrics listen", client(Config{MetricsListen: "127.0.0.1:9100"}), ""},
+		{"metrics listen without port", client(Config{MetricsListen: "127.0.0.1"}), "-metrics-listen"},
+		{"local listen", client(Config{LocalListen: "127.0.0.1:9000", LocalKey: "remote-app"}), ""},
+		{"local listen without port", client(Config{LocalListen: "localhost"}), "-local-listen"},
+		{"local listen with long polling", Config{Mode: "http-client", ServerAddr: "http://127.0.0.1:8080", TargetAddr: "127.0.0.1:3000", Key: "dev", LocalListen: "127.0.0.1:9000"}, "-local-listen"},
+		{"registration listen bad port", Config{Mode: "server", RegistrationListen: ":70000"}, "-registration-listen"},
+		{"sse heartbeat", Config{Mode: "server", Keys: map[string]*KeyConfig{"events": {SSE: true, SSEHeartbeat: Duration(15 * time.Second)}}}, ""},
+		{"host cert and route", Config{Mode: "server", CertFile: "server.crt", KeyFile: "server.key", Hosts: map[string]*HostConfig{"app.example.com": {TunnelKey: "app", CertFile: "app.crt", KeyFile: "app.key"}}}, ""},
+		{"host route only", Config{Mode: "server", Hosts: map[string]*HostConfig{"*.example.com": {TunnelKey: "app"}}}, ""},
+		{"host certs with reject", Config{Mode: "server", TLSUnknownSNI: "reject", Hosts: map[string]*HostConfig{"app.example.com": {CertFile: "app.crt", KeyFile: "app.key"}}}, ""},
+		{"host certs without default", Config{Mode: "server", Hosts: map[string]*HostConfig{"app.example.com": {CertFile: "app.crt", KeyFile: "app.key"}}}, "-tls-unknown-sni"},
+		{"host cert without key", Config{Mode: "server", CertFile: "server.crt", KeyFile: "server.key", Hosts: map[string]*HostConfig{"app.example.com": {CertFile: "app.crt"}}}, "hosts.app.example.com"},
+		{"empty host", Config{Mode: "server", Hosts: map[string]*HostConfig{"app.example.com": {}}}, "hosts.app.example.com"},
+		{"bad host wildcard", Config{Mode: "server", Hosts: map[string]*HostConfig{"app.*.com": {TunnelKey: "app"}}}, "hosts.app.*.com"},
+		{"host default key only", Config{Mode: "server", Hosts: map[string]*HostConfig{"scan.example.com": {DefaultKey: "none"}}}, ""},
+		{"host tunnel and default key", Config{Mode: "server", Hosts: map[string]*HostConfig{"app.example.com": {TunnelKey: "app", DefaultKey: "other"}}}, "hosts.app.example.com"},
+		{"unknown sni mode", Config{Mode: "server", TLSUnknownSNI: "drop"}, "-tls-unknown-sni"},
+		{"tls fingerprint deny", Config{Mode: "server", TLSFingerprintDeny: []string{"e7d705a3286e19ea42f587b344ee6865"}}, ""},
+		{"log cardinality", Config{Mode: "server", LogCardinality: "warn", LogCardinalityLimit: 500}, ""},
+		{"unknown log cardinality", Config{Mode: "server", LogCardinality: "strict"}, "-log-cardinality"},
+		{"negative log cardinality limit", Config{Mode: "server", LogCardinalityLimit: -1}, "-log-cardinality-limit"},
+		{"header table size", Config{Mode: "server", HeaderTableSize: 16384}, ""},
+		{"negative header table size", Config{Mode: "server", HeaderTableSize: -1}, "-header-table-size"},
+		{"header table size too large", Config{Mode: "server", HeaderTableSize: 1 << 20}, "-header-table-size"},
+		{"tls fingerprint not md5", Config{Mode: "server", TLSFingerprintDeny: []string{"771,4865-4866,0-23,29,0"}}, "-tls-fingerprint-deny"},
+		{"truncated response trailer", Config{Mode: "server", TruncatedResponse: "trailer"}, ""},
+		{"wait for target path", Config{Mode: "server", WaitForTargetPath: "healthz"}, "-wait-for-target-path"},
+		{"negative wait for target timeout", Config{Mode: "server", WaitForTargetTimeout: -time.Second}, "-wait-for-target-timeout"},
+		{"unknown truncated response mode", Config{Mode: "server", TruncatedResponse: "drop"}, "-truncated-response"},
+		{"negative sse heartbeat", Config{Mode: "server", Keys: map[string]*KeyConfig{"events": {SSEHeartbeat: Duration(-time.Second)}}}, "sse_heartbeat"},
+		{"idempotency", Config{Mode: "server", Keys: map[string]*KeyConfig{"pay": {Idempotency: &IdempotencyConfig{Paths: []string{"/api/payments"}, TTL: Duration(time.Hour)}}}}, ""},
+		{"negative idempotency ttl", Config{Mode: "server", Keys: map[string]*KeyConfig{"pay": {Idempotency: &IdempotencyConfig{TTL: Duration(-time.Second)}}}}, "idempotency.ttl"},
+		{"relative idempotency path", Config{Mode: "server", Keys: map[string]*KeyConfig{"pay": {Idempotency: &IdempotencyConfig{Paths: []string{"api"}}}}}, "idempotency.paths"},
+		{"coalesce", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Coalesce: &CoalesceConfig{Paths: []string{"/assets"}, Headers: []string{"X-Tenant"}, MaxBodyBytes: 4 << 20}}}}, ""},
+		{"negative coalesce body", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Coalesce: &CoalesceConfig{MaxBodyBytes: -1}}}}, "coalesce.max_body_bytes"},
+		{"oversized coalesce body", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Coalesce: &CoalesceConfig{MaxBodyBytes: MaxCoalesceBodyBytes + 1}}}}, "coalesce.max_body_bytes"},
+		{"relative coalesce path", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Coalesce: &CoalesceConfig{Paths: []string{"assets"}}}}}, "coalesce.paths"},
+		{"bad coalesce header", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Coalesce: &CoalesceConfig{Headers: []string{"X Tenant"}}}}}, "coalesce.headers"},
+		{"schedule", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Schedule: &ScheduleConfig{Timezone: "Europe/Berlin", Windows: []string{"Mon-Fri 09:00-18:00"}}}}}, ""},
+		{"schedule without windows", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Schedule: &ScheduleConfig{}}}}, "keys.web.schedule"},
+		{"unknown schedule timezone", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Schedule: &ScheduleConfig{Timezone: "Mars/Olympus", Windows: []string{"09:00-18:00"}}}}}, "keys.web.schedule"},
+		{"bad schedule window", Config{Mode: "server", Keys: map[string]*KeyConfig{"web": {Schedule: &ScheduleConfig{Windows: []string{"Mon-Fri 9-18"}}}}}, "keys.web.schedule"},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		switch {
+		case tt.contains == "" && err != nil:
+			t.Errorf("%s: expected valid, got %v", tt.name, err)
+		case tt.contains != "" && (err == nil || !strings.Contains(err.Error(), tt.contains)):
+			t.Errorf("%s: expected error naming %s, got %v", tt.name, tt.contains, err)
+		}
+	}
+}
+
+func TestValidateClientAddrs(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		contains string
+	}{
+		{"websocket", Config{Mode: "client", ServerAddr: "wss://tunnel.example.com", TargetAddr: "127.0.0.1:3000", Key: "web"}, ""},
+		{"http long poll", Config{Mode: "http-client", ServerAddr: "https://tunnel.example.com/tunnel", TargetAddr: "localhost:3000", Key: "web"}, ""},
+		{"ipv6 target", Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "[::1]:3000", Key: "web"}, ""},
+		{"auto key", Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "127.0.0.1:3000", AutoKey: true}, ""},
+		{"http scheme in client mode", Config{Mode: "client", ServerAddr: "https://tunnel.example.com", TargetAddr: "127.0.0.1:3000", Key: "web"}, "-server"},
+		{"ws scheme in http-client mode", Config{Mode: "http-client", ServerAddr: "wss://tunnel.example.com", TargetAddr: "127.0.0.1:3000", Key: "web"}, "-server"},
+		{"server without host", Config{Mode: "client", ServerAddr: "ws://", TargetAddr: "127.0.0.1:3000", Key: "web"}, "-server"},
+		{"empty key", Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "127.0.0.1:3000"}, "-key"},
+		{"key with slash", Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "127.0.0.1:3000", Key: "team/web"}, "-key"},
+		{"target without port", Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "localhost", Key: "web"}, "-target"},
+		{"target with scheme", Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "http://localhost:3000", Key: "web"}, "-target"},
+		{"target port zero", Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "localhost:0", Key: "web"}, "-target"},
+		{"target port not numeric", Config{Mode: "client", ServerAddr: "ws://localhost:8080", TargetAddr: "localhost:http", Key: "web"}, "-target"},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		switch {
+		case tt.contains == "" && err != nil:
+			t.Errorf("%s: expected valid, got %v", tt.name, err)
+		case tt.contains != "" && (err == nil || !strings.Contains(err.Error(), tt.contains)):
+			t.Errorf("%s: expected error naming %s, got %v", tt.name, tt.contains, err)
+		}
+	}
+}
+
+// writeConfigFiles 在临时目录中写入配置文件，返回目录
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigFileInclude(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"main.yaml": "include: [keys.d/*.yaml, routes.yaml]\nserver:\n  listen_port: \"8443\"\n  keys:\n    main:\n      offline_page: one.html\n",
+		"keys.d/b.yaml": "server:\n  keys:\n    beta:\n      offline_page: two.html\n",
+		"keys.d/a.yaml": "server:\n  keys:\n    alpha:\n      offline_page: three.html\n",
+		// 多文档文件按顺序合并
+		"routes.yaml": "server:\n  proxy_allow_cidrs: [10.0.0.0/8]\n---\nserver:\n  proxy_allow_cidrs: [192.168.0.0/16]\n  listen_port: \"8443\"\n",
+	})
+
+	fc, err := LoadConfigFile(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if fc.Server.ListenPort != "8443" {
+		t.Errorf("Expected listen_port 8443, got %q", fc.Server.ListenPort)
+	}
+	for key, want := range map[string]string{"main": "one.html", "alpha": "three.html", "beta": "two.html"} {
+		if kc := fc.Server.Keys[key]; kc == nil || kc.OfflinePage != want {
+			t.Errorf("Expected key %s with offline_page %s, got %+v", key, want, kc)
+		}
+	}
+	if got := strings.Join(fc.Server.ProxyAllowCIDRs, ","); got != "10.0.0.0/8,192.168.0.0/16" {
+		t.Errorf("Expected lists from both documents, got %s", got)
+	}
+
+	// 每次加载都重新展开通配
+	os.WriteFile(filepath.Join(dir, "keys.d", "c.yaml"), []byte("server:\n  keys:\n    gamma: {}\n"), 0644)
+	fc, err = LoadConfigFile(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if _, ok := fc.Server.Keys["gamma"]; !ok {
+		t.Errorf("Expected newly added include file to be loaded")
+	}
+}
+
+func TestLoadConfigFileIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		contains []string
+	}{
+		{
+			"conflicting scalar",
+			map[string]string{
+				"main.yaml":  "include: other.yaml\nserver:\n  listen_port: \"8443\"\n",
+				"other.yaml": "server:\n  listen_port: \"9443\"\n",
+			},
+			[]string{"server.listen_port", "main.yaml", "other.yaml"},
+		},
+		{
+			"conflicting key setting",
+			map[string]string{
+				"main.yaml":     "include: [keys.d/*.yaml]\n",
+				"keys.d/a.yaml": "server:\n  keys:\n    app:\n      offline_page: one.html\n",
+				"keys.d/b.yaml": "server:\n  keys:\n    app:\n      offline_page: two.html\n",
+			},
+			[]string{"server.keys.app.offline_page", "a.yaml", "b.yaml"},
+		},
+		{
+			"cycle",
+			map[string]string{
+				"main.yaml": "include: a.yaml\n",
+				"a.yaml":    "include: main.yaml\n",
+			},
+			[]string{"include cycle", "a.yaml"},
+		},
+		{
+			"missing file",
+			map[string]string{"main.yaml": "include: missing.yaml\n"},
+			[]string{"missing.yaml"},
+		},
+	}
+
+	for _, tt := range tests {
+		dir := writeConfigFiles(t, tt.files)
+		_, err := LoadConfigFile(filepath.Join(dir, "main.yaml"))
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+			continue
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("%s: expected error to mention %q, got %v", tt.name, s, err)
+			}
+		}
+	}
+
+	// 超过嵌套层数
+	files := map[string]string{}
+	for i := 0; i <= maxIncludeDepth+1; i++ {
+		files[fmt.Sprintf("f%d.yaml", i)] = fmt.Sprintf("include: f%d.yaml\n", i+1)
+	}
+	files["main.yaml"] = "include: f0.yaml\n"
+	dir := writeConfigFiles(t, files)
+	os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d.yaml", maxIncludeDepth+2)), nil, 0644)
+	if _, err := LoadConfigFile(filepath.Join(dir, "main.yaml")); err == nil || !strings.Contains(err.Error(), "include depth") {
+		t.Errorf("Expected include depth error, got %v", err)
+	}
+}
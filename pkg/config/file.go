@@ -1,9 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -18,34 +20,196 @@ type FileConfig struct {
 // ServerConfig 服务器配置
 type ServerConfig struct {
 	ListenPort   string `yaml:"listen_port"`
+	DefaultKey   string `yaml:"default_key"`
 	CertFile     string `yaml:"cert_file"`
 	KeyFile      string `yaml:"key_file"`
 	IPRateLimit  int    `yaml:"ip_rate_limit"`
 	KeyRateLimit int    `yaml:"key_rate_limit"`
+
+	KeyRateBurst     int      `yaml:"key_rate_burst"`
+	KeyRateSmoothing Duration `yaml:"key_rate_smoothing"`
+
+	TarpitDelay     Duration `yaml:"tarpit_delay"`
+	TarpitThreshold int      `yaml:"tarpit_threshold"`
+	TarpitMaxConns  int      `yaml:"tarpit_max_conns"`
+
+	AdminToken string `yaml:"admin_token"`
+	CaptureDir string `yaml:"capture_dir"`
+
+	ProxyAllowCIDRs    []string `yaml:"proxy_allow_cidrs"`
+	ConnectIdleTimeout Duration `yaml:"connect_idle_timeout"`
+
+	MaxTunnelKeys     int `yaml:"max_tunnel_keys"`
+	RegistrationRate  int `yaml:"registration_rate"`
+	RegistrationBurst int `yaml:"registration_burst"`
+
+	FDWarnPercent int      `yaml:"fd_warn_percent"`
+	DrainOnStop   Duration `yaml:"drain_on_stop"`
+
+	RedirectTo        string `yaml:"redirect_to"`
+	RedirectThreshold int    `yaml:"redirect_threshold"`
+
+	ClusterPeers        []string `yaml:"cluster_peers"`
+	ClusterToken        string   `yaml:"cluster_token"`
+	ClusterSyncInterval Duration `yaml:"cluster_sync_interval"`
+
+	MaxResponseViolations int `yaml:"max_response_violations"`
+	TunnelSendQueue       int `yaml:"tunnel_send_queue"`
+	MaxBufferedFrameBytes int `yaml:"max_buffered_frame_bytes"`
+
+	ChunkCoalesceBytes int      `yaml:"chunk_coalesce_bytes"`
+	ChunkCoalesceDelay Duration `yaml:"chunk_coalesce_delay"`
+
+	TrafficMode string `yaml:"traffic_mode"`
+	PausedPage  string `yaml:"paused_page"`
+
+	AccessLogMaxOpenFiles int `yaml:"access_log_max_open_files"`
+	AccessLogRing         int `yaml:"access_log_ring"`
+
+	LogCardinality      string `yaml:"log_cardinality"`
+	LogCardinalityLimit int    `yaml:"log_cardinality_limit"`
+
+	RegistrationListen       string   `yaml:"registration_listen"`
+	RegistrationAllowedCIDRs []string `yaml:"registration_allowed_cidrs"`
+	TunnelIdleMax            Duration `yaml:"tunnel_idle_max"`
+
+	ResponseHeaderTimeout Duration `yaml:"response_header_timeout"`
+	ResponseTimeout       Duration `yaml:"response_timeout"`
+	ClientBodyReadTimeout Duration `yaml:"client_body_read_timeout"`
+	RequestTimeoutMin     Duration `yaml:"request_timeout_min"`
+	RequestTimeoutMax     Duration `yaml:"request_timeout_max"`
+	ProxyErrorHeader      bool     `yaml:"proxy_error_header"`
+	TruncatedResponse     string   `yaml:"truncated_response"`
+
+	UsageFile          string `yaml:"usage_file"`
+	UsageRetentionDays int    `yaml:"usage_retention_days"`
+
+	AutoKeyFormat string   `yaml:"auto_key_format"`
+	AutoKeyTTL    Duration `yaml:"auto_key_ttl"`
+	PublicBaseURL string   `yaml:"public_base_url"`
+
+	Keys map[string]*KeyConfig `yaml:"keys"`
+
+	Hosts         map[string]*HostConfig `yaml:"hosts"`
+	TLSUnknownSNI string                 `yaml:"tls_unknown_sni"`
+
+	TLSFingerprintDeny []string `yaml:"tls_fingerprint_deny"`
+	TLSClientCA        string   `yaml:"tls_client_ca"`
+
+	ForwardedHeaders bool     `yaml:"forwarded_headers"`
+	TrustedProxies   []string `yaml:"trusted_proxies"`
+
+	AdminTokens []*AdminTokenConfig `yaml:"admin_tokens"`
+
+	TopResponses *TopResponsesConfig `yaml:"top_responses"`
+	Watchdog     *WatchdogConfig     `yaml:"watchdog"`
+
+	WSPathPrefix      string   `yaml:"ws_path_prefix"`
+	WSAllowedOrigins  []string `yaml:"ws_allowed_origins"`
+	WSReadBufferSize  int      `yaml:"ws_read_buffer_size"`
+	WSWriteBufferSize int      `yaml:"ws_write_buffer_size"`
+	MaxFrameSize      int      `yaml:"max_frame_size"`
+	HeaderTableSize   int      `yaml:"header_table_size"`
 }
 
 // ClientConfig 客户端配置
 type ClientConfig struct {
-	ServerAddr string `yaml:"server_addr"`
-	TargetAddr string `yaml:"target_addr"`
-	Key        string `yaml:"key"`
-	Insecure   bool   `yaml:"insecure"`
+	ServerAddr string   `yaml:"server_addr"`
+	TargetAddr string   `yaml:"target_addr"`
+	Key        string   `yaml:"key"`
+	Insecure   bool     `yaml:"insecure"`
+	Bindings   []string `yaml:"bindings"`
+	AutoKey    bool     `yaml:"auto_key"`
+
+	MaxConcurrentRequests int    `yaml:"max_concurrent_requests"`
+	MetricsListen         string `yaml:"metrics_listen"`
+	LocalListen           string `yaml:"local_listen"`
+	LocalKey              string `yaml:"local_key"`
+	FullResponseThreshold int    `yaml:"full_response_threshold"`
+	Weight                int    `yaml:"weight"`
+	TargetProtocol        string `yaml:"target_protocol"`
+	FollowTargetRedirects bool   `yaml:"follow_target_redirects"`
+	TargetLocationRewrite string `yaml:"target_location_rewrite"`
+	AbortWebhook          string `yaml:"abort_webhook"`
+	RequestIDHeader       string `yaml:"request_id_header"`
+
+	WaitForTarget          bool     `yaml:"wait_for_target"`
+	WaitForTargetTimeout   Duration `yaml:"wait_for_target_timeout"`
+	WaitForTargetPath      string   `yaml:"wait_for_target_path"`
+	WaitForTargetExit      bool     `yaml:"wait_for_target_exit"`
+	WaitForTargetReconnect bool     `yaml:"wait_for_target_reconnect"`
+	MaxReconnects          int      `yaml:"max_reconnects"`
+
+	RedirectAllow []string `yaml:"redirect_allow"`
+
+	WSReadBufferSize  int `yaml:"ws_read_buffer_size"`
+	WSWriteBufferSize int `yaml:"ws_write_buffer_size"`
+
+	ChunkCoalesceBytes int      `yaml:"chunk_coalesce_bytes"`
+	ChunkCoalesceDelay Duration `yaml:"chunk_coalesce_delay"`
+	MaxFrameSize       int      `yaml:"max_frame_size"`
+}
+
+// Duration 是支持 "30s"、"1h" 等写法的YAML时长类型
+type Duration time.Duration
+
+// UnmarshalYAML 解析时长字符串
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalYAML 以字符串形式输出时长
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
 }
 
 // GlobalConfig 全局配置
 type GlobalConfig struct {
-	LogLevel string `yaml:"log_level"`
-	LogFile  string `yaml:"log_file"`
+	LogLevel   string `yaml:"log_level"`
+	LogFile    string `yaml:"log_file"`
+	KeyPattern string `yaml:"key_pattern"`
+
+	LogMaxSize    int `yaml:"log_max_size"`
+	LogMaxBackups int `yaml:"log_max_backups"`
+
+	LogHeaders       string   `yaml:"log_headers"`
+	LogRedactHeaders []string `yaml:"log_redact_headers"`
+
+	MaxUnknownMessages int `yaml:"max_unknown_messages"`
+
+	MaxHeaderCount      int `yaml:"max_header_count"`
+	MaxHeaderFieldBytes int `yaml:"max_header_field_bytes"`
+	MaxHeaderBytes      int `yaml:"max_header_bytes"`
+
+	MessageAuthKey         string `yaml:"message_auth_key"`
+	MessageAuthMaxFailures int    `yaml:"message_auth_max_failures"`
+
+	DNSCacheSize   int      `yaml:"dns_cache_size"`
+	DNSMinTTL      Duration `yaml:"dns_min_ttl"`
+	DNSMaxTTL      Duration `yaml:"dns_max_ttl"`
+	DNSNegativeTTL Duration `yaml:"dns_negative_ttl"`
+	DNSPrefer      string   `yaml:"dns_prefer"`
+	DNSServer      string   `yaml:"dns_server"`
 }
 
-// LoadConfigFile 从YAML文件加载配置
+// LoadConfigFile 从YAML文件加载配置，展开 include 列出的文件并与之合并。
+// 每次调用都会重新展开通配，新增的文件在重新加载时生效
 func LoadConfigFile(filename string) (*FileConfig, error) {
 	// 检查文件是否存在
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		return nil, err
 	}
 
-	data, err := ioutil.ReadFile(filename)
+	data, err := loadConfigTree(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -61,6 +225,11 @@ func LoadConfigFile(filename string) (*FileConfig, error) {
 
 // SaveConfigFile 保存配置到YAML文件
 func SaveConfigFile(filename string, config *FileConfig) error {
+	return saveConfigFile(filename, config, "")
+}
+
+// saveConfigFile 保存配置文件，header 为写在文件开头的注释
+func saveConfigFile(filename string, config *FileConfig, header string) error {
 	// 创建目录（如果不存在）
 	dir := filepath.Dir(filename)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -72,15 +241,74 @@ func SaveConfigFile(filename string, config *FileConfig) error {
 		return err
 	}
 
-	return ioutil.WriteFile(filename, data, 0644)
+	return ioutil.WriteFile(filename, append([]byte(header), data...), 0644)
 }
 
+// exampleConfigHeader 示例配置文件开头的说明，YAML序列化无法输出字段注释
+const exampleConfigHeader = `# server.default_key: 未携带 X-Tunnel-Key 且未按主机名路由的公网请求转发到的key。
+# 默认为 "default"，任何以 default 注册的客户端都会收到扫描器等随机流量；
+# 不需要默认路由时设为 "none"，这类请求返回 404。hosts.<主机名>.default_key 可按主机名覆盖。
+# server.ws_path_prefix: 隧道注册入口的路径前缀，长轮询入口为同级的 http-tunnel/。
+# 在 nginx 的 /tunnel/ 下原样转发时设为 "/tunnel/ws/"，客户端 server_addr 使用 wss://your-domain.com/tunnel。
+`
+
 // MergeWithFileConfig 将文件配置合并到Config结构中
 func (c *Config) MergeWithFileConfig(fileConfig *FileConfig, mode string) {
 	// 合并全局配置
 	if fileConfig.Global.LogLevel != "" {
 		// LogLevel 在Config中还没有，暂时忽略
 	}
+	if c.LogHeaders == "" && fileConfig.Global.LogHeaders != "" {
+		c.LogHeaders = fileConfig.Global.LogHeaders
+	}
+	if len(c.LogRedactHeaders) == 0 && len(fileConfig.Global.LogRedactHeaders) > 0 {
+		c.LogRedactHeaders = fileConfig.Global.LogRedactHeaders
+	}
+	if c.KeyPattern == "" && fileConfig.Global.KeyPattern != "" {
+		c.KeyPattern = fileConfig.Global.KeyPattern
+	}
+	if c.LogMaxSize == 0 && fileConfig.Global.LogMaxSize > 0 {
+		c.LogMaxSize = fileConfig.Global.LogMaxSize
+	}
+	if c.LogMaxBackups == 0 && fileConfig.Global.LogMaxBackups > 0 {
+		c.LogMaxBackups = fileConfig.Global.LogMaxBackups
+	}
+	if c.MaxUnknownMessages == 0 && fileConfig.Global.MaxUnknownMessages > 0 {
+		c.MaxUnknownMessages = fileConfig.Global.MaxUnknownMessages
+	}
+	if c.MaxHeaderCount == 0 && fileConfig.Global.MaxHeaderCount > 0 {
+		c.MaxHeaderCount = fileConfig.Global.MaxHeaderCount
+	}
+	if c.MaxHeaderFieldBytes == 0 && fileConfig.Global.MaxHeaderFieldBytes > 0 {
+		c.MaxHeaderFieldBytes = fileConfig.Global.MaxHeaderFieldBytes
+	}
+	if c.MaxHeaderBytes == 0 && fileConfig.Global.MaxHeaderBytes > 0 {
+		c.MaxHeaderBytes = fileConfig.Global.MaxHeaderBytes
+	}
+	if c.MessageAuthKey == "" && fileConfig.Global.MessageAuthKey != "" {
+		c.MessageAuthKey = fileConfig.Global.MessageAuthKey
+	}
+	if c.MessageAuthMaxFailures == 0 && fileConfig.Global.MessageAuthMaxFailures > 0 {
+		c.MessageAuthMaxFailures = fileConfig.Global.MessageAuthMaxFailures
+	}
+	if c.DNSCacheSize == 0 && fileConfig.Global.DNSCacheSize != 0 {
+		c.DNSCacheSize = fileConfig.Global.DNSCacheSize
+	}
+	if c.DNSMinTTL == 0 && fileConfig.Global.DNSMinTTL > 0 {
+		c.DNSMinTTL = time.Duration(fileConfig.Global.DNSMinTTL)
+	}
+	if c.DNSMaxTTL == 0 && fileConfig.Global.DNSMaxTTL > 0 {
+		c.DNSMaxTTL = time.Duration(fileConfig.Global.DNSMaxTTL)
+	}
+	if c.DNSNegativeTTL == 0 && fileConfig.Global.DNSNegativeTTL > 0 {
+		c.DNSNegativeTTL = time.Duration(fileConfig.Global.DNSNegativeTTL)
+	}
+	if c.DNSPrefer == "" && fileConfig.Global.DNSPrefer != "" {
+		c.DNSPrefer = fileConfig.Global.DNSPrefer
+	}
+	if c.DNSServer == "" && fileConfig.Global.DNSServer != "" {
+		c.DNSServer = fileConfig.Global.DNSServer
+	}
 
 	if mode == "server" {
 		// 合并服务器配置（只有当命令行参数为默认值时才使用文件配置）
@@ -99,6 +327,192 @@ func (c *Config) MergeWithFileConfig(fileConfig *FileConfig, mode string) {
 		if c.KeyRateLimit == 0 && fileConfig.Server.KeyRateLimit != 0 {
 			c.KeyRateLimit = fileConfig.Server.KeyRateLimit
 		}
+		if c.KeyRateBurst == 0 && fileConfig.Server.KeyRateBurst > 0 {
+			c.KeyRateBurst = fileConfig.Server.KeyRateBurst
+		}
+		if c.KeyRateSmoothing == 0 && fileConfig.Server.KeyRateSmoothing > 0 {
+			c.KeyRateSmoothing = time.Duration(fileConfig.Server.KeyRateSmoothing)
+		}
+		if c.TarpitDelay == 0 && fileConfig.Server.TarpitDelay > 0 {
+			c.TarpitDelay = time.Duration(fileConfig.Server.TarpitDelay)
+		}
+		if c.TarpitThreshold == 0 && fileConfig.Server.TarpitThreshold > 0 {
+			c.TarpitThreshold = fileConfig.Server.TarpitThreshold
+		}
+		if c.TarpitMaxConns == 0 && fileConfig.Server.TarpitMaxConns > 0 {
+			c.TarpitMaxConns = fileConfig.Server.TarpitMaxConns
+		}
+		if c.AdminToken == "" && fileConfig.Server.AdminToken != "" {
+			c.AdminToken = fileConfig.Server.AdminToken
+		}
+		if c.AutoKeyFormat == "" && fileConfig.Server.AutoKeyFormat != "" {
+			c.AutoKeyFormat = fileConfig.Server.AutoKeyFormat
+		}
+		if c.AutoKeyTTL == 0 && fileConfig.Server.AutoKeyTTL != 0 {
+			c.AutoKeyTTL = time.Duration(fileConfig.Server.AutoKeyTTL)
+		}
+		if c.CaptureDir == "" && fileConfig.Server.CaptureDir != "" {
+			c.CaptureDir = fileConfig.Server.CaptureDir
+		}
+		if c.MaxTunnelKeys == 0 && fileConfig.Server.MaxTunnelKeys > 0 {
+			c.MaxTunnelKeys = fileConfig.Server.MaxTunnelKeys
+		}
+		if c.FDWarnPercent == 0 && fileConfig.Server.FDWarnPercent > 0 {
+			c.FDWarnPercent = fileConfig.Server.FDWarnPercent
+		}
+		if c.DrainOnStop == 0 && fileConfig.Server.DrainOnStop > 0 {
+			c.DrainOnStop = time.Duration(fileConfig.Server.DrainOnStop)
+		}
+		if c.RedirectTo == "" && fileConfig.Server.RedirectTo != "" {
+			c.RedirectTo = fileConfig.Server.RedirectTo
+		}
+		if c.RedirectThreshold == 0 && fileConfig.Server.RedirectThreshold > 0 {
+			c.RedirectThreshold = fileConfig.Server.RedirectThreshold
+		}
+		if c.MaxResponseViolations == 0 && fileConfig.Server.MaxResponseViolations > 0 {
+			c.MaxResponseViolations = fileConfig.Server.MaxResponseViolations
+		}
+		if c.TunnelSendQueue == 0 && fileConfig.Server.TunnelSendQueue > 0 {
+			c.TunnelSendQueue = fileConfig.Server.TunnelSendQueue
+		}
+		if c.MaxBufferedFrameBytes == 0 && fileConfig.Server.MaxBufferedFrameBytes > 0 {
+			c.MaxBufferedFrameBytes = fileConfig.Server.MaxBufferedFrameBytes
+		}
+		if c.ChunkCoalesceBytes == 0 && fileConfig.Server.ChunkCoalesceBytes > 0 {
+			c.ChunkCoalesceBytes = fileConfig.Server.ChunkCoalesceBytes
+		}
+		if c.ChunkCoalesceDelay == 0 && fileConfig.Server.ChunkCoalesceDelay > 0 {
+			c.ChunkCoalesceDelay = time.Duration(fileConfig.Server.ChunkCoalesceDelay)
+		}
+		if c.TrafficMode == "" && fileConfig.Server.TrafficMode != "" {
+			c.TrafficMode = fileConfig.Server.TrafficMode
+		}
+		if c.PausedPage == "" && fileConfig.Server.PausedPage != "" {
+			c.PausedPage = fileConfig.Server.PausedPage
+		}
+		if c.AccessLogMaxOpenFiles == 0 && fileConfig.Server.AccessLogMaxOpenFiles > 0 {
+			c.AccessLogMaxOpenFiles = fileConfig.Server.AccessLogMaxOpenFiles
+		}
+		if c.AccessLogRing == 0 && fileConfig.Server.AccessLogRing > 0 {
+			c.AccessLogRing = fileConfig.Server.AccessLogRing
+		}
+		if c.LogCardinality == "" && fileConfig.Server.LogCardinality != "" {
+			c.LogCardinality = fileConfig.Server.LogCardinality
+		}
+		if c.LogCardinalityLimit == 0 && fileConfig.Server.LogCardinalityLimit > 0 {
+			c.LogCardinalityLimit = fileConfig.Server.LogCardinalityLimit
+		}
+		if c.RegistrationRate == 0 && fileConfig.Server.RegistrationRate != 0 {
+			c.RegistrationRate = fileConfig.Server.RegistrationRate
+		}
+		if c.RegistrationBurst == 0 && fileConfig.Server.RegistrationBurst > 0 {
+			c.RegistrationBurst = fileConfig.Server.RegistrationBurst
+		}
+		if c.ResponseHeaderTimeout == 0 && fileConfig.Server.ResponseHeaderTimeout > 0 {
+			c.ResponseHeaderTimeout = time.Duration(fileConfig.Server.ResponseHeaderTimeout)
+		}
+		if c.TunnelIdleMax == 0 && fileConfig.Server.TunnelIdleMax > 0 {
+			c.TunnelIdleMax = time.Duration(fileConfig.Server.TunnelIdleMax)
+		}
+		if c.ClientBodyReadTimeout == 0 && fileConfig.Server.ClientBodyReadTimeout > 0 {
+			c.ClientBodyReadTimeout = time.Duration(fileConfig.Server.ClientBodyReadTimeout)
+		}
+		if c.ResponseTimeout == 0 && fileConfig.Server.ResponseTimeout > 0 {
+			c.ResponseTimeout = time.Duration(fileConfig.Server.ResponseTimeout)
+		}
+		if c.RequestTimeoutMin == 0 && fileConfig.Server.RequestTimeoutMin > 0 {
+			c.RequestTimeoutMin = time.Duration(fileConfig.Server.RequestTimeoutMin)
+		}
+		if c.RequestTimeoutMax == 0 && fileConfig.Server.RequestTimeoutMax > 0 {
+			c.RequestTimeoutMax = time.Duration(fileConfig.Server.RequestTimeoutMax)
+		}
+		if !c.ProxyErrorHeader && fileConfig.Server.ProxyErrorHeader {
+			c.ProxyErrorHeader = true
+		}
+		if c.TruncatedResponse == "" && fileConfig.Server.TruncatedResponse != "" {
+			c.TruncatedResponse = fileConfig.Server.TruncatedResponse
+		}
+		if c.UsageFile == "" && fileConfig.Server.UsageFile != "" {
+			c.UsageFile = fileConfig.Server.UsageFile
+		}
+		if c.UsageRetentionDays == 0 && fileConfig.Server.UsageRetentionDays > 0 {
+			c.UsageRetentionDays = fileConfig.Server.UsageRetentionDays
+		}
+		if len(c.ProxyAllowCIDRs) == 0 && len(fileConfig.Server.ProxyAllowCIDRs) > 0 {
+			c.ProxyAllowCIDRs = fileConfig.Server.ProxyAllowCIDRs
+		}
+		if c.ConnectIdleTimeout == 0 && fileConfig.Server.ConnectIdleTimeout > 0 {
+			c.ConnectIdleTimeout = time.Duration(fileConfig.Server.ConnectIdleTimeout)
+		}
+		if len(c.ClusterPeers) == 0 && len(fileConfig.Server.ClusterPeers) > 0 {
+			c.ClusterPeers = fileConfig.Server.ClusterPeers
+		}
+		if c.ClusterToken == "" && fileConfig.Server.ClusterToken != "" {
+			c.ClusterToken = fileConfig.Server.ClusterToken
+		}
+		if c.ClusterSyncInterval == 0 && fileConfig.Server.ClusterSyncInterval > 0 {
+			c.ClusterSyncInterval = time.Duration(fileConfig.Server.ClusterSyncInterval)
+		}
+		if c.RegistrationListen == "" && fileConfig.Server.RegistrationListen != "" {
+			c.RegistrationListen = fileConfig.Server.RegistrationListen
+		}
+		if len(c.RegistrationAllowedCIDRs) == 0 && len(fileConfig.Server.RegistrationAllowedCIDRs) > 0 {
+			c.RegistrationAllowedCIDRs = fileConfig.Server.RegistrationAllowedCIDRs
+		}
+		if c.PublicBaseURL == "" && fileConfig.Server.PublicBaseURL != "" {
+			c.PublicBaseURL = fileConfig.Server.PublicBaseURL
+		}
+		if c.Keys == nil && len(fileConfig.Server.Keys) > 0 {
+			c.Keys = fileConfig.Server.Keys
+		}
+		if c.Hosts == nil && len(fileConfig.Server.Hosts) > 0 {
+			c.Hosts = fileConfig.Server.Hosts
+		}
+		if c.DefaultKey == "" && fileConfig.Server.DefaultKey != "" {
+			c.DefaultKey = fileConfig.Server.DefaultKey
+		}
+		if c.TLSUnknownSNI == "" && fileConfig.Server.TLSUnknownSNI != "" {
+			c.TLSUnknownSNI = fileConfig.Server.TLSUnknownSNI
+		}
+		if len(c.TLSFingerprintDeny) == 0 && len(fileConfig.Server.TLSFingerprintDeny) > 0 {
+			c.TLSFingerprintDeny = fileConfig.Server.TLSFingerprintDeny
+		}
+		if c.TLSClientCA == "" && fileConfig.Server.TLSClientCA != "" {
+			c.TLSClientCA = fileConfig.Server.TLSClientCA
+		}
+		if !c.ForwardedHeaders && fileConfig.Server.ForwardedHeaders {
+			c.ForwardedHeaders = true
+		}
+		if len(c.TrustedProxies) == 0 && len(fileConfig.Server.TrustedProxies) > 0 {
+			c.TrustedProxies = fileConfig.Server.TrustedProxies
+		}
+		if c.AdminTokens == nil && len(fileConfig.Server.AdminTokens) > 0 {
+			c.AdminTokens = fileConfig.Server.AdminTokens
+		}
+		if c.TopResponses == nil && fileConfig.Server.TopResponses != nil {
+			c.TopResponses = fileConfig.Server.TopResponses
+		}
+		if c.Watchdog == nil && fileConfig.Server.Watchdog != nil {
+			c.Watchdog = fileConfig.Server.Watchdog
+		}
+		if c.WSPathPrefix == "" && fileConfig.Server.WSPathPrefix != "" {
+			c.WSPathPrefix = fileConfig.Server.WSPathPrefix
+		}
+		if len(c.WSAllowedOrigins) == 0 && len(fileConfig.Server.WSAllowedOrigins) > 0 {
+			c.WSAllowedOrigins = fileConfig.Server.WSAllowedOrigins
+		}
+		if c.WSReadBufferSize == 0 && fileConfig.Server.WSReadBufferSize > 0 {
+			c.WSReadBufferSize = fileConfig.Server.WSReadBufferSize
+		}
+		if c.WSWriteBufferSize == 0 && fileConfig.Server.WSWriteBufferSize > 0 {
+			c.WSWriteBufferSize = fileConfig.Server.WSWriteBufferSize
+		}
+		if c.MaxFrameSize == 0 && fileConfig.Server.MaxFrameSize > 0 {
+			c.MaxFrameSize = fileConfig.Server.MaxFrameSize
+		}
+		if c.HeaderTableSize == 0 && fileConfig.Server.HeaderTableSize > 0 {
+			c.HeaderTableSize = fileConfig.Server.HeaderTableSize
+		}
 	} else if mode == "client" {
 		// 合并客户端配置
 		if c.ServerAddr == "" && fileConfig.Client.ServerAddr != "" {
@@ -113,6 +527,81 @@ func (c *Config) MergeWithFileConfig(fileConfig *FileConfig, mode string) {
 		if !c.Insecure && fileConfig.Client.Insecure {
 			c.Insecure = fileConfig.Client.Insecure
 		}
+		if len(c.Bindings) == 0 && len(fileConfig.Client.Bindings) > 0 {
+			c.Bindings = fileConfig.Client.Bindings
+		}
+		if !c.AutoKey && fileConfig.Client.AutoKey {
+			c.AutoKey = fileConfig.Client.AutoKey
+		}
+		if c.MaxConcurrentRequests == 0 && fileConfig.Client.MaxConcurrentRequests > 0 {
+			c.MaxConcurrentRequests = fileConfig.Client.MaxConcurrentRequests
+		}
+		if c.FullResponseThreshold == 0 && fileConfig.Client.FullResponseThreshold != 0 {
+			c.FullResponseThreshold = fileConfig.Client.FullResponseThreshold
+		}
+		if c.ChunkCoalesceBytes == 0 && fileConfig.Client.ChunkCoalesceBytes > 0 {
+			c.ChunkCoalesceBytes = fileConfig.Client.ChunkCoalesceBytes
+		}
+		if c.ChunkCoalesceDelay == 0 && fileConfig.Client.ChunkCoalesceDelay > 0 {
+			c.ChunkCoalesceDelay = time.Duration(fileConfig.Client.ChunkCoalesceDelay)
+		}
+		if c.Weight == 0 && fileConfig.Client.Weight > 0 {
+			c.Weight = fileConfig.Client.Weight
+		}
+		if c.TargetProtocol == "" && fileConfig.Client.TargetProtocol != "" {
+			c.TargetProtocol = fileConfig.Client.TargetProtocol
+		}
+		if !c.FollowTargetRedirects && fileConfig.Client.FollowTargetRedirects {
+			c.FollowTargetRedirects = true
+		}
+		if c.TargetLocationRewrite == "" && fileConfig.Client.TargetLocationRewrite != "" {
+			c.TargetLocationRewrite = fileConfig.Client.TargetLocationRewrite
+		}
+		if c.MetricsListen == "" && fileConfig.Client.MetricsListen != "" {
+			c.MetricsListen = fileConfig.Client.MetricsListen
+		}
+		if c.LocalListen == "" && fileConfig.Client.LocalListen != "" {
+			c.LocalListen = fileConfig.Client.LocalListen
+		}
+		if c.LocalKey == "" && fileConfig.Client.LocalKey != "" {
+			c.LocalKey = fileConfig.Client.LocalKey
+		}
+		if c.AbortWebhook == "" && fileConfig.Client.AbortWebhook != "" {
+			c.AbortWebhook = fileConfig.Client.AbortWebhook
+		}
+		if c.RequestIDHeader == "" && fileConfig.Client.RequestIDHeader != "" {
+			c.RequestIDHeader = fileConfig.Client.RequestIDHeader
+		}
+		if !c.WaitForTarget && fileConfig.Client.WaitForTarget {
+			c.WaitForTarget = true
+		}
+		if c.WaitForTargetTimeout == 0 && fileConfig.Client.WaitForTargetTimeout > 0 {
+			c.WaitForTargetTimeout = time.Duration(fileConfig.Client.WaitForTargetTimeout)
+		}
+		if c.WaitForTargetPath == "" && fileConfig.Client.WaitForTargetPath != "" {
+			c.WaitForTargetPath = fileConfig.Client.WaitForTargetPath
+		}
+		if !c.WaitForTargetExit && fileConfig.Client.WaitForTargetExit {
+			c.WaitForTargetExit = true
+		}
+		if !c.WaitForTargetReconnect && fileConfig.Client.WaitForTargetReconnect {
+			c.WaitForTargetReconnect = true
+		}
+		if c.MaxReconnects == 0 && fileConfig.Client.MaxReconnects > 0 {
+			c.MaxReconnects = fileConfig.Client.MaxReconnects
+		}
+		if len(c.RedirectAllow) == 0 && len(fileConfig.Client.RedirectAllow) > 0 {
+			c.RedirectAllow = fileConfig.Client.RedirectAllow
+		}
+		if c.WSReadBufferSize == 0 && fileConfig.Client.WSReadBufferSize > 0 {
+			c.WSReadBufferSize = fileConfig.Client.WSReadBufferSize
+		}
+		if c.WSWriteBufferSize == 0 && fileConfig.Client.WSWriteBufferSize > 0 {
+			c.WSWriteBufferSize = fileConfig.Client.WSWriteBufferSize
+		}
+		if c.MaxFrameSize == 0 && fileConfig.Client.MaxFrameSize > 0 {
+			c.MaxFrameSize = fileConfig.Client.MaxFrameSize
+		}
 	}
 }
 
@@ -132,7 +621,7 @@ func LoadWithFile(configPath string, baseConfig *Config) (*Config, error) {
 		// 尝试在常见位置查找配置文件
 		possiblePaths := []string{
 			"./singleproxy.yaml",
-			"./config/singleproxy.yaml", 
+			"./config/singleproxy.yaml",
 			"~/.singleproxy.yaml",
 			"/etc/singleproxy.yaml",
 		}
@@ -160,17 +649,33 @@ func LoadWithFile(configPath string, baseConfig *Config) (*Config, error) {
 func GenerateExampleConfig(filename string) error {
 	exampleConfig := &FileConfig{
 		Server: ServerConfig{
-			ListenPort:   "443",
-			CertFile:     "/path/to/cert.pem",
-			KeyFile:      "/path/to/key.pem",
-			IPRateLimit:  100,
-			KeyRateLimit: 50,
+			ListenPort:    "443",
+			DefaultKey:    DefaultKeyNone,
+			WSPathPrefix:  DefaultWSPathPrefix,
+			CertFile:      "/path/to/cert.pem",
+			KeyFile:       "/path/to/key.pem",
+			IPRateLimit:   100,
+			KeyRateLimit:  50,
+			AutoKeyFormat: "words",
+			AutoKeyTTL:    Duration(time.Hour),
+			PublicBaseURL: "https://your-domain.com",
+			Keys: map[string]*KeyConfig{
+				"your-service-key": {
+					AllowedHosts: []string{"*.your-domain.com"},
+					AllowedPorts: []string{"20000-20100"},
+				},
+			},
+			AdminTokens: []*AdminTokenConfig{
+				{Name: "team-a", Token: "change-me-team-a-token", Keys: []string{"team-a-*"}},
+			},
 		},
 		Client: ClientConfig{
 			ServerAddr: "wss://your-domain.com",
 			TargetAddr: "127.0.0.1:8080",
 			Key:        "your-service-key",
 			Insecure:   false,
+
+			MaxConcurrentRequests: 512,
 		},
 		Global: GlobalConfig{
 			LogLevel: "info",
@@ -178,5 +683,5 @@ func GenerateExampleConfig(filename string) error {
 		},
 	}
 
-	return SaveConfigFile(filename, exampleConfig)
-}
\ No newline at end of file
+	return saveConfigFile(filename, exampleConfig, exampleConfigHeader)
+}
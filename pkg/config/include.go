@@ -0,0 +1,189 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// maxIncludeDepth include 的最大嵌套层数
+const maxIncludeDepth = 8
+
+// configLoader 读取配置文件及其 include 的文件，合并为一棵YAML树。
+// 映射按键深度合并，列表按加载顺序拼接，同一位置的标量只能定义一次 (相同的值除外)
+type configLoader struct {
+	merged  map[interface{}]interface{}
+	origins map[string]string // 标量的路径 -> 定义它的文件，用于冲突提示
+	loaded  map[string]bool   // 已加载的文件，多个 include 匹配同一文件时只加载一次
+	stack   []string          // 当前的 include 链，用于发现循环
+}
+
+// loadConfigTree 加载配置文件，展开 include 并合并文件内的多个YAML文档，返回合并后的YAML
+func loadConfigTree(filename string) ([]byte, error) {
+	l := &configLoader{
+		merged:  make(map[interface{}]interface{}),
+		origins: make(map[string]string),
+		loaded:  make(map[string]bool),
+	}
+	if err := l.load(filename); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(l.merged)
+}
+
+func (l *configLoader) load(filename string) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	for _, f := range l.stack {
+		if f == abs {
+			return fmt.Errorf("include cycle: %s -> %s", strings.Join(l.stack, " -> "), abs)
+		}
+	}
+	if len(l.stack) > maxIncludeDepth {
+		return fmt.Errorf("include depth exceeds %d: %s", maxIncludeDepth, strings.Join(append(l.stack, abs), " -> "))
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return err
+	}
+	l.stack = append(l.stack, abs)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	// 一个文件可以包含多个以 --- 分隔的文档，依次合并
+	var includes []string
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc map[interface{}]interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("%s: %v", abs, err)
+		}
+		if raw, ok := doc["include"]; ok {
+			patterns, err := includePatterns(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %v", abs, err)
+			}
+			includes = append(includes, patterns...)
+			delete(doc, "include")
+		}
+		if err := l.merge(l.merged, doc, "", abs); err != nil {
+			return err
+		}
+	}
+
+	// include 的路径相对于当前文件所在目录，通配按文件名排序后加载
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(abs), pattern)
+		}
+		files := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			if files, err = filepath.Glob(pattern); err != nil {
+				return fmt.Errorf("%s: invalid include pattern %q: %v", abs, pattern, err)
+			}
+			sort.Strings(files)
+		}
+		for _, f := range files {
+			if err := l.load(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// includePatterns 解析 include 的值，支持单个字符串或字符串列表
+func includePatterns(raw interface{}) ([]string, error) {
+	switch v := raw.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		patterns := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("include entries must be strings, got %v", item)
+			}
+			patterns = append(patterns, s)
+		}
+		return patterns, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("include must be a string or a list of strings")
+}
+
+// merge 将 src 合并到 dst。path 为当前位置的点分路径，file 为 src 所在文件
+func (l *configLoader) merge(dst, src map[interface{}]interface{}, path, file string) error {
+	for k, v := range src {
+		key := fmt.Sprint(k)
+		if path != "" {
+			key = path + "." + key
+		}
+		existing, ok := dst[k]
+		if !ok || existing == nil {
+			dst[k] = v
+			l.recordOrigins(v, key, file)
+			continue
+		}
+		switch ev := existing.(type) {
+		case map[interface{}]interface{}:
+			sv, ok := v.(map[interface{}]interface{})
+			if !ok {
+				if v == nil {
+					continue
+				}
+				return l.conflict(key, file)
+			}
+			if err := l.merge(ev, sv, key, file); err != nil {
+				return err
+			}
+		case []interface{}:
+			sv, ok := v.([]interface{})
+			if !ok {
+				if v == nil {
+					continue
+				}
+				return l.conflict(key, file)
+			}
+			dst[k] = append(ev, sv...)
+		default:
+			if v == nil || reflect.DeepEqual(existing, v) {
+				continue
+			}
+			return l.conflict(key, file)
+		}
+	}
+	return nil
+}
+
+// recordOrigins 记录新加入的值及其下所有标量的来源文件
+func (l *configLoader) recordOrigins(v interface{}, key, file string) {
+	l.origins[key] = file
+	if m, ok := v.(map[interface{}]interface{}); ok {
+		for k, child := range m {
+			l.recordOrigins(child, key+"."+fmt.Sprint(k), file)
+		}
+	}
+}
+
+func (l *configLoader) conflict(key, file string) error {
+	return fmt.Errorf("conflicting definitions of %s in %s and %s", key, l.origins[key], file)
+}
@@ -0,0 +1,322 @@
+// Package dnscache 为出站连接提供带TTL的域名解析缓存，
+// 客户端转发到目标服务、SOCKS5 和正向代理的拨号共用同一个缓存
+package dnscache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"singleproxy/pkg/metrics"
+)
+
+const (
+	defaultSize        = 1024
+	defaultMinTTL      = 5 * time.Second
+	defaultMaxTTL      = 5 * time.Minute
+	defaultNegativeTTL = 5 * time.Second
+
+	// 标准库解析器不返回记录的TTL，此时使用该值再按上下限截断
+	defaultTTL = time.Minute
+)
+
+var (
+	hitsCounter = metrics.NewCounter("singleproxy_dns_cache_hits_total",
+		"Outbound DNS lookups answered from the cache")
+	missesCounter = metrics.NewCounter("singleproxy_dns_cache_misses_total",
+		"Outbound DNS lookups sent to the resolver")
+)
+
+// Options 缓存配置，零值表示使用默认值
+type Options struct {
+	Size        int           // 缓存条目上限 (0为默认1024, 负数禁用缓存)
+	MinTTL      time.Duration // 缓存时长下限 (0为默认5秒)
+	MaxTTL      time.Duration // 缓存时长上限 (0为默认5分钟)
+	NegativeTTL time.Duration // 域名不存在时的缓存时长 (0为默认5秒)
+	Prefer      string        // 地址族偏好: ipv4, ipv6 (为空保持解析器返回的顺序)
+	Server      string        // 自定义DNS服务器 host:port (为空使用系统解析器)
+}
+
+// Resolver 可替换的域名解析器，*net.Resolver 即满足该接口
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// TTLResolver 能返回记录TTL的解析器，缓存会按返回的TTL过期
+type TTLResolver interface {
+	Resolver
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+// Stats 缓存统计
+type Stats struct {
+	Entries  int     `json:"entries"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+type entry struct {
+	host    string
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// Cache 按LRU淘汰的域名解析缓存
+type Cache struct {
+	opts     Options
+	resolver Resolver
+	dialer   *net.Dialer
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// New 创建缓存，resolver 为nil时根据 opts.Server 选择解析器
+func New(opts Options, resolver Resolver) *Cache {
+	if opts.Size == 0 {
+		opts.Size = defaultSize
+	}
+	if opts.MinTTL <= 0 {
+		opts.MinTTL = defaultMinTTL
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = defaultMaxTTL
+	}
+	if opts.MaxTTL < opts.MinTTL {
+		opts.MaxTTL = opts.MinTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+	if resolver == nil {
+		resolver = newResolver(opts.Server)
+	}
+	return &Cache{
+		opts:     opts,
+		resolver: resolver,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// newResolver 返回系统解析器，或固定查询指定DNS服务器的解析器
+func newResolver(server string) Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+var defaultCache atomic.Pointer[Cache]
+
+func init() {
+	defaultCache.Store(New(Options{}, nil))
+	metrics.NewGaugeFunc("singleproxy_dns_cache_entries",
+		"Entries currently held in the outbound DNS cache",
+		func() int64 { return int64(Default().Len()) })
+}
+
+// Configure 使用新的配置替换进程共用的缓存，原有条目随之丢弃
+func Configure(opts Options) {
+	defaultCache.Store(New(opts, nil))
+}
+
+// Default 返回进程共用的缓存
+func Default() *Cache {
+	return defaultCache.Load()
+}
+
+// DialContext 使用进程共用的缓存解析并拨号，可直接用作 http.Transport.DialContext
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return Default().DialContext(ctx, network, addr)
+}
+
+// LookupIPAddr 解析主机名，结果按地址族偏好排序。IP字面量直接返回
+func (c *Cache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	if c.opts.Size < 0 {
+		addrs, _, err := c.lookup(ctx, name)
+		return c.order(addrs), err
+	}
+
+	if e, ok := c.get(name); ok {
+		c.hits.Add(1)
+		hitsCounter.Inc()
+		return c.order(e.addrs), e.err
+	}
+	c.misses.Add(1)
+	missesCounter.Inc()
+
+	addrs, ttl, err := c.lookup(ctx, name)
+	switch {
+	case err == nil:
+		c.put(&entry{host: name, addrs: addrs, expires: c.now().Add(c.clamp(ttl))})
+	case isNotFound(err):
+		// 只缓存确定的否定结果，超时等临时错误下次重新查询
+		c.put(&entry{host: name, err: err, expires: c.now().Add(c.opts.NegativeTTL)})
+	}
+	return c.order(addrs), err
+}
+
+// lookup 查询解析器，解析器不提供TTL时返回0
+func (c *Cache) lookup(ctx context.Context, name string) ([]net.IPAddr, time.Duration, error) {
+	if r, ok := c.resolver.(TTLResolver); ok {
+		return r.LookupIPAddrTTL(ctx, name)
+	}
+	addrs, err := c.resolver.LookupIPAddr(ctx, name)
+	return addrs, 0, err
+}
+
+// clamp 将TTL限制在配置的上下限之间
+func (c *Cache) clamp(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return min(max(ttl, c.opts.MinTTL), c.opts.MaxTTL)
+}
+
+func (c *Cache) get(name string) (*entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, name)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return e, true
+}
+
+func (c *Cache) put(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[e.host]; ok {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[e.host] = c.lru.PushFront(e)
+	for c.lru.Len() > c.opts.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).host)
+	}
+}
+
+// order 返回按地址族偏好排序的副本，缓存中的切片不会被修改
+func (c *Cache) order(addrs []net.IPAddr) []net.IPAddr {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	out := append([]net.IPAddr(nil), addrs...)
+	if c.opts.Prefer != "ipv4" && c.opts.Prefer != "ipv6" {
+		return out
+	}
+	preferV4 := c.opts.Prefer == "ipv4"
+	sort.SliceStable(out, func(i, j int) bool {
+		iv4, jv4 := out[i].IP.To4() != nil, out[j].IP.To4() != nil
+		return iv4 != jv4 && iv4 == preferV4
+	})
+	return out
+}
+
+// DialContext 解析地址后依次尝试每个IP，返回第一个成功的连接
+func (c *Cache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return c.DialWith(ctx, c.dialer, network, addr)
+}
+
+// DialWith 与 DialContext 相同，但使用调用方提供的 Dialer，用于附加 Control 等检查
+func (c *Cache) DialWith(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := c.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range addrs {
+		isV4 := ip.IP.To4() != nil
+		if (strings.HasSuffix(network, "4") && !isV4) || (strings.HasSuffix(network, "6") && isV4) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	return nil, lastErr
+}
+
+// Flush 清空缓存，返回被清除的条目数
+func (c *Cache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	return n
+}
+
+// Len 返回当前缓存的条目数 (包括尚未清理的过期条目)
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Stats 返回缓存统计
+func (c *Cache) Stats() Stats {
+	s := Stats{Entries: c.Len(), Hits: c.hits.Load(), Misses: c.misses.Load()}
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+	return s
+}
+
+// isNotFound 判断是否为域名不存在等确定的否定结果
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
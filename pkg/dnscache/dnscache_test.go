@@ -0,0 +1,167 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeResolver 记录查询次数的解析器
+type fakeResolver struct {
+	addrs map[string][]net.IPAddr
+	ttl   time.Duration
+	calls int
+}
+
+func (r *fakeResolver) LookupIPAddrTTL(_ context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	r.calls++
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, r.ttl, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+func ips(list ...string) []net.IPAddr {
+	var out []net.IPAddr
+	for _, s := range list {
+		out = append(out, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	return out
+}
+
+// newTestCache 创建使用假时钟的缓存
+func newTestCache(opts Options, r Resolver) (*Cache, *time.Time) {
+	c := New(opts, r)
+	now := time.Unix(1700000000, 0)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCacheRespectsClampedTTL(t *testing.T) {
+	r := &fakeResolver{addrs: map[string][]net.IPAddr{"app.example": ips("192.0.2.1")}, ttl: time.Hour}
+	c, now := newTestCache(Options{MinTTL: time.Second, MaxTTL: 10 * time.Second}, r)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.LookupIPAddr(context.Background(), "App.Example."); err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+	}
+	if r.calls != 1 {
+		t.Errorf("Expected 1 resolver call, got %d", r.calls)
+	}
+
+	// 记录TTL为1小时，但被 max_ttl 截断为10秒
+	*now = now.Add(11 * time.Second)
+	c.LookupIPAddr(context.Background(), "app.example")
+	if r.calls != 2 {
+		t.Errorf("Expected entry to expire after max TTL, got %d resolver calls", r.calls)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.HitRatio != 0.5 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheNegativeResults(t *testing.T) {
+	r := &fakeResolver{addrs: map[string][]net.IPAddr{}}
+	c, now := newTestCache(Options{NegativeTTL: 2 * time.Second}, r)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupIPAddr(context.Background(), "missing.example"); !isNotFound(err) {
+			t.Fatalf("Expected not-found error, got %v", err)
+		}
+	}
+	if r.calls != 1 {
+		t.Errorf("Expected negative result to be cached, got %d resolver calls", r.calls)
+	}
+	*now = now.Add(3 * time.Second)
+	c.LookupIPAddr(context.Background(), "missing.example")
+	if r.calls != 2 {
+		t.Errorf("Expected negative entry to expire, got %d resolver calls", r.calls)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	r := &fakeResolver{addrs: map[string][]net.IPAddr{
+		"a.example": ips("192.0.2.1"),
+		"b.example": ips("192.0.2.2"),
+		"c.example": ips("192.0.2.3"),
+	}}
+	c, _ := newTestCache(Options{Size: 2}, r)
+	ctx := context.Background()
+
+	c.LookupIPAddr(ctx, "a.example")
+	c.LookupIPAddr(ctx, "b.example")
+	c.LookupIPAddr(ctx, "a.example") // a 变为最近使用
+	c.LookupIPAddr(ctx, "c.example") // 淘汰 b
+	calls := r.calls
+	c.LookupIPAddr(ctx, "a.example")
+	if r.calls != calls {
+		t.Errorf("Expected a.example to stay cached")
+	}
+	c.LookupIPAddr(ctx, "b.example")
+	if r.calls != calls+1 {
+		t.Errorf("Expected b.example to be evicted")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", c.Len())
+	}
+	if n := c.Flush(); n != 2 || c.Len() != 0 {
+		t.Errorf("Flush removed %d entries, %d left", n, c.Len())
+	}
+}
+
+func TestCachePreferAddressFamily(t *testing.T) {
+	r := &fakeResolver{addrs: map[string][]net.IPAddr{"dual.example": ips("2001:db8::1", "192.0.2.1", "2001:db8::2")}}
+	for prefer, first := range map[string]string{"ipv4": "192.0.2.1", "ipv6": "2001:db8::1", "": "2001:db8::1"} {
+		c, _ := newTestCache(Options{Prefer: prefer}, r)
+		addrs, err := c.LookupIPAddr(context.Background(), "dual.example")
+		if err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+		if len(addrs) != 3 || addrs[0].IP.String() != first {
+			t.Errorf("prefer=%q: unexpected order %v", prefer, addrs)
+		}
+	}
+}
+
+func TestDialUsesCachedAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// 监听只绑定 127.0.0.1，第一个地址拒绝连接，拨号应回退到第二个
+	r := &fakeResolver{addrs: map[string][]net.IPAddr{"target.example": ips("127.0.0.2", "127.0.0.1")}}
+	c := New(Options{}, r)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	for i := 0; i < 2; i++ {
+		conn, err := c.DialContext(context.Background(), "tcp4", net.JoinHostPort("target.example", port))
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.Close()
+	}
+	if r.calls != 1 {
+		t.Errorf("Expected 1 resolver call, got %d", r.calls)
+	}
+}
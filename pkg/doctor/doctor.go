@@ -0,0 +1,309 @@
+// Package doctor 实现配置自检：检查配置文件、证书、端口和网络连通性，
+// 以 PASS/WARN/FAIL 列表的形式给出可操作的提示
+package doctor
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+)
+
+// Status 单项检查的结果
+type Status string
+
+const (
+	Pass Status = "PASS"
+	Warn Status = "WARN"
+	Fail Status = "FAIL"
+)
+
+// 证书剩余有效期低于该值时给出警告
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// 与服务器时钟偏差超过该值时给出警告
+const maxClockSkew = time.Minute
+
+// Result 单项检查
+type Result struct {
+	Name    string
+	Status  Status
+	Message string
+}
+
+// Options 自检选项
+type Options struct {
+	// Network 为 true 时执行网络检查：端口绑定、服务器握手和目标连通性。
+	// 启动时的轻量自检不执行网络检查
+	Network bool
+	// CheckKey 握手检查使用的key，为空时随机生成，避免顶替正在运行的隧道
+	CheckKey string
+	// Timeout 单项网络检查的超时 (0为默认5秒)
+	Timeout time.Duration
+}
+
+// Report 自检报告
+type Report struct {
+	Results []Result
+}
+
+func (r *Report) add(name string, status Status, format string, args ...any) {
+	r.Results = append(r.Results, Result{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// Failed 是否存在失败项
+func (r *Report) Failed() bool {
+	for _, res := range r.Results {
+		if res.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Write 以每行一项的格式输出报告
+func (r *Report) Write(w io.Writer) {
+	counts := make(map[Status]int)
+	for _, res := range r.Results {
+		fmt.Fprintf(w, "[%s] %-16s %s\n", res.Status, res.Name, res.Message)
+		counts[res.Status]++
+	}
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed\n", counts[Pass], counts[Warn], counts[Fail])
+}
+
+// Run 按运行模式执行自检
+func Run(cfg *config.Config, opts Options) *Report {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	r := &Report{}
+
+	if cfg.ConfigFile != "" {
+		if _, err := os.Stat(cfg.ConfigFile); err != nil {
+			r.add("config_file", Fail, "cannot read %s: %v", cfg.ConfigFile, err)
+		} else {
+			r.add("config_file", Pass, "%s", cfg.ConfigFile)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		r.add("config", Fail, "%v", err)
+		return r
+	}
+	r.add("config", Pass, "mode %s", cfg.Mode)
+
+	switch cfg.Mode {
+	case "server":
+		checkServerConfig(r, cfg)
+		checkTLSFiles(r, cfg)
+		if opts.Network {
+			checkListenPort(r, cfg)
+		}
+	case "client", "http-client":
+		serverURL, ok := checkClientConfig(r, cfg)
+		if opts.Network && ok {
+			if checkServerReachable(r, serverURL, opts.Timeout) && cfg.Mode == "client" {
+				checkHandshake(r, cfg, serverURL, opts)
+			}
+		}
+		if opts.Network {
+			checkTarget(r, cfg.TargetAddr, opts.Timeout)
+		}
+	}
+	return r
+}
+
+// checkServerConfig 检查服务器配置项之间的关系
+func checkServerConfig(r *Report, cfg *config.Config) {
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < 16 {
+		r.add("admin_token", Warn, "admin token is only %d characters; use at least 16 random characters", len(cfg.AdminToken))
+	}
+	if cfg.PublicBaseURL != "" {
+		u, err := url.Parse(cfg.PublicBaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			r.add("public_base_url", Warn, "%q should be an absolute http(s) URL such as https://tunnel.example.com", cfg.PublicBaseURL)
+		}
+	}
+}
+
+// checkTLSFiles 检查证书和私钥文件可读、互相匹配且在有效期内
+func checkTLSFiles(r *Report, cfg *config.Config) {
+	switch {
+	case !cfg.TLSEnabled():
+		r.add("tls", Pass, "TLS is disabled; expecting TLS to be terminated in front of the server")
+		return
+	case cfg.CertFile == "":
+		r.add("tls", Pass, "no default certificate; handshakes for server names not listed in hosts are rejected")
+		return
+	}
+
+	pair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		r.add("tls", Fail, "cannot load %s / %s: %v", cfg.CertFile, cfg.KeyFile, err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		r.add("tls", Fail, "cannot parse certificate %s: %v", cfg.CertFile, err)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(leaf.NotBefore):
+		r.add("tls", Fail, "certificate is not valid until %s; check the system clock", leaf.NotBefore.Format(time.RFC3339))
+	case now.After(leaf.NotAfter):
+		r.add("tls", Fail, "certificate expired at %s; renew it", leaf.NotAfter.Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		r.add("tls", Warn, "certificate expires soon (%s); renew it", leaf.NotAfter.Format(time.RFC3339))
+	default:
+		r.add("tls", Pass, "certificate matches key, valid until %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// checkListenPort 检查监听端口可以绑定
+func checkListenPort(r *Report, cfg *config.Config) {
+	ln, err := net.Listen("tcp", ":"+cfg.ListenPort)
+	if err != nil {
+		hint := "another process may be using it"
+		if errors.Is(err, os.ErrPermission) {
+			hint = "ports below 1024 need root or CAP_NET_BIND_SERVICE"
+		}
+		r.add("listen_port", Fail, "cannot bind port %s: %v (%s)", cfg.ListenPort, err, hint)
+		return
+	}
+	ln.Close()
+	r.add("listen_port", Pass, "port %s is available", cfg.ListenPort)
+}
+
+// checkClientConfig 检查客户端的服务器和目标地址格式
+func checkClientConfig(r *Report, cfg *config.Config) (*url.URL, bool) {
+	ok := true
+	serverURL, err := url.Parse(cfg.ServerAddr)
+	wantSchemes := "ws:// or wss://"
+	schemeOK := err == nil && (serverURL.Scheme == "ws" || serverURL.Scheme == "wss")
+	if cfg.Mode == "http-client" {
+		wantSchemes = "http:// or https://"
+		schemeOK = err == nil && (serverURL.Scheme == "http" || serverURL.Scheme == "https")
+	}
+	if !schemeOK || serverURL.Host == "" {
+		r.add("server_addr", Fail, "%q must start with %s and include a host", cfg.ServerAddr, wantSchemes)
+		ok = false
+	} else if path := strings.TrimSuffix(serverURL.Path, "/"); strings.HasSuffix(path, "/ws") || strings.Contains(path, "/ws/") {
+		r.add("server_addr", Warn, "path %q already contains /ws; the client appends /ws/{key} itself, so use only the prefix (e.g. wss://example.com/tunnel)", serverURL.Path)
+	} else {
+		r.add("server_addr", Pass, "%s", cfg.ServerAddr)
+	}
+	if ok && serverURL.Scheme == "wss" && cfg.Insecure {
+		r.add("insecure", Warn, "-insecure disables certificate verification; use it only for testing")
+	}
+
+	if cfg.AutoKey && cfg.Mode == "http-client" {
+		r.add("auto_key", Warn, "-auto-key is only supported in client mode and is ignored")
+	}
+	return serverURL, ok
+}
+
+// serverHostPort 返回服务器地址的 host:port，缺省端口按 scheme 推断
+func serverHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "wss" || u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// checkServerReachable 检查服务器地址可以解析并建立TCP连接
+func checkServerReachable(r *Report, u *url.URL, timeout time.Duration) bool {
+	if _, err := net.LookupHost(u.Hostname()); err != nil {
+		r.add("server_dns", Fail, "cannot resolve %s: %v", u.Hostname(), err)
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", serverHostPort(u), timeout)
+	if err != nil {
+		r.add("server_tcp", Fail, "cannot connect to %s: %v; check the address and firewall", serverHostPort(u), err)
+		return false
+	}
+	conn.Close()
+	r.add("server_tcp", Pass, "%s is reachable", serverHostPort(u))
+	return true
+}
+
+// checkHandshake 使用 dry-run key 完成一次 WebSocket 注册握手，并比较服务器时钟
+func checkHandshake(r *Report, cfg *config.Config, serverURL *url.URL, opts Options) {
+	key := opts.CheckKey
+	if key == "" {
+		buf := make([]byte, 4)
+		_, _ = rand.Read(buf)
+		key = "doctor-check-" + hex.EncodeToString(buf)
+	}
+
+	connURL := *serverURL
+	connURL.Path = protocol.JoinTunnelPath(connURL.Path, protocol.WebSocketPathSegment, key)
+	dialer := websocket.Dialer{
+		HandshakeTimeout: opts.Timeout,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: cfg.Insecure},
+	}
+
+	conn, resp, err := dialer.Dial(connURL.String(), nil)
+	if err != nil {
+		var certErr x509.CertificateInvalidError
+		var unknownAuthErr x509.UnknownAuthorityError
+		switch {
+		case errors.As(err, &certErr) && certErr.Reason == x509.Expired:
+			r.add("handshake", Fail, "server certificate is expired or not yet valid: %v; check the system clock on both hosts", err)
+		case errors.As(err, &unknownAuthErr):
+			r.add("handshake", Fail, "server certificate is not trusted: %v; install the CA or use -insecure for testing", err)
+		case resp != nil && resp.StatusCode == http.StatusNotFound:
+			r.add("handshake", Fail, "server returned 404 for %s; check the path prefix and reverse proxy WebSocket settings", connURL.Path)
+		case resp != nil:
+			r.add("handshake", Fail, "server rejected the handshake with %s", resp.Status)
+		default:
+			r.add("handshake", Fail, "WebSocket handshake failed: %v", err)
+		}
+		return
+	}
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "doctor check"),
+		time.Now().Add(time.Second))
+	conn.Close()
+	r.add("handshake", Pass, "registered dry-run key %s", key)
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		if skew := time.Since(date); skew > maxClockSkew || skew < -maxClockSkew {
+			r.add("clock", Warn, "local clock differs from the server by %s; large skews break TLS and key expiry", skew.Round(time.Second))
+		} else {
+			r.add("clock", Pass, "clock skew %s", skew.Round(time.Second))
+		}
+	}
+}
+
+// checkTarget 检查目标服务接受TCP连接
+func checkTarget(r *Report, targetAddr string, timeout time.Duration) {
+	// 格式错误已在 checkClientConfig 中报告
+	if _, _, err := net.SplitHostPort(targetAddr); err != nil || strings.Contains(targetAddr, "://") {
+		return
+	}
+	conn, err := net.DialTimeout("tcp", targetAddr, timeout)
+	if err != nil {
+		r.add("target", Fail, "cannot connect to target %s: %v; is the local service running?", targetAddr, err)
+		return
+	}
+	conn.Close()
+	r.add("target", Pass, "%s accepts connections", targetAddr)
+}
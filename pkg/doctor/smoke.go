@@ -0,0 +1,214 @@
+package doctor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	"singleproxy/pkg/protocol"
+)
+
+// SmokeOptions test 子命令的参数
+type SmokeOptions struct {
+	// Server 服务器的公网地址, e.g. https://example.com
+	Server string
+	// Key 要测试的隧道key，通过 X-Tunnel-Key 头路由
+	Key string
+	// Path 请求路径 (默认 /)
+	Path string
+	// Host 覆盖 Host 头，测试主机名绑定时使用
+	Host string
+	// Insecure 跳过服务器证书验证
+	Insecure bool
+	// Timeout 单次请求的超时 (0为默认10秒)
+	Timeout time.Duration
+
+	// TunnelSide 为 true 时通过管理API要求已连接的客户端检查能否访问目标服务
+	TunnelSide bool
+	// AdminToken 管理API令牌，TunnelSide 时必填
+	AdminToken string
+}
+
+// smokeTimings 公网请求各阶段的耗时
+type smokeTimings struct {
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+}
+
+func span(from, to time.Time) string {
+	if from.IsZero() || to.IsZero() {
+		return "-"
+	}
+	return to.Sub(from).Round(time.Microsecond).String()
+}
+
+// Smoke 以公网用户身份请求指定key，检查服务器、隧道和目标服务整条链路
+func Smoke(opts SmokeOptions) *Report {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	r := &Report{}
+
+	base, err := url.Parse(strings.TrimSuffix(opts.Server, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		r.add("server", Fail, "%q must be an http:// or https:// URL such as https://tunnel.example.com", opts.Server)
+		return r
+	}
+	if opts.Key == "" && opts.Host == "" {
+		r.add("key", Fail, "either --key or --host is required to route the request")
+		return r
+	}
+
+	httpClient := &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: opts.Insecure},
+			DisableKeepAlives: true,
+		},
+		// 重定向由目标服务决定，原样报告
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	smokePublicRequest(r, httpClient, base, opts)
+	if opts.TunnelSide {
+		smokeTunnelSide(r, httpClient, base, opts)
+	}
+	return r
+}
+
+// smokePublicRequest 发送一次公网请求并报告状态、耗时和响应大小
+func smokePublicRequest(r *Report, httpClient *http.Client, base *url.URL, opts SmokeOptions) {
+	target := base.String() + opts.Path
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		r.add("request", Fail, "invalid path %q: %v", opts.Path, err)
+		return
+	}
+	if opts.Key != "" {
+		req.Header.Set(protocol.HeaderTunnelKey, opts.Key)
+	}
+	if opts.Host != "" {
+		req.Host = opts.Host
+	}
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	requestID := hex.EncodeToString(buf)
+	req.Header.Set("X-Request-Id", requestID)
+	req.Header.Set("User-Agent", "singleproxy-test")
+
+	var t smokeTimings
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { t.connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { t.connectDone = time.Now() },
+		TLSHandshakeStart:    func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.tlsDone = time.Now() },
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+	start := time.Now()
+	resp, err := httpClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		r.add("request", Fail, "GET %s failed: %v", target, err)
+		return
+	}
+	size, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	total := time.Since(start)
+	if err != nil {
+		r.add("request", Fail, "GET %s: reading the body failed after %d bytes: %v", target, size, err)
+		return
+	}
+
+	status := Pass
+	hint := ""
+	switch {
+	case resp.StatusCode == http.StatusBadGateway:
+		status, hint = Fail, "; no client is connected for the key, or the client cannot reach its target (try --tunnel-side)"
+	case resp.StatusCode == http.StatusGatewayTimeout:
+		status, hint = Fail, "; the tunnel client or target did not answer in time"
+	case resp.StatusCode == http.StatusTooManyRequests:
+		status, hint = Fail, "; rate limited by the server"
+	case resp.StatusCode >= 400:
+		status = Fail
+	}
+	r.add("request", status, "GET %s -> %s (%d bytes)%s", target, resp.Status, size, hint)
+	r.add("timing", Pass, "dns %s, connect %s, tls %s, ttfb %s, total %s",
+		span(t.dnsStart, t.dnsDone), span(t.connectStart, t.connectDone), span(t.tlsStart, t.tlsDone),
+		span(start, t.firstByte), total.Round(time.Microsecond))
+	if id := resp.Header.Get("X-Request-Id"); id != "" {
+		requestID = id
+	}
+	r.add("request_id", Pass, "X-Request-Id %s", requestID)
+}
+
+// smokeTunnelSide 通过管理API要求客户端检查目标服务，每个连接报告一项
+func smokeTunnelSide(r *Report, httpClient *http.Client, base *url.URL, opts SmokeOptions) {
+	if opts.AdminToken == "" {
+		r.add("tunnel_side", Fail, "--tunnel-side requires --admin-token")
+		return
+	}
+	if opts.Key == "" {
+		r.add("tunnel_side", Fail, "--tunnel-side requires --key")
+		return
+	}
+	body, _ := json.Marshal(protocol.TargetCheckRequest{Path: opts.Path})
+	req, _ := http.NewRequest(http.MethodPost, base.String()+"/admin/keys/"+url.PathEscape(opts.Key)+"/check", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+opts.AdminToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		r.add("tunnel_side", Fail, "target check request failed: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Error   string `json:"error"`
+		Results []struct {
+			ConnectionID string `json:"connection_id"`
+			protocol.TargetCheckResult
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil || resp.StatusCode != http.StatusOK {
+		msg := out.Error
+		if msg == "" {
+			msg = resp.Status
+		}
+		r.add("tunnel_side", Fail, "server refused the target check: %s", msg)
+		return
+	}
+	for _, res := range out.Results {
+		name := "tunnel_side"
+		if len(out.Results) > 1 {
+			name += "[" + res.ConnectionID + "]"
+		}
+		detail := fmt.Sprintf("connect %.1fms, total %.1fms", res.ConnectMs, res.TotalMs)
+		if res.Status != 0 {
+			detail = fmt.Sprintf("GET %s -> %d, %s", opts.Path, res.Status, detail)
+		}
+		if res.OK {
+			r.add(name, Pass, "client %s reached its target (%s)", res.ConnectionID, detail)
+		} else {
+			reason := res.Error
+			if reason == "" {
+				reason = detail
+			}
+			r.add(name, Fail, "client %s cannot reach its target: %s", res.ConnectionID, reason)
+		}
+	}
+}
@@ -5,8 +5,8 @@ import (
 	"log"
 	"log/slog"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"singleproxy/pkg/config"
 )
@@ -15,23 +15,21 @@ import (
 type Logger struct {
 	*slog.Logger
 	level slog.Level
+	file  *RotatingFile // 写入的日志文件 (为nil表示标准输出)，被替换时关闭
 }
 
-// Global logger instance
-var globalLogger *Logger
+// Global logger instance。其他协程随时可能在读取，替换时原子地换入新的日志器
+var globalLogger atomic.Pointer[Logger]
 
 // InitLogger 初始化全局日志器
 func InitLogger(cfg *config.Config) error {
 	var writer io.Writer = os.Stdout
 
 	// 如果指定了日志文件，创建文件写入器
+	var file *RotatingFile
 	if cfg.LogFile != "" {
-		// 创建日志目录
-		if err := os.MkdirAll(filepath.Dir(cfg.LogFile), 0755); err != nil {
-			return err
-		}
-
-		file, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		var err error
+		file, err = OpenRotatingFile(cfg.LogFile, int64(cfg.LogMaxSize)<<20, cfg.LogMaxBackups)
 		if err != nil {
 			return err
 		}
@@ -54,11 +52,15 @@ func InitLogger(cfg *config.Config) error {
 		handler = slog.NewTextHandler(writer, opts)
 	}
 
-	// 创建并设置全局日志器
+	// 创建并设置全局日志器，关闭被替换的日志器打开的文件 (之后经旧日志器的写入被丢弃)
 	slogLogger := slog.New(handler)
-	globalLogger = &Logger{
+	old := globalLogger.Swap(&Logger{
 		Logger: slogLogger,
 		level:  level,
+		file:   file,
+	})
+	if old != nil && old.file != nil {
+		old.file.Close()
 	}
 
 	// 设置标准库log也使用我们的日志器
@@ -85,17 +87,18 @@ func parseLogLevel(level string) slog.Level {
 
 // GetLogger 获取全局日志器
 func GetLogger() *Logger {
-	if globalLogger == nil {
-		// 如果没有初始化，创建一个默认的文本日志器
-		handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-			Level: slog.LevelInfo,
-		})
-		globalLogger = &Logger{
-			Logger: slog.New(handler),
-			level:  slog.LevelInfo,
-		}
+	if l := globalLogger.Load(); l != nil {
+		return l
 	}
-	return globalLogger
+	// 如果没有初始化，创建一个默认的文本日志器
+	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})
+	globalLogger.CompareAndSwap(nil, &Logger{
+		Logger: slog.New(handler),
+		level:  slog.LevelInfo,
+	})
+	return globalLogger.Load()
 }
 
 // 便捷方法
@@ -144,16 +147,6 @@ func WithField(key string, value any) *Logger {
 	return GetLogger().WithField(key, value)
 }
 
-// RequestLogger 为HTTP请求创建专用日志器
-func RequestLogger(requestID string, clientIP string, method string, path string) *Logger {
-	return GetLogger().WithFields(map[string]any{
-		"request_id": requestID,
-		"client_ip":  clientIP,
-		"method":     method,
-		"path":       path,
-	})
-}
-
 // TunnelLogger 为隧道连接创建专用日志器
 func TunnelLogger(key string, clientAddr string) *Logger {
 	return GetLogger().WithFields(map[string]any{
@@ -173,13 +166,24 @@ func (l *Logger) IsInfoEnabled() bool {
 	return l.level <= slog.LevelInfo
 }
 
-// Fatal 记录致命错误并退出程序
-func (l *Logger) Fatal(msg string, args ...any) {
+// exitHook 在 Fatal 退出前调用，用于输出退出报告
+var exitHook func(code int)
+
+// SetExitHook 设置 Fatal 在退出前调用的函数
+func SetExitHook(fn func(code int)) {
+	exitHook = fn
+}
+
+// Fatal 记录致命错误并以 code 退出程序
+func (l *Logger) Fatal(code int, msg string, args ...any) {
 	l.Error(msg, args...)
-	os.Exit(1)
+	if exitHook != nil {
+		exitHook(code)
+	}
+	os.Exit(code)
 }
 
 // Fatal 全局致命错误方法
-func Fatal(msg string, args ...any) {
-	GetLogger().Fatal(msg, args...)
+func Fatal(code int, msg string, args ...any) {
+	GetLogger().Fatal(code, msg, args...)
 }
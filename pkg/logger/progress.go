@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"os"
+	"time"
+)
+
+// 响应流进度日志的输出间隔：每传输 progressLogBytes 字节或每隔 progressLogInterval 输出一条
+const (
+	progressLogBytes    = 8 << 20
+	progressLogInterval = 5 * time.Second
+)
+
+// traceEnabled 由环境变量 SINGLEPROXY_TRACE=1 开启，调试级别下额外输出逐个数据块的日志
+var traceEnabled = os.Getenv("SINGLEPROXY_TRACE") == "1"
+
+// TraceEnabled 判断是否输出逐个数据块的日志
+func TraceEnabled() bool {
+	return traceEnabled
+}
+
+// Trace 输出逐条消息的详细日志，只在开启 SINGLEPROXY_TRACE 且为调试级别时输出
+func Trace(msg string, args ...any) {
+	if traceEnabled {
+		GetLogger().Debug(msg, args...)
+	}
+}
+
+// StreamProgress 汇总单个响应流传输的数据块，按字节数或时间间隔输出一条调试日志，
+// 代替逐个数据块的日志。Chunks 和 Bytes 可在结束时用于汇总日志和指标
+type StreamProgress struct {
+	Chunks int64
+	Bytes  int64
+
+	msg         string
+	args        []any
+	start       time.Time
+	lastLog     time.Time
+	loggedBytes int64
+}
+
+// NewStreamProgress 创建进度汇总，msg 和 args 为进度日志的消息和固定字段
+func NewStreamProgress(msg string, args ...any) *StreamProgress {
+	now := time.Now()
+	return &StreamProgress{msg: msg, args: args, start: now, lastLog: now}
+}
+
+// Add 记录一个数据块，达到输出间隔时输出进度日志
+func (p *StreamProgress) Add(n int) {
+	p.Chunks++
+	p.Bytes += int64(n)
+	if p.Bytes-p.loggedBytes < progressLogBytes && time.Since(p.lastLog) < progressLogInterval {
+		return
+	}
+	p.lastLog = time.Now()
+	p.loggedBytes = p.Bytes
+	if GetLogger().IsDebugEnabled() {
+		Debug(p.msg, append(p.args[:len(p.args):len(p.args)],
+			"chunks", p.Chunks,
+			"total_bytes", p.Bytes,
+			"elapsed", time.Since(p.start))...)
+	}
+}
+
+// Elapsed 返回自创建以来的时间
+func (p *StreamProgress) Elapsed() time.Duration {
+	return time.Since(p.start)
+}
@@ -0,0 +1,38 @@
+package logger
+
+import "time"
+
+// 隧道请求经过的传输方式
+const (
+	TransportWebSocket = "websocket"
+	TransportLongPoll  = "long_poll"
+)
+
+// RequestLog 单个隧道请求的日志器。服务器和两种客户端对同一请求使用相同的字段:
+// transport、key、request_id、method、path，结束时由 Completed 追加 status、duration、bytes，
+// 站点在 WebSocket 和长轮询之间切换时按字段建立的日志看板不受影响
+type RequestLog struct {
+	*Logger
+}
+
+// RequestLogger 为隧道请求创建日志器，请求尚未解析时 method 和 path 为空
+func RequestLogger(transport, key string, requestID uint64, method, path string) *RequestLog {
+	l := GetLogger()
+	return &RequestLog{Logger: &Logger{
+		Logger: l.With(
+			"transport", transport,
+			"key", key,
+			"request_id", requestID,
+			"method", method,
+			"path", path),
+		level: l.level,
+	}}
+}
+
+// Completed 记录请求结束时的状态码、从开始处理到结束的耗时和响应体字节数，args 为附加字段
+func (l *RequestLog) Completed(msg string, status int, duration time.Duration, bytes int64, args ...any) {
+	l.Info(msg, append([]any{
+		"status", status,
+		"duration", duration,
+		"bytes", bytes}, args...)...)
+}
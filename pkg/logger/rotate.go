@@ -0,0 +1,96 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultMaxBackups 开启轮转但未配置保留份数时保留的旧文件数
+const DefaultMaxBackups = 5
+
+// RotatingFile 以追加方式写入的日志文件。maxBytes 大于0时，写入后超过该大小的文件依次重命名为
+// path.1、path.2 …，最多保留 backups 份，然后重新创建 path。主日志和按key的访问日志共用
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile 打开 (不存在时创建) 日志文件及其目录，maxBytes 为0时不轮转
+func OpenRotatingFile(path string, maxBytes int64, backups int) (*RotatingFile, error) {
+	if backups <= 0 {
+		backups = DefaultMaxBackups
+	}
+	f := &RotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write 写入一条或多条完整的日志行，写入后超过大小上限时轮转
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil && f.maxBytes > 0 && f.size >= f.maxBytes {
+		if rerr := f.rotate(); rerr != nil {
+			return n, fmt.Errorf("rotate %s: %w", f.path, rerr)
+		}
+	}
+	return n, err
+}
+
+// rotate 关闭当前文件，将 path.N-1 … path 依次后移一位，超出保留份数的最旧文件被覆盖
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	for i := f.backups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
+
+// Close 关闭文件，之后的写入返回 os.ErrClosed
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
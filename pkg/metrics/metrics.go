@@ -0,0 +1,259 @@
+// Package metrics 提供进程内的轻量指标，并以 Prometheus 文本格式导出
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter 是单调递增的计数器
+type Counter struct {
+	v atomic.Int64
+}
+
+// Inc 计数加一
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add 增加计数，n 应为非负数
+func (c *Counter) Add(n int64) { c.v.Add(n) }
+
+// Value 返回当前计数
+func (c *Counter) Value() int64 { return c.v.Load() }
+
+// Gauge 是可增可减的瞬时值
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Inc 加一
+func (g *Gauge) Inc() { g.v.Add(1) }
+
+// Dec 减一
+func (g *Gauge) Dec() { g.v.Add(-1) }
+
+// Add 增加 n，n 可以为负数
+func (g *Gauge) Add(n int64) { g.v.Add(n) }
+
+// Set 设置当前值
+func (g *Gauge) Set(n int64) { g.v.Store(n) }
+
+// Value 返回当前值
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+// CounterVec 是按一个标签区分的一组计数器
+type CounterVec struct {
+	label    string
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// WithLabelValue 返回标签值对应的计数器，首次使用时创建
+func (v *CounterVec) WithLabelValue(value string) *Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[value]
+	if !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+// samples 返回按标签值排序的所有计数
+func (v *CounterVec) samples() []sample {
+	v.mu.Lock()
+	out := make([]sample, 0, len(v.counters))
+	for value, c := range v.counters {
+		out = append(out, sample{labels: fmt.Sprintf("{%s=%q}", v.label, value), value: c.Value()})
+	}
+	v.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].labels < out[j].labels })
+	return out
+}
+
+// HistogramVec 是按一个标签区分的一组直方图，桶上界为整数 (如字节数)
+type HistogramVec struct {
+	label  string
+	bounds []int64
+	mu     sync.Mutex
+	hists  map[string]*histogram
+}
+
+// histogram 各桶的计数 (不累计，导出时再累加)，末尾为超出最后一个上界的溢出桶
+type histogram struct {
+	buckets []int64
+	sum     int64
+	count   int64
+}
+
+// Observe 记录标签值对应的一次观测
+func (v *HistogramVec) Observe(value string, n int64) {
+	i := sort.Search(len(v.bounds), func(i int) bool { return n <= v.bounds[i] })
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.hists[value]
+	if !ok {
+		h = &histogram{buckets: make([]int64, len(v.bounds)+1)}
+		v.hists[value] = h
+	}
+	h.buckets[i]++
+	h.sum += n
+	h.count++
+}
+
+// samples 按标签值排序输出每个直方图的累计桶、总和与次数
+func (v *HistogramVec) samples() []sample {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values := make([]string, 0, len(v.hists))
+	for value := range v.hists {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	var out []sample
+	for _, value := range values {
+		h := v.hists[value]
+		var cumulative int64
+		for i, n := range h.buckets {
+			cumulative += n
+			le := "+Inf"
+			if i < len(v.bounds) {
+				le = fmt.Sprint(v.bounds[i])
+			}
+			out = append(out, sample{suffix: "_bucket", labels: fmt.Sprintf("{%s=%q,le=%q}", v.label, value, le), value: cumulative})
+		}
+		labels := fmt.Sprintf("{%s=%q}", v.label, value)
+		out = append(out,
+			sample{suffix: "_sum", labels: labels, value: h.sum},
+			sample{suffix: "_count", labels: labels, value: h.count})
+	}
+	return out
+}
+
+// ExponentialBuckets 返回 count 个从 start 开始、每个是前一个 factor 倍的桶上界
+func ExponentialBuckets(start int64, factor, count int) []int64 {
+	bounds := make([]int64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= int64(factor)
+	}
+	return bounds
+}
+
+// sample 是指标的一行输出，labels 为空或形如 {reason="x"}，直方图的各行以 suffix 区分
+type sample struct {
+	suffix string
+	labels string
+	value  int64
+}
+
+// metric 是注册表中的一个指标
+type metric struct {
+	name    string
+	help    string
+	kind    string // counter、gauge 或 histogram
+	samples func() []sample
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]metric)
+)
+
+func register(name, help, kind string, value func() int64) {
+	registerSamples(name, help, kind, func() []sample {
+		return []sample{{value: value()}}
+	})
+}
+
+func registerSamples(name, help, kind string, samples func() []sample) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", name))
+	}
+	registry[name] = metric{name: name, help: help, kind: kind, samples: samples}
+}
+
+// NewCounter 创建并注册一个计数器
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	register(name, help, "counter", c.Value)
+	return c
+}
+
+// NewCounterVec 创建并注册一组按 label 区分的计数器
+func NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	registerSamples(name, help, "counter", v.samples)
+	return v
+}
+
+// NewHistogramVec 创建并注册一组按 label 区分的直方图，bounds 为升序的桶上界
+func NewHistogramVec(name, help, label string, bounds []int64) *HistogramVec {
+	v := &HistogramVec{label: label, bounds: bounds, hists: make(map[string]*histogram)}
+	registerSamples(name, help, "histogram", v.samples)
+	return v
+}
+
+// NewGauge 创建并注册一个瞬时值指标
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	register(name, help, "gauge", g.Value)
+	return g
+}
+
+// NewGaugeFunc 注册一个在导出时计算的瞬时值指标
+func NewGaugeFunc(name, help string, fn func() int64) {
+	register(name, help, "gauge", fn)
+}
+
+// Value 返回已注册的计数器或瞬时值的当前值，带标签的指标为各行之和；未注册时返回 false
+func Value(name string) (int64, bool) {
+	registryMu.RLock()
+	m, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	var total int64
+	for _, s := range m.samples() {
+		total += s.value
+	}
+	return total, true
+}
+
+// WritePrometheus 按名称顺序以 Prometheus 文本格式写出所有指标
+func WritePrometheus(w io.Writer) error {
+	registryMu.RLock()
+	metrics := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		metrics = append(metrics, m)
+	}
+	registryMu.RUnlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, s := range m.samples() {
+			if _, err := fmt.Fprintf(w, "%s%s%s %d\n", m.name, s.suffix, s.labels, s.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handler 返回导出所有指标的 HTTP 处理器
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WritePrometheus(w)
+	})
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests")
+	g := NewGauge("test_active", "Active")
+	NewGaugeFunc("test_func", "Func", func() int64 { return 7 })
+
+	c.Add(3)
+	c.Inc()
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"# TYPE test_requests_total counter\ntest_requests_total 4\n",
+		"# TYPE test_active gauge\ntest_active 1\n",
+		"test_func 7\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, "test_active") > strings.Index(out, "test_requests_total") {
+		t.Errorf("Expected metrics sorted by name")
+	}
+}
+
+func TestValue(t *testing.T) {
+	c := NewCounter("test_value_total", "Value")
+	v := NewCounterVec("test_value_labeled_total", "Labeled", "reason")
+	c.Add(5)
+	v.WithLabelValue("a").Inc()
+	v.WithLabelValue("b").Add(2)
+
+	if n, ok := Value("test_value_total"); !ok || n != 5 {
+		t.Errorf("Expected counter value 5, got %d %v", n, ok)
+	}
+	if n, ok := Value("test_value_labeled_total"); !ok || n != 3 {
+		t.Errorf("Expected labeled counters to sum to 3, got %d %v", n, ok)
+	}
+	if _, ok := Value("test_value_missing"); ok {
+		t.Error("Expected missing metric to report false")
+	}
+}
+
+func TestDuplicateRegistrationPanics(t *testing.T) {
+	NewCounter("test_duplicate", "Duplicate")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on duplicate metric name")
+		}
+	}()
+	NewGauge("test_duplicate", "Duplicate")
+}
+
+func TestCounterVec(t *testing.T) {
+	v := NewCounterVec("test_errors_total", "Errors", "reason")
+	v.WithLabelValue("timeout").Inc()
+	v.WithLabelValue("timeout").Inc()
+	v.WithLabelValue("no_tunnel").Inc()
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	want := "# TYPE test_errors_total counter\n" +
+		"test_errors_total{reason=\"no_tunnel\"} 1\n" +
+		"test_errors_total{reason=\"timeout\"} 2\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected output to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	v := NewHistogramVec("test_sizes_bytes", "Sizes", "key", ExponentialBuckets(100, 10, 3))
+	v.Observe("web", 50)
+	v.Observe("web", 100)
+	v.Observe("web", 5000)
+	v.Observe("web", 1000000)
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	want := "# TYPE test_sizes_bytes histogram\n" +
+		"test_sizes_bytes_bucket{key=\"web\",le=\"100\"} 2\n" +
+		"test_sizes_bytes_bucket{key=\"web\",le=\"1000\"} 2\n" +
+		"test_sizes_bytes_bucket{key=\"web\",le=\"10000\"} 3\n" +
+		"test_sizes_bytes_bucket{key=\"web\",le=\"+Inf\"} 4\n" +
+		"test_sizes_bytes_sum{key=\"web\"} 1005150\n" +
+		"test_sizes_bytes_count{key=\"web\"} 4\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected output to contain %q, got:\n%s", want, buf.String())
+	}
+}
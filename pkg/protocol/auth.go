@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// HeaderMessageAuth 的值
+const (
+	MessageAuthHMACSHA256    = "hmac-sha256"     // 每条消息末尾附加 HMAC-SHA256 签名，不防重放 (旧版客户端)
+	MessageAuthHMACSHA256Seq = "hmac-sha256-seq" // 签名覆盖握手随机数、方向和递增的计数器，见 MessageAuth
+)
+
+// MessageAuthTagSize 签名的长度
+const MessageAuthTagSize = sha256.Size
+
+// MessageAuthCounterSize hmac-sha256-seq 时签名前附加的计数器长度
+const MessageAuthCounterSize = 8
+
+// MessageAuthNonceSize 握手时服务器生成的随机数长度
+const MessageAuthNonceSize = 16
+
+// 消息的发送方向，计入签名，防止把一个方向的消息原样反射给发送方
+const (
+	MessageAuthServerToClient byte = 's'
+	MessageAuthClientToServer byte = 'c'
+)
+
+// DefaultMaxAuthFailures 是单个连接默认允许的签名校验失败次数，超出后以协议错误关闭
+const DefaultMaxAuthFailures = 3
+
+// ErrMessageAuth 消息签名缺失或不匹配
+var ErrMessageAuth = errors.New("message authentication failed")
+
+// ErrMessageReplay 签名正确但计数器没有递增，消息被重放或重排
+var ErrMessageReplay = errors.New("message authentication failed: counter not increasing")
+
+// SignTunnelMessage 在序列化后的消息 (ID、Type、Payload) 末尾附加签名
+func SignTunnelMessage(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(data)
+}
+
+// VerifyTunnelMessage 以常量时间比较校验签名，返回去掉签名后的消息
+func VerifyTunnelMessage(key, data []byte) ([]byte, error) {
+	if len(data) < MessageAuthTagSize {
+		return nil, ErrMessageAuth
+	}
+	body, tag := data[:len(data)-MessageAuthTagSize], data[len(data)-MessageAuthTagSize:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, ErrMessageAuth
+	}
+	return body, nil
+}
+
+// NewMessageAuthNonce 生成握手随机数，服务器在 HeaderMessageAuthNonce 中返回给客户端
+func NewMessageAuthNonce() []byte {
+	nonce := make([]byte, MessageAuthNonceSize)
+	rand.Read(nonce)
+	return nonce
+}
+
+// MessageAuth 一条连接上一个方向的消息签名状态。nonce 为空时退回不带计数器的 hmac-sha256。
+// 发送方只在写协程中调用 Sign，接收方只在读取循环中调用 Verify，不加锁
+type MessageAuth struct {
+	key   []byte
+	nonce []byte
+	dir   byte
+	seq   uint64 // 发送方: 最近一次使用的计数器；接收方: 最近一次通过校验的计数器
+}
+
+// NewMessageAuth 创建 dir 方向的签名状态，计数器从1开始
+func NewMessageAuth(key, nonce []byte, dir byte) *MessageAuth {
+	return &MessageAuth{key: key, nonce: nonce, dir: dir}
+}
+
+// mac 计算 nonce、方向和 data (消息及计数器) 的签名
+func (a *MessageAuth) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(a.nonce)
+	mac.Write([]byte{a.dir})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Sign 在序列化后的消息末尾附加递增的计数器和签名
+func (a *MessageAuth) Sign(data []byte) []byte {
+	if len(a.nonce) == 0 {
+		return SignTunnelMessage(a.key, data)
+	}
+	a.seq++
+	data = binary.BigEndian.AppendUint64(data, a.seq)
+	return append(data, a.mac(data)...)
+}
+
+// Verify 校验签名和计数器，返回去掉计数器和签名后的消息。计数器不大于上一条通过校验的消息时返回 ErrMessageReplay
+func (a *MessageAuth) Verify(data []byte) ([]byte, error) {
+	if len(a.nonce) == 0 {
+		return VerifyTunnelMessage(a.key, data)
+	}
+	if len(data) < MessageAuthCounterSize+MessageAuthTagSize {
+		return nil, ErrMessageAuth
+	}
+	signed, tag := data[:len(data)-MessageAuthTagSize], data[len(data)-MessageAuthTagSize:]
+	if !hmac.Equal(a.mac(signed), tag) {
+		return nil, ErrMessageAuth
+	}
+	body := signed[:len(signed)-MessageAuthCounterSize]
+	seq := binary.BigEndian.Uint64(signed[len(body):])
+	if seq <= a.seq {
+		return nil, ErrMessageReplay
+	}
+	a.seq = seq
+	return body, nil
+}
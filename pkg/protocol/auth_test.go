@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVerifyTunnelMessage(t *testing.T) {
+	key := []byte("shared-secret")
+	data, _ := SerializeTunnelMessage(TunnelMessage{ID: 7, Type: MSG_TYPE_HTTP_RES_CHUNK, Payload: []byte("hello")})
+	signed := SignTunnelMessage(key, append([]byte(nil), data...))
+	if len(signed) != len(data)+MessageAuthTagSize {
+		t.Fatalf("Expected %d byte tag, got %d bytes", MessageAuthTagSize, len(signed)-len(data))
+	}
+
+	body, err := VerifyTunnelMessage(key, signed)
+	if err != nil || !bytes.Equal(body, data) {
+		t.Fatalf("Expected signed message to verify, got %v", err)
+	}
+
+	// ID、类型、负载任一被改动都应校验失败
+	for _, offset := range []int{0, 8, len(data) - 1, len(signed) - 1} {
+		tampered := append([]byte(nil), signed...)
+		tampered[offset] ^= 0x01
+		if _, err := VerifyTunnelMessage(key, tampered); err != ErrMessageAuth {
+			t.Errorf("Expected tampered byte %d to fail verification, got %v", offset, err)
+		}
+	}
+	if _, err := VerifyTunnelMessage([]byte("other-secret"), signed); err != ErrMessageAuth {
+		t.Errorf("Expected wrong key to fail verification, got %v", err)
+	}
+	if _, err := VerifyTunnelMessage(key, data[:4]); err != ErrMessageAuth {
+		t.Errorf("Expected short message to fail verification, got %v", err)
+	}
+}
+
+func TestMessageAuthRejectsReplay(t *testing.T) {
+	key, nonce := []byte("shared-secret"), NewMessageAuthNonce()
+	signer := NewMessageAuth(key, nonce, MessageAuthClientToServer)
+	verifier := NewMessageAuth(key, nonce, MessageAuthClientToServer)
+	sign := func(payload string) []byte {
+		data, _ := SerializeTunnelMessage(TunnelMessage{ID: 7, Type: MSG_TYPE_HTTP_RES_CHUNK, Payload: []byte(payload)})
+		return signer.Sign(data)
+	}
+
+	first, second := sign("first"), sign("second")
+	if len(first) != MessageHeaderSize+len("first")+MessageAuthCounterSize+MessageAuthTagSize {
+		t.Fatalf("Expected counter and tag to be appended, got %d bytes", len(first))
+	}
+	if body, err := verifier.Verify(first); err != nil || string(body[MessageHeaderSize:]) != "first" {
+		t.Fatalf("Expected first message to verify, got %q %v", body, err)
+	}
+	// 同一条消息再次到达，或较早的消息在较晚的之后到达，都按重放拒绝
+	if _, err := verifier.Verify(first); err != ErrMessageReplay {
+		t.Errorf("Expected replayed message to be rejected, got %v", err)
+	}
+	if _, err := verifier.Verify(second); err != nil {
+		t.Fatalf("Expected second message to verify, got %v", err)
+	}
+	if _, err := verifier.Verify(first); err != ErrMessageReplay {
+		t.Errorf("Expected reordered message to be rejected, got %v", err)
+	}
+
+	// 签名绑定方向和握手随机数，不能反射给发送方或重放到另一条连接
+	third := sign("third")
+	if _, err := NewMessageAuth(key, nonce, MessageAuthServerToClient).Verify(third); err != ErrMessageAuth {
+		t.Errorf("Expected message reflected to the other direction to fail, got %v", err)
+	}
+	if _, err := NewMessageAuth(key, NewMessageAuthNonce(), MessageAuthClientToServer).Verify(third); err != ErrMessageAuth {
+		t.Errorf("Expected message replayed on another connection to fail, got %v", err)
+	}
+	// 改动计数器同样校验失败
+	tampered := append([]byte(nil), third...)
+	tampered[len(tampered)-MessageAuthTagSize-1] ^= 0x01
+	if _, err := verifier.Verify(tampered); err != ErrMessageAuth {
+		t.Errorf("Expected tampered counter to fail verification, got %v", err)
+	}
+	if _, err := verifier.Verify(third); err != nil {
+		t.Errorf("Expected third message to verify after rejected ones, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 绑定类型常量
+const (
+	BindTypeHost = "host"
+	BindTypePort = "port"
+)
+
+// Binding 描述客户端申请的一个公网绑定 (类似 ssh -R)
+type Binding struct {
+	Type string `json:"type"`           // "host" 或 "port"
+	Host string `json:"host,omitempty"` // Type为host时的主机名
+	Port int    `json:"port,omitempty"` // Type为port时的端口
+}
+
+// String 返回绑定的文本形式, 与 ParseBinding 的输入格式一致
+func (b Binding) String() string {
+	if b.Type == BindTypePort {
+		return fmt.Sprintf("%s=%d", BindTypePort, b.Port)
+	}
+	return fmt.Sprintf("%s=%s", b.Type, b.Host)
+}
+
+// BindRequest 是 MSG_TYPE_BIND_REQ 的负载
+type BindRequest struct {
+	Bindings []Binding `json:"bindings"`
+}
+
+// BindResult 是单个绑定的处理结果
+type BindResult struct {
+	Binding Binding `json:"binding"`
+	Granted bool    `json:"granted"`
+	Reason  string  `json:"reason,omitempty"` // 拒绝原因
+}
+
+// BindResponse 是 MSG_TYPE_BIND_RES 的负载
+type BindResponse struct {
+	Results []BindResult `json:"results"`
+}
+
+// ParseBinding 解析 "host=app.example.com" 或 "port=2222" 格式的绑定
+func ParseBinding(s string) (Binding, error) {
+	typ, value, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok || value == "" {
+		return Binding{}, fmt.Errorf("invalid binding %q, expected host=<name> or port=<number>", s)
+	}
+
+	switch strings.ToLower(typ) {
+	case BindTypeHost:
+		return Binding{Type: BindTypeHost, Host: strings.ToLower(value)}, nil
+	case BindTypePort:
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return Binding{}, fmt.Errorf("invalid port in binding %q", s)
+		}
+		return Binding{Type: BindTypePort, Port: port}, nil
+	default:
+		return Binding{}, fmt.Errorf("unknown binding type %q in %q", typ, s)
+	}
+}
+
+// EncodeBindRequest 序列化绑定申请
+func EncodeBindRequest(req BindRequest) ([]byte, error) {
+	return json.Marshal(req)
+}
+
+// DecodeBindRequest 反序列化绑定申请
+func DecodeBindRequest(data []byte) (BindRequest, error) {
+	var req BindRequest
+	err := json.Unmarshal(data, &req)
+	return req, err
+}
+
+// EncodeBindResponse 序列化绑定结果
+func EncodeBindResponse(resp BindResponse) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+// DecodeBindResponse 反序列化绑定结果
+func DecodeBindResponse(data []byte) (BindResponse, error) {
+	var resp BindResponse
+	err := json.Unmarshal(data, &resp)
+	return resp, err
+}
@@ -0,0 +1,69 @@
+package protocol
+
+import "testing"
+
+func TestParseBinding(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Binding
+		wantErr bool
+	}{
+		{input: "host=App.Example.com", want: Binding{Type: BindTypeHost, Host: "app.example.com"}},
+		{input: "port=2222", want: Binding{Type: BindTypePort, Port: 2222}},
+		{input: " port=80 ", want: Binding{Type: BindTypePort, Port: 80}},
+		{input: "port=0", wantErr: true},
+		{input: "port=70000", wantErr: true},
+		{input: "port=abc", wantErr: true},
+		{input: "host=", wantErr: true},
+		{input: "udp=53", wantErr: true},
+		{input: "app.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseBinding(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseBinding(%q) expected error, got %+v", tt.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseBinding(%q) unexpected error: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseBinding(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+		if parsed, _ := ParseBinding(got.String()); parsed != got {
+			t.Errorf("String() round trip mismatch for %q: %q", tt.input, got.String())
+		}
+	}
+}
+
+func TestBindMessagesRoundTrip(t *testing.T) {
+	req := BindRequest{Bindings: []Binding{{Type: BindTypeHost, Host: "a.example.com"}, {Type: BindTypePort, Port: 2222}}}
+	data, err := EncodeBindRequest(req)
+	if err != nil {
+		t.Fatalf("Failed to encode bind request: %v", err)
+	}
+	decoded, err := DecodeBindRequest(data)
+	if err != nil {
+		t.Fatalf("Failed to decode bind request: %v", err)
+	}
+	if len(decoded.Bindings) != 2 || decoded.Bindings[1].Port != 2222 {
+		t.Errorf("Unexpected decoded bind request: %+v", decoded)
+	}
+
+	resp := BindResponse{Results: []BindResult{{Binding: req.Bindings[0], Granted: false, Reason: "host not allowed by policy"}}}
+	data, err = EncodeBindResponse(resp)
+	if err != nil {
+		t.Fatalf("Failed to encode bind response: %v", err)
+	}
+	decodedResp, err := DecodeBindResponse(data)
+	if err != nil {
+		t.Fatalf("Failed to decode bind response: %v", err)
+	}
+	if len(decodedResp.Results) != 1 || decodedResp.Results[0].Reason != "host not allowed by policy" {
+		t.Errorf("Unexpected decoded bind response: %+v", decodedResp)
+	}
+}
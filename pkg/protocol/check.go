@@ -0,0 +1,41 @@
+package protocol
+
+import "encoding/json"
+
+// TargetCheckRequest 要求客户端检查目标服务，Path 为空时只检查TCP连接
+type TargetCheckRequest struct {
+	Path string `json:"path,omitempty"`
+}
+
+// TargetCheckResult 客户端对目标服务的检查结果
+type TargetCheckResult struct {
+	OK        bool    `json:"ok"`
+	Error     string  `json:"error,omitempty"`
+	Status    int     `json:"status,omitempty"` // 检查路径时目标服务返回的状态码
+	ConnectMs float64 `json:"connect_ms"`
+	TotalMs   float64 `json:"total_ms"`
+}
+
+// EncodeTargetCheckRequest 序列化目标服务检查请求
+func EncodeTargetCheckRequest(req TargetCheckRequest) ([]byte, error) {
+	return json.Marshal(req)
+}
+
+// DecodeTargetCheckRequest 反序列化目标服务检查请求
+func DecodeTargetCheckRequest(data []byte) (TargetCheckRequest, error) {
+	var req TargetCheckRequest
+	err := json.Unmarshal(data, &req)
+	return req, err
+}
+
+// EncodeTargetCheckResult 序列化目标服务检查结果
+func EncodeTargetCheckResult(res TargetCheckResult) ([]byte, error) {
+	return json.Marshal(res)
+}
+
+// DecodeTargetCheckResult 反序列化目标服务检查结果
+func DecodeTargetCheckResult(data []byte) (TargetCheckResult, error) {
+	var res TargetCheckResult
+	err := json.Unmarshal(data, &res)
+	return res, err
+}
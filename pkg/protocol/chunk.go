@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 双方都支持 FeatureChunkSeq 时，MSG_TYPE_HTTP_RES_CHUNK 的负载以带序号的头部开始:
+//
+//	4字节序号 (每个请求从0开始) | 1字节标志 | 数据
+//
+// 结束标记设置 ChunkFlagEnd，不带数据；同时设置 ChunkFlagLength 时附加8字节的响应体总长度
+const ChunkHeaderSize = 5
+
+// 数据块头部的标志位
+const (
+	ChunkFlagEnd    = 1 << 0 // 响应体结束
+	ChunkFlagLength = 1 << 1 // 结束标记附带响应体总长度
+)
+
+// ErrChunkHeader 带序号的数据块头部不完整
+var ErrChunkHeader = errors.New("malformed response chunk header")
+
+// ResponseChunk 带序号的响应体数据块
+type ResponseChunk struct {
+	Seq  uint32
+	End  bool
+	Data []byte
+	// TotalLength 结束标记中的响应体总长度，-1 表示未知
+	TotalLength int64
+}
+
+// EncodeResponseChunk 编码带序号的数据块负载
+func EncodeResponseChunk(c ResponseChunk) []byte {
+	size := ChunkHeaderSize + len(c.Data)
+	var flags byte
+	if c.End {
+		flags |= ChunkFlagEnd
+		if c.TotalLength >= 0 {
+			flags |= ChunkFlagLength
+			size += 8
+		}
+	}
+	buf := make([]byte, ChunkHeaderSize, size)
+	binary.BigEndian.PutUint32(buf, c.Seq)
+	buf[4] = flags
+	if flags&ChunkFlagLength != 0 {
+		return binary.BigEndian.AppendUint64(buf, uint64(c.TotalLength))
+	}
+	return append(buf, c.Data...)
+}
+
+// DecodeResponseChunk 解码带序号的数据块负载，Data 引用 payload 的内存
+func DecodeResponseChunk(payload []byte) (ResponseChunk, error) {
+	if len(payload) < ChunkHeaderSize {
+		return ResponseChunk{}, ErrChunkHeader
+	}
+	c := ResponseChunk{
+		Seq:         binary.BigEndian.Uint32(payload),
+		End:         payload[4]&ChunkFlagEnd != 0,
+		TotalLength: -1,
+	}
+	rest := payload[ChunkHeaderSize:]
+	if !c.End {
+		c.Data = rest
+		return c, nil
+	}
+	if payload[4]&ChunkFlagLength != 0 {
+		if len(rest) != 8 {
+			return ResponseChunk{}, ErrChunkHeader
+		}
+		c.TotalLength = int64(binary.BigEndian.Uint64(rest))
+	} else if len(rest) != 0 {
+		return ResponseChunk{}, ErrChunkHeader
+	}
+	return c, nil
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResponseChunkRoundTrip(t *testing.T) {
+	for _, c := range []ResponseChunk{
+		{Seq: 0, Data: []byte("hello"), TotalLength: -1},
+		{Seq: 1 << 31, Data: []byte{}, TotalLength: -1},
+		{Seq: 7, End: true, TotalLength: -1},
+		{Seq: 8, End: true, TotalLength: 0},
+		{Seq: 9, End: true, TotalLength: 1 << 40},
+	} {
+		got, err := DecodeResponseChunk(EncodeResponseChunk(c))
+		if err != nil {
+			t.Fatalf("Failed to decode %+v: %v", c, err)
+		}
+		if got.Seq != c.Seq || got.End != c.End || got.TotalLength != c.TotalLength || !bytes.Equal(got.Data, c.Data) {
+			t.Errorf("Expected %+v, got %+v", c, got)
+		}
+	}
+
+	// 数据块的头部开销固定，结束标记附带长度时多8字节
+	if n := len(EncodeResponseChunk(ResponseChunk{Data: []byte("abc")})); n != ChunkHeaderSize+3 {
+		t.Errorf("Expected %d bytes, got %d", ChunkHeaderSize+3, n)
+	}
+	if n := len(EncodeResponseChunk(ResponseChunk{End: true, TotalLength: 3})); n != ChunkHeaderSize+8 {
+		t.Errorf("Expected %d bytes, got %d", ChunkHeaderSize+8, n)
+	}
+}
+
+func TestDecodeResponseChunkMalformed(t *testing.T) {
+	for _, payload := range [][]byte{
+		nil,
+		{0, 0, 0, 1},
+		{0, 0, 0, 1, ChunkFlagEnd, 'x'},
+		{0, 0, 0, 1, ChunkFlagEnd | ChunkFlagLength, 0, 0, 0, 1},
+	} {
+		if _, err := DecodeResponseChunk(payload); err != ErrChunkHeader {
+			t.Errorf("Expected ErrChunkHeader for %v, got %v", payload, err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package protocol
+
+import "strconv"
+
+// 隧道WebSocket连接的关闭原因，关闭码为 RFC 6455 定义的值 (见各常量注释)。
+// 客户端只按关闭码区分处理，原因文本用于日志，1013 时还从中解析重试等待时间
+const (
+	CloseReasonServerShutdown          = "server shutting down"              // 1001 Going Away
+	CloseReasonClientShutdown          = "client shutting down"              // 1000 Normal Closure
+	CloseReasonKeyExpired              = "tunnel key expired"                // 1000 Normal Closure
+	CloseReasonIdle                    = "tunnel idle"                       // 1000 Normal Closure，超过 -tunnel-idle-max 没有请求和数据消息
+	CloseReasonServerDraining          = "server draining"                   // 1001 Going Away，MSG_TYPE_GOAWAY 的宽限期结束
+	CloseReasonClientDraining          = "client draining"                   // 1000 Normal Closure，客户端收到 MSG_TYPE_GOAWAY 后完成了进行中的请求
+	CloseReasonRegistrationRateLimited = "registration rate limited"         // 1013 Try Again Later，经 FormatRetryAfterReason 附带等待时间
+	CloseReasonMessageAuthFailed       = "message authentication failed"     // 1002 Protocol Error
+	CloseReasonUnknownMessages         = "too many unknown message types"    // 1002 Protocol Error
+	CloseReasonChunkIntegrity          = "response chunk integrity failures" // 1002 Protocol Error
+	CloseReasonResponseViolations      = "response protocol violations"      // 1002 Protocol Error
+	CloseReasonFrameTooLarge           = "message exceeds frame size"        // 1002 Protocol Error，经 FormatFrameTooLargeReason 附带协商的上限
+	CloseReasonHeaderTable             = "header table out of sync"          // 1002 Protocol Error，重连后双方从空的索引表开始
+)
+
+// FormatFrameTooLargeReason 生成附带协商上限的关闭原因，e.g. "message exceeds frame size 10485760"
+func FormatFrameTooLargeReason(limit int) string {
+	return CloseReasonFrameTooLarge + " " + strconv.Itoa(limit)
+}
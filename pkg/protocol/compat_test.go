@@ -0,0 +1,325 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "singleproxy/pkg/protocol/testdata/v1"
+)
+
+// messageShape 一种消息的典型负载及其解码检查
+type messageShape struct {
+	name    string
+	msgType MessageType
+	payload func() []byte
+	check   func(t *testing.T, payload []byte)
+}
+
+// mustEncode 用例负载都是固定值，编码失败说明编码器本身有问题
+func mustEncode(data []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// messageShapes 覆盖每种消息类型的每种负载格式，新增消息类型或负载格式时必须在这里加入
+var messageShapes = []messageShape{
+	{"http request", MSG_TYPE_HTTP_REQ,
+		func() []byte {
+			r := httptest.NewRequest(http.MethodPost, "http://app.example.com/api?q=1", strings.NewReader("body"))
+			r.Header.Set("X-Test", "yes")
+			r.Header.Set("Content-Length", "4")
+			return mustEncode(SerializeHTTPRequest(r))
+		},
+		func(t *testing.T, payload []byte) {
+			r, err := ParseHTTPRequest(payload, HeaderLimits{})
+			if err != nil {
+				t.Fatalf("Failed to parse request: %v", err)
+			}
+			body, _ := io.ReadAll(r.Body)
+			if r.Method != http.MethodPost || r.URL.RequestURI() != "/api?q=1" || r.Header.Get("X-Test") != "yes" || string(body) != "body" {
+				t.Errorf("Unexpected request %s %s %v %q", r.Method, r.URL.RequestURI(), r.Header, body)
+			}
+		}},
+	{"http request head", MSG_TYPE_HTTP_REQ,
+		func() []byte {
+			r := httptest.NewRequest(http.MethodPut, "http://app.example.com/upload", strings.NewReader("streamed separately"))
+			return SerializeHTTPRequestHead(r)
+		},
+		func(t *testing.T, payload []byte) {
+			r, err := ParseHTTPRequest(payload, HeaderLimits{})
+			if err != nil {
+				t.Fatalf("Failed to parse request head: %v", err)
+			}
+			if body, _ := io.ReadAll(r.Body); r.Method != http.MethodPut || len(body) != 0 {
+				t.Errorf("Unexpected request head %s with body %q", r.Method, body)
+			}
+		}},
+	{"response header", MSG_TYPE_HTTP_RES,
+		func() []byte {
+			return []byte("HTTP/1.1 201 Created\r\nContent-Type: text/plain\r\n\r\n")
+		},
+		func(t *testing.T, payload []byte) {
+			resp, err := DeserializeHTTPResponse(payload)
+			if err != nil {
+				t.Fatalf("Failed to parse response header: %v", err)
+			}
+			if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "text/plain" {
+				t.Errorf("Unexpected response header %d %v", resp.StatusCode, resp.Header)
+			}
+		}},
+	{"target error response", MSG_TYPE_HTTP_RES_FULL,
+		func() []byte { return TargetErrorResponse(TargetErrConnectTimeout) },
+		func(t *testing.T, payload []byte) {
+			if kind := ParseTargetError(payload); kind != TargetErrConnectTimeout {
+				t.Errorf("Expected %s, got %q", TargetErrConnectTimeout, kind)
+			}
+		}},
+	{"full response", MSG_TYPE_HTTP_RES_FULL,
+		func() []byte {
+			return []byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+		},
+		func(t *testing.T, payload []byte) {
+			resp, err := DeserializeHTTPResponse(payload)
+			if err != nil {
+				t.Fatalf("Failed to parse full response: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != "hello" || ParseTargetError(payload) != "" {
+				t.Errorf("Unexpected full response %d %q", resp.StatusCode, body)
+			}
+		}},
+	{"raw chunk", MSG_TYPE_HTTP_RES_CHUNK,
+		func() []byte { return []byte("data") },
+		func(t *testing.T, payload []byte) {
+			if string(payload) != "data" {
+				t.Errorf("Unexpected chunk %q", payload)
+			}
+		}},
+	{"raw end", MSG_TYPE_HTTP_RES_CHUNK,
+		func() []byte { return nil },
+		func(t *testing.T, payload []byte) {
+			if len(payload) != 0 {
+				t.Errorf("Expected empty end marker, got %q", payload)
+			}
+		}},
+	{"sequenced chunk", MSG_TYPE_HTTP_RES_CHUNK,
+		func() []byte {
+			return EncodeResponseChunk(ResponseChunk{Seq: 3, End: true, TotalLength: 42})
+		},
+		func(t *testing.T, payload []byte) {
+			c, err := DecodeResponseChunk(payload)
+			if err != nil || c.Seq != 3 || !c.End || c.TotalLength != 42 {
+				t.Errorf("Unexpected chunk %+v: %v", c, err)
+			}
+		}},
+	{"interim response", MSG_TYPE_HTTP_RES_INTERIM,
+		func() []byte {
+			return []byte("HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n")
+		},
+		func(t *testing.T, payload []byte) {
+			resp, err := DeserializeHTTPResponse(payload)
+			if err != nil || resp.StatusCode != http.StatusEarlyHints || resp.Header.Get("Link") == "" {
+				t.Errorf("Unexpected interim response: %v", err)
+			}
+		}},
+	{"bind request", MSG_TYPE_BIND_REQ,
+		func() []byte {
+			return mustEncode(EncodeBindRequest(BindRequest{Bindings: []Binding{
+				{Type: BindTypeHost, Host: "app.example.com"}, {Type: BindTypePort, Port: 2222},
+			}}))
+		},
+		func(t *testing.T, payload []byte) {
+			req, err := DecodeBindRequest(payload)
+			if err != nil || len(req.Bindings) != 2 || req.Bindings[1].Port != 2222 {
+				t.Errorf("Unexpected bind request %+v: %v", req, err)
+			}
+		}},
+	{"bind response", MSG_TYPE_BIND_RES,
+		func() []byte {
+			return mustEncode(EncodeBindResponse(BindResponse{Results: []BindResult{
+				{Binding: Binding{Type: BindTypePort, Port: 2222}, Reason: "port in use"},
+			}}))
+		},
+		func(t *testing.T, payload []byte) {
+			resp, err := DecodeBindResponse(payload)
+			if err != nil || len(resp.Results) != 1 || resp.Results[0].Granted || resp.Results[0].Reason != "port in use" {
+				t.Errorf("Unexpected bind response %+v: %v", resp, err)
+			}
+		}},
+	{"target health", MSG_TYPE_TARGET_HEALTH,
+		func() []byte { return []byte(TargetHealthDown) },
+		func(t *testing.T, payload []byte) {
+			if string(payload) != TargetHealthDown {
+				t.Errorf("Unexpected health %q", payload)
+			}
+		}},
+	{"cancel", MSG_TYPE_CANCEL,
+		func() []byte { return []byte(CancelReasonClientDisconnect) },
+		func(t *testing.T, payload []byte) {
+			if string(payload) != CancelReasonClientDisconnect {
+				t.Errorf("Unexpected cancel reason %q", payload)
+			}
+		}},
+	{"target check", MSG_TYPE_TARGET_CHECK,
+		func() []byte {
+			return mustEncode(EncodeTargetCheckRequest(TargetCheckRequest{Path: "/healthz"}))
+		},
+		func(t *testing.T, payload []byte) {
+			req, err := DecodeTargetCheckRequest(payload)
+			if err != nil || req.Path != "/healthz" {
+				t.Errorf("Unexpected target check %+v: %v", req, err)
+			}
+		}},
+	{"target check result", MSG_TYPE_TARGET_CHECK_RES,
+		func() []byte {
+			return mustEncode(EncodeTargetCheckResult(TargetCheckResult{OK: true, Status: 204, ConnectMs: 1.5}))
+		},
+		func(t *testing.T, payload []byte) {
+			res, err := DecodeTargetCheckResult(payload)
+			want := TargetCheckResult{OK: true, Status: 204, ConnectMs: 1.5}
+			if err != nil || !reflect.DeepEqual(res, want) {
+				t.Errorf("Expected %+v, got %+v: %v", want, res, err)
+			}
+		}},
+	{"goaway", MSG_TYPE_GOAWAY,
+		func() []byte {
+			return mustEncode(EncodeGoAway(GoAway{GraceMs: 30000, ReconnectTo: "wss://next.example.com", Reason: GoAwayReasonDrain}))
+		},
+		func(t *testing.T, payload []byte) {
+			g, err := DecodeGoAway(payload)
+			if err != nil || g.Grace() != 30*time.Second || g.ReconnectTo != "wss://next.example.com" || g.Reason != GoAwayReasonDrain {
+				t.Errorf("Unexpected goaway %+v: %v", g, err)
+			}
+		}},
+	{"local request", MSG_TYPE_LOCAL_REQ,
+		func() []byte {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost:9000/dashboard?tab=1", nil)
+			r.Header.Set(HeaderTunnelKey, "remote-app")
+			return mustEncode(SerializeHTTPRequest(r))
+		},
+		func(t *testing.T, payload []byte) {
+			r, err := ParseHTTPRequest(payload, HeaderLimits{})
+			if err != nil {
+				t.Fatalf("Failed to parse local request: %v", err)
+			}
+			if r.URL.RequestURI() != "/dashboard?tab=1" || r.Header.Get(HeaderTunnelKey) != "remote-app" {
+				t.Errorf("Unexpected local request %s %v", r.URL.RequestURI(), r.Header)
+			}
+		}},
+	{"local response header", MSG_TYPE_LOCAL_RES,
+		func() []byte {
+			return []byte("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n")
+		},
+		func(t *testing.T, payload []byte) {
+			resp, err := DeserializeHTTPResponse(payload)
+			if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/html" {
+				t.Errorf("Unexpected local response header: %v", err)
+			}
+		}},
+	{"local response chunk", MSG_TYPE_LOCAL_RES_CHUNK,
+		func() []byte { return []byte("<html>") },
+		func(t *testing.T, payload []byte) {
+			if string(payload) != "<html>" {
+				t.Errorf("Unexpected chunk %q", payload)
+			}
+		}},
+	{"local response end", MSG_TYPE_LOCAL_RES_CHUNK,
+		func() []byte { return []byte{} },
+		func(t *testing.T, payload []byte) {
+			if len(payload) != 0 {
+				t.Errorf("Expected an empty end marker, got %q", payload)
+			}
+		}},
+}
+
+func TestMessageShapesRoundTrip(t *testing.T) {
+	covered := make(map[MessageType]bool)
+	for i, shape := range messageShapes {
+		t.Run(shape.name, func(t *testing.T) {
+			covered[shape.msgType] = true
+			payload := shape.payload()
+			data, err := SerializeTunnelMessage(TunnelMessage{ID: uint64(i) << 40, Type: shape.msgType, Payload: payload})
+			if err != nil {
+				t.Fatalf("Failed to serialize: %v", err)
+			}
+			if len(data) != MessageHeaderSize+len(payload) {
+				t.Errorf("Expected %d bytes, got %d", MessageHeaderSize+len(payload), len(data))
+			}
+			msg, err := DeserializeTunnelMessage(data)
+			if err != nil {
+				t.Fatalf("Failed to deserialize: %v", err)
+			}
+			if msg.ID != uint64(i)<<40 || msg.Type != shape.msgType || !bytes.Equal(msg.Payload, payload) {
+				t.Fatalf("Round trip changed the message: %+v", msg)
+			}
+			shape.check(t, msg.Payload)
+		})
+	}
+
+	// 每种消息类型都要有用例
+	for msgType := range messageTypeNames {
+		if !covered[msgType] {
+			t.Errorf("No message shape covers %s", msgType)
+		}
+	}
+}
+
+func TestMessageTypeString(t *testing.T) {
+	seen := make(map[string]MessageType)
+	for msgType, name := range messageTypeNames {
+		if other, ok := seen[name]; ok {
+			t.Errorf("%d and %d share the name %q", msgType, other, name)
+		}
+		seen[name] = msgType
+		if msgType.String() != name {
+			t.Errorf("Expected %q, got %q", name, msgType.String())
+		}
+	}
+	if s := MessageType(200).String(); s != "unknown(200)" {
+		t.Errorf("Expected unknown(200), got %q", s)
+	}
+}
+
+// TestV1WireCompatibility 当前编码与冻结的 v1 编码在 v1 消息上逐字节一致
+func TestV1WireCompatibility(t *testing.T) {
+	head := v1.EncodeResponseHead("404 Not Found", http.Header{"Content-Type": {"text/plain"}})
+	for _, tc := range []struct {
+		msgType MessageType
+		payload []byte
+	}{
+		{v1.TypeHTTPReq, []byte("GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n")},
+		{v1.TypeHTTPRes, head},
+		{v1.TypeHTTPResChunk, []byte("data")},
+		{v1.TypeHTTPResChunk, nil},
+	} {
+		current, err := SerializeTunnelMessage(TunnelMessage{ID: 0x0102030405060708, Type: tc.msgType, Payload: tc.payload})
+		if err != nil {
+			t.Fatalf("Failed to serialize: %v", err)
+		}
+		frozen := v1.Encode(0x0102030405060708, uint8(tc.msgType), tc.payload)
+		if !bytes.Equal(current, frozen) {
+			t.Errorf("%s: encoding differs from v1\ncurrent: %x\nv1:      %x", tc.msgType, current, frozen)
+		}
+
+		id, msgType, payload, err := v1.Decode(current)
+		if err != nil || id != 0x0102030405060708 || MessageType(msgType) != tc.msgType || !bytes.Equal(payload, tc.payload) {
+			t.Errorf("%s: v1 decoder cannot read the current encoding: %v", tc.msgType, err)
+		}
+	}
+
+	if !bytes.Equal(v1.EncodeEnd(9), v1.Encode(9, v1.TypeHTTPResChunk, []byte{})) {
+		t.Error("v1 end marker must be an empty chunk")
+	}
+	resp, err := DeserializeHTTPResponse(head)
+	if err != nil || resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Failed to parse v1 response header: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// 单条隧道消息 (一个WebSocket数据帧) 的大小上限。双方在注册时经 HeaderMaxFrameSize 协商，
+// 协商结果同时用于两端的 SetReadLimit 和发送方的消息切分
+const (
+	// DefaultMaxFrameSize 未配置或对端未声明时的上限，与协商引入前两端固定的读取上限相同
+	DefaultMaxFrameSize = 10 << 20
+	// MinFrameSize 配置和协商结果的下限，保证 32KB 的响应体数据块和 64KB 的完整响应加上头部仍能放入一条消息
+	MinFrameSize = 256 << 10
+	// MaxFrameSizeLimit 配置和协商结果的上限，单条消息需要整体读入内存
+	MaxFrameSizeLimit = 64 << 20
+)
+
+// ClampFrameSize 将配置的上限限制在 [MinFrameSize, MaxFrameSizeLimit] 内，0 或负数为 DefaultMaxFrameSize
+func ClampFrameSize(n int) int {
+	if n <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return min(max(n, MinFrameSize), MaxFrameSizeLimit)
+}
+
+// NegotiateFrameSize 由本端配置的上限和对端在 HeaderMaxFrameSize 中声明的值得出连接的上限，取两者较小者。
+// 对端未声明 (旧版) 或声明的值无法解析时使用 DefaultMaxFrameSize，与旧版的行为一致
+func NegotiateFrameSize(local int, peer string) int {
+	n, err := strconv.Atoi(peer)
+	if err != nil || n <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return min(ClampFrameSize(local), ClampFrameSize(n))
+}
+
+// MessageOverhead 隧道消息在负载之外的最大字节数: 消息头部和启用签名时的签名
+const MessageOverhead = MessageHeaderSize + MessageAuthTagSize
+
+// MaxChunkData 在大小上限为 frameSize 的连接上，一个带序号的响应体数据块最多可以携带的数据字节数
+func MaxChunkData(frameSize int) int {
+	return frameSize - MessageOverhead - ChunkHeaderSize
+}
+
+// FrameDiscardLimit 超过上限的消息最多读取并丢弃的字节数。丢弃后连接可以继续使用，
+// 更大的消息不再读完，读取方以协议错误关闭连接
+const FrameDiscardLimit = MaxFrameSizeLimit
+
+// FrameTooLargeError 收到的消息超过连接协商的大小上限。ID 和 Type 取自消息头部，启用签名时未经校验，只用于定位请求。
+// Drained 为 true 时消息已被读完丢弃，读取方可以只结束对应的请求而保留连接
+type FrameTooLargeError struct {
+	ID      uint64
+	Type    MessageType
+	Size    int64 // 读取的字节数，Drained 为 false 时只是下限
+	Limit   int
+	Drained bool
+}
+
+func (e *FrameTooLargeError) Error() string {
+	if !e.Drained {
+		return fmt.Sprintf("tunnel message %d (type %s) exceeds the negotiated frame size %d by more than %d bytes", e.ID, e.Type, e.Limit, FrameDiscardLimit)
+	}
+	return fmt.Sprintf("tunnel message %d (type %s) of %d bytes exceeds the negotiated frame size %d", e.ID, e.Type, e.Size, e.Limit)
+}
+
+// ReadFrame 将 r 中的一条消息读入 buf (调用方先清空)。超过 limit 时读取并丢弃剩余部分，
+// 不占用额外内存，返回 *FrameTooLargeError；连接读取失败时返回原始错误
+func ReadFrame(buf *bytes.Buffer, r io.Reader, limit int) error {
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return err
+	}
+	if n <= int64(limit) {
+		return nil
+	}
+
+	tooLarge := &FrameTooLargeError{Limit: limit}
+	if data := buf.Bytes(); len(data) >= MessageHeaderSize {
+		tooLarge.ID = binary.BigEndian.Uint64(data[:8])
+		tooLarge.Type = MessageType(data[8])
+	}
+	buf.Reset()
+	dropped, err := io.CopyN(io.Discard, r, FrameDiscardLimit)
+	tooLarge.Size = n + dropped
+	switch err {
+	case io.EOF:
+		tooLarge.Drained = true
+	case nil:
+		// 丢弃上限内没有读完
+	default:
+		return err
+	}
+	return tooLarge
+}
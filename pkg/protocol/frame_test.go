@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestNegotiateFrameSize(t *testing.T) {
+	tests := []struct {
+		local int
+		peer  string
+		want  int
+	}{
+		// 对端未声明或声明无效时保持旧版的 10MB
+		{0, "", DefaultMaxFrameSize},
+		{MinFrameSize, "", DefaultMaxFrameSize},
+		{0, "abc", DefaultMaxFrameSize},
+		{0, "-1", DefaultMaxFrameSize},
+		{0, "1048576", 1 << 20},
+		{1 << 20, "4194304", 1 << 20},
+		// 超出范围的值被限制在下限和上限之间
+		{1024, "1048576", MinFrameSize},
+		{1 << 30, "1073741824", MaxFrameSizeLimit},
+	}
+	for _, tt := range tests {
+		if got := NegotiateFrameSize(tt.local, tt.peer); got != tt.want {
+			t.Errorf("NegotiateFrameSize(%d, %q) = %d, want %d", tt.local, tt.peer, got, tt.want)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	msg, _ := SerializeTunnelMessage(TunnelMessage{ID: 42, Type: MSG_TYPE_HTTP_RES_FULL, Payload: bytes.Repeat([]byte("x"), MinFrameSize)})
+
+	var buf bytes.Buffer
+	if err := ReadFrame(&buf, bytes.NewReader(msg), len(msg)); err != nil || buf.Len() != len(msg) {
+		t.Fatalf("Expected the message to fit, got %d bytes and %v", buf.Len(), err)
+	}
+
+	// 超限的消息被读完丢弃，错误中带有头部的请求ID
+	buf.Reset()
+	r := bytes.NewReader(msg)
+	err := ReadFrame(&buf, r, MinFrameSize)
+	var tooLarge *FrameTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Expected FrameTooLargeError, got %v", err)
+	}
+	if !tooLarge.Drained || tooLarge.ID != 42 || tooLarge.Type != MSG_TYPE_HTTP_RES_FULL || tooLarge.Size != int64(len(msg)) {
+		t.Errorf("Unexpected error details: %+v", tooLarge)
+	}
+	if r.Len() != 0 || buf.Len() != 0 {
+		t.Errorf("Expected the message to be discarded, %d unread and %d buffered", r.Len(), buf.Len())
+	}
+
+	// 超出丢弃上限的消息不再读完
+	huge := io.MultiReader(bytes.NewReader(msg), io.LimitReader(zeroReader{}, FrameDiscardLimit))
+	err = ReadFrame(&buf, huge, MinFrameSize)
+	if !errors.As(err, &tooLarge) || tooLarge.Drained {
+		t.Errorf("Expected an undrained FrameTooLargeError, got %v", err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// MSG_TYPE_GOAWAY 的原因
+const (
+	GoAwayReasonDrain          = "drain"           // 管理员通过 /admin/drain 要求迁移
+	GoAwayReasonServerShutdown = "server_shutdown" // 服务器正在停止
+	GoAwayReasonRebalance      = "rebalance"       // 在线连接数超过 -redirect-threshold，新注册的客户端被重定向到备用服务器
+)
+
+// GoAway 是 MSG_TYPE_GOAWAY 的负载。客户端应完成进行中的请求后主动断开并重连，
+// ReconnectTo 不为空时改为连接该地址；宽限期结束时服务器关闭仍未断开的连接
+type GoAway struct {
+	GraceMs     int64  `json:"grace_ms"`
+	ReconnectTo string `json:"reconnect_to,omitempty"` // 备用服务器地址 (ws:// 或 wss://)，客户端只接受 -redirect-allow 允许的地址
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Grace 返回宽限期
+func (g GoAway) Grace() time.Duration {
+	return time.Duration(g.GraceMs) * time.Millisecond
+}
+
+// EncodeGoAway 序列化迁移通知
+func EncodeGoAway(g GoAway) ([]byte, error) {
+	return json.Marshal(g)
+}
+
+// DecodeGoAway 反序列化迁移通知
+func DecodeGoAway(data []byte) (GoAway, error) {
+	var g GoAway
+	err := json.Unmarshal(data, &g)
+	return g, err
+}
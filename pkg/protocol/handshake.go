@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 隧道注册握手中使用的HTTP头和查询参数
+const (
+	// HeaderTunnelKey 公网请求中指定目标隧道的头，同时在注册响应中返回服务器分配的key
+	HeaderTunnelKey = "X-Tunnel-Key"
+	// HeaderPublicURL 注册响应中返回的公网访问地址
+	HeaderPublicURL = "X-Tunnel-Public-Url"
+	// HeaderKeyExpires 注册响应中返回的自动key过期时间 (RFC3339)
+	HeaderKeyExpires = "X-Tunnel-Key-Expires"
+	// HeaderRoute 注册响应中返回的公网路由方式 (见 Route* 常量)
+	HeaderRoute = "X-Tunnel-Route"
+	// HeaderWeight 注册请求中客户端声明的负载均衡权重
+	HeaderWeight = "X-Tunnel-Weight"
+	// HeaderFeatures 注册请求中客户端支持的可选消息类型 (逗号分隔，见 Feature* 常量)
+	HeaderFeatures = "X-Tunnel-Features"
+	// HeaderMessageAuth 注册响应中服务器确认启用的消息签名算法 (见 MessageAuth* 常量)，未返回时双方不签名
+	HeaderMessageAuth = "X-Tunnel-Message-Auth"
+	// HeaderMessageAuthNonce 注册响应中 hmac-sha256-seq 的握手随机数 (十六进制)，把签名绑定到这条连接
+	HeaderMessageAuthNonce = "X-Tunnel-Message-Auth-Nonce"
+	// HeaderServerFeatures 注册响应中服务器对该连接启用的、会改变消息格式的功能 (逗号分隔，见 Feature* 常量)
+	HeaderServerFeatures = "X-Tunnel-Server-Features"
+	// HeaderMaxFrameSize 注册请求中客户端声明的单条消息大小上限，注册响应中返回协商结果 (见 NegotiateFrameSize)
+	HeaderMaxFrameSize = "X-Tunnel-Max-Frame-Size"
+	// HeaderHeaderTableSize 注册请求中客户端声明的请求头索引表大小上限，注册响应中返回协商结果 (见 NegotiateHeaderTableSize)
+	HeaderHeaderTableSize = "X-Tunnel-Header-Table-Size"
+	// HeaderRequestBody HTTP长轮询的轮询响应中标记请求体需要单独获取 (值为 RequestBodyStream)
+	HeaderRequestBody = "X-Tunnel-Request-Body"
+
+	// QueryAutoKey 注册时请求服务器分配key的查询参数
+	QueryAutoKey = "auto_key"
+)
+
+// 公网请求路由到隧道的方式
+const (
+	RouteHeader  = "header"  // 公网请求需携带 X-Tunnel-Key 头
+	RouteDefault = "default" // 未携带key的公网请求默认路由到该隧道
+)
+
+// 客户端可选支持的协议功能，旧客户端收到未知消息过多时会断开连接，服务器只向声明支持的客户端发送
+const (
+	FeatureCancel         = "cancel"           // 接收 MSG_TYPE_CANCEL
+	FeatureTargetCheck    = "target_check"     // 响应 MSG_TYPE_TARGET_CHECK
+	FeatureMessageAuth    = "message_auth"     // 配置了 message_auth_key，可以对消息签名
+	FeatureMessageAuthSeq = "message_auth_seq" // 支持 hmac-sha256-seq，服务器在 HeaderMessageAuth 中确认后启用
+	FeatureChunkSeq       = "chunk_seq"        // 响应体数据块带序号和结束长度 (见 ResponseChunk)，服务器在 HeaderServerFeatures 中确认后启用
+	FeatureBodyStream     = "body_stream"      // HTTP长轮询客户端可以从 /http-tunnel/body/{key}/{id} 流式获取请求体
+	FeatureGoAway         = "goaway"           // 接收 MSG_TYPE_GOAWAY
+	FeatureHeaderTable    = "header_table"     // 请求消息的头部经索引表编码 (见 HeaderEncoder)，服务器在 HeaderServerFeatures 中确认后启用
+	FeatureLocalForward   = "local_forward"    // 客户端发送 MSG_TYPE_LOCAL_REQ 并接收其响应，服务器在 HeaderServerFeatures 中确认后启用
+	FeatureResponseAbort  = "response_abort"   // 读取目标响应体失败时以 MSG_TYPE_CANCEL 中止已发出响应头的响应，服务器在 HeaderServerFeatures 中确认后启用
+)
+
+// RequestBodyStream HeaderRequestBody 的值: 请求消息只含请求行和头部，请求体从 body 端点读取
+const RequestBodyStream = "stream"
+
+// HasFeature 判断 HeaderFeatures 头的值中是否包含指定功能
+func HasFeature(header, feature string) bool {
+	for _, f := range strings.Split(header, ",") {
+		if strings.TrimSpace(f) == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfterPrefix 关闭原因中携带重试等待时间的前缀
+const retryAfterPrefix = "retry-after="
+
+// FormatRetryAfterReason 生成携带重试等待时间的关闭原因，
+// 服务器以 1013 (Try Again Later) 关闭连接时使用
+func FormatRetryAfterReason(reason string, d time.Duration) string {
+	return fmt.Sprintf("%s; %s%d", reason, retryAfterPrefix, int(math.Ceil(d.Seconds())))
+}
+
+// ParseRetryAfterReason 从关闭原因中解析重试等待时间
+func ParseRetryAfterReason(reason string) (time.Duration, bool) {
+	idx := strings.LastIndex(reason, retryAfterPrefix)
+	if idx < 0 {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(strings.TrimSpace(reason[idx+len(retryAfterPrefix):]))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
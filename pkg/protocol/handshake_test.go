@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryAfterReason(t *testing.T) {
+	reason := FormatRetryAfterReason("registration rate limited", 1500*time.Millisecond)
+	if reason != "registration rate limited; retry-after=2" {
+		t.Errorf("Unexpected reason %q", reason)
+	}
+	if d, ok := ParseRetryAfterReason(reason); !ok || d != 2*time.Second {
+		t.Errorf("Expected 2s, got %v %v", d, ok)
+	}
+
+	for _, reason := range []string{"", "tunnel key expired", "retry-after=abc", "retry-after=-1"} {
+		if _, ok := ParseRetryAfterReason(reason); ok {
+			t.Errorf("Expected %q to have no retry-after", reason)
+		}
+	}
+}
+
+func TestHasFeature(t *testing.T) {
+	if !HasFeature("cancel", FeatureCancel) || !HasFeature("other, cancel", FeatureCancel) {
+		t.Error("Expected cancel feature to be found")
+	}
+	for _, header := range []string{"", "cancellation", "other"} {
+		if HasFeature(header, FeatureCancel) {
+			t.Errorf("Expected %q not to declare cancel", header)
+		}
+	}
+}
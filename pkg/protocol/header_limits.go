@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// 公网请求头部的默认限制，与 net/http 的 DefaultMaxHeaderBytes 一致；net/http 不限制头部行数，默认同样不限制
+const (
+	DefaultMaxHeaderBytes      = http.DefaultMaxHeaderBytes
+	DefaultMaxHeaderFieldBytes = http.DefaultMaxHeaderBytes
+)
+
+// HeaderLimits 限制经隧道转发的请求头部，避免超大头部在服务器、客户端和目标服务逐跳放大内存占用
+type HeaderLimits struct {
+	MaxCount      int // 头部行数上限 (0为不限制)
+	MaxFieldBytes int // 单个头部行的字节上限, 按名称加值计算
+	MaxTotalBytes int // 全部头部的字节上限, 每行按 "名称: 值\r\n" 计算
+}
+
+// NewHeaderLimits 按配置创建头部限制，字节上限为0时使用默认值
+func NewHeaderLimits(maxCount, maxFieldBytes, maxTotalBytes int) HeaderLimits {
+	if maxFieldBytes <= 0 {
+		maxFieldBytes = DefaultMaxHeaderFieldBytes
+	}
+	if maxTotalBytes <= 0 {
+		maxTotalBytes = DefaultMaxHeaderBytes
+	}
+	return HeaderLimits{MaxCount: maxCount, MaxFieldBytes: maxFieldBytes, MaxTotalBytes: maxTotalBytes}
+}
+
+// HeaderLimitError 请求头部超出限制，Limit 为 count、field 或 total
+type HeaderLimitError struct {
+	Limit string
+	Name  string // Limit 为 field 时超出限制的头部名称
+	Value int
+	Max   int
+}
+
+func (e *HeaderLimitError) Error() string {
+	switch e.Limit {
+	case "count":
+		return fmt.Sprintf("request has %d header fields, limit is %d", e.Value, e.Max)
+	case "field":
+		return fmt.Sprintf("header %s is %d bytes, limit is %d", e.Name, e.Value, e.Max)
+	}
+	return fmt.Sprintf("request headers are %d bytes, limit is %d", e.Value, e.Max)
+}
+
+// Check 检查头部是否超出限制，超出时返回 *HeaderLimitError
+func (l HeaderLimits) Check(h http.Header) error {
+	count, total := 0, 0
+	for name, values := range h {
+		for _, v := range values {
+			count++
+			field := len(name) + len(v)
+			if l.MaxFieldBytes > 0 && field > l.MaxFieldBytes {
+				return &HeaderLimitError{Limit: "field", Name: name, Value: field, Max: l.MaxFieldBytes}
+			}
+			total += field + len(": \r\n")
+		}
+	}
+	if l.MaxCount > 0 && count > l.MaxCount {
+		return &HeaderLimitError{Limit: "count", Value: count, Max: l.MaxCount}
+	}
+	if l.MaxTotalBytes > 0 && total > l.MaxTotalBytes {
+		return &HeaderLimitError{Limit: "total", Value: total, Max: l.MaxTotalBytes}
+	}
+	return nil
+}
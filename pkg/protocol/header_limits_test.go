@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	check := func(limits HeaderLimits, h http.Header) string {
+		err := limits.Check(h)
+		if err == nil {
+			return ""
+		}
+		var limitErr *HeaderLimitError
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("Expected HeaderLimitError, got %v", err)
+		}
+		return limitErr.Limit
+	}
+	headers := func(n int) http.Header {
+		h := make(http.Header)
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprintf("X-H%d", i), "v")
+		}
+		return h
+	}
+
+	count := HeaderLimits{MaxCount: 10}
+	if got := check(count, headers(10)); got != "" {
+		t.Errorf("10 headers at count limit: got %q", got)
+	}
+	if got := check(count, headers(11)); got != "count" {
+		t.Errorf("11 headers over count limit: got %q", got)
+	}
+	// 同名头部的每个值单独计数
+	if got := check(count, http.Header{"X-Multi": strings.Split(strings.Repeat("v,", 11), ",")[:11]}); got != "count" {
+		t.Errorf("Repeated header over count limit: got %q", got)
+	}
+
+	// 单个头部按名称加值计算: "Cookie" 6 字节
+	field := HeaderLimits{MaxFieldBytes: 100}
+	if got := check(field, http.Header{"Cookie": {strings.Repeat("c", 94)}}); got != "" {
+		t.Errorf("Field at limit: got %q", got)
+	}
+	if got := check(field, http.Header{"Cookie": {strings.Repeat("c", 95)}}); got != "field" {
+		t.Errorf("Field over limit: got %q", got)
+	}
+
+	// 总大小每行按 "名称: 值\r\n" 计算: "X-A: " + 值 + "\r\n"
+	total := HeaderLimits{MaxTotalBytes: 200}
+	h := http.Header{"X-A": {strings.Repeat("a", 96)}, "X-B": {strings.Repeat("b", 90)}}
+	if got := check(total, h); got != "" {
+		t.Errorf("Headers at total limit: got %q", got)
+	}
+	h.Set("X-B", strings.Repeat("b", 91))
+	if got := check(total, h); got != "total" {
+		t.Errorf("Headers over total limit: got %q", got)
+	}
+
+	defaults := NewHeaderLimits(0, 0, 0)
+	if defaults.MaxCount != 0 || defaults.MaxFieldBytes != http.DefaultMaxHeaderBytes || defaults.MaxTotalBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("Unexpected default limits %+v", defaults)
+	}
+	if got := check(defaults, http.Header{"Cookie": {strings.Repeat("c", http.DefaultMaxHeaderBytes)}}); got != "field" {
+		t.Errorf("1MB cookie with default limits: got %q", got)
+	}
+}
+
+func TestParseHTTPRequestHeaderLimits(t *testing.T) {
+	data := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nX-A: 1\r\nX-B: 2\r\n\r\n")
+	if _, err := ParseHTTPRequest(data, HeaderLimits{MaxCount: 2}); err != nil {
+		t.Errorf("Expected request at limit to parse, got %v", err)
+	}
+	var limitErr *HeaderLimitError
+	if _, err := ParseHTTPRequest(data, HeaderLimits{MaxCount: 1}); !errors.As(err, &limitErr) {
+		t.Errorf("Expected HeaderLimitError, got %v", err)
+	}
+}
@@ -0,0 +1,435 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 请求头索引表: 类似 HPACK 的静态表加动态表，在一条隧道连接上把重复的请求头编码为表项序号。
+// 服务器编码 MSG_TYPE_HTTP_REQ 的负载，客户端在转发前还原为原始字节。动态表随连接创建，
+// 双方按相同顺序插入和淘汰表项，连接断开后即丢弃，重连从空表开始。
+// 只在客户端声明 FeatureHeaderTable、服务器配置了表大小并在 HeaderServerFeatures 中确认后启用
+const (
+	// MaxHeaderTableSize 动态表大小的协议上限，客户端注册时以此声明
+	MaxHeaderTableSize = 64 << 10
+	// HeaderTableOverhead 编码后的负载最多比原始负载多出的字节数，发送前的消息大小检查需计入
+	HeaderTableOverhead = 16
+
+	// headerEntryOverhead 每个表项在名称和值之外计入表大小的字节数，与 HPACK 相同
+	headerEntryOverhead = 32
+)
+
+// 编码后负载的首字节
+const (
+	headerBlockRaw   byte = 0 // 其后为原始负载，不涉及动态表
+	headerBlockCoded byte = 1 // 其后为编码的请求行和头部，再后为原始请求体
+)
+
+// 头部字段的编码方式
+const (
+	fieldIndexed             byte = 0 // 名称和值都引用表项
+	fieldIndexedNameInsert   byte = 1 // 名称引用表项，值为原文，插入动态表
+	fieldLiteralInsert       byte = 2 // 名称和值都为原文，插入动态表
+	fieldIndexedNameNoInsert byte = 3 // 名称引用表项，值为原文，不插入
+	fieldLiteralNoInsert     byte = 4 // 名称和值都为原文，不插入
+)
+
+// ErrHeaderTableDesync 编码的请求与本端的动态表不一致，双方的表已无法对齐，只能断开连接重建
+var ErrHeaderTableDesync = errors.New("header table out of sync")
+
+type headerField struct {
+	name, value string
+}
+
+func (f headerField) size() int {
+	return len(f.name) + len(f.value) + headerEntryOverhead
+}
+
+// headerStaticTable 常见请求头，值为空的表项只用于引用名称。追加表项会改变动态表的序号，属于协议变更
+var headerStaticTable = []headerField{
+	{"Accept", "*/*"},
+	{"Accept", "application/json"},
+	{"Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+	{"Accept-Encoding", "gzip"},
+	{"Accept-Encoding", "gzip, deflate"},
+	{"Accept-Encoding", "gzip, deflate, br"},
+	{"Accept-Encoding", "gzip, deflate, br, zstd"},
+	{"Accept-Language", ""},
+	{"Authorization", ""},
+	{"Cache-Control", "no-cache"},
+	{"Cache-Control", "max-age=0"},
+	{"Connection", "keep-alive"},
+	{"Content-Length", ""},
+	{"Content-Type", "application/json"},
+	{"Content-Type", "application/x-www-form-urlencoded"},
+	{"Cookie", ""},
+	{"If-Modified-Since", ""},
+	{"If-None-Match", ""},
+	{"Origin", ""},
+	{"Pragma", "no-cache"},
+	{"Referer", ""},
+	{"Sec-Fetch-Dest", "empty"},
+	{"Sec-Fetch-Mode", "cors"},
+	{"Sec-Fetch-Site", "same-origin"},
+	{"Upgrade-Insecure-Requests", "1"},
+	{"User-Agent", ""},
+	{"X-Forwarded-For", ""},
+	{"X-Forwarded-Host", ""},
+	{"X-Forwarded-Proto", "http"},
+	{"X-Forwarded-Proto", "https"},
+	{"X-Real-Ip", ""},
+	{"X-Request-Id", ""},
+}
+
+// headerStaticIndex 静态表的查找索引
+var headerStaticIndex, headerStaticNames = func() (map[headerField]int, map[string]int) {
+	fields := make(map[headerField]int)
+	names := make(map[string]int)
+	for i, f := range headerStaticTable {
+		if _, ok := names[f.name]; !ok {
+			names[f.name] = i
+		}
+		if f.value != "" {
+			fields[f] = i
+		}
+	}
+	return fields, names
+}()
+
+// neverIndexedHeaders 携带凭据的头部不进入动态表，避免借助编码长度推测其内容
+var neverIndexedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+}
+
+// headerTable 动态表，entries 按插入顺序排列，最新的表项序号最小
+type headerTable struct {
+	maxSize  int
+	size     int
+	entries  []headerField
+	inserted uint64 // 连接建立以来插入的表项总数，编码时随请求发送以检查双方是否一致
+}
+
+// add 插入表项并按先进先出淘汰，返回是否插入。大于整个表的表项不插入
+func (t *headerTable) add(f headerField) (evicted []headerField, ok bool) {
+	if f.size() > t.maxSize {
+		return nil, false
+	}
+	for t.size+f.size() > t.maxSize {
+		evicted = append(evicted, t.entries[0])
+		t.size -= t.entries[0].size()
+		t.entries = t.entries[1:]
+	}
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.inserted++
+	return evicted, true
+}
+
+// field 按序号返回表项，先静态表后动态表 (最新的在前)
+func (t *headerTable) field(index uint64) (headerField, bool) {
+	if index < uint64(len(headerStaticTable)) {
+		return headerStaticTable[index], true
+	}
+	index -= uint64(len(headerStaticTable))
+	if index >= uint64(len(t.entries)) {
+		return headerField{}, false
+	}
+	return t.entries[len(t.entries)-1-int(index)], true
+}
+
+// HeaderEncoder 服务器端一条隧道连接上的编码器。Encode 的调用顺序必须与消息写入连接的顺序一致，
+// 调用方在持有写锁时编码
+type HeaderEncoder struct {
+	table headerTable
+	// 动态表中表项和名称最近一次插入的序号 (对应 table.inserted)，淘汰时若未被更新则删除
+	fields map[headerField]uint64
+	names  map[string]uint64
+}
+
+// NewHeaderEncoder 创建动态表大小为 size 字节的编码器
+func NewHeaderEncoder(size int) *HeaderEncoder {
+	return &HeaderEncoder{
+		table:  headerTable{maxSize: size},
+		fields: make(map[headerField]uint64),
+		names:  make(map[string]uint64),
+	}
+}
+
+// HeaderDecoder 客户端一条隧道连接上的解码器，只在读取消息的协程中使用
+type HeaderDecoder struct {
+	table headerTable
+}
+
+// NewHeaderDecoder 创建动态表大小为 size 字节的解码器，size 与服务器协商的结果一致
+func NewHeaderDecoder(size int) *HeaderDecoder {
+	return &HeaderDecoder{table: headerTable{maxSize: size}}
+}
+
+// NegotiateHeaderTableSize 由服务器配置的表大小和客户端在 HeaderHeaderTableSize 中声明的上限得出连接的表大小，
+// 取两者较小者且不超过 MaxHeaderTableSize。任一方为0或声明无法解析时返回0，不启用
+func NegotiateHeaderTableSize(local int, peer string) int {
+	n, err := strconv.Atoi(peer)
+	if err != nil || n <= 0 || local <= 0 {
+		return 0
+	}
+	return min(local, n, MaxHeaderTableSize)
+}
+
+// splitRequestHead 将 SerializeHTTPRequest 生成的负载拆分为请求行、头部字段和请求体，格式不符时返回 false
+func splitRequestHead(payload []byte) (line string, fields []headerField, body []byte, ok bool) {
+	end := bytes.Index(payload, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", nil, nil, false
+	}
+	lines := strings.Split(string(payload[:end]), "\r\n")
+	for _, l := range lines[1:] {
+		name, value, found := strings.Cut(l, ": ")
+		if !found {
+			return "", nil, nil, false
+		}
+		fields = append(fields, headerField{name, value})
+	}
+	return lines[0], fields, payload[end+4:], true
+}
+
+// literalSize 头部全部以原文编码时的长度，索引引用不会比原文更长，它是编码结果的上限
+func literalSize(line string, fields []headerField, body []byte) int {
+	n := 1 + binary.MaxVarintLen64 + uvarintSize(len(line)) + len(line) + uvarintSize(len(fields)) + len(body)
+	for _, f := range fields {
+		n += 1 + uvarintSize(len(f.name)) + len(f.name) + uvarintSize(len(f.value)) + len(f.value)
+	}
+	return n
+}
+
+func uvarintSize(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n))
+}
+
+// Encode 编码一条请求消息的负载 (SerializeHTTPRequest 或 SerializeHTTPRequestHead 的结果)。
+// 结果不超过原始负载加 HeaderTableOverhead；无法拆分或编码后更长时原样发送
+func (e *HeaderEncoder) Encode(payload []byte) []byte {
+	line, fields, body, ok := splitRequestHead(payload)
+	if !ok || literalSize(line, fields, body) > len(payload)+HeaderTableOverhead {
+		return append([]byte{headerBlockRaw}, payload...)
+	}
+
+	buf := make([]byte, 0, len(payload)+HeaderTableOverhead)
+	buf = append(buf, headerBlockCoded)
+	buf = binary.AppendUvarint(buf, e.table.inserted)
+	buf = appendString(buf, line)
+	buf = binary.AppendUvarint(buf, uint64(len(fields)))
+	for _, f := range fields {
+		buf = e.encodeField(buf, f)
+	}
+	return append(buf, body...)
+}
+
+func (e *HeaderEncoder) encodeField(buf []byte, f headerField) []byte {
+	if i, ok := e.lookup(f); ok {
+		buf = append(buf, fieldIndexed)
+		return binary.AppendUvarint(buf, i)
+	}
+	nameIndex, nameFound := e.lookupName(f.name)
+	insert := !neverIndexedHeaders[f.name] && f.size() <= e.table.maxSize
+	switch {
+	case nameFound && insert:
+		buf = append(buf, fieldIndexedNameInsert)
+	case nameFound:
+		buf = append(buf, fieldIndexedNameNoInsert)
+	case insert:
+		buf = append(buf, fieldLiteralInsert)
+	default:
+		buf = append(buf, fieldLiteralNoInsert)
+	}
+	if nameFound {
+		buf = binary.AppendUvarint(buf, nameIndex)
+	} else {
+		buf = appendString(buf, f.name)
+	}
+	buf = appendString(buf, f.value)
+	if insert {
+		e.insert(f)
+	}
+	return buf
+}
+
+// lookup 返回名称和值都匹配的表项序号
+func (e *HeaderEncoder) lookup(f headerField) (uint64, bool) {
+	if i, ok := headerStaticIndex[f]; ok {
+		return uint64(i), true
+	}
+	if seq, ok := e.fields[f]; ok {
+		return e.dynamicIndex(seq), true
+	}
+	return 0, false
+}
+
+// lookupName 返回名称匹配的表项序号
+func (e *HeaderEncoder) lookupName(name string) (uint64, bool) {
+	if i, ok := headerStaticNames[name]; ok {
+		return uint64(i), true
+	}
+	if seq, ok := e.names[name]; ok {
+		return e.dynamicIndex(seq), true
+	}
+	return 0, false
+}
+
+// dynamicIndex 将插入序号换算为当前的表项序号
+func (e *HeaderEncoder) dynamicIndex(seq uint64) uint64 {
+	return uint64(len(headerStaticTable)) + e.table.inserted - 1 - seq
+}
+
+func (e *HeaderEncoder) insert(f headerField) {
+	seq := e.table.inserted
+	evicted, ok := e.table.add(f)
+	if !ok {
+		return
+	}
+	// 被淘汰的表项按插入顺序排在最前，它们的插入序号从仍在表中的最早表项往前推
+	oldest := e.table.inserted - uint64(len(e.table.entries)) - uint64(len(evicted))
+	for i, old := range evicted {
+		if e.fields[old] == oldest+uint64(i) {
+			delete(e.fields, old)
+		}
+		if e.names[old.name] == oldest+uint64(i) {
+			delete(e.names, old.name)
+		}
+	}
+	e.fields[f] = seq
+	e.names[f.name] = seq
+}
+
+// Decode 还原 Encode 的结果。返回 ErrHeaderTableDesync 时双方的动态表已不一致，调用方应断开连接
+func (d *HeaderDecoder) Decode(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty header block")
+	}
+	if data[0] == headerBlockRaw {
+		return data[1:], nil
+	}
+	if data[0] != headerBlockCoded {
+		return nil, fmt.Errorf("unknown header block type %d", data[0])
+	}
+	r := &blockReader{data: data[1:]}
+	inserted := r.uvarint()
+	if r.err == nil && inserted != d.table.inserted {
+		return nil, fmt.Errorf("%w: encoder inserted %d entries, decoder %d", ErrHeaderTableDesync, inserted, d.table.inserted)
+	}
+	line := r.string()
+	count := r.uvarint()
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) * 2)
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		f, err := d.decodeField(r)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(f.name)
+		buf.WriteString(": ")
+		buf.WriteString(f.value)
+		buf.WriteString("\r\n")
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	buf.WriteString("\r\n")
+	buf.Write(r.data)
+	return buf.Bytes(), nil
+}
+
+func (d *HeaderDecoder) decodeField(r *blockReader) (headerField, error) {
+	op := r.byte()
+	var f headerField
+	switch op {
+	case fieldIndexed, fieldIndexedNameInsert, fieldIndexedNameNoInsert:
+		index := r.uvarint()
+		if r.err != nil {
+			return f, r.err
+		}
+		entry, ok := d.table.field(index)
+		if !ok {
+			return f, fmt.Errorf("%w: index %d beyond %d entries", ErrHeaderTableDesync, index, len(headerStaticTable)+len(d.table.entries))
+		}
+		f.name = entry.name
+		if op == fieldIndexed {
+			return entry, nil
+		}
+	case fieldLiteralInsert, fieldLiteralNoInsert:
+		f.name = r.string()
+	default:
+		if r.err == nil {
+			return f, fmt.Errorf("unknown header field encoding %d", op)
+		}
+	}
+	f.value = r.string()
+	if r.err != nil {
+		return f, r.err
+	}
+	if op == fieldIndexedNameInsert || op == fieldLiteralInsert {
+		d.table.add(f)
+	}
+	return f, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// blockReader 顺序读取编码的头部，遇到截断后 err 非空且后续读取都返回零值
+type blockReader struct {
+	data []byte
+	err  error
+}
+
+var errHeaderBlockTruncated = errors.New("truncated header block")
+
+func (r *blockReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = errHeaderBlockTruncated
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *blockReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errHeaderBlockTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *blockReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.data)) {
+		r.err = errHeaderBlockTruncated
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
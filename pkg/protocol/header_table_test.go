@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func browserRequest(path, cookie string) []byte {
+	req := httptest.NewRequest("GET", "http://app.example.com"+path, nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en;q=0.8")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36")
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	data, _ := SerializeHTTPRequest(req)
+	return data
+}
+
+func TestHeaderTableRoundTrip(t *testing.T) {
+	enc := NewHeaderEncoder(4096)
+	dec := NewHeaderDecoder(4096)
+
+	post := httptest.NewRequest("POST", "http://app.example.com/api/items?x=1", strings.NewReader(`{"name":"a"}`))
+	post.Header.Set("Content-Type", "application/json")
+	post.Header.Add("X-Multi", "one")
+	post.Header.Add("X-Multi", "two")
+	post.Header.Set("X-Empty", "")
+	postData, _ := SerializeHTTPRequest(post)
+
+	payloads := [][]byte{
+		browserRequest("/", "session=abc"),
+		browserRequest("/app.js", "session=abc"),
+		postData,
+		browserRequest("/style.css", "session=def"),
+		[]byte("not an http request"),
+		SerializeHTTPRequestHead(httptest.NewRequest("GET", "/", nil)),
+	}
+	var sizes []int
+	for i, payload := range payloads {
+		encoded := enc.Encode(payload)
+		if len(encoded) > len(payload)+HeaderTableOverhead {
+			t.Errorf("Payload %d grew from %d to %d bytes", i, len(payload), len(encoded))
+		}
+		decoded, err := dec.Decode(encoded)
+		if err != nil {
+			t.Fatalf("Payload %d: decode failed: %v", i, err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Fatalf("Payload %d: round trip mismatch\n got %q\nwant %q", i, decoded, payload)
+		}
+		sizes = append(sizes, len(encoded))
+	}
+
+	// 第二次请求只有路径不同，头部全部引用表项
+	if sizes[1] > len(payloads[1])/3 {
+		t.Errorf("Expected repeated headers to be indexed, got %d of %d bytes", sizes[1], len(payloads[1]))
+	}
+	// 凭据不进入动态表
+	for _, f := range enc.table.entries {
+		if f.name == "Authorization" {
+			t.Errorf("Expected Authorization never to be indexed, got %+v", f)
+		}
+	}
+	if enc.table.inserted != dec.table.inserted || len(enc.table.entries) != len(dec.table.entries) {
+		t.Errorf("Expected tables in sync, encoder %d/%d decoder %d/%d",
+			enc.table.inserted, len(enc.table.entries), dec.table.inserted, len(dec.table.entries))
+	}
+
+	req, err := ParseHTTPRequest(mustDecode(t, dec, enc.Encode(postData)), HeaderLimits{})
+	if err != nil || req.Header.Get("Content-Type") != "application/json" || len(req.Header["X-Multi"]) != 2 {
+		t.Errorf("Expected the decoded request to parse, got %v %v", req, err)
+	}
+}
+
+func mustDecode(t *testing.T, dec *HeaderDecoder, data []byte) []byte {
+	t.Helper()
+	decoded, err := dec.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestHeaderTableEviction(t *testing.T) {
+	const size = 512
+	enc := NewHeaderEncoder(size)
+	dec := NewHeaderDecoder(size)
+	for i := 0; i < 200; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		// 每次一个新值，同时重复最近的几个值
+		for j := max(0, i-3); j <= i; j++ {
+			req.Header.Add(fmt.Sprintf("X-Trace-%d", j%7), fmt.Sprintf("value-%d", j))
+		}
+		payload := SerializeHTTPRequestHead(req)
+		if got := mustDecode(t, dec, enc.Encode(payload)); !bytes.Equal(got, payload) {
+			t.Fatalf("Request %d: round trip mismatch\n got %q\nwant %q", i, got, payload)
+		}
+		if enc.table.size > size {
+			t.Fatalf("Request %d: table size %d exceeds %d", i, enc.table.size, size)
+		}
+	}
+	// 编码器的查找索引只指向仍在表中的表项
+	if len(enc.fields) != len(enc.table.entries) {
+		t.Errorf("Expected %d indexed fields, got %d", len(enc.table.entries), len(enc.fields))
+	}
+}
+
+func TestHeaderTableLargeValue(t *testing.T) {
+	enc := NewHeaderEncoder(256)
+	dec := NewHeaderDecoder(256)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Large", strings.Repeat("v", 20000))
+	payload := SerializeHTTPRequestHead(req)
+	for i := 0; i < 2; i++ {
+		encoded := enc.Encode(payload)
+		if got := mustDecode(t, dec, encoded); !bytes.Equal(got, payload) {
+			t.Fatal("Expected the large header to round trip")
+		}
+		if len(enc.table.entries) != 0 {
+			t.Errorf("Expected an entry larger than the table not to be inserted, got %d entries", len(enc.table.entries))
+		}
+	}
+}
+
+func TestHeaderTableDesync(t *testing.T) {
+	enc := NewHeaderEncoder(4096)
+	dec := NewHeaderDecoder(4096)
+	// 第一条消息丢失 (如签名校验失败被丢弃)，解码器没有插入对应表项
+	enc.Encode(browserRequest("/", "session=abc"))
+	_, err := dec.Decode(enc.Encode(browserRequest("/next", "session=abc")))
+	if !errors.Is(err, ErrHeaderTableDesync) {
+		t.Errorf("Expected ErrHeaderTableDesync, got %v", err)
+	}
+
+	// 截断的消息返回错误而不是越界
+	encoded := NewHeaderEncoder(4096).Encode(browserRequest("/", "session=abc"))
+	for n := 1; n < 40; n++ {
+		if _, err := NewHeaderDecoder(4096).Decode(encoded[:n]); err == nil {
+			t.Fatalf("Expected an error for %d truncated bytes", n)
+		}
+	}
+}
+
+func TestNegotiateHeaderTableSize(t *testing.T) {
+	tests := []struct {
+		local int
+		peer  string
+		want  int
+	}{
+		{0, "65536", 0},
+		{16384, "", 0},
+		{16384, "abc", 0},
+		{16384, "65536", 16384},
+		{16384, "4096", 4096},
+		{1 << 20, "1048576", MaxHeaderTableSize},
+	}
+	for _, tt := range tests {
+		if got := NegotiateHeaderTableSize(tt.local, tt.peer); got != tt.want {
+			t.Errorf("NegotiateHeaderTableSize(%d, %q) = %d, want %d", tt.local, tt.peer, got, tt.want)
+		}
+	}
+}
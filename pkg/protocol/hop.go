@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// HeaderHop 记录请求经过的 singleproxy 实例。服务器转发公网请求、客户端转发到目标服务之前各追加自己的实例ID，
+// 请求再次到达同一个实例或经过的实例过多时说明路由形成了环路
+const HeaderHop = "X-SingleProxy-Hop"
+
+// MaxHops 一个请求最多经过的实例数，超过时按环路拒绝。
+// 用于发现经过多个服务器和客户端、每个实例只经过一次的环路
+const MaxHops = 8
+
+// NewInstanceID 生成一个实例ID，服务器和客户端在创建时各生成一次，在进程运行期间不变
+func NewInstanceID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Hops 返回请求已经过的实例ID，按经过的顺序
+func Hops(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values(HeaderHop) {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				hops = append(hops, id)
+			}
+		}
+	}
+	return hops
+}
+
+// LoopDetected 判断请求是否已经过实例 id，或经过的实例数已达到 MaxHops
+func LoopDetected(hops []string, id string) bool {
+	if len(hops) >= MaxHops {
+		return true
+	}
+	for _, hop := range hops {
+		if hop == id {
+			return true
+		}
+	}
+	return false
+}
+
+// AddHop 在请求头中追加实例ID，合并为一个字段
+func AddHop(h http.Header, id string) {
+	h.Set(HeaderHop, strings.Join(append(Hops(h), id), ", "))
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestHops(t *testing.T) {
+	h := http.Header{}
+	h.Add(HeaderHop, "a, b")
+	h.Add(HeaderHop, " c ,")
+	AddHop(h, "d")
+	if got := h.Values(HeaderHop); len(got) != 1 || got[0] != "a, b, c, d" {
+		t.Errorf("Expected hops merged into one field, got %q", got)
+	}
+
+	hops := Hops(h)
+	if LoopDetected(hops, "e") {
+		t.Errorf("Expected no loop for a new instance, hops %q", hops)
+	}
+	if !LoopDetected(hops, "b") {
+		t.Errorf("Expected a loop when the instance already appears in %q", hops)
+	}
+
+	h = http.Header{}
+	for i := 0; i < MaxHops; i++ {
+		AddHop(h, strconv.Itoa(i))
+	}
+	if !LoopDetected(Hops(h), "new") {
+		t.Errorf("Expected a loop after %d hops", MaxHops)
+	}
+
+	if a, b := NewInstanceID(), NewInstanceID(); a == b || len(a) != 16 {
+		t.Errorf("Expected distinct 16 character instance IDs, got %q and %q", a, b)
+	}
+}
@@ -7,26 +7,21 @@ import (
 	"io"
 	"net/http"
 	"singleproxy/pkg/logger"
+	"singleproxy/pkg/utils"
 )
 
 // SerializeHTTPRequest 序列化HTTP请求
 func SerializeHTTPRequest(r *http.Request) ([]byte, error) {
 	logger := logger.WithFields(map[string]interface{}{
 		"method":         r.Method,
-		"url":            r.URL.String(),
+		"url":            utils.SanitizeURL(r.URL),
 		"content_length": r.ContentLength,
 	})
 
 	logger.Debug("Starting HTTP request serialization")
 
 	var buf bytes.Buffer
-	// 重建请求行
-	reqURL := *r.URL
-	reqURL.Scheme = "http"
-	reqURL.Host = r.Host
-	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", r.Method, reqURL.RequestURI())
-	_ = r.Header.Write(&buf)
-	buf.WriteString("\r\n")
+	writeRequestHead(&buf, r)
 
 	headerSize := buf.Len()
 
@@ -50,8 +45,25 @@ func SerializeHTTPRequest(r *http.Request) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// ParseHTTPRequest 解析HTTP请求
-func ParseHTTPRequest(data []byte) (*http.Request, error) {
+// SerializeHTTPRequestHead 只序列化请求行和头部，请求体由调用方另行传输
+func SerializeHTTPRequestHead(r *http.Request) []byte {
+	var buf bytes.Buffer
+	writeRequestHead(&buf, r)
+	return buf.Bytes()
+}
+
+// writeRequestHead 重建请求行并写入头部
+func writeRequestHead(buf *bytes.Buffer, r *http.Request) {
+	reqURL := *r.URL
+	reqURL.Scheme = "http"
+	reqURL.Host = r.Host
+	fmt.Fprintf(buf, "%s %s HTTP/1.1\r\n", r.Method, reqURL.RequestURI())
+	_ = r.Header.Write(buf)
+	buf.WriteString("\r\n")
+}
+
+// ParseHTTPRequest 解析HTTP请求，头部超出 limits 时返回 *HeaderLimitError
+func ParseHTTPRequest(data []byte, limits HeaderLimits) (*http.Request, error) {
 	logger.Debug("Starting HTTP request parsing",
 		"data_size", len(data))
 
@@ -63,10 +75,18 @@ func ParseHTTPRequest(data []byte) (*http.Request, error) {
 			"error", err)
 		return nil, err
 	}
+	if err := limits.Check(req.Header); err != nil {
+		logger.Warn("Rejected HTTP request exceeding header limits",
+			"method", req.Method,
+			"url", utils.SanitizeURL(req.URL),
+			"header_count", len(req.Header),
+			"error", err)
+		return nil, err
+	}
 
 	logger.Debug("HTTP request parsing completed",
 		"method", req.Method,
-		"url", req.URL.String(),
+		"url", utils.SanitizeURL(req.URL),
 		"proto", req.Proto,
 		"content_length", req.ContentLength,
 		"header_count", len(req.Header))
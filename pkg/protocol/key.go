@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultKeyPattern 是隧道key的默认语法: 1-64 个字母、数字、点、下划线或连字符
+const DefaultKeyPattern = `^[a-zA-Z0-9._-]{1,64}$`
+
+var defaultKeyRegexp = regexp.MustCompile(DefaultKeyPattern)
+
+// KeyValidator 校验隧道key的语法
+type KeyValidator struct {
+	pattern *regexp.Regexp
+}
+
+// NewKeyValidator 创建key校验器，pattern 为空时使用 DefaultKeyPattern
+func NewKeyValidator(pattern string) (*KeyValidator, error) {
+	if pattern == "" {
+		return &KeyValidator{pattern: defaultKeyRegexp}, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pattern %q: %v", pattern, err)
+	}
+	return &KeyValidator{pattern: re}, nil
+}
+
+// Validate 检查key是否合法。无论 pattern 如何配置，路径分隔符和
+// 仅由点组成的key都会被拒绝，因为key会被用作目录名
+func (v *KeyValidator) Validate(key string) error {
+	if key == "" {
+		return fmt.Errorf("tunnel key cannot be empty")
+	}
+	if strings.ContainsAny(key, "/\\\x00") {
+		return fmt.Errorf("tunnel key must not contain path separators")
+	}
+	if strings.Trim(key, ".") == "" {
+		return fmt.Errorf("tunnel key must not consist only of dots")
+	}
+	if !v.pattern.MatchString(key) {
+		return fmt.Errorf("tunnel key does not match %s", v.pattern.String())
+	}
+	return nil
+}
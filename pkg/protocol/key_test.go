@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyValidatorDefault(t *testing.T) {
+	v, err := NewKeyValidator("")
+	if err != nil {
+		t.Fatalf("NewKeyValidator failed: %v", err)
+	}
+
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"default", true},
+		{"my-service_01.v2", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../etc", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a%2Fb", false},
+		{"服务", false},
+		{"key with space", false},
+	}
+
+	for _, tt := range tests {
+		err := v.Validate(tt.key)
+		if tt.valid && err != nil {
+			t.Errorf("Validate(%q) unexpected error: %v", tt.key, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Validate(%q) expected error", tt.key)
+		}
+	}
+}
+
+func TestKeyValidatorCustomPattern(t *testing.T) {
+	v, err := NewKeyValidator(`^.{1,128}$`)
+	if err != nil {
+		t.Fatalf("NewKeyValidator failed: %v", err)
+	}
+	if err := v.Validate("legacy key:服务"); err != nil {
+		t.Errorf("Expected custom pattern to accept unusual key: %v", err)
+	}
+	// 路径分隔符和纯点key始终被拒绝
+	for _, key := range []string{"a/b", "...", "a\\b"} {
+		if err := v.Validate(key); err == nil {
+			t.Errorf("Validate(%q) expected error with custom pattern", key)
+		}
+	}
+
+	if _, err := NewKeyValidator("("); err == nil {
+		t.Errorf("Expected error for invalid pattern")
+	}
+}
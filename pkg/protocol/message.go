@@ -4,19 +4,93 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"strconv"
 )
 
-// 消息类型常量
+// MessageType 隧道消息类型，一经发布不得更改取值。新增类型须由客户端在 HeaderFeatures 中声明支持，
+// 并在 testdata/v1 的兼容性测试中覆盖
+type MessageType uint8
+
+// 消息类型常量，1-3 为最初版本 (v1) 的消息，其余类型只在协商后使用或由旧客户端按未知消息忽略
+const (
+	MSG_TYPE_HTTP_REQ         MessageType = 1  // 服务器 -> 客户端: 序列化的公网请求
+	MSG_TYPE_HTTP_RES         MessageType = 2  // 客户端 -> 服务器: 响应状态行和头部
+	MSG_TYPE_HTTP_RES_CHUNK   MessageType = 3  // 客户端 -> 服务器: 响应体数据块，空负载表示结束 (FeatureChunkSeq 时见 ResponseChunk)
+	MSG_TYPE_BIND_REQ         MessageType = 4  // 客户端 -> 服务器: 申请公网绑定
+	MSG_TYPE_BIND_RES         MessageType = 5  // 服务器 -> 客户端: 绑定申请结果
+	MSG_TYPE_HTTP_RES_FULL    MessageType = 6  // 客户端 -> 服务器: 包含响应头和完整响应体的小响应
+	MSG_TYPE_TARGET_HEALTH    MessageType = 7  // 客户端 -> 服务器: 目标服务健康状态变化 (负载为 TargetHealthUp 或 TargetHealthDown)
+	MSG_TYPE_HTTP_RES_INTERIM MessageType = 8  // 客户端 -> 服务器: 最终响应之前的 1xx 临时响应 (如 103 Early Hints)，只有状态行和头部
+	MSG_TYPE_CANCEL           MessageType = 9  // 服务器 -> 客户端: 公网请求已中止 (负载为 CancelReason* 之一)，只发给声明支持 FeatureCancel 的客户端；ID 为本地请求ID时双向使用，见 FeatureLocalForward；客户端 -> 服务器: 响应体未读完就失败 (负载为 TargetErr*)，见 FeatureResponseAbort
+	MSG_TYPE_TARGET_CHECK     MessageType = 10 // 服务器 -> 客户端: 检查能否访问目标服务 (JSON TargetCheckRequest)，只发给声明支持 FeatureTargetCheck 的客户端
+	MSG_TYPE_TARGET_CHECK_RES MessageType = 11 // 客户端 -> 服务器: 目标服务检查结果 (JSON TargetCheckResult)
+	MSG_TYPE_GOAWAY           MessageType = 12 // 服务器 -> 客户端: 完成进行中的请求后断开并重连 (JSON GoAway)，只发给声明支持 FeatureGoAway 的客户端
+	MSG_TYPE_LOCAL_REQ        MessageType = 13 // 客户端 -> 服务器: 客户端本地监听收到的请求 (格式同 MSG_TYPE_HTTP_REQ，ID 带 LocalRequestIDFlag)，服务器确认 FeatureLocalForward 后才发送
+	MSG_TYPE_LOCAL_RES        MessageType = 14 // 服务器 -> 客户端: 本地请求的响应状态行和头部
+	MSG_TYPE_LOCAL_RES_CHUNK  MessageType = 15 // 服务器 -> 客户端: 本地请求的响应体数据块，空负载表示结束
+)
+
+// messageTypeNames 消息类型在日志中显示的名称
+var messageTypeNames = map[MessageType]string{
+	MSG_TYPE_HTTP_REQ:         "http_req",
+	MSG_TYPE_HTTP_RES:         "http_res",
+	MSG_TYPE_HTTP_RES_CHUNK:   "http_res_chunk",
+	MSG_TYPE_BIND_REQ:         "bind_req",
+	MSG_TYPE_BIND_RES:         "bind_res",
+	MSG_TYPE_HTTP_RES_FULL:    "http_res_full",
+	MSG_TYPE_TARGET_HEALTH:    "target_health",
+	MSG_TYPE_HTTP_RES_INTERIM: "http_res_interim",
+	MSG_TYPE_CANCEL:           "cancel",
+	MSG_TYPE_TARGET_CHECK:     "target_check",
+	MSG_TYPE_TARGET_CHECK_RES: "target_check_res",
+	MSG_TYPE_GOAWAY:           "goaway",
+	MSG_TYPE_LOCAL_REQ:        "local_req",
+	MSG_TYPE_LOCAL_RES:        "local_res",
+	MSG_TYPE_LOCAL_RES_CHUNK:  "local_res_chunk",
+}
+
+// String 返回消息类型的名称，未知类型显示为 unknown(<值>)
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "unknown(" + strconv.Itoa(int(t)) + ")"
+}
+
+// MessageHeaderSize 消息头部长度: 8字节大端请求ID | 1字节消息类型，其后为负载
+const MessageHeaderSize = 9
+
+// MSG_TYPE_CANCEL 的负载: 中止原因
+const (
+	CancelReasonClientDisconnect = "client_disconnect" // 公网用户断开连接
+	CancelReasonTimeout          = "timeout"           // 等待响应超时
+	CancelReasonServerShutdown   = "server_shutdown"   // 服务器正在关闭
+	CancelReasonFrameTooLarge    = "frame_too_large"   // 响应消息超过协商的大小上限，响应已无法完整送达
+	CancelReasonResponseAborted  = "response_aborted"  // 本地请求的响应中途失败，已发出的部分不完整 (服务器 -> 客户端)
+)
+
+// LocalRequestIDFlag 客户端发起的本地请求ID的最高位。服务器分配的请求ID从1递增，不会设置该位，
+// 两个方向的请求在同一连接上共用ID空间也不会冲突
+const LocalRequestIDFlag uint64 = 1 << 63
+
+// IsLocalRequestID 判断ID是否属于客户端发起的本地请求
+func IsLocalRequestID(id uint64) bool {
+	return id&LocalRequestIDFlag != 0
+}
+
+// MSG_TYPE_TARGET_HEALTH 的负载
 const (
-	MSG_TYPE_HTTP_REQ       = 1
-	MSG_TYPE_HTTP_RES       = 2
-	MSG_TYPE_HTTP_RES_CHUNK = 3
+	TargetHealthUp   = "up"
+	TargetHealthDown = "down"
 )
 
+// DefaultMaxUnknownMessages 是单个连接默认允许的未知类型消息数，超出后视为协议不兼容并断开
+const DefaultMaxUnknownMessages = 10
+
 // TunnelMessage 定义了隧道中传输的消息格式
 type TunnelMessage struct {
 	ID      uint64
-	Type    uint8
+	Type    MessageType
 	Payload []byte
 }
 
@@ -26,7 +100,7 @@ func SerializeTunnelMessage(msg TunnelMessage) ([]byte, error) {
 	if err := binary.Write(buf, binary.BigEndian, msg.ID); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(buf, binary.BigEndian, msg.Type); err != nil {
+	if err := buf.WriteByte(byte(msg.Type)); err != nil {
 		return nil, err
 	}
 	if _, err := buf.Write(msg.Payload); err != nil {
@@ -35,15 +109,27 @@ func SerializeTunnelMessage(msg TunnelMessage) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// DeserializeTunnelMessage 反序列化隧道消息
+// DeserializeTunnelMessage 反序列化隧道消息。Payload 是 data 的副本，归返回的消息所有，
+// 可以交给其他协程处理，调用方随后复用 data 不会影响它
 func DeserializeTunnelMessage(data []byte) (TunnelMessage, error) {
-	if len(data) < 9 { // 8 bytes ID + 1 byte Type
+	msg, err := DeserializeTunnelMessageNoCopy(data)
+	if err != nil {
+		return msg, err
+	}
+	msg.Payload = bytes.Clone(msg.Payload)
+	return msg, nil
+}
+
+// DeserializeTunnelMessageNoCopy 与 DeserializeTunnelMessage 相同，但 Payload 与 data 共用内存。
+// 只在 data 之后不会被修改时使用，例如 websocket.Conn.ReadMessage 每次返回新分配的切片
+func DeserializeTunnelMessageNoCopy(data []byte) (TunnelMessage, error) {
+	if len(data) < MessageHeaderSize {
 		return TunnelMessage{}, errors.New("message too short")
 	}
 	msg := TunnelMessage{
 		ID:   binary.BigEndian.Uint64(data[:8]),
-		Type: data[8],
+		Type: MessageType(data[8]),
 	}
-	msg.Payload = data[9:]
+	msg.Payload = data[MessageHeaderSize:]
 	return msg, nil
-}
\ No newline at end of file
+}
@@ -65,6 +65,32 @@ func TestDeserializeTunnelMessageTooShort(t *testing.T) {
 	}
 }
 
+func TestDeserializeTunnelMessagePayloadOwnership(t *testing.T) {
+	data, err := SerializeTunnelMessage(TunnelMessage{ID: 7, Type: MSG_TYPE_HTTP_REQ, Payload: []byte("request-7")})
+	if err != nil {
+		t.Fatalf("Serialize failed: %v", err)
+	}
+
+	owned, err := DeserializeTunnelMessage(data)
+	if err != nil {
+		t.Fatalf("Deserialize failed: %v", err)
+	}
+	aliased, err := DeserializeTunnelMessageNoCopy(data)
+	if err != nil {
+		t.Fatalf("Deserialize without copy failed: %v", err)
+	}
+
+	// 模拟读取缓冲区被下一帧复用
+	copy(data[MessageHeaderSize:], "overwrite")
+
+	if string(owned.Payload) != "request-7" {
+		t.Errorf("Expected the copied payload to survive buffer reuse, got %q", owned.Payload)
+	}
+	if string(aliased.Payload) != "overwrite" {
+		t.Errorf("Expected the no-copy payload to alias the buffer, got %q", aliased.Payload)
+	}
+}
+
 func TestMessageTypes(t *testing.T) {
 	// 验证消息类型常量
 	if MSG_TYPE_HTTP_REQ != 1 {
@@ -0,0 +1,15 @@
+package protocol
+
+import "strings"
+
+// 客户端在服务器地址的路径后拼接的隧道入口，服务器的 -ws-path-prefix 需与之对应
+const (
+	WebSocketPathSegment  = "ws"
+	HTTPTunnelPathSegment = "http-tunnel"
+)
+
+// JoinTunnelPath 在服务器地址的路径后拼接隧道入口路径，base 末尾的斜杠会被去掉，
+// 例如 ("/tunnel/", "ws", "app") 得到 /tunnel/ws/app
+func JoinTunnelPath(base string, segments ...string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,22 @@
+package protocol
+
+import "testing"
+
+func TestJoinTunnelPath(t *testing.T) {
+	for _, tt := range []struct {
+		base, want string
+	}{
+		{"", "/ws/app"},
+		{"/", "/ws/app"},
+		{"/tunnel", "/tunnel/ws/app"},
+		{"/tunnel/", "/tunnel/ws/app"},
+		{"/a/b/tunnel//", "/a/b/tunnel/ws/app"},
+	} {
+		if got := JoinTunnelPath(tt.base, WebSocketPathSegment, "app"); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.base, tt.want, got)
+		}
+	}
+	if got := JoinTunnelPath("https://example.com/tunnel/", HTTPTunnelPathSegment, "poll", "app"); got != "https://example.com/tunnel/http-tunnel/poll/app" {
+		t.Errorf("Unexpected long-poll URL %q", got)
+	}
+}
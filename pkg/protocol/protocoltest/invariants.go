@@ -0,0 +1,114 @@
+// Package protocoltest 以代码的形式记录隧道响应消息的顺序约定，供测试检查客户端发出的消息流。
+//
+// 多个请求的响应在同一条WebSocket连接上交错发送，服务器只按消息ID区分。单个请求的消息必须满足:
+//
+//  1. 最终响应之前可以有任意条 MSG_TYPE_HTTP_RES_INTERIM，最终响应之后不能再有
+//  2. 最终响应是一条 MSG_TYPE_HTTP_RES (之后是响应体数据块) 或一条 MSG_TYPE_HTTP_RES_FULL，恰好一次
+//  3. MSG_TYPE_HTTP_RES_CHUNK 只能在 MSG_TYPE_HTTP_RES 之后
+//  4. 启用 FeatureChunkSeq 时数据块序号从0开始逐个加1，结束标记的总长度等于已发送的数据量
+//  5. 结束标记 (空数据块或设置 ChunkFlagEnd 的数据块) 恰好一次，之后该请求不再有任何消息
+//
+// 不同请求之间的消息顺序不做任何保证。
+package protocoltest
+
+import (
+	"fmt"
+
+	"singleproxy/pkg/protocol"
+)
+
+// streamState 一个请求已观察到的响应消息
+type streamState struct {
+	final   bool // 已收到 MSG_TYPE_HTTP_RES 或 MSG_TYPE_HTTP_RES_FULL
+	chunked bool // 最终响应是 MSG_TYPE_HTTP_RES
+	ended   bool
+	nextSeq uint32
+	body    []byte
+}
+
+// Checker 按到达顺序检查一条连接上的响应消息，并拼接每个请求的响应体
+type Checker struct {
+	chunkSeq bool
+	streams  map[uint64]*streamState
+}
+
+// NewChecker 创建检查器，chunkSeq 表示连接是否启用了带序号的数据块
+func NewChecker(chunkSeq bool) *Checker {
+	return &Checker{chunkSeq: chunkSeq, streams: make(map[uint64]*streamState)}
+}
+
+// Observe 检查下一条消息，违反约定时返回错误。非响应消息忽略
+func (c *Checker) Observe(msg protocol.TunnelMessage) error {
+	switch msg.Type {
+	case protocol.MSG_TYPE_HTTP_RES, protocol.MSG_TYPE_HTTP_RES_FULL, protocol.MSG_TYPE_HTTP_RES_INTERIM, protocol.MSG_TYPE_HTTP_RES_CHUNK:
+	default:
+		return nil
+	}
+	s := c.streams[msg.ID]
+	if s == nil {
+		s = &streamState{}
+		c.streams[msg.ID] = s
+	}
+	if s.ended {
+		return fmt.Errorf("request %d: %s after the response ended", msg.ID, msg.Type)
+	}
+
+	switch msg.Type {
+	case protocol.MSG_TYPE_HTTP_RES_INTERIM:
+		if s.final {
+			return fmt.Errorf("request %d: interim response after the final header", msg.ID)
+		}
+	case protocol.MSG_TYPE_HTTP_RES, protocol.MSG_TYPE_HTTP_RES_FULL:
+		if s.final {
+			return fmt.Errorf("request %d: duplicate final response (%s)", msg.ID, msg.Type)
+		}
+		s.final = true
+		s.chunked = msg.Type == protocol.MSG_TYPE_HTTP_RES
+		s.ended = !s.chunked
+	case protocol.MSG_TYPE_HTTP_RES_CHUNK:
+		if !s.chunked {
+			return fmt.Errorf("request %d: body chunk before the response header", msg.ID)
+		}
+		data, end := msg.Payload, len(msg.Payload) == 0
+		if c.chunkSeq {
+			chunk, err := protocol.DecodeResponseChunk(msg.Payload)
+			if err != nil {
+				return fmt.Errorf("request %d: %w", msg.ID, err)
+			}
+			if chunk.Seq != s.nextSeq {
+				return fmt.Errorf("request %d: chunk sequence %d, expected %d", msg.ID, chunk.Seq, s.nextSeq)
+			}
+			s.nextSeq++
+			if chunk.End && chunk.TotalLength >= 0 && chunk.TotalLength != int64(len(s.body)) {
+				return fmt.Errorf("request %d: end marker declares %d bytes, %d were sent", msg.ID, chunk.TotalLength, len(s.body))
+			}
+			data, end = chunk.Data, chunk.End
+		}
+		s.body = append(s.body, data...)
+		s.ended = end
+	}
+	return nil
+}
+
+// Finish 检查所有开始的响应都已结束
+func (c *Checker) Finish() error {
+	for id, s := range c.streams {
+		if !s.ended {
+			return fmt.Errorf("request %d: response never ended", id)
+		}
+	}
+	return nil
+}
+
+// Body 返回请求以数据块发送的响应体，MSG_TYPE_HTTP_RES_FULL 的响应体不在其中
+func (c *Checker) Body(id uint64) []byte {
+	if s := c.streams[id]; s != nil {
+		return s.body
+	}
+	return nil
+}
+
+// Requests 返回观察到的请求数
+func (c *Checker) Requests() int {
+	return len(c.streams)
+}
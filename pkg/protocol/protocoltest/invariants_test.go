@@ -0,0 +1,97 @@
+package protocoltest
+
+import (
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/protocol"
+)
+
+func header(id uint64) protocol.TunnelMessage {
+	return protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_HTTP_RES, Payload: []byte("HTTP/1.1 200 OK\r\n\r\n")}
+}
+
+func chunk(id uint64, seq uint32, data string) protocol.TunnelMessage {
+	return protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK,
+		Payload: protocol.EncodeResponseChunk(protocol.ResponseChunk{Seq: seq, Data: []byte(data)})}
+}
+
+func end(id uint64, seq uint32, total int64) protocol.TunnelMessage {
+	return protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK,
+		Payload: protocol.EncodeResponseChunk(protocol.ResponseChunk{Seq: seq, End: true, TotalLength: total})}
+}
+
+func typed(id uint64, t protocol.MessageType) protocol.TunnelMessage {
+	return protocol.TunnelMessage{ID: id, Type: t, Payload: []byte("HTTP/1.1 103 Early Hints\r\n\r\n")}
+}
+
+func TestCheckerAcceptsInterleavedStreams(t *testing.T) {
+	c := NewChecker(true)
+	for _, msg := range []protocol.TunnelMessage{
+		typed(1, protocol.MSG_TYPE_HTTP_RES_INTERIM),
+		header(2),
+		header(1),
+		chunk(2, 0, "bb"),
+		chunk(1, 0, "a"),
+		typed(3, protocol.MSG_TYPE_HTTP_RES_FULL),
+		chunk(1, 1, "aa"),
+		{ID: 9, Type: protocol.MSG_TYPE_TARGET_HEALTH},
+		end(2, 1, 2),
+		end(1, 2, -1),
+	} {
+		if err := c.Observe(msg); err != nil {
+			t.Fatalf("Unexpected violation: %v", err)
+		}
+	}
+	if err := c.Finish(); err != nil {
+		t.Fatalf("Unexpected unfinished stream: %v", err)
+	}
+	if got := string(c.Body(1)); got != "aaa" {
+		t.Errorf("Expected the assembled body %q, got %q", "aaa", got)
+	}
+	if c.Requests() != 3 {
+		t.Errorf("Expected 3 requests, got %d", c.Requests())
+	}
+}
+
+func TestCheckerRejectsViolations(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunkSeq bool
+		msgs     []protocol.TunnelMessage
+		want     string
+	}{
+		{"chunk before header", true, []protocol.TunnelMessage{chunk(1, 0, "x")}, "before the response header"},
+		{"chunk after full response", true, []protocol.TunnelMessage{typed(1, protocol.MSG_TYPE_HTTP_RES_FULL), chunk(1, 0, "x")}, "after the response ended"},
+		{"duplicate header", true, []protocol.TunnelMessage{header(1), header(1)}, "duplicate final response"},
+		{"interim after header", true, []protocol.TunnelMessage{header(1), typed(1, protocol.MSG_TYPE_HTTP_RES_INTERIM)}, "interim response after"},
+		{"sequence gap", true, []protocol.TunnelMessage{header(1), chunk(1, 0, "x"), chunk(1, 2, "y")}, "chunk sequence 2, expected 1"},
+		{"reordered chunks", true, []protocol.TunnelMessage{header(1), chunk(1, 1, "y"), chunk(1, 0, "x")}, "chunk sequence 1, expected 0"},
+		{"wrong total length", true, []protocol.TunnelMessage{header(1), chunk(1, 0, "x"), end(1, 1, 5)}, "declares 5 bytes"},
+		{"duplicate end marker", true, []protocol.TunnelMessage{header(1), end(1, 0, 0), end(1, 1, 0)}, "after the response ended"},
+		{"duplicate legacy end marker", false, []protocol.TunnelMessage{header(1),
+			{ID: 1, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK}, {ID: 1, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK}}, "after the response ended"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecker(tt.chunkSeq)
+			var err error
+			for _, msg := range tt.msgs {
+				if err = c.Observe(msg); err != nil {
+					break
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected violation %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// 没有结束标记的响应
+	c := NewChecker(false)
+	c.Observe(header(1))
+	c.Observe(protocol.TunnelMessage{ID: 1, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK, Payload: []byte("x")})
+	if err := c.Finish(); err == nil {
+		t.Error("Expected an unfinished stream to be reported")
+	}
+}
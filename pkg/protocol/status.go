@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fallbackReason 自定义状态码 (如 599) 没有标准原因短语时使用的原因短语
+const fallbackReason = "Status"
+
+// StatusLine 构造以 CRLF 结尾的 HTTP/1.1 状态行，状态码后总有一个非空的原因短语。
+// status 为 resp.Status 形式的 "599 Network Timeout"，取其中状态码之后的原因短语；
+// 为空、只有状态码 (HTTP/2 目标的自定义状态码) 或与 code 不符时使用 http.StatusText，仍为空时使用 "Status"。
+// 部分解析器会拒绝 "HTTP/1.1 599 " 这样以空格结尾的状态行
+func StatusLine(code int, status string) string {
+	reason := ""
+	if rest, ok := strings.CutPrefix(status, strconv.Itoa(code)); ok && (rest == "" || rest[0] == ' ') {
+		reason = strings.TrimSpace(rest)
+	}
+	// 原因短语不能包含换行，否则会拆出额外的头部
+	if strings.ContainsAny(reason, "\r\n") {
+		reason = ""
+	}
+	if reason == "" {
+		reason = http.StatusText(code)
+	}
+	if reason == "" {
+		reason = fallbackReason
+	}
+	return "HTTP/1.1 " + strconv.Itoa(code) + " " + reason + "\r\n"
+}
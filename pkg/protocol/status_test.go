@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStatusLine(t *testing.T) {
+	tests := []struct {
+		code   int
+		status string
+		want   string
+	}{
+		{200, "200 OK", "HTTP/1.1 200 OK\r\n"},
+		{103, "", "HTTP/1.1 103 Early Hints\r\n"},
+		{418, "418 I'm a teapot", "HTTP/1.1 418 I'm a teapot\r\n"},
+		// 目标服务自定义的原因短语保留
+		{599, "599 Network Connect Timeout", "HTTP/1.1 599 Network Connect Timeout\r\n"},
+		// HTTP/2 目标的自定义状态码只有状态码，没有原因短语
+		{599, "599 ", "HTTP/1.1 599 Status\r\n"},
+		{599, "599", "HTTP/1.1 599 Status\r\n"},
+		{599, "", "HTTP/1.1 599 Status\r\n"},
+		// 与状态码不符的 status 不使用
+		{200, "404 Not Found", "HTTP/1.1 200 OK\r\n"},
+		{599, "5990 Other", "HTTP/1.1 599 Status\r\n"},
+		{502, "502 Bad\r\nX-Injected: 1", "HTTP/1.1 502 Bad Gateway\r\n"},
+	}
+	for _, tt := range tests {
+		got := StatusLine(tt.code, tt.status)
+		if got != tt.want {
+			t.Errorf("StatusLine(%d, %q) = %q, want %q", tt.code, tt.status, got, tt.want)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(got+"Content-Length: 0\r\n\r\n")), nil)
+		if err != nil || resp.StatusCode != tt.code {
+			t.Errorf("StatusLine(%d, %q) does not parse back: %v", tt.code, tt.status, err)
+		}
+	}
+}
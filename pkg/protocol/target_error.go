@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// HeaderTargetError 客户端转发目标服务失败时，在返回给服务器的错误响应中说明原因
+const HeaderTargetError = "X-Target-Error"
+
+// 客户端转发目标服务失败的原因。服务器据此选择状态码，并作为 X-Proxy-Error 的值和指标标签
+const (
+	TargetErrConnectRefused        = "target_connect_refused"         // 目标端口没有服务监听
+	TargetErrConnectTimeout        = "target_connect_timeout"         // 连接目标或TLS握手超时
+	TargetErrConnectFailed         = "target_connect_failed"          // 其他连接错误，如DNS解析失败、网络不可达
+	TargetErrTLS                   = "target_tls_failed"              // TLS握手失败或证书无效
+	TargetErrResponseHeaderTimeout = "target_response_header_timeout" // 已连接但等待响应头超时
+	TargetErrRead                  = "target_read_failed"             // 读取目标响应失败，如连接被重置
+	TargetErrRedirectLoop          = "target_redirect_loop"           // 跟随目标服务的重定向次数超过上限
+	TargetErrFailed                = "target_failed"                  // 无法归类的转发错误
+)
+
+// targetErrorStatus 每种原因对应的状态码: 超时为 504，其余为 502
+var targetErrorStatus = map[string]int{
+	TargetErrConnectRefused:        http.StatusBadGateway,
+	TargetErrConnectTimeout:        http.StatusGatewayTimeout,
+	TargetErrConnectFailed:         http.StatusBadGateway,
+	TargetErrTLS:                   http.StatusBadGateway,
+	TargetErrResponseHeaderTimeout: http.StatusGatewayTimeout,
+	TargetErrRead:                  http.StatusBadGateway,
+	TargetErrRedirectLoop:          http.StatusBadGateway,
+	TargetErrFailed:                http.StatusBadGateway,
+}
+
+// TargetErrorStatus 返回转发失败原因对应的状态码，未知原因返回 502
+func TargetErrorStatus(kind string) int {
+	if status, ok := targetErrorStatus[kind]; ok {
+		return status
+	}
+	return http.StatusBadGateway
+}
+
+// IsTargetError 判断是否为已知的转发失败原因
+func IsTargetError(kind string) bool {
+	_, ok := targetErrorStatus[kind]
+	return ok
+}
+
+// TargetErrorResponse 构造客户端转发失败时返回给服务器的空响应，状态码与原因一致，
+// 不识别 X-Target-Error 的旧服务器也能原样返回正确的状态码
+func TargetErrorResponse(kind string) []byte {
+	status := TargetErrorStatus(kind)
+	return fmt.Appendf(nil, "%s%s: %s\r\nContent-Length: 0\r\n\r\n",
+		StatusLine(status, ""), HeaderTargetError, kind)
+}
+
+// ParseTargetError 从客户端返回的完整响应中取出转发失败原因，不是转发失败的响应或原因未知时返回空串
+func ParseTargetError(payload []byte) string {
+	if !bytes.Contains(payload, []byte(HeaderTargetError)) {
+		return ""
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), nil)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+	kind := resp.Header.Get(HeaderTargetError)
+	if !IsTargetError(kind) {
+		return ""
+	}
+	return kind
+}
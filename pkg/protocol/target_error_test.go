@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTargetErrorResponse(t *testing.T) {
+	for kind, status := range targetErrorStatus {
+		payload := TargetErrorResponse(kind)
+		if got := ParseTargetError(payload); got != kind {
+			t.Errorf("ParseTargetError(TargetErrorResponse(%q)) = %q", kind, got)
+		}
+		if TargetErrorStatus(kind) != status {
+			t.Errorf("TargetErrorStatus(%q) = %d, want %d", kind, TargetErrorStatus(kind), status)
+		}
+	}
+	if TargetErrorStatus(TargetErrConnectTimeout) != http.StatusGatewayTimeout || TargetErrorStatus(TargetErrConnectRefused) != http.StatusBadGateway {
+		t.Error("Expected timeouts to map to 504 and refused connections to 502")
+	}
+
+	// 目标服务自己返回的响应和未知原因不算转发失败
+	for _, payload := range []string{
+		"HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n",
+		"HTTP/1.1 502 Bad Gateway\r\nX-Target-Error: something_else\r\nContent-Length: 0\r\n\r\n",
+		"not a response",
+	} {
+		if got := ParseTargetError([]byte(payload)); got != "" {
+			t.Errorf("Expected no target error for %q, got %q", payload, got)
+		}
+	}
+}
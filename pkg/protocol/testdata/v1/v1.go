@@ -0,0 +1,51 @@
+// Package v1 是最初版本隧道协议编码的冻结副本，代表已经部署、不声明任何 Feature 的客户端。
+// 兼容性测试用它与当前的服务器和解码器交互，以保证旧客户端继续可用。
+//
+// 不要修改本文件: 协议变更应当在兼容性测试中增加用例，而不是让这里的编码跟着变
+package v1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// v1 的全部消息类型
+const (
+	TypeHTTPReq      = 1
+	TypeHTTPRes      = 2
+	TypeHTTPResChunk = 3
+)
+
+// Encode 编码一条消息: 8字节大端ID | 1字节类型 | 负载
+func Encode(id uint64, msgType uint8, payload []byte) []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.BigEndian, id)
+	_ = binary.Write(buf, binary.BigEndian, msgType)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// Decode 解码一条消息
+func Decode(data []byte) (id uint64, msgType uint8, payload []byte, err error) {
+	if len(data) < 9 {
+		return 0, 0, nil, errors.New("message too short")
+	}
+	return binary.BigEndian.Uint64(data[:8]), data[8], data[9:], nil
+}
+
+// EncodeResponseHead 编码响应头消息的负载: 状态行和头部，不含响应体
+func EncodeResponseHead(status string, header http.Header) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "HTTP/1.1 %s\r\n", status)
+	_ = header.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// EncodeEnd 编码响应结束标记: 空的数据块
+func EncodeEnd(id uint64) []byte {
+	return Encode(id, TypeHTTPResChunk, nil)
+}
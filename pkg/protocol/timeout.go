@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderRequestTimeout 公网请求声明自己愿意等待的时间，服务器限制范围后随请求转发给客户端
+const HeaderRequestTimeout = "X-Request-Timeout"
+
+// ParseRequestTimeout 解析 X-Request-Timeout 的值，接受秒数 (可带小数, 如 "2.5") 或 Go 时长 (如 "1500ms")
+func ParseRequestTimeout(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+		// 超出范围的秒数按无效处理，避免转换溢出
+		if seconds <= 0 || seconds > float64(365*24*time.Hour/time.Second) {
+			return 0, false
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	} else if parsed, err := time.ParseDuration(v); err == nil {
+		d = parsed
+	}
+	if d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// FormatRequestTimeout 按秒格式化超时，作为转发给客户端的 X-Request-Timeout 值
+func FormatRequestTimeout(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
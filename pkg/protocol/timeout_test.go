@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRequestTimeout(t *testing.T) {
+	valid := map[string]time.Duration{
+		"5":      5 * time.Second,
+		"2.5":    2500 * time.Millisecond,
+		" 10 ":   10 * time.Second,
+		"1500ms": 1500 * time.Millisecond,
+		"1m":     time.Minute,
+	}
+	for v, want := range valid {
+		if d, ok := ParseRequestTimeout(v); !ok || d != want {
+			t.Errorf("ParseRequestTimeout(%q) = %v %v, want %v", v, d, ok, want)
+		}
+	}
+
+	for _, v := range []string{"", "0", "-1", "abc", "-5s", "1e300"} {
+		if d, ok := ParseRequestTimeout(v); ok {
+			t.Errorf("Expected %q to be rejected, got %v", v, d)
+		}
+	}
+
+	if d, _ := ParseRequestTimeout(FormatRequestTimeout(2500 * time.Millisecond)); d != 2500*time.Millisecond {
+		t.Errorf("Expected formatted timeout to round-trip, got %v", d)
+	}
+}
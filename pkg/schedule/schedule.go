@@ -0,0 +1,239 @@
+// Package schedule 解析按星期和时段描述的开放时间，例如 "Mon-Fri 09:00-18:00"。
+// 时段按指定时区的墙上时间计算，夏令时切换当天按该时区实际的时刻开放和关闭
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // 没有系统时区数据库的环境 (Windows、精简容器) 也能加载时区
+)
+
+// maxLookahead 查找下一次开放或关闭时间的最大天数，超过时视为不会再变化
+const maxLookahead = 8
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// window 一个开放时段: 在 days 中的日期从 start 开放到 end (距零点的分钟数)。
+// end 不大于 start 时跨过午夜，在次日的 end 关闭
+type window struct {
+	days       [7]bool
+	start, end int
+	spec       string
+}
+
+// Schedule 一组开放时段，任一时段内为开放
+type Schedule struct {
+	loc     *time.Location
+	windows []window
+}
+
+// Parse 解析开放时段，timezone 为 IANA 时区名 (为空使用服务器本地时区)。每个时段的格式为
+// "[星期] HH:MM-HH:MM"，星期可写 "Mon-Fri"、"Sat,Sun"、"Fri-Mon"、"*" 或 "daily"，省略时为每天；
+// 结束时间可写 24:00，早于开始时间时跨过午夜
+func Parse(windows []string, timezone string) (*Schedule, error) {
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("未知的时区 %q", timezone)
+		}
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("至少需要一个开放时段")
+	}
+	s := &Schedule{loc: loc}
+	for _, spec := range windows {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("开放时段 %q 不合法: %v", spec, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+func parseWindow(spec string) (window, error) {
+	w := window{spec: spec}
+	fields := strings.Fields(spec)
+	var days, hours string
+	switch len(fields) {
+	case 1:
+		days, hours = "*", fields[0]
+	case 2:
+		days, hours = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("格式应为 \"[星期] HH:MM-HH:MM\"")
+	}
+
+	if days == "*" || strings.EqualFold(days, "daily") {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(days, ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first, ok := dayNames[strings.ToLower(from)]
+			if !ok {
+				return w, fmt.Errorf("未知的星期 %q", from)
+			}
+			last := first
+			if isRange {
+				if last, ok = dayNames[strings.ToLower(to)]; !ok {
+					return w, fmt.Errorf("未知的星期 %q", to)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return w, fmt.Errorf("时间段应为 HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parseClock(from, false); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(to, true); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("开始和结束时间相同")
+	}
+	return w, nil
+}
+
+// parseClock 解析 HH:MM，返回距零点的分钟数。allowEndOfDay 时接受 24:00
+func parseClock(s string, allowEndOfDay bool) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || len(m) != 2 || minute < 0 || minute > 59 || hour < 0 {
+		return 0, fmt.Errorf("时间 %q 应为 HH:MM", s)
+	}
+	if hour == 24 && minute == 0 && allowEndOfDay {
+		return 24 * 60, nil
+	}
+	if hour > 23 {
+		return 0, fmt.Errorf("时间 %q 超出范围", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// Location 返回计算时段使用的时区
+func (s *Schedule) Location() *time.Location {
+	return s.loc
+}
+
+// interval 返回时段在 day 当天 (该时区的日期) 开放的绝对时间区间，当天不开放时返回 false。
+// 夏令时开始时跳过的时刻顺延，结束时重复的时刻取第一次
+func (w *window) interval(year int, month time.Month, day int, loc *time.Location) (time.Time, time.Time, bool) {
+	if !w.days[time.Date(year, month, day, 12, 0, 0, 0, loc).Weekday()] {
+		return time.Time{}, time.Time{}, false
+	}
+	start := wallTime(year, month, day, w.start, loc)
+	endDay := day
+	if w.end <= w.start {
+		endDay++
+	}
+	end := wallTime(year, month, endDay, w.end, loc)
+	return start, end, true
+}
+
+// wallTime 返回 loc 中某天零点后 minutes 分钟的墙上时间。夏令时开始时不存在的时刻
+// time.Date 可能换算到跳变之前，这里按跳过的时长顺延，e.g. 02:30 记为 03:30
+func wallTime(year int, month time.Month, day, minutes int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, 0, minutes, 0, 0, loc)
+	want := time.Date(year, month, day, 0, minutes, 0, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	if skipped := want.Sub(got); skipped > 0 {
+		t = t.Add(skipped)
+	}
+	return t
+}
+
+// Open 判断 t 是否在任一开放时段内
+func (s *Schedule) Open(t time.Time) bool {
+	local := t.In(s.loc)
+	year, month, day := local.Date()
+	// 前一天开始的跨午夜时段可能仍在开放
+	for _, d := range []int{day - 1, day} {
+		for i := range s.windows {
+			start, end, ok := s.windows[i].interval(year, month, d, s.loc)
+			if ok && !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NextOpen 返回 t 之后最近一次开放的时间，t 时已开放时返回 t。一周内都不开放时返回 false
+func (s *Schedule) NextOpen(t time.Time) (time.Time, bool) {
+	if s.Open(t) {
+		return t, true
+	}
+	local := t.In(s.loc)
+	year, month, day := local.Date()
+	var next time.Time
+	for d := 0; d < maxLookahead; d++ {
+		for i := range s.windows {
+			start, _, ok := s.windows[i].interval(year, month, day+d, s.loc)
+			if ok && start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// NextClose 返回 t 之后最近一次关闭的时间，相连或重叠的时段合并计算。
+// t 时未开放时返回 t，始终开放时返回 false
+func (s *Schedule) NextClose(t time.Time) (time.Time, bool) {
+	closeAt := t
+	for i := 0; i < maxLookahead*len(s.windows)+1; i++ {
+		if !s.Open(closeAt) {
+			return closeAt, true
+		}
+		closeAt = s.currentEnd(closeAt)
+	}
+	return time.Time{}, false
+}
+
+// currentEnd 返回包含 t 的时段中最晚的结束时间
+func (s *Schedule) currentEnd(t time.Time) time.Time {
+	local := t.In(s.loc)
+	year, month, day := local.Date()
+	latest := t
+	for _, d := range []int{day - 1, day} {
+		for i := range s.windows {
+			start, end, ok := s.windows[i].interval(year, month, d, s.loc)
+			if ok && !t.Before(start) && t.Before(end) && end.After(latest) {
+				latest = end
+			}
+		}
+	}
+	return latest
+}
+
+// String 返回时段的原始写法，以 "; " 分隔
+func (s *Schedule) String() string {
+	specs := make([]string, len(s.windows))
+	for i, w := range s.windows {
+		specs[i] = w.spec
+	}
+	return strings.Join(specs, "; ")
+}
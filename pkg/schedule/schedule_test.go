@@ -0,0 +1,175 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, timezone string, windows ...string) *Schedule {
+	t.Helper()
+	s, err := Parse(windows, timezone)
+	if err != nil {
+		t.Fatalf("Parse(%q, %q): %v", windows, timezone, err)
+	}
+	return s
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		windows  []string
+		timezone string
+	}{
+		{nil, "UTC"},
+		{[]string{"Mon-Fri 09:00-18:00"}, "Mars/Olympus"},
+		{[]string{"Mon-Fry 09:00-18:00"}, ""},
+		{[]string{"Mon-Fri 9-18"}, ""},
+		{[]string{"Mon-Fri 09:00"}, ""},
+		{[]string{"Mon-Fri 09:00-25:00"}, ""},
+		{[]string{"Mon-Fri 24:00-06:00"}, ""},
+		{[]string{"Mon-Fri 09:60-10:00"}, ""},
+		{[]string{"09:00-09:00"}, ""},
+		{[]string{"Mon 09:00-10:00 extra"}, ""},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.windows, tt.timezone); err == nil {
+			t.Errorf("Parse(%q, %q) should fail", tt.windows, tt.timezone)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	s := mustParse(t, "UTC", "Mon-Fri 09:00-18:00", "Sat,Sun 10:00-14:00", "Fri 22:00-02:00")
+	tests := []struct {
+		at   string
+		open bool
+	}{
+		{"2026-10-12T09:00:00Z", true},  // 周一开始时刻
+		{"2026-10-12T08:59:59Z", false}, // 开始之前
+		{"2026-10-12T18:00:00Z", false}, // 结束时刻不含
+		{"2026-10-17T12:00:00Z", true},  // 周六
+		{"2026-10-17T15:00:00Z", false},
+		{"2026-10-16T23:30:00Z", true},  // 周五晚上跨午夜
+		{"2026-10-17T01:59:00Z", true},  // 跨到周六凌晨
+		{"2026-10-17T02:00:00Z", false}, // 跨午夜时段结束
+		{"2026-10-13T01:00:00Z", false}, // 周一晚上没有跨午夜时段
+	}
+	for _, tt := range tests {
+		at, _ := time.Parse(time.RFC3339, tt.at)
+		if got := s.Open(at); got != tt.open {
+			t.Errorf("Open(%s) = %v, want %v", tt.at, got, tt.open)
+		}
+	}
+}
+
+func TestWeekdayRangeWraps(t *testing.T) {
+	s := mustParse(t, "UTC", "Fri-Mon 00:00-24:00")
+	for day, open := range map[string]bool{
+		"2026-10-16": true, "2026-10-17": true, "2026-10-18": true, "2026-10-19": true,
+		"2026-10-20": false, "2026-10-21": false, "2026-10-22": false,
+	} {
+		at, _ := time.Parse(time.RFC3339, day+"T12:00:00Z")
+		if got := s.Open(at); got != open {
+			t.Errorf("Open(%s) = %v, want %v", day, got, open)
+		}
+	}
+}
+
+func TestNextOpenAndClose(t *testing.T) {
+	s := mustParse(t, "Asia/Shanghai", "Mon-Fri 09:00-18:00")
+	loc := s.Location()
+
+	// 周五晚上关闭，下一次开放在周一早上
+	friday := time.Date(2026, 10, 16, 20, 0, 0, 0, loc)
+	next, ok := s.NextOpen(friday)
+	if want := time.Date(2026, 10, 19, 9, 0, 0, 0, loc); !ok || !next.Equal(want) {
+		t.Errorf("NextOpen = %v, %v, want %v", next, ok, want)
+	}
+	if closeAt, ok := s.NextClose(friday); !ok || !closeAt.Equal(friday) {
+		t.Errorf("NextClose while closed = %v, %v, want %v", closeAt, ok, friday)
+	}
+
+	monday := time.Date(2026, 10, 19, 10, 0, 0, 0, loc)
+	if next, ok := s.NextOpen(monday); !ok || !next.Equal(monday) {
+		t.Errorf("NextOpen while open = %v, %v, want %v", next, ok, monday)
+	}
+	if closeAt, ok := s.NextClose(monday); !ok || !closeAt.Equal(time.Date(2026, 10, 19, 18, 0, 0, 0, loc)) {
+		t.Errorf("NextClose = %v, %v", closeAt, ok)
+	}
+}
+
+func TestNextCloseMergesAdjacentWindows(t *testing.T) {
+	s := mustParse(t, "UTC", "Mon 20:00-24:00", "Tue 00:00-03:00", "Tue 02:00-06:00")
+	at := time.Date(2026, 10, 12, 21, 0, 0, 0, time.UTC)
+	if closeAt, ok := s.NextClose(at); !ok || !closeAt.Equal(time.Date(2026, 10, 13, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("NextClose = %v, %v", closeAt, ok)
+	}
+
+	always := mustParse(t, "UTC", "00:00-24:00")
+	if _, ok := always.NextClose(at); ok {
+		t.Error("Always open schedule should never close")
+	}
+}
+
+// 2026-03-08 美东时间 02:00 跳到 03:00，2026-11-01 02:00 回到 01:00
+func TestDaylightSavingTransitions(t *testing.T) {
+	s := mustParse(t, "America/New_York", "Sun 01:00-05:00")
+	loc := s.Location()
+
+	// 夏令时开始当天的时段只有3个小时
+	start, end, _ := s.windows[0].interval(2026, time.March, 8, loc)
+	if got := end.Sub(start); got != 3*time.Hour {
+		t.Errorf("Spring forward window lasts %v, want 3h", got)
+	}
+	// 夏令时结束当天的时段有5个小时
+	start, end, _ = s.windows[0].interval(2026, time.November, 1, loc)
+	if got := end.Sub(start); got != 5*time.Hour {
+		t.Errorf("Fall back window lasts %v, want 5h", got)
+	}
+	if !s.Open(time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC)) { // 第一次 01:30 EDT
+		t.Error("Expected open during first 01:30")
+	}
+	if !s.Open(time.Date(2026, 11, 1, 7, 30, 0, 0, time.UTC)) { // 第二次 01:30 EST
+		t.Error("Expected open during repeated 01:30")
+	}
+	if s.Open(time.Date(2026, 11, 1, 10, 0, 0, 0, time.UTC)) { // 05:00 EST
+		t.Error("Expected closed at 05:00 EST")
+	}
+}
+
+func TestDaylightSavingSkippedStart(t *testing.T) {
+	// 02:30 在夏令时开始当天不存在，顺延到 03:30 EDT
+	s := mustParse(t, "America/New_York", "Sun 02:30-06:00")
+	loc := s.Location()
+
+	before := time.Date(2026, 3, 8, 1, 45, 0, 0, loc) // 01:45 EST
+	next, ok := s.NextOpen(before)
+	if want := time.Date(2026, 3, 8, 3, 30, 0, 0, loc); !ok || !next.Equal(want) {
+		t.Errorf("NextOpen = %v, %v, want %v", next, ok, want)
+	}
+	if s.Open(time.Date(2026, 3, 8, 3, 15, 0, 0, loc)) {
+		t.Error("Expected closed at 03:15 EDT")
+	}
+	if !s.Open(time.Date(2026, 3, 8, 4, 0, 0, 0, loc)) {
+		t.Error("Expected open at 04:00 EDT")
+	}
+	// 下一周恢复正常
+	next, _ = s.NextOpen(time.Date(2026, 3, 9, 0, 0, 0, 0, loc))
+	if want := time.Date(2026, 3, 15, 2, 30, 0, 0, loc); !next.Equal(want) {
+		t.Errorf("NextOpen next week = %v, want %v", next, want)
+	}
+}
+
+func TestDaylightSavingOvernightWindow(t *testing.T) {
+	// 跨午夜时段在夏令时开始的那一晚少一个小时
+	s := mustParse(t, "Europe/Berlin", "Sat 22:00-06:00")
+	start, end, _ := s.windows[0].interval(2026, time.March, 28, s.Location())
+	if got := end.Sub(start); got != 7*time.Hour {
+		t.Errorf("Overnight window across spring forward lasts %v, want 7h", got)
+	}
+	if !s.Open(time.Date(2026, 3, 29, 3, 30, 0, 0, time.UTC)) { // 05:30 CEST
+		t.Error("Expected open at 05:30 CEST")
+	}
+	if s.Open(time.Date(2026, 3, 29, 4, 0, 0, 0, time.UTC)) { // 06:00 CEST
+		t.Error("Expected closed at 06:00 CEST")
+	}
+}
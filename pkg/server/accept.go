@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// Accept 失败后的退避时间，与 net/http 相同: 从5ms起翻倍，最长1s，成功后重置
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// maxPermanentAcceptErrors 主监听器连续出现这么多次永久错误后 Start 返回错误，交由进程管理器重启
+const maxPermanentAcceptErrors = 5
+
+// Accept 错误的类别，同时作为 singleproxy_server_accept_errors_total 的标签值
+const (
+	acceptErrorFDExhausted = "fd_exhausted" // 文件描述符耗尽 (EMFILE/ENFILE)，连接关闭后会恢复
+	acceptErrorTemporary   = "temporary"    // 临时错误，如对端在握手完成前断开
+	acceptErrorPermanent   = "permanent"    // 重试也不会恢复的错误
+)
+
+var acceptErrorsCounter = metrics.NewCounterVec("singleproxy_server_accept_errors_total",
+	"Failed accepts on server listeners by class", "class")
+
+// acceptBackoff Accept 连续失败时的退避状态，每个监听循环各持有一个
+type acceptBackoff struct {
+	delay     time.Duration
+	permanent int // 连续的永久错误次数
+}
+
+// next 记录一次 Accept 失败，返回错误类别和调用方应等待的时间
+func (b *acceptBackoff) next(err error) (string, time.Duration) {
+	class := classifyAcceptError(err)
+	acceptErrorsCounter.WithLabelValue(class).Inc()
+	if class == acceptErrorPermanent {
+		b.permanent++
+	} else {
+		b.permanent = 0
+	}
+	if b.delay == 0 {
+		b.delay = minAcceptBackoff
+	} else {
+		b.delay *= 2
+	}
+	if b.delay > maxAcceptBackoff {
+		b.delay = maxAcceptBackoff
+	}
+	return class, b.delay
+}
+
+// reset 在 Accept 成功后清除退避
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+	b.permanent = 0
+}
+
+// classifyAcceptError 按是否可能自行恢复对 Accept 错误分类
+func classifyAcceptError(err error) string {
+	if isFDExhausted(err) {
+		return acceptErrorFDExhausted
+	}
+	if errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ECONNRESET) {
+		return acceptErrorTemporary
+	}
+	var te interface{ Temporary() bool }
+	if errors.As(err, &te) && te.Temporary() {
+		return acceptErrorTemporary
+	}
+	return acceptErrorPermanent
+}
+
+// isFDExhausted 判断错误是否由进程或系统的文件描述符耗尽引起
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// serve 在主监听器上接受连接直到其关闭。监听器关闭 (包括 Stop) 时返回 nil，
+// 连续出现 maxPermanentAcceptErrors 次永久错误时返回错误
+func (p *SinglePortProxy) serve(listener net.Listener) error {
+	var backoff acceptBackoff
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if p.stopping.Load() || errors.Is(err, net.ErrClosed) {
+				logger.Info("Server stopped accepting connections", "port", p.config.ListenPort)
+				return nil
+			}
+			class, delay := backoff.next(err)
+			if backoff.permanent >= maxPermanentAcceptErrors {
+				listener.Close()
+				return fmt.Errorf("accept failed %d times in a row on port %s: %v", backoff.permanent, p.config.ListenPort, err)
+			}
+			logger.Error("Failed to accept connection",
+				"class", class,
+				"open_connections", p.conns.open.Load(),
+				"retry_in", delay,
+				"error", err)
+			time.Sleep(delay)
+			continue
+		}
+		backoff.reset()
+
+		// 为每个连接启动一个协程处理协议检测
+		go p.handleConnection(p.conns.track(conn))
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestClassifyAcceptError(t *testing.T) {
+	cases := map[error]string{
+		&net.OpError{Op: "accept", Err: fmt.Errorf("accept4: %w", syscall.EMFILE)}: acceptErrorFDExhausted,
+		&net.OpError{Op: "accept", Err: syscall.ENFILE}:                            acceptErrorFDExhausted,
+		&net.OpError{Op: "accept", Err: syscall.ECONNABORTED}:                      acceptErrorTemporary,
+		errors.New("listener broken"):                                              acceptErrorPermanent,
+	}
+	for err, want := range cases {
+		if got := classifyAcceptError(err); got != want {
+			t.Errorf("classifyAcceptError(%v) = %s, want %s", err, got, want)
+		}
+	}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	var b acceptBackoff
+	fdErr := &net.OpError{Op: "accept", Err: syscall.EMFILE}
+
+	want := []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}
+	for _, w := range want {
+		if _, d := b.next(fdErr); d != w {
+			t.Errorf("Expected backoff %v, got %v", w, d)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		b.next(fdErr)
+	}
+	if b.delay != maxAcceptBackoff {
+		t.Errorf("Expected backoff to cap at %v, got %v", maxAcceptBackoff, b.delay)
+	}
+	b.reset()
+	if _, d := b.next(fdErr); d != minAcceptBackoff {
+		t.Errorf("Expected backoff to restart at %v after reset, got %v", minAcceptBackoff, d)
+	}
+
+	// 临时错误打断连续的永久错误计数
+	b.next(errors.New("boom"))
+	b.next(errors.New("boom"))
+	b.next(fdErr)
+	if b.permanent != 0 {
+		t.Errorf("Expected permanent count to reset on a recoverable error, got %d", b.permanent)
+	}
+}
+
+// failingListener 每次 Accept 都返回同一个错误
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) { return nil, l.err }
+
+func TestServeStopsOnClosedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p := &SinglePortProxy{config: &config.Config{}, conns: newConnTracker(0, 0)}
+	done := make(chan error, 1)
+	go func() { done <- p.serve(ln) }()
+
+	time.Sleep(50 * time.Millisecond)
+	ln.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected clean return after the listener closed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected serve to return after the listener closed")
+	}
+}
+
+func TestServeGivesUpOnPermanentErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p := &SinglePortProxy{config: &config.Config{}, conns: newConnTracker(0, 0)}
+	permanent := acceptErrorsCounter.WithLabelValue(acceptErrorPermanent).Value()
+
+	err = p.serve(&failingListener{Listener: ln, err: errors.New("listener broken")})
+	if err == nil {
+		t.Fatal("Expected serve to fail after repeated permanent errors")
+	}
+	if got := acceptErrorsCounter.WithLabelValue(acceptErrorPermanent).Value() - permanent; got != maxPermanentAcceptErrors {
+		t.Errorf("Expected %d permanent errors counted, got %d", maxPermanentAcceptErrors, got)
+	}
+}
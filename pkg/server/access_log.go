@@ -0,0 +1,254 @@
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+const (
+	defaultAccessLogMaxOpenFiles = 64
+	defaultAccessLogLimit        = 100
+	// accessLogRetryInterval 打开失败的访问日志文件在该时间内不再重试，避免每个请求都记录一次错误
+	accessLogRetryInterval = time.Minute
+)
+
+var accessLogOpenFiles = metrics.NewGauge("singleproxy_server_access_log_open_files",
+	"Per-key access log files currently open")
+
+// accessEntry 一条访问记录，按key写入访问日志文件 (每行一条JSON) 并保留在内存中
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"duration_ms"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Aborted    bool      `json:"aborted,omitempty"`
+	ProxyError string    `json:"proxy_error,omitempty"`
+	KeySource  string    `json:"key_source,omitempty"`
+
+	TLSFingerprint string `json:"tls_fingerprint,omitempty"` // 客户端的 JA3 指纹 (TLS在本服务器终止时)
+	Scheme         string `json:"scheme,omitempty"`          // http 或 https，经可信代理时取自 X-Forwarded-Proto
+	ClientCert     string `json:"client_cert,omitempty"`     // 客户端证书的主题
+	Backend        string `json:"backend,omitempty"`         // 调用方通过 X-Tunnel-Backend 指定的连接ID
+}
+
+// accessRing 一个key最近的访问记录，写满后覆盖最早的
+type accessRing struct {
+	entries []accessEntry
+	next    int
+	full    bool
+}
+
+func (r *accessRing) add(e accessEntry) {
+	r.entries[r.next] = e
+	r.next++
+	if r.next == len(r.entries) {
+		r.next, r.full = 0, true
+	}
+}
+
+// recent 返回最近的至多 limit 条记录，最新的在前
+func (r *accessRing) recent(limit int) []accessEntry {
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	limit = min(limit, n)
+	out := make([]accessEntry, 0, limit)
+	for i := 1; i <= limit; i++ {
+		out = append(out, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return out
+}
+
+// accessLogFile 一个key已打开的访问日志文件
+type accessLogFile struct {
+	key  string
+	file *logger.RotatingFile
+	elem *list.Element
+}
+
+// accessLogs 按key分开的访问日志。文件在该key第一次请求时打开，与主日志使用相同的轮转设置；
+// 同时打开的文件超过上限时关闭最久未写入的，下次写入时重新打开
+type accessLogs struct {
+	paths    map[string]string // 只包含配置了 access_log_file 的key
+	maxBytes int64
+	backups  int
+	maxOpen  int
+	ringSize int
+
+	mu          sync.Mutex
+	open        map[string]*accessLogFile
+	lru         *list.List // 最近写入的在前
+	failedUntil map[string]time.Time
+	rings       map[string]*accessRing
+}
+
+func newAccessLogs(cfg *config.Config) *accessLogs {
+	a := &accessLogs{
+		paths:       make(map[string]string),
+		maxBytes:    int64(cfg.LogMaxSize) << 20,
+		backups:     cfg.LogMaxBackups,
+		maxOpen:     cfg.AccessLogMaxOpenFiles,
+		ringSize:    cfg.AccessLogRing,
+		open:        make(map[string]*accessLogFile),
+		lru:         list.New(),
+		failedUntil: make(map[string]time.Time),
+		rings:       make(map[string]*accessRing),
+	}
+	if a.maxOpen <= 0 {
+		a.maxOpen = defaultAccessLogMaxOpenFiles
+	}
+	for key, kc := range cfg.Keys {
+		if kc != nil && kc.AccessLogFile != "" {
+			a.paths[key] = kc.AccessLogFile
+		}
+	}
+	return a
+}
+
+// record 把请求写入该key的访问日志文件和内存记录，两者都未配置时不做任何事
+func (a *accessLogs) record(s requestStats) {
+	path := a.paths[s.key]
+	if path == "" && a.ringSize <= 0 {
+		return
+	}
+	e := accessEntry{
+		Time:       s.start,
+		Key:        s.key,
+		ClientIP:   s.clientIP,
+		Method:     s.method,
+		Path:       s.path,
+		Status:     s.status,
+		DurationMs: float64(s.duration.Microseconds()) / 1000,
+		BytesIn:    s.bytesIn,
+		BytesOut:   s.bytesOut,
+		Aborted:    s.aborted,
+		ProxyError: string(s.proxyError),
+		KeySource:  s.keySource,
+
+		TLSFingerprint: s.tlsFingerprint,
+		Scheme:         s.scheme,
+		ClientCert:     s.clientCert,
+		Backend:        s.backend,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ringSize > 0 {
+		ring := a.rings[s.key]
+		if ring == nil {
+			ring = &accessRing{entries: make([]accessEntry, a.ringSize)}
+			a.rings[s.key] = ring
+		}
+		ring.add(e)
+	}
+	if path == "" {
+		return
+	}
+	f := a.fileLocked(s.key, path)
+	if f == nil {
+		return
+	}
+	line, _ := json.Marshal(e)
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		logger.Error("Failed to write access log", "key", s.key, "path", path, "error", err)
+	}
+}
+
+// fileLocked 返回key的访问日志文件，未打开时打开并在超过上限时关闭最久未写入的文件
+func (a *accessLogs) fileLocked(key, path string) *accessLogFile {
+	if f := a.open[key]; f != nil {
+		a.lru.MoveToFront(f.elem)
+		return f
+	}
+	now := time.Now()
+	if now.Before(a.failedUntil[key]) {
+		return nil
+	}
+	file, err := logger.OpenRotatingFile(path, a.maxBytes, a.backups)
+	if err != nil {
+		a.failedUntil[key] = now.Add(accessLogRetryInterval)
+		logger.Error("Failed to open access log", "key", key, "path", path, "error", err)
+		return nil
+	}
+	delete(a.failedUntil, key)
+	f := &accessLogFile{key: key, file: file}
+	f.elem = a.lru.PushFront(f)
+	a.open[key] = f
+	accessLogOpenFiles.Inc()
+	for a.lru.Len() > a.maxOpen {
+		a.closeLocked(a.lru.Back().Value.(*accessLogFile))
+	}
+	return f
+}
+
+func (a *accessLogs) closeLocked(f *accessLogFile) {
+	if err := f.file.Close(); err != nil {
+		logger.Warn("Failed to close access log", "key", f.key, "error", err)
+	}
+	a.lru.Remove(f.elem)
+	delete(a.open, f.key)
+	accessLogOpenFiles.Dec()
+}
+
+// recent 返回key最近的访问记录，未开启内存记录时 ok 为 false
+func (a *accessLogs) recent(key string, limit int) (entries []accessEntry, ok bool) {
+	if a.ringSize <= 0 {
+		return nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ring := a.rings[key]
+	if ring == nil {
+		return []accessEntry{}, true
+	}
+	return ring.recent(limit), true
+}
+
+// close 关闭所有打开的访问日志文件
+func (a *accessLogs) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.lru.Len() > 0 {
+		a.closeLocked(a.lru.Back().Value.(*accessLogFile))
+	}
+}
+
+// handleAdminKeyAccess 返回key最近的访问记录，最新的在前: GET /admin/keys/{key}/access?limit=
+func (p *SinglePortProxy) handleAdminKeyAccess(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !authorizeKey(w, r, key) {
+		return
+	}
+	limit := defaultAccessLogLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = n
+	}
+	entries, ok := p.accessLogs.recent(key, limit)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "access ring is disabled (-access-log-ring)"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"key":     key,
+		"entries": entries,
+	})
+}
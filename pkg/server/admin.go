@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"singleproxy/pkg/dnscache"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/protocol"
+)
+
+// adminTunnelInfo 是管理API中单个隧道连接的描述
+type adminTunnelInfo struct {
+	ID           string    `json:"id,omitempty"`
+	Key          string    `json:"key"`
+	Transport    string    `json:"transport"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at,omitempty"`
+	LastSeen     time.Time `json:"last_seen,omitempty"`
+	LastActivity time.Time `json:"last_activity,omitempty"`
+	Bindings     []string  `json:"bindings,omitempty"`
+	Draining     bool      `json:"draining,omitempty"`
+
+	Balance *adminBalanceInfo `json:"balance,omitempty"` // 仅开启负载均衡的key
+}
+
+// newAdminMux 创建管理API路由
+func (p *SinglePortProxy) newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/info", p.handleAdminInfo)
+	mux.HandleFunc("GET /admin/tunnels", p.handleAdminTunnels)
+	mux.HandleFunc("GET /admin/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// 指标覆盖所有租户，只对完整权限开放
+		if requireFullAdmin(w, r) {
+			metrics.Handler().ServeHTTP(w, r)
+		}
+	})
+	mux.HandleFunc("GET /admin/limits", p.handleAdminLimits)
+	mux.HandleFunc("GET /admin/usage", p.handleAdminUsage)
+	mux.HandleFunc("GET /admin/top-responses", p.handleAdminTopResponses)
+	mux.HandleFunc("GET /admin/dns", handleAdminDNS)
+	mux.HandleFunc("POST /admin/dns/flush", handleAdminDNSFlush)
+	mux.HandleFunc("GET /admin/debug/goroutines", handleAdminGoroutines)
+	mux.HandleFunc("GET /admin/tls", p.handleAdminTLS)
+	mux.HandleFunc("GET /admin/routes", p.handleAdminRoutes)
+	mux.HandleFunc("GET /admin/cluster", p.handleAdminCluster)
+	mux.HandleFunc("POST /admin/tls/reload", p.handleAdminTLSReload)
+	mux.HandleFunc("POST /admin/keys/{key}/capture", p.handleAdminCaptureStart)
+	mux.HandleFunc("GET /admin/keys/{key}/capture", p.handleAdminCaptureStatus)
+	mux.HandleFunc("DELETE /admin/keys/{key}/capture", p.handleAdminCaptureStop)
+	mux.HandleFunc("GET /admin/keys/{key}/access", p.handleAdminKeyAccess)
+	mux.HandleFunc("POST /admin/keys/{key}/check", p.handleAdminTargetCheck)
+	mux.HandleFunc("POST /admin/drain", p.handleAdminDrain)
+	mux.HandleFunc("DELETE /admin/drain", p.handleAdminDrainLift)
+	mux.HandleFunc("GET /admin/traffic", p.handleAdminTraffic)
+	mux.HandleFunc("PUT /admin/traffic", p.handleAdminTrafficSet)
+	mux.HandleFunc("GET /admin/ready", p.handleAdminReady)
+	mux.HandleFunc("GET /admin/schedules", p.handleAdminSchedules)
+	mux.HandleFunc("POST /admin/schedules/reload", p.handleAdminSchedulesReload)
+	return mux
+}
+
+// handleAdmin 校验令牌后分发管理API请求，各接口再按令牌的权限范围过滤或授权
+func (p *SinglePortProxy) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	principal := p.authenticateAdmin(token)
+	if principal == nil {
+		logger.Warn("Unauthorized admin API request",
+			"remote_addr", r.RemoteAddr,
+			"path", r.URL.Path)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	// 审计日志只记录令牌名称和摘要，变更类请求以 info 级别记录
+	auditLog := logger.Debug
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		auditLog = logger.Info
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	p.adminMux.ServeHTTP(rec, withAdminPrincipal(r, principal))
+	if rec.status == http.StatusForbidden {
+		auditLog = logger.Warn
+	}
+	auditLog("Admin API request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", rec.status,
+		"token_name", principal.name,
+		"token_fingerprint", principal.fingerprint,
+		"remote_addr", r.RemoteAddr)
+}
+
+// statusRecorder 记录管理API响应的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// handleAdminInfo 返回服务器实例的基本信息。instance_id 即转发请求时写入 X-SingleProxy-Hop 的值，
+// 用于在环路日志的 hops 中辨认各个服务器
+func (p *SinglePortProxy) handleAdminInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"instance_id":    p.instanceID,
+		"started_at":     p.startedAt,
+		"uptime_seconds": int64(time.Since(p.startedAt).Seconds()),
+		"max_hops":       protocol.MaxHops,
+	})
+}
+
+// handleAdminTunnels 列出所有已注册的隧道及其绑定
+func (p *SinglePortProxy) handleAdminTunnels(w http.ResponseWriter, r *http.Request) {
+	tunnels := make([]adminTunnelInfo, 0)
+	principal := adminPrincipalFrom(r)
+
+	balance := p.balanceInfo()
+	for _, tc := range p.allTunnels() {
+		if !principal.allows(tc.key) {
+			continue
+		}
+		info := adminTunnelInfo{
+			ID:           tc.id,
+			Key:          tc.key,
+			Transport:    "websocket",
+			RemoteAddr:   tc.conn.RemoteAddr().String(),
+			ConnectedAt:  tc.connectedAt,
+			LastActivity: tc.lastActive(),
+			Draining:     tc.draining.Load(),
+			Balance:      balance[tc],
+		}
+		for _, b := range tc.grantedBindings() {
+			info.Bindings = append(info.Bindings, b.String())
+		}
+		tunnels = append(tunnels, info)
+	}
+
+	p.httpTunnelMgr.mu.RLock()
+	for _, client := range p.httpTunnelMgr.clients {
+		if !principal.allows(client.key) {
+			continue
+		}
+		tunnels = append(tunnels, adminTunnelInfo{
+			Key:        client.key,
+			Transport:  "http",
+			RemoteAddr: client.remoteAddr,
+			LastSeen:   client.lastSeen,
+		})
+	}
+	p.httpTunnelMgr.mu.RUnlock()
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		if tunnels[i].Key != tunnels[j].Key {
+			return tunnels[i].Key < tunnels[j].Key
+		}
+		return tunnels[i].ID < tunnels[j].ID
+	})
+
+	writeJSON(w, http.StatusOK, map[string]any{"tunnels": tunnels})
+}
+
+// handleAdminDNS 返回出站DNS缓存的统计，缓存由所有租户共用，只对完整权限开放
+func handleAdminDNS(w http.ResponseWriter, r *http.Request) {
+	if requireFullAdmin(w, r) {
+		writeJSON(w, http.StatusOK, dnscache.Default().Stats())
+	}
+}
+
+// handleAdminDNSFlush 清空出站DNS缓存，用于目标地址变更后立即生效
+func handleAdminDNSFlush(w http.ResponseWriter, r *http.Request) {
+	if requireFullAdmin(w, r) {
+		writeJSON(w, http.StatusOK, map[string]int{"flushed": dnscache.Default().Flush()})
+	}
+}
+
+// handleAdminGoroutines 返回 goroutine profile，处理请求的协程带有 key、request_id、stage 标签，
+// 隧道连接的读写循环带有 key、loop 标签。默认为 pprof 格式，debug=1 为带标签的文本。
+// 包含所有租户的key，只对完整权限开放
+func handleAdminGoroutines(w http.ResponseWriter, r *http.Request) {
+	if !requireFullAdmin(w, r) {
+		return
+	}
+	debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	debug = min(max(debug, 0), 2)
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="goroutine.pprof"`)
+	}
+	if err := pprof.Lookup("goroutine").WriteTo(w, debug); err != nil {
+		logger.Error("Failed to write goroutine profile", "error", err)
+	}
+}
+
+// writeJSON 以JSON格式写入响应
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Failed to encode JSON response", "error", err)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"path"
+
+	"singleproxy/pkg/config"
+)
+
+// adminPrincipal 一个管理令牌及其权限范围
+type adminPrincipal struct {
+	name        string
+	tokenHash   [sha256.Size]byte
+	fingerprint string   // 令牌摘要前缀，用于审计日志，不暴露令牌本身
+	full        bool     // 完整管理权限
+	keys        []string // 可管理的key模式
+}
+
+// allows 检查该令牌是否可以查看和管理指定key
+func (a *adminPrincipal) allows(key string) bool {
+	if a.full {
+		return true
+	}
+	for _, pattern := range a.keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenFingerprint 返回令牌的 SHA-256 摘要前缀
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// newAdminPrincipals 根据配置创建管理令牌列表，admin_token 视为完整权限
+func newAdminPrincipals(cfg *config.Config) []*adminPrincipal {
+	var principals []*adminPrincipal
+	add := func(name, token string, full bool, keys []string) {
+		principals = append(principals, &adminPrincipal{
+			name:        name,
+			tokenHash:   sha256.Sum256([]byte(token)),
+			fingerprint: tokenFingerprint(token),
+			full:        full,
+			keys:        keys,
+		})
+	}
+	if cfg.AdminToken != "" {
+		add("admin", cfg.AdminToken, true, nil)
+	}
+	for _, t := range cfg.AdminTokens {
+		if t == nil || t.Token == "" {
+			continue
+		}
+		add(t.Name, t.Token, t.Full, t.Keys)
+	}
+	return principals
+}
+
+// authenticateAdmin 查找与令牌匹配的管理身份。
+// 比较摘要而非原值，并且总是遍历全部令牌，耗时不随匹配位置或长度变化
+func (p *SinglePortProxy) authenticateAdmin(token string) *adminPrincipal {
+	if token == "" {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(token))
+	var matched *adminPrincipal
+	for _, a := range p.adminPrincipals {
+		if subtle.ConstantTimeCompare(hash[:], a.tokenHash[:]) == 1 {
+			matched = a
+		}
+	}
+	return matched
+}
+
+type adminPrincipalContextKey struct{}
+
+// adminPrincipalFrom 返回请求对应的管理身份
+func adminPrincipalFrom(r *http.Request) *adminPrincipal {
+	a, _ := r.Context().Value(adminPrincipalContextKey{}).(*adminPrincipal)
+	return a
+}
+
+// withAdminPrincipal 将管理身份放入请求上下文
+func withAdminPrincipal(r *http.Request, a *adminPrincipal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminPrincipalContextKey{}, a))
+}
+
+// authorizeKey 检查当前令牌可以管理指定key，否则返回 403 并指明被拒绝的key
+func authorizeKey(w http.ResponseWriter, r *http.Request, key string) bool {
+	if a := adminPrincipalFrom(r); a != nil && a.allows(key) {
+		return true
+	}
+	writeJSON(w, http.StatusForbidden, map[string]string{
+		"error": "token is not allowed to manage key " + key,
+		"key":   key,
+	})
+	return false
+}
+
+// requireFullAdmin 检查当前令牌拥有完整管理权限
+func requireFullAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if a := adminPrincipalFrom(r); a != nil && a.full {
+		return true
+	}
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": "endpoint requires a full admin token"})
+	return false
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// 自动key默认有效期
+const defaultAutoKeyTTL = time.Hour
+
+// 生成自动key时的最大重试次数
+const maxAutoKeyAttempts = 16
+
+var autoKeyAdjectives = []string{
+	"brave", "calm", "clever", "eager", "fancy", "gentle", "happy", "jolly",
+	"kind", "lively", "lucky", "mighty", "nimble", "proud", "quick", "quiet",
+	"rapid", "shiny", "silly", "smart", "steady", "sunny", "swift", "tidy",
+	"vivid", "warm", "wise", "witty", "zesty", "bold", "bright", "cosmic",
+}
+
+var autoKeyNouns = []string{
+	"otter", "falcon", "panda", "tiger", "koala", "lynx", "heron", "badger",
+	"beaver", "bison", "cobra", "crane", "dingo", "eagle", "ferret", "gecko",
+	"ibis", "jaguar", "lemur", "marten", "narwhal", "ocelot", "puffin", "quail",
+	"raven", "salmon", "tapir", "walrus", "yak", "zebra", "moose", "orca",
+}
+
+// autoKeyRegistry 记录服务器分配的key及其过期时间
+type autoKeyRegistry struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newAutoKeyRegistry() *autoKeyRegistry {
+	return &autoKeyRegistry{expires: make(map[string]time.Time)}
+}
+
+// lookup 返回自动key的过期时间
+func (r *autoKeyRegistry) lookup(key string) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exp, ok := r.expires[key]
+	return exp, ok
+}
+
+// generateAutoKey 生成一个与在线及已知key都不冲突的新key并登记过期时间
+func (p *SinglePortProxy) generateAutoKey() (string, time.Time, error) {
+	ttl := p.config.AutoKeyTTL
+	if ttl <= 0 {
+		ttl = defaultAutoKeyTTL
+	}
+
+	r := p.autoKeys
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 清理过期超过一天的记录
+	now := time.Now()
+	for k, exp := range r.expires {
+		if now.Sub(exp) > 24*time.Hour {
+			delete(r.expires, k)
+		}
+	}
+
+	for i := 0; i < maxAutoKeyAttempts; i++ {
+		key, err := randomKey(p.config.AutoKeyFormat)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if _, exists := r.expires[key]; exists || p.keyInUse(key) {
+			continue
+		}
+		expiresAt := now.Add(ttl)
+		r.expires[key] = expiresAt
+		return key, expiresAt, nil
+	}
+	return "", time.Time{}, fmt.Errorf("failed to generate a unique key after %d attempts", maxAutoKeyAttempts)
+}
+
+// keyInUse 检查key是否已被在线隧道或配置占用
+func (p *SinglePortProxy) keyInUse(key string) bool {
+	if p.config.KeyConfig(key) != nil {
+		return true
+	}
+
+	p.connsMu.RLock()
+	_, wsExists := p.clientConns[key]
+	p.connsMu.RUnlock()
+
+	p.httpTunnelMgr.mu.RLock()
+	_, httpExists := p.httpTunnelMgr.clients[key]
+	p.httpTunnelMgr.mu.RUnlock()
+
+	return wsExists || httpExists
+}
+
+// randomKey 按格式生成随机key: words 形如 brave-otter-4712, hex 为16位十六进制
+func randomKey(format string) (string, error) {
+	switch format {
+	case "", "words":
+		adj, err := randomIndex(len(autoKeyAdjectives))
+		if err != nil {
+			return "", err
+		}
+		noun, err := randomIndex(len(autoKeyNouns))
+		if err != nil {
+			return "", err
+		}
+		num, err := randomIndex(10000)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s-%s-%04d", autoKeyAdjectives[adj], autoKeyNouns[noun], num), nil
+	case "hex":
+		buf := make([]byte, 8)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(buf), nil
+	default:
+		return "", fmt.Errorf("unknown auto key format %q", format)
+	}
+}
+
+func randomIndex(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(v.Int64()), nil
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/utils"
+)
+
+const (
+	// affinityCookieName 会话保持cookie，值为 "连接ID.签名"
+	affinityCookieName = "singleproxy_backend"
+	// headerBackendOverride 测试时指定处理请求的连接ID，优先于负载均衡和会话保持
+	headerBackendOverride = "X-Tunnel-Backend"
+	// headerBackendToken 指定连接时一并出示的管理令牌，令牌需有权管理该key
+	headerBackendToken = "X-Tunnel-Backend-Token"
+)
+
+// tunnelPool 同一key下已注册的WebSocket连接。
+// conns 只整体替换不原地修改，持有 connsMu 读锁复制出切片后即可在锁外使用
+type tunnelPool struct {
+	conns []*tunnelConn // 按注册顺序
+	sched *scheduler
+}
+
+func newTunnelPool(kc *config.KeyConfig) *tunnelPool {
+	if kc == nil {
+		return &tunnelPool{sched: newScheduler(false, 0)}
+	}
+	return &tunnelPool{sched: newScheduler(kc.Balance == "weighted", kc.MaxErrorRate)}
+}
+
+// latest 返回最近注册的连接
+func (tp *tunnelPool) latest() *tunnelConn {
+	if len(tp.conns) == 0 {
+		return nil
+	}
+	return tp.conns[len(tp.conns)-1]
+}
+
+func (tp *tunnelPool) add(tc *tunnelConn) {
+	tp.conns = append(append([]*tunnelConn(nil), tp.conns...), tc)
+}
+
+// remove 移除连接，连接不在池中时返回 false
+func (tp *tunnelPool) remove(tc *tunnelConn) bool {
+	for i, c := range tp.conns {
+		if c == tc {
+			conns := make([]*tunnelConn, 0, len(tp.conns)-1)
+			tp.conns = append(append(conns, tp.conns[:i]...), tp.conns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// allTunnels 返回所有已注册连接的快照
+func (p *SinglePortProxy) allTunnels() []*tunnelConn {
+	p.connsMu.RLock()
+	defer p.connsMu.RUnlock()
+	var conns []*tunnelConn
+	for _, pool := range p.clientConns {
+		conns = append(conns, pool.conns...)
+	}
+	return conns
+}
+
+// backendOverride 返回调用方通过 X-Tunnel-Backend 指定的连接ID。调用方同时在 X-Tunnel-Backend-Token
+// 中出示有权管理该key的管理令牌时才生效，否则忽略指定；两个头总是从转发的请求中去掉
+func (p *SinglePortProxy) backendOverride(r *http.Request, key, clientIP string) string {
+	override := r.Header.Get(headerBackendOverride)
+	token := r.Header.Get(headerBackendToken)
+	r.Header.Del(headerBackendOverride)
+	r.Header.Del(headerBackendToken)
+	if override == "" {
+		return ""
+	}
+	principal := p.authenticateAdmin(token)
+	if principal == nil || !principal.allows(key) {
+		logger.Debug("Ignored tunnel backend override without an authorized token",
+			"client_ip", clientIP,
+			"key", key,
+			"connection_id", override)
+		return ""
+	}
+	logger.Debug("Tunnel backend override requested",
+		"client_ip", clientIP,
+		"key", key,
+		"connection_id", override,
+		"token_name", principal.name,
+		"token_fingerprint", principal.fingerprint)
+	return override
+}
+
+// writeBackendNotFound 指定的连接不在该key的连接中时返回404并说明原因
+func (p *SinglePortProxy) writeBackendNotFound(w http.ResponseWriter, key, backend string) {
+	p.markProxyError(w, proxyErrBackendNotFound)
+	http.Error(w, fmt.Sprintf("Tunnel backend %q is not connected for key %q, see GET /admin/tunnels for connection IDs", backend, key),
+		http.StatusNotFound)
+}
+
+// selectTunnel 为公网请求选择该key下的连接，没有WebSocket连接时返回nil。override 为已授权调用方指定的连接ID，
+// 指定时不经过负载均衡，连接不存在时返回nil。
+// 会话保持需要下发cookie时写入 w 的响应头，并从转发的请求中去掉服务器自用的头和cookie
+func (p *SinglePortProxy) selectTunnel(w http.ResponseWriter, r *http.Request, key, override string) *tunnelConn {
+	p.connsMu.RLock()
+	pool := p.clientConns[key]
+	var conns []*tunnelConn
+	if pool != nil {
+		conns = pool.conns
+	}
+	p.connsMu.RUnlock()
+
+	cookieID, hasCookie := p.takeAffinityCookie(r, key)
+	if len(conns) == 0 {
+		return nil
+	}
+
+	if override != "" {
+		tc := findTunnel(conns, override)
+		if tc == nil {
+			logger.Debug("Requested tunnel backend is not connected",
+				"key", key,
+				"connection_id", override)
+			return nil
+		}
+		logger.Debug("Selected tunnel backend",
+			"key", key,
+			"connection_id", tc.id,
+			"decision", "override")
+		return tc
+	}
+
+	// 迁移中的连接只处理已分配给它的请求
+	conns = preferActive(conns)
+	kc := p.config.KeyConfig(key)
+	if !kc.MultiClient() {
+		return conns[len(conns)-1]
+	}
+
+	var tc *tunnelConn
+	decision := kc.Balance
+	switch kc.Affinity {
+	case "cookie":
+		if hasCookie {
+			if tc = findTunnel(conns, cookieID); tc != nil && pool.sched.effectiveWeight(tc) > 0 {
+				decision = "cookie"
+				break
+			}
+		}
+		// 首次访问或固定的连接已断开、不健康，重新选择并刷新cookie
+		tc = pool.sched.pick(conns)
+		decision = "cookie_assigned"
+		http.SetCookie(w, &http.Cookie{
+			Name:     affinityCookieName,
+			Value:    tc.id + "." + p.signAffinity(key, tc.id),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   p.connSecurityOf(r).https,
+			SameSite: http.SameSiteLaxMode,
+		})
+	case "ip_hash":
+		clientIP, _ := utils.GetClientIP(r)
+		tc = hashTunnel(pool.sched.eligible(conns), clientIP)
+		decision = "ip_hash"
+	default:
+		tc = pool.sched.pick(conns)
+	}
+
+	logger.Debug("Selected tunnel backend",
+		"key", key,
+		"connection_id", tc.id,
+		"decision", decision,
+		"backends", len(conns))
+	return tc
+}
+
+// adminBalanceInfo 管理API中连接的负载均衡状态
+type adminBalanceInfo struct {
+	Weight          int     `json:"weight"`
+	EffectiveWeight int     `json:"effective_weight"` // 被排除时为0
+	TargetHealthy   bool    `json:"target_healthy"`
+	ErrorRate       float64 `json:"error_rate"` // 最近一分钟
+	Share           float64 `json:"share"`      // 最近一分钟该连接处理的请求占该key的比例
+}
+
+// balanceInfo 返回开启负载均衡的key下各连接的状态
+func (p *SinglePortProxy) balanceInfo() map[*tunnelConn]*adminBalanceInfo {
+	p.connsMu.RLock()
+	pools := make(map[string]*tunnelPool, len(p.clientConns))
+	for key, pool := range p.clientConns {
+		if p.config.KeyConfig(key).MultiClient() {
+			pools[key] = pool
+		}
+	}
+	p.connsMu.RUnlock()
+
+	now := time.Now()
+	out := make(map[*tunnelConn]*adminBalanceInfo)
+	for _, pool := range pools {
+		var total int64
+		requests := make(map[*tunnelConn]int64, len(pool.conns))
+		for _, tc := range pool.conns {
+			n, errors := tc.recent.counts(now)
+			info := &adminBalanceInfo{
+				Weight:          pool.sched.weight(tc),
+				EffectiveWeight: pool.sched.effectiveWeight(tc),
+				TargetHealthy:   !tc.targetDown.Load(),
+			}
+			if n > 0 {
+				info.ErrorRate = float64(errors) / float64(n)
+			}
+			out[tc] = info
+			requests[tc] = n
+			total += n
+		}
+		if total > 0 {
+			for tc, n := range requests {
+				out[tc].Share = float64(n) / float64(total)
+			}
+		}
+	}
+	return out
+}
+
+// tunnelsExcluded 判断key的所有连接是否都因目标不可达或错误率过高被排除
+func (p *SinglePortProxy) tunnelsExcluded(key string) bool {
+	p.connsMu.RLock()
+	defer p.connsMu.RUnlock()
+	pool := p.clientConns[key]
+	if pool == nil || len(pool.conns) == 0 {
+		return false
+	}
+	for _, tc := range pool.conns {
+		if pool.sched.effectiveWeight(tc) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func findTunnel(conns []*tunnelConn, id string) *tunnelConn {
+	for _, tc := range conns {
+		if tc.id == id {
+			return tc
+		}
+	}
+	return nil
+}
+
+// hashTunnel 按最高随机权重 (rendezvous) 哈希选择连接，连接增减时只影响原本落在该连接上的客户端
+func hashTunnel(conns []*tunnelConn, clientIP string) *tunnelConn {
+	var best *tunnelConn
+	var bestScore uint64
+	for _, tc := range conns {
+		h := fnv.New64a()
+		h.Write([]byte(clientIP))
+		h.Write([]byte{0})
+		h.Write([]byte(tc.id))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = tc, score
+		}
+	}
+	return best
+}
+
+// signAffinity 计算会话保持cookie的签名，签名包含key，cookie不能用于其他key
+func (p *SinglePortProxy) signAffinity(key, id string) string {
+	mac := hmac.New(sha256.New, p.affinitySecret)
+	mac.Write([]byte(key))
+	mac.Write([]byte{0})
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// takeAffinityCookie 取出并校验会话保持cookie，同时将其从转发给目标服务的 Cookie 头中删除
+func (p *SinglePortProxy) takeAffinityCookie(r *http.Request, key string) (string, bool) {
+	cookies := r.Cookies()
+	var value string
+	var found bool
+	kept := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		if c.Name == affinityCookieName {
+			value, found = c.Value, true
+			continue
+		}
+		kept = append(kept, c.String())
+	}
+	if !found {
+		return "", false
+	}
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	} else {
+		r.Header.Del("Cookie")
+	}
+
+	id, sig, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(p.signAffinity(key, id))) {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+func TestBackendOverrideRequiresToken(t *testing.T) {
+	p := NewSinglePortProxy(&config.Config{
+		Mode:       "server",
+		AdminToken: "admin-secret",
+		AdminTokens: []*config.AdminTokenConfig{
+			{Name: "qa", Token: "qa-secret", Keys: []string{"staging-*"}},
+		},
+	})
+	tests := []struct {
+		name  string
+		key   string
+		token string
+		want  string
+	}{
+		{"no token", "web", "", ""},
+		{"wrong token", "web", "guess", ""},
+		{"scoped token for another key", "web", "qa-secret", ""},
+		{"scoped token for its key", "staging-web", "qa-secret", "conn-2"},
+		{"full admin token", "web", "admin-secret", "conn-2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set(headerBackendOverride, "conn-2")
+		if tt.token != "" {
+			r.Header.Set(headerBackendToken, tt.token)
+		}
+		if got := p.backendOverride(r, tt.key, "203.0.113.7"); got != tt.want {
+			t.Errorf("%s: backendOverride = %q, want %q", tt.name, got, tt.want)
+		}
+		// 无论是否生效都不转发给目标服务
+		if r.Header.Get(headerBackendOverride) != "" || r.Header.Get(headerBackendToken) != "" {
+			t.Errorf("%s: expected override headers to be stripped, got %v", tt.name, r.Header)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+)
+
+// boundKeyContextKey 用于在请求上下文中携带端口绑定所指定的key
+type boundKeyContextKey struct{}
+
+// portBinding 表示一个为隧道动态开启的公网端口
+type portBinding struct {
+	owner    *tunnelConn
+	listener net.Listener
+}
+
+// bindingManager 管理客户端申请的动态公网绑定
+type bindingManager struct {
+	mu    sync.RWMutex
+	hosts map[string]*tunnelConn
+	ports map[int]*portBinding
+}
+
+func newBindingManager() *bindingManager {
+	return &bindingManager{
+		hosts: make(map[string]*tunnelConn),
+		ports: make(map[int]*portBinding),
+	}
+}
+
+// lookupHost 返回绑定到指定主机名的key
+func (m *bindingManager) lookupHost(host string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if tc, ok := m.hosts[host]; ok {
+		return tc.key, true
+	}
+	return "", false
+}
+
+// handleBindRequest 处理客户端的公网绑定申请，并返回逐项的授予/拒绝结果
+func (p *SinglePortProxy) handleBindRequest(tc *tunnelConn, msg protocol.TunnelMessage) {
+	req, err := protocol.DecodeBindRequest(msg.Payload)
+	if err != nil {
+		logger.Warn("Invalid bind request",
+			"key", tc.key,
+			"connection_id", tc.id,
+			"error", err)
+		return
+	}
+
+	resp := protocol.BindResponse{Results: make([]protocol.BindResult, 0, len(req.Bindings))}
+	for _, b := range req.Bindings {
+		result := protocol.BindResult{Binding: b}
+		if reason := p.grantBinding(tc, b); reason != "" {
+			result.Reason = reason
+			logger.Warn("Binding refused",
+				"key", tc.key,
+				"connection_id", tc.id,
+				"binding", b.String(),
+				"reason", reason)
+		} else {
+			result.Granted = true
+			tc.addBinding(b)
+			logger.Info("Binding granted",
+				"key", tc.key,
+				"connection_id", tc.id,
+				"binding", b.String())
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	payload, err := protocol.EncodeBindResponse(resp)
+	if err != nil {
+		logger.Error("Failed to encode bind response",
+			"key", tc.key,
+			"error", err)
+		return
+	}
+	if err := tc.sendTunnelMessage(protocol.TunnelMessage{ID: msg.ID, Type: protocol.MSG_TYPE_BIND_RES, Payload: payload}); err != nil {
+		logger.Error("Failed to send bind response",
+			"key", tc.key,
+			"connection_id", tc.id,
+			"error", err)
+	}
+}
+
+// grantBinding 按key的策略检查并创建绑定，返回空字符串表示成功，否则返回拒绝原因
+func (p *SinglePortProxy) grantBinding(tc *tunnelConn, b protocol.Binding) string {
+	policy := p.config.KeyConfig(tc.key)
+	if policy == nil {
+		return "no binding policy configured for key"
+	}
+
+	m := p.bindings
+	switch b.Type {
+	case protocol.BindTypeHost:
+		host := strings.ToLower(b.Host)
+		if !hostAllowed(policy.AllowedHosts, host) {
+			return "host not allowed by policy"
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if owner, ok := m.hosts[host]; ok && owner != tc {
+			return "host already bound by another tunnel"
+		}
+		m.hosts[host] = tc
+		return ""
+
+	case protocol.BindTypePort:
+		if !portAllowed(policy.AllowedPorts, b.Port) {
+			return "port not allowed by policy"
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if existing, ok := m.ports[b.Port]; ok {
+			if existing.owner == tc {
+				return ""
+			}
+			return "port already bound by another tunnel"
+		}
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(b.Port))
+		if err != nil {
+			return fmt.Sprintf("failed to listen on port %d", b.Port)
+		}
+		if p.tlsConfig != nil {
+			ln = p.newTLSListener(ln)
+		}
+		m.ports[b.Port] = &portBinding{owner: tc, listener: ln}
+		go p.servePortBinding(ln, tc.key, b.Port)
+		return ""
+
+	default:
+		return "unknown binding type"
+	}
+}
+
+// releaseBindings 在连接断开时撤销其全部绑定
+func (p *SinglePortProxy) releaseBindings(tc *tunnelConn) {
+	m := p.bindings
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	released := 0
+	for host, owner := range m.hosts {
+		if owner == tc {
+			delete(m.hosts, host)
+			released++
+		}
+	}
+	for port, pb := range m.ports {
+		if pb.owner == tc {
+			pb.listener.Close()
+			delete(m.ports, port)
+			released++
+		}
+	}
+
+	if released > 0 {
+		logger.Info("Released tunnel bindings",
+			"key", tc.key,
+			"connection_id", tc.id,
+			"count", released)
+	}
+}
+
+// servePortBinding 在绑定端口上接受连接，所有请求都路由到该key
+func (p *SinglePortProxy) servePortBinding(ln net.Listener, key string, port int) {
+	logger.Info("Port binding listening",
+		"key", key,
+		"port", port)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rejectMalformedTarget(w, r) {
+			return
+		}
+		ctx := context.WithValue(r.Context(), boundKeyContextKey{}, key)
+		p.handlePublicHTTPRequest(w, r.WithContext(ctx))
+	})
+
+	var backoff acceptBackoff
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logger.Info("Port binding closed",
+					"key", key,
+					"port", port)
+				return
+			}
+			class, delay := backoff.next(err)
+			logger.Warn("Failed to accept connection on port binding",
+				"key", key,
+				"port", port,
+				"class", class,
+				"retry_in", delay,
+				"error", err)
+			time.Sleep(delay)
+			continue
+		}
+		backoff.reset()
+		go p.handleHTTPConnection(p.conns.track(conn), handler)
+	}
+}
+
+// hostAllowed 检查主机名是否匹配策略中的任一模式
+func hostAllowed(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			suffix := pattern[1:] // ".example.com"
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portAllowed 检查端口是否落在策略允许的端口或端口范围内
+func portAllowed(ranges []string, port int) bool {
+	for _, r := range ranges {
+		low, high, isRange := strings.Cut(strings.TrimSpace(r), "-")
+		lo, err := strconv.Atoi(strings.TrimSpace(low))
+		if err != nil {
+			continue
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(strings.TrimSpace(high)); err != nil {
+				continue
+			}
+		}
+		if port >= lo && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+// hostWithoutPort 去掉Host中的端口部分并转换为小写
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"singleproxy/pkg/logger"
+)
+
+const (
+	// defaultClientBodyReadTimeout 读取公网请求体时要求最低进度的间隔
+	defaultClientBodyReadTimeout = 30 * time.Second
+	// minBodyReadProgress 每个间隔内至少要收到的请求体字节数，请求体剩余部分不足时读完即可
+	minBodyReadProgress = 1024
+)
+
+// errClientBodyTimeout 公网调用方发送请求体过慢
+var errClientBodyTimeout = errors.New("client body read timeout")
+
+// deadlineBody 在读取公网请求体期间为连接设置读取期限。每收到 minBodyReadProgress 字节才延长期限，
+// 每秒只发一个字节的调用方无法无限期占用处理协程。期限在第一次读取时才设置，
+// 长轮询客户端稍后才从 body 端点读取请求体时不受影响；读完或出错后清除期限，不影响之后等待响应
+type deadlineBody struct {
+	body     io.ReadCloser
+	rc       *http.ResponseController
+	timeout  time.Duration
+	armed    bool
+	done     bool
+	progress int // 上次延长期限以来收到的字节数
+}
+
+// limitBodyReadTime 为请求体包装读取期限，ResponseWriter 不支持设置期限时保持原样
+func (p *SinglePortProxy) limitBodyReadTime(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	r.Body = &deadlineBody{body: r.Body, rc: http.NewResponseController(w), timeout: p.bodyReadTimeout()}
+}
+
+// bodyReadTimeout 返回生效的请求体读取间隔
+func (p *SinglePortProxy) bodyReadTimeout() time.Duration {
+	if p.config.ClientBodyReadTimeout > 0 {
+		return p.config.ClientBodyReadTimeout
+	}
+	return defaultClientBodyReadTimeout
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	if b.done {
+		return b.body.Read(p)
+	}
+	if !b.armed {
+		b.armed = true
+		if err := b.rc.SetReadDeadline(time.Now().Add(b.timeout)); err != nil {
+			// 不支持设置期限，之后按原样读取
+			b.done = true
+			return b.body.Read(p)
+		}
+	}
+
+	n, err := b.body.Read(p)
+	b.progress += n
+	if b.progress >= minBodyReadProgress {
+		b.progress = 0
+		_ = b.rc.SetReadDeadline(time.Now().Add(b.timeout))
+	}
+	if err != nil {
+		b.clear()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, errClientBodyTimeout
+		}
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	b.clear()
+	return b.body.Close()
+}
+
+// clear 清除读取期限
+func (b *deadlineBody) clear() {
+	if b.armed && !b.done {
+		_ = b.rc.SetReadDeadline(time.Time{})
+	}
+	b.done = true
+}
+
+// rejectSlowBody 以408回应请求体发送过慢的调用方
+func (p *SinglePortProxy) rejectSlowBody(w http.ResponseWriter, ip, key string) {
+	clientBodyTimeoutsCounter.Inc()
+	logger.Warn("Public request body arrived too slowly",
+		"client_ip", ip,
+		"key", key,
+		"timeout", p.bodyReadTimeout())
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Request Timeout", http.StatusRequestTimeout)
+}
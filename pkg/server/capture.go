@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/utils"
+)
+
+// 抓包默认参数
+const (
+	defaultCaptureDuration = 5 * time.Minute
+	defaultCaptureMaxBytes = 10 * 1024 * 1024
+	defaultCaptureBodyMax  = 64 * 1024 // 每个响应最多记录的body字节数
+	captureQueueSize       = 256
+)
+
+// captureRecord 是写入抓包文件的一段数据
+type captureRecord struct {
+	requestID uint64
+	kind      string // "request" 或 "response"
+	data      []byte
+}
+
+// captureSession 表示一个key上正在进行的抓包
+type captureSession struct {
+	key         string
+	dir         string
+	startedAt   time.Time
+	expiresAt   time.Time
+	maxBytes    int64
+	bodyMax     int
+	written     atomic.Int64
+	dropped     atomic.Int64
+	records     chan captureRecord
+	stopCh      chan struct{}
+	stopOnce    sync.Once
+	timer       *time.Timer
+	bodyCapture sync.Map // requestID -> 已记录的body字节数
+}
+
+// captureStatus 是抓包状态的JSON描述
+type captureStatus struct {
+	Key          string    `json:"key"`
+	Dir          string    `json:"dir"`
+	StartedAt    time.Time `json:"started_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MaxBytes     int64     `json:"max_bytes"`
+	WrittenBytes int64     `json:"written_bytes"`
+	Dropped      int64     `json:"dropped_records"`
+}
+
+// captureManager 管理所有key的抓包会话
+type captureManager struct {
+	mu       sync.RWMutex
+	sessions map[string]*captureSession
+	active   atomic.Int32 // 快速判断是否存在抓包，避免热路径加锁
+}
+
+func newCaptureManager() *captureManager {
+	return &captureManager{sessions: make(map[string]*captureSession)}
+}
+
+// start 为key开始抓包，已存在的抓包会先被停止
+func (m *captureManager) start(baseDir, key string, duration time.Duration, maxBytes int64, bodyMax int) (*captureSession, error) {
+	if duration <= 0 {
+		duration = defaultCaptureDuration
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCaptureMaxBytes
+	}
+	if bodyMax <= 0 {
+		bodyMax = defaultCaptureBodyMax
+	}
+
+	dir := filepath.Join(baseDir, key)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %v", err)
+	}
+
+	now := time.Now()
+	s := &captureSession{
+		key:       key,
+		dir:       dir,
+		startedAt: now,
+		expiresAt: now.Add(duration),
+		maxBytes:  maxBytes,
+		bodyMax:   bodyMax,
+		records:   make(chan captureRecord, captureQueueSize),
+		stopCh:    make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if old, ok := m.sessions[key]; ok {
+		old.stop()
+	} else {
+		m.active.Add(1)
+	}
+	m.sessions[key] = s
+	m.mu.Unlock()
+
+	s.timer = time.AfterFunc(duration, func() { m.stop(key, s) })
+	go s.writeLoop(func() { m.stop(key, s) })
+
+	logger.Info("Capture started",
+		"key", key,
+		"dir", dir,
+		"duration", duration,
+		"max_bytes", maxBytes)
+	return s, nil
+}
+
+// stop 停止指定会话，session为nil时停止该key的当前会话
+func (m *captureManager) stop(key string, s *captureSession) *captureSession {
+	m.mu.Lock()
+	current, ok := m.sessions[key]
+	if ok && (s == nil || current == s) {
+		delete(m.sessions, key)
+		m.active.Add(-1)
+	} else {
+		current = s
+	}
+	m.mu.Unlock()
+
+	if current != nil {
+		current.stop()
+	}
+	return current
+}
+
+// get 返回key上正在进行的抓包
+func (m *captureManager) get(key string) *captureSession {
+	if m.active.Load() == 0 {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sessions[key]
+}
+
+func (s *captureSession) stop() {
+	s.stopOnce.Do(func() {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		close(s.stopCh)
+		logger.Info("Capture stopped",
+			"key", s.key,
+			"written_bytes", s.written.Load(),
+			"dropped_records", s.dropped.Load())
+	})
+}
+
+func (s *captureSession) status() captureStatus {
+	return captureStatus{
+		Key:          s.key,
+		Dir:          s.dir,
+		StartedAt:    s.startedAt,
+		ExpiresAt:    s.expiresAt,
+		MaxBytes:     s.maxBytes,
+		WrittenBytes: s.written.Load(),
+		Dropped:      s.dropped.Load(),
+	}
+}
+
+// enqueue 非阻塞地提交一条记录，队列满时丢弃并计数
+func (s *captureSession) enqueue(rec captureRecord) {
+	select {
+	case <-s.stopCh:
+		return
+	default:
+	}
+
+	select {
+	case s.records <- rec:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// captureRequest 记录脱敏后的序列化请求
+func (s *captureSession) captureRequest(requestID uint64, serialized []byte) {
+	s.enqueue(captureRecord{requestID: requestID, kind: "request", data: redactHeaderBlock(serialized)})
+}
+
+// captureResponse 记录脱敏后的响应头，若payload中带有body则按上限截取
+func (s *captureSession) captureResponse(requestID uint64, payload []byte) {
+	header, body := payload, []byte(nil)
+	if idx := bytes.Index(payload, []byte("\r\n\r\n")); idx >= 0 {
+		header, body = payload[:idx+4], payload[idx+4:]
+	}
+	s.enqueue(captureRecord{requestID: requestID, kind: "response", data: redactHeaderBlock(header)})
+	s.captureResponseBody(requestID, body)
+}
+
+// captureResponseBody 记录响应body的前 bodyMax 字节
+func (s *captureSession) captureResponseBody(requestID uint64, chunk []byte) {
+	captured := 0
+	if v, ok := s.bodyCapture.Load(requestID); ok {
+		captured = v.(int)
+	}
+	remaining := s.bodyMax - captured
+	if remaining <= 0 || len(chunk) == 0 {
+		return
+	}
+	if len(chunk) > remaining {
+		chunk = chunk[:remaining]
+	}
+	s.bodyCapture.Store(requestID, captured+len(chunk))
+	s.enqueue(captureRecord{requestID: requestID, kind: "response", data: bytes.Clone(chunk)})
+}
+
+// finishResponse 清理单个请求的body计数
+func (s *captureSession) finishResponse(requestID uint64) {
+	s.bodyCapture.Delete(requestID)
+}
+
+// writeLoop 将记录追加到文件，超出字节预算时结束抓包
+func (s *captureSession) writeLoop(onBudgetExceeded func()) {
+	prefix := s.startedAt.Format("20060102-150405")
+	for {
+		select {
+		case rec := <-s.records:
+			name := filepath.Join(s.dir, fmt.Sprintf("%s-%06d-%s.http", prefix, rec.requestID, rec.kind))
+			if err := appendFile(name, rec.data); err != nil {
+				logger.Error("Failed to write capture record",
+					"key", s.key,
+					"file", name,
+					"error", err)
+				continue
+			}
+			if s.written.Add(int64(len(rec.data))) >= s.maxBytes {
+				onBudgetExceeded()
+				return
+			}
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func appendFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// redactHeaderBlock 对HTTP消息头部中的敏感头脱敏，body保持不变
+func redactHeaderBlock(data []byte) []byte {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		headerEnd = len(data)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	lines := strings.Split(string(data[:headerEnd]), "\r\n")
+	for i, line := range lines {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		if name, _, ok := strings.Cut(line, ":"); ok && i > 0 && utils.IsSensitiveHeader(strings.TrimSpace(name)) {
+			buf.WriteString(name + ": [REDACTED]")
+			continue
+		}
+		buf.WriteString(line)
+	}
+	buf.Write(data[headerEnd:])
+	return buf.Bytes()
+}
+
+// captureRequestBody 是开启抓包的请求参数
+type captureRequestBody struct {
+	Duration     string `json:"duration"`
+	MaxBytes     int64  `json:"max_bytes"`
+	MaxBodyBytes int    `json:"max_body_bytes"`
+}
+
+// captureDir 返回抓包根目录
+func (p *SinglePortProxy) captureDir() string {
+	if p.config.CaptureDir != "" {
+		return p.config.CaptureDir
+	}
+	return filepath.Join(os.TempDir(), "singleproxy-captures")
+}
+
+// handleAdminCaptureStart 为指定key开启抓包
+func (p *SinglePortProxy) handleAdminCaptureStart(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !authorizeKey(w, r, key) {
+		return
+	}
+	// key 将被用作目录名，必须通过语法校验
+	if err := p.keyValidator.Validate(key); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var body captureRequestBody
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+	}
+
+	var duration time.Duration
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration"})
+			return
+		}
+		duration = d
+	}
+
+	s, err := p.captures.start(p.captureDir(), key, duration, body.MaxBytes, body.MaxBodyBytes)
+	if err != nil {
+		logger.Error("Failed to start capture",
+			"key", key,
+			"error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, s.status())
+}
+
+// handleAdminCaptureStatus 返回指定key的抓包状态
+func (p *SinglePortProxy) handleAdminCaptureStatus(w http.ResponseWriter, r *http.Request) {
+	if !authorizeKey(w, r, r.PathValue("key")) {
+		return
+	}
+	s := p.captures.get(r.PathValue("key"))
+	if s == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no active capture"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+// handleAdminCaptureStop 提前结束指定key的抓包
+func (p *SinglePortProxy) handleAdminCaptureStop(w http.ResponseWriter, r *http.Request) {
+	if !authorizeKey(w, r, r.PathValue("key")) {
+		return
+	}
+	s := p.captures.stop(r.PathValue("key"), nil)
+	if s == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no active capture"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.status())
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+)
+
+// certStore 按SNI选择证书。证书在启动时全部加载，重新加载时整体替换，
+// 任一文件加载失败则保留原有证书
+type certStore struct {
+	cfg *config.Config
+
+	mu    sync.RWMutex
+	def   *tls.Certificate            // 默认证书 (-cert/-key-file)，未配置时为nil
+	hosts map[string]*tls.Certificate // 小写主机名 -> 证书，包含 "*.example.com" 通配
+}
+
+// newCertStore 加载默认证书和所有主机名证书
+func newCertStore(cfg *config.Config) (*certStore, error) {
+	s := &certStore{cfg: cfg}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadClientCAs 读取用于验证客户端证书的CA文件 (-tls-client-ca)
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in TLS client CA %s", file)
+	}
+	return pool, nil
+}
+
+// reload 重新读取所有证书文件，用于证书续期后不重启服务器替换证书
+func (s *certStore) reload() error {
+	var def *tls.Certificate
+	if s.cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		def = &cert
+	}
+	hosts := make(map[string]*tls.Certificate)
+	for host, h := range s.cfg.Hosts {
+		if h == nil || h.CertFile == "" {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(h.CertFile, h.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate for host %s: %v", host, err)
+		}
+		hosts[strings.ToLower(host)] = &cert
+	}
+
+	s.mu.Lock()
+	s.def = def
+	s.hosts = hosts
+	s.mu.Unlock()
+	return nil
+}
+
+// getCertificate 是 tls.Config.GetCertificate 的实现：先精确匹配主机名，再匹配上一级的通配，
+// 都没有时按 tls_unknown_sni 使用默认证书或中止握手
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert, ok := lookupHostName(s.hosts, name); ok {
+		return cert, nil
+	}
+	if s.def != nil && s.cfg.TLSUnknownSNI != "reject" {
+		return s.def, nil
+	}
+	unknownSNICounter.Inc()
+	logger.Warn("Rejected TLS handshake for unknown server name",
+		"server_name", hello.ServerName,
+		"remote_addr", hello.Conn.RemoteAddr())
+	return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+}
+
+// certInfo 是管理API中单个证书的描述
+type certInfo struct {
+	Host     string    `json:"host"`
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// list 返回当前加载的证书，默认证书的主机名为 "default"
+func (s *certStore) list() []certInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var infos []certInfo
+	add := func(host string, cert *tls.Certificate) {
+		info := certInfo{Host: host}
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			info.Subject = leaf.Subject.CommonName
+			info.NotAfter = leaf.NotAfter
+		}
+		infos = append(infos, info)
+	}
+	if s.def != nil {
+		add("default", s.def)
+	}
+	hosts := make([]string, 0, len(s.hosts))
+	for host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		add(host, s.hosts[host])
+	}
+	return infos
+}
+
+// newHostRoutes 从主机名配置中提取静态路由: 小写主机名 -> 隧道key
+func newHostRoutes(hosts map[string]*config.HostConfig) map[string]string {
+	routes := make(map[string]string)
+	for host, h := range hosts {
+		if h != nil && h.TunnelKey != "" {
+			routes[strings.ToLower(host)] = h.TunnelKey
+		}
+	}
+	return routes
+}
+
+// lookupHostName 按主机名查找，先精确匹配，再匹配上一级的 "*.example.com" 通配。name 需为小写
+func lookupHostName[T any](m map[string]T, name string) (T, bool) {
+	if v, ok := m[name]; ok {
+		return v, true
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if v, ok := m["*"+name[i:]]; ok {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// handleAdminTLSReload 重新加载所有证书文件，加载失败时继续使用原有证书
+func (p *SinglePortProxy) handleAdminTLSReload(w http.ResponseWriter, r *http.Request) {
+	if !requireFullAdmin(w, r) {
+		return
+	}
+	if p.certs == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "tls not enabled"})
+		return
+	}
+	if err := p.certs.reload(); err != nil {
+		logger.Error("Failed to reload TLS certificates", "error", err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	logger.Info("TLS certificates reloaded", "certificates", len(p.certs.list()))
+	writeJSON(w, http.StatusOK, map[string]any{"certificates": p.certs.list()})
+}
+
+// handleAdminTLS 列出当前加载的证书及其有效期
+func (p *SinglePortProxy) handleAdminTLS(w http.ResponseWriter, r *http.Request) {
+	if !requireFullAdmin(w, r) {
+		return
+	}
+	infos := []certInfo{}
+	if p.certs != nil {
+		infos = p.certs.list()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"certificates": infos})
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+)
+
+// targetCheckTimeout 等待客户端返回目标服务检查结果的时间
+const targetCheckTimeout = 10 * time.Second
+
+// targetCheckRegistry 等待客户端返回的目标服务检查
+type targetCheckRegistry struct {
+	mu      sync.Mutex
+	pending map[uint64]chan protocol.TargetCheckResult
+}
+
+func newTargetCheckRegistry() *targetCheckRegistry {
+	return &targetCheckRegistry{pending: make(map[uint64]chan protocol.TargetCheckResult)}
+}
+
+func (r *targetCheckRegistry) register(id uint64) chan protocol.TargetCheckResult {
+	ch := make(chan protocol.TargetCheckResult, 1)
+	r.mu.Lock()
+	r.pending[id] = ch
+	r.mu.Unlock()
+	return ch
+}
+
+func (r *targetCheckRegistry) unregister(id uint64) {
+	r.mu.Lock()
+	delete(r.pending, id)
+	r.mu.Unlock()
+}
+
+// deliver 将客户端返回的结果交给等待方，检查已超时时丢弃
+func (r *targetCheckRegistry) deliver(id uint64, res protocol.TargetCheckResult) bool {
+	r.mu.Lock()
+	ch, ok := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if ok {
+		ch <- res
+	}
+	return ok
+}
+
+// adminTargetCheck 管理API中单个连接的目标服务检查结果
+type adminTargetCheck struct {
+	ConnectionID string `json:"connection_id"`
+	protocol.TargetCheckResult
+}
+
+// handleAdminTargetCheck 要求该key的每个连接检查能否访问目标服务，
+// 请求体可选 {"path": "/healthz"}，为空时只检查TCP连接
+func (p *SinglePortProxy) handleAdminTargetCheck(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !authorizeKey(w, r, key) {
+		return
+	}
+	var req protocol.TargetCheckRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+	}
+
+	p.connsMu.RLock()
+	var conns []*tunnelConn
+	if pool := p.clientConns[key]; pool != nil {
+		conns = pool.conns
+	}
+	p.connsMu.RUnlock()
+	if len(conns) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no WebSocket tunnel connected for key", "key": key})
+		return
+	}
+
+	// 并行检查所有连接
+	results := make([]adminTargetCheck, len(conns))
+	var wg sync.WaitGroup
+	for i, tc := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = adminTargetCheck{ConnectionID: tc.id, TargetCheckResult: p.checkTarget(tc, req)}
+		}()
+	}
+	wg.Wait()
+
+	logger.Info("Tunnel target check completed",
+		"key", key,
+		"path", req.Path,
+		"connections", len(conns))
+	writeJSON(w, http.StatusOK, map[string]any{"key": key, "results": results})
+}
+
+// checkTarget 向连接发送目标服务检查并等待结果
+func (p *SinglePortProxy) checkTarget(tc *tunnelConn, req protocol.TargetCheckRequest) protocol.TargetCheckResult {
+	if !tc.targetCheckSupported {
+		return protocol.TargetCheckResult{Error: "client does not support target checks; upgrade the client"}
+	}
+	payload, err := protocol.EncodeTargetCheckRequest(req)
+	if err != nil {
+		return protocol.TargetCheckResult{Error: err.Error()}
+	}
+
+	id := atomic.AddUint64(&p.nextRequestID, 1)
+	ch := p.targetChecks.register(id)
+	defer p.targetChecks.unregister(id)
+	if err := tc.sendTunnelMessage(protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_TARGET_CHECK, Payload: payload}); err != nil {
+		return protocol.TargetCheckResult{Error: "failed to send check to client: " + err.Error()}
+	}
+
+	timer := time.NewTimer(targetCheckTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res
+	case <-timer.C:
+		return protocol.TargetCheckResult{Error: "timed out waiting for the client"}
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+// 同一IPv4客户端经双栈监听器以映射地址到达时，与普通IPv4连接共用一个限速器
+func TestPublicRequestClientIPNormalized(t *testing.T) {
+	p := NewSinglePortProxy(&config.Config{Mode: "server", IPRateLimit: 1, DefaultKey: "none"})
+	remotes := []struct{ addr, canonical string }{
+		{"203.0.113.7:1000", "203.0.113.7:1000"},
+		{"[::ffff:203.0.113.7]:1001", "203.0.113.7:1001"},
+		{"[::ffff:cb00:7107]:1002", "203.0.113.7:1002"},
+	}
+	var codes []int
+	for _, remote := range remotes {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = remote.addr
+		rec := httptest.NewRecorder()
+		p.handlePublicHTTPRequest(rec, req)
+		codes = append(codes, rec.Code)
+		if req.RemoteAddr != remote.canonical {
+			t.Errorf("Expected RemoteAddr %s to be rewritten to %s, got %s", remote.addr, remote.canonical, req.RemoteAddr)
+		}
+	}
+	// 突发为 2N，第三个请求被限速
+	if codes[2] != http.StatusTooManyRequests || codes[1] == http.StatusTooManyRequests {
+		t.Errorf("Expected only the third request to be rate limited, got %v", codes)
+	}
+	if len(p.ipLimiters) != 1 {
+		t.Errorf("Expected one limiter for all representations, got %d", len(p.ipLimiters))
+	}
+
+	// 带 zone 的链路本地地址去掉 zone
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "[fe80::1%eth0]:2000"
+	p.handlePublicHTTPRequest(httptest.NewRecorder(), req)
+	if _, ok := p.ipLimiters["fe80::1"]; !ok {
+		t.Errorf("Expected zone to be dropped from the limiter key, got RemoteAddr %s", req.RemoteAddr)
+	}
+}
+
+func TestRegistrationAccessIPv6(t *testing.T) {
+	a := newRegistrationAccess(&config.Config{RegistrationAllowedCIDRs: []string{"10.8.0.0/24", "fe80::/64"}})
+	tests := []struct {
+		remote string
+		want   bool
+	}{
+		{"10.8.0.5:4000", true},
+		{"[::ffff:10.8.0.5]:4000", true},
+		{"[fe80::1%wg0]:4000", true},
+		{"[2001:db8::1]:4000", false},
+		{"[::ffff:10.9.0.5]:4000", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/ws/key", nil)
+		req.RemoteAddr = tt.remote
+		if ok, _ := a.allowed(req); ok != tt.want {
+			t.Errorf("allowed(%s) = %v, expected %v", tt.remote, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/dnscache"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/utils"
+)
+
+const (
+	// headerClusterToken 服务器之间请求携带的共享令牌
+	headerClusterToken = "X-Cluster-Token"
+	// headerClusterHop 标记由其他服务器转发的公网请求，带有该头和正确令牌的请求不会再次转发，避免两台服务器互相转发；转发给目标服务前移除
+	headerClusterHop = "X-Cluster-Hop"
+	// clusterKeysPath 其他服务器拉取本机key列表的地址
+	clusterKeysPath = "/cluster/keys"
+	// defaultClusterSyncInterval 未配置 -cluster-sync-interval 时拉取key列表的间隔
+	defaultClusterSyncInterval = 5 * time.Second
+	// clusterStaleIntervals 连续该数量的间隔没有拉取成功时不再使用该服务器的key列表
+	clusterStaleIntervals = 3
+)
+
+var (
+	clusterRequestsCounter = metrics.NewCounterVec("singleproxy_server_cluster_requests_total",
+		"Public requests in cluster mode, by route: local (local tunnel), from_peer (local tunnel, forwarded by a peer), to_peer (forwarded to the peer that has the key), to_peer_failed", "route")
+	clusterSyncFailuresCounter = metrics.NewCounter("singleproxy_server_cluster_sync_failures_total",
+		"Failed key list fetches from cluster peers")
+)
+
+// clusterTransport 转发到其他服务器的共用连接池，主机名经DNS缓存解析
+var clusterTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dnscache.DialContext
+	return t
+}()
+
+// clusterPeer 一台其他服务器及最近一次拉取到的key列表
+type clusterPeer struct {
+	target *url.URL
+
+	mu      sync.RWMutex
+	keys    map[string]bool
+	synced  time.Time // 最近一次拉取成功的时间
+	lastErr string
+}
+
+// cluster 服务器之间的 key→服务器 映射。每台服务器定期拉取其他服务器当前在线的key，
+// 本机没有该key的隧道时把公网请求转发到拥有它的服务器
+type cluster struct {
+	token    string
+	interval time.Duration
+	peers    []*clusterPeer
+	client   *http.Client
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newCluster 未配置 -cluster-token 时返回nil。配置了其他服务器时启动拉取协程
+func newCluster(cfg *config.Config) *cluster {
+	if cfg.ClusterToken == "" {
+		return nil
+	}
+	c := &cluster{
+		token:    cfg.ClusterToken,
+		interval: cfg.ClusterSyncInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if c.interval <= 0 {
+		c.interval = defaultClusterSyncInterval
+	}
+	c.client = &http.Client{Transport: clusterTransport, Timeout: c.interval}
+	for _, peer := range cfg.ClusterPeers {
+		target, err := url.Parse(strings.TrimSuffix(peer, "/"))
+		if err != nil {
+			logger.Error("Invalid cluster peer, ignoring", "peer", peer, "error", err)
+			continue
+		}
+		c.peers = append(c.peers, &clusterPeer{target: target})
+	}
+	if len(c.peers) == 0 {
+		close(c.done)
+		return c
+	}
+	logger.Info("Cluster mode enabled",
+		"peers", len(c.peers),
+		"sync_interval", c.interval)
+	go c.run()
+	return c
+}
+
+func (c *cluster) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.syncAll()
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// close 停止拉取协程，c 为nil时不做任何事
+func (c *cluster) close() {
+	if c == nil {
+		return
+	}
+	c.closeOnce.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+// syncAll 并发拉取所有服务器的key列表
+func (c *cluster) syncAll() {
+	var wg sync.WaitGroup
+	for _, peer := range c.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.sync(peer)
+		}()
+	}
+	wg.Wait()
+}
+
+// sync 拉取一台服务器的key列表，失败时保留上一次的结果直到过期
+func (c *cluster) sync(peer *clusterPeer) {
+	keys, err := c.fetchKeys(peer)
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if err != nil {
+		clusterSyncFailuresCounter.Inc()
+		if peer.lastErr != err.Error() {
+			logger.Warn("Failed to fetch keys from cluster peer",
+				"peer", peer.target.String(),
+				"error", err)
+		}
+		peer.lastErr = err.Error()
+		return
+	}
+	if peer.lastErr != "" {
+		logger.Info("Cluster peer reachable again", "peer", peer.target.String(), "keys", len(keys))
+	}
+	peer.keys = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		peer.keys[key] = true
+	}
+	peer.synced = time.Now()
+	peer.lastErr = ""
+}
+
+func (c *cluster) fetchKeys(peer *clusterPeer) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, peer.target.String()+clusterKeysPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headerClusterToken, c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var body struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Keys, nil
+}
+
+// lookup 返回最近拉取的列表中拥有该key的服务器，列表已过期的服务器不参与
+func (c *cluster) lookup(key string, now time.Time) *clusterPeer {
+	for _, peer := range c.peers {
+		peer.mu.RLock()
+		ok := peer.keys[key] && now.Sub(peer.synced) < clusterStaleIntervals*c.interval
+		peer.mu.RUnlock()
+		if ok {
+			return peer
+		}
+	}
+	return nil
+}
+
+// forget 转发失败时从该服务器的列表中移除key，下一次拉取前不再转发
+func (peer *clusterPeer) forget(key string) {
+	peer.mu.Lock()
+	delete(peer.keys, key)
+	peer.mu.Unlock()
+}
+
+// authorized 检查请求是否携带正确的集群令牌，c 为nil时总是返回 false
+func (c *cluster) authorized(r *http.Request) bool {
+	if c == nil {
+		return false
+	}
+	token := r.Header.Get(headerClusterToken)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1
+}
+
+// fromPeer 判断公网请求是否由集群中的其他服务器转发，并移除请求中的集群令牌和转发标记，它们不会转发给目标服务
+func (c *cluster) fromPeer(r *http.Request) bool {
+	ok := r.Header.Get(headerClusterHop) != "" && c.authorized(r)
+	r.Header.Del(headerClusterToken)
+	r.Header.Del(headerClusterHop)
+	return ok
+}
+
+// peerClientIP 返回转发方记录的公网调用方地址 (X-Forwarded-For 的最后一项)
+func peerClientIP(r *http.Request) (string, bool) {
+	xff := r.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		return "", false
+	}
+	entries := strings.Split(xff[len(xff)-1], ",")
+	addr, ok := utils.ParseClientIP(strings.TrimSpace(entries[len(entries)-1]))
+	if !ok {
+		return "", false
+	}
+	return addr.String(), true
+}
+
+// localKeys 返回本机有在线隧道的key
+func (p *SinglePortProxy) localKeys() []string {
+	seen := make(map[string]bool)
+	p.connsMu.RLock()
+	for key := range p.clientConns {
+		seen[key] = true
+	}
+	p.connsMu.RUnlock()
+	p.httpTunnelMgr.mu.RLock()
+	for key := range p.httpTunnelMgr.clients {
+		seen[key] = true
+	}
+	p.httpTunnelMgr.mu.RUnlock()
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// handleCluster 处理其他服务器的请求，令牌不正确时返回404，不暴露入口的存在
+func (p *SinglePortProxy) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != clusterKeysPath || r.Method != http.MethodGet || !p.cluster.authorized(r) {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": p.localKeys()})
+}
+
+// peerRequestBody 转发给其他服务器的请求体，记录是否已被读取。出站请求结束时不关闭原始请求体，
+// 转发失败而请求体还没有被读取时仍可交给备用地址
+type peerRequestBody struct {
+	io.ReadCloser
+	read atomic.Bool
+}
+
+func (b *peerRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.read.Store(true)
+	}
+	return n, err
+}
+
+func (b *peerRequestBody) Close() error {
+	return nil
+}
+
+// serveFromPeer 本机没有该key的隧道时，把请求转发到拥有它的服务器，保留 X-Tunnel-Key 头。
+// 未启用集群或没有服务器拥有该key时返回 false，请求本身由其他服务器转发时调用方不应再转发；
+// 转发失败时依次尝试备用地址 (请求体已部分发出时跳过) 和离线页面，并在本次请求中返回错误
+func (p *SinglePortProxy) serveFromPeer(w http.ResponseWriter, r *http.Request, key, clientIP string) bool {
+	if p.cluster == nil {
+		return false
+	}
+	peer := p.cluster.lookup(key, time.Now())
+	if peer == nil {
+		return false
+	}
+
+	out := r
+	var body *peerRequestBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &peerRequestBody{ReadCloser: r.Body}
+		out = r.WithContext(r.Context())
+		out.Body = body
+	}
+
+	startTime := time.Now()
+	failed := false
+	proxy := &httputil.ReverseProxy{
+		Transport: clusterTransport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(peer.target)
+			pr.SetXForwarded()
+			pr.Out.Host = pr.In.Host
+			pr.Out.Header.Set("X-Tunnel-Key", key)
+			pr.Out.Header.Set(headerClusterHop, "1")
+			pr.Out.Header.Set(headerClusterToken, p.cluster.token)
+		},
+		// 出站请求已带有集群令牌，回退时使用原始请求。请求体已有部分发给该服务器时无法重新发送，不回退到备用地址
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			failed = true
+			peer.forget(key)
+			bodySent := body != nil && body.read.Load()
+			logger.Warn("Failed to forward request to cluster peer",
+				"client_ip", clientIP,
+				"key", key,
+				"peer", peer.target.String(),
+				"body_sent", bodySent,
+				"error", err)
+			if !bodySent && p.serveFallback(w, r, key, clientIP) {
+				return
+			}
+			if !p.serveOffline(w, r, key) {
+				p.writeProxyError(w, proxyErrPeerUnreachable)
+			}
+		},
+	}
+	proxy.ServeHTTP(w, out)
+
+	if failed {
+		clusterRequestsCounter.WithLabelValue("to_peer_failed").Inc()
+		return true
+	}
+	clusterRequestsCounter.WithLabelValue("to_peer").Inc()
+	status := 0
+	if uw, ok := w.(*usageWriter); ok {
+		status = uw.status
+	}
+	logger.Debug("Request forwarded to cluster peer",
+		"client_ip", clientIP,
+		"key", key,
+		"method", r.Method,
+		"url", utils.SanitizeURL(r.URL),
+		"peer", peer.target.String(),
+		"status", status,
+		"duration", time.Since(startTime))
+	return true
+}
+
+// handleAdminCluster 返回集群中其他服务器的状态和最近拉取到的key数
+func (p *SinglePortProxy) handleAdminCluster(w http.ResponseWriter, r *http.Request) {
+	if !requireFullAdmin(w, r) {
+		return
+	}
+	if p.cluster == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "cluster not enabled"})
+		return
+	}
+	type peerStatus struct {
+		Peer   string    `json:"peer"`
+		Keys   []string  `json:"keys"`
+		Synced time.Time `json:"synced"`
+		Error  string    `json:"error,omitempty"`
+	}
+	peers := make([]peerStatus, 0, len(p.cluster.peers))
+	for _, peer := range p.cluster.peers {
+		peer.mu.RLock()
+		ps := peerStatus{Peer: peer.target.String(), Keys: make([]string, 0, len(peer.keys)), Synced: peer.synced, Error: peer.lastErr}
+		for key := range peer.keys {
+			ps.Keys = append(ps.Keys, key)
+		}
+		peer.mu.RUnlock()
+		sort.Strings(ps.Keys)
+		peers = append(peers, ps)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"local_keys":    p.localKeys(),
+		"sync_interval": p.cluster.interval.String(),
+		"peers":         peers,
+	})
+}
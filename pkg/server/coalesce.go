@@ -0,0 +1,69 @@
+package server
+
+import (
+	"time"
+
+	"singleproxy/pkg/metrics"
+)
+
+// defaultChunkCoalesceDelay 合并的数据块最长等待时间
+const defaultChunkCoalesceDelay = 5 * time.Millisecond
+
+var coalescedFlushesCounter = metrics.NewCounterVec("singleproxy_server_coalesced_flushes_total",
+	"Coalesced response body writes to public clients, by trigger (size, delay, end)", "trigger")
+
+// coalescing 判断响应体数据块是否合并写出。事件流逐条送达，不合并
+func (h *streamHandler) coalescing() bool {
+	return h.coalesceBytes > 0 && !h.sse
+}
+
+// writeChunk 写入一个响应体数据块。不合并时立即写出并刷新；合并时先缓冲，
+// 累计达到 coalesceBytes 时立即写出，否则最多等待 coalesceDelay。调用方需持有 mu
+func (h *streamHandler) writeChunk(p []byte) error {
+	if !h.coalescing() {
+		err := h.writeBody(p)
+		h.flusher.Flush()
+		return err
+	}
+	if h.body != nil {
+		p = h.body.Write(p)
+	}
+	h.pending = append(h.pending, p...)
+	if len(h.pending) >= h.coalesceBytes {
+		return h.flushPending("size")
+	}
+	if len(h.pending) > 0 && h.flushTimer == nil {
+		delay := h.coalesceDelay
+		if delay <= 0 {
+			delay = defaultChunkCoalesceDelay
+		}
+		h.flushTimer = time.AfterFunc(delay, h.flushDelayed)
+	}
+	return nil
+}
+
+// flushPending 写出并刷新缓冲的数据块。调用方需持有 mu
+func (h *streamHandler) flushPending(trigger string) error {
+	if h.flushTimer != nil {
+		h.flushTimer.Stop()
+		h.flushTimer = nil
+	}
+	if len(h.pending) == 0 {
+		return nil
+	}
+	coalescedFlushesCounter.WithLabelValue(trigger).Inc()
+	h.lastWrite = time.Now()
+	_, err := h.writer.Write(h.pending)
+	h.pending = h.pending[:0]
+	h.flusher.Flush()
+	return err
+}
+
+// flushDelayed 等待时间到期后写出缓冲的数据块，处理器已结束时不做任何事
+func (h *streamHandler) flushDelayed() {
+	if !h.acquire() {
+		return
+	}
+	defer h.mu.Unlock()
+	_ = h.flushPending("delay")
+}
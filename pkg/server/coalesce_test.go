@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingConn 统计写入连接的次数，原始连接上每次写入对应一次 write 系统调用
+type countingConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// newRawStreamHandler 创建写入原始连接的处理器，返回连接和读取端收到的全部数据
+func newRawStreamHandler(t testing.TB, coalesceBytes int, delay time.Duration) (*streamHandler, *countingConn, <-chan []byte) {
+	server, client := net.Pipe()
+	conn := &countingConn{Conn: server}
+	w := &httpResponseWriter{conn: conn, header: make(http.Header), headerWritten: true}
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		received <- data
+	}()
+	t.Cleanup(func() { server.Close(); client.Close() })
+	h := &streamHandler{
+		writer:        w,
+		flusher:       w,
+		done:          make(chan struct{}),
+		headersSent:   true,
+		coalesceBytes: coalesceBytes,
+		coalesceDelay: delay,
+	}
+	return h, conn, received
+}
+
+func TestChunkCoalescing(t *testing.T) {
+	h, conn, received := newRawStreamHandler(t, 1024, time.Hour)
+	var want bytes.Buffer
+	h.mu.Lock()
+	for i := 0; i < 100; i++ {
+		line := []byte(strings.Repeat("x", 40) + "\n")
+		want.Write(line)
+		if err := h.writeChunk(line); err != nil {
+			t.Fatalf("writeChunk failed: %v", err)
+		}
+	}
+	if err := h.closeBody(); err != nil {
+		t.Fatalf("closeBody failed: %v", err)
+	}
+	h.finishLocked()
+	h.mu.Unlock()
+	conn.Close()
+
+	if got := <-received; !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("Expected %d bytes in order, got %d", want.Len(), len(got))
+	}
+	// 每 25 行 (1025 字节) 达到阈值写出一次，共 4 次
+	if n := conn.writes.Load(); n != 4 {
+		t.Errorf("Expected 4 coalesced writes, got %d", n)
+	}
+}
+
+func TestChunkCoalescingDelay(t *testing.T) {
+	h, conn, received := newRawStreamHandler(t, 1<<20, 20*time.Millisecond)
+	h.mu.Lock()
+	h.writeChunk([]byte("first\n"))
+	h.mu.Unlock()
+
+	// 未达到阈值的数据在等待时间到期后写出
+	deadline := time.Now().Add(2 * time.Second)
+	for conn.writes.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected buffered chunk to be written after the coalesce delay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// 事件流不合并，每个数据块立即写出
+	h.mu.Lock()
+	h.sse = true
+	h.writeChunk([]byte("data: x\n\n"))
+	writes := conn.writes.Load()
+	h.finishLocked()
+	h.mu.Unlock()
+	if writes != 2 {
+		t.Errorf("Expected event stream chunk to bypass coalescing, got %d writes", writes)
+	}
+	conn.Close()
+	if got := string(<-received); got != "first\ndata: x\n\n" {
+		t.Errorf("Unexpected body %q", got)
+	}
+}
+
+// BenchmarkChunkCoalescing 目标服务逐行输出时，每行一个数据块写入原始连接。
+// writes/op 为每个响应的写入 (系统调用) 次数
+func BenchmarkChunkCoalescing(b *testing.B) {
+	line := []byte(`{"id":12345,"event":"tick","value":0.5}` + "\n")
+	const lines = 1000
+	for _, bc := range []struct {
+		name  string
+		bytes int
+	}{
+		{"off", 0},
+		{"16KB", 16 << 10},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			server, client := net.Pipe()
+			conn := &countingConn{Conn: server}
+			go io.Copy(io.Discard, client)
+			defer server.Close()
+			defer client.Close()
+			b.SetBytes(int64(len(line) * lines))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := &httpResponseWriter{conn: conn, header: make(http.Header), headerWritten: true}
+				h := &streamHandler{writer: w, flusher: w, done: make(chan struct{}), headersSent: true,
+					coalesceBytes: bc.bytes, coalesceDelay: time.Hour}
+				h.mu.Lock()
+				for j := 0; j < lines; j++ {
+					h.writeChunk(line)
+				}
+				h.closeBody()
+				h.finishLocked()
+				h.mu.Unlock()
+			}
+			b.ReportMetric(float64(conn.writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/utils"
+)
+
+const (
+	// defaultConnectIdleTimeout CONNECT 隧道两个方向都空闲多久后关闭 (-connect-idle-timeout)
+	defaultConnectIdleTimeout = 5 * time.Minute
+	// connectDialTimeout 连接 CONNECT 目标的超时
+	connectDialTimeout = 10 * time.Second
+)
+
+var (
+	connectTunnelsCounter = metrics.NewCounterVec("singleproxy_server_connect_tunnels_total",
+		"CONNECT forward proxy requests, by result (established, blocked, dial_failed, bad_target)", "result")
+	connectTunnelsActive = metrics.NewGauge("singleproxy_server_connect_tunnels_active",
+		"CONNECT tunnels currently relaying data")
+)
+
+// handleConnectProxy 处理 HTTP CONNECT 正向代理请求 (curl -x、浏览器的HTTPS代理设置)。
+// 与 /proxy/ 路径代理一样执行IP速率限制和目标地址策略，连接建立后接管公网连接，双向转发原始字节
+func (p *SinglePortProxy) handleConnectProxy(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	if p.servePaused(w, r, "proxy") {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	addr, ok := utils.ParseClientIP(host)
+	if err != nil || !ok {
+		logger.Error("Failed to parse remote address for CONNECT",
+			"remote_addr", r.RemoteAddr,
+			"error", err)
+		p.writeProxyError(w, proxyErrBadRemoteAddr)
+		return
+	}
+	ip := addr.String()
+	r.RemoteAddr = net.JoinHostPort(ip, port)
+
+	if !p.getIPLimiter(ip).Allow() {
+		logger.Warn("IP rate limited for CONNECT request",
+			"client_ip", ip,
+			"target_addr", r.Host)
+		p.rejectRateLimited(w, r, ip, "Too many requests from your IP")
+		return
+	}
+
+	// CONNECT 的请求目标是 authority-form (host:port)，端口不能省略
+	targetAddr := r.Host
+	targetHost, targetPort, err := net.SplitHostPort(targetAddr)
+	if err != nil || targetHost == "" || targetPort == "" {
+		connectTunnelsCounter.WithLabelValue("bad_target").Inc()
+		logger.Warn("Invalid CONNECT target",
+			"client_ip", ip,
+			"target_addr", targetAddr)
+		http.Error(w, "CONNECT target must be host:port", http.StatusBadRequest)
+		return
+	}
+
+	// 先检查解析结果，拨号时再检查实际连接的IP
+	ctx, cancel := context.WithTimeout(r.Context(), connectDialTimeout)
+	defer cancel()
+	err = p.destPolicy.check(ctx, targetHost)
+	var targetConn net.Conn
+	if err == nil {
+		targetConn, err = p.destPolicy.DialContext(ctx, "tcp", targetAddr)
+	}
+	if errors.Is(err, errDestinationBlocked) {
+		proxyBlockedCounter.Inc()
+		connectTunnelsCounter.WithLabelValue("blocked").Inc()
+		logger.Warn("Blocked CONNECT to disallowed destination",
+			"client_ip", ip,
+			"target_addr", targetAddr,
+			"error", err)
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		connectTunnelsCounter.WithLabelValue("dial_failed").Inc()
+		logger.Warn("Failed to connect to CONNECT target",
+			"client_ip", ip,
+			"target_addr", targetAddr,
+			"error", err)
+		p.writeProxyError(w, proxyErrUpstreamConnect)
+		return
+	}
+	defer targetConn.Close()
+
+	clientConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.Error("Failed to hijack connection for CONNECT",
+			"client_ip", ip,
+			"target_addr", targetAddr,
+			"error", err)
+		http.Error(w, "CONNECT is not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		logger.Debug("Failed to write CONNECT response",
+			"client_ip", ip,
+			"target_addr", targetAddr,
+			"error", err)
+		return
+	}
+	// 客户端在收到 200 之前已经发出的数据 (如 TLS ClientHello) 在读取请求时被缓冲，先转给目标
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		if _, err := targetConn.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	connectTunnelsCounter.WithLabelValue("established").Inc()
+	connectTunnelsActive.Inc()
+	defer connectTunnelsActive.Dec()
+	logger.Info("CONNECT tunnel established",
+		"client_ip", ip,
+		"target_addr", targetAddr)
+
+	idle := p.config.ConnectIdleTimeout
+	if idle <= 0 {
+		idle = defaultConnectIdleTimeout
+	}
+	up, down, reason := relayConnect(clientConn, targetConn, idle)
+	logger.Info("CONNECT tunnel closed",
+		"client_ip", ip,
+		"target_addr", targetAddr,
+		"bytes_up", up,
+		"bytes_down", down,
+		"reason", reason,
+		"duration", time.Since(startTime))
+}
+
+// relayConnect 在两个连接之间双向复制数据。任一方断开、写入失败，或两个方向都超过 idle 没有数据时，
+// 关闭两端并返回两个方向的字节数和结束原因
+func relayConnect(client, target net.Conn, idle time.Duration) (up, down int64, reason string) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	copyDir := func(dst, src net.Conn, closed string, n *int64) string {
+		buf := make([]byte, 32<<10)
+		for {
+			src.SetReadDeadline(time.Now().Add(idle))
+			nr, err := src.Read(buf)
+			if nr > 0 {
+				lastActive.Store(time.Now().UnixNano())
+				dst.SetWriteDeadline(time.Now().Add(idle))
+				if _, werr := dst.Write(buf[:nr]); werr != nil {
+					return "write_failed"
+				}
+				*n += int64(nr)
+			}
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					// 只有这个方向空闲，另一方向仍在传输 (如大文件下载) 时继续等待
+					if time.Since(time.Unix(0, lastActive.Load())) < idle {
+						continue
+					}
+					return "idle_timeout"
+				}
+				return closed
+			}
+		}
+	}
+
+	done := make(chan string, 2)
+	go func() { done <- copyDir(target, client, "client_closed", &up) }()
+	go func() { done <- copyDir(client, target, "target_closed", &down) }()
+	reason = <-done
+	// 一方结束后关闭两端，另一个方向的读取随之返回
+	client.Close()
+	target.Close()
+	<-done
+	return up, down, reason
+}
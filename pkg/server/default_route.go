@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/utils"
+)
+
+// defaultRouteLogInterval 同一来源IP使用默认路由时，该时间内只输出一条 Info 日志
+const defaultRouteLogInterval = time.Hour
+
+var defaultKeyRequestsCounter = metrics.NewCounterVec("singleproxy_server_default_key_requests_total",
+	"Public requests without a tunnel key, by whether they were routed to the default key or rejected because default routing is disabled", "result")
+
+// defaultRouteLog 记录每个来源IP最近一次输出默认路由日志的时间
+type defaultRouteLog struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newDefaultRouteLog() *defaultRouteLog {
+	return &defaultRouteLog{seen: make(map[string]time.Time)}
+}
+
+// first 判断该IP在最近一个周期内是否第一次使用默认路由，同时清理过期的记录
+func (l *defaultRouteLog) first(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= defaultRouteLogInterval {
+		for k, t := range l.seen {
+			if now.Sub(t) >= defaultRouteLogInterval {
+				delete(l.seen, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	if t, ok := l.seen[ip]; ok && now.Sub(t) < defaultRouteLogInterval {
+		return false
+	}
+	l.seen[ip] = now
+	return true
+}
+
+// newHostDefaultKeys 收集配置文件 hosts 中按主机名覆盖的默认key，主机名转为小写
+func newHostDefaultKeys(hosts map[string]*config.HostConfig) map[string]string {
+	keys := make(map[string]string)
+	for host, h := range hosts {
+		if h != nil && h.DefaultKey != "" {
+			keys[strings.ToLower(host)] = h.DefaultKey
+		}
+	}
+	return keys
+}
+
+// defaultKey 返回未指定key的请求转发到的key及其来源，主机名的设置优先于全局设置。
+// 默认路由已关闭时返回空key
+func (rr *RouteResolver) defaultKey(host string) (string, string) {
+	if key, ok := lookupHostName(rr.hostDefaultKeys, strings.ToLower(host)); ok {
+		if key == config.DefaultKeyNone {
+			return "", "host_default"
+		}
+		return key, "host_default"
+	}
+	return rr.cfg.DefaultRouteKey(), "default"
+}
+
+// checkDefaultRoute 统计未指定key的公网请求。默认路由已关闭时返回404并返回 false；
+// 转发到默认key时每个来源IP每小时输出一条 Info 日志，便于发现扫描流量
+func (p *SinglePortProxy) checkDefaultRoute(w http.ResponseWriter, r *http.Request, ip, key, source string) bool {
+	if key == "" {
+		defaultKeyRequestsCounter.WithLabelValue("disabled").Inc()
+		logger.Debug("Rejected public request without tunnel key, default routing disabled",
+			"client_ip", ip,
+			"host", r.Host,
+			"method", r.Method,
+			"url", utils.SanitizeURL(r.URL))
+		http.Error(w, "No tunnel key specified", http.StatusNotFound)
+		return false
+	}
+	defaultKeyRequestsCounter.WithLabelValue("routed").Inc()
+	if p.defaultRoutes.first(ip, time.Now()) {
+		logger.Info("Public request without tunnel key routed to default key",
+			"client_ip", ip,
+			"key", key,
+			"key_source", source,
+			"host", p.logHost(r.Host),
+			"method", r.Method,
+			"url", utils.SanitizeURL(r.URL))
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/h12w/go-socks5"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/dnscache"
+	"singleproxy/pkg/logger"
+)
+
+// errDestinationBlocked 目标地址被正向代理/SOCKS5的目标策略拒绝
+var errDestinationBlocked = errors.New("destination address is not allowed")
+
+// sharedAddressSpace 运营商级NAT地址 (RFC 6598)，部分云厂商的元数据服务位于此网段
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// destinationPolicy 正向代理和SOCKS5共用的目标地址策略。
+// 默认拒绝环回、链路本地、私有和未指定地址，allow 中的网段可重新放行。
+// 域名在解析后逐个检查，拨号时再通过 Control 检查实际连接的IP，防止DNS重绑定。
+// 解析使用进程共用的DNS缓存。
+type destinationPolicy struct {
+	allow  []*net.IPNet
+	dialer *net.Dialer
+}
+
+// newDestinationPolicy 根据允许的网段列表创建目标策略
+func newDestinationPolicy(cidrs []string) (*destinationPolicy, error) {
+	d := &destinationPolicy{}
+	for _, cidr := range cidrs {
+		ipNet, err := config.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy allow CIDR %q: %v", cidr, err)
+		}
+		d.allow = append(d.allow, ipNet)
+	}
+	d.dialer = &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !d.allowed(ip) {
+				return fmt.Errorf("%w: %s", errDestinationBlocked, host)
+			}
+			return nil
+		},
+	}
+	return d, nil
+}
+
+// allowed 检查单个IP是否允许访问
+func (d *destinationPolicy) allowed(ip net.IP) bool {
+	for _, ipNet := range d.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || sharedAddressSpace.Contains(ip))
+}
+
+// check 解析主机名并检查所有解析结果，任一地址被拒绝即视为拒绝
+func (d *destinationPolicy) check(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !d.allowed(ip) {
+			return fmt.Errorf("%w: %s", errDestinationBlocked, host)
+		}
+		return nil
+	}
+	addrs, err := dnscache.Default().LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !d.allowed(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", errDestinationBlocked, host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// DialContext 拨号到目标地址，实际连接的IP同样受策略约束
+func (d *destinationPolicy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dnscache.Default().DialWith(ctx, d.dialer, network, addr)
+}
+
+// Resolve 实现 socks5.NameResolver，通过DNS缓存解析并返回偏好的第一个地址
+func (d *destinationPolicy) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addrs, err := dnscache.Default().LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if len(addrs) == 0 {
+		return ctx, nil, &net.DNSError{Err: "no addresses found", Name: name}
+	}
+	return ctx, addrs[0].IP, nil
+}
+
+// Allow 实现 socks5.RuleSet，库在调用前已完成域名解析。
+// 被拒绝时库会回复 0x02 (connection not allowed by ruleset)。
+func (d *destinationPolicy) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		return ctx, true
+	}
+	if req.DestAddr.IP == nil || !d.allowed(req.DestAddr.IP) {
+		proxyBlockedCounter.Inc()
+		logger.Warn("Blocked SOCKS5 connection to disallowed destination",
+			"destination", req.DestAddr.String(),
+			"remote_addr", fmt.Sprint(req.RemoteAddr))
+		return ctx, false
+	}
+	return ctx, true
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/protocol"
+)
+
+// 迁移的默认宽限期，以及停止前等待进行中请求时的检查间隔
+const (
+	defaultDrainGrace  = 30 * time.Second
+	drainPollInterval  = 50 * time.Millisecond
+	drainMaxBodyLength = 4096
+)
+
+var (
+	drainedTunnelsCounter = metrics.NewCounterVec("singleproxy_server_drained_tunnels_total",
+		"Tunnel connections asked to drain, by whether the client was sent MSG_TYPE_GOAWAY (notified) or only gets closed when the grace period ends (legacy)", "result")
+	drainRefusedRegistrationsCounter = metrics.NewCounter("singleproxy_server_drain_refused_registrations_total",
+		"Tunnel registrations refused because the key is draining")
+	redirectsCounter = metrics.NewCounterVec("singleproxy_server_redirects_total",
+		"Tunnel clients sent an alternate server address in MSG_TYPE_GOAWAY, by reason (drain for /admin/drain, rebalance for -redirect-threshold)", "reason")
+)
+
+// drainState 管理员要求在迁移期间拒绝注册的key，直到通过 DELETE /admin/drain 解除或服务器重启
+type drainState struct {
+	mu         sync.Mutex
+	all        bool
+	keys       map[string]bool
+	retryAfter time.Duration // 被拒绝的客户端重试前等待的时间，取最近一次迁移的宽限期
+}
+
+func newDrainState() *drainState {
+	return &drainState{keys: make(map[string]bool)}
+}
+
+// refuse 开始拒绝key的注册，key为空时拒绝所有注册
+func (d *drainState) refuse(key string, retryAfter time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key == "" {
+		d.all = true
+	} else {
+		d.keys[key] = true
+	}
+	d.retryAfter = retryAfter
+}
+
+// lift 解除key的注册限制，key为空时全部解除
+func (d *drainState) lift(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key == "" {
+		d.all = false
+		d.keys = make(map[string]bool)
+		return
+	}
+	delete(d.keys, key)
+}
+
+// refuses 判断是否拒绝key的注册，并返回建议的重试等待时间
+func (d *drainState) refuses(key string) (bool, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.all || d.keys[key], d.retryAfter
+}
+
+// refuseDrainingRegistration 管理员要求拒绝该key的注册时返回 503 并告知重试等待时间
+func (p *SinglePortProxy) refuseDrainingRegistration(w http.ResponseWriter, key, remoteAddr string) bool {
+	refused, retryAfter := p.drains.refuses(key)
+	if !refused {
+		return false
+	}
+	drainRefusedRegistrationsCounter.Inc()
+	logger.Warn("Tunnel registration refused - key is draining",
+		"key", key,
+		"remote_addr", remoteAddr)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+	return true
+}
+
+// drainTunnels 向 match 匹配的WebSocket隧道发送迁移通知，宽限期结束时关闭仍未断开的连接。
+// 未声明支持 FeatureGoAway 的客户端只在宽限期结束时被关闭，已在迁移中的连接不重复处理。
+// 返回本次开始迁移的连接数和其中收到通知的连接数
+func (p *SinglePortProxy) drainTunnels(match func(key string) bool, g protocol.GoAway) (drained, notified int) {
+	payload, err := protocol.EncodeGoAway(g)
+	if err != nil {
+		logger.Error("Failed to encode goaway", "error", err)
+		return 0, 0
+	}
+	for _, tc := range p.allTunnels() {
+		if !match(tc.key) {
+			continue
+		}
+		started, sent := p.drainTunnel(tc, payload, g)
+		if started {
+			drained++
+		}
+		if sent {
+			notified++
+		}
+	}
+	return drained, notified
+}
+
+// drainTunnel 让单个连接开始迁移，连接已在迁移中时返回 started=false
+func (p *SinglePortProxy) drainTunnel(tc *tunnelConn, payload []byte, g protocol.GoAway) (started, notified bool) {
+	if tc.draining.Swap(true) {
+		return false, false
+	}
+	if tc.goAwaySupported {
+		if err := tc.sendTunnelMessage(protocol.TunnelMessage{Type: protocol.MSG_TYPE_GOAWAY, Payload: payload}); err != nil {
+			logger.Warn("Failed to send goaway",
+				"key", tc.key,
+				"connection_id", tc.id,
+				"error", err)
+		} else {
+			notified = true
+			drainedTunnelsCounter.WithLabelValue("notified").Inc()
+		}
+	} else {
+		drainedTunnelsCounter.WithLabelValue("legacy").Inc()
+	}
+	logger.Info("Draining tunnel",
+		"key", tc.key,
+		"connection_id", tc.id,
+		"goaway", tc.goAwaySupported,
+		"grace", g.Grace(),
+		"reconnect_to", g.ReconnectTo,
+		"reason", g.Reason)
+	if notified && g.ReconnectTo != "" {
+		logRedirect(tc, g)
+	}
+
+	time.AfterFunc(g.Grace(), func() {
+		if !p.tunnelRegistered(tc) {
+			return
+		}
+		logger.Info("Closing drained tunnel - grace period ended",
+			"key", tc.key,
+			"connection_id", tc.id)
+		_ = tc.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, protocol.CloseReasonServerDraining),
+			time.Now().Add(time.Second))
+		tc.conn.Close()
+	})
+	return true, notified
+}
+
+// logRedirect 记录发给客户端的备用服务器地址
+func logRedirect(tc *tunnelConn, g protocol.GoAway) {
+	redirectsCounter.WithLabelValue(g.Reason).Inc()
+	logger.Info("Redirected tunnel client to alternate server",
+		"key", tc.key,
+		"connection_id", tc.id,
+		"remote_addr", tc.conn.RemoteAddr(),
+		"reconnect_to", g.ReconnectTo,
+		"reason", g.Reason)
+}
+
+// redirectOverThreshold 在线连接数超过 -redirect-threshold 时要求刚注册的客户端改为连接 -redirect-to。
+// 与迁移不同，连接不标记为迁移中、宽限期结束时也不关闭: 备用地址不在客户端 -redirect-allow 中时客户端会留下，
+// 强制关闭只会让它反复重连。不支持 FeatureGoAway 的旧客户端无法重定向，同样留在本服务器
+func (p *SinglePortProxy) redirectOverThreshold(tc *tunnelConn, totalConns int) {
+	if p.config.RedirectThreshold <= 0 || totalConns <= p.config.RedirectThreshold || !tc.goAwaySupported {
+		return
+	}
+	g := protocol.GoAway{GraceMs: defaultDrainGrace.Milliseconds(), ReconnectTo: p.config.RedirectTo, Reason: protocol.GoAwayReasonRebalance}
+	payload, err := protocol.EncodeGoAway(g)
+	if err != nil {
+		logger.Error("Failed to encode goaway", "error", err)
+		return
+	}
+	logger.Info("Connection threshold exceeded, redirecting new tunnel",
+		"key", tc.key,
+		"connection_id", tc.id,
+		"total_connections", totalConns,
+		"redirect_threshold", p.config.RedirectThreshold)
+	if err := tc.sendTunnelMessage(protocol.TunnelMessage{Type: protocol.MSG_TYPE_GOAWAY, Payload: payload}); err != nil {
+		logger.Warn("Failed to send goaway",
+			"key", tc.key,
+			"connection_id", tc.id,
+			"error", err)
+		return
+	}
+	logRedirect(tc, g)
+}
+
+// tunnelRegistered 判断连接是否仍在其key的连接池中
+func (p *SinglePortProxy) tunnelRegistered(tc *tunnelConn) bool {
+	p.connsMu.RLock()
+	defer p.connsMu.RUnlock()
+	if pool := p.clientConns[tc.key]; pool != nil {
+		for _, c := range pool.conns {
+			if c == tc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// preferActive 排除迁移中的连接，全部在迁移中时原样返回，让它们在宽限期内继续服务
+func preferActive(conns []*tunnelConn) []*tunnelConn {
+	active := make([]*tunnelConn, 0, len(conns))
+	for _, tc := range conns {
+		if !tc.draining.Load() {
+			active = append(active, tc)
+		}
+	}
+	if len(active) == 0 {
+		return conns
+	}
+	return active
+}
+
+// waitForStreams 等待进行中的公网请求完成，最多等待 timeout
+func (p *SinglePortProxy) waitForStreams(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		p.handlersMu.Lock()
+		pending := len(p.streamHandlers)
+		p.handlersMu.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			logger.Warn("Drain grace period ended with requests in flight",
+				"pending_requests", pending,
+				"grace", timeout)
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// drainRequestBody POST /admin/drain 的请求体，均为可选
+type drainRequestBody struct {
+	Key                 string `json:"key"`                  // 只迁移该key的连接，为空时迁移所有连接
+	Grace               string `json:"grace"`                // 宽限期，默认30s
+	ReconnectTo         string `json:"reconnect_to"`         // 通知客户端改为连接的备用服务器地址
+	RefuseRegistrations bool   `json:"refuse_registrations"` // 同时拒绝这些key的新注册
+}
+
+// handleAdminDrain 通知隧道客户端完成进行中的请求后断开并重连，用于计划内的重启或迁移。
+// 不指定key时作用于所有租户，只对完整权限开放
+func (p *SinglePortProxy) handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	var body drainRequestBody
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, drainMaxBodyLength)).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+	}
+	if body.Key == "" {
+		if !requireFullAdmin(w, r) {
+			return
+		}
+	} else if !authorizeKey(w, r, body.Key) {
+		return
+	}
+
+	grace := defaultDrainGrace
+	if body.Grace != "" {
+		d, err := time.ParseDuration(body.Grace)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid grace"})
+			return
+		}
+		grace = d
+	}
+	if body.ReconnectTo != "" {
+		u, err := url.Parse(body.ReconnectTo)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reconnect_to must be a ws:// or wss:// address"})
+			return
+		}
+	}
+
+	if body.RefuseRegistrations {
+		p.drains.refuse(body.Key, grace)
+	}
+	drained, notified := p.drainTunnels(func(key string) bool {
+		return body.Key == "" || key == body.Key
+	}, protocol.GoAway{GraceMs: grace.Milliseconds(), ReconnectTo: body.ReconnectTo, Reason: protocol.GoAwayReasonDrain})
+
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"key":                  body.Key,
+		"grace":                grace.String(),
+		"reconnect_to":         body.ReconnectTo,
+		"refuse_registrations": body.RefuseRegistrations,
+		"drained":              drained,
+		"notified":             notified,
+	})
+}
+
+// handleAdminDrainLift 解除迁移期间的注册限制，已在迁移中的连接不受影响
+func (p *SinglePortProxy) handleAdminDrainLift(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		if !requireFullAdmin(w, r) {
+			return
+		}
+	} else if !authorizeKey(w, r, key) {
+		return
+	}
+	p.drains.lift(key)
+	writeJSON(w, http.StatusOK, map[string]any{"key": key, "refuse_registrations": false})
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainState(t *testing.T) {
+	d := newDrainState()
+	if refused, _ := d.refuses("app"); refused {
+		t.Fatal("Expected no refusal by default")
+	}
+
+	d.refuse("app", 5*time.Second)
+	if refused, retryAfter := d.refuses("app"); !refused || retryAfter != 5*time.Second {
+		t.Errorf("Expected app to be refused for 5s, got %v %v", refused, retryAfter)
+	}
+	if refused, _ := d.refuses("other"); refused {
+		t.Error("Other keys should not be refused")
+	}
+
+	d.refuse("", time.Second)
+	if refused, _ := d.refuses("other"); !refused {
+		t.Error("Expected all keys to be refused")
+	}
+	// 解除单个key不影响对所有key的限制
+	d.lift("app")
+	if refused, _ := d.refuses("app"); !refused {
+		t.Error("Expected app to stay refused while all keys are draining")
+	}
+	d.lift("")
+	if refused, _ := d.refuses("app"); refused {
+		t.Error("Expected refusals to be lifted")
+	}
+}
+
+func TestPreferActive(t *testing.T) {
+	a, b := newTunnelConn("app", nil), newTunnelConn("app", nil)
+	a.draining.Store(true)
+	if got := preferActive([]*tunnelConn{a, b}); len(got) != 1 || got[0] != b {
+		t.Errorf("Expected only the active connection, got %v", got)
+	}
+	// 全部在迁移中时继续使用
+	b.draining.Store(true)
+	if got := preferActive([]*tunnelConn{a, b}); len(got) != 2 {
+		t.Errorf("Expected draining connections to keep serving, got %v", got)
+	}
+}
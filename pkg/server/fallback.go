@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/dnscache"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/utils"
+)
+
+const (
+	// headerServedBy 标记由备用地址提供的响应
+	headerServedBy = "X-Served-By"
+	// fallbackRetryInterval 备用地址请求失败后暂停使用的时长，之后的第一个请求重新尝试
+	fallbackRetryInterval = 30 * time.Second
+	// fallbackHeaderTimeout 等待备用地址响应头的超时
+	fallbackHeaderTimeout = 30 * time.Second
+)
+
+var fallbackRequestsCounter = metrics.NewCounterVec("singleproxy_server_fallback_requests_total",
+	"Public requests for offline tunnels handled by fallback_upstream, by result (served, failed, skipped)", "result")
+
+// fallbackTransport 转发到备用地址的共用连接池，主机名经DNS缓存解析
+var fallbackTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dnscache.DialContext
+	t.ResponseHeaderTimeout = fallbackHeaderTimeout
+	return t
+}()
+
+// fallbackUpstream 一个key的备用地址。健康状态只在转发失败时更新，不做主动探测
+type fallbackUpstream struct {
+	target    *url.URL
+	proxy     *httputil.ReverseProxy
+	downUntil atomic.Int64 // 暂停使用到该时间 (UnixNano)，0 表示可用
+}
+
+// newFallbackUpstreams 为配置了 fallback_upstream 的key创建反向代理
+func newFallbackUpstreams(keys map[string]*config.KeyConfig) map[string]*fallbackUpstream {
+	upstreams := make(map[string]*fallbackUpstream)
+	for key, kc := range keys {
+		if kc == nil || kc.FallbackUpstream == "" {
+			continue
+		}
+		target, err := url.Parse(kc.FallbackUpstream)
+		if err != nil {
+			logger.Error("Invalid fallback upstream, ignoring",
+				"key", key,
+				"fallback_upstream", kc.FallbackUpstream,
+				"error", err)
+			continue
+		}
+		f := &fallbackUpstream{target: target}
+		f.proxy = &httputil.ReverseProxy{
+			Transport: fallbackTransport,
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				pr.SetXForwarded()
+				pr.Out.Header.Del("X-Tunnel-Key")
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				resp.Header.Set(headerServedBy, "fallback")
+				return nil
+			},
+		}
+		upstreams[key] = f
+	}
+	return upstreams
+}
+
+// available 判断备用地址当前是否可用
+func (f *fallbackUpstream) available(now time.Time) bool {
+	return now.UnixNano() >= f.downUntil.Load()
+}
+
+// serveFallback 将请求转发到key的备用地址。未配置或备用地址暂停使用时返回 false，
+// 由调用方返回离线页面或502；转发失败时暂停使用备用地址，并在本次请求中返回离线页面或502
+func (p *SinglePortProxy) serveFallback(w http.ResponseWriter, r *http.Request, key, clientIP string) bool {
+	f := p.fallbacks[key]
+	if f == nil {
+		return false
+	}
+	if !f.available(time.Now()) {
+		fallbackRequestsCounter.WithLabelValue("skipped").Inc()
+		return false
+	}
+
+	startTime := time.Now()
+	failed := false
+	proxy := *f.proxy
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		failed = true
+		f.downUntil.Store(time.Now().Add(fallbackRetryInterval).UnixNano())
+		logger.Warn("Fallback upstream failed, suspending it",
+			"client_ip", clientIP,
+			"key", key,
+			"fallback_upstream", f.target.String(),
+			"retry_after", fallbackRetryInterval,
+			"error", err)
+		if !p.serveOffline(w, r, key) {
+			p.writeProxyError(w, proxyErrNoTunnel)
+		}
+	}
+	proxy.ServeHTTP(w, r)
+
+	if failed {
+		fallbackRequestsCounter.WithLabelValue("failed").Inc()
+		return true
+	}
+	fallbackRequestsCounter.WithLabelValue("served").Inc()
+	status := 0
+	if uw, ok := w.(*usageWriter); ok {
+		status = uw.status
+	}
+	logger.Info("Request served by fallback upstream",
+		"client_ip", clientIP,
+		"key", key,
+		"method", r.Method,
+		"url", utils.SanitizeURL(r.URL),
+		"fallback_upstream", f.target.String(),
+		"status", status,
+		"duration", time.Since(startTime))
+	return true
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// defaultFDWarnPercent 未配置 -fd-warn-percent 时的告警百分比
+const defaultFDWarnPercent = 80
+
+var (
+	openConnsGauge = metrics.NewGauge("singleproxy_server_open_connections",
+		"Accepted connections currently open on the main listener, port bindings and the registration listener")
+	fdLimitGauge = metrics.NewGauge("singleproxy_server_fd_limit",
+		"Soft file descriptor limit of the process, 0 when unknown")
+)
+
+// connTracker 统计已接受且尚未关闭的连接数，作为文件描述符用量的近似值
+type connTracker struct {
+	open   atomic.Int64
+	limit  uint64 // 文件描述符软限制，0 表示未知
+	warnAt int64  // 达到该连接数时告警，0 表示不告警
+
+	// 已告警后回落到告警线的90%以下才重新告警，避免在告警线附近反复输出
+	warned atomic.Bool
+}
+
+// newConnTracker 按文件描述符软限制和告警百分比创建计数器，limit 为0时只计数不告警
+func newConnTracker(limit uint64, percent int) *connTracker {
+	if percent <= 0 {
+		percent = defaultFDWarnPercent
+	}
+	t := &connTracker{limit: limit}
+	if limit > 0 {
+		t.warnAt = int64(limit * uint64(percent) / 100)
+		if t.warnAt < 1 {
+			t.warnAt = 1
+		}
+	}
+	return t
+}
+
+// track 计入一个新接受的连接，返回的连接关闭时自动减计数
+func (t *connTracker) track(conn net.Conn) net.Conn {
+	n := t.open.Add(1)
+	openConnsGauge.Inc()
+	if t.warnAt > 0 && n >= t.warnAt && t.warned.CompareAndSwap(false, true) {
+		logger.Warn("Open connections approaching file descriptor limit",
+			"open_connections", n,
+			"fd_limit", t.limit,
+			"warn_at", t.warnAt)
+	}
+	return &trackedConn{Conn: conn, tracker: t}
+}
+
+func (t *connTracker) release() {
+	n := t.open.Add(-1)
+	openConnsGauge.Dec()
+	if t.warnAt > 0 && n < t.warnAt*9/10 {
+		t.warned.Store(false)
+	}
+}
+
+// trackedConn 关闭时从 connTracker 中减去自身，多次 Close 只计一次
+type trackedConn struct {
+	net.Conn
+	tracker   *connTracker
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.tracker.release)
+	return err
+}
+
+// newFDConnTracker 读取文件描述符限制并与相关的连接上限一起输出，上限可能超过限制时告警
+func newFDConnTracker(cfg *config.Config) *connTracker {
+	soft, hard, ok := fdLimit()
+	if !ok {
+		logger.Info("File descriptor limit unknown on this platform",
+			"max_tunnel_keys", cfg.MaxTunnelKeys)
+		return newConnTracker(0, cfg.FDWarnPercent)
+	}
+	t := newConnTracker(soft, cfg.FDWarnPercent)
+	fdLimitGauge.Set(int64(soft))
+	logger.Info("File descriptor limit",
+		"soft", soft,
+		"hard", hard,
+		"fd_warn_at", t.warnAt,
+		"max_tunnel_keys", cfg.MaxTunnelKeys)
+	// 每个隧道至少占用一个描述符，转发中的公网请求还需要更多；上限超过软限制一半时提前告警
+	if cfg.MaxTunnelKeys > 0 && uint64(cfg.MaxTunnelKeys) > soft/2 {
+		logger.Warn("Configured tunnel cap may exceed the file descriptor limit",
+			"max_tunnel_keys", cfg.MaxTunnelKeys,
+			"soft", soft,
+			"hint", "raise the limit with ulimit -n or LimitNOFILE, or lower -max-tunnel-keys")
+	}
+	return t
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package server
+
+import (
+	"syscall"
+
+	"singleproxy/pkg/logger"
+)
+
+// fdLimit 读取 RLIMIT_NOFILE，软限制低于硬限制时先尝试提高到硬限制。
+// Go 运行时在多数平台上启动时已经这样做，这里覆盖被系统上限截断的情况 (如 macOS)
+func fdLimit() (soft, hard uint64, ok bool) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		logger.Warn("Failed to read file descriptor limit", "error", err)
+		return 0, 0, false
+	}
+	if rlim.Cur < rlim.Max {
+		raised := rlim
+		raised.Cur = rlim.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err != nil {
+			logger.Debug("Failed to raise file descriptor soft limit",
+				"soft", rlim.Cur,
+				"hard", rlim.Max,
+				"error", err)
+		} else {
+			logger.Info("Raised file descriptor soft limit",
+				"from", rlim.Cur,
+				"to", rlim.Max)
+			rlim.Cur = rlim.Max
+		}
+	}
+	return uint64(rlim.Cur), uint64(rlim.Max), true
+}
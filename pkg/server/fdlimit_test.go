@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnTracker(t *testing.T) {
+	tracker := newConnTracker(10, 50)
+	if tracker.warnAt != 5 {
+		t.Fatalf("Expected warn threshold 5, got %d", tracker.warnAt)
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		conns = append(conns, tracker.track(c1))
+	}
+	if n := tracker.open.Load(); n != 5 {
+		t.Fatalf("Expected 5 open connections, got %d", n)
+	}
+	if !tracker.warned.Load() {
+		t.Error("Expected warning at the threshold")
+	}
+
+	// 重复关闭只减一次
+	conns[0].Close()
+	conns[0].Close()
+	if n := tracker.open.Load(); n != 4 {
+		t.Errorf("Expected 4 open connections after close, got %d", n)
+	}
+	if !tracker.warned.Load() {
+		t.Error("Expected warning to stay armed just below the threshold")
+	}
+	for _, c := range conns[1:] {
+		c.Close()
+	}
+	if tracker.warned.Load() {
+		t.Error("Expected warning to re-arm after connections dropped")
+	}
+
+	if unknown := newConnTracker(0, 0); unknown.warnAt != 0 {
+		t.Errorf("Expected no warning threshold without a limit, got %d", unknown.warnAt)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package server
+
+// fdLimit Windows 没有 RLIMIT_NOFILE，套接字数量只受系统资源限制
+func fdLimit() (soft, hard uint64, ok bool) {
+	return 0, 0, false
+}
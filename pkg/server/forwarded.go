@@ -0,0 +1,212 @@
+package server
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/utils"
+)
+
+// 转发给目标服务的协议和客户端证书头部，与 nginx 常用的写法一致:
+//
+//	proxy_set_header X-Forwarded-Proto $scheme;
+//	proxy_set_header X-Forwarded-Ssl-Client-Cert $ssl_client_escaped_cert;
+//	proxy_set_header X-SSL-Client-Verify $ssl_client_verify;
+const (
+	headerForwardedProto    = "X-Forwarded-Proto"
+	headerClientCert        = "X-Forwarded-Ssl-Client-Cert"
+	headerClientVerify      = "X-SSL-Client-Verify"
+	headerClientSubject     = "X-SSL-Client-S-DN"
+	headerClientIssuer      = "X-SSL-Client-I-DN"
+	headerClientSerial      = "X-SSL-Client-Serial"
+	headerClientFingerprint = "X-SSL-Client-Fingerprint"
+
+	// clientHeaderPrefix 客户端证书头部的公共前缀，其余 X-SSL-Client-* 头部同样只接受可信代理传入
+	clientHeaderPrefix = "X-Ssl-Client-"
+)
+
+var forwardedHeadersStrippedCounter = metrics.NewCounter("singleproxy_server_forwarded_headers_stripped_total",
+	"Public requests whose X-Forwarded-Proto or client certificate headers were removed because they did not come from a trusted proxy")
+
+// connSecurity 公网请求所在连接的协议和客户端证书，TLS在本服务器终止时取自连接，
+// 在可信代理终止时取自代理传入的头部
+type connSecurity struct {
+	https  bool
+	cert   *x509.Certificate
+	verify string // SUCCESS、NONE 或代理传入的 FAILED:<原因>，为空表示未知
+
+	viaProxy bool
+}
+
+// newTrustedProxies 解析可信代理网段，配置校验已检查格式，这里跳过非法项
+func newTrustedProxies(cfg *config.Config) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cfg.TrustedProxies {
+		ipNet, err := config.ParseCIDR(cidr)
+		if err != nil {
+			logger.Error("Invalid trusted proxy CIDR, ignoring",
+				"cidr", cidr,
+				"error", err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// fromTrustedProxy 按直连地址判断请求是否来自可信代理
+func (p *SinglePortProxy) fromTrustedProxy(r *http.Request) bool {
+	if len(p.trustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, ok := utils.ParseClientIP(host)
+	if !ok {
+		return false
+	}
+	ip := net.IP(addr.AsSlice())
+	for _, ipNet := range p.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// connSecurityOf 返回请求的协议和客户端证书
+func (p *SinglePortProxy) connSecurityOf(r *http.Request) connSecurity {
+	if p.fromTrustedProxy(r) {
+		return proxiedSecurity(r)
+	}
+	sec := connSecurity{https: r.TLS != nil}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		sec.cert = r.TLS.PeerCertificates[0]
+		sec.verify = "SUCCESS"
+	} else {
+		sec.verify = "NONE"
+	}
+	return sec
+}
+
+// proxiedSecurity 解析可信代理传入的头部。没有 X-Forwarded-Proto 时按代理与本服务器之间的连接判断
+func proxiedSecurity(r *http.Request) connSecurity {
+	sec := connSecurity{https: r.TLS != nil, viaProxy: true, verify: r.Header.Get(headerClientVerify)}
+	if proto := r.Header.Get(headerForwardedProto); proto != "" {
+		first, _, _ := strings.Cut(proto, ",")
+		sec.https = strings.EqualFold(strings.TrimSpace(first), "https")
+	}
+	if escaped := r.Header.Get(headerClientCert); escaped != "" {
+		cert, err := parseEscapedCert(escaped)
+		if err != nil {
+			logger.Debug("Ignoring unparsable client certificate from trusted proxy",
+				"remote_addr", r.RemoteAddr,
+				"error", err)
+		} else {
+			sec.cert = cert
+		}
+	}
+	return sec
+}
+
+// parseEscapedCert 解析 URL 编码的 PEM 证书 (nginx 的 $ssl_client_escaped_cert)
+func parseEscapedCert(escaped string) (*x509.Certificate, error) {
+	data, err := url.PathUnescape(escaped)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// isForwardedHeader 判断头部是否只能由可信代理传入
+func isForwardedHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return name == headerForwardedProto || name == headerClientCert || strings.HasPrefix(name, clientHeaderPrefix)
+}
+
+// applyForwardedHeaders 整理转发给目标服务的协议和客户端证书头部。
+// 不是来自可信代理的请求移除自带的这些头部；启用 -forwarded-headers 时按连接重新设置，
+// 经可信代理和直接TLS访问的同一客户端在目标服务看到相同的头部
+func (p *SinglePortProxy) applyForwardedHeaders(r *http.Request, sec connSecurity) {
+	if !p.config.ForwardedHeaders && len(p.trustedProxies) == 0 {
+		return
+	}
+	if !sec.viaProxy {
+		stripped := false
+		for name := range r.Header {
+			if isForwardedHeader(name) {
+				r.Header.Del(name)
+				stripped = true
+			}
+		}
+		if stripped {
+			forwardedHeadersStrippedCounter.Inc()
+			logger.Debug("Removed forwarded headers from untrusted source",
+				"remote_addr", r.RemoteAddr,
+				"url", utils.SanitizeURL(r.URL))
+		}
+	}
+	if !p.config.ForwardedHeaders {
+		return
+	}
+
+	r.Header.Set(headerForwardedProto, sec.scheme())
+	if sec.cert == nil {
+		// 代理只传入了部分证书头部时原样保留
+		if !sec.viaProxy {
+			r.Header.Set(headerClientVerify, sec.verify)
+		}
+		return
+	}
+	for name := range r.Header {
+		if isForwardedHeader(name) && name != headerForwardedProto {
+			r.Header.Del(name)
+		}
+	}
+	if sec.verify != "" {
+		r.Header.Set(headerClientVerify, sec.verify)
+	}
+	r.Header.Set(headerClientCert, url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: sec.cert.Raw}))))
+	r.Header.Set(headerClientSubject, sec.cert.Subject.String())
+	r.Header.Set(headerClientIssuer, sec.cert.Issuer.String())
+	r.Header.Set(headerClientSerial, strings.ToUpper(sec.cert.SerialNumber.Text(16)))
+	r.Header.Set(headerClientFingerprint, certFingerprint(sec.cert))
+}
+
+// certFingerprint 证书DER编码的SHA1，与 nginx 的 $ssl_client_fingerprint 相同
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// clientCertSubject 返回写入日志的客户端证书主题，没有证书时为空
+func (sec connSecurity) clientCertSubject() string {
+	if sec.cert == nil {
+		return ""
+	}
+	return sec.cert.Subject.String()
+}
+
+// scheme 返回公网请求的协议
+func (sec connSecurity) scheme() string {
+	if sec.https {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+const (
+	// defaultMaxBufferedFrameBytes 未配置 -max-buffered-frame-bytes 时的上限
+	defaultMaxBufferedFrameBytes = 256 << 20
+	// frameBudgetWarnPercent 用量达到上限的该百分比时告警
+	frameBudgetWarnPercent = 80
+	// maxFramePause 单次暂停读取的最长时间。暂停期间连接上的 ping 也得不到处理，
+	// 超过后照常读取一条消息，避免客户端因收不到 pong 断线；响应头之前缓冲的数据只有继续读取才能释放
+	maxFramePause = 10 * time.Second
+)
+
+var (
+	bufferedFrameBytesGauge = metrics.NewGauge("singleproxy_server_buffered_frame_bytes",
+		"Bytes of tunnel response frames read from tunnel connections and not yet flushed to the public caller")
+	framePausesCounter = metrics.NewCounter("singleproxy_server_frame_read_pauses_total",
+		"Times a tunnel connection paused reading because buffered response frames reached max_buffered_frame_bytes")
+)
+
+// frameBudget 统计已从隧道读入、尚未写给公网调用方的消息字节数。
+// 公网调用方读取缓慢时写出会阻塞，大量连接同时积压可能耗尽内存。总用量只作为硬上限：
+// 达到上限后，仍有自己的数据未写出的连接在读取下一条消息前暂停，直到这些数据写出或总用量回落，
+// 由TCP流控把压力传回客户端；没有积压的连接照常读取，不影响其 ping/pong 处理
+type frameBudget struct {
+	limit  int64
+	warnAt int64
+
+	mu   sync.Mutex
+	used int64
+	// below 在用量低于上限时已关闭；达到上限时换成新的通道，回落后关闭以唤醒暂停的连接
+	below chan struct{}
+	// 已告警后回落到告警线的90%以下才重新告警，避免在告警线附近反复输出
+	warned bool
+}
+
+// newFrameBudget 按 -max-buffered-frame-bytes 创建计数器，0 为默认值
+func newFrameBudget(limit int) *frameBudget {
+	if limit <= 0 {
+		limit = defaultMaxBufferedFrameBytes
+	}
+	b := &frameBudget{
+		limit:  int64(limit),
+		warnAt: int64(limit) * frameBudgetWarnPercent / 100,
+		below:  make(chan struct{}),
+	}
+	close(b.below)
+	return b
+}
+
+// frameAccount 一条隧道连接 (或一次长轮询投递) 已读入、尚未写出的字节数，同时计入所属的 frameBudget
+type frameAccount struct {
+	budget *frameBudget
+
+	// 以下字段由 budget.mu 保护
+	used int64
+	// drained 在该连接没有积压时已关闭；开始积压时换成新的通道，全部写出后关闭以唤醒暂停的读取
+	drained chan struct{}
+}
+
+// account 创建一个计入该上限的连接级计数器
+func (b *frameBudget) account() *frameAccount {
+	a := &frameAccount{budget: b, drained: make(chan struct{})}
+	close(a.drained)
+	return a
+}
+
+// acquire 计入 n 字节已读入的数据。单条消息本身不会因超过上限被拒绝，上限只决定是否继续读取
+func (a *frameAccount) acquire(n int) {
+	if n <= 0 {
+		return
+	}
+	b := a.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if a.used == 0 {
+		a.drained = make(chan struct{})
+	}
+	a.used += int64(n)
+	b.acquireLocked(n)
+}
+
+// release 减去 n 字节已写出 (或已丢弃) 的数据
+func (a *frameAccount) release(n int) {
+	if n <= 0 {
+		return
+	}
+	b := a.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a.used -= int64(n)
+	if a.used == 0 {
+		close(a.drained)
+	}
+	b.releaseLocked(n)
+}
+
+// wait 在总用量达到上限且该连接仍有数据未写出时阻塞，直到其中之一解除或超过 maxFramePause，
+// 返回暂停的时长 (未暂停为0)
+func (a *frameAccount) wait() time.Duration {
+	b := a.budget
+	b.mu.Lock()
+	below, drained := b.below, a.drained
+	b.mu.Unlock()
+	select {
+	case <-below:
+		return 0
+	case <-drained:
+		return 0
+	default:
+	}
+
+	framePausesCounter.Inc()
+	start := time.Now()
+	timer := time.NewTimer(maxFramePause)
+	defer timer.Stop()
+	select {
+	case <-below:
+	case <-drained:
+	case <-timer.C:
+	}
+	return time.Since(start)
+}
+
+// acquireLocked 计入总用量，调用方需持有 mu
+func (b *frameBudget) acquireLocked(n int) {
+	prev := b.used
+	b.used += int64(n)
+	bufferedFrameBytesGauge.Add(int64(n))
+	if prev < b.limit && b.used >= b.limit {
+		b.below = make(chan struct{})
+	}
+	if !b.warned && b.used >= b.warnAt {
+		b.warned = true
+		logger.Warn("Buffered tunnel frames approaching memory ceiling",
+			"buffered_bytes", b.used,
+			"max_buffered_frame_bytes", b.limit,
+			"warn_at", b.warnAt)
+	}
+}
+
+// releaseLocked 减去总用量，调用方需持有 mu
+func (b *frameBudget) releaseLocked(n int) {
+	prev := b.used
+	b.used -= int64(n)
+	bufferedFrameBytesGauge.Add(-int64(n))
+	if prev >= b.limit && b.used < b.limit {
+		close(b.below)
+	}
+	if b.warned && b.used < b.warnAt*9/10 {
+		b.warned = false
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameBudgetPausesOnlyBackloggedConnections(t *testing.T) {
+	b := newFrameBudget(100)
+	slow, fast := b.account(), b.account()
+
+	// 总用量达到上限，但没有积压的连接照常读取
+	slow.acquire(150)
+	if paused := fast.wait(); paused != 0 {
+		t.Errorf("Expected a connection without buffered frames not to pause, paused %v", paused)
+	}
+
+	// 仍有积压的连接暂停，直到自己的数据写出
+	done := make(chan time.Duration, 1)
+	go func() { done <- slow.wait() }()
+	select {
+	case <-done:
+		t.Fatal("Expected the backlogged connection to pause")
+	case <-time.After(50 * time.Millisecond):
+	}
+	slow.release(150)
+	select {
+	case paused := <-done:
+		if paused <= 0 {
+			t.Errorf("Expected a positive pause, got %v", paused)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection to resume once its frames were released")
+	}
+
+	// 总用量低于上限时，有积压的连接也不暂停
+	slow.acquire(10)
+	if paused := slow.wait(); paused != 0 {
+		t.Errorf("Expected no pause below the limit, paused %v", paused)
+	}
+	slow.release(10)
+
+	// 其他连接的积压回落到上限以下后，暂停的连接也继续读取
+	slow.acquire(10)
+	fast.acquire(100)
+	go func() { done <- slow.wait() }()
+	select {
+	case <-done:
+		t.Fatal("Expected the connection to pause while over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	fast.release(100)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection to resume once total usage fell below the limit")
+	}
+	slow.release(10)
+	if b.used != 0 || slow.used != 0 || fast.used != 0 {
+		t.Errorf("Expected all usage to return to 0, got total %d slow %d fast %d", b.used, slow.used, fast.used)
+	}
+}
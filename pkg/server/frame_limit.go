@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxLoggedRequestIDs 超限日志中最多列出的进行中请求ID数
+const maxLoggedRequestIDs = 32
+
+var frameLimitViolationsCounter = metrics.NewCounterVec("singleproxy_server_frame_limit_violations_total",
+	"Tunnel messages from clients larger than the negotiated frame size, by action (request_failed, dropped, connection_closed)", "action")
+
+// readTunnelFrame 读取一条隧道消息，每次返回新分配的切片。
+// 超过协商上限的消息被读完丢弃并返回 *protocol.FrameTooLargeError，连接仍可继续读取
+func readTunnelFrame(conn *websocket.Conn, limit int) ([]byte, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := protocol.ReadFrame(&buf, r, limit); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tunnelRequestIDs 返回连接上等待响应的请求ID，按ID排序
+func (p *SinglePortProxy) tunnelRequestIDs(tc *tunnelConn) []uint64 {
+	p.handlersMu.Lock()
+	ids := make([]uint64, 0, len(p.streamHandlers))
+	for id, handler := range p.streamHandlers {
+		if handler.tunnel == tc {
+			ids = append(ids, id)
+		}
+	}
+	p.handlersMu.Unlock()
+	slices.Sort(ids)
+	return ids
+}
+
+// handleOversizedFrame 处理客户端发来的超过协商上限的消息。消息已丢弃时只以 frame_too_large 结束它所属的请求，
+// 连接上的其他请求不受影响；消息过大无法丢弃时以协议错误关闭连接并返回 false，读取循环随即退出
+func (p *SinglePortProxy) handleOversizedFrame(tc *tunnelConn, tooLarge *protocol.FrameTooLargeError) bool {
+	ids := p.tunnelRequestIDs(tc)
+	args := []any{
+		"key", tc.key,
+		"remote_addr", tc.conn.RemoteAddr().String(),
+		"connection_id", tc.id,
+		"request_id", tooLarge.ID,
+		"message_type", tooLarge.Type,
+		"message_size", tooLarge.Size,
+		"read_limit", tc.maxFrameSize,
+		"message_auth", tc.authIn != nil,
+		"chunk_seq", tc.chunkSeq,
+		"active_requests", len(ids),
+		"active_request_ids", ids[:min(len(ids), maxLoggedRequestIDs)],
+	}
+
+	if !tooLarge.Drained {
+		frameLimitViolationsCounter.WithLabelValue("connection_closed").Inc()
+		logger.Error("Tunnel message exceeded the negotiated frame size, closing tunnel", args...)
+		_ = tc.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.FormatFrameTooLargeReason(tc.maxFrameSize)),
+			time.Now().Add(time.Second))
+		return false
+	}
+
+	handler, ok := p.lookupStreamHandler(tooLarge.ID)
+	if !ok || handler.tunnel != tc || !handler.abandon(proxyErrFrameTooLarge) {
+		frameLimitViolationsCounter.WithLabelValue("dropped").Inc()
+		logger.Warn("Dropped tunnel message exceeding the negotiated frame size", args...)
+		return true
+	}
+	p.removeStreamHandler(tooLarge.ID)
+	handler.notifyCancel(tooLarge.ID, protocol.CancelReasonFrameTooLarge)
+	frameLimitViolationsCounter.WithLabelValue("request_failed").Inc()
+	logger.Warn("Tunnel message exceeded the negotiated frame size, failing its request", args...)
+	return true
+}
@@ -2,10 +2,15 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"runtime/pprof"
 	"singleproxy/pkg/logger"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -14,10 +19,31 @@ import (
 	"golang.org/x/time/rate"
 
 	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/utils"
 )
 
+// 公网请求等待隧道响应的默认超时：响应头需在30秒内到达，整个响应最长90秒
+const (
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultResponseTimeout       = 90 * time.Second
+)
+
+// tunnelReadGraceMultiplier 最近收到过客户端数据消息时，读取超时放宽的倍数
+const tunnelReadGraceMultiplier = 2
+
+// maxChunkIntegrityFailures 单个连接上数据块校验失败的响应数达到该值时关闭连接
+const maxChunkIntegrityFailures = 3
+
+// defaultMaxResponseViolations 单个连接上违反响应消息顺序的默认次数上限，达到后关闭连接
+const defaultMaxResponseViolations = 5
+
+// longPollInlineBodyLimit 长轮询客户端支持 body 端点时，超过该大小的请求体不随轮询消息发送
+const longPollInlineBodyLimit = 64 * 1024
+
 // clientReadLoop 是唯一的读取器，处理来自客户端的所有消息 (支持流式传输)
-func (p *SinglePortProxy) clientReadLoop(wsConn *websocket.Conn, key string) {
+func (p *SinglePortProxy) clientReadLoop(ctx context.Context, tc *tunnelConn) {
+	wsConn := tc.conn
+	key := tc.key
 	remoteAddr := wsConn.RemoteAddr().String()
 
 	logger.Info("Starting client read loop",
@@ -26,38 +52,101 @@ func (p *SinglePortProxy) clientReadLoop(wsConn *websocket.Conn, key string) {
 
 	defer func() {
 		wsConn.Close()
+		tc.closeWriter()
+		tc.cancelLocalRequests()
+		p.releaseBindings(tc)
 		p.connsMu.Lock()
-		delete(p.clientConns, key)
+		// 连接可能已被同key的新连接替换，只删除自己
+		if pool := p.clientConns[key]; pool != nil && pool.remove(tc) && len(pool.conns) == 0 {
+			delete(p.clientConns, key)
+		}
 		connectionCount := len(p.clientConns)
 		p.connsMu.Unlock()
 
 		logger.Info("Tunnel client disconnected",
 			"key", key,
 			"remote_addr", remoteAddr,
-			"remaining_active_tunnels", connectionCount)
+			"remaining_active_tunnels", connectionCount,
+			"closed_streams", p.closeTunnelStreams(tc))
 	}()
 
-	wsConn.SetReadLimit(10 * 1024 * 1024)
+	// 读取上限由 readTunnelFrame 按消息检查，超限的消息只影响它所属的请求，不使用 SetReadLimit 断开连接
 	// 与客户端保持一致的超时时间
 	serverReadTimeout := 90 * time.Second
 	_ = wsConn.SetReadDeadline(time.Now().Add(serverReadTimeout))
 
 	logger.Debug("Set WebSocket read configuration",
 		"key", key,
-		"read_limit", "10MB",
+		"read_limit", tc.maxFrameSize,
 		"read_timeout", serverReadTimeout)
 
+	// 客户端定时发送ping。慢速上行链路上ping可能排在大响应的数据帧之后，
+	// 最近收到过数据消息时按倍数放宽超时，数据本身也说明连接仍然可用
+	var lastData time.Time
+	extendReadDeadline := func() {
+		timeout := serverReadTimeout
+		if time.Since(lastData) < serverReadTimeout {
+			timeout *= tunnelReadGraceMultiplier
+		}
+		_ = wsConn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	wsConn.SetPingHandler(func(appData string) error {
+		extendReadDeadline()
+		err := wsConn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		return err
+	})
 	wsConn.SetPongHandler(func(string) error {
-		_ = wsConn.SetReadDeadline(time.Now().Add(serverReadTimeout))
+		extendReadDeadline()
 		logger.Debug("Received pong from client",
 			"key", key,
 			"remote_addr", remoteAddr)
 		return nil
 	})
 
+	maxUnknown := p.config.MaxUnknownMessages
+	if maxUnknown <= 0 {
+		maxUnknown = protocol.DefaultMaxUnknownMessages
+	}
+	unknownCount := 0
+	maxAuthFailures := p.config.MessageAuthMaxFailures
+	if maxAuthFailures <= 0 {
+		maxAuthFailures = protocol.DefaultMaxAuthFailures
+	}
+	maxViolations := p.config.MaxResponseViolations
+	if maxViolations <= 0 {
+		maxViolations = defaultMaxResponseViolations
+	}
+	authFailures := 0
+
+	// 每次只持有一条读入的消息: 处理完成 (已写给公网调用方或已丢弃) 后在读取下一条前释放
+	held := 0
+	defer func() { tc.frames.release(held) }()
+
 	messageCount := 0
 	for {
-		_, data, err := wsConn.ReadMessage()
+		tc.frames.release(held)
+		held = 0
+		if paused := tc.frames.wait(); paused > 0 {
+			logger.Debug("Paused reading tunnel while buffered frames were over the limit",
+				"key", key,
+				"remote_addr", remoteAddr,
+				"paused", paused)
+		}
+
+		data, err := readTunnelFrame(wsConn, tc.maxFrameSize)
+		var tooLarge *protocol.FrameTooLargeError
+		if errors.As(err, &tooLarge) {
+			if !p.handleOversizedFrame(tc, tooLarge) {
+				return
+			}
+			continue
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger.Error("Unexpected WebSocket close error",
@@ -75,14 +164,44 @@ func (p *SinglePortProxy) clientReadLoop(wsConn *websocket.Conn, key string) {
 			break
 		}
 
+		held = len(data)
+		tc.frames.acquire(held)
 		messageCount++
-		logger.Debug("Received message from client",
+		lastData = time.Now()
+		tc.touch()
+		extendReadDeadline()
+		logger.Trace("Received message from client",
 			"key", key,
 			"remote_addr", remoteAddr,
 			"message_size", len(data),
 			"total_messages", messageCount)
 
-		msg, err := protocol.DeserializeTunnelMessage(data)
+		if tc.authIn != nil {
+			if data, err = tc.authIn.Verify(data); err != nil {
+				authFailures++
+				messageAuthFailuresCounter.Inc()
+				logger.Warn("Dropping tunnel message with invalid signature",
+					"key", key,
+					"remote_addr", remoteAddr,
+					"auth_failures", authFailures,
+					"error", err)
+				if authFailures >= maxAuthFailures {
+					// 消息被篡改或路由错误，以协议错误关闭，客户端重连后重新握手
+					logger.Error("Too many tunnel messages with invalid signature, closing tunnel",
+						"key", key,
+						"remote_addr", remoteAddr,
+						"auth_failures", authFailures)
+					_ = wsConn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.CloseReasonMessageAuthFailed),
+						time.Now().Add(time.Second))
+					return
+				}
+				continue
+			}
+		}
+
+		// readTunnelFrame 每次返回新分配的切片，Payload 无需复制
+		msg, err := protocol.DeserializeTunnelMessageNoCopy(data)
 		if err != nil {
 			logger.Error("Failed to deserialize tunnel message",
 				"key", key,
@@ -92,17 +211,74 @@ func (p *SinglePortProxy) clientReadLoop(wsConn *websocket.Conn, key string) {
 			continue
 		}
 
-		logger.Debug("Deserialized tunnel message",
+		logger.Trace("Deserialized tunnel message",
 			"key", key,
 			"remote_addr", remoteAddr,
 			"message_id", msg.ID,
 			"message_type", msg.Type,
 			"payload_size", len(msg.Payload))
 
-		p.handlersMu.Lock()
-		handler, ok := p.streamHandlers[msg.ID]
+		// 未协商本地转发的连接上，这两种消息按未知消息处理
+		if tc.localForward && p.handleLocalMessage(ctx, tc, msg) {
+			continue
+		}
+
+		switch msg.Type {
+		case protocol.MSG_TYPE_BIND_REQ:
+			p.handleBindRequest(tc, msg)
+			continue
+		case protocol.MSG_TYPE_TARGET_HEALTH:
+			down := string(msg.Payload) == protocol.TargetHealthDown
+			if tc.targetDown.Swap(down) != down {
+				logger.Info("Tunnel client reported target health",
+					"key", key,
+					"connection_id", tc.id,
+					"target_health", string(msg.Payload))
+			}
+			continue
+		case protocol.MSG_TYPE_TARGET_CHECK_RES:
+			res, err := protocol.DecodeTargetCheckResult(msg.Payload)
+			if err != nil {
+				res = protocol.TargetCheckResult{Error: "invalid check result from client: " + err.Error()}
+			}
+			if !p.targetChecks.deliver(msg.ID, res) {
+				logger.Debug("Dropping late target check result",
+					"key", key,
+					"connection_id", tc.id,
+					"message_id", msg.ID)
+			}
+			continue
+		case protocol.MSG_TYPE_HTTP_RES, protocol.MSG_TYPE_HTTP_RES_CHUNK, protocol.MSG_TYPE_HTTP_RES_FULL, protocol.MSG_TYPE_HTTP_RES_INTERIM:
+		default:
+			if msg.Type == protocol.MSG_TYPE_CANCEL && tc.responseAbort {
+				// 客户端读取目标响应体失败，交给处理器中止响应；未协商的连接上按未知消息处理
+				break
+			}
+			unknownCount++
+			unknownMessagesCounter.Inc()
+			logger.Warn("Received unknown message type from client",
+				"key", key,
+				"remote_addr", remoteAddr,
+				"message_id", msg.ID,
+				"message_type", msg.Type,
+				"unknown_count", unknownCount)
+			if unknownCount >= maxUnknown {
+				// 认为对端协议不兼容，以协议错误关闭，便于对端在重连时暴露问题
+				logger.Error("Too many unknown message types, closing incompatible tunnel",
+					"key", key,
+					"remote_addr", remoteAddr,
+					"unknown_count", unknownCount)
+				_ = wsConn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.CloseReasonUnknownMessages),
+					time.Now().Add(time.Second))
+				return
+			}
+			continue
+		}
+
+		handler, ok := p.lookupStreamHandler(msg.ID)
 		if !ok {
-			// 如果找不到处理器，说明这是一个新的请求
+			// 如果找不到处理器，说明请求已结束或ID未知
 			if msg.Type == protocol.MSG_TYPE_HTTP_RES {
 				logger.Warn("Received response for unknown request ID",
 					"key", key,
@@ -110,69 +286,312 @@ func (p *SinglePortProxy) clientReadLoop(wsConn *websocket.Conn, key string) {
 					"request_id", msg.ID,
 					"message_type", msg.Type)
 			}
-			p.handlersMu.Unlock()
 			continue
 		}
+		switch {
+		case handler.tunnel != tc:
+			// 只接受转发该请求的连接发来的消息，其他连接 (包括其他key) 不能回应、截断或劫持该请求
+			p.foreignResponse(key, tc, msg.ID, msg.Type)
+		case !handler.acquire():
+			// 处理器已因超时等原因结束，丢弃迟到的消息
+			lateStreamMessagesCounter.Inc()
+			logger.Debug("Dropping message for finished request",
+				"key", key,
+				"request_id", msg.ID,
+				"message_type", msg.Type)
+		default:
+			// 持有处理器的锁写入响应，写给慢速调用方时读取循环阻塞在这里，标签指出是哪个请求
+			var finished bool
+			pprof.Do(ctx, utils.RequestProfileLabels(key, msg.ID, "relay"), func(context.Context) {
+				finished = p.writeStreamMessage(key, handler, msg)
+			})
+			handler.mu.Unlock()
+			if finished {
+				p.removeStreamHandler(msg.ID)
+			}
+		}
+		if tc.chunkErrors.Load() >= maxChunkIntegrityFailures {
+			// 多个响应的数据块都校验失败，说明连接本身有问题，以协议错误关闭，客户端重连
+			logger.Error("Too many responses failed chunk integrity checks, closing tunnel",
+				"key", key,
+				"remote_addr", remoteAddr,
+				"connection_id", tc.id)
+			_ = wsConn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.CloseReasonChunkIntegrity),
+				time.Now().Add(time.Second))
+			return
+		}
+		if violations := tc.responseViolations.Load(); violations >= int32(maxViolations) {
+			// 客户端反复发送顺序错误的响应消息，可能有缺陷或被篡改，以协议错误关闭，客户端重连
+			logger.Error("Too many response protocol violations, closing tunnel",
+				"key", key,
+				"remote_addr", remoteAddr,
+				"connection_id", tc.id,
+				"violations", violations)
+			_ = wsConn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseProtocolError, protocol.CloseReasonResponseViolations),
+				time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+// writeStreamMessage 将WebSocket隧道的响应消息写回公网用户，调用方需持有 handler.mu。
+// 返回 true 表示响应已结束，处理器可以注销
+func (p *SinglePortProxy) writeStreamMessage(key string, handler *streamHandler, msg protocol.TunnelMessage) bool {
+	switch msg.Type {
+	case protocol.MSG_TYPE_HTTP_RES:
+		// 收到响应头
+		logger.Debug("Processing HTTP response header",
+			"key", key,
+			"request_id", msg.ID,
+			"payload_size", len(msg.Payload))
+
+		// 响应头只能写一次，重复的响应头会把第二个状态行混进响应体
+		if handler.headersSent {
+			p.responseViolation(key, handler, msg.ID, "duplicate_header")
+			return false
+		}
+		handler.headersSent = true
 
-		if msg.Type == protocol.MSG_TYPE_HTTP_RES {
-			// 收到响应头
-			logger.Debug("Processing HTTP response header",
+		resp, err := protocol.DeserializeHTTPResponse(msg.Payload)
+		if err != nil {
+			logger.Error("Failed to deserialize response header",
 				"key", key,
 				"request_id", msg.ID,
-				"payload_size", len(msg.Payload))
+				"error", err)
+			p.writeProxyError(handler.writer, proxyErrResponseDeserialize)
+			handler.finishLocked()
+			return true
+		}
 
-			resp, err := protocol.DeserializeHTTPResponse(msg.Payload)
-			if err != nil {
-				logger.Error("Failed to deserialize response header",
-					"key", key,
-					"request_id", msg.ID,
-					"error", err)
-				delete(p.streamHandlers, msg.ID)
-				close(handler.done)
-				p.handlersMu.Unlock()
-				continue
+		logger.Debug("Sending HTTP response header to client",
+			"key", key,
+			"request_id", msg.ID,
+			"status_code", resp.StatusCode,
+			"header_count", len(resp.Header))
+
+		if handler.capture != nil {
+			handler.capture.captureResponse(msg.ID, msg.Payload)
+		}
+
+		// 将响应头写回给公网用户，追加而非覆盖以保留服务器设置的会话保持cookie
+		for k, v := range resp.Header {
+			handler.writer.Header()[k] = append(handler.writer.Header()[k], v...)
+		}
+		handler.writeHeader(resp.StatusCode)
+		if err := handler.flushEarlyBody(msg.ID); err != nil {
+			p.abortOnWriteError(key, handler, msg.ID, err)
+			return true
+		}
+		handler.flusher.Flush() // 立即发送头部
+
+	case protocol.MSG_TYPE_HTTP_RES_INTERIM:
+		// 收到 1xx 临时响应 (如 103 Early Hints)，最终响应头之前可以有多个
+		if handler.headersSent {
+			logger.Warn("Ignoring interim response after final header",
+				"key", key,
+				"request_id", msg.ID)
+			return false
+		}
+		if err := handler.writeInterim(msg.Payload); err != nil {
+			logger.Warn("Failed to write interim response",
+				"key", key,
+				"request_id", msg.ID,
+				"error", err)
+			return false
+		}
+		logger.Debug("Interim response sent to client",
+			"key", key,
+			"request_id", msg.ID)
+
+	case protocol.MSG_TYPE_HTTP_RES_FULL:
+		// 收到包含完整响应体的小响应，一次性写回并结束
+		logger.Debug("Processing full HTTP response",
+			"key", key,
+			"request_id", msg.ID,
+			"payload_size", len(msg.Payload))
+
+		if handler.headersSent {
+			// 已流式发送了响应头，完整响应无法再写入，直接结束
+			p.responseViolation(key, handler, msg.ID, "duplicate_header")
+			if handler.capture != nil {
+				handler.capture.finishResponse(msg.ID)
 			}
+			handler.finishLocked()
+			return true
+		}
 
-			logger.Debug("Sending HTTP response header to client",
+		if handler.capture != nil {
+			handler.capture.captureResponse(msg.ID, msg.Payload)
+			handler.capture.finishResponse(msg.ID)
+		}
+		// 客户端转发目标服务失败: 由等待方按原因返回 502 或 504
+		if kind := protocol.ParseTargetError(msg.Payload); kind != "" {
+			handler.failure = proxyErrorKind(kind)
+			handler.finishLocked()
+			return true
+		}
+		// 完整响应自带响应体，之前缓冲的数据块 (已计为违规) 丢弃
+		handler.dropEarly()
+		handler.headersSent = true
+		if err := handler.writeFull(msg.Payload); err != nil {
+			logger.Error("Failed to write full response",
 				"key", key,
 				"request_id", msg.ID,
-				"status_code", resp.StatusCode,
-				"header_count", len(resp.Header))
+				"error", err)
+			p.writeProxyError(handler.writer, proxyErrResponseDeserialize)
+		}
+		handler.flusher.Flush()
+		handler.finishLocked()
+		return true
 
-			// 将响应头写回给公网用户
-			for k, v := range resp.Header {
-				handler.writer.Header()[k] = v
+	case protocol.MSG_TYPE_HTTP_RES_CHUNK:
+		payload, end := msg.Payload, len(msg.Payload) == 0
+		if handler.tunnel != nil && handler.tunnel.chunkSeq {
+			chunk, reason, err := handler.checkChunk(msg.Payload)
+			if err != nil {
+				p.failChunkIntegrity(key, handler, msg.ID, reason, err)
+				return true
 			}
-			handler.writer.WriteHeader(resp.StatusCode)
-			handler.flusher.Flush() // 立即发送头部
+			payload, end = chunk.Data, chunk.End
+		}
 
-		} else if msg.Type == protocol.MSG_TYPE_HTTP_RES_CHUNK {
-			// 收到响应体数据块
-			if len(msg.Payload) > 0 {
-				logger.Debug("Processing response body chunk",
+		// 响应头之前的数据块不能直接写出，否则会以隐含的 200 发出响应。
+		// 缓冲少量数据等待响应头，超出上限或在响应头之前结束时以 response_protocol_error 结束请求
+		if !handler.headersSent {
+			if !handler.earlyBody {
+				handler.earlyBody = true
+				p.responseViolation(key, handler, msg.ID, "chunk_before_header")
+			}
+			handler.progress.Add(len(payload))
+			if end || len(handler.early)+len(payload) > maxEarlyBodyBytes {
+				logger.Warn("Response body arrived without a header, failing request",
 					"key", key,
 					"request_id", msg.ID,
-					"chunk_size", len(msg.Payload))
-
-				if _, err := handler.writer.Write(msg.Payload); err != nil {
-					logger.Error("Failed to write chunk to response",
-						"key", key,
-						"request_id", msg.ID,
-						"chunk_size", len(msg.Payload),
-						"error", err)
+					"buffered_bytes", len(handler.early)+len(payload),
+					"end", end)
+				if handler.capture != nil {
+					handler.capture.finishResponse(msg.ID)
 				}
-				handler.flusher.Flush() // 立即发送数据块
-			} else {
-				// 收到空的数据块，表示流结束
-				logger.Debug("Response body streaming finished",
+				handler.dropEarly()
+				handler.failure = proxyErrResponseProtocol
+				handler.finishLocked()
+				return true
+			}
+			handler.bufferEarly(payload)
+			return false
+		}
+
+		// 收到空的数据块 (或带序号的结束标记)，表示流结束
+		if end {
+			logger.Debug("Response body streaming finished",
+				"key", key,
+				"request_id", msg.ID)
+			if handler.capture != nil {
+				handler.capture.finishResponse(msg.ID)
+			}
+			if err := handler.closeBody(); err != nil {
+				logger.Error("Failed to write transformed response tail",
 					"key", key,
-					"request_id", msg.ID)
-				close(handler.done)
-				delete(p.streamHandlers, msg.ID)
+					"request_id", msg.ID,
+					"error", err)
 			}
+			handler.flusher.Flush()
+			handler.finishLocked()
+			return true
+		}
+
+		// 收到响应体数据块，调试级别只按数据量和时间汇总输出进度
+		handler.progress.Add(len(payload))
+		logger.Trace("Processing response body chunk",
+			"key", key,
+			"request_id", msg.ID,
+			"chunk_size", len(payload))
+
+		if handler.capture != nil {
+			handler.capture.captureResponseBody(msg.ID, payload)
 		}
-		p.handlersMu.Unlock()
+		// 逐块立即发送，配置了 -chunk-coalesce-bytes 时合并连续的小数据块
+		if err := handler.writeChunk(payload); err != nil {
+			p.abortOnWriteError(key, handler, msg.ID, err)
+			return true
+		}
+
+	case protocol.MSG_TYPE_CANCEL:
+		// 客户端读取目标响应体失败 (见 FeatureResponseAbort)，响应头已发出时等待方截断响应
+		kind := string(msg.Payload)
+		if !protocol.IsTargetError(kind) {
+			kind = protocol.TargetErrRead
+		}
+		logger.Warn("Tunnel client aborted the response",
+			"key", key,
+			"request_id", msg.ID,
+			"target_error", kind,
+			"headers_sent", handler.headersSent,
+			"bytes", handler.progress.Bytes)
+		if handler.capture != nil {
+			handler.capture.finishResponse(msg.ID)
+		}
+		handler.dropEarly()
+		handler.failure = proxyErrorKind(kind)
+		handler.finishLocked()
+		return true
+	}
+	return false
+}
+
+// failChunkIntegrity 以 chunk_integrity_failed 结束响应校验失败的请求，调用方需持有 handler.mu。
+// 响应头已发出时等待方中断公网连接，用户收到截断的响应而不是损坏的响应体
+func (p *SinglePortProxy) failChunkIntegrity(key string, handler *streamHandler, requestID uint64, reason string, err error) {
+	chunkIntegrityErrorsCounter.WithLabelValue(reason).Inc()
+	failures := handler.tunnel.chunkErrors.Add(1)
+	logger.Error("Response chunk integrity check failed, aborting response",
+		"key", key,
+		"request_id", requestID,
+		"connection_id", handler.tunnel.id,
+		"reason", reason,
+		"chunks", handler.progress.Chunks,
+		"bytes", handler.progress.Bytes,
+		"connection_failures", failures,
+		"error", err)
+	if handler.capture != nil {
+		handler.capture.finishResponse(requestID)
+	}
+	handler.failure = proxyErrChunkIntegrity
+	handler.finishLocked()
+}
+
+// responseViolation 记录一条违反响应消息顺序的消息 (重复的响应头、响应头之前的数据块)，
+// 计入指标和所属连接的违规次数，达到 -max-response-violations 后读取循环关闭连接。调用方需持有 handler.mu
+func (p *SinglePortProxy) responseViolation(key string, handler *streamHandler, requestID uint64, kind string) {
+	responseViolationsCounter.WithLabelValue(kind).Inc()
+	var violations int32
+	if handler.tunnel != nil {
+		violations = handler.tunnel.responseViolations.Add(1)
 	}
+	logger.Warn("Tunnel client violated the response message order",
+		"key", key,
+		"request_id", requestID,
+		"kind", kind,
+		"connection_violations", violations)
+}
+
+// foreignResponse 记录并丢弃一条回应不属于发送方的请求ID的消息，计入发送方连接的违规次数 (长轮询隧道 tc 为nil)。
+// 请求ID在所有连接之间共享，只按ID查找会让任一已认证的客户端写入其他连接或其他key的响应
+func (p *SinglePortProxy) foreignResponse(key string, tc *tunnelConn, requestID uint64, msgType protocol.MessageType) {
+	responseViolationsCounter.WithLabelValue("foreign_request").Inc()
+	args := []any{
+		"key", key,
+		"request_id", requestID,
+		"message_type", msgType,
+	}
+	if tc != nil {
+		args = append(args,
+			"connection_id", tc.id,
+			"connection_violations", tc.responseViolations.Add(1))
+	}
+	logger.Warn("Dropping response for a request forwarded by another tunnel", args...)
 }
 
 // getLimiter 获取或创建一个指定 key 的速率限制器
@@ -187,8 +606,8 @@ func (p *SinglePortProxy) getKeyLimiter(key string) *rate.Limiter {
 			// 返回一个总是允许的限制器
 			limiter = rate.NewLimiter(rate.Inf, 0)
 		} else {
-			// 创建一个新的限制器: 每秒 N 个请求，突发 2N 个
-			limiter = rate.NewLimiter(rate.Limit(p.config.KeyRateLimit), p.config.KeyRateLimit*2)
+			// 创建一个新的限制器: 每秒 N 个请求，突发按 keys.<key>.rate_burst、-key-rate-burst、2N 的顺序取值
+			limiter = rate.NewLimiter(rate.Limit(p.config.KeyRateLimit), p.keyRateBurst(key))
 		}
 		p.keyLimiters[key] = limiter
 	}
@@ -220,73 +639,220 @@ func (p *SinglePortProxy) getIPLimiter(ip string) *rate.Limiter {
 // handlePublicHTTPRequest 处理来自公网的请求 (支持流式传输) 增加速率限制
 func (p *SinglePortProxy) handlePublicHTTPRequest(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
+	if p.servePaused(w, r, "http") {
+		return
+	}
 
 	// 检查 IP 速率限制
-	ip, port, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	addr, ok := utils.ParseClientIP(host)
+	if err != nil || !ok {
 		logger.Error("Failed to parse remote address",
 			"remote_addr", r.RemoteAddr,
 			"error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		p.writeProxyError(w, proxyErrBadRemoteAddr)
 		return
 	}
+	// 以规范形式作为限速、日志和访问控制中的客户端标识，IPv4映射的IPv6连接与IPv4连接不会被计为两个客户端；
+	// 改写后的连接地址也用于转发到备用地址时的 X-Forwarded-For
+	ip := addr.String()
+	r.RemoteAddr = net.JoinHostPort(ip, port)
+
+	// 集群中其他服务器转发的请求: 客户端标识取转发方记录的公网地址，IP速率限制已由转发方执行；
+	// 连接的TLS指纹属于转发方而非公网客户端，不记录
+	tlsFingerprint := tlsFingerprintFrom(r)
+	fromPeer := p.cluster.fromPeer(r)
+	sec := p.connSecurityOf(r)
+	if fromPeer {
+		if peerIP, ok := peerClientIP(r); ok {
+			ip = peerIP
+		}
+		tlsFingerprint = ""
+		// 转发方已整理过协议和客户端证书头部
+		sec = proxiedSecurity(r)
+	}
+	p.applyForwardedHeaders(r, sec)
 
 	logger.Debug("Processing public HTTP request",
 		"client_ip", ip,
 		"client_port", port,
 		"method", r.Method,
-		"url", r.URL.String(),
-		"user_agent", r.Header.Get("User-Agent"))
+		"url", utils.SanitizeURL(r.URL),
+		"user_agent", r.Header.Get("User-Agent"),
+		"tls_fingerprint", tlsFingerprint,
+		"scheme", sec.scheme(),
+		"client_cert", sec.clientCertSubject())
 
-	ipLimiter := p.getIPLimiter(ip)
-	if !ipLimiter.Allow() {
+	if !fromPeer && !p.getIPLimiter(ip).Allow() {
 		logger.Warn("IP rate limited",
 			"client_ip", ip,
 			"method", r.Method,
-			"url", r.URL.String())
-		http.Error(w, "Too many requests from your IP", http.StatusTooManyRequests)
+			"url", utils.SanitizeURL(r.URL))
+		p.rejectRateLimited(w, r, ip, "Too many requests from your IP")
 		return
 	}
 
 	// 2. 获取密钥
-	key := r.Header.Get("X-Tunnel-Key")
-	if key == "" {
-		key = "default"
-		logger.Debug("Using default tunnel key", "client_ip", ip)
-	} else {
-		logger.Debug("Using tunnel key from header",
+	key, keySource := p.routes.resolveKey(r)
+	if keySource == "default" || keySource == "host_default" {
+		if !p.checkDefaultRoute(w, r, ip, key, keySource) {
+			return
+		}
+	}
+	if err := p.keyValidator.Validate(key); err != nil {
+		logger.Warn("Rejected public request with invalid tunnel key",
 			"client_ip", ip,
-			"key", key)
+			"key_length", len(key),
+			"source", keySource,
+			"error", err)
+		http.Error(w, "Invalid tunnel key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Debug("Resolved tunnel key",
+		"client_ip", ip,
+		"key", key,
+		"source", keySource)
+
+	// 公网调用方声明的超时替代服务器默认的响应超时，限制范围后随请求转发，客户端对目标服务使用相同的截止时间
+	requestTimeout, requestTimeoutSource := p.requestTimeout(r)
+	if requestTimeout > 0 {
+		r.Header.Set(protocol.HeaderRequestTimeout, protocol.FormatRequestTimeout(requestTimeout))
+	}
+
+	// 记录该key的请求数、流量、状态码和耗时
+	uw := &usageWriter{ResponseWriter: w}
+	w = uw
+	var body *countingBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	var servedBy *tunnelConn
+	var backend string // 调用方指定的连接ID
+	defer func() {
+		stats := requestStats{
+			key:      key,
+			method:   r.Method,
+			path:     r.URL.Path,
+			start:    startTime,
+			duration: time.Since(startTime),
+			status:   uw.status,
+			aborted:  uw.aborted,
+			bytesOut: uw.bytes,
+
+			clientIP:   ip,
+			keySource:  keySource,
+			proxyError: uw.proxyError,
+
+			tlsFingerprint: tlsFingerprint,
+			scheme:         sec.scheme(),
+			clientCert:     sec.clientCertSubject(),
+			backend:        backend,
+		}
+		if body != nil {
+			stats.bytesIn = body.n
+		}
+		if servedBy != nil {
+			// 供负载均衡按最近错误率排除连接
+			servedBy.recent.add(time.Now(), stats.failed())
+		}
+		if uw.proxyError != "" {
+			logger.Warn("Proxy error response",
+				"client_ip", ip,
+				"key", p.logKey(key),
+				"method", r.Method,
+				"url", p.logURL(key, r.URL),
+				"status", uw.status,
+				"proxy_error", uw.proxyError,
+				"key_source", keySource,
+				"request_timeout", requestTimeout,
+				"request_timeout_source", requestTimeoutSource,
+				"duration", stats.duration)
+		}
+		p.recordRequest(stats)
+	}()
+
+	// 请求已经过本服务器说明路由形成了环路，继续转发只会不断放大
+	if !p.checkProxyLoop(w, r, ip, key, keySource) {
+		return
+	}
+
+	// 开放时段外不转发，也不消耗key的速率限制
+	if p.serveScheduleClosed(w, r, key) {
+		return
 	}
 
-	// 检查 Key 速率限制
-	keyLimiter := p.getKeyLimiter(key)
-	if !keyLimiter.Allow() {
+	// 检查 Key 速率限制，配置了平滑等待时短暂排队而不是立即拒绝
+	if !p.allowKeyRequest(r, key) {
+		if r.Context().Err() != nil {
+			// 公网用户在排队时断开，没有人接收响应
+			return
+		}
 		logger.Warn("Key rate limited",
 			"client_ip", ip,
-			"key", key,
+			"key", p.logKey(key),
 			"method", r.Method,
-			"url", r.URL.String())
-		http.Error(w, "Too many requests for this service", http.StatusTooManyRequests)
+			"url", p.logURL(key, r.URL))
+		p.rejectRateLimited(w, r, ip, "Too many requests for this service")
 		return
 	}
 
-	// 尝试WebSocket隧道
-	p.connsMu.RLock()
-	wsConn, wsExists := p.clientConns[key]
-	p.connsMu.RUnlock()
+	// 携带 Idempotency-Key 的重复提交返回第一次的响应，不再转发到隧道
+	idem, handled := p.beginIdempotent(uw, r, key, ip)
+	if handled {
+		return
+	}
+	if idem != nil {
+		defer idem.finish(uw)
+	}
+
+	// 调用方指定的连接在合并之前取出，指定了连接的请求必须由该连接处理，不与其他请求共享响应
+	backend = p.backendOverride(r, key, ip)
+
+	// 相同的并发 GET/HEAD 请求等待第一个请求的响应，只经隧道转发一次
+	if backend == "" {
+		coalesced, handled := p.beginCoalesced(uw, r, key, ip)
+		if handled {
+			return
+		}
+		if coalesced != nil {
+			defer coalesced.finish(uw)
+		}
+	}
+
+	// 尝试WebSocket隧道，同一key有多个连接时按负载均衡和会话保持选择
+	wsTunnel := p.selectTunnel(w, r, key, backend)
+	if backend != "" && wsTunnel == nil {
+		p.writeBackendNotFound(w, key, backend)
+		return
+	}
+	wsExists := wsTunnel != nil
+	servedBy = wsTunnel
 
 	// 尝试HTTP长轮询隧道
 	p.httpTunnelMgr.mu.RLock()
 	httpClient, httpExists := p.httpTunnelMgr.clients[key]
 	p.httpTunnelMgr.mu.RUnlock()
 
+	// 本机没有该key的隧道时，转发到集群中拥有它的服务器。已由其他服务器转发的请求不再转发，避免两台服务器互相转发
+	if !wsExists && !httpExists && !fromPeer && p.serveFromPeer(w, r, key, ip) {
+		return
+	}
+
+	// 隧道离线或所有连接都被排除时，转发到key配置的备用地址
+	if (!wsExists && !httpExists) || (!httpExists && p.tunnelsExcluded(key)) {
+		if p.serveFallback(w, r, key, ip) {
+			servedBy = nil
+			return
+		}
+	}
+
 	if !wsExists && !httpExists {
 		logger.Warn("No active tunnel for key",
 			"client_ip", ip,
-			"key", key,
+			"key", p.logKey(key),
 			"method", r.Method,
-			"url", r.URL.String(),
+			"url", p.logURL(key, r.URL),
 			"available_ws_keys", func() []string {
 				p.connsMu.RLock()
 				defer p.connsMu.RUnlock()
@@ -305,49 +871,146 @@ func (p *SinglePortProxy) handlePublicHTTPRequest(w http.ResponseWriter, r *http
 				}
 				return keys
 			}())
-		http.Error(w, "Service unavailable", http.StatusBadGateway)
+		if !p.serveOffline(w, r, key) {
+			p.writeProxyError(w, proxyErrNoTunnel)
+		}
 		return
 	}
+	if p.cluster != nil {
+		if fromPeer {
+			clusterRequestsCounter.WithLabelValue("from_peer").Inc()
+		} else {
+			clusterRequestsCounter.WithLabelValue("local").Inc()
+		}
+	}
 
-	// 序列化HTTP请求
-	reqData, err := protocol.SerializeHTTPRequest(r)
-	if err != nil {
-		logger.Error("Failed to serialize request",
+	// 超大的头部会在隧道两端和目标服务逐跳放大内存占用，序列化之前拒绝
+	if err := p.headerLimits.Check(r.Header); err != nil {
+		limit := "total"
+		var limitErr *protocol.HeaderLimitError
+		if errors.As(err, &limitErr) {
+			limit = limitErr.Limit
+		}
+		headerLimitRejectionsCounter.WithLabelValue(limit).Inc()
+		logger.Warn("Rejected public request exceeding header limits",
 			"client_ip", ip,
 			"key", key,
 			"method", r.Method,
-			"url", r.URL.String(),
+			"url", utils.SanitizeURL(r.URL),
+			"limit", limit,
 			"error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, "Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
 		return
 	}
 
+	// 按key的改写规则处理请求体
+	// 读取请求体时要求调用方持续发送，过慢的调用方不能无限期占用处理协程
+	p.limitBodyReadTime(w, r)
+
+	pipeline := p.transforms.pipeline(key)
+	if err := pipeline.Request(r); err != nil {
+		if errors.Is(err, errClientBodyTimeout) {
+			p.rejectSlowBody(w, ip, key)
+			return
+		}
+		logger.Warn("Failed to read request body for transform",
+			"client_ip", ip,
+			"key", key,
+			"error", err)
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// 序列化HTTP请求。长轮询客户端支持时，大的或长度未知的请求体不放入轮询消息，
+	// 由客户端从 body 端点流式读取，服务器不缓存整个请求体
+	streamBody := !wsExists && httpExists && httpClient.bodyStream &&
+		(r.ContentLength < 0 || r.ContentLength > longPollInlineBodyLimit)
+	var reqData []byte
+	if streamBody {
+		reqData = protocol.SerializeHTTPRequestHead(r)
+	} else {
+		var err error
+		reqData, err = protocol.SerializeHTTPRequest(r)
+		if errors.Is(err, errClientBodyTimeout) {
+			p.rejectSlowBody(w, ip, key)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to serialize request",
+				"client_ip", ip,
+				"key", key,
+				"method", r.Method,
+				"url", utils.SanitizeURL(r.URL),
+				"error", err)
+			p.writeProxyError(w, proxyErrRequestSerialize)
+			return
+		}
+	}
+
 	requestID := atomic.AddUint64(&p.nextRequestID, 1)
+	// goroutine profile 中按key和请求ID区分等待响应的协程，返回前清除标签
+	labeled := pprof.WithLabels(r.Context(), utils.RequestProfileLabels(key, requestID, "wait"))
+	pprof.SetGoroutineLabels(labeled)
+	defer pprof.SetGoroutineLabels(r.Context())
+	r = r.WithContext(labeled)
+	transport := logger.TransportWebSocket
+	if !wsExists {
+		transport = logger.TransportLongPoll
+	}
+	rl := logger.RequestLogger(transport, key, requestID, r.Method, r.URL.Path)
 
-	logger.Debug("Generated request ID and serialized request",
+	rl.Debug("Generated request ID and serialized request",
 		"client_ip", ip,
-		"key", key,
-		"request_id", requestID,
-		"serialized_size", len(reqData),
-		"method", r.Method,
-		"url", r.URL.String())
+		"serialized_size", len(reqData))
+
+	// 超过协商上限的消息会被客户端当作协议错误断开连接，影响该连接上的所有请求，在发送前拒绝
+	if wsExists && len(reqData)+wsTunnel.requestOverhead() > wsTunnel.maxFrameSize {
+		rl.Warn("Request exceeds the tunnel frame size limit",
+			"client_ip", ip,
+			"serialized_size", len(reqData),
+			"max_frame_size", wsTunnel.maxFrameSize)
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
 
 	// 检查 ResponseWriter 是否支持 Flusher
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		logger.Error("ResponseWriter does not support flushing",
-			"client_ip", ip,
-			"key", key,
-			"request_id", requestID)
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		rl.Error("ResponseWriter does not support flushing",
+			"client_ip", ip)
+		p.writeProxyError(w, proxyErrStreamingUnsupported)
 		return
 	}
 
+	kc := p.config.KeyConfig(key)
+	// 响应头之前缓冲的响应体计入转发该请求的连接，长轮询隧道单独计数
+	frames := p.frames.account()
+	if wsExists {
+		frames = wsTunnel.frames
+	}
 	done := make(chan struct{})
 	handler := &streamHandler{
-		writer:  w,
-		flusher: flusher,
-		done:    done,
+		writer:    w,
+		flusher:   flusher,
+		done:      done,
+		request:   r,
+		key:       key,
+		transform: pipeline,
+		tunnel:    wsTunnel,
+		frames:    frames,
+		progress: logger.NewStreamProgress("Response stream progress",
+			"key", key,
+			"request_id", requestID),
+		sse: kc != nil && kc.SSE,
+	}
+	// 期望事件流的请求 (浏览器 EventSource) 逐块送达，不合并
+	if !utils.AcceptsEventStream(r.Header) {
+		handler.coalesceBytes = p.config.ChunkCoalesceBytes
+		handler.coalesceDelay = p.config.ChunkCoalesceDelay
+	}
+	if cs := p.captures.get(key); cs != nil {
+		cs.captureRequest(requestID, reqData)
+		handler.capture = cs
 	}
 
 	p.handlersMu.Lock()
@@ -359,110 +1022,211 @@ func (p *SinglePortProxy) handlePublicHTTPRequest(w http.ResponseWriter, r *http
 	// 选择隧道类型发送消息
 	if wsExists {
 		// 使用WebSocket隧道
-		logger.Debug("Sending request to client via WebSocket",
-			"client_ip", ip,
-			"key", key,
-			"request_id", requestID)
+		rl.Debug("Sending request to client via WebSocket",
+			"client_ip", ip)
 
-		msgData, _ := protocol.SerializeTunnelMessage(tunnelMsg)
-		if err := wsConn.WriteMessage(websocket.BinaryMessage, msgData); err != nil {
-			logger.Error("Failed to send request to WebSocket client",
+		if err := wsTunnel.sendRequest(tunnelMsg); err != nil {
+			rl.Error("Failed to send request to WebSocket client",
 				"client_ip", ip,
-				"key", key,
-				"request_id", requestID,
+				"connection_id", wsTunnel.id,
 				"error", err)
-			p.handlersMu.Lock()
-			delete(p.streamHandlers, requestID)
-			p.handlersMu.Unlock()
-			http.Error(w, "Failed to forward request", http.StatusBadGateway)
+			// 写入队列已满时返回503，调用方可以稍后重试，而不是阻塞到客户端跟上
+			kind := proxyErrTunnelWrite
+			if errors.Is(err, errTunnelQueueFull) {
+				kind = proxyErrTunnelBusy
+			}
+			if expired, _ := p.expireStreamHandler(requestID, handler, false); expired {
+				p.writeProxyError(w, kind)
+			}
 			return
 		}
 
-		logger.Debug("Request sent to WebSocket client",
-			"client_ip", ip,
-			"key", key,
-			"request_id", requestID)
+		rl.Debug("Request sent to WebSocket client",
+			"client_ip", ip)
 
 	} else if httpExists {
 		// 使用HTTP长轮询隧道
-		logger.Debug("Sending request to client via HTTP tunnel",
-			"client_ip", ip,
-			"key", key,
-			"request_id", requestID)
+		rl.Debug("Sending request to client via HTTP tunnel",
+			"client_ip", ip)
+
+		if streamBody {
+			httpClient.pendingBodies.Store(requestID, &pendingBody{body: r.Body, length: r.ContentLength})
+			defer httpClient.pendingBodies.Delete(requestID)
+		}
 
 		// 发送消息到长轮询客户端
 		select {
 		case httpClient.pollChan <- &tunnelMsg:
-			logger.Debug("Request queued for HTTP tunnel client",
-				"client_ip", ip,
-				"key", key,
-				"request_id", requestID)
+			rl.Debug("Request queued for HTTP tunnel client",
+				"client_ip", ip)
 		default:
 			// 通道已满，客户端可能无响应
-			logger.Error("Failed to queue request for HTTP tunnel client - channel full",
-				"client_ip", ip,
-				"key", key,
-				"request_id", requestID)
-			p.handlersMu.Lock()
-			delete(p.streamHandlers, requestID)
-			p.handlersMu.Unlock()
-			http.Error(w, "Tunnel client busy", http.StatusServiceUnavailable)
+			rl.Error("Failed to queue request for HTTP tunnel client - channel full",
+				"client_ip", ip)
+			if expired, _ := p.expireStreamHandler(requestID, handler, false); expired {
+				p.writeProxyError(w, proxyErrTunnelBusy)
+			}
 			return
 		}
 	}
 
-	// 等待流结束或超时 (增加更长的超时时间，避免与连接超时冲突)
-	timeout := 90 * time.Second
-	timer := time.NewTimer(timeout)
+	// 等待流结束或超时：响应头需在 response_header_timeout 内到达，之后只受总超时约束
+	headerTimeout := p.config.ResponseHeaderTimeout
+	if headerTimeout <= 0 {
+		headerTimeout = defaultResponseHeaderTimeout
+	}
+	responseTimeout := p.config.ResponseTimeout
+	if responseTimeout <= 0 {
+		responseTimeout = defaultResponseTimeout
+	}
+	if requestTimeout > 0 {
+		responseTimeout = requestTimeout
+		if headerTimeout > requestTimeout {
+			headerTimeout = requestTimeout
+		}
+	}
+	headerTimer := time.NewTimer(headerTimeout)
+	defer headerTimer.Stop()
+	timer := time.NewTimer(responseTimeout)
 	defer timer.Stop()
+	// 配置了 sse_heartbeat 时定期检查事件流是否空闲
+	var heartbeat <-chan time.Time
+	var heartbeatInterval time.Duration
+	if kc != nil && kc.SSEHeartbeat > 0 {
+		heartbeatInterval = time.Duration(kc.SSEHeartbeat)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
 
-	select {
-	case <-handler.done:
-		// 流正常结束
-		duration := time.Since(startTime)
-		tunnelType := "WebSocket"
-		if httpExists && !wsExists {
-			tunnelType = "HTTP"
-		}
-		logger.Info("Response stream completed successfully",
-			"client_ip", ip,
-			"key", key,
-			"request_id", requestID,
-			"duration", duration,
-			"method", r.Method,
-			"url", r.URL.String(),
-			"tunnel_type", tunnelType)
-	case <-timer.C:
-		duration := time.Since(startTime)
-		logger.Error("Timeout waiting for response stream",
-			"client_ip", ip,
-			"key", key,
-			"request_id", requestID,
-			"timeout", timeout,
-			"duration", duration,
-			"method", r.Method,
-			"url", r.URL.String())
-		p.handlersMu.Lock()
-		delete(p.streamHandlers, requestID)
-		p.handlersMu.Unlock()
-		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+	for {
+		select {
+		case <-handler.done:
+			if handler.clientGone {
+				// 读取循环写入失败时已通知客户端停止转发
+				uw.aborted = true
+				rl.Info("Public client disconnected before response completed",
+					"client_ip", ip,
+					"duration", time.Since(startTime),
+					"headers_sent", handler.headersSent)
+				return
+			}
+			if handler.failure != "" {
+				// 响应未完成就被结束，例如隧道连接被替换
+				rl.Warn("Request ended before the tunnel completed the response",
+					"client_ip", ip,
+					"proxy_error", handler.failure,
+					"headers_sent", handler.headersSent,
+					"duration", time.Since(startTime))
+				if handler.headersSent {
+					p.truncateResponse(w, r, handler, key, requestID, handler.failure)
+					return
+				}
+				p.writeProxyError(w, handler.failure)
+				return
+			}
+			// 流正常结束
+			rl.Completed("Response stream completed successfully", uw.status, time.Since(startTime), uw.bytes,
+				"client_ip", ip,
+				"chunks", handler.progress.Chunks,
+				"key_source", keySource,
+				"request_timeout", requestTimeout,
+				"request_timeout_source", requestTimeoutSource)
+			return
+		case <-r.Context().Done():
+			// 公网用户断开连接，通知客户端停止处理
+			expired, headersSent := p.expireStreamHandler(requestID, handler, false)
+			if !expired {
+				continue
+			}
+			uw.aborted = true
+			rl.Info("Public client disconnected before response completed",
+				"client_ip", ip,
+				"duration", time.Since(startTime),
+				"headers_sent", headersSent)
+			handler.notifyCancel(requestID, protocol.CancelReasonClientDisconnect)
+			return
+		case <-headerTimer.C:
+			if expired, _ := p.expireStreamHandler(requestID, handler, true); !expired {
+				continue
+			}
+			responseHeaderTimeoutCounter.Inc()
+			rl.Error("Timeout waiting for response header",
+				"client_ip", ip,
+				"timeout", headerTimeout,
+				"duration", time.Since(startTime))
+			handler.notifyCancel(requestID, protocol.CancelReasonTimeout)
+			p.writeProxyError(w, proxyErrResponseHeaderTimeout)
+			return
+		case <-heartbeat:
+			handler.writeSSEHeartbeat(heartbeatInterval)
+		case <-timer.C:
+			if handler.streamingSSE() {
+				// 事件流可以长时间保持，由公网用户或隧道断开结束
+				rl.Debug("Response timeout does not apply to event stream")
+				continue
+			}
+			expired, headersSent := p.expireStreamHandler(requestID, handler, false)
+			if !expired {
+				continue
+			}
+			rl.Error("Timeout waiting for response stream",
+				"client_ip", ip,
+				"timeout", responseTimeout,
+				"duration", time.Since(startTime),
+				"headers_sent", headersSent)
+			handler.notifyCancel(requestID, protocol.CancelReasonTimeout)
+			if headersSent {
+				// 状态码已发出，只能截断响应让用户感知响应不完整
+				p.truncateResponse(w, r, handler, key, requestID, proxyErrResponseTimeout)
+				return
+			}
+			p.writeProxyError(w, proxyErrResponseTimeout)
+			return
+		}
+	}
+}
+
+// abortResponse 中断已发出响应头的响应。
+// 直接关闭底层连接，使用户收到截断的响应而不是看似完整的错误页面
+func abortResponse(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
 	}
+	panic(http.ErrAbortHandler)
 }
 
 // handleHTTPTunnel 处理HTTP长轮询模式的隧道连接
 func (p *SinglePortProxy) handleHTTPTunnel(w http.ResponseWriter, r *http.Request) {
-	// 解析路径获取操作类型和key
-	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/http-tunnel/"), "/")
-	if len(pathParts) < 2 {
-		http.Error(w, "Invalid HTTP tunnel path format. Use: /http-tunnel/{operation}/{key}", http.StatusBadRequest)
+	if !p.checkRegistrationAccess(w, r) {
+		return
+	}
+
+	// 解析路径获取操作类型和key，body 操作额外带请求ID: /http-tunnel/body/{key}/{id}
+	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, p.longPollPathPrefix), "/")
+	var requestID string
+	if len(pathParts) == 3 && pathParts[0] == "body" {
+		requestID = pathParts[2]
+		pathParts = pathParts[:2]
+	}
+	if len(pathParts) != 2 {
+		http.Error(w, "Invalid HTTP tunnel path format. Use: "+p.longPollPathPrefix+"{operation}/{key}", http.StatusBadRequest)
 		return
 	}
 
 	operation := pathParts[0]
 	key := pathParts[1]
 
-	if key == "" {
-		http.Error(w, "Tunnel key cannot be empty", http.StatusBadRequest)
+	if err := p.keyValidator.Validate(key); err != nil {
+		logger.Warn("Rejected HTTP tunnel request with invalid key",
+			"operation", operation,
+			"key_length", len(key),
+			"remote_addr", r.RemoteAddr,
+			"error", err)
+		http.Error(w, "Invalid tunnel key: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -479,8 +1243,10 @@ func (p *SinglePortProxy) handleHTTPTunnel(w http.ResponseWriter, r *http.Reques
 		p.handleHTTPTunnelPoll(w, r, key)
 	case "response":
 		p.handleHTTPTunnelResponse(w, r, key)
+	case "body":
+		p.handleHTTPTunnelBody(w, r, key, requestID)
 	default:
-		http.Error(w, "Invalid operation. Use: register, poll, or response", http.StatusBadRequest)
+		http.Error(w, "Invalid operation. Use: register, poll, body, or response", http.StatusBadRequest)
 	}
 }
 
@@ -496,6 +1262,30 @@ func (p *SinglePortProxy) handleHTTPTunnelRegister(w http.ResponseWriter, r *htt
 		"key", key,
 		"remote_addr", remoteAddr)
 
+	if p.tunnelKeyLimitReached(key) {
+		tunnelKeyLimitCounter.Inc()
+		logger.Warn("HTTP tunnel registration rejected - tunnel key limit reached",
+			"key", p.logKey(key),
+			"remote_addr", remoteAddr,
+			"max_tunnel_keys", p.config.MaxTunnelKeys)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Tunnel key limit reached", http.StatusServiceUnavailable)
+		return
+	}
+	if p.refuseDrainingRegistration(w, key, remoteAddr) {
+		return
+	}
+	if ok, wait := p.registrations.allow(key); !ok {
+		registrationThrottledCounter.Inc()
+		logger.Warn("HTTP tunnel registration rate limited",
+			"key", key,
+			"remote_addr", remoteAddr,
+			"retry_after", wait)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many registrations for this key", http.StatusTooManyRequests)
+		return
+	}
+
 	// 创建或更新客户端
 	p.httpTunnelMgr.mu.Lock()
 
@@ -516,6 +1306,7 @@ func (p *SinglePortProxy) handleHTTPTunnelRegister(w http.ResponseWriter, r *htt
 		lastSeen:     time.Now(),
 		pollChan:     make(chan *protocol.TunnelMessage, 10), // 缓冲通道
 		responseChan: make(chan *protocol.TunnelMessage, 10),
+		bodyStream:   protocol.HasFeature(r.Header.Get(protocol.HeaderFeatures), protocol.FeatureBodyStream),
 	}
 	p.httpTunnelMgr.clients[key] = client
 	clientCount := len(p.httpTunnelMgr.clients)
@@ -577,13 +1368,16 @@ func (p *SinglePortProxy) handleHTTPTunnelPoll(w http.ResponseWriter, r *http.Re
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		if _, ok := client.pendingBodies.Load(msg.ID); ok {
+			w.Header().Set(protocol.HeaderRequestBody, protocol.RequestBodyStream)
+		}
 
 		w.WriteHeader(http.StatusOK)
 		w.Write(msgData)
 
 		logger.Debug("HTTP tunnel message sent to client",
 			"key", key,
-			"message_id", msg.ID,
+			"request_id", msg.ID,
 			"message_type", msg.Type)
 
 	case <-timer.C:
@@ -644,17 +1438,77 @@ func (p *SinglePortProxy) handleHTTPTunnelResponse(w http.ResponseWriter, r *htt
 
 	logger.Debug("HTTP tunnel response received",
 		"key", key,
-		"message_id", msg.ID,
+		"request_id", msg.ID,
 		"message_type", msg.Type)
 
-	// 处理响应消息
-	p.handleHTTPTunnelMessage(&msg, key)
+	// 处理响应消息，写给公网调用方之前计入已读入的数据
+	frames := p.frames.account()
+	frames.acquire(len(body))
+	pprof.Do(r.Context(), utils.RequestProfileLabels(key, msg.ID, "relay"), func(context.Context) {
+		p.handleHTTPTunnelMessage(&msg, key)
+	})
+	frames.release(len(body))
 
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"status": "received"}`))
 }
 
+// handleHTTPTunnelBody 向长轮询客户端流式发送公网请求的请求体，每个请求体只能读取一次
+func (p *SinglePortProxy) handleHTTPTunnelBody(w http.ResponseWriter, r *http.Request, key, id string) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed. Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	requestID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	p.httpTunnelMgr.mu.RLock()
+	client, exists := p.httpTunnelMgr.clients[key]
+	p.httpTunnelMgr.mu.RUnlock()
+
+	if !exists {
+		http.Error(w, "Tunnel not registered. Please register first", http.StatusNotFound)
+		return
+	}
+	value, ok := client.pendingBodies.LoadAndDelete(requestID)
+	if !ok {
+		// 公网请求已结束，或请求体已被读取
+		http.Error(w, "Request body not found", http.StatusNotFound)
+		return
+	}
+	pending := value.(*pendingBody)
+
+	p.httpTunnelMgr.mu.Lock()
+	client.lastSeen = time.Now()
+	p.httpTunnelMgr.mu.Unlock()
+
+	// 长度已知时声明 Content-Length，中途失败断开连接后客户端能发现请求体不完整
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if pending.length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(pending.length, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	n, err := io.Copy(w, pending.body)
+	if err != nil {
+		logger.Warn("Failed to stream request body to HTTP tunnel client",
+			"key", key,
+			"request_id", requestID,
+			"bytes", n,
+			"error", err)
+		abortResponse(w)
+		return
+	}
+
+	logger.Debug("Request body streamed to HTTP tunnel client",
+		"key", key,
+		"request_id", requestID,
+		"bytes", n)
+}
+
 // cleanupHTTPTunnelClient 定期清理不活跃的客户端
 func (p *SinglePortProxy) cleanupHTTPTunnelClient(key string) {
 	ticker := time.NewTicker(60 * time.Second) // 每分钟检查一次
@@ -689,109 +1543,130 @@ func (p *SinglePortProxy) cleanupHTTPTunnelClient(key string) {
 func (p *SinglePortProxy) handleHTTPTunnelMessage(msg *protocol.TunnelMessage, key string) {
 	logger.Debug("Processing HTTP tunnel message",
 		"key", key,
-		"message_id", msg.ID,
+		"request_id", msg.ID,
 		"message_type", msg.Type)
 
 	switch msg.Type {
-	case protocol.MSG_TYPE_HTTP_RES:
-		// HTTP响应消息
-		p.handlersMu.Lock()
-		handler, ok := p.streamHandlers[msg.ID]
+	case protocol.MSG_TYPE_HTTP_RES, protocol.MSG_TYPE_HTTP_RES_FULL:
+		// HTTP响应消息 (长轮询模式下响应头和响应体总是一起发送)
+		handler, ok := p.lookupStreamHandler(msg.ID)
 		if !ok {
-			p.handlersMu.Unlock()
 			logger.Warn("No handler found for HTTP response",
 				"key", key,
-				"message_id", msg.ID)
+				"request_id", msg.ID)
 			return
 		}
-		p.handlersMu.Unlock()
-
-		// 反序列化HTTP响应
-		resp, err := protocol.DeserializeHTTPResponse(msg.Payload)
-		if err != nil {
-			logger.Error("Failed to deserialize HTTP response",
+		if !handler.polledBy(key) {
+			p.foreignResponse(key, nil, msg.ID, msg.Type)
+			return
+		}
+		if !handler.acquire() {
+			lateStreamMessagesCounter.Inc()
+			logger.Debug("Dropping HTTP response for finished request",
 				"key", key,
-				"message_id", msg.ID,
-				"error", err)
-			close(handler.done)
+				"request_id", msg.ID)
 			return
 		}
-
-		// 写入响应头
-		for key, values := range resp.Header {
-			for _, value := range values {
-				handler.writer.Header().Add(key, value)
-			}
+		// 超时处理据此判断是否还能返回 504；重复的响应直接丢弃
+		if handler.headersSent {
+			p.responseViolation(key, handler, msg.ID, "duplicate_header")
+			handler.mu.Unlock()
+			return
+		}
+		if handler.capture != nil {
+			handler.capture.captureResponse(msg.ID, msg.Payload)
+			handler.capture.finishResponse(msg.ID)
 		}
 
-		// 写入状态码
-		handler.writer.WriteHeader(resp.StatusCode)
-
-		// 写入响应体
-		if resp.Body != nil {
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				logger.Error("Failed to read response body",
+		if kind := protocol.ParseTargetError(msg.Payload); kind != "" {
+			// 客户端转发目标服务失败: 由等待方按原因返回 502 或 504
+			handler.failure = proxyErrorKind(kind)
+		} else {
+			handler.headersSent = true
+			// 写入响应头和响应体，解析失败时返回 502
+			if err := handler.writeFull(msg.Payload); err != nil {
+				logger.Error("Failed to write HTTP response",
 					"key", key,
-					"message_id", msg.ID,
+					"request_id", msg.ID,
 					"error", err)
-			} else if len(body) > 0 {
-				_, err = handler.writer.Write(body)
-				if err != nil {
-					logger.Error("Failed to write response body",
-						"key", key,
-						"message_id", msg.ID,
-						"error", err)
-				}
+				p.writeProxyError(handler.writer, proxyErrResponseDeserialize)
 			}
-			resp.Body.Close()
+			handler.flusher.Flush()
 		}
 
 		// 完成响应
-		handler.flusher.Flush()
-		close(handler.done)
+		handler.finishLocked()
+		handler.mu.Unlock()
+		p.removeStreamHandler(msg.ID)
 
 		logger.Debug("HTTP tunnel response completed",
 			"key", key,
-			"message_id", msg.ID,
-			"status_code", resp.StatusCode)
+			"request_id", msg.ID)
 
 	case protocol.MSG_TYPE_HTTP_RES_CHUNK:
 		// HTTP响应数据块
-		p.handlersMu.Lock()
-		handler, ok := p.streamHandlers[msg.ID]
+		handler, ok := p.lookupStreamHandler(msg.ID)
 		if !ok {
-			p.handlersMu.Unlock()
 			logger.Warn("No handler found for HTTP response chunk",
 				"key", key,
-				"message_id", msg.ID)
+				"request_id", msg.ID)
+			return
+		}
+		if !handler.polledBy(key) {
+			p.foreignResponse(key, nil, msg.ID, msg.Type)
+			return
+		}
+		if !handler.acquire() {
+			lateStreamMessagesCounter.Inc()
+			logger.Debug("Dropping HTTP response chunk for finished request",
+				"key", key,
+				"request_id", msg.ID)
+			return
+		}
+		// 长轮询的响应头总是与响应体一起发送，之前到达的数据块不能以隐含的 200 写出，直接结束请求
+		if !handler.headersSent {
+			p.responseViolation(key, handler, msg.ID, "chunk_before_header")
+			if handler.capture != nil {
+				handler.capture.finishResponse(msg.ID)
+			}
+			handler.failure = proxyErrResponseProtocol
+			handler.finishLocked()
+			handler.mu.Unlock()
+			p.removeStreamHandler(msg.ID)
 			return
 		}
-		p.handlersMu.Unlock()
 
 		// 写入数据块
 		if len(msg.Payload) > 0 {
-			_, err := handler.writer.Write(msg.Payload)
-			if err != nil {
-				logger.Error("Failed to write response chunk",
-					"key", key,
-					"message_id", msg.ID,
-					"error", err)
-				close(handler.done)
+			handler.progress.Add(len(msg.Payload))
+			if handler.capture != nil {
+				handler.capture.captureResponseBody(msg.ID, msg.Payload)
+			}
+			if err := handler.writeBody(msg.Payload); err != nil {
+				p.abortOnWriteError(key, handler, msg.ID, err)
+				handler.mu.Unlock()
+				p.removeStreamHandler(msg.ID)
 				return
 			}
 			handler.flusher.Flush()
+		} else if err := handler.closeBody(); err != nil {
+			// 空数据块表示响应体结束，写出改写流中剩余的数据
+			logger.Error("Failed to write transformed response tail",
+				"key", key,
+				"request_id", msg.ID,
+				"error", err)
 		}
+		handler.mu.Unlock()
 
-		logger.Debug("HTTP tunnel response chunk written",
+		logger.Trace("HTTP tunnel response chunk written",
 			"key", key,
-			"message_id", msg.ID,
+			"request_id", msg.ID,
 			"chunk_size", len(msg.Payload))
 
 	default:
 		logger.Warn("Unknown HTTP tunnel message type",
 			"key", key,
-			"message_id", msg.ID,
+			"request_id", msg.ID,
 			"message_type", msg.Type)
 	}
 }
@@ -799,22 +1674,29 @@ func (p *SinglePortProxy) handleHTTPTunnelMessage(msg *protocol.TunnelMessage, k
 // handleHTTPProxy 处理基于路径的HTTP代理请求
 func (p *SinglePortProxy) handleHTTPProxy(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
+	if p.servePaused(w, r, "proxy") {
+		return
+	}
 
 	// 检查 IP 速率限制
-	ip, port, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	addr, ok := utils.ParseClientIP(host)
+	if err != nil || !ok {
 		logger.Error("Failed to parse remote address for proxy",
 			"remote_addr", r.RemoteAddr,
 			"error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		p.writeProxyError(w, proxyErrBadRemoteAddr)
 		return
 	}
+	// 与公网请求相同，以规范形式作为限速和日志中的客户端标识
+	ip := addr.String()
+	r.RemoteAddr = net.JoinHostPort(ip, port)
 
 	logger.Debug("Processing HTTP path proxy request",
 		"client_ip", ip,
 		"client_port", port,
 		"method", r.Method,
-		"url", r.URL.String(),
+		"url", utils.SanitizeURL(r.URL),
 		"user_agent", r.Header.Get("User-Agent"))
 
 	ipLimiter := p.getIPLimiter(ip)
@@ -822,8 +1704,8 @@ func (p *SinglePortProxy) handleHTTPProxy(w http.ResponseWriter, r *http.Request
 		logger.Warn("IP rate limited for proxy request",
 			"client_ip", ip,
 			"method", r.Method,
-			"url", r.URL.String())
-		http.Error(w, "Too many requests from your IP", http.StatusTooManyRequests)
+			"url", utils.SanitizeURL(r.URL))
+		p.rejectRateLimited(w, r, ip, "Too many requests from your IP")
 		return
 	}
 
@@ -879,15 +1761,28 @@ func (p *SinglePortProxy) handleHTTPProxy(w http.ResponseWriter, r *http.Request
 		"target_port", targetPort,
 		"method", r.Method)
 
-	// 连接到目标服务器
+	// 连接到目标服务器，先检查解析结果，拨号时再检查实际连接的IP
 	targetAddr := net.JoinHostPort(targetHost, targetPort)
-	targetConn, err := net.DialTimeout("tcp", targetAddr, 30*time.Second)
+	err = p.destPolicy.check(r.Context(), targetHost)
+	var targetConn net.Conn
+	if err == nil {
+		targetConn, err = p.destPolicy.DialContext(r.Context(), "tcp", targetAddr)
+	}
+	if errors.Is(err, errDestinationBlocked) {
+		proxyBlockedCounter.Inc()
+		logger.Warn("Blocked proxy request to disallowed destination",
+			"client_ip", ip,
+			"target_addr", targetAddr,
+			"error", err)
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		logger.Error("Failed to connect to target server",
 			"client_ip", ip,
 			"target_addr", targetAddr,
 			"error", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		p.writeProxyError(w, proxyErrUpstreamConnect)
 		return
 	}
 	defer targetConn.Close()
@@ -910,7 +1805,7 @@ func (p *SinglePortProxy) handleHTTPProxy(w http.ResponseWriter, r *http.Request
 			"client_ip", ip,
 			"target_addr", targetAddr,
 			"error", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		p.writeProxyError(w, proxyErrUpstreamWrite)
 		return
 	}
 
@@ -922,7 +1817,7 @@ func (p *SinglePortProxy) handleHTTPProxy(w http.ResponseWriter, r *http.Request
 			"client_ip", ip,
 			"target_addr", targetAddr,
 			"error", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		p.writeProxyError(w, proxyErrUpstreamResponse)
 		return
 	}
 	defer resp.Body.Close()
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"container/list"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/utils"
+)
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	// headerIdempotentReplayed 标记重放的响应
+	headerIdempotentReplayed = "Idempotent-Replayed"
+	// idempotencyKeyMaxLength Idempotency-Key 头的长度上限
+	idempotencyKeyMaxLength = 255
+
+	defaultIdempotencyTTL          = 24 * time.Hour
+	defaultIdempotencyMaxBodyBytes = 64 * 1024
+	defaultIdempotencyMaxEntries   = 1000
+)
+
+var idempotentReplaysCounter = metrics.NewCounterVec("singleproxy_server_idempotent_replays_total",
+	"Requests answered with the stored response of an earlier request carrying the same Idempotency-Key, by tunnel key", "key")
+
+// idempotentEntry 一个 Idempotency-Key 对应的响应。done 关闭之前第一次请求仍在转发
+type idempotentEntry struct {
+	id   string
+	elem *list.Element
+	done chan struct{}
+
+	// 以下字段在 done 关闭之前写入，之后只读
+	abandoned bool // 第一次请求没有得到目标服务的响应，之后的请求重新转发
+	retained  bool // 响应已保存，可以重放
+	status    int
+	header    http.Header
+	body      []byte
+	expires   time.Time
+}
+
+// idempotencyStore 一个key保存的响应，按创建顺序淘汰
+type idempotencyStore struct {
+	paths      []string
+	ttl        time.Duration
+	maxBody    int
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+	order   *list.List // 最早创建的在末尾
+}
+
+// newIdempotencyStores 为配置了 idempotency 的key创建响应存储
+func newIdempotencyStores(keys map[string]*config.KeyConfig) map[string]*idempotencyStore {
+	stores := make(map[string]*idempotencyStore)
+	for key, kc := range keys {
+		if kc == nil || kc.Idempotency == nil {
+			continue
+		}
+		ic := kc.Idempotency
+		s := &idempotencyStore{
+			paths:      ic.Paths,
+			ttl:        time.Duration(ic.TTL),
+			maxBody:    ic.MaxBodyBytes,
+			maxEntries: ic.MaxEntries,
+			entries:    make(map[string]*idempotentEntry),
+			order:      list.New(),
+		}
+		if s.ttl <= 0 {
+			s.ttl = defaultIdempotencyTTL
+		}
+		if s.maxBody <= 0 {
+			s.maxBody = defaultIdempotencyMaxBodyBytes
+		}
+		if s.maxEntries <= 0 {
+			s.maxEntries = defaultIdempotencyMaxEntries
+		}
+		stores[key] = s
+	}
+	return stores
+}
+
+// applies 判断请求是否需要去重: 只处理会修改数据的方法和配置的路径
+func (s *idempotencyStore) applies(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return false
+	}
+	if len(s.paths) == 0 {
+		return true
+	}
+	for _, prefix := range s.paths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// begin 查找 id 对应的响应，不存在时创建并返回 owner 为 true，由调用方转发请求
+func (s *idempotencyStore) begin(id string, now time.Time) (entry *idempotentEntry, owner bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for elem := s.order.Back(); elem != nil; elem = s.order.Back() {
+		e := elem.Value.(*idempotentEntry)
+		if e.expires.IsZero() || now.Before(e.expires) {
+			break
+		}
+		s.removeLocked(e)
+	}
+	if e, ok := s.entries[id]; ok {
+		if e.expires.IsZero() || now.Before(e.expires) {
+			return e, false
+		}
+		s.removeLocked(e)
+	}
+
+	e := &idempotentEntry{id: id, done: make(chan struct{})}
+	e.elem = s.order.PushFront(e)
+	s.entries[id] = e
+	for s.order.Len() > s.maxEntries {
+		s.removeLocked(s.order.Back().Value.(*idempotentEntry))
+	}
+	return e, true
+}
+
+// complete 保存第一次请求的响应并唤醒等待的重复请求，body 为 nil 表示响应过大没有保留
+func (s *idempotencyStore) complete(e *idempotentEntry, status int, header http.Header, body []byte, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.status = status
+	e.header = header
+	e.body = body
+	e.retained = body != nil
+	e.expires = now.Add(s.ttl)
+	close(e.done)
+}
+
+// abandon 删除没有得到响应的记录，等待的重复请求中的一个重新转发
+func (s *idempotencyStore) abandon(e *idempotentEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[e.id] == e {
+		s.removeLocked(e)
+	}
+	e.abandoned = true
+	close(e.done)
+}
+
+func (s *idempotencyStore) removeLocked(e *idempotentEntry) {
+	if s.entries[e.id] == e {
+		delete(s.entries, e.id)
+	}
+	s.order.Remove(e.elem)
+}
+
+// idempotentRequest 负责转发的第一次请求，结束时保存写给公网用户的响应
+type idempotentRequest struct {
+	store *idempotencyStore
+	entry *idempotentEntry
+	rec   *idempotentRecorder
+}
+
+// beginIdempotent 处理携带 Idempotency-Key 的请求。已有保存的响应时直接重放并返回 handled；
+// 相同的请求正在转发时等待它完成而不是再转发一次。需要转发时返回的 idempotentRequest 记录响应，
+// 调用方在请求结束时调用 finish
+func (p *SinglePortProxy) beginIdempotent(uw *usageWriter, r *http.Request, key, clientIP string) (req *idempotentRequest, handled bool) {
+	store := p.idempotency[key]
+	idemKey := r.Header.Get(headerIdempotencyKey)
+	if store == nil || idemKey == "" || !store.applies(r) {
+		return nil, false
+	}
+	if len(idemKey) > idempotencyKeyMaxLength {
+		http.Error(uw, "Idempotency-Key too long", http.StatusBadRequest)
+		return nil, true
+	}
+
+	id := r.Method + " " + r.URL.Path + "\x00" + idemKey
+	for {
+		entry, owner := store.begin(id, time.Now())
+		if owner {
+			rec := &idempotentRecorder{ResponseWriter: uw.ResponseWriter, limit: store.maxBody}
+			uw.ResponseWriter = rec
+			return &idempotentRequest{store: store, entry: entry, rec: rec}, false
+		}
+
+		select {
+		case <-entry.done:
+		case <-r.Context().Done():
+			uw.aborted = true
+			return nil, true
+		}
+		if entry.abandoned {
+			// 第一次请求没有得到目标服务的响应，由本次请求重新转发
+			continue
+		}
+
+		idempotentReplaysCounter.WithLabelValue(key).Inc()
+		logger.Info("Replaying stored response for duplicate request",
+			"client_ip", clientIP,
+			"key", key,
+			"method", r.Method,
+			"url", utils.SanitizeURL(r.URL),
+			"status", entry.status,
+			"retained", entry.retained)
+		if !entry.retained {
+			http.Error(uw, "The original response for this Idempotency-Key was too large to keep", http.StatusConflict)
+			return nil, true
+		}
+		for k, v := range entry.header {
+			uw.Header()[k] = v
+		}
+		uw.Header().Set(headerIdempotentReplayed, "true")
+		uw.WriteHeader(entry.status)
+		uw.Write(entry.body)
+		return nil, true
+	}
+}
+
+// finish 保存目标服务的完整响应。代理自身产生的错误响应和中断的响应不保存，重复请求会重新转发
+func (req *idempotentRequest) finish(uw *usageWriter) {
+	rec := req.rec
+	if uw.proxyError != "" || uw.aborted || rec.status == 0 {
+		req.store.abandon(req.entry)
+		return
+	}
+	var body []byte
+	if !rec.overflow {
+		body = rec.body
+		if body == nil {
+			body = []byte{}
+		}
+	}
+	req.store.complete(req.entry, rec.status, rec.header, body, time.Now())
+}
+
+// idempotentRecorder 在转发给公网用户的同时记录最终状态码、响应头和不超过 limit 的响应体
+type idempotentRecorder struct {
+	http.ResponseWriter
+	limit    int
+	status   int
+	header   http.Header
+	body     []byte
+	overflow bool
+}
+
+func (w *idempotentRecorder) WriteHeader(status int) {
+	// 1xx 临时响应之后还有最终状态码
+	if w.status == 0 && (status < 100 || status > 199) {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotentRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	if !w.overflow {
+		if len(w.body)+len(p) > w.limit {
+			w.overflow = true
+			w.body = nil
+		} else {
+			w.body = append(w.body, p...)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *idempotentRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *idempotentRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+func (w *idempotentRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// watchIdle 在连接超过 -tunnel-idle-max 没有隧道活动时以 1000 关闭，返回停止监视的函数。
+// 只完成握手后挂着的扫描器靠 ping 可以无限期占用连接和协程，活动时间只在分配请求和收发数据消息时更新。
+// 未配置上限或该key设置了 allow_idle 时不监视
+func (p *SinglePortProxy) watchIdle(tc *tunnelConn) (stop func()) {
+	idleMax := p.config.TunnelIdleMax
+	if idleMax <= 0 {
+		return func() {}
+	}
+	if kc := p.config.KeyConfig(tc.key); kc != nil && kc.AllowIdle {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(idleMax)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			// 期间有过活动时从最近一次活动重新计时
+			if idle := time.Since(tc.lastActive()); idle < idleMax {
+				timer.Reset(idleMax - idle)
+				continue
+			}
+
+			idleTunnelsClosedCounter.Inc()
+			logger.Info("Closing idle tunnel",
+				"key", tc.key,
+				"connection_id", tc.id,
+				"remote_addr", tc.conn.RemoteAddr(),
+				"connected_for", time.Since(tc.connectedAt).Round(time.Second),
+				"idle_max", idleMax)
+			_ = tc.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, protocol.CloseReasonIdle),
+				time.Now().Add(time.Second))
+			tc.conn.Close()
+			return
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"singleproxy/pkg/metrics"
+)
+
+// keyRateWaitHistogram 平滑等待为每个放行的请求增加的毫秒数，没有等待的请求记为0
+var keyRateWaitHistogram = metrics.NewHistogramVec("singleproxy_server_key_rate_wait_milliseconds",
+	"Delay added by key rate limit smoothing per admitted request, by tunnel key", "key",
+	[]int64{0, 5, 10, 25, 50, 100, 200, 500, 1000, 2000, 5000})
+
+// keyRateBurst 返回key限制器的令牌桶容量: keys.<key>.rate_burst 优先，其次 -key-rate-burst，默认为速率的2倍
+func (p *SinglePortProxy) keyRateBurst(key string) int {
+	if kc := p.config.KeyConfig(key); kc != nil && kc.RateBurst > 0 {
+		return kc.RateBurst
+	}
+	if p.config.KeyRateBurst > 0 {
+		return p.config.KeyRateBurst
+	}
+	return p.config.KeyRateLimit * 2
+}
+
+// keyRateSmoothing 返回令牌不足时的最长等待时间，0表示立即拒绝
+func (p *SinglePortProxy) keyRateSmoothing(key string) time.Duration {
+	if kc := p.config.KeyConfig(key); kc != nil && kc.RateSmoothing > 0 {
+		return time.Duration(kc.RateSmoothing)
+	}
+	return p.config.KeyRateSmoothing
+}
+
+// allowKeyRequest 检查key的速率限制。配置了平滑等待时，令牌在等待上限内可用就排队等待，
+// 否则立即拒绝且不消耗令牌。等待在 rateLimitMu 之外进行，公网用户断开时随请求上下文结束
+func (p *SinglePortProxy) allowKeyRequest(r *http.Request, key string) bool {
+	limiter := p.getKeyLimiter(key)
+	smoothing := p.keyRateSmoothing(key)
+	if smoothing <= 0 || p.config.KeyRateLimit <= 0 {
+		return limiter.Allow()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), smoothing)
+	defer cancel()
+	start := time.Now()
+	if err := limiter.Wait(ctx); err != nil {
+		return false
+	}
+	keyRateWaitHistogram.Observe(p.labelKey(key), time.Since(start).Milliseconds())
+	return true
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"runtime/pprof"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/utils"
+)
+
+// 客户端本地监听 (-local-listen) 收到的请求以 MSG_TYPE_LOCAL_REQ 经隧道发给服务器，按公网请求路由转发，
+// 响应以 MSG_TYPE_LOCAL_RES 和 MSG_TYPE_LOCAL_RES_CHUNK 经同一连接发回。本地请求与公网请求受相同的
+// 速率限制、消息大小上限和响应超时约束
+
+// localResponseChunkSize 本地请求的响应体数据块的数据大小，协商的消息上限更小时以上限为准
+const localResponseChunkSize = 32 * 1024
+
+var localRequestsCounter = metrics.NewCounterVec("singleproxy_server_local_requests_total",
+	"Requests forwarded from the local listener of tunnel clients, by the key of the sending tunnel", "key")
+
+// handleLocalMessage 处理协商启用本地转发的连接上的本地请求和本地请求的取消消息，返回 false 表示不是这两种消息
+func (p *SinglePortProxy) handleLocalMessage(ctx context.Context, tc *tunnelConn, msg protocol.TunnelMessage) bool {
+	switch msg.Type {
+	case protocol.MSG_TYPE_LOCAL_REQ:
+		p.startLocalRequest(ctx, tc, msg)
+		return true
+	case protocol.MSG_TYPE_CANCEL:
+		if !protocol.IsLocalRequestID(msg.ID) {
+			// 公网请求的取消消息是响应中止，见 FeatureResponseAbort
+			return false
+		}
+		if cancel := tc.untrackLocal(msg.ID); cancel != nil {
+			logger.Debug("Local request canceled by tunnel client",
+				"key", tc.key,
+				"request_id", msg.ID,
+				"reason", string(msg.Payload))
+			cancel()
+		}
+		return true
+	}
+	return false
+}
+
+// startLocalRequest 在新协程中把本地请求交给公网请求的处理流程。请求ID必须带 protocol.LocalRequestIDFlag，
+// 否则可能与服务器分配给该连接的请求ID冲突
+func (p *SinglePortProxy) startLocalRequest(ctx context.Context, tc *tunnelConn, msg protocol.TunnelMessage) {
+	if !protocol.IsLocalRequestID(msg.ID) {
+		logger.Warn("Dropping local request without the local request ID flag",
+			"key", tc.key,
+			"connection_id", tc.id,
+			"request_id", msg.ID)
+		return
+	}
+	reqCtx, cancel := context.WithCancel(ctx)
+	if !tc.trackLocal(msg.ID, cancel) {
+		cancel()
+		logger.Warn("Dropping local request with a duplicate request ID",
+			"key", tc.key,
+			"connection_id", tc.id,
+			"request_id", msg.ID)
+		return
+	}
+	localRequestsCounter.WithLabelValue(tc.key).Inc()
+
+	go func() {
+		defer cancel()
+		defer tc.untrackLocal(msg.ID)
+		w := &localResponseWriter{ctx: reqCtx, tunnel: tc, id: msg.ID, header: make(http.Header)}
+
+		r, err := protocol.ParseHTTPRequest(msg.Payload, p.headerLimits)
+		if err != nil {
+			logger.Warn("Rejected malformed local request",
+				"key", tc.key,
+				"request_id", msg.ID,
+				"error", err)
+			status := http.StatusBadRequest
+			var limitErr *protocol.HeaderLimitError
+			if errors.As(err, &limitErr) {
+				status = http.StatusRequestHeaderFieldsTooLarge
+			}
+			http.Error(w, http.StatusText(status), status)
+			w.finish()
+			return
+		}
+		// 以隧道客户端的地址作为调用方，IP限速和访问控制与它直接访问公网地址时相同
+		r.RemoteAddr = tc.conn.RemoteAddr().String()
+		r = r.WithContext(reqCtx)
+
+		logger.Debug("Forwarding local request from tunnel client",
+			"key", tc.key,
+			"request_id", msg.ID,
+			"method", r.Method,
+			"url", utils.SanitizeURL(r.URL),
+			"target_key", r.Header.Get(protocol.HeaderTunnelKey))
+		pprof.Do(reqCtx, utils.RequestProfileLabels(tc.key, msg.ID, "local"), func(context.Context) {
+			defer func() {
+				// 响应头已发出后失败时 abortResponse 以 http.ErrAbortHandler 中断，由 finish 通知客户端
+				if v := recover(); v != nil {
+					if v != http.ErrAbortHandler {
+						panic(v)
+					}
+					w.aborted = true
+				}
+			}()
+			p.handlePublicHTTPRequest(w, r)
+		})
+		w.finish()
+	}()
+}
+
+// trackLocal 登记进行中的本地请求，ID已在使用时返回 false
+func (t *tunnelConn) trackLocal(id uint64, cancel context.CancelFunc) bool {
+	t.localMu.Lock()
+	defer t.localMu.Unlock()
+	if t.localRequests == nil {
+		t.localRequests = make(map[uint64]context.CancelFunc)
+	}
+	if _, ok := t.localRequests[id]; ok {
+		return false
+	}
+	t.localRequests[id] = cancel
+	return true
+}
+
+// untrackLocal 注销本地请求并返回它的取消函数，请求已结束时返回nil
+func (t *tunnelConn) untrackLocal(id uint64) context.CancelFunc {
+	t.localMu.Lock()
+	defer t.localMu.Unlock()
+	cancel := t.localRequests[id]
+	delete(t.localRequests, id)
+	return cancel
+}
+
+// cancelLocalRequests 连接断开时取消所有进行中的本地请求
+func (t *tunnelConn) cancelLocalRequests() {
+	t.localMu.Lock()
+	defer t.localMu.Unlock()
+	for id, cancel := range t.localRequests {
+		cancel()
+		delete(t.localRequests, id)
+	}
+}
+
+// localResponseWriter 把公网请求处理流程写出的响应转为发给客户端的消息。
+// 与 streamHandler 写入公网调用方一样只在一个协程中使用
+type localResponseWriter struct {
+	ctx         context.Context
+	tunnel      *tunnelConn
+	id          uint64
+	header      http.Header
+	wroteHeader bool
+	aborted     bool // 响应中途失败，客户端收到 MSG_TYPE_CANCEL 而不是结束标记
+	failed      bool // 消息无法入队 (连接已关闭或请求已取消)，之后的写入都丢弃
+}
+
+func (w *localResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *localResponseWriter) WriteHeader(code int) {
+	// 临时响应不转发，本地调用方只收到最终响应
+	if w.wroteHeader || (code >= 100 && code < 200) {
+		return
+	}
+	w.wroteHeader = true
+	var buf bytes.Buffer
+	buf.WriteString(protocol.StatusLine(code, ""))
+	_ = w.header.Write(&buf)
+	buf.WriteString("\r\n")
+	w.send(protocol.MSG_TYPE_LOCAL_RES, buf.Bytes())
+}
+
+func (w *localResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	chunkSize := min(localResponseChunkSize, w.tunnel.maxFrameSize-protocol.MessageOverhead)
+	for written := 0; written < len(b); {
+		if w.failed {
+			return written, errTunnelClosed
+		}
+		n := min(len(b)-written, chunkSize)
+		// 消息在写入协程中发出，数据必须复制
+		w.send(protocol.MSG_TYPE_LOCAL_RES_CHUNK, bytes.Clone(b[written:written+n]))
+		written += n
+	}
+	if w.failed {
+		return len(b), errTunnelClosed
+	}
+	return len(b), nil
+}
+
+// Flush 每次 Write 都立即入队，没有需要刷新的缓冲
+func (w *localResponseWriter) Flush() {}
+
+// finish 在处理流程返回后结束响应: 正常时发送结束标记；响应被截断 (中断或以尾部字段标记失败) 时发送取消消息，
+// 客户端据此中断本地调用方的连接，而不是让截断的响应看起来完整
+func (w *localResponseWriter) finish() {
+	if w.failed {
+		return
+	}
+	if w.aborted || w.header.Get(http.TrailerPrefix+headerProxyError) != "" {
+		w.send(protocol.MSG_TYPE_CANCEL, []byte(protocol.CancelReasonResponseAborted))
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.send(protocol.MSG_TYPE_LOCAL_RES_CHUNK, nil)
+}
+
+// send 等待写入队列的空位发送一条消息，失败后标记 failed
+func (w *localResponseWriter) send(msgType protocol.MessageType, payload []byte) {
+	if w.failed {
+		return
+	}
+	if payload == nil {
+		payload = []byte{}
+	}
+	err := w.tunnel.enqueueWait(w.ctx, outboundMessage{msg: protocol.TunnelMessage{ID: w.id, Type: msgType, Payload: payload}})
+	if err != nil {
+		w.failed = true
+		logger.Debug("Stopped sending local response",
+			"key", w.tunnel.key,
+			"request_id", w.id,
+			"message_type", msgType,
+			"error", err)
+	}
+}
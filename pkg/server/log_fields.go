@@ -0,0 +1,195 @@
+package server
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/utils"
+)
+
+const (
+	logCardinalityEnforce = "enforce"
+	logCardinalityWarn    = "warn"
+	logCardinalityOff     = "off"
+
+	// unregisteredValue enforce 模式下代替未登记的key和主机名写入日志
+	unregisteredValue = "<unregistered>"
+	// otherLabel enforce 模式下未登记的key在指标标签中的取值
+	otherLabel = "other"
+
+	defaultLogCardinalityLimit = 100
+	logCardinalityWindow       = time.Minute
+	// logPathDepth 未登记key的请求路径在日志中保留的段数
+	logPathDepth = 2
+)
+
+var unregisteredValuesCounter = metrics.NewCounterVec("singleproxy_server_unregistered_log_values_total",
+	"Unregistered keys and hostnames from public requests seen by the log field normalizer, by field", "field")
+
+// logFieldPolicy 公网请求中调用方可以任意填写的key和主机名写入日志字段和指标标签前的归一化。
+// 已配置、在线或已绑定的值原样保留；未登记的值在 enforce 模式下替换为占位值，原值只在debug日志中输出。
+// 不论 enforce 还是 warn，一分钟内出现的不同未登记值超过上限时输出一条告警
+type logFieldPolicy struct {
+	mode  string
+	limit int
+	now   func() time.Time
+
+	staticKeys map[string]bool // 配置文件 hosts 中的隧道key和默认key
+	hosts      map[string]bool // 配置文件 hosts 中的主机名，支持 "*." 通配
+	paths      *pathNormalizer
+
+	mu      sync.Mutex
+	windows map[string]*fieldWindow // 字段名 -> 当前统计窗口
+}
+
+// fieldWindow 一个字段在一分钟内出现的不同未登记值，达到上限后不再记录
+type fieldWindow struct {
+	start  time.Time
+	seen   map[string]struct{}
+	warned bool
+}
+
+func newLogFieldPolicy(cfg *config.Config) *logFieldPolicy {
+	f := &logFieldPolicy{
+		mode:       cfg.LogCardinality,
+		limit:      cfg.LogCardinalityLimit,
+		now:        time.Now,
+		staticKeys: make(map[string]bool),
+		hosts:      make(map[string]bool),
+		paths: &pathNormalizer{
+			maxLength: defaultTopPathLength,
+			depth:     logPathDepth,
+			rewrites:  []pathRewrite{{re: regexp.MustCompile(`[0-9]+`), replacement: "#"}},
+		},
+		windows: make(map[string]*fieldWindow),
+	}
+	if f.mode == "" {
+		f.mode = logCardinalityEnforce
+	}
+	if f.limit <= 0 {
+		f.limit = defaultLogCardinalityLimit
+	}
+	if key := cfg.DefaultRouteKey(); key != "" {
+		f.staticKeys[key] = true
+	}
+	for host, hc := range cfg.Hosts {
+		f.hosts[strings.ToLower(host)] = true
+		if hc == nil {
+			continue
+		}
+		for _, key := range []string{hc.TunnelKey, hc.DefaultKey} {
+			if key != "" && key != config.DefaultKeyNone {
+				f.staticKeys[key] = true
+			}
+		}
+	}
+	return f
+}
+
+// observe 记录一个未登记的值，窗口内不同值超过上限时输出一次告警
+func (f *logFieldPolicy) observe(field, value string) {
+	unregisteredValuesCounter.WithLabelValue(field).Inc()
+	now := f.now()
+
+	f.mu.Lock()
+	w := f.windows[field]
+	if w == nil || now.Sub(w.start) >= logCardinalityWindow {
+		w = &fieldWindow{start: now, seen: make(map[string]struct{})}
+		f.windows[field] = w
+	}
+	if w.warned {
+		f.mu.Unlock()
+		return
+	}
+	w.seen[value] = struct{}{}
+	exceeded := len(w.seen) > f.limit
+	if exceeded {
+		// 告警之后本窗口不再需要逐个记录，释放集合
+		w.warned = true
+		w.seen = nil
+	}
+	f.mu.Unlock()
+
+	if exceeded {
+		logger.Warn("Unregistered values in log fields exceeded the soft limit, possibly a scan",
+			"field", field,
+			"limit", f.limit,
+			"window", logCardinalityWindow,
+			"mode", f.mode)
+	}
+}
+
+// keyRegistered 判断key是否已配置或有在线隧道，空key不计为未登记
+func (p *SinglePortProxy) keyRegistered(key string) bool {
+	return key == "" || p.logFields.staticKeys[key] || p.keyInUse(key)
+}
+
+// hostRegistered 判断主机名是否在配置文件 hosts 中或已被客户端绑定
+func (p *SinglePortProxy) hostRegistered(host string) bool {
+	host = hostWithoutPort(host)
+	if host == "" {
+		return true
+	}
+	if _, ok := lookupHostName(p.logFields.hosts, host); ok {
+		return true
+	}
+	if p.bindings == nil {
+		return false
+	}
+	_, ok := p.bindings.lookupHost(host)
+	return ok
+}
+
+// logKey 返回写入日志字段的key
+func (p *SinglePortProxy) logKey(key string) string {
+	f := p.logFields
+	if f == nil || f.mode == logCardinalityOff || p.keyRegistered(key) {
+		return key
+	}
+	f.observe("key", key)
+	if f.mode != logCardinalityEnforce {
+		return key
+	}
+	logger.Debug("Unregistered key replaced in log fields", "key", key)
+	return unregisteredValue
+}
+
+// labelKey 返回作为指标标签的key，enforce 模式下未登记的key归入 other
+func (p *SinglePortProxy) labelKey(key string) string {
+	f := p.logFields
+	if f == nil || f.mode != logCardinalityEnforce || p.keyRegistered(key) {
+		return key
+	}
+	f.observe("key", key)
+	return otherLabel
+}
+
+// logHost 返回写入日志字段的主机名
+func (p *SinglePortProxy) logHost(host string) string {
+	f := p.logFields
+	if f == nil || f.mode == logCardinalityOff || p.hostRegistered(host) {
+		return host
+	}
+	f.observe("host", hostWithoutPort(host))
+	if f.mode != logCardinalityEnforce {
+		return host
+	}
+	logger.Debug("Unregistered host replaced in log fields", "host", host)
+	return unregisteredValue
+}
+
+// logURL 返回写入日志字段的请求地址。enforce 模式下请求未登记key的地址只保留路径模板:
+// 前两段路径，数字替换为 #，不含查询参数
+func (p *SinglePortProxy) logURL(key string, u *url.URL) string {
+	f := p.logFields
+	if f == nil || f.mode != logCardinalityEnforce || p.keyRegistered(key) {
+		return utils.SanitizeURL(u)
+	}
+	return f.paths.normalize(u.Path)
+}
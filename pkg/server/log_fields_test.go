@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// 扫描方以一万个随机key请求时，日志和指标标签中只出现占位值，软上限告警每分钟只有一条
+func TestLogFieldsKeySpray(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "server.log")
+	if err := logger.InitLogger(&config.Config{LogFile: logFile, LogFormat: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logger.InitLogger(&config.Config{}) })
+
+	p := NewSinglePortProxy(&config.Config{
+		Mode:       "server",
+		DefaultKey: "none",
+		Keys:       map[string]*config.KeyConfig{"web": {}},
+	})
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("spray-%016x", rand.Uint64())
+		req := httptest.NewRequest("GET", fmt.Sprintf("http://example.com/api/v1/items/%d?q=%d", i, i), nil)
+		req.RemoteAddr = "203.0.113.7:1000"
+		req.Header.Set("X-Tunnel-Key", keys[i])
+		p.handlePublicHTTPRequest(httptest.NewRecorder(), req)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(data)
+	for _, key := range keys[:100] {
+		if strings.Contains(log, key) {
+			t.Fatalf("Expected sprayed key %s not to appear in info logs", key)
+		}
+	}
+	if !strings.Contains(log, `"key":"<unregistered>"`) || !strings.Contains(log, `"url":"/api/v#"`) {
+		t.Errorf("Expected placeholder key and templated path in logs, got %.500s", log)
+	}
+	if n := strings.Count(log, "exceeded the soft limit"); n != 1 {
+		t.Errorf("Expected one soft limit warning per minute, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf)
+	if strings.Contains(buf.String(), "spray-") ||
+		!strings.Contains(buf.String(), `singleproxy_server_response_size_bytes_count{key="other"}`) {
+		t.Errorf("Expected sprayed keys to be labeled other, got %s", buf.String())
+	}
+
+	// 告警之后本窗口不再保存出现过的值，内存不随扫描增长
+	w := p.logFields.windows["key"]
+	if w == nil || !w.warned || w.seen != nil {
+		t.Errorf("Expected the window to be warned with its value set released, got %+v", w)
+	}
+}
+
+func TestLogFieldsRegisteredValues(t *testing.T) {
+	p := NewSinglePortProxy(&config.Config{
+		Mode:  "server",
+		Keys:  map[string]*config.KeyConfig{"web": {}},
+		Hosts: map[string]*config.HostConfig{"*.example.com": {TunnelKey: "site"}},
+	})
+	for _, key := range []string{"web", "site", "default", ""} {
+		if got := p.logKey(key); got != key {
+			t.Errorf("logKey(%q) = %q, want it unchanged", key, got)
+		}
+		if got := p.labelKey(key); got != key {
+			t.Errorf("labelKey(%q) = %q, want it unchanged", key, got)
+		}
+	}
+	if got := p.logKey("unknown"); got != unregisteredValue {
+		t.Errorf("Expected unknown key to be replaced, got %q", got)
+	}
+	if got := p.labelKey("unknown"); got != otherLabel {
+		t.Errorf("Expected unknown key label to be other, got %q", got)
+	}
+	if got := p.logHost("App.Example.com:443"); got != "App.Example.com:443" {
+		t.Errorf("Expected configured wildcard host unchanged, got %q", got)
+	}
+	if got := p.logHost("random-1234.test"); got != unregisteredValue {
+		t.Errorf("Expected unknown host to be replaced, got %q", got)
+	}
+
+	u, _ := url.Parse("/api/v2/users/12345/avatar?token=secret")
+	if got := p.logURL("unknown", u); got != "/api/v#" {
+		t.Errorf("Expected templated path for unknown key, got %q", got)
+	}
+	if got := p.logURL("web", u); !strings.HasPrefix(got, "/api/v2/users/12345/avatar") {
+		t.Errorf("Expected full path for registered key, got %q", got)
+	}
+}
+
+func TestLogFieldsModes(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	warn := NewSinglePortProxy(&config.Config{Mode: "server", LogCardinality: "warn", LogCardinalityLimit: 3})
+	warn.logFields.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("scan-%d", i)
+		if got := warn.logKey(key); got != key {
+			t.Errorf("Expected warn mode to keep %q, got %q", key, got)
+		}
+		if got := warn.labelKey(key); got != key {
+			t.Errorf("Expected warn mode to keep label %q, got %q", key, got)
+		}
+	}
+	if w := warn.logFields.windows["key"]; !w.warned {
+		t.Error("Expected warn mode to reach the soft limit")
+	}
+	// 下一分钟重新计数
+	now = now.Add(time.Minute)
+	warn.logKey("scan-next")
+	if w := warn.logFields.windows["key"]; w.warned || len(w.seen) != 1 {
+		t.Errorf("Expected a fresh window, got %+v", w)
+	}
+
+	off := NewSinglePortProxy(&config.Config{Mode: "server", LogCardinality: "off"})
+	if got := off.logKey("scan"); got != "scan" || len(off.logFields.windows) != 0 {
+		t.Errorf("Expected off mode to leave keys untouched, got %q", got)
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/utils"
+)
+
+// checkProxyLoop 拒绝已经过本服务器或经过的实例过多的公网请求，返回 false 表示已以 508 结束。
+// 未形成环路时在请求头中追加本服务器的实例ID，随请求经隧道、集群转发和备用地址传给下一跳。
+// 常见原因是主机名路由指向的key，其客户端的目标地址又是本服务器的公网地址
+func (p *SinglePortProxy) checkProxyLoop(w http.ResponseWriter, r *http.Request, ip, key, keySource string) bool {
+	hops := protocol.Hops(r.Header)
+	if !protocol.LoopDetected(hops, p.instanceID) {
+		protocol.AddHop(r.Header, p.instanceID)
+		return true
+	}
+	logger.Error("Proxy loop detected, refusing to forward request",
+		"client_ip", ip,
+		"key", key,
+		"key_source", keySource,
+		"host", r.Host,
+		"method", r.Method,
+		"url", utils.SanitizeURL(r.URL),
+		"instance_id", p.instanceID,
+		"hops", hops)
+	p.writeProxyError(w, proxyErrLoopDetected)
+	return false
+}
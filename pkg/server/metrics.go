@@ -0,0 +1,48 @@
+package server
+
+import "singleproxy/pkg/metrics"
+
+var (
+	unknownMessagesCounter = metrics.NewCounter("singleproxy_server_unknown_messages_total",
+		"Tunnel messages received from clients with an unknown type")
+	proxyBlockedCounter = metrics.NewCounter("singleproxy_server_proxy_blocked_total",
+		"Forward proxy and SOCKS5 connections rejected by the destination policy")
+	tunnelKeyLimitCounter = metrics.NewCounter("singleproxy_server_tunnel_key_limit_rejections_total",
+		"Tunnel registrations rejected because max_tunnel_keys was reached")
+	registrationThrottledCounter = metrics.NewCounter("singleproxy_server_registration_throttled_total",
+		"Tunnel registrations rejected by the per-key registration rate limit")
+	proxyErrorsCounter = metrics.NewCounterVec("singleproxy_server_proxy_errors_total",
+		"Error responses produced by the proxy itself, by reason", "reason")
+	registrationDeniedCounter = metrics.NewCounter("singleproxy_server_registration_denied_total",
+		"Tunnel registration endpoint requests rejected by listener role or registration_allowed_cidrs")
+	responseHeaderTimeoutCounter = metrics.NewCounter("singleproxy_server_response_header_timeouts_total",
+		"Public requests answered with 504 because the tunnel client sent no response header in time")
+	lateStreamMessagesCounter = metrics.NewCounter("singleproxy_server_late_stream_messages_total",
+		"Response messages dropped because their public request had already timed out or finished")
+	unknownSNICounter = metrics.NewCounter("singleproxy_server_tls_unknown_sni_total",
+		"TLS handshakes aborted because the server name has no certificate and tls_unknown_sni is reject")
+	sseHeartbeatsCounter = metrics.NewCounter("singleproxy_server_sse_heartbeats_total",
+		"Keepalive comments injected into idle Server-Sent Events streams")
+	messageAuthFailuresCounter = metrics.NewCounter("singleproxy_server_message_auth_failures_total",
+		"Tunnel messages from clients dropped because their signature was missing or invalid")
+	pipelinedRequestsCounter = metrics.NewCounter("singleproxy_server_pipelined_requests_total",
+		"Raw HTTP connections that sent another request before the first response finished")
+	chunkIntegrityErrorsCounter = metrics.NewCounterVec("singleproxy_server_chunk_integrity_errors_total",
+		"Streamed responses aborted because a sequenced body chunk was malformed, out of order or the length did not match, by reason", "reason")
+	responseViolationsCounter = metrics.NewCounterVec("singleproxy_server_response_violations_total",
+		"Response messages from tunnel clients that broke the message order, by kind (duplicate_header, chunk_before_header, foreign_request)", "kind")
+	clientBodyTimeoutsCounter = metrics.NewCounter("singleproxy_server_client_body_timeouts_total",
+		"Public requests answered with 408 because the caller sent the request body too slowly")
+	tunnelConnectionsCounter = metrics.NewCounter("singleproxy_server_tunnel_connections_total",
+		"WebSocket tunnel connections registered, including reconnects")
+	idleTunnelsClosedCounter = metrics.NewCounter("singleproxy_server_idle_tunnels_closed_total",
+		"Tunnel connections closed after tunnel_idle_max without requests or data messages")
+	truncatedResponsesCounter = metrics.NewCounterVec("singleproxy_server_truncated_responses_total",
+		"Public responses cut short after the header was sent, by tunnel key", "key")
+	headerLimitRejectionsCounter = metrics.NewCounterVec("singleproxy_server_header_limit_rejections_total",
+		"Public requests rejected with 431 because their headers exceeded the count, per-field or total size limit, by limit", "limit")
+	headerTableInputBytesCounter = metrics.NewCounter("singleproxy_server_header_table_input_bytes_total",
+		"Request message payload bytes before header table encoding, on tunnels that negotiated the header table")
+	headerTableOutputBytesCounter = metrics.NewCounter("singleproxy_server_header_table_output_bytes_total",
+		"Request message payload bytes after header table encoding, on tunnels that negotiated the header table")
+)
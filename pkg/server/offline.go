@@ -0,0 +1,114 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+)
+
+// offlineRetryAfter 离线页面建议客户端重试的等待秒数
+const offlineRetryAfter = 30
+
+//go:embed offline.html
+var defaultOfflinePage string
+
+var defaultOfflineTemplate = template.Must(template.New("offline").Parse(defaultOfflinePage))
+
+// offlinePages 每个key在隧道离线时返回的页面，页面文件在启动时读取并缓存
+type offlinePages struct {
+	pages map[string][]byte // nil 表示使用内置模板
+}
+
+func newOfflinePages(keys map[string]*config.KeyConfig) *offlinePages {
+	o := &offlinePages{pages: make(map[string][]byte)}
+	for key, kc := range keys {
+		if kc == nil || kc.OfflinePage == "" {
+			continue
+		}
+		if kc.OfflinePage == config.OfflinePageDefault {
+			o.pages[key] = nil
+			continue
+		}
+		page, err := readOfflinePage(kc.OfflinePage)
+		if err != nil {
+			logger.Error("Failed to load offline page, using default template",
+				"key", key,
+				"file", kc.OfflinePage,
+				"error", err)
+		}
+		o.pages[key] = page
+	}
+	return o
+}
+
+// readOfflinePage 读取页面文件，超过 MaxOfflinePageBytes 时报错
+func readOfflinePage(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	page, err := io.ReadAll(io.LimitReader(f, config.MaxOfflinePageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(page) > config.MaxOfflinePageBytes {
+		return nil, fmt.Errorf("offline page exceeds %d bytes", config.MaxOfflinePageBytes)
+	}
+	return page, nil
+}
+
+// serveOffline 为配置了离线页面的key返回503，未配置时返回 false。
+// 只接受JSON的API调用方收到JSON错误
+func (p *SinglePortProxy) serveOffline(w http.ResponseWriter, r *http.Request, key string) bool {
+	page, ok := p.offlinePages.pages[key]
+	if !ok {
+		return false
+	}
+	p.markProxyError(w, proxyErrNoTunnel)
+	w.Header().Set("Retry-After", strconv.Itoa(offlineRetryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error":       "tunnel_offline",
+			"message":     "The tunnel for this service is not connected",
+			"key":         key,
+			"retry_after": offlineRetryAfter,
+		})
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method == http.MethodHead {
+		return true
+	}
+	if page != nil {
+		w.Write(page)
+		return true
+	}
+	defaultOfflineTemplate.Execute(w, struct {
+		Key  string
+		Time string
+	}{key, time.Now().UTC().Format(time.RFC3339)})
+	return true
+}
+
+// wantsJSON 判断调用方是否要求JSON而非HTML
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
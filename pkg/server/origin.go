@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"singleproxy/pkg/logger"
+)
+
+// newOriginChecker 根据允许的来源列表构造 Upgrader.CheckOrigin。
+// 列表为空时接受任意来源；未携带 Origin 头的请求 (非浏览器客户端) 总是放行。
+// 支持的写法: "*"、"app.example.com"、"*.example.com"、"https://*.example.com"
+func newOriginChecker(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return func(r *http.Request) bool { return true }
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || originAllowed(allowed, origin) {
+			return true
+		}
+		logger.Warn("Rejected WebSocket upgrade from disallowed origin",
+			"origin", origin,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr)
+		return false
+	}
+}
+
+// originAllowed 检查 Origin 是否匹配任一允许的来源
+func originAllowed(patterns []string, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*" {
+			return true
+		}
+		if patternScheme, patternHost, ok := strings.Cut(pattern, "://"); ok {
+			if patternScheme == scheme && hostAllowed([]string{patternHost}, host) {
+				return true
+			}
+			continue
+		}
+		// 未指定 scheme 时只比较主机名，忽略端口
+		if hostAllowed([]string{pattern}, hostWithoutPort(host)) || hostAllowed([]string{pattern}, host) {
+			return true
+		}
+	}
+	return false
+}
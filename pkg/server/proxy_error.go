@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+
+	"singleproxy/pkg/protocol"
+)
+
+// headerProxyError 代理自身产生的错误响应中说明原因的头 (需开启 proxy_error_header)
+const headerProxyError = "X-Proxy-Error"
+
+// proxyErrorKind 代理自身产生的错误响应的原因，用于响应头、日志和指标标签
+type proxyErrorKind string
+
+const (
+	proxyErrNoTunnel              proxyErrorKind = "no_tunnel"                   // 该key没有在线的隧道
+	proxyErrTunnelWrite           proxyErrorKind = "tunnel_write_failed"         // 请求写入WebSocket隧道失败
+	proxyErrTunnelBusy            proxyErrorKind = "tunnel_busy"                 // 隧道连接的写入队列或长轮询客户端的请求队列已满
+	proxyErrTunnelReplaced        proxyErrorKind = "tunnel_replaced"             // 等待响应时隧道连接被新连接替换
+	proxyErrTunnelClosed          proxyErrorKind = "tunnel_closed"               // 事件流进行中隧道连接断开
+	proxyErrRequestSerialize      proxyErrorKind = "request_serialize_failed"    // 公网请求无法序列化
+	proxyErrResponseDeserialize   proxyErrorKind = "response_deserialize_failed" // 隧道返回的响应无法解析
+	proxyErrChunkIntegrity        proxyErrorKind = "chunk_integrity_failed"      // 响应体数据块序号或总长度不符
+	proxyErrResponseProtocol      proxyErrorKind = "response_protocol_error"     // 响应头之前的数据块超出缓冲上限或已结束
+	proxyErrFrameTooLarge         proxyErrorKind = "frame_too_large"             // 响应消息超过连接协商的大小上限
+	proxyErrResponseHeaderTimeout proxyErrorKind = "response_header_timeout"     // 等待响应头超时
+	proxyErrResponseTimeout       proxyErrorKind = "response_timeout"            // 整个响应超时 (响应流停滞)
+	proxyErrStreamingUnsupported  proxyErrorKind = "streaming_unsupported"       // ResponseWriter 不支持流式写出
+	proxyErrBadRemoteAddr         proxyErrorKind = "bad_remote_addr"             // 无法解析公网连接地址
+	proxyErrUpstreamConnect       proxyErrorKind = "upstream_connect_failed"     // /proxy/ 或 CONNECT 连接目标失败
+	proxyErrUpstreamWrite         proxyErrorKind = "upstream_write_failed"       // /proxy/ 请求写入目标失败
+	proxyErrUpstreamResponse      proxyErrorKind = "upstream_response_failed"    // /proxy/ 读取目标响应失败
+	proxyErrTrafficPaused         proxyErrorKind = "traffic_paused"              // 流量模式为 paused，公网请求不转发
+	proxyErrPeerUnreachable       proxyErrorKind = "peer_unreachable"            // 转发到集群中拥有该key的服务器失败
+	proxyErrScheduleClosed        proxyErrorKind = "schedule_closed"             // 请求不在该key的开放时段内
+	proxyErrBackendNotFound       proxyErrorKind = "backend_not_found"           // X-Tunnel-Backend 指定的连接不在该key的连接中
+	proxyErrLoopDetected          proxyErrorKind = "loop_detected"               // 请求已经过本服务器或经过的实例过多
+
+	// 客户端转发目标服务失败，原因由客户端在 X-Target-Error 中给出
+	proxyErrTargetConnectRefused        proxyErrorKind = protocol.TargetErrConnectRefused
+	proxyErrTargetConnectTimeout        proxyErrorKind = protocol.TargetErrConnectTimeout
+	proxyErrTargetConnectFailed         proxyErrorKind = protocol.TargetErrConnectFailed
+	proxyErrTargetTLS                   proxyErrorKind = protocol.TargetErrTLS
+	proxyErrTargetResponseHeaderTimeout proxyErrorKind = protocol.TargetErrResponseHeaderTimeout
+	proxyErrTargetRead                  proxyErrorKind = protocol.TargetErrRead
+	proxyErrTargetRedirectLoop          proxyErrorKind = protocol.TargetErrRedirectLoop
+	proxyErrTargetFailed                proxyErrorKind = protocol.TargetErrFailed
+)
+
+// proxyErrorResponses 每种原因返回给公网用户的状态码和消息
+var proxyErrorResponses = map[proxyErrorKind]struct {
+	status  int
+	message string
+}{
+	proxyErrNoTunnel:              {http.StatusBadGateway, "Service unavailable"},
+	proxyErrTunnelWrite:           {http.StatusBadGateway, "Failed to forward request"},
+	proxyErrTunnelBusy:            {http.StatusServiceUnavailable, "Tunnel client busy"},
+	proxyErrTunnelReplaced:        {http.StatusBadGateway, "Tunnel connection replaced"},
+	proxyErrTunnelClosed:          {http.StatusBadGateway, "Tunnel connection closed"},
+	proxyErrRequestSerialize:      {http.StatusInternalServerError, "Internal server error"},
+	proxyErrResponseDeserialize:   {http.StatusBadGateway, "Bad Gateway"},
+	proxyErrChunkIntegrity:        {http.StatusBadGateway, "Bad Gateway"},
+	proxyErrResponseProtocol:      {http.StatusBadGateway, "Bad Gateway"},
+	proxyErrFrameTooLarge:         {http.StatusBadGateway, "Bad Gateway"},
+	proxyErrResponseHeaderTimeout: {http.StatusGatewayTimeout, "Gateway Timeout"},
+	proxyErrResponseTimeout:       {http.StatusGatewayTimeout, "Gateway Timeout"},
+	proxyErrStreamingUnsupported:  {http.StatusInternalServerError, "Streaming unsupported"},
+	proxyErrBadRemoteAddr:         {http.StatusInternalServerError, "Internal server error"},
+	proxyErrUpstreamConnect:       {http.StatusBadGateway, "Bad Gateway"},
+	proxyErrUpstreamWrite:         {http.StatusBadGateway, "Bad Gateway"},
+	proxyErrUpstreamResponse:      {http.StatusBadGateway, "Bad Gateway"},
+	proxyErrTrafficPaused:         {http.StatusServiceUnavailable, "Service paused"},
+	proxyErrPeerUnreachable:       {http.StatusBadGateway, "Service unavailable"},
+	proxyErrScheduleClosed:        {http.StatusServiceUnavailable, "Service closed"},
+	proxyErrBackendNotFound:       {http.StatusNotFound, "Tunnel backend not connected"},
+	proxyErrLoopDetected:          {http.StatusLoopDetected, "Loop Detected"},
+
+	proxyErrTargetConnectRefused:        {http.StatusBadGateway, "Target connection refused"},
+	proxyErrTargetConnectTimeout:        {http.StatusGatewayTimeout, "Target connection timed out"},
+	proxyErrTargetConnectFailed:         {http.StatusBadGateway, "Target unreachable"},
+	proxyErrTargetTLS:                   {http.StatusBadGateway, "Target TLS handshake failed"},
+	proxyErrTargetResponseHeaderTimeout: {http.StatusGatewayTimeout, "Target response timed out"},
+	proxyErrTargetRead:                  {http.StatusBadGateway, "Failed to read target response"},
+	proxyErrTargetRedirectLoop:          {http.StatusBadGateway, "Target redirect loop"},
+	proxyErrTargetFailed:                {http.StatusBadGateway, "Bad Gateway"},
+}
+
+// markProxyError 记录错误原因：计入指标、写入用量记录供日志使用，开启时设置 X-Proxy-Error 头。
+// 响应头已发出时只记录不设置头
+func (p *SinglePortProxy) markProxyError(w http.ResponseWriter, kind proxyErrorKind) {
+	proxyErrorsCounter.WithLabelValue(string(kind)).Inc()
+	if uw, ok := w.(*usageWriter); ok {
+		uw.proxyError = kind
+	}
+	if p.config.ProxyErrorHeader {
+		w.Header().Set(headerProxyError, string(kind))
+	}
+}
+
+// writeProxyError 记录错误原因并返回对应的错误响应
+func (p *SinglePortProxy) writeProxyError(w http.ResponseWriter, kind proxyErrorKind) {
+	p.markProxyError(w, kind)
+	resp := proxyErrorResponses[kind]
+	http.Error(w, resp.message, resp.status)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// 每个key默认每分钟允许的注册次数及突发次数，突发额度用于容忍网络抖动后的正常重连
+const (
+	defaultRegistrationRate  = 10
+	defaultRegistrationBurst = 3
+)
+
+// 连续被限流时重试等待时间的上限
+const maxRegistrationRetryAfter = 5 * time.Minute
+
+// 超过该数量时清理长期未注册的限流记录
+const registrationPruneThreshold = 1024
+
+// registrationEntry 单个key的注册限流状态
+type registrationEntry struct {
+	limiter  *rate.Limiter
+	strikes  int // 连续被拒绝的次数，用于递增重试等待时间
+	lastSeen time.Time
+}
+
+// registrationLimiter 限制每个key的注册频率，防止崩溃循环的客户端反复重连
+type registrationLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	entries map[string]*registrationEntry
+}
+
+// newRegistrationLimiter 创建注册限流器，perMinute 为0时使用默认值，负数表示不限制
+func newRegistrationLimiter(perMinute, burst int) *registrationLimiter {
+	if perMinute == 0 {
+		perMinute = defaultRegistrationRate
+	}
+	if burst <= 0 {
+		burst = defaultRegistrationBurst
+	}
+	l := &registrationLimiter{
+		limit:   rate.Limit(float64(perMinute) / 60),
+		burst:   burst,
+		entries: make(map[string]*registrationEntry),
+	}
+	if perMinute < 0 {
+		l.limit = rate.Inf
+	}
+	return l
+}
+
+// allow 记录一次注册尝试。被拒绝时返回客户端应等待的时间，
+// 连续被拒绝时等待时间逐次翻倍，直到 maxRegistrationRetryAfter
+func (l *registrationLimiter) allow(key string) (bool, time.Duration) {
+	if l.limit == rate.Inf {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := l.entries[key]
+	if !ok {
+		if len(l.entries) >= registrationPruneThreshold {
+			l.pruneLocked(now)
+		}
+		entry = &registrationEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.entries[key] = entry
+	}
+	entry.lastSeen = now
+
+	if entry.limiter.AllowN(now, 1) {
+		entry.strikes = 0
+		return true, 0
+	}
+
+	// 计算令牌恢复所需时间，再按连续拒绝次数加倍
+	reservation := entry.limiter.ReserveN(now, 1)
+	wait := reservation.DelayFrom(now)
+	reservation.CancelAt(now)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	for i := 0; i < entry.strikes && wait < maxRegistrationRetryAfter; i++ {
+		wait *= 2
+	}
+	if wait > maxRegistrationRetryAfter {
+		wait = maxRegistrationRetryAfter
+	}
+	entry.strikes++
+	return false, wait
+}
+
+// pruneLocked 清理令牌已恢复满额且没有连续拒绝记录的条目
+func (l *registrationLimiter) pruneLocked(now time.Time) {
+	refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for key, entry := range l.entries {
+		if entry.strikes == 0 && now.Sub(entry.lastSeen) > refill {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// throttledKey 管理API中被限流的key
+type throttledKey struct {
+	Key      string    `json:"key"`
+	Strikes  int       `json:"strikes"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// throttled 返回当前处于连续被拒绝状态且满足 include 的key
+func (l *registrationLimiter) throttled(include func(string) bool) []throttledKey {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	keys := make([]throttledKey, 0)
+	for key, entry := range l.entries {
+		if entry.strikes > 0 && include(key) {
+			keys = append(keys, throttledKey{Key: key, Strikes: entry.strikes, LastSeen: entry.lastSeen})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+// tunnelKeyCount 返回当前已注册的不同key数量 (WebSocket 与长轮询合计)
+func (p *SinglePortProxy) tunnelKeyCount() int {
+	return p.countTunnelKeys(func(string) bool { return true })
+}
+
+// countTunnelKeys 返回满足 include 的已注册key数量
+func (p *SinglePortProxy) countTunnelKeys(include func(string) bool) int {
+	keys := make(map[string]struct{})
+
+	p.connsMu.RLock()
+	for key := range p.clientConns {
+		if include(key) {
+			keys[key] = struct{}{}
+		}
+	}
+	p.connsMu.RUnlock()
+
+	p.httpTunnelMgr.mu.RLock()
+	for key := range p.httpTunnelMgr.clients {
+		if include(key) {
+			keys[key] = struct{}{}
+		}
+	}
+	p.httpTunnelMgr.mu.RUnlock()
+
+	return len(keys)
+}
+
+// tunnelKeyLimitReached 检查注册新key是否会超过 max_tunnel_keys。
+// 已在线或在配置文件中声明的key不受影响；检查与登记之间未加锁，并发注册时可能略微超出上限
+func (p *SinglePortProxy) tunnelKeyLimitReached(key string) bool {
+	if p.config.MaxTunnelKeys <= 0 || p.keyInUse(key) {
+		return false
+	}
+	return p.tunnelKeyCount() >= p.config.MaxTunnelKeys
+}
+
+// handleAdminLimits 返回注册相关的限制及当前状态，key相关数据按令牌权限范围过滤，启用拖延时附带被拖延的IP
+func (p *SinglePortProxy) handleAdminLimits(w http.ResponseWriter, r *http.Request) {
+	principal := adminPrincipalFrom(r)
+	perMinute := 0.0
+	if p.registrations.limit != rate.Inf {
+		perMinute = float64(p.registrations.limit) * 60
+	}
+	limits := map[string]any{
+		"max_tunnel_keys":              p.config.MaxTunnelKeys,
+		"tunnel_keys":                  p.countTunnelKeys(principal.allows),
+		"registration_rate_per_minute": perMinute,
+		"registration_burst":           p.registrations.burst,
+		"throttled_keys":               p.registrations.throttled(principal.allows),
+	}
+	// 拖延的来源IP不属于任何key，只对完整权限的令牌展示
+	if p.tarpit != nil && principal.full {
+		limits["tarpit"] = p.tarpit.status()
+	}
+	writeJSON(w, http.StatusOK, limits)
+}
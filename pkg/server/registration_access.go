@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/utils"
+)
+
+// registrationListenerContextKey 标记经注册专用监听器收到的请求
+type registrationListenerContextKey struct{}
+
+// registrationAccess 隧道注册入口的访问限制
+type registrationAccess struct {
+	dedicated bool         // 配置了注册专用监听器，主端口不再接受注册
+	allow     []*net.IPNet // 允许注册的来源网段，为空不限制
+}
+
+func newRegistrationAccess(cfg *config.Config) *registrationAccess {
+	a := &registrationAccess{dedicated: cfg.RegistrationListen != ""}
+	for _, cidr := range cfg.RegistrationAllowedCIDRs {
+		ipNet, err := config.ParseCIDR(cidr)
+		if err != nil {
+			logger.Error("Invalid registration allowed CIDR, ignoring",
+				"cidr", cidr,
+				"error", err)
+			continue
+		}
+		a.allow = append(a.allow, ipNet)
+	}
+	return a
+}
+
+// allowed 检查请求是否可以访问注册入口。来源地址只取直连地址，
+// 不信任可被伪造的 X-Forwarded-For / X-Real-IP
+func (a *registrationAccess) allowed(r *http.Request) (bool, string) {
+	if a.dedicated && r.Context().Value(registrationListenerContextKey{}) == nil {
+		return false, "listener_role"
+	}
+	if len(a.allow) == 0 {
+		return true, ""
+	}
+	if addr, ok := utils.ParseClientIP(r.RemoteAddr); ok {
+		ip := net.IP(addr.AsSlice())
+		for _, ipNet := range a.allow {
+			if ipNet.Contains(ip) {
+				return true, ""
+			}
+		}
+	}
+	return false, "source_cidr"
+}
+
+// checkRegistrationAccess 注册入口不允许访问时返回404，不暴露入口的存在
+func (p *SinglePortProxy) checkRegistrationAccess(w http.ResponseWriter, r *http.Request) bool {
+	ok, reason := p.registrationAccess.allowed(r)
+	if !ok {
+		registrationDeniedCounter.Inc()
+		logger.Warn("Rejected tunnel registration endpoint access",
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"reason", reason)
+		http.NotFound(w, r)
+	}
+	return ok
+}
+
+// isRegistrationPath 判断路径是否属于隧道注册入口
+func (p *SinglePortProxy) isRegistrationPath(path string) bool {
+	return strings.HasPrefix(path, p.wsPathPrefix) || strings.HasPrefix(path, p.longPollPathPrefix)
+}
+
+// listenRegistration 在注册专用地址上监听，主监听器启用TLS时同样启用
+func (p *SinglePortProxy) listenRegistration() (net.Listener, error) {
+	ln, err := net.Listen("tcp", p.config.RegistrationListen)
+	if err != nil {
+		return nil, err
+	}
+	if p.tlsConfig != nil {
+		ln = p.newTLSListener(ln)
+	}
+	return ln, nil
+}
+
+// serveRegistration 在注册专用监听器上只提供隧道注册入口，其他路径返回404
+func (p *SinglePortProxy) serveRegistration(ln net.Listener) {
+	logger.Info("Registration listener started", "listen_addr", p.config.RegistrationListen)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.isRegistrationPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), registrationListenerContextKey{}, true)
+		p.ServeHTTP(w, r.WithContext(ctx))
+	})
+
+	var backoff acceptBackoff
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logger.Info("Registration listener closed", "listen_addr", p.config.RegistrationListen)
+				return
+			}
+			class, delay := backoff.next(err)
+			logger.Warn("Failed to accept connection on registration listener",
+				"listen_addr", p.config.RegistrationListen,
+				"class", class,
+				"retry_in", delay,
+				"error", err)
+			time.Sleep(delay)
+			continue
+		}
+		backoff.reset()
+		go p.handleHTTPConnection(p.conns.track(conn), handler)
+	}
+}
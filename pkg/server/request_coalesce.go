@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// defaultCoalesceMaxBodyBytes 共享的响应体默认上限
+const defaultCoalesceMaxBodyBytes = 1 << 20
+
+// defaultCoalesceHeaders 总是用来区分请求的头部: 内容协商、身份和范围不同的请求不能共享响应
+var defaultCoalesceHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "Range", headerClientCert}
+
+var (
+	coalescedRequestsCounter = metrics.NewCounterVec("singleproxy_server_coalesced_requests_total",
+		"GET/HEAD requests answered with the response of an identical concurrent request instead of their own tunnel round trip, by tunnel key", "key")
+	coalesceFallbacksCounter = metrics.NewCounterVec("singleproxy_server_coalesce_fallbacks_total",
+		"Requests that waited for an identical concurrent request but were forwarded on their own, by reason (leader_failed, too_large, streaming, private)", "reason")
+)
+
+// coalescedCall 正在转发的一个请求，相同的请求等待它的响应。done 关闭之前第一个请求仍在转发
+type coalescedCall struct {
+	id   string
+	done chan struct{}
+
+	// 以下字段在 done 关闭之前写入，之后只读
+	released bool   // 已唤醒等待的请求
+	reason   string // 响应不能共享的原因，为空表示响应已保存
+	status   int
+	header   http.Header
+	body     []byte
+}
+
+// requestCoalescer 一个key正在转发的 GET/HEAD 请求，响应完成后即删除，不做缓存
+type requestCoalescer struct {
+	paths   []string
+	headers []string
+	maxBody int
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// newRequestCoalescers 为配置了 coalesce 的key创建请求合并
+func newRequestCoalescers(keys map[string]*config.KeyConfig) map[string]*requestCoalescer {
+	coalescers := make(map[string]*requestCoalescer)
+	for key, kc := range keys {
+		if kc == nil || kc.Coalesce == nil {
+			continue
+		}
+		cc := kc.Coalesce
+		c := &requestCoalescer{
+			paths:   cc.Paths,
+			headers: append(append([]string(nil), defaultCoalesceHeaders...), cc.Headers...),
+			maxBody: cc.MaxBodyBytes,
+			calls:   make(map[string]*coalescedCall),
+		}
+		if c.maxBody <= 0 {
+			c.maxBody = defaultCoalesceMaxBodyBytes
+		}
+		coalescers[key] = c
+	}
+	return coalescers
+}
+
+// applies 判断请求是否可以合并: 只处理不带请求体的 GET/HEAD 和配置的路径，协议升级请求独占连接，不合并
+func (c *requestCoalescer) applies(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.ContentLength != 0 || len(r.TransferEncoding) > 0 || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if len(c.paths) == 0 {
+		return true
+	}
+	for _, prefix := range c.paths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// identity 方法、主机、路径和查询参数以及区分请求的头部都相同时返回相同的值
+func (c *requestCoalescer) identity(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.Host)
+	b.WriteString(r.URL.RequestURI())
+	for _, name := range c.headers {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// begin 查找 id 对应的正在转发的请求，不存在时创建并返回 leader 为 true，由调用方转发请求
+func (c *requestCoalescer) begin(id string) (call *coalescedCall, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[id]; ok {
+		return call, false
+	}
+	call = &coalescedCall{id: id, done: make(chan struct{})}
+	c.calls[id] = call
+	return call, true
+}
+
+// release 唤醒等待的请求。reason 为空时共享保存的响应，否则等待的请求各自转发。
+// 之后到达的相同请求开始新的一轮合并
+func (c *requestCoalescer) release(call *coalescedCall, reason string, status int, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call.released {
+		return
+	}
+	if c.calls[call.id] == call {
+		delete(c.calls, call.id)
+	}
+	call.released = true
+	call.reason = reason
+	call.status = status
+	call.header = header
+	call.body = body
+	close(call.done)
+}
+
+// coalescedRequest 负责转发的第一个请求，结束时把响应交给等待的相同请求
+type coalescedRequest struct {
+	coalescer *requestCoalescer
+	call      *coalescedCall
+	rec       *coalesceRecorder
+}
+
+// beginCoalesced 合并相同的并发 GET/HEAD 请求。相同的请求正在转发时等待它的响应并返回 handled；
+// 需要转发时返回的 coalescedRequest 记录响应，调用方在请求结束时调用 finish。
+// 第一个请求失败或响应不能共享时，等待的请求各自转发，而不是一起失败
+func (p *SinglePortProxy) beginCoalesced(uw *usageWriter, r *http.Request, key, clientIP string) (req *coalescedRequest, handled bool) {
+	c := p.coalescers[key]
+	if c == nil || !c.applies(r) {
+		return nil, false
+	}
+
+	call, leader := c.begin(c.identity(r))
+	if leader {
+		rec := &coalesceRecorder{ResponseWriter: uw.ResponseWriter, coalescer: c, call: call}
+		uw.ResponseWriter = rec
+		return &coalescedRequest{coalescer: c, call: call, rec: rec}, false
+	}
+
+	select {
+	case <-call.done:
+	case <-r.Context().Done():
+		uw.aborted = true
+		return nil, true
+	}
+	if call.reason != "" {
+		coalesceFallbacksCounter.WithLabelValue(call.reason).Inc()
+		logger.Debug("Forwarding coalesced request on its own",
+			"client_ip", clientIP,
+			"key", p.logKey(key),
+			"method", r.Method,
+			"url", p.logURL(key, r.URL),
+			"reason", call.reason)
+		return nil, false
+	}
+
+	coalescedRequestsCounter.WithLabelValue(key).Inc()
+	logger.Debug("Serving response of identical concurrent request",
+		"client_ip", clientIP,
+		"key", p.logKey(key),
+		"method", r.Method,
+		"url", p.logURL(key, r.URL),
+		"status", call.status)
+	// 每个等待的请求使用各自的副本，之后的处理 (如访问日志、响应改写) 修改头部时互不影响
+	for k, v := range call.header.Clone() {
+		uw.Header()[k] = v
+	}
+	uw.WriteHeader(call.status)
+	uw.Write(call.body)
+	return nil, true
+}
+
+// finish 把完整的响应交给等待的请求。代理自身产生的错误响应和中断的响应不共享，等待的请求各自转发
+func (req *coalescedRequest) finish(uw *usageWriter) {
+	rec := req.rec
+	if uw.proxyError != "" || uw.aborted || rec.status == 0 {
+		req.coalescer.release(req.call, "leader_failed", 0, nil, nil)
+		return
+	}
+	body := rec.body
+	if body == nil {
+		body = []byte{}
+	}
+	req.coalescer.release(req.call, "", rec.status, rec.header, body)
+}
+
+// coalesceRecorder 在转发给公网用户的同时记录最终状态码、响应头和响应体。
+// 一旦确定响应不能共享 (过大、事件流、针对单个用户) 立即唤醒等待的请求，不让它们等到响应结束
+type coalesceRecorder struct {
+	http.ResponseWriter
+	coalescer *requestCoalescer
+	call      *coalescedCall
+	status    int
+	header    http.Header
+	body      []byte
+	skipped   bool
+}
+
+// start 记录最终状态码和响应头，检查响应能否共享
+func (w *coalesceRecorder) start(status int) {
+	w.status = status
+	w.header = w.ResponseWriter.Header().Clone()
+	if reason := unshareableReason(w.header, w.coalescer.maxBody); reason != "" {
+		w.skip(reason)
+	}
+}
+
+func (w *coalesceRecorder) skip(reason string) {
+	w.skipped = true
+	w.body = nil
+	w.coalescer.release(w.call, reason, 0, nil, nil)
+}
+
+// unshareableReason 返回响应不能交给其他请求的原因
+func unshareableReason(header http.Header, maxBody int) string {
+	if len(header.Values("Set-Cookie")) > 0 {
+		return "private"
+	}
+	cacheControl := strings.ToLower(strings.Join(header.Values("Cache-Control"), ","))
+	if strings.Contains(cacheControl, "private") || strings.Contains(cacheControl, "no-store") {
+		return "private"
+	}
+	if strings.HasPrefix(strings.ToLower(header.Get("Content-Type")), "text/event-stream") {
+		return "streaming"
+	}
+	if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && n > int64(maxBody) {
+		return "too_large"
+	}
+	return ""
+}
+
+func (w *coalesceRecorder) WriteHeader(status int) {
+	// 1xx 临时响应之后还有最终状态码
+	if w.status == 0 && (status < 100 || status > 199) {
+		w.start(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *coalesceRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.start(http.StatusOK)
+	}
+	if !w.skipped {
+		if len(w.body)+len(p) > w.coalescer.maxBody {
+			w.skip("too_large")
+		} else {
+			w.body = append(w.body, p...)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *coalesceRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *coalesceRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+func (w *coalesceRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"singleproxy/pkg/protocol"
+)
+
+// defaultRequestTimeoutMin 未配置 -request-timeout-min 时请求级超时的下限
+const defaultRequestTimeoutMin = time.Second
+
+// requestTimeout 返回公网请求自带的超时，限制在 -request-timeout-min 和 -request-timeout-max 之间。
+// X-Request-Timeout 头优先，其次是上游代理在请求 context 上设置的截止时间；
+// 没有可用的超时时返回 0，请求按服务器配置的超时处理
+func (p *SinglePortProxy) requestTimeout(r *http.Request) (time.Duration, string) {
+	var timeout time.Duration
+	var source string
+	if d, ok := protocol.ParseRequestTimeout(r.Header.Get(protocol.HeaderRequestTimeout)); ok {
+		timeout, source = d, "header"
+	} else if deadline, ok := r.Context().Deadline(); ok {
+		timeout, source = time.Until(deadline), "deadline"
+	} else {
+		return 0, ""
+	}
+
+	min := p.config.RequestTimeoutMin
+	if min <= 0 {
+		min = defaultRequestTimeoutMin
+	}
+	max := p.config.RequestTimeoutMax
+	if max <= 0 {
+		max = p.config.ResponseTimeout
+	}
+	if max <= 0 {
+		max = defaultResponseTimeout
+	}
+	if min > max {
+		min = max
+	}
+	if timeout < min {
+		timeout = min
+	}
+	if timeout > max {
+		timeout = max
+	}
+	return timeout, source
+}
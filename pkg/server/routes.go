@@ -0,0 +1,562 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+)
+
+// 请求路径对应的入口，与 ServeHTTP 的分派顺序一致
+const (
+	routeEntryAdmin        = "admin"
+	routeEntryRegistration = "registration"
+	routeEntryLongPoll     = "long_poll"
+	routeEntryCluster      = "cluster"
+	routeEntryPathProxy    = "path_proxy"
+	routeEntryPublic       = "public"
+)
+
+// keySourceOrder 公网请求确定隧道key的来源，按优先级排列
+var keySourceOrder = []string{"port_binding", "header", "host_config", "host_binding", "host_default", "default"}
+
+// RouteResolver 公网请求的路由规则: 先按路径选择入口，再按 keySourceOrder 确定隧道key。
+// 服务器处理请求、routes 子命令和 GET /admin/routes 使用同一份规则；
+// 离线检查配置时没有客户端动态申请的绑定
+type RouteResolver struct {
+	cfg            *config.Config
+	adminEnabled   bool
+	clusterEnabled bool
+
+	// 隧道注册入口的路径前缀: WebSocket 和与其同级的 HTTP 长轮询
+	wsPathPrefix       string
+	longPollPathPrefix string
+
+	hostRoutes      map[string]string // 配置文件 hosts 中的静态主机名路由
+	hostDefaultKeys map[string]string // 按主机名覆盖的默认key ("none" 表示关闭)
+	bindings        *bindingManager   // 客户端申请的动态绑定 (离线检查时为nil)
+}
+
+// NewRouteResolver 根据配置创建路由规则，不包含动态绑定
+func NewRouteResolver(cfg *config.Config) *RouteResolver {
+	rr := &RouteResolver{
+		cfg:             cfg,
+		adminEnabled:    len(newAdminPrincipals(cfg)) > 0,
+		clusterEnabled:  cfg.ClusterToken != "",
+		hostRoutes:      newHostRoutes(cfg.Hosts),
+		hostDefaultKeys: newHostDefaultKeys(cfg.Hosts),
+	}
+	rr.wsPathPrefix, rr.longPollPathPrefix = cfg.TunnelPathPrefixes()
+	return rr
+}
+
+// entry 返回请求路径对应的入口
+func (rr *RouteResolver) entry(path string) string {
+	switch {
+	case rr.adminEnabled && strings.HasPrefix(path, "/admin/"):
+		return routeEntryAdmin
+	case strings.HasPrefix(path, rr.wsPathPrefix):
+		return routeEntryRegistration
+	case strings.HasPrefix(path, rr.longPollPathPrefix):
+		return routeEntryLongPoll
+	case rr.clusterEnabled && strings.HasPrefix(path, "/cluster/"):
+		return routeEntryCluster
+	case strings.HasPrefix(path, "/proxy/"):
+		return routeEntryPathProxy
+	}
+	return routeEntryPublic
+}
+
+// resolveKey 确定公网请求对应的隧道key及其来源:
+// 端口绑定 > X-Tunnel-Key 头 > 配置文件的主机名路由 > 主机名绑定 > 主机名或全局的默认key。
+// 默认路由已关闭时返回空key
+func (rr *RouteResolver) resolveKey(r *http.Request) (string, string) {
+	if key, ok := r.Context().Value(boundKeyContextKey{}).(string); ok {
+		return key, "port_binding"
+	}
+	if key := r.Header.Get("X-Tunnel-Key"); key != "" {
+		return key, "header"
+	}
+	host := hostWithoutPort(r.Host)
+	if key, ok := lookupHostName(rr.hostRoutes, host); ok {
+		return key, "host_config"
+	}
+	if rr.bindings != nil {
+		if key, ok := rr.bindings.lookupHost(host); ok {
+			return key, "host_binding"
+		}
+	}
+	return rr.defaultKey(host)
+}
+
+// RouteTable 生效的路由表: 监听器角色、路径入口、主机名路由、默认key、全局限制和每个key的设置
+type RouteTable struct {
+	Listeners  []ListenerRoute `json:"listeners"`
+	Paths      []PathRoute     `json:"paths"`
+	KeyOrder   []string        `json:"key_order"`
+	Hosts      []HostRoute     `json:"hosts"`
+	DefaultKey string          `json:"default_key"` // 为空表示默认路由已关闭
+	Policy     RoutePolicy     `json:"policy"`
+	Keys       []KeyRoute      `json:"keys"`
+}
+
+// ListenerRoute 一个监听地址及其接受的请求类型
+type ListenerRoute struct {
+	Addr  string   `json:"addr"`
+	TLS   bool     `json:"tls"`
+	Roles []string `json:"roles"`
+	Key   string   `json:"key,omitempty"` // 端口绑定所属的key
+}
+
+// PathRoute 路径前缀对应的入口，按匹配顺序排列
+type PathRoute struct {
+	Prefix string `json:"prefix"`
+	Entry  string `json:"entry"`
+}
+
+// HostRoute 按主机名的路由
+type HostRoute struct {
+	Host       string `json:"host"`
+	Key        string `json:"key,omitempty"`
+	DefaultKey string `json:"default_key,omitempty"`
+	Source     string `json:"source"` // host_config (配置文件) 或 host_binding (客户端申请)
+}
+
+// RoutePolicy 对所有key生效的限制、超时和认证设置，超时为生效值
+type RoutePolicy struct {
+	IPRateLimit              int      `json:"ip_rate_limit"`
+	KeyRateLimit             int      `json:"key_rate_limit"`
+	ResponseHeaderTimeout    string   `json:"response_header_timeout"`
+	ResponseTimeout          string   `json:"response_timeout"`
+	RequestTimeoutMin        string   `json:"request_timeout_min"`
+	RequestTimeoutMax        string   `json:"request_timeout_max"`
+	MessageAuth              bool     `json:"message_auth"`
+	RegistrationAllowedCIDRs []string `json:"registration_allowed_cidrs,omitempty"`
+}
+
+// KeyRoute 单个key的设置，包含配置文件 keys 中的key和被主机名或默认路由引用的key
+type KeyRoute struct {
+	Key              string   `json:"key"`
+	Balance          string   `json:"balance,omitempty"`
+	Affinity         string   `json:"affinity,omitempty"`
+	FallbackUpstream string   `json:"fallback_upstream,omitempty"`
+	OfflinePage      string   `json:"offline_page,omitempty"`
+	SSE              bool     `json:"sse,omitempty"`
+	AllowIdle        bool     `json:"allow_idle,omitempty"`
+	AllowedHosts     []string `json:"allowed_hosts,omitempty"`
+	AllowedPorts     []string `json:"allowed_ports,omitempty"`
+	Idempotency      []string `json:"idempotency,omitempty"` // 去重的路径前缀, 对所有路径去重时为 "*"
+	Transforms       []string `json:"transforms,omitempty"`
+	AccessLogFile    string   `json:"access_log_file,omitempty"`
+	Schedule         string   `json:"schedule,omitempty"`     // 开放时段和时区
+	AdminTokens      []string `json:"admin_tokens,omitempty"` // 可管理该key的有范围令牌
+}
+
+// Table 返回生效的路由表
+func (rr *RouteResolver) Table() *RouteTable {
+	cfg := rr.cfg
+	t := &RouteTable{
+		Listeners:  rr.listeners(),
+		KeyOrder:   keySourceOrder,
+		DefaultKey: cfg.DefaultRouteKey(),
+		Policy:     rr.policy(),
+	}
+	if rr.adminEnabled {
+		t.Paths = append(t.Paths, PathRoute{"/admin/", routeEntryAdmin})
+	}
+	t.Paths = append(t.Paths,
+		PathRoute{rr.wsPathPrefix, routeEntryRegistration},
+		PathRoute{rr.longPollPathPrefix, routeEntryLongPoll})
+	if rr.clusterEnabled {
+		t.Paths = append(t.Paths, PathRoute{"/cluster/", routeEntryCluster})
+	}
+	t.Paths = append(t.Paths,
+		PathRoute{"/proxy/", routeEntryPathProxy},
+		PathRoute{"/", routeEntryPublic})
+
+	keys := make(map[string]bool)
+	if t.DefaultKey != "" {
+		keys[t.DefaultKey] = true
+	}
+	for host := range cfg.Hosts {
+		name := strings.ToLower(host)
+		key, routed := rr.hostRoutes[name]
+		def, hasDefault := rr.hostDefaultKeys[name]
+		if !routed && !hasDefault {
+			continue
+		}
+		t.Hosts = append(t.Hosts, HostRoute{Host: name, Key: key, DefaultKey: def, Source: "host_config"})
+		if routed {
+			keys[key] = true
+		}
+		if hasDefault && def != config.DefaultKeyNone {
+			keys[def] = true
+		}
+	}
+	if rr.bindings != nil {
+		rr.bindings.mu.RLock()
+		for host, tc := range rr.bindings.hosts {
+			t.Hosts = append(t.Hosts, HostRoute{Host: host, Key: tc.key, Source: "host_binding"})
+			keys[tc.key] = true
+		}
+		rr.bindings.mu.RUnlock()
+	}
+	sort.Slice(t.Hosts, func(i, j int) bool {
+		if t.Hosts[i].Host != t.Hosts[j].Host {
+			return t.Hosts[i].Host < t.Hosts[j].Host
+		}
+		return t.Hosts[i].Source < t.Hosts[j].Source
+	})
+
+	for key := range cfg.Keys {
+		keys[key] = true
+	}
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		t.Keys = append(t.Keys, rr.keyRoute(key))
+	}
+	return t
+}
+
+// listeners 返回主端口、注册专用地址和已开启的端口绑定各自接受的请求
+func (rr *RouteResolver) listeners() []ListenerRoute {
+	cfg := rr.cfg
+	useTLS := cfg.TLSEnabled()
+	roles := []string{routeEntryPublic, routeEntryPathProxy, "socks5"}
+	if cfg.RegistrationListen == "" {
+		roles = append(roles, routeEntryRegistration)
+	}
+	if rr.adminEnabled {
+		roles = append(roles, routeEntryAdmin)
+	}
+	if rr.clusterEnabled {
+		roles = append(roles, routeEntryCluster)
+	}
+	listeners := []ListenerRoute{{Addr: ":" + cfg.ListenPort, TLS: useTLS, Roles: roles}}
+	if cfg.RegistrationListen != "" {
+		listeners = append(listeners, ListenerRoute{Addr: cfg.RegistrationListen, TLS: useTLS, Roles: []string{routeEntryRegistration}})
+	}
+	if rr.bindings != nil {
+		rr.bindings.mu.RLock()
+		ports := make([]int, 0, len(rr.bindings.ports))
+		for port := range rr.bindings.ports {
+			ports = append(ports, port)
+		}
+		sort.Ints(ports)
+		for _, port := range ports {
+			listeners = append(listeners, ListenerRoute{
+				Addr:  ":" + strconv.Itoa(port),
+				TLS:   useTLS,
+				Roles: []string{"port_binding"},
+				Key:   rr.bindings.ports[port].owner.key,
+			})
+		}
+		rr.bindings.mu.RUnlock()
+	}
+	return listeners
+}
+
+// policy 返回对所有key生效的设置，未配置的超时填入默认值
+func (rr *RouteResolver) policy() RoutePolicy {
+	cfg := rr.cfg
+	headerTimeout := cfg.ResponseHeaderTimeout
+	if headerTimeout <= 0 {
+		headerTimeout = defaultResponseHeaderTimeout
+	}
+	responseTimeout := cfg.ResponseTimeout
+	if responseTimeout <= 0 {
+		responseTimeout = defaultResponseTimeout
+	}
+	min := cfg.RequestTimeoutMin
+	if min <= 0 {
+		min = defaultRequestTimeoutMin
+	}
+	max := cfg.RequestTimeoutMax
+	if max <= 0 {
+		max = responseTimeout
+	}
+	return RoutePolicy{
+		IPRateLimit:              cfg.IPRateLimit,
+		KeyRateLimit:             cfg.KeyRateLimit,
+		ResponseHeaderTimeout:    headerTimeout.String(),
+		ResponseTimeout:          responseTimeout.String(),
+		RequestTimeoutMin:        min.String(),
+		RequestTimeoutMax:        max.String(),
+		MessageAuth:              cfg.MessageAuthKey != "",
+		RegistrationAllowedCIDRs: cfg.RegistrationAllowedCIDRs,
+	}
+}
+
+// keyRoute 返回单个key的设置，没有配置的key只有名称
+func (rr *RouteResolver) keyRoute(key string) KeyRoute {
+	kr := KeyRoute{Key: key}
+	for _, t := range rr.cfg.AdminTokens {
+		if t == nil || t.Token == "" || t.Full {
+			continue
+		}
+		if (&adminPrincipal{keys: t.Keys}).allows(key) {
+			kr.AdminTokens = append(kr.AdminTokens, t.Name)
+		}
+	}
+	kc := rr.cfg.Keys[key]
+	if kc == nil {
+		return kr
+	}
+	kr.Balance = kc.Balance
+	kr.Affinity = kc.Affinity
+	kr.FallbackUpstream = kc.FallbackUpstream
+	kr.OfflinePage = kc.OfflinePage
+	kr.SSE = kc.SSE
+	kr.AllowIdle = kc.AllowIdle
+	kr.AllowedHosts = kc.AllowedHosts
+	kr.AllowedPorts = kc.AllowedPorts
+	kr.AccessLogFile = kc.AccessLogFile
+	if sc := kc.Schedule; sc != nil {
+		timezone := sc.Timezone
+		if timezone == "" {
+			timezone = "Local"
+		}
+		kr.Schedule = fmt.Sprintf("%s (%s)", strings.Join(sc.Windows, "; "), timezone)
+	}
+	if ic := kc.Idempotency; ic != nil {
+		kr.Idempotency = ic.Paths
+		if len(ic.Paths) == 0 {
+			kr.Idempotency = []string{"*"}
+		}
+	}
+	for _, tc := range kc.Transforms {
+		if tc != nil {
+			kr.Transforms = append(kr.Transforms, describeTransform(tc))
+		}
+	}
+	return kr
+}
+
+// describeTransform 返回改写规则的单行说明
+func describeTransform(tc *config.TransformConfig) string {
+	direction := tc.Direction
+	if direction == "" {
+		direction = "response"
+	}
+	s := fmt.Sprintf("%s %s %q -> %q", direction, tc.Type, tc.From, tc.To)
+	if tc.PathPrefix != "" {
+		s += " path_prefix=" + tc.PathPrefix
+	}
+	return s
+}
+
+// RouteMatch 一个假设请求的路由结果
+type RouteMatch struct {
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	Entry     string `json:"entry"`
+	Key       string `json:"key,omitempty"`
+	KeySource string `json:"key_source,omitempty"`
+	Rejected  string `json:"rejected,omitempty"` // 请求在转发前被拒绝的原因
+
+	// 以下仅在转发到隧道时设置
+	IPRateLimit           int       `json:"ip_rate_limit,omitempty"`
+	KeyRateLimit          int       `json:"key_rate_limit,omitempty"`
+	ResponseHeaderTimeout string    `json:"response_header_timeout,omitempty"`
+	ResponseTimeout       string    `json:"response_timeout,omitempty"` // 按SSE处理时为 "none"
+	Idempotent            bool      `json:"idempotent,omitempty"`
+	Transforms            []string  `json:"transforms,omitempty"` // 按路径前缀筛选后生效的改写规则
+	Settings              *KeyRoute `json:"settings,omitempty"`
+}
+
+// Match 评估一个假设的请求，spec 为 "METHOD URL"，e.g. "GET https://app.example.com/foo"，
+// 只有URL时按 GET 处理。header 为请求携带的头部 (可为nil)，URL中的端口命中端口绑定时按端口绑定路由
+func (rr *RouteResolver) Match(spec string, header http.Header) (*RouteMatch, error) {
+	method, rawURL := http.MethodGet, strings.TrimSpace(spec)
+	if fields := strings.Fields(spec); len(fields) == 2 {
+		method, rawURL = strings.ToUpper(fields[0]), fields[1]
+	} else if len(fields) != 1 {
+		return nil, fmt.Errorf("请求格式应为 \"METHOD URL\": %q", spec)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("URL 不合法: %q", rawURL)
+	}
+	r, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		r.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if err := normalizeRequestTarget(r); err != nil {
+		return nil, err
+	}
+	if rr.bindings != nil {
+		if port, err := strconv.Atoi(u.Port()); err == nil {
+			rr.bindings.mu.RLock()
+			pb, ok := rr.bindings.ports[port]
+			rr.bindings.mu.RUnlock()
+			if ok {
+				r = r.WithContext(context.WithValue(r.Context(), boundKeyContextKey{}, pb.owner.key))
+			}
+		}
+	}
+
+	m := &RouteMatch{Method: method, URL: u.String(), Entry: rr.entry(r.URL.Path)}
+	if m.Entry != routeEntryPublic {
+		return m, nil
+	}
+	m.Key, m.KeySource = rr.resolveKey(r)
+	if m.Key == "" {
+		m.Rejected = "default routing disabled (404)"
+		return m, nil
+	}
+	validator, err := protocol.NewKeyValidator(rr.cfg.KeyPattern)
+	if err == nil {
+		err = validator.Validate(m.Key)
+	}
+	if err != nil {
+		m.Rejected = "invalid tunnel key (400): " + err.Error()
+		return m, nil
+	}
+
+	policy := rr.policy()
+	settings := rr.keyRoute(m.Key)
+	m.Settings = &settings
+	m.IPRateLimit = policy.IPRateLimit
+	m.KeyRateLimit = policy.KeyRateLimit
+	m.ResponseHeaderTimeout = policy.ResponseHeaderTimeout
+	m.ResponseTimeout = policy.ResponseTimeout
+	if kc := rr.cfg.Keys[m.Key]; kc != nil {
+		if kc.SSE {
+			m.ResponseTimeout = "none"
+		}
+		if kc.Idempotency != nil {
+			m.Idempotent = (&idempotencyStore{paths: kc.Idempotency.Paths}).applies(r)
+		}
+		for _, tc := range kc.Transforms {
+			if tc != nil && strings.HasPrefix(r.URL.Path, tc.PathPrefix) {
+				m.Transforms = append(m.Transforms, describeTransform(tc))
+			}
+		}
+	}
+	return m, nil
+}
+
+// WriteText 以表格输出路由表
+func (t *RouteTable) WriteText(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintln(tw, "LISTENER\tTLS\tROLES\tKEY")
+	for _, l := range t.Listeners {
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\n", l.Addr, l.TLS, strings.Join(l.Roles, ","), dash(l.Key))
+	}
+	fmt.Fprintln(tw, "\nPATH PREFIX\tENTRY")
+	for _, p := range t.Paths {
+		fmt.Fprintf(tw, "%s\t%s\n", p.Prefix, p.Entry)
+	}
+	fmt.Fprintln(tw, "\nHOST\tKEY\tDEFAULT KEY\tSOURCE")
+	for _, h := range t.Hosts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", h.Host, dash(h.Key), dash(h.DefaultKey), h.Source)
+	}
+	fmt.Fprintf(tw, "\nkey order:\t%s\n", strings.Join(t.KeyOrder, " > "))
+	fmt.Fprintf(tw, "default key:\t%s\n", orNone(t.DefaultKey))
+	fmt.Fprintf(tw, "rate limits:\tip=%d/s key=%d/s (0 = unlimited)\n", t.Policy.IPRateLimit, t.Policy.KeyRateLimit)
+	fmt.Fprintf(tw, "timeouts:\tresponse_header=%s response=%s request=%s..%s\n",
+		t.Policy.ResponseHeaderTimeout, t.Policy.ResponseTimeout, t.Policy.RequestTimeoutMin, t.Policy.RequestTimeoutMax)
+	fmt.Fprintf(tw, "message auth:\t%t\n", t.Policy.MessageAuth)
+	if len(t.Policy.RegistrationAllowedCIDRs) > 0 {
+		fmt.Fprintf(tw, "registration cidrs:\t%s\n", strings.Join(t.Policy.RegistrationAllowedCIDRs, ","))
+	}
+
+	fmt.Fprintln(tw, "\nKEY\tBALANCE\tFALLBACK\tOFFLINE PAGE\tSSE\tIDEMPOTENCY\tTRANSFORMS\tACCESS LOG\tADMIN TOKENS")
+	for _, k := range t.Keys {
+		balance := k.Balance
+		if k.Affinity != "" {
+			balance += "/" + k.Affinity
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\t%d\t%s\t%s\n", k.Key, dash(balance), dash(k.FallbackUpstream),
+			dash(k.OfflinePage), k.SSE, dash(strings.Join(k.Idempotency, ",")), len(k.Transforms),
+			dash(k.AccessLogFile), dash(strings.Join(k.AdminTokens, ",")))
+	}
+}
+
+// WriteText 以键值形式输出路由结果
+func (m *RouteMatch) WriteText(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintf(tw, "request:\t%s %s\n", m.Method, m.URL)
+	fmt.Fprintf(tw, "entry:\t%s\n", m.Entry)
+	if m.Entry != routeEntryPublic {
+		return
+	}
+	fmt.Fprintf(tw, "key:\t%s (%s)\n", orNone(m.Key), m.KeySource)
+	if m.Rejected != "" {
+		fmt.Fprintf(tw, "rejected:\t%s\n", m.Rejected)
+		return
+	}
+	fmt.Fprintf(tw, "rate limits:\tip=%d/s key=%d/s (0 = unlimited)\n", m.IPRateLimit, m.KeyRateLimit)
+	fmt.Fprintf(tw, "timeouts:\tresponse_header=%s response=%s\n", m.ResponseHeaderTimeout, m.ResponseTimeout)
+	fmt.Fprintf(tw, "idempotent:\t%t\n", m.Idempotent)
+	if s := m.Settings; s != nil {
+		if s.Balance != "" {
+			fmt.Fprintf(tw, "balance:\t%s %s\n", s.Balance, s.Affinity)
+		}
+		fmt.Fprintf(tw, "fallback:\t%s\n", dash(s.FallbackUpstream))
+		fmt.Fprintf(tw, "offline page:\t%s\n", dash(s.OfflinePage))
+		fmt.Fprintf(tw, "access log:\t%s\n", dash(s.AccessLogFile))
+		if s.Schedule != "" {
+			fmt.Fprintf(tw, "schedule:\t%s\n", s.Schedule)
+		}
+	}
+	for i, t := range m.Transforms {
+		fmt.Fprintf(tw, "transform %d:\t%s\n", i+1, t)
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return config.DefaultKeyNone
+	}
+	return s
+}
+
+// handleAdminRoutes 返回生效的路由表；携带 match 参数时评估该假设请求，
+// e.g. ?match=GET%20https://app.example.com/foo&key=mykey (key 模拟 X-Tunnel-Key 头)
+func (p *SinglePortProxy) handleAdminRoutes(w http.ResponseWriter, r *http.Request) {
+	if !requireFullAdmin(w, r) {
+		return
+	}
+	spec := r.URL.Query().Get("match")
+	if spec == "" {
+		writeJSON(w, http.StatusOK, p.routes.Table())
+		return
+	}
+	header := make(http.Header)
+	if key := r.URL.Query().Get("key"); key != "" {
+		header.Set("X-Tunnel-Key", key)
+	}
+	m, err := p.routes.Match(spec, header)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
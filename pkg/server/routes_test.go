@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+func TestRouteResolverKeyOrder(t *testing.T) {
+	rr := NewRouteResolver(&config.Config{
+		DefaultKey: "fallback",
+		Hosts: map[string]*config.HostConfig{
+			"app.example.com":    {TunnelKey: "app"},
+			"*.dev.example.com":  {DefaultKey: "dev"},
+			"closed.example.com": {DefaultKey: config.DefaultKeyNone},
+		},
+	})
+
+	tests := []struct {
+		spec, tunnelKey string
+		key, source     string
+	}{
+		{"GET https://APP.example.com:8443/", "", "app", "host_config"},
+		{"GET https://app.example.com/", "other", "other", "header"},
+		{"GET https://a.dev.example.com/", "", "dev", "host_default"},
+		{"GET https://closed.example.com/", "", "", "host_default"},
+		{"https://unknown.example.com/", "", "fallback", "default"},
+	}
+	for _, tt := range tests {
+		header := make(http.Header)
+		if tt.tunnelKey != "" {
+			header.Set("X-Tunnel-Key", tt.tunnelKey)
+		}
+		m, err := rr.Match(tt.spec, header)
+		if err != nil {
+			t.Fatalf("Match(%q) failed: %v", tt.spec, err)
+		}
+		if m.Key != tt.key || m.KeySource != tt.source {
+			t.Errorf("Match(%q) = %q (%s), want %q (%s)", tt.spec, m.Key, m.KeySource, tt.key, tt.source)
+		}
+	}
+}
+
+func TestRouteResolverMatch(t *testing.T) {
+	rr := NewRouteResolver(&config.Config{
+		AdminToken:         "secret",
+		RegistrationListen: "10.0.0.1:8443",
+		Keys: map[string]*config.KeyConfig{
+			"default": {
+				Idempotency: &config.IdempotencyConfig{Paths: []string{"/api/pay"}},
+				Transforms: []*config.TransformConfig{
+					{Type: "replace", From: "a", To: "b", PathPrefix: "/api/"},
+					{Type: "replace", From: "c", To: "d", PathPrefix: "/static/"},
+				},
+			},
+		},
+	})
+
+	m, err := rr.Match("post https://example.com/api/pay/1", nil)
+	if err != nil {
+		t.Fatalf("Match failed: %v", err)
+	}
+	if m.Method != "POST" || m.Key != "default" || !m.Idempotent || len(m.Transforms) != 1 {
+		t.Errorf("Unexpected match %+v", m)
+	}
+
+	// 非公网入口不确定key
+	for spec, entry := range map[string]string{
+		"GET https://example.com/admin/tunnels": routeEntryAdmin,
+		"GET https://example.com/ws/app":        routeEntryRegistration,
+		"GET https://example.com/proxy/a:80/":   routeEntryPathProxy,
+	} {
+		m, _ := rr.Match(spec, nil)
+		if m.Entry != entry || m.Key != "" {
+			t.Errorf("Match(%q) = %s %q, want entry %s", spec, m.Entry, m.Key, entry)
+		}
+	}
+
+	if _, err := rr.Match("GET /relative", nil); err == nil {
+		t.Error("Expected error for a URL without host")
+	}
+
+	// 配置了注册专用地址时主端口不接受注册
+	table := rr.Table()
+	if len(table.Listeners) != 2 || len(table.Listeners[1].Roles) != 1 {
+		t.Fatalf("Expected dedicated registration listener, got %+v", table.Listeners)
+	}
+	for _, role := range table.Listeners[0].Roles {
+		if role == routeEntryRegistration {
+			t.Errorf("Expected main listener without registration role, got %v", table.Listeners[0].Roles)
+		}
+	}
+}
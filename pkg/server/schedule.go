@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/schedule"
+)
+
+// headerNextOpen 开放时段外的响应中下一次开放的时间 (RFC3339)
+const headerNextOpen = "X-Next-Open"
+
+var scheduleClosedCounter = metrics.NewCounterVec("singleproxy_server_schedule_closed_requests_total",
+	"Public requests turned away outside the key's schedule windows, by key", "key")
+
+// keySchedule 单个key的开放时间
+type keySchedule struct {
+	schedule     *schedule.Schedule
+	affectsReady bool
+}
+
+// schedules 每个key的开放时间，可通过 POST /admin/schedules/reload 从配置文件重新加载
+type schedules struct {
+	mu    sync.RWMutex
+	byKey map[string]*keySchedule
+}
+
+// parseSchedules 解析所有key的开放时间，任一key不合法时返回错误
+func parseSchedules(keys map[string]*config.KeyConfig) (map[string]*keySchedule, error) {
+	byKey := make(map[string]*keySchedule)
+	for key, kc := range keys {
+		if kc == nil || kc.Schedule == nil {
+			continue
+		}
+		s, err := schedule.Parse(kc.Schedule.Windows, kc.Schedule.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("keys.%s.schedule: %v", key, err)
+		}
+		byKey[key] = &keySchedule{schedule: s, affectsReady: kc.Schedule.AffectsReady}
+	}
+	return byKey, nil
+}
+
+func newSchedules(keys map[string]*config.KeyConfig) *schedules {
+	byKey, err := parseSchedules(keys)
+	if err != nil {
+		// 配置已通过验证，这里只在绕过验证构造服务器时出现
+		logger.Error("Failed to parse key schedules, keys are always open", "error", err)
+		byKey = nil
+	}
+	return &schedules{byKey: byKey}
+}
+
+// get 返回key的开放时间，没有配置时返回 nil
+func (s *schedules) get(key string) *keySchedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byKey[key]
+}
+
+// replace 替换所有key的开放时间
+func (s *schedules) replace(byKey map[string]*keySchedule) {
+	s.mu.Lock()
+	s.byKey = byKey
+	s.mu.Unlock()
+}
+
+// snapshot 返回当前所有key的开放时间
+func (s *schedules) snapshot() map[string]*keySchedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	byKey := make(map[string]*keySchedule, len(s.byKey))
+	for key, ks := range s.byKey {
+		byKey[key] = ks
+	}
+	return byKey
+}
+
+// serveScheduleClosed 请求不在key的开放时段内时以503回应，在时段内或未配置时返回 false。
+// 页面使用该key的离线页面文件，未配置时使用维护页面；只接受JSON的API调用方收到JSON错误
+func (p *SinglePortProxy) serveScheduleClosed(w http.ResponseWriter, r *http.Request, key string) bool {
+	ks := p.schedules.get(key)
+	if ks == nil {
+		return false
+	}
+	now := time.Now()
+	if ks.schedule.Open(now) {
+		return false
+	}
+	scheduleClosedCounter.WithLabelValue(key).Inc()
+	p.markProxyError(w, proxyErrScheduleClosed)
+	w.Header().Set("Cache-Control", "no-store")
+	var retryAfter int
+	nextOpen, ok := ks.schedule.NextOpen(now)
+	if ok {
+		retryAfter = max(1, int(nextOpen.Sub(now).Round(time.Second)/time.Second))
+		w.Header().Set(headerNextOpen, nextOpen.In(ks.schedule.Location()).Format(time.RFC3339))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+
+	if wantsJSON(r) {
+		body := map[string]any{
+			"error":   "schedule_closed",
+			"message": "The service is closed outside its opening hours",
+			"key":     key,
+		}
+		if ok {
+			body["next_open"] = nextOpen.In(ks.schedule.Location()).Format(time.RFC3339)
+			body["retry_after"] = retryAfter
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(body)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method == http.MethodHead {
+		return true
+	}
+	if page := p.offlinePages.pages[key]; page != nil {
+		w.Write(page)
+		return true
+	}
+	w.Write(p.pausedPage)
+	return true
+}
+
+// closedReadyKeys 返回当前不在开放时段内的key，以及其中设置了 affects_ready 的key
+func (p *SinglePortProxy) closedReadyKeys(now time.Time) (closed, notReady []string) {
+	closed, notReady = []string{}, []string{}
+	for key, ks := range p.schedules.snapshot() {
+		if ks.schedule.Open(now) {
+			continue
+		}
+		closed = append(closed, key)
+		if ks.affectsReady {
+			notReady = append(notReady, key)
+		}
+	}
+	sort.Strings(closed)
+	sort.Strings(notReady)
+	return closed, notReady
+}
+
+// scheduleStatus 单个key在 /admin/schedules 中的状态
+type scheduleStatus struct {
+	Key          string     `json:"key"`
+	Timezone     string     `json:"timezone"`
+	Windows      string     `json:"windows"`
+	Open         bool       `json:"open"`
+	NextOpen     *time.Time `json:"next_open,omitempty"`
+	ClosesAt     *time.Time `json:"closes_at,omitempty"`
+	AffectsReady bool       `json:"affects_ready"`
+}
+
+// handleAdminSchedules 返回配置了开放时间的key当前是否开放，以及下一次开放或关闭的时间
+func (p *SinglePortProxy) handleAdminSchedules(w http.ResponseWriter, r *http.Request) {
+	principal := adminPrincipalFrom(r)
+	now := time.Now()
+	statuses := []scheduleStatus{}
+	for key, ks := range p.schedules.snapshot() {
+		if principal == nil || !principal.allows(key) {
+			continue
+		}
+		loc := ks.schedule.Location()
+		st := scheduleStatus{
+			Key:          key,
+			Timezone:     loc.String(),
+			Windows:      ks.schedule.String(),
+			Open:         ks.schedule.Open(now),
+			AffectsReady: ks.affectsReady,
+		}
+		if st.Open {
+			if closesAt, ok := ks.schedule.NextClose(now); ok {
+				closesAt = closesAt.In(loc)
+				st.ClosesAt = &closesAt
+			}
+		} else if nextOpen, ok := ks.schedule.NextOpen(now); ok {
+			nextOpen = nextOpen.In(loc)
+			st.NextOpen = &nextOpen
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Key < statuses[j].Key })
+	writeJSON(w, http.StatusOK, map[string]any{"schedules": statuses})
+}
+
+// handleAdminSchedulesReload 从配置文件重新读取所有key的开放时间，其他配置不变。
+// 任一key的开放时间不合法时保留原来的设置并返回422。作用于所有租户，只对完整权限开放
+func (p *SinglePortProxy) handleAdminSchedulesReload(w http.ResponseWriter, r *http.Request) {
+	if !requireFullAdmin(w, r) {
+		return
+	}
+	if p.config.ConfigFile == "" {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "server was not started with -config"})
+		return
+	}
+	fileConfig, err := config.LoadConfigFile(p.config.ConfigFile)
+	if err != nil {
+		logger.Error("Failed to reload key schedules", "file", p.config.ConfigFile, "error", err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	byKey, err := parseSchedules(fileConfig.Server.Keys)
+	if err != nil {
+		logger.Error("Failed to reload key schedules", "file", p.config.ConfigFile, "error", err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	p.schedules.replace(byKey)
+	logger.Info("Key schedules reloaded", "file", p.config.ConfigFile, "schedules", len(byKey))
+	p.handleAdminSchedules(w, r)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// 错误率统计窗口：最近一分钟，按10秒分桶
+	requestWindowBuckets = 6
+	requestWindowBucket  = 10 * time.Second
+
+	defaultMaxErrorRate = 0.5
+	// minErrorRateSamples 窗口内请求数少于该值时不按错误率排除连接
+	minErrorRateSamples = 10
+)
+
+// requestWindow 连接最近一分钟处理的请求数和失败数
+type requestWindow struct {
+	mu      sync.Mutex
+	buckets [requestWindowBuckets]struct {
+		slot     int64 // 桶对应的时间片编号
+		requests int64
+		errors   int64
+	}
+}
+
+func windowSlot(now time.Time) int64 {
+	return now.UnixNano() / int64(requestWindowBucket)
+}
+
+// add 记录一个请求的结果
+func (w *requestWindow) add(now time.Time, failed bool) {
+	slot := windowSlot(now)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := &w.buckets[slot%requestWindowBuckets]
+	if b.slot != slot {
+		b.slot, b.requests, b.errors = slot, 0, 0
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+}
+
+// counts 返回窗口内的请求数和失败数
+func (w *requestWindow) counts(now time.Time) (requests, errors int64) {
+	slot := windowSlot(now)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, b := range w.buckets {
+		if slot-b.slot < requestWindowBuckets {
+			requests += b.requests
+			errors += b.errors
+		}
+	}
+	return requests, errors
+}
+
+// scheduler 在同一key的多个连接之间按权重分发请求 (平滑加权轮询)，
+// 跳过目标服务不可用或最近错误率过高的连接
+type scheduler struct {
+	weighted     bool
+	maxErrorRate float64
+	now          func() time.Time
+
+	mu      sync.Mutex
+	current map[*tunnelConn]int
+}
+
+func newScheduler(weighted bool, maxErrorRate float64) *scheduler {
+	if maxErrorRate <= 0 {
+		maxErrorRate = defaultMaxErrorRate
+	}
+	return &scheduler{
+		weighted:     weighted,
+		maxErrorRate: maxErrorRate,
+		now:          time.Now,
+		current:      make(map[*tunnelConn]int),
+	}
+}
+
+// weight 返回连接的配置权重，round_robin 模式下所有连接权重相同
+func (s *scheduler) weight(tc *tunnelConn) int {
+	if !s.weighted || tc.weight <= 0 {
+		return 1
+	}
+	return tc.weight
+}
+
+// effectiveWeight 返回连接当前实际参与分配的权重，被排除时为0
+func (s *scheduler) effectiveWeight(tc *tunnelConn) int {
+	if tc.targetDown.Load() {
+		return 0
+	}
+	if s.maxErrorRate < 1 {
+		requests, errors := tc.recent.counts(s.now())
+		if requests >= minErrorRateSamples && float64(errors)/float64(requests) > s.maxErrorRate {
+			return 0
+		}
+	}
+	return s.weight(tc)
+}
+
+// eligible 返回可分配流量的连接；全部被排除时返回所有连接，避免整个key不可用
+func (s *scheduler) eligible(conns []*tunnelConn) []*tunnelConn {
+	out := make([]*tunnelConn, 0, len(conns))
+	for _, tc := range conns {
+		if s.effectiveWeight(tc) > 0 {
+			out = append(out, tc)
+		}
+	}
+	if len(out) == 0 {
+		return conns
+	}
+	return out
+}
+
+// pick 从连接中按有效权重选择一个
+func (s *scheduler) pick(conns []*tunnelConn) *tunnelConn {
+	candidates := s.eligible(conns)
+	weights := make([]int, len(candidates))
+	total := 0
+	for i, tc := range candidates {
+		if weights[i] = s.effectiveWeight(tc); weights[i] == 0 {
+			weights[i] = s.weight(tc) // 全部被排除时按配置权重分配
+		}
+		total += weights[i]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *tunnelConn
+	for i, tc := range candidates {
+		s.current[tc] += weights[i]
+		if best == nil || s.current[tc] > s.current[best] {
+			best = tc
+		}
+	}
+	s.current[best] -= total
+
+	// 清理已断开连接的状态
+	if len(s.current) > len(conns) {
+		present := make(map[*tunnelConn]bool, len(conns))
+		for _, tc := range conns {
+			present[tc] = true
+		}
+		for tc := range s.current {
+			if !present[tc] {
+				delete(s.current, tc)
+			}
+		}
+	}
+	return best
+}
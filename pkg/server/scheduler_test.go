@@ -0,0 +1,102 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func pickCounts(s *scheduler, conns []*tunnelConn, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[s.pick(conns).id]++
+	}
+	return counts
+}
+
+func TestSchedulerWeightedSplit(t *testing.T) {
+	a := &tunnelConn{id: "a", weight: 3}
+	b := &tunnelConn{id: "b", weight: 1}
+	conns := []*tunnelConn{a, b}
+
+	if counts := pickCounts(newScheduler(true, 0), conns, 400); counts["a"] != 300 || counts["b"] != 100 {
+		t.Errorf("Expected 3:1 split, got %v", counts)
+	}
+	// round_robin 忽略权重
+	if counts := pickCounts(newScheduler(false, 0), conns, 400); counts["a"] != 200 || counts["b"] != 200 {
+		t.Errorf("Expected even split, got %v", counts)
+	}
+
+	// 平滑加权：高权重的连接不会连续占满
+	s := newScheduler(true, 0)
+	var seq string
+	for i := 0; i < 4; i++ {
+		seq += s.pick(conns).id
+	}
+	if seq != "aaba" {
+		t.Errorf("Expected smooth sequence aaba, got %s", seq)
+	}
+}
+
+func TestSchedulerSkipsUnhealthy(t *testing.T) {
+	a := &tunnelConn{id: "a"}
+	b := &tunnelConn{id: "b"}
+	conns := []*tunnelConn{a, b}
+	s := newScheduler(true, 0)
+
+	b.targetDown.Store(true)
+	if counts := pickCounts(s, conns, 10); counts["a"] != 10 {
+		t.Errorf("Expected down connection to be skipped, got %v", counts)
+	}
+	if got := s.eligible(conns); len(got) != 1 || got[0] != a {
+		t.Errorf("Expected only a to be eligible, got %d connections", len(got))
+	}
+
+	// 全部不可用时仍然分配流量
+	a.targetDown.Store(true)
+	if counts := pickCounts(s, conns, 10); counts["a"] != 5 || counts["b"] != 5 {
+		t.Errorf("Expected fail-open split, got %v", counts)
+	}
+}
+
+func TestSchedulerErrorRate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := &tunnelConn{id: "a"}
+	b := &tunnelConn{id: "b"}
+	conns := []*tunnelConn{a, b}
+	s := newScheduler(true, 0.5)
+	s.now = func() time.Time { return now }
+
+	// 样本不足时不排除
+	for i := 0; i < minErrorRateSamples-1; i++ {
+		b.recent.add(now, true)
+	}
+	if s.effectiveWeight(b) == 0 {
+		t.Fatal("Expected connection with too few samples to stay eligible")
+	}
+	b.recent.add(now, true)
+	if s.effectiveWeight(b) != 0 {
+		t.Fatal("Expected connection over the error rate to be excluded")
+	}
+	if counts := pickCounts(s, conns, 6); counts["a"] != 6 {
+		t.Errorf("Expected failing connection to be skipped, got %v", counts)
+	}
+
+	// 窗口过期后恢复
+	now = now.Add(requestWindowBuckets * requestWindowBucket)
+	if requests, _ := b.recent.counts(now); requests != 0 {
+		t.Errorf("Expected window to expire, got %d requests", requests)
+	}
+	if s.effectiveWeight(b) != 1 {
+		t.Errorf("Expected connection to recover after the window, got weight %d", s.effectiveWeight(b))
+	}
+
+	// max_error_rate 为1时不按错误率排除
+	s = newScheduler(true, 1)
+	s.now = func() time.Time { return now }
+	for i := 0; i < minErrorRateSamples; i++ {
+		a.recent.add(now, true)
+	}
+	if s.effectiveWeight(a) != 1 {
+		t.Errorf("Expected error rate check to be disabled")
+	}
+}
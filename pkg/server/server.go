@@ -2,12 +2,20 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"singleproxy/pkg/config"
@@ -20,16 +28,9 @@ import (
 	"golang.org/x/time/rate"
 )
 
-// streamHandler 用于处理一个流式响应
-type streamHandler struct {
-	writer  http.ResponseWriter
-	flusher http.Flusher
-	done    chan struct{}
-}
-
 // SinglePortProxy 是服务器端组件
 type SinglePortProxy struct {
-	clientConns    map[string]*websocket.Conn
+	clientConns    map[string]*tunnelPool
 	connsMu        sync.RWMutex
 	streamHandlers map[uint64]*streamHandler
 	handlersMu     sync.Mutex
@@ -49,71 +50,358 @@ type SinglePortProxy struct {
 
 	// HTTP长轮询隧道管理器
 	httpTunnelMgr *httpTunnelManager
+
+	// 客户端申请的动态公网绑定
+	bindings *bindingManager
+
+	// 服务器分配的自动key
+	autoKeys *autoKeyRegistry
+
+	// 管理API路由
+	adminMux *http.ServeMux
+
+	// 按key开启的调试抓包
+	captures *captureManager
+
+	// 隧道key语法校验
+	keyValidator *protocol.KeyValidator
+
+	// 经隧道转发的请求头部限制
+	headerLimits protocol.HeaderLimits
+
+	// 正向代理与SOCKS5的目标地址策略
+	destPolicy *destinationPolicy
+
+	// 每个key的注册频率限制
+	registrations *registrationLimiter
+
+	// 注册入口的监听器角色与来源网段限制
+	registrationAccess *registrationAccess
+
+	// 管理API令牌及其权限范围
+	adminPrincipals []*adminPrincipal
+
+	// 每个key的请求体/响应体改写规则
+	transforms *transformRegistry
+
+	// 每个key在隧道离线时返回的页面
+	offlinePages *offlinePages
+	schedules    *schedules // 每个key的开放时间
+
+	// 每个key按天汇总的用量
+	usage *usageRecorder
+
+	// 每个key最近一小时内最大的响应
+	topResponses *topResponses
+
+	// 隧道离线时转发的备用地址，只包含配置了 fallback_upstream 的key
+	fallbacks map[string]*fallbackUpstream
+
+	// 按key分开的访问日志文件和最近的访问记录
+	accessLogs *accessLogs
+
+	// 按 Idempotency-Key 保存的响应，只包含配置了 idempotency 的key
+	idempotency map[string]*idempotencyStore
+	// 正在转发的 GET/HEAD 请求，只包含配置了 coalesce 的key
+	coalescers map[string]*requestCoalescer
+
+	// 等待客户端返回的目标服务检查
+	targetChecks *targetCheckRegistry
+
+	// 会话保持cookie的签名密钥，每次启动随机生成
+	affinitySecret []byte
+
+	// 实例ID，转发请求时写入 X-SingleProxy-Hop 用于检测代理环路，每次启动随机生成
+	instanceID string
+	startedAt  time.Time
+
+	// 主监听器，Stop 时关闭以结束 Start 的接受循环
+	listener   net.Listener
+	listenerMu sync.Mutex
+	stopping   atomic.Bool
+
+	// 注册专用监听器 (未配置时为nil)，由 listenerMu 保护
+	registrationListener net.Listener
+
+	// 主监听器的TLS配置 (未启用TLS时为nil)，端口绑定复用该配置
+	tlsConfig *tls.Config
+	certs     *certStore // 按SNI选择的证书 (未启用TLS时为nil)
+
+	tlsFingerprintDeny map[string]bool // 拒绝握手的 JA3 指纹
+	trustedProxies     []*net.IPNet    // 在前面终止TLS的反向代理，信任其传入的协议和客户端证书头部
+
+	// 按路径选择入口、按主机名和默认key确定隧道key的路由规则
+	routes *RouteResolver
+
+	// 未指定key的公网请求按来源IP限频的日志
+	defaultRoutes *defaultRouteLog
+
+	// 公网请求的key、主机名和路径写入日志字段和指标标签前的归一化
+	logFields *logFieldPolicy
+
+	// 隧道注册入口的路径前缀: WebSocket 和与其同级的 HTTP 长轮询
+	wsPathPrefix       string
+	longPollPathPrefix string
+
+	// 内存看门狗 (未配置时为nil)
+	watchdog *watchdog
+
+	// 各监听器已接受且未关闭的连接数，近似文件描述符用量
+	conns *connTracker
+
+	// 已从隧道读入、尚未写给公网调用方的响应数据
+	frames *frameBudget
+
+	// 流量模式为 paused 时公网请求直接返回暂停页面，隧道照常注册和保活
+	trafficPaused atomic.Bool
+	pausedPage    []byte
+
+	// 屡次超过速率限制的IP的拖延器 (未配置 -tarpit-delay 时为nil)
+	tarpit *tarpit
+
+	// 迁移期间被拒绝注册的key
+	drains *drainState
+
+	// 服务器之间的 key→服务器 映射 (未配置 -cluster-token 时为nil)
+	cluster *cluster
 }
 
 // NewSinglePortProxy 创建一个新的服务器实例
 func NewSinglePortProxy(cfg *config.Config) *SinglePortProxy {
+	destPolicy, err := newDestinationPolicy(cfg.ProxyAllowCIDRs)
+	if err != nil {
+		logger.Error("Invalid proxy allow CIDRs, ignoring allowlist",
+			"proxy_allow_cidrs", cfg.ProxyAllowCIDRs,
+			"error", err)
+		destPolicy, _ = newDestinationPolicy(nil)
+	}
+
 	// 创建SOCKS5服务器配置
 	socksConf := &socks5.Config{
 		// 不需要认证
 		AuthMethods: []socks5.Authenticator{
 			&socks5.NoAuthAuthenticator{},
 		},
+		// 目标地址策略：经DNS缓存解析后由规则检查，拨号时再次检查
+		Rules:    destPolicy,
+		Resolver: destPolicy,
+		Dial:     destPolicy.DialContext,
 	}
 	socksServer, _ := socks5.New(socksConf)
 
-	return &SinglePortProxy{
-		clientConns:    make(map[string]*websocket.Conn),
+	keyValidator, err := protocol.NewKeyValidator(cfg.KeyPattern)
+	if err != nil {
+		logger.Error("Invalid key pattern, falling back to default",
+			"key_pattern", cfg.KeyPattern,
+			"error", err)
+		keyValidator, _ = protocol.NewKeyValidator("")
+	}
+
+	// 超出范围的 -max-frame-size 会被限制到支持的范围内，提示实际使用的值
+	if n := cfg.MaxFrameSize; n > 0 && protocol.ClampFrameSize(n) != n {
+		logger.Warn("Configured max frame size is outside the supported range, using the nearest supported value",
+			"max_frame_size", n,
+			"effective_max_frame_size", protocol.ClampFrameSize(n),
+			"min_frame_size", protocol.MinFrameSize,
+			"max_frame_size_limit", protocol.MaxFrameSizeLimit)
+	}
+
+	p := &SinglePortProxy{
+		clientConns:    make(map[string]*tunnelPool),
 		streamHandlers: make(map[uint64]*streamHandler),
 		config:         cfg,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
+			CheckOrigin:     newOriginChecker(cfg.WSAllowedOrigins),
+			ReadBufferSize:  cfg.WSReadBufferSize,
+			WriteBufferSize: cfg.WSWriteBufferSize,
 		},
 		keyLimiters:   make(map[string]*rate.Limiter),
 		ipLimiters:    make(map[string]*rate.Limiter),
 		socksServer:   socksServer,
 		httpTunnelMgr: newHTTPTunnelManager(),
+		bindings:      newBindingManager(),
+		autoKeys:      newAutoKeyRegistry(),
+		captures:      newCaptureManager(),
+		keyValidator:  keyValidator,
+		headerLimits:  protocol.NewHeaderLimits(cfg.MaxHeaderCount, cfg.MaxHeaderFieldBytes, cfg.MaxHeaderBytes),
+		destPolicy:    destPolicy,
+		registrations: newRegistrationLimiter(cfg.RegistrationRate, cfg.RegistrationBurst),
+
+		registrationAccess: newRegistrationAccess(cfg),
+
+		adminPrincipals: newAdminPrincipals(cfg),
+		transforms:      newTransformRegistry(cfg.Keys),
+		offlinePages:    newOfflinePages(cfg.Keys),
+		schedules:       newSchedules(cfg.Keys),
+		routes:          NewRouteResolver(cfg),
+		defaultRoutes:   newDefaultRouteLog(),
+		logFields:       newLogFieldPolicy(cfg),
+		usage:           newUsageRecorder(cfg.UsageFile, cfg.UsageRetentionDays),
+		topResponses:    newTopResponses(cfg.TopResponses),
+		fallbacks:       newFallbackUpstreams(cfg.Keys),
+		idempotency:     newIdempotencyStores(cfg.Keys),
+		coalescers:      newRequestCoalescers(cfg.Keys),
+		accessLogs:      newAccessLogs(cfg),
+		targetChecks:    newTargetCheckRegistry(),
+		affinitySecret:  make([]byte, 32),
+		instanceID:      protocol.NewInstanceID(),
+		startedAt:       time.Now(),
+
+		tlsFingerprintDeny: newTLSFingerprintDeny(cfg.TLSFingerprintDeny),
+		trustedProxies:     newTrustedProxies(cfg),
+	}
+	p.wsPathPrefix, p.longPollPathPrefix = cfg.TunnelPathPrefixes()
+	p.routes.bindings = p.bindings
+	if _, err := rand.Read(p.affinitySecret); err != nil {
+		logger.Error("Failed to generate affinity secret", "error", err)
+	}
+	p.adminMux = p.newAdminMux()
+	p.conns = newFDConnTracker(cfg)
+	p.frames = newFrameBudget(cfg.MaxBufferedFrameBytes)
+	p.pausedPage = newPausedPage(cfg.PausedPage)
+	if cfg.TrafficMode == trafficPaused {
+		p.setTrafficMode(trafficPaused)
 	}
+	p.tarpit = newTarpit(cfg)
+	p.drains = newDrainState()
+	p.cluster = newCluster(cfg)
+	p.watchdog = newWatchdog(cfg.Watchdog, p.watchdogSample)
+	return p
 }
 
+// Start 因以下原因失败时返回的错误包装了对应的哨兵错误，调用方据此区分进程退出码
+var (
+	// ErrListen 无法监听主端口或注册地址 (端口被占用、权限不足等)
+	ErrListen = errors.New("failed to listen")
+	// ErrTLS 无法加载TLS证书
+	ErrTLS = errors.New("failed to set up TLS")
+)
+
 // Start 启动服务器
 func (p *SinglePortProxy) Start() error {
 	var listener net.Listener
 	var err error
 
-	if p.config.CertFile != "" && p.config.KeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(p.config.CertFile, p.config.KeyFile)
+	if p.config.TLSEnabled() {
+		certs, err := newCertStore(p.config)
 		if err != nil {
-			return fmt.Errorf("failed to load TLS certificate: %v", err)
+			return fmt.Errorf("%w: %v", ErrTLS, err)
 		}
-		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-		listener, err = tls.Listen("tcp", ":"+p.config.ListenPort, tlsConfig)
+		p.certs = certs
+		p.tlsConfig = &tls.Config{GetCertificate: certs.getCertificate, GetConfigForClient: p.inspectClientHello}
+		if p.config.TLSClientCA != "" {
+			pool, err := loadClientCAs(p.config.TLSClientCA)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrTLS, err)
+			}
+			// 只验证客户端主动提供的证书，浏览器和隧道客户端不带证书时照常访问
+			p.tlsConfig.ClientCAs = pool
+			p.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		listener, err = net.Listen("tcp", ":"+p.config.ListenPort)
 		if err != nil {
-			return fmt.Errorf("failed to listen on port %s: %v", p.config.ListenPort, err)
+			return fmt.Errorf("%w on port %s: %v", ErrListen, p.config.ListenPort, err)
 		}
-		logger.Info("Server listening with TLS", "port", p.config.ListenPort)
+		listener = p.newTLSListener(listener)
+		logger.Info("Server listening with TLS",
+			"port", p.config.ListenPort,
+			"certificates", len(certs.list()),
+			"unknown_sni", p.config.TLSUnknownSNI,
+			"tls_fingerprint_deny", len(p.tlsFingerprintDeny))
 	} else {
 		listener, err = net.Listen("tcp", ":"+p.config.ListenPort)
 		if err != nil {
-			return fmt.Errorf("failed to listen on port %s: %v", p.config.ListenPort, err)
+			return fmt.Errorf("%w on port %s: %v", ErrListen, p.config.ListenPort, err)
 		}
 		logger.Info("Server listening without TLS", "port", p.config.ListenPort)
+		if len(p.tlsFingerprintDeny) > 0 {
+			logger.Warn("TLS fingerprint deny list has no effect when TLS is terminated upstream",
+				"tls_fingerprint_deny", len(p.tlsFingerprintDeny))
+		}
+		if p.config.TLSClientCA != "" {
+			logger.Warn("TLS client CA has no effect when TLS is terminated upstream, pass client certificates from a trusted proxy instead",
+				"tls_client_ca", p.config.TLSClientCA)
+		}
 	}
 
-	logger.Info("Server supports: HTTP/WebSocket tunneling and SOCKS5 proxy")
+	logger.Info("Server supports: HTTP/WebSocket tunneling and SOCKS5 proxy", "instance_id", p.instanceID)
 
-	for {
-		conn, err := listener.Accept()
+	var regListener net.Listener
+	if p.config.RegistrationListen != "" {
+		regListener, err = p.listenRegistration()
 		if err != nil {
-			logger.Error("Failed to accept connection",
-				"remote_addr", conn.RemoteAddr().String(),
-				"error", err)
-			continue
+			listener.Close()
+			return fmt.Errorf("%w on registration address %s: %v", ErrListen, p.config.RegistrationListen, err)
 		}
+		go p.serveRegistration(regListener)
+	}
+
+	p.listenerMu.Lock()
+	p.listener = listener
+	p.registrationListener = regListener
+	p.listenerMu.Unlock()
+	if p.stopping.Load() {
+		listener.Close()
+		if regListener != nil {
+			regListener.Close()
+		}
+	}
 
-		// 为每个连接启动一个协程处理协议检测
-		go p.handleConnection(conn)
+	return p.serve(listener)
+}
+
+// Stop 停止接受新连接，并通知所有隧道客户端服务器即将关闭 (1001 Going Away)。
+// 设置了 -drain-on-stop 时先向客户端发送迁移通知，等待进行中的请求完成或超时后再关闭。
+// 隧道关闭后其端口绑定随之释放，Start 随后返回 nil
+func (p *SinglePortProxy) Stop() error {
+	if p.stopping.Swap(true) {
+		return nil
+	}
+	logger.Info("Stopping server", "port", p.config.ListenPort)
+
+	p.listenerMu.Lock()
+	listener, regListener := p.listener, p.registrationListener
+	p.listenerMu.Unlock()
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	if regListener != nil {
+		regListener.Close()
+	}
+
+	if grace := p.config.DrainOnStop; grace > 0 {
+		p.drainTunnels(func(string) bool { return true },
+			protocol.GoAway{GraceMs: grace.Milliseconds(), Reason: protocol.GoAwayReasonServerShutdown})
+		p.waitForStreams(grace)
+	}
+
+	// 通知客户端进行中的请求将被中止
+	p.handlersMu.Lock()
+	pending := make(map[uint64]*streamHandler, len(p.streamHandlers))
+	for id, handler := range p.streamHandlers {
+		pending[id] = handler
 	}
+	p.handlersMu.Unlock()
+	for id, handler := range pending {
+		handler.notifyCancel(id, protocol.CancelReasonServerShutdown)
+	}
+
+	for _, tc := range p.allTunnels() {
+		// 取消通知在写入队列中，先写出再发送关闭帧
+		tc.flush(time.Second)
+		_ = tc.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, protocol.CloseReasonServerShutdown),
+			time.Now().Add(time.Second))
+		tc.conn.Close()
+	}
+
+	// 写入尚未持久化的用量
+	p.usage.close()
+	p.accessLogs.close()
+	p.watchdog.close()
+	p.cluster.close()
+	return err
 }
 
 // handleConnection 检测连接协议类型并分发处理
@@ -134,6 +422,11 @@ func (p *SinglePortProxy) handleConnection(conn net.Conn) {
 	}
 
 	n, err := conn.Read(buf)
+	if errors.Is(err, errTLSFingerprintDenied) {
+		// 已在握手时记录
+		conn.Close()
+		return
+	}
 	if err != nil {
 		logger.Error("Failed to read protocol bytes",
 			"remote_addr", remoteAddr,
@@ -167,6 +460,10 @@ func (p *SinglePortProxy) handleConnection(conn net.Conn) {
 			"remote_addr", remoteAddr,
 			"version", fmt.Sprintf("0x%02x", actualBuf[0]))
 
+		if p.refusePausedSOCKS(conn) {
+			return
+		}
+
 		// 创建一个可以回放所有字节的连接包装器
 		wrappedConn := &prefixedConn{
 			Conn:   conn,
@@ -217,12 +514,12 @@ func (p *SinglePortProxy) handleConnection(conn net.Conn) {
 		}
 
 		// 直接处理HTTP连接，而不是通过HTTP服务器
-		p.handleHTTPConnection(wrappedConn)
+		p.handleHTTPConnection(wrappedConn, p)
 	}
 }
 
-// handleHTTPConnection 直接处理HTTP连接（包括WebSocket升级）
-func (p *SinglePortProxy) handleHTTPConnection(conn net.Conn) {
+// handleHTTPConnection 直接处理HTTP连接（包括WebSocket升级），请求交给handler处理
+func (p *SinglePortProxy) handleHTTPConnection(conn net.Conn, handler http.Handler) {
 	remoteAddr := conn.RemoteAddr().String()
 
 	logger.Debug("Handling HTTP connection",
@@ -232,6 +529,10 @@ func (p *SinglePortProxy) handleHTTPConnection(conn net.Conn) {
 	// 读取HTTP请求
 	reader := bufio.NewReader(conn)
 	req, err := http.ReadRequest(reader)
+	if errors.Is(err, errTLSFingerprintDenied) {
+		conn.Close()
+		return
+	}
 	if err != nil {
 		logger.Error("Failed to read HTTP request",
 			"remote_addr", remoteAddr,
@@ -243,7 +544,7 @@ func (p *SinglePortProxy) handleHTTPConnection(conn net.Conn) {
 	logger.Debug("Successfully read HTTP request",
 		"remote_addr", remoteAddr,
 		"method", req.Method,
-		"url", req.URL.String(),
+		"url", utils.SanitizeURL(req.URL),
 		"proto", req.Proto,
 		"host", req.Host,
 		"user_agent", req.Header.Get("User-Agent"),
@@ -259,21 +560,39 @@ func (p *SinglePortProxy) handleHTTPConnection(conn net.Conn) {
 	// 创建响应写入器
 	w := &httpResponseWriter{
 		conn:   conn,
+		reader: reader,
 		header: make(http.Header),
 	}
 
 	logger.Debug("Created HTTP response writer",
 		"remote_addr", remoteAddr)
 
+	// TLS在本服务器终止时，握手记录的客户端指纹随请求进入访问日志，
+	// 连接状态 (包括客户端证书) 与 net/http 服务器一样放入 req.TLS
+	if fp := tlsFingerprintOf(conn); fp != "" {
+		req = withTLSFingerprint(req, fp)
+	}
+	req.TLS = tlsStateOf(conn)
+
 	// 调用我们的HTTP处理器
 	startTime := time.Now()
-	p.ServeHTTP(w, req)
+	handler.ServeHTTP(w, req)
 	duration := time.Since(startTime)
+	// 之后仍在写入的 streamHandler 不能再向连接写数据
+	w.finish()
+
+	if !w.hijacked && reader.Buffered() > 0 {
+		// 客户端在响应完成前发送了下一个请求，连接只处理一个请求，由客户端按 Connection: close 重发
+		pipelinedRequestsCounter.Inc()
+		logger.Debug("Discarding pipelined request data, connection serves one request",
+			"remote_addr", remoteAddr,
+			"buffered_bytes", reader.Buffered())
+	}
 
 	logger.Debug("HTTP request processing completed",
 		"remote_addr", remoteAddr,
 		"method", req.Method,
-		"url", req.URL.String(),
+		"url", utils.SanitizeURL(req.URL),
 		"duration", duration,
 		"hijacked", w.hijacked)
 
@@ -291,59 +610,73 @@ func (p *SinglePortProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// 记录所有HTTP请求的debug信息
 	logger.Debug("Received HTTP request",
 		"method", r.Method,
-		"url", r.URL.String(),
+		"url", utils.SanitizeURL(r.URL),
 		"remote_addr", r.RemoteAddr,
 		"user_agent", r.Header.Get("User-Agent"),
 		"content_length", r.ContentLength,
-		"headers", utils.SanitizeHeaders(r.Header))
+		"headers", utils.LazyHeaders(r.Header))
+
+	if rejectMalformedTarget(w, r) {
+		return
+	}
 
-	// 路由1: 处理来自内网客户端的 WebSocket 隧道连接
-	// 支持任意路径下的 /ws/ 端点，例如：/ws/key 或 /path/ws/key
-	if strings.Contains(r.URL.Path, "/ws/") && strings.HasSuffix(r.URL.Path, strings.Split(r.URL.Path, "/ws/")[1]) {
+	// CONNECT 的请求目标是 host:port 而不是路径，作为正向代理处理，不参与路由
+	if r.Method == http.MethodConnect {
+		p.handleConnectProxy(w, r)
+		return
+	}
+
+	// 按路径选择入口，分派顺序见 RouteResolver.entry
+	switch p.routes.entry(r.URL.Path) {
+	case routeEntryAdmin:
+		// 路由0: 管理API (仅在配置了管理令牌时启用)
+		p.handleAdmin(w, r)
+
+	case routeEntryRegistration:
+		// 路由1: 处理来自内网客户端的 WebSocket 隧道连接
+		// 注册入口位于 -ws-path-prefix 下，例如默认的 /ws/key 或 /tunnel/ws/key
 		logger.Debug("Routing to tunnel registration handler",
 			"path", r.URL.Path,
 			"remote_addr", r.RemoteAddr)
 		p.handleTunnelRegistration(w, r)
-		return
-	}
 
-	// 路由1.5: 处理HTTP长轮询模式的隧道连接
-	if strings.HasPrefix(r.URL.Path, "/http-tunnel/") {
+	case routeEntryLongPoll:
+		// 路由1.5: 处理HTTP长轮询模式的隧道连接
 		logger.Debug("Routing to HTTP tunnel handler",
 			"path", r.URL.Path,
 			"method", r.Method,
 			"remote_addr", r.RemoteAddr)
 		p.handleHTTPTunnel(w, r)
-		return
-	}
 
-	// 路由2: 处理基于路径的HTTP代理请求
-	if strings.HasPrefix(r.URL.Path, "/proxy/") {
+	case routeEntryCluster:
+		// 路由1.6: 集群中其他服务器拉取key列表
+		p.handleCluster(w, r)
+
+	case routeEntryPathProxy:
+		// 路由2: 处理基于路径的HTTP代理请求
 		logger.Debug("Routing to HTTP path proxy handler",
 			"path", r.URL.Path,
 			"remote_addr", r.RemoteAddr)
 		p.handleHTTPProxy(w, r)
-		return
-	}
 
-	// 路由3: 处理来自公网的普通 HTTP 请求 (内网穿透)
-	logger.Debug("Routing to public HTTP request handler",
-		"path", r.URL.Path,
-		"remote_addr", r.RemoteAddr)
-	p.handlePublicHTTPRequest(w, r)
+	default:
+		// 路由3: 处理来自公网的普通 HTTP 请求 (内网穿透)
+		logger.Debug("Routing to public HTTP request handler",
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr)
+		p.handlePublicHTTPRequest(w, r)
+	}
 }
 
 // handleTunnelRegistration 处理内网客户端的隧道注册请求
 func (p *SinglePortProxy) handleTunnelRegistration(w http.ResponseWriter, r *http.Request) {
-	// 从路径中提取密钥，支持 /ws/key 或 /path/ws/key 格式
-	var key string
-	if idx := strings.Index(r.URL.Path, "/ws/"); idx >= 0 {
-		key = r.URL.Path[idx+4:] // 跳过 "/ws/" 部分
-	} else {
-		// 如果没有找到 /ws/ 前缀，使用旧的逻辑作为备用
-		key = strings.TrimPrefix(r.URL.Path, "/ws/")
+	if !p.checkRegistrationAccess(w, r) {
+		return
 	}
 
+	// 注册入口前缀之后的部分是密钥
+	key := strings.TrimPrefix(r.URL.Path, p.wsPathPrefix)
+
 	remoteAddr := r.RemoteAddr
 
 	logger.Debug("Processing tunnel registration request",
@@ -351,7 +684,36 @@ func (p *SinglePortProxy) handleTunnelRegistration(w http.ResponseWriter, r *htt
 		"full_path", r.URL.Path,
 		"remote_addr", remoteAddr,
 		"user_agent", r.Header.Get("User-Agent"),
-		"headers", utils.SanitizeHeaders(r.Header))
+		"headers", utils.LazyHeaders(r.Header))
+
+	// 空key且带 auto_key=1 时由服务器分配key
+	var keyExpires time.Time
+	if key == "" && r.URL.Query().Get(protocol.QueryAutoKey) == "1" {
+		generated, expiresAt, err := p.generateAutoKey()
+		if err != nil {
+			logger.Error("Failed to allocate auto key",
+				"remote_addr", remoteAddr,
+				"error", err)
+			http.Error(w, "Failed to allocate tunnel key", http.StatusServiceUnavailable)
+			return
+		}
+		key, keyExpires = generated, expiresAt
+		logger.Info("Allocated auto key",
+			"key", key,
+			"remote_addr", remoteAddr,
+			"expires_at", keyExpires)
+	} else if expiresAt, ok := p.autoKeys.lookup(key); ok {
+		// 使用已分配的自动key重连，沿用原有效期
+		if time.Now().After(expiresAt) {
+			logger.Warn("Tunnel registration failed - auto key expired",
+				"key", key,
+				"remote_addr", remoteAddr,
+				"expired_at", expiresAt)
+			http.Error(w, "Tunnel key expired", http.StatusGone)
+			return
+		}
+		keyExpires = expiresAt
+	}
 
 	if key == "" {
 		logger.Warn("Tunnel registration failed - empty key",
@@ -360,12 +722,96 @@ func (p *SinglePortProxy) handleTunnelRegistration(w http.ResponseWriter, r *htt
 		http.Error(w, "Tunnel key cannot be empty", http.StatusBadRequest)
 		return
 	}
+	if err := p.keyValidator.Validate(key); err != nil {
+		logger.Warn("Tunnel registration failed - invalid key",
+			"remote_addr", remoteAddr,
+			"key_length", len(key),
+			"error", err)
+		http.Error(w, "Invalid tunnel key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.tunnelKeyLimitReached(key) {
+		tunnelKeyLimitCounter.Inc()
+		logger.Warn("Tunnel registration failed - tunnel key limit reached",
+			"key", p.logKey(key),
+			"remote_addr", remoteAddr,
+			"max_tunnel_keys", p.config.MaxTunnelKeys)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Tunnel key limit reached", http.StatusServiceUnavailable)
+		return
+	}
+	if p.refuseDrainingRegistration(w, key, remoteAddr) {
+		return
+	}
+	// 注册过于频繁时仍完成升级，再以 1013 关闭并在关闭原因中告知重试等待时间
+	registrationAllowed, retryAfter := p.registrations.allow(key)
 
 	logger.Info("Attempting to upgrade connection to WebSocket",
 		"key", key,
 		"remote_addr", remoteAddr)
 
-	wsConn, err := p.upgrader.Upgrade(w, r, nil)
+	respHeader := http.Header{}
+	respHeader.Set(protocol.HeaderTunnelKey, key)
+	// 升级响应默认不带 Date，客户端自检依赖它估算时钟偏差
+	respHeader.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if !keyExpires.IsZero() {
+		respHeader.Set(protocol.HeaderKeyExpires, keyExpires.Format(time.RFC3339))
+	}
+	if p.config.PublicBaseURL != "" {
+		respHeader.Set(protocol.HeaderPublicURL, p.config.PublicBaseURL)
+	}
+	if key == p.config.DefaultRouteKey() {
+		respHeader.Set(protocol.HeaderRoute, protocol.RouteDefault)
+	} else {
+		respHeader.Set(protocol.HeaderRoute, protocol.RouteHeader)
+	}
+	features := r.Header.Get(protocol.HeaderFeatures)
+	// 双方都配置了签名密钥时才启用，未声明支持的旧客户端仍以不签名的方式连接
+	messageAuth := p.config.MessageAuthKey != "" && protocol.HasFeature(features, protocol.FeatureMessageAuth)
+	// 支持计数器的客户端使用每条连接各自的随机数，旧客户端退回不防重放的 hmac-sha256
+	var authNonce []byte
+	if messageAuth && protocol.HasFeature(features, protocol.FeatureMessageAuthSeq) {
+		authNonce = protocol.NewMessageAuthNonce()
+		respHeader.Set(protocol.HeaderMessageAuth, protocol.MessageAuthHMACSHA256Seq)
+		respHeader.Set(protocol.HeaderMessageAuthNonce, hex.EncodeToString(authNonce))
+	} else if messageAuth {
+		respHeader.Set(protocol.HeaderMessageAuth, protocol.MessageAuthHMACSHA256)
+	}
+	var serverFeatures []string
+	chunkSeq := protocol.HasFeature(features, protocol.FeatureChunkSeq)
+	if chunkSeq {
+		serverFeatures = append(serverFeatures, protocol.FeatureChunkSeq)
+	}
+	// 服务器配置了表大小且客户端声明支持时启用请求头索引表，表大小取双方的较小值
+	headerTableSize := 0
+	if protocol.HasFeature(features, protocol.FeatureHeaderTable) {
+		headerTableSize = protocol.NegotiateHeaderTableSize(p.config.HeaderTableSize, r.Header.Get(protocol.HeaderHeaderTableSize))
+	}
+	if headerTableSize > 0 {
+		serverFeatures = append(serverFeatures, protocol.FeatureHeaderTable)
+		respHeader.Set(protocol.HeaderHeaderTableSize, strconv.Itoa(headerTableSize))
+	}
+	// 客户端配置了本地监听时确认接受它发起的请求，客户端在确认前不会发送 MSG_TYPE_LOCAL_REQ
+	localForward := protocol.HasFeature(features, protocol.FeatureLocalForward)
+	if localForward {
+		serverFeatures = append(serverFeatures, protocol.FeatureLocalForward)
+	}
+	// 客户端读取目标响应体失败时以 MSG_TYPE_CANCEL 中止响应，确认后才会发送
+	responseAbort := protocol.HasFeature(features, protocol.FeatureResponseAbort)
+	if responseAbort {
+		serverFeatures = append(serverFeatures, protocol.FeatureResponseAbort)
+	}
+	if len(serverFeatures) > 0 {
+		respHeader.Set(protocol.HeaderServerFeatures, strings.Join(serverFeatures, ","))
+	}
+	// 客户端声明了上限时返回协商结果，旧客户端不声明，双方仍按默认的 10MB
+	clientFrameSize := r.Header.Get(protocol.HeaderMaxFrameSize)
+	maxFrameSize := protocol.NegotiateFrameSize(p.config.MaxFrameSize, clientFrameSize)
+	if clientFrameSize != "" {
+		respHeader.Set(protocol.HeaderMaxFrameSize, strconv.Itoa(maxFrameSize))
+	}
+
+	wsConn, err := p.upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
 		logger.Error("Failed to upgrade connection to WebSocket",
 			"key", key,
@@ -374,29 +820,79 @@ func (p *SinglePortProxy) handleTunnelRegistration(w http.ResponseWriter, r *htt
 		return
 	}
 
+	if !registrationAllowed {
+		registrationThrottledCounter.Inc()
+		logger.Warn("Tunnel registration rate limited",
+			"key", key,
+			"remote_addr", remoteAddr,
+			"retry_after", retryAfter)
+		_ = wsConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater,
+				protocol.FormatRetryAfterReason(protocol.CloseReasonRegistrationRateLimited, retryAfter)),
+			time.Now().Add(time.Second))
+		wsConn.Close()
+		return
+	}
+
 	logger.Info("Tunnel client connected successfully",
 		"key", key,
 		"remote_addr", wsConn.RemoteAddr())
 
+	tc := newTunnelConn(key, wsConn)
+	tunnelConnectionsCounter.Inc()
+	if weight, err := strconv.Atoi(r.Header.Get(protocol.HeaderWeight)); err == nil && weight > 0 {
+		tc.weight = weight
+	}
+	tc.cancelSupported = protocol.HasFeature(features, protocol.FeatureCancel)
+	tc.targetCheckSupported = protocol.HasFeature(features, protocol.FeatureTargetCheck)
+	tc.goAwaySupported = protocol.HasFeature(features, protocol.FeatureGoAway)
+	tc.chunkSeq = chunkSeq
+	tc.localForward = localForward
+	tc.responseAbort = responseAbort
+	tc.maxFrameSize = maxFrameSize
+	tc.frames = p.frames.account()
+	if headerTableSize > 0 {
+		tc.headerEncoder = protocol.NewHeaderEncoder(headerTableSize)
+	}
+	if messageAuth {
+		authKey := []byte(p.config.MessageAuthKey)
+		tc.authOut = protocol.NewMessageAuth(authKey, authNonce, protocol.MessageAuthServerToClient)
+		tc.authIn = protocol.NewMessageAuth(authKey, authNonce, protocol.MessageAuthClientToServer)
+		if authNonce == nil {
+			logger.Warn("Tunnel client does not support message counters, replayed messages will not be detected",
+				"key", key,
+				"remote_addr", wsConn.RemoteAddr())
+		}
+	} else if p.config.MessageAuthKey != "" {
+		logger.Warn("Tunnel client does not support message authentication, messages will not be signed",
+			"key", key,
+			"remote_addr", wsConn.RemoteAddr())
+	}
+	tc.startWriter(p.config.TunnelSendQueue)
+
 	p.connsMu.Lock()
-	if oldConn, ok := p.clientConns[key]; ok {
+	pool := p.clientConns[key]
+	if pool == nil {
+		pool = newTunnelPool(p.config.KeyConfig(key))
+		p.clientConns[key] = pool
+	}
+	// 未开启负载均衡的key只保留一个连接，新连接替换旧连接
+	if oldConn := pool.latest(); oldConn != nil && !p.config.KeyConfig(key).MultiClient() {
+		pool.remove(oldConn)
 		logger.Info("Replacing existing connection for key",
 			"key", key,
-			"old_remote_addr", oldConn.RemoteAddr(),
+			"old_connection_id", oldConn.id,
+			"old_remote_addr", oldConn.conn.RemoteAddr(),
 			"new_remote_addr", wsConn.RemoteAddr())
-		oldConn.Close()
+		oldConn.conn.Close()
 
 		// 清理与该连接相关的待处理请求，避免请求ID冲突
 		p.handlersMu.Lock()
 		cleanupCount := 0
 		for reqID, handler := range p.streamHandlers {
 			// 简单的启发式方法：如果handler已经等待很久，可能是断线前的请求
-			select {
-			case <-handler.done:
-				// 已完成，跳过
-			default:
+			if handler.abandon(proxyErrTunnelReplaced) {
 				// 未完成，清理它
-				close(handler.done)
 				delete(p.streamHandlers, reqID)
 				cleanupCount++
 			}
@@ -409,18 +905,44 @@ func (p *SinglePortProxy) handleTunnelRegistration(w http.ResponseWriter, r *htt
 				"cleanup_count", cleanupCount)
 		}
 	}
-	p.clientConns[key] = wsConn
+	pool.add(tc)
 
 	// 记录当前活跃连接数
 	connectionCount := len(p.clientConns)
+	keyConnections := len(pool.conns)
+	totalConnections := 0
+	for _, pl := range p.clientConns {
+		totalConnections += len(pl.conns)
+	}
 	p.connsMu.Unlock()
 
 	logger.Info("Tunnel registered successfully",
 		"key", key,
+		"connection_id", tc.id,
 		"remote_addr", wsConn.RemoteAddr(),
+		"key_connections", keyConnections,
 		"total_active_tunnels", connectionCount)
 
-	p.clientReadLoop(wsConn, key)
+	// 自动key到期后关闭连接
+	if !keyExpires.IsZero() {
+		expiryTimer := time.AfterFunc(time.Until(keyExpires), func() {
+			logger.Info("Closing tunnel - auto key expired",
+				"key", key,
+				"connection_id", tc.id)
+			_ = wsConn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, protocol.CloseReasonKeyExpired),
+				time.Now().Add(time.Second))
+			wsConn.Close()
+		})
+		defer expiryTimer.Stop()
+	}
+	defer p.watchIdle(tc)()
+	p.redirectOverThreshold(tc, totalConnections)
+
+	// goroutine profile 中按key区分各隧道连接的读取循环
+	pprof.Do(r.Context(), utils.LoopProfileLabels(key, "read"), func(ctx context.Context) {
+		p.clientReadLoop(ctx, tc)
+	})
 }
 
 // HTTP长轮询模式的隧道管理
@@ -430,6 +952,17 @@ type httpTunnelClient struct {
 	lastSeen     time.Time
 	pollChan     chan *protocol.TunnelMessage // 用于发送消息给客户端
 	responseChan chan *protocol.TunnelMessage // 用于接收客户端响应
+
+	// 客户端注册时声明支持 body 端点，此时大的请求体不放入轮询消息
+	bodyStream bool
+	// 等待客户端获取的请求体 (requestID -> *pendingBody)，公网请求结束时删除
+	pendingBodies sync.Map
+}
+
+// pendingBody 等待长轮询客户端读取的公网请求体
+type pendingBody struct {
+	body   io.Reader
+	length int64 // 公网请求的 Content-Length，-1 表示未知
 }
 
 type httpTunnelManager struct {
@@ -0,0 +1,31 @@
+package server
+
+import "time"
+
+// sseKeepalive SSE注释行，浏览器的 EventSource 会忽略它，但能让中间代理和浏览器保持连接
+var sseKeepalive = []byte(": keepalive\n\n")
+
+// writeSSEHeartbeat 事件流在 interval 内没有写出数据时注入一行心跳注释。
+// 响应头尚未发出或不是事件流时不做任何事
+func (h *streamHandler) writeSSEHeartbeat(interval time.Duration) {
+	if !h.acquire() {
+		return
+	}
+	defer h.mu.Unlock()
+	if !h.sse || !h.headersSent || time.Since(h.lastWrite) < interval {
+		return
+	}
+	if _, err := h.writer.Write(sseKeepalive); err != nil {
+		return
+	}
+	h.flusher.Flush()
+	h.lastWrite = time.Now()
+	sseHeartbeatsCounter.Inc()
+}
+
+// streamingSSE 判断响应是否为已发出响应头的事件流，这类响应不受总超时限制
+func (h *streamHandler) streamingSSE() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sse && h.headersSent
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/transform"
+	"singleproxy/pkg/utils"
+)
+
+// streamHandler 用于处理一个流式响应。
+// 状态只会从进行中变为已结束：正常结束、超时和连接替换都通过 mu 内的 finished 标记收尾，
+// 写入响应前必须持有 mu 并确认未结束，避免在公网请求的处理函数返回后继续使用 ResponseWriter
+type streamHandler struct {
+	writer    http.ResponseWriter
+	flusher   http.Flusher
+	done      chan struct{}
+	request   *http.Request       // 公网请求，用于正确解析 HEAD 等无响应体的响应及匹配改写规则
+	key       string              // 公网请求所属的key
+	capture   *captureSession     // 非nil时该请求的响应会被抓包
+	transform *transform.Pipeline // 该key的改写规则 (nil表示不改写)
+	tunnel    *tunnelConn         // 转发该请求的WebSocket连接 (长轮询隧道为nil)
+	frames    *frameAccount       // 计入响应头之前缓冲的响应体
+
+	mu          sync.Mutex
+	finished    bool
+	headersSent bool                   // 响应头已写回公网用户，之后超时只能中断连接而不能再返回错误状态
+	body        *transform.Stream      // 当前响应体的改写流 (nil表示原样转发)
+	failure     proxyErrorKind         // 未写出响应就被结束的原因，由等待方返回错误响应
+	progress    *logger.StreamProgress // 已收到的响应体数据块，代替逐块的调试日志
+	sse         bool                   // 按SSE事件流处理: 不受总超时限制，不经改写流 (key配置 sse 或响应类型为 text/event-stream)
+	lastWrite   time.Time              // 最近一次写出响应体的时间，用于判断是否需要注入心跳
+	nextSeq     uint32                 // 下一个带序号数据块的序号
+	early       []byte                 // 响应头之前到达的响应体，响应头写出后补发
+	earlyBody   bool                   // 已收到过响应头之前的数据块，每个响应只计一次违规
+	clientGone  bool                   // 写入公网用户失败而结束，调用方已断开
+
+	coalesceBytes int           // 合并写出的数据块字节数阈值 (0表示逐块写出)
+	coalesceDelay time.Duration // 缓冲的数据块最长等待时间
+	pending       []byte        // 等待合并写出的响应体
+	flushTimer    *time.Timer   // 到期后写出 pending
+}
+
+// maxEarlyBodyBytes 响应头之前到达的响应体最多缓冲的字节数，超出后以 response_protocol_error 结束请求
+const maxEarlyBodyBytes = 64 * 1024
+
+// acquire 锁定处理器以写入响应。处理器已结束时返回 false，此时不持有锁
+func (h *streamHandler) acquire() bool {
+	h.mu.Lock()
+	if h.finished {
+		h.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// polledBy 判断请求是否经 key 的HTTP长轮询隧道转发，只有该隧道能回应它
+func (h *streamHandler) polledBy(key string) bool {
+	return h.tunnel == nil && h.key == key
+}
+
+// finishLocked 将处理器标记为已结束并唤醒等待方，调用方需持有 mu
+func (h *streamHandler) finishLocked() {
+	h.dropEarly()
+	// 已收到的数据在交还 ResponseWriter 之前写出，截断的响应也包含全部已收到的数据
+	_ = h.flushPending("end")
+	h.finished = true
+	close(h.done)
+}
+
+// abandon 以指定原因结束尚未结束的处理器，返回是否由本次调用结束
+func (h *streamHandler) abandon(kind proxyErrorKind) bool {
+	if !h.acquire() {
+		return false
+	}
+	h.failure = kind
+	h.finishLocked()
+	h.mu.Unlock()
+	return true
+}
+
+// checkChunk 校验带序号的数据块: 序号必须连续，结束标记附带的总长度必须与已收到的字节数一致。
+// 失败时返回用于指标标签的原因和错误。调用方需持有 mu
+func (h *streamHandler) checkChunk(payload []byte) (protocol.ResponseChunk, string, error) {
+	chunk, err := protocol.DecodeResponseChunk(payload)
+	if err != nil {
+		return chunk, "malformed", err
+	}
+	if chunk.Seq != h.nextSeq {
+		return chunk, "sequence", fmt.Errorf("expected chunk %d, got %d", h.nextSeq, chunk.Seq)
+	}
+	h.nextSeq++
+	if chunk.End && chunk.TotalLength >= 0 && chunk.TotalLength != h.progress.Bytes {
+		return chunk, "length", fmt.Errorf("client sent %d body bytes, received %d", chunk.TotalLength, h.progress.Bytes)
+	}
+	return chunk, "", nil
+}
+
+// writeHeader 写回响应状态码，有匹配的改写规则时先改写响应头并创建响应体改写流。调用方需持有 mu
+func (h *streamHandler) writeHeader(status int) {
+	if h.sse || utils.IsEventStream(h.writer.Header()) {
+		// 事件流逐条送达，不经过可能缓冲的改写流，并提示 nginx 等中间代理不要缓冲
+		h.sse = true
+		h.writer.Header().Set("X-Accel-Buffering", "no")
+	} else {
+		h.body = h.transform.Response(h.request, status, h.writer.Header())
+	}
+	h.writer.WriteHeader(status)
+	h.lastWrite = time.Now()
+}
+
+// writeBody 经改写流写入一段响应体。调用方需持有 mu
+func (h *streamHandler) writeBody(p []byte) error {
+	if h.body != nil {
+		p = h.body.Write(p)
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	h.lastWrite = time.Now()
+	_, err := h.writer.Write(p)
+	return err
+}
+
+// flushEarlyBody 在响应头写出后补发之前缓冲的响应体。调用方需持有 mu
+func (h *streamHandler) flushEarlyBody(requestID uint64) error {
+	early := h.early
+	h.early = nil
+	if len(early) == 0 {
+		return nil
+	}
+	if h.frames != nil {
+		defer h.frames.release(len(early))
+	}
+	if h.capture != nil {
+		h.capture.captureResponseBody(requestID, early)
+	}
+	return h.writeBody(early)
+}
+
+// bufferEarly 缓冲响应头之前到达的响应体，计入 frames 直到补发或丢弃。调用方需持有 mu
+func (h *streamHandler) bufferEarly(p []byte) {
+	h.early = append(h.early, p...)
+	if h.frames != nil {
+		h.frames.acquire(len(p))
+	}
+}
+
+// dropEarly 丢弃响应头之前缓冲的响应体。调用方需持有 mu
+func (h *streamHandler) dropEarly() {
+	if h.frames != nil {
+		h.frames.release(len(h.early))
+	}
+	h.early = nil
+}
+
+// closeBody 在响应体结束时写入改写流中剩余的数据。调用方需持有 mu
+func (h *streamHandler) closeBody() error {
+	if err := h.flushPending("end"); err != nil {
+		return err
+	}
+	if h.body == nil {
+		return nil
+	}
+	tail := h.body.Close()
+	if len(tail) == 0 {
+		return nil
+	}
+	_, err := h.writer.Write(tail)
+	return err
+}
+
+// writeInterim 在最终响应之前写回 1xx 临时响应。调用方需持有 mu。
+// 100 Continue 由公网请求读取请求体时自动发送，101 只能作为最终响应，两者都不接受
+func (h *streamHandler) writeInterim(payload []byte) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), h.request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 100 || resp.StatusCode > 199 ||
+		resp.StatusCode == http.StatusContinue || resp.StatusCode == http.StatusSwitchingProtocols {
+		return fmt.Errorf("unexpected interim status %d", resp.StatusCode)
+	}
+
+	// 1xx 会带上当前已设置的全部响应头，临时替换为临时响应自己的头部，写完后恢复
+	header := h.writer.Header()
+	saved := header.Clone()
+	clear(header)
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	h.writer.WriteHeader(resp.StatusCode)
+	clear(header)
+	for k, v := range saved {
+		header[k] = v
+	}
+	return nil
+}
+
+// writeFull 将包含响应头和完整响应体的负载写回公网用户，保留或重新计算 Content-Length。
+// 负载无法解析时不写出任何内容并返回错误。调用方需持有 mu
+func (h *streamHandler) writeFull(payload []byte) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(payload)), h.request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range resp.Header {
+		h.writer.Header()[k] = append(h.writer.Header()[k], v...)
+	}
+	// 完整响应体已知，改写后重新计算长度
+	if stream := h.transform.Response(h.request, resp.StatusCode, h.writer.Header()); stream != nil {
+		body = append(stream.Write(body), stream.Close()...)
+		h.writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	h.writer.WriteHeader(resp.StatusCode)
+	_, err = h.writer.Write(body)
+	return err
+}
+
+// notifyCancel 通知客户端公网请求已中止，长轮询隧道或客户端不支持时忽略
+func (h *streamHandler) notifyCancel(requestID uint64, reason string) {
+	if h.tunnel == nil || !h.tunnel.cancelSupported {
+		return
+	}
+	msg := protocol.TunnelMessage{ID: requestID, Type: protocol.MSG_TYPE_CANCEL, Payload: []byte(reason)}
+	if err := h.tunnel.sendTunnelMessage(msg); err != nil {
+		logger.Debug("Failed to send cancel message",
+			"key", h.tunnel.key,
+			"request_id", requestID,
+			"reason", reason,
+			"error", err)
+	}
+}
+
+// abortOnWriteError 写入公网用户失败时结束处理器并通知客户端停止转发，调用方需持有 handler.mu。
+// 不等公网请求的上下文结束，读取循环不再为已断开的调用方写出后续数据块，客户端也尽早停止读取目标服务
+func (p *SinglePortProxy) abortOnWriteError(key string, handler *streamHandler, requestID uint64, err error) {
+	logger.Warn("Failed to write response to public client, canceling request",
+		"key", key,
+		"request_id", requestID,
+		"delivered_bytes", handler.progress.Bytes,
+		"error", err)
+	if handler.capture != nil {
+		handler.capture.finishResponse(requestID)
+	}
+	handler.clientGone = true
+	handler.finishLocked()
+	handler.notifyCancel(requestID, protocol.CancelReasonClientDisconnect)
+}
+
+// lookupStreamHandler 查找请求ID对应的处理器
+func (p *SinglePortProxy) lookupStreamHandler(requestID uint64) (*streamHandler, bool) {
+	p.handlersMu.Lock()
+	defer p.handlersMu.Unlock()
+	handler, ok := p.streamHandlers[requestID]
+	return handler, ok
+}
+
+// removeStreamHandler 注销请求ID对应的处理器
+func (p *SinglePortProxy) removeStreamHandler(requestID uint64) {
+	p.handlersMu.Lock()
+	delete(p.streamHandlers, requestID)
+	p.handlersMu.Unlock()
+}
+
+// expireStreamHandler 在超时后结束并注销请求的流处理器。
+// 流已结束时返回 expired=false；onlyBeforeHeaders 为 true 且响应头已到达时保留处理器。
+// 结束后隧道消息不会再写入该响应，调用方可以独占 ResponseWriter
+func (p *SinglePortProxy) expireStreamHandler(requestID uint64, handler *streamHandler, onlyBeforeHeaders bool) (expired, headersSent bool) {
+	if !handler.acquire() {
+		return false, false
+	}
+	headersSent = handler.headersSent
+	if onlyBeforeHeaders && headersSent {
+		handler.mu.Unlock()
+		return false, true
+	}
+	handler.finishLocked()
+	handler.mu.Unlock()
+	p.removeStreamHandler(requestID)
+	return true, headersSent
+}
+
+// streaming 判断响应头是否已写回公网用户，之后的失败只能截断响应
+func (h *streamHandler) streaming() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.headersSent
+}
+
+// closeTunnelStreams 结束经该隧道连接转发、已发出响应头的响应。隧道断开后不会再收到数据块，
+// 不必等到响应超时，返回结束的数量
+func (p *SinglePortProxy) closeTunnelStreams(tc *tunnelConn) int {
+	p.handlersMu.Lock()
+	defer p.handlersMu.Unlock()
+	closed := 0
+	for reqID, handler := range p.streamHandlers {
+		if handler.tunnel == tc && handler.streaming() && handler.abandon(proxyErrTunnelClosed) {
+			delete(p.streamHandlers, reqID)
+			closed++
+		}
+	}
+	return closed
+}
+
+// truncateResponse 结束已发出响应头但未完整送达的响应，使公网用户能够察觉截断。
+// 先把已缓冲的响应体写出；承诺了 Content-Length 或响应不是分块传输时直接断开连接，
+// 分块传输默认同样断开而不发送结束块，配置 truncated_response: trailer 时改为以 X-Proxy-Error 尾部字段结束
+func (p *SinglePortProxy) truncateResponse(w http.ResponseWriter, r *http.Request, handler *streamHandler, key string, requestID uint64, kind proxyErrorKind) {
+	p.markProxyError(w, kind)
+	truncatedResponsesCounter.WithLabelValue(key).Inc()
+
+	expected := int64(-1)
+	if v := w.Header().Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			expected = n
+		}
+	}
+	trailer := p.config.TruncatedResponse == "trailer" && expected < 0 && r.ProtoAtLeast(1, 1) && !isRawResponseWriter(w)
+	logger.Warn("Response truncated",
+		"key", key,
+		"request_id", requestID,
+		"proxy_error", kind,
+		"delivered_bytes", handler.progress.Bytes,
+		"expected_bytes", expected,
+		"trailer", trailer)
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	if trailer {
+		w.Header().Set(http.TrailerPrefix+headerProxyError, string(kind))
+		return
+	}
+	abortResponse(w)
+}
+
+// isRawResponseWriter 判断响应是否由原始连接上的 httpResponseWriter 写出。
+// 它以关闭连接结束响应体，不使用分块传输，无法发送尾部字段
+func isRawResponseWriter(w http.ResponseWriter) bool {
+	for {
+		switch rw := w.(type) {
+		case *httpResponseWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"singleproxy/pkg/logger"
+)
+
+// rejectMalformedTarget 规范化请求目标，无法识别时返回 400，返回 true 表示请求已结束。
+// 主端口和端口绑定上的请求都先经过它，再进入路由
+func rejectMalformedTarget(w http.ResponseWriter, r *http.Request) bool {
+	err := normalizeRequestTarget(r)
+	if err == nil {
+		return false
+	}
+	logger.Warn("Rejected malformed request target",
+		"method", r.Method,
+		"request_uri", r.RequestURI,
+		"remote_addr", r.RemoteAddr,
+		"error", err)
+	http.Error(w, "Bad Request", http.StatusBadRequest)
+	return true
+}
+
+// normalizeRequestTarget 将公网请求的请求目标统一为 origin-form:
+// absolute-form 的主机名写入 Host，asterisk-form 仅允许 OPTIONS，
+// 带 userinfo、非 http(s) scheme 或无法识别的请求目标返回错误
+func normalizeRequestTarget(r *http.Request) error {
+	if r.Method == http.MethodConnect {
+		return nil
+	}
+
+	if r.RequestURI == "*" || r.URL.Path == "*" {
+		if r.Method != http.MethodOptions {
+			return fmt.Errorf("asterisk-form target is only allowed for OPTIONS")
+		}
+		return nil
+	}
+
+	if r.URL.Opaque != "" {
+		return fmt.Errorf("unsupported request target %q", r.RequestURI)
+	}
+	if r.URL.User != nil {
+		return fmt.Errorf("userinfo is not allowed in request target")
+	}
+
+	if r.URL.IsAbs() || r.URL.Host != "" {
+		scheme := strings.ToLower(r.URL.Scheme)
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unsupported scheme %q in request target", r.URL.Scheme)
+		}
+		if r.URL.Host == "" {
+			return fmt.Errorf("absolute-form target without host")
+		}
+		// absolute-form 中的主机名优先于 Host 头 (RFC 9112 3.2.2)
+		r.Host = r.URL.Host
+		r.URL.Scheme = ""
+		r.URL.Host = ""
+		if r.URL.Path == "" {
+			r.URL.Path = "/"
+		}
+		r.RequestURI = r.URL.RequestURI()
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/") {
+		return fmt.Errorf("request target must start with '/'")
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// tarpit 的默认值: 一分钟内被限频多少次视为屡犯，以及同时拖延的连接上限
+const (
+	defaultTarpitThreshold = 10
+	defaultTarpitMaxConns  = 100
+	tarpitWindow           = time.Minute
+)
+
+var (
+	tarpitCounter = metrics.NewCounterVec("singleproxy_server_tarpitted_requests_total",
+		"Rate limited requests from repeat offenders, by whether they were held before the 429 or answered immediately because all tarpit slots were busy", "result")
+	tarpitActiveGauge = metrics.NewGauge("singleproxy_server_tarpit_active",
+		"Requests currently held by the tarpit")
+)
+
+// tarpitOffender 单个来源IP在当前统计周期内被限频的情况
+type tarpitOffender struct {
+	rejections  int       // 当前周期内被限频的次数
+	windowStart time.Time // 当前周期的开始时间
+	tarpitted   int64     // 累计被拖延的请求数
+	lastSeen    time.Time
+}
+
+// tarpit 拖延屡次超过速率限制的来源IP: 请求被接受但不做任何隧道工作，等待一段时间后才返回 429，
+// 让立即重试的爬虫慢下来。同时拖延的请求数有上限，避免反被用来耗尽服务器资源
+type tarpit struct {
+	delay     time.Duration
+	threshold int
+	slots     chan struct{}
+
+	mu        sync.Mutex
+	offenders map[string]*tarpitOffender
+	lastSweep time.Time
+}
+
+// newTarpit 按配置创建拖延器，未设置 -tarpit-delay 时返回nil
+func newTarpit(cfg *config.Config) *tarpit {
+	if cfg.TarpitDelay <= 0 {
+		return nil
+	}
+	threshold := cfg.TarpitThreshold
+	if threshold <= 0 {
+		threshold = defaultTarpitThreshold
+	}
+	maxConns := cfg.TarpitMaxConns
+	if maxConns <= 0 {
+		maxConns = defaultTarpitMaxConns
+	}
+	return &tarpit{
+		delay:     cfg.TarpitDelay,
+		threshold: threshold,
+		slots:     make(chan struct{}, maxConns),
+		offenders: make(map[string]*tarpitOffender),
+	}
+}
+
+// record 记录一次限频并判断该IP是否已是屡犯，同时清理过期的记录
+func (t *tarpit) record(ip string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastSweep) >= tarpitWindow {
+		for k, o := range t.offenders {
+			if now.Sub(o.lastSeen) >= tarpitWindow {
+				delete(t.offenders, k)
+			}
+		}
+		t.lastSweep = now
+	}
+	o := t.offenders[ip]
+	if o == nil {
+		o = &tarpitOffender{windowStart: now}
+		t.offenders[ip] = o
+	}
+	if now.Sub(o.windowStart) >= tarpitWindow {
+		o.rejections, o.windowStart = 0, now
+	}
+	o.rejections++
+	o.lastSeen = now
+	if o.rejections <= t.threshold {
+		return false
+	}
+	o.tarpitted++
+	return true
+}
+
+// hold 对屡犯的IP拖延 delay 后返回，公网连接断开时立即返回。
+// 拖延槽位已满时不等待，返回是否实际拖延过
+func (t *tarpit) hold(ctx context.Context, ip string) bool {
+	if !t.record(ip, time.Now()) {
+		return false
+	}
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		tarpitCounter.WithLabelValue("overflow").Inc()
+		return false
+	}
+	defer func() { <-t.slots }()
+	tarpitCounter.WithLabelValue("held").Inc()
+	tarpitActiveGauge.Inc()
+	defer tarpitActiveGauge.Dec()
+
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+// tarpitOffenderStatus 管理接口中展示的屡犯IP
+type tarpitOffenderStatus struct {
+	IP         string    `json:"ip"`
+	Rejections int       `json:"rejections"`
+	Tarpitted  int64     `json:"tarpitted"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// status 返回拖延器的配置、当前拖延数和已达到阈值的IP，按最近出现时间排序
+func (t *tarpit) status() map[string]any {
+	t.mu.Lock()
+	offenders := make([]tarpitOffenderStatus, 0)
+	for ip, o := range t.offenders {
+		if o.tarpitted > 0 {
+			offenders = append(offenders, tarpitOffenderStatus{IP: ip, Rejections: o.rejections, Tarpitted: o.tarpitted, LastSeen: o.lastSeen})
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(offenders, func(i, j int) bool { return offenders[i].LastSeen.After(offenders[j].LastSeen) })
+	return map[string]any{
+		"delay":     t.delay.String(),
+		"threshold": t.threshold,
+		"max_conns": cap(t.slots),
+		"active":    len(t.slots),
+		"offenders": offenders,
+	}
+}
+
+// rejectRateLimited 返回 429。启用拖延时屡犯的IP先被拖延，不占用隧道资源
+func (p *SinglePortProxy) rejectRateLimited(w http.ResponseWriter, r *http.Request, ip, message string) {
+	if p.tarpit != nil && p.tarpit.hold(r.Context(), ip) {
+		logger.Debug("Tarpitted rate limited request",
+			"client_ip", ip,
+			"delay", p.tarpit.delay)
+	}
+	http.Error(w, message, http.StatusTooManyRequests)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestNewTarpitDisabled(t *testing.T) {
+	if tp := newTarpit(&config.Config{}); tp != nil {
+		t.Error("Expected no tarpit without -tarpit-delay")
+	}
+	tp := newTarpit(&config.Config{TarpitDelay: time.Second})
+	if tp.threshold != defaultTarpitThreshold || cap(tp.slots) != defaultTarpitMaxConns {
+		t.Errorf("Expected defaults, got threshold=%d max_conns=%d", tp.threshold, cap(tp.slots))
+	}
+}
+
+func TestTarpitRecordThreshold(t *testing.T) {
+	tp := newTarpit(&config.Config{TarpitDelay: time.Second, TarpitThreshold: 3})
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		if tp.record("1.2.3.4", now) {
+			t.Fatalf("Rejection %d should not be tarpitted", i)
+		}
+	}
+	if !tp.record("1.2.3.4", now) {
+		t.Fatal("Expected tarpit after exceeding the threshold")
+	}
+	if tp.record("5.6.7.8", now) {
+		t.Error("Other IPs should not be affected")
+	}
+
+	// 新的统计周期重新计数，过期的记录被清理
+	later := now.Add(tarpitWindow)
+	if tp.record("1.2.3.4", later) {
+		t.Error("Expected count to reset after the window")
+	}
+	if _, ok := tp.offenders["5.6.7.8"]; ok {
+		t.Error("Expected stale offender to be swept")
+	}
+}
+
+func TestTarpitHold(t *testing.T) {
+	tp := newTarpit(&config.Config{TarpitDelay: time.Hour, TarpitThreshold: 1, TarpitMaxConns: 1})
+	tp.record("1.2.3.4", time.Now())
+
+	// 连接断开时立即返回
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() { done <- tp.hold(ctx, "1.2.3.4") }()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(tp.slots) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 槽位已满时不等待
+	if tp.hold(context.Background(), "1.2.3.4") {
+		t.Error("Expected overflow when all slots are busy")
+	}
+
+	cancel()
+	select {
+	case held := <-done:
+		if !held {
+			t.Error("Expected request to be held")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("hold did not return after the context was cancelled")
+	}
+	if len(tp.slots) != 0 {
+		t.Errorf("Expected slot to be released, %d in use", len(tp.slots))
+	}
+
+	status := tp.status()
+	offenders := status["offenders"].([]tarpitOffenderStatus)
+	if len(offenders) != 1 || offenders[0].IP != "1.2.3.4" || offenders[0].Tarpitted != 2 {
+		t.Errorf("Unexpected offenders: %+v", offenders)
+	}
+	if status["max_conns"] != 1 || status["active"] != 0 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
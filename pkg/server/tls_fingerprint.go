@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// extSupportedVersions supported_versions 扩展，出现时 ClientHello 的版本字段固定为 TLS 1.2
+const extSupportedVersions = 43
+
+var (
+	tlsFingerprintsCounter = metrics.NewCounterVec("singleproxy_server_tls_fingerprints_total",
+		"TLS handshakes by the first two hex digits of the client's JA3 fingerprint (256 buckets at most)", "bucket")
+	tlsFingerprintDeniedCounter = metrics.NewCounter("singleproxy_server_tls_fingerprint_denied_total",
+		"TLS handshakes aborted because the client's JA3 fingerprint is in -tls-fingerprint-deny")
+)
+
+var errTLSFingerprintDenied = errors.New("tls fingerprint denied")
+
+// fingerprintListener 在TLS之下包装接受的连接，握手时把客户端指纹记录在连接上
+type fingerprintListener struct {
+	net.Listener
+}
+
+func (l fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprintConn{Conn: conn}, nil
+}
+
+// fingerprintConn TLS连接下层的TCP连接。ja3 在握手时写入，握手与之后读取请求在同一协程中进行
+type fingerprintConn struct {
+	net.Conn
+	ja3 string
+}
+
+// newTLSListener 在 ln 上终止TLS，握手时计算客户端的 JA3 指纹
+func (p *SinglePortProxy) newTLSListener(ln net.Listener) net.Listener {
+	return tls.NewListener(fingerprintListener{ln}, p.tlsConfig)
+}
+
+// inspectClientHello 作为 GetConfigForClient 计算指纹，指纹在拒绝列表中时中止握手。
+// 返回 nil 表示继续使用原有的TLS配置
+func (p *SinglePortProxy) inspectClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	fc, ok := hello.Conn.(*fingerprintConn)
+	if !ok {
+		return nil, nil
+	}
+	fc.ja3 = ja3Fingerprint(hello)
+	tlsFingerprintsCounter.WithLabelValue(fc.ja3[:2]).Inc()
+	if p.tlsFingerprintDeny[fc.ja3] {
+		tlsFingerprintDeniedCounter.Inc()
+		logger.Debug("Rejected TLS handshake by client fingerprint",
+			"remote_addr", fc.RemoteAddr().String(),
+			"server_name", hello.ServerName,
+			"tls_fingerprint", fc.ja3)
+		return nil, errTLSFingerprintDenied
+	}
+	return nil, nil
+}
+
+// newTLSFingerprintDeny 整理拒绝列表，统一为小写
+func newTLSFingerprintDeny(fingerprints []string) map[string]bool {
+	deny := make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		deny[strings.ToLower(fp)] = true
+	}
+	return deny
+}
+
+// ja3String 按 JA3 的格式拼接 ClientHello 的字段: 版本,密码套件,扩展,椭圆曲线,点格式，
+// 各项的值以 "-" 分隔并去掉 GREASE 值。版本取 ClientHello 的版本字段: 带 supported_versions
+// 扩展时固定为 771 (TLS 1.2)，否则为客户端支持的最高版本
+func ja3String(hello *tls.ClientHelloInfo) string {
+	version := uint16(tls.VersionTLS12)
+	hasSupportedVersions := false
+	for _, ext := range hello.Extensions {
+		if ext == extSupportedVersions {
+			hasSupportedVersions = true
+		}
+	}
+	if !hasSupportedVersions && len(hello.SupportedVersions) > 0 {
+		version = hello.SupportedVersions[0]
+	}
+
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(version)))
+	b.WriteByte(',')
+	writeJA3List(&b, hello.CipherSuites)
+	b.WriteByte(',')
+	writeJA3List(&b, hello.Extensions)
+	b.WriteByte(',')
+	writeJA3List(&b, hello.SupportedCurves)
+	b.WriteByte(',')
+	writeJA3List(&b, hello.SupportedPoints)
+	return b.String()
+}
+
+// ja3Fingerprint 返回 JA3 字符串的MD5十六进制形式
+func ja3Fingerprint(hello *tls.ClientHelloInfo) string {
+	sum := md5.Sum([]byte(ja3String(hello)))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJA3List[T ~uint8 | ~uint16](b *strings.Builder, values []T) {
+	first := true
+	for _, v := range values {
+		if isGREASE(uint16(v)) {
+			continue
+		}
+		if !first {
+			b.WriteByte('-')
+		}
+		first = false
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+}
+
+// isGREASE 判断是否为 RFC 8701 保留的 GREASE 值 (0x0a0a, 0x1a1a, ... 0xfafa)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsFingerprintOf 返回连接握手时记录的 JA3 指纹，非TLS连接 (或TLS在上游终止) 时返回空
+func tlsFingerprintOf(conn net.Conn) string {
+	for {
+		switch c := conn.(type) {
+		case *prefixedConn:
+			conn = c.Conn
+		case *trackedConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *fingerprintConn:
+			return c.ja3
+		default:
+			return ""
+		}
+	}
+}
+
+type tlsFingerprintContextKey struct{}
+
+// tlsStateOf 返回连接的TLS状态，TLS不在本服务器终止时为nil
+func tlsStateOf(conn net.Conn) *tls.ConnectionState {
+	for {
+		switch c := conn.(type) {
+		case *prefixedConn:
+			conn = c.Conn
+		case *trackedConn:
+			conn = c.Conn
+		case *tls.Conn:
+			state := c.ConnectionState()
+			return &state
+		default:
+			return nil
+		}
+	}
+}
+
+// withTLSFingerprint 把连接的 JA3 指纹放入请求上下文
+func withTLSFingerprint(r *http.Request, fingerprint string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tlsFingerprintContextKey{}, fingerprint))
+}
+
+// tlsFingerprintFrom 返回请求所在连接的 JA3 指纹
+func tlsFingerprintFrom(r *http.Request) string {
+	fp, _ := r.Context().Value(tlsFingerprintContextKey{}).(string)
+	return fp
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestJA3String(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello tls.ClientHelloInfo
+		want  string
+	}{
+		{
+			name: "tls13 with grease",
+			hello: tls.ClientHelloInfo{
+				CipherSuites:      []uint16{0x2a2a, 4865, 4866, 49195},
+				Extensions:        []uint16{0x3a3a, 0, 23, 65281, 10, 11, 43, 0xfafa},
+				SupportedCurves:   []tls.CurveID{0x4a4a, tls.X25519, tls.CurveP256},
+				SupportedPoints:   []uint8{0},
+				SupportedVersions: []uint16{0x5a5a, tls.VersionTLS13, tls.VersionTLS12},
+			},
+			want: "771,4865-4866-49195,0-23-65281-10-11-43,29-23,0",
+		},
+		{
+			name: "tls11 without supported_versions",
+			hello: tls.ClientHelloInfo{
+				CipherSuites:      []uint16{47, 53},
+				Extensions:        []uint16{0, 65281},
+				SupportedVersions: []uint16{tls.VersionTLS11, tls.VersionTLS10},
+			},
+			want: "770,47-53,0-65281,,",
+		},
+	}
+	for _, tt := range tests {
+		if got := ja3String(&tt.hello); got != tt.want {
+			t.Errorf("%s: ja3String = %q, want %q", tt.name, got, tt.want)
+		}
+		sum := md5.Sum([]byte(tt.want))
+		if got := ja3Fingerprint(&tt.hello); got != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: ja3Fingerprint = %q, want md5 of the JA3 string", tt.name, got)
+		}
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xdada, 0xfafa} {
+		if !isGREASE(v) {
+			t.Errorf("Expected %#04x to be GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0, 0x0a1a, 0x1301, 0xc02b, 0x0a0b} {
+		if isGREASE(v) {
+			t.Errorf("Expected %#04x not to be GREASE", v)
+		}
+	}
+}
+
+func TestInspectClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	hello := &tls.ClientHelloInfo{CipherSuites: []uint16{4865}, Extensions: []uint16{43}}
+	fp := ja3Fingerprint(hello)
+	p := &SinglePortProxy{tlsFingerprintDeny: newTLSFingerprintDeny([]string{"00000000000000000000000000000000"})}
+
+	fc := &fingerprintConn{Conn: server}
+	hello.Conn = fc
+	if _, err := p.inspectClientHello(hello); err != nil {
+		t.Fatalf("Expected handshake to continue, got %v", err)
+	}
+	// 指纹可以穿过服务器对连接的各层包装读取
+	wrapped := &prefixedConn{Conn: &trackedConn{Conn: tls.Server(fc, &tls.Config{})}}
+	if got := tlsFingerprintOf(wrapped); got != fp {
+		t.Errorf("tlsFingerprintOf = %q, want %q", got, fp)
+	}
+	if got := tlsFingerprintOf(server); got != "" {
+		t.Errorf("Expected no fingerprint for a plain connection, got %q", got)
+	}
+
+	// 拒绝列表不区分大小写
+	p.tlsFingerprintDeny = newTLSFingerprintDeny([]string{strings.ToUpper(fp)})
+	if _, err := p.inspectClientHello(hello); err != errTLSFingerprintDenied {
+		t.Errorf("Expected denied fingerprint to abort the handshake, got %v", err)
+	}
+}
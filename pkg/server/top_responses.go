@@ -0,0 +1,226 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+const (
+	topResponsesWindow      = time.Hour // 统计窗口，条目超过该时长后重新计数
+	topResponsesMaxEntries  = 1000      // 每个key最多跟踪的 方法+路径 数
+	defaultTopPathLength    = 128
+	defaultTopResponseLimit = 20
+)
+
+// responseSizeHistogram 每个请求写回公网用户的响应体字节数，桶上界从256B到64MB按4倍递增
+var responseSizeHistogram = metrics.NewHistogramVec("singleproxy_server_response_size_bytes",
+	"Response body bytes written to public clients per request, by tunnel key", "key",
+	metrics.ExponentialBuckets(256, 4, 10))
+
+// pathRewrite 编译后的路径改写规则
+type pathRewrite struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// pathNormalizer 将请求路径归一化为有限的几种，避免统计条目无限增长
+type pathNormalizer struct {
+	maxLength int
+	depth     int
+	rewrites  []pathRewrite
+}
+
+func newPathNormalizer(cfg *config.TopResponsesConfig) *pathNormalizer {
+	n := &pathNormalizer{maxLength: defaultTopPathLength}
+	if cfg == nil {
+		return n
+	}
+	if cfg.MaxPathLength > 0 {
+		n.maxLength = cfg.MaxPathLength
+	}
+	n.depth = cfg.PathDepth
+	for _, r := range cfg.Rewrites {
+		if r == nil {
+			continue
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			logger.Error("Invalid top responses path rewrite, ignoring",
+				"pattern", r.Pattern,
+				"error", err)
+			continue
+		}
+		n.rewrites = append(n.rewrites, pathRewrite{re: re, replacement: r.Replacement})
+	}
+	return n
+}
+
+// normalize 去掉查询参数，依次执行改写规则、截取前几段路径并截断长度
+func (n *pathNormalizer) normalize(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	for _, r := range n.rewrites {
+		path = r.re.ReplaceAllString(path, r.replacement)
+	}
+	if n.depth > 0 {
+		segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", n.depth+1)
+		if len(segments) > n.depth {
+			path = "/" + strings.Join(segments[:n.depth], "/")
+		}
+	}
+	if len(path) > n.maxLength {
+		path = path[:n.maxLength]
+	}
+	if path == "" {
+		path = "/"
+	}
+	return path
+}
+
+// topResponse 一个 方法+路径 在当前窗口内的响应大小
+type topResponse struct {
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	MaxBytes   int64     `json:"max_bytes"`
+	Requests   int64     `json:"requests"`
+	TotalBytes int64     `json:"total_bytes"`
+	LastSeen   time.Time `json:"last_seen"`
+
+	windowStart time.Time
+}
+
+// topResponses 按key跟踪最大的响应。每个条目在窗口开始一小时后清零重新计数，
+// 条目数达到上限时淘汰过期条目，仍然已满则替换最大响应最小的条目
+type topResponses struct {
+	normalizer *pathNormalizer
+	now        func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]map[string]*topResponse // key -> "方法 路径" -> 统计
+}
+
+func newTopResponses(cfg *config.TopResponsesConfig) *topResponses {
+	return &topResponses{
+		normalizer: newPathNormalizer(cfg),
+		now:        time.Now,
+		keys:       make(map[string]map[string]*topResponse),
+	}
+}
+
+// record 记录一个请求的响应大小
+func (t *topResponses) record(key, method, path string, size int64) {
+	path = t.normalizer.normalize(path)
+	id := method + " " + path
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := t.keys[key]
+	if entries == nil {
+		entries = make(map[string]*topResponse)
+		t.keys[key] = entries
+	}
+	e, ok := entries[id]
+	if !ok {
+		if len(entries) >= topResponsesMaxEntries && !evictTopResponse(entries, now, size) {
+			return
+		}
+		e = &topResponse{Method: method, Path: path, windowStart: now}
+		entries[id] = e
+	}
+	if now.Sub(e.windowStart) > topResponsesWindow {
+		*e = topResponse{Method: method, Path: path, windowStart: now}
+	}
+	e.Requests++
+	e.TotalBytes += size
+	e.LastSeen = now
+	if size > e.MaxBytes {
+		e.MaxBytes = size
+	}
+}
+
+// evictTopResponse 为新条目腾出位置，返回 false 表示新响应比所有现有条目都小，不记录
+func evictTopResponse(entries map[string]*topResponse, now time.Time, size int64) bool {
+	evicted := false
+	for id, e := range entries {
+		if now.Sub(e.LastSeen) > topResponsesWindow {
+			delete(entries, id)
+			evicted = true
+		}
+	}
+	if evicted {
+		return true
+	}
+	var smallest string
+	for id, e := range entries {
+		if smallest == "" || e.MaxBytes < entries[smallest].MaxBytes {
+			smallest = id
+		}
+	}
+	if entries[smallest].MaxBytes >= size {
+		return false
+	}
+	delete(entries, smallest)
+	return true
+}
+
+// top 返回key在最近一小时内最大的响应，按最大响应字节数降序
+func (t *topResponses) top(key string, limit int) []topResponse {
+	now := t.now()
+	t.mu.Lock()
+	out := []topResponse{}
+	for _, e := range t.keys[key] {
+		if now.Sub(e.LastSeen) <= topResponsesWindow {
+			out = append(out, *e)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].MaxBytes != out[j].MaxBytes {
+			return out[i].MaxBytes > out[j].MaxBytes
+		}
+		return out[i].Method+" "+out[i].Path < out[j].Method+" "+out[j].Path
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// handleAdminTopResponses 列出key最近一小时内最大的响应: GET /admin/top-responses?key=&limit=
+func (p *SinglePortProxy) handleAdminTopResponses(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "key is required"})
+		return
+	}
+	if !authorizeKey(w, r, key) {
+		return
+	}
+	limit := defaultTopResponseLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"key":       key,
+		"window":    topResponsesWindow.String(),
+		"responses": p.topResponses.top(key, limit),
+	})
+}
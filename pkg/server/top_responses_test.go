@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestPathNormalizer(t *testing.T) {
+	n := newPathNormalizer(&config.TopResponsesConfig{
+		MaxPathLength: 24,
+		Rewrites: []*config.PathRewrite{
+			{Pattern: `/[0-9]+(/|$)`, Replacement: "/:id$1"},
+		},
+	})
+	for _, tt := range []struct{ in, want string }{
+		{"/api/users/42/avatar", "/api/users/:id/avatar"},
+		{"/files/report.pdf?download=1", "/files/report.pdf"},
+		{"/" + strings.Repeat("a", 40), "/" + strings.Repeat("a", 23)},
+		{"", "/"},
+	} {
+		if got := n.normalize(tt.in); got != tt.want {
+			t.Errorf("normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	depth := newPathNormalizer(&config.TopResponsesConfig{PathDepth: 2})
+	if got := depth.normalize("/api/users/42"); got != "/api/users" {
+		t.Errorf("Expected path cut to two segments, got %q", got)
+	}
+	if got := depth.normalize("/api"); got != "/api" {
+		t.Errorf("Expected short path unchanged, got %q", got)
+	}
+}
+
+func TestTopResponsesWindowAndEviction(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	top := newTopResponses(nil)
+	top.now = func() time.Time { return now }
+
+	top.record("web", "GET", "/big", 5000)
+	top.record("web", "GET", "/big?page=2", 9000)
+	top.record("web", "GET", "/small", 10)
+	top.record("other", "GET", "/huge", 1<<20)
+
+	got := top.top("web", 10)
+	if len(got) != 2 || got[0].Path != "/big" || got[0].MaxBytes != 9000 || got[0].Requests != 2 || got[0].TotalBytes != 14000 {
+		t.Fatalf("Unexpected top responses: %+v", got)
+	}
+	if got := top.top("web", 1); len(got) != 1 {
+		t.Errorf("Expected limit to be applied, got %d entries", len(got))
+	}
+
+	// 超过一小时未出现的条目不再列出，再次出现时重新计数
+	now = now.Add(61 * time.Minute)
+	if got := top.top("web", 10); len(got) != 0 {
+		t.Errorf("Expected expired entries to be hidden, got %+v", got)
+	}
+	top.record("web", "GET", "/big", 100)
+	if got := top.top("web", 10); len(got) != 1 || got[0].MaxBytes != 100 || got[0].Requests != 1 {
+		t.Errorf("Expected entry to restart its window, got %+v", got)
+	}
+
+	// 条目已满时替换最大响应最小的条目，比所有条目都小的响应不记录
+	full := newTopResponses(nil)
+	for i := 0; i < topResponsesMaxEntries; i++ {
+		full.record("web", "GET", fmt.Sprintf("/p%d", i), int64(100+i))
+	}
+	full.record("web", "GET", "/tiny", 1)
+	full.record("web", "GET", "/large", 1<<20)
+	entries := full.keys["web"]
+	if len(entries) != topResponsesMaxEntries {
+		t.Fatalf("Expected entries capped at %d, got %d", topResponsesMaxEntries, len(entries))
+	}
+	if _, ok := entries["GET /tiny"]; ok {
+		t.Errorf("Expected response smaller than all entries to be dropped")
+	}
+	if _, ok := entries["GET /p0"]; ok {
+		t.Errorf("Expected smallest entry to be evicted")
+	}
+	if _, ok := entries["GET /large"]; !ok {
+		t.Errorf("Expected large response to be tracked")
+	}
+}
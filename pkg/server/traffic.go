@@ -0,0 +1,156 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// 全局流量模式 (-traffic-mode / PUT /admin/traffic)
+const (
+	trafficNormal = "normal"
+	trafficPaused = "paused"
+)
+
+// pausedRetryAfter 暂停页面建议客户端重试的等待秒数
+const pausedRetryAfter = 60
+
+//go:embed paused.html
+var defaultPausedPage []byte
+
+var (
+	trafficPausedGauge = metrics.NewGauge("singleproxy_server_traffic_paused",
+		"1 while public HTTP, /proxy/ and SOCKS5 traffic is paused (traffic_mode: paused), 0 otherwise")
+	pausedRequestsCounter = metrics.NewCounterVec("singleproxy_server_paused_requests_total",
+		"Public requests turned away while traffic is paused, by kind (http, proxy, socks5)", "kind")
+)
+
+// newPausedPage 读取 -paused-page，未配置或读取失败时使用内置页面
+func newPausedPage(path string) []byte {
+	if path == "" {
+		return defaultPausedPage
+	}
+	page, err := readOfflinePage(path)
+	if err != nil {
+		logger.Error("Failed to load paused page, using default page",
+			"file", path,
+			"error", err)
+		return defaultPausedPage
+	}
+	return page
+}
+
+// trafficMode 返回当前的流量模式
+func (p *SinglePortProxy) trafficMode() string {
+	if p.trafficPaused.Load() {
+		return trafficPaused
+	}
+	return trafficNormal
+}
+
+// setTrafficMode 切换流量模式。只影响之后到达的公网请求，隧道连接和进行中的请求不受影响，恢复时客户端无需重连
+func (p *SinglePortProxy) setTrafficMode(mode string) {
+	paused := mode == trafficPaused
+	if p.trafficPaused.Swap(paused) == paused {
+		return
+	}
+	if paused {
+		trafficPausedGauge.Inc()
+	} else {
+		trafficPausedGauge.Dec()
+	}
+	logger.Warn("Traffic mode changed", "traffic_mode", mode)
+}
+
+// servePaused 流量暂停时以503和暂停页面回应公网请求，不查找也不使用隧道，未暂停时返回 false。
+// 只接受JSON的API调用方收到JSON错误
+func (p *SinglePortProxy) servePaused(w http.ResponseWriter, r *http.Request, kind string) bool {
+	if !p.trafficPaused.Load() {
+		return false
+	}
+	pausedRequestsCounter.WithLabelValue(kind).Inc()
+	p.markProxyError(w, proxyErrTrafficPaused)
+	w.Header().Set("Retry-After", strconv.Itoa(pausedRetryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error":       "traffic_paused",
+			"message":     "The service is paused for maintenance",
+			"retry_after": pausedRetryAfter,
+		})
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method != http.MethodHead {
+		w.Write(p.pausedPage)
+	}
+	return true
+}
+
+// refusePausedSOCKS 流量暂停时以"没有可接受的认证方式"拒绝SOCKS5握手并关闭连接，未暂停时返回 false
+func (p *SinglePortProxy) refusePausedSOCKS(conn net.Conn) bool {
+	if !p.trafficPaused.Load() {
+		return false
+	}
+	pausedRequestsCounter.WithLabelValue("socks5").Inc()
+	logger.Debug("Refusing SOCKS5 connection while traffic is paused",
+		"remote_addr", conn.RemoteAddr().String())
+	conn.Write([]byte{0x05, 0xff})
+	conn.Close()
+	return true
+}
+
+// handleAdminTraffic 返回当前的流量模式
+func (p *SinglePortProxy) handleAdminTraffic(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"traffic_mode": p.trafficMode()})
+}
+
+// handleAdminTrafficSet 切换流量模式，请求体 {"traffic_mode": "paused"}。作用于所有租户，只对完整权限开放
+func (p *SinglePortProxy) handleAdminTrafficSet(w http.ResponseWriter, r *http.Request) {
+	if !requireFullAdmin(w, r) {
+		return
+	}
+	var body struct {
+		TrafficMode string `json:"traffic_mode"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, drainMaxBodyLength)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if body.TrafficMode != trafficNormal && body.TrafficMode != trafficPaused {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "traffic_mode must be normal or paused"})
+		return
+	}
+	p.setTrafficMode(body.TrafficMode)
+	writeJSON(w, http.StatusOK, map[string]string{"traffic_mode": p.trafficMode()})
+}
+
+// handleAdminReady 就绪检查: 流量暂停、服务器正在停止或设置了 affects_ready 的key不在开放时段内时返回503，
+// 供负载均衡器摘除流量
+func (p *SinglePortProxy) handleAdminReady(w http.ResponseWriter, r *http.Request) {
+	stopping := p.stopping.Load()
+	closedKeys, notReadyKeys := p.closedReadyKeys(time.Now())
+	ready := !stopping && !p.trafficPaused.Load() && len(notReadyKeys) == 0
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]any{
+		"ready":        ready,
+		"traffic_mode": p.trafficMode(),
+		"stopping":     stopping,
+		"closed_keys":  closedKeys,
+	})
+}
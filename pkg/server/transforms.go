@@ -0,0 +1,66 @@
+package server
+
+import (
+	"sync"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/transform"
+)
+
+// allKeys 注册对所有key生效的改写规则时使用的key
+const allKeys = "*"
+
+// transformRegistry 每个key的请求体/响应体改写规则
+type transformRegistry struct {
+	mu    sync.RWMutex
+	rules map[string][]transform.Transform
+}
+
+// newTransformRegistry 根据配置文件中各key的 transforms 创建规则表
+func newTransformRegistry(keys map[string]*config.KeyConfig) *transformRegistry {
+	reg := &transformRegistry{rules: make(map[string][]transform.Transform)}
+	for key, kc := range keys {
+		if kc == nil {
+			continue
+		}
+		for i, tc := range kc.Transforms {
+			t, err := transform.FromConfig(tc)
+			if err != nil {
+				logger.Error("Invalid transform, ignoring",
+					"key", key,
+					"index", i,
+					"error", err)
+				continue
+			}
+			reg.rules[key] = append(reg.rules[key], t)
+		}
+	}
+	return reg
+}
+
+// add 追加一条规则，已进行中的请求不受影响
+func (reg *transformRegistry) add(key string, t transform.Transform) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	// 复制后追加，避免与正在读取的切片共享底层数组
+	rules := append([]transform.Transform(nil), reg.rules[key]...)
+	reg.rules[key] = append(rules, t)
+}
+
+// pipeline 返回对指定key生效的改写流水线，先执行对所有key生效的规则
+func (reg *transformRegistry) pipeline(key string) *transform.Pipeline {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	all, own := reg.rules[allKeys], reg.rules[key]
+	if len(all) == 0 {
+		return transform.NewPipeline(own...)
+	}
+	return transform.NewPipeline(append(append([]transform.Transform(nil), all...), own...)...)
+}
+
+// AddTransform 为指定key注册自定义的请求体/响应体改写规则，key 为 "*" 时对所有key生效。
+// 规则在配置文件声明的规则之后执行，可在服务器运行期间调用
+func (p *SinglePortProxy) AddTransform(key string, t transform.Transform) {
+	p.transforms.add(key, t)
+}
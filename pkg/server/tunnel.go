@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+	"singleproxy/pkg/protocol"
+)
+
+// nextTunnelID 用于生成连接ID
+var nextTunnelID uint64
+
+// defaultTunnelSendQueue 每个隧道连接等待写入的消息数上限 (-tunnel-send-queue)
+const defaultTunnelSendQueue = 256
+
+var (
+	// errTunnelQueueFull 连接的写入队列已满，客户端或上行链路跟不上
+	errTunnelQueueFull = errors.New("tunnel send queue full")
+	// errTunnelClosed 连接的写入协程已退出
+	errTunnelClosed = errors.New("tunnel connection closed")
+)
+
+var tunnelSendQueueFullCounter = metrics.NewCounter("singleproxy_server_tunnel_send_queue_full_total",
+	"Messages rejected because the send queue of the tunnel connection was full")
+
+// outboundMessage 等待写入客户端的消息。request 为 true 时在写入协程中按请求头索引表编码；
+// flushed 不为nil时不写入任何内容，之前入队的消息都写出后关闭它
+type outboundMessage struct {
+	msg     protocol.TunnelMessage
+	request bool
+	flushed chan struct{}
+}
+
+// tunnelConn 表示一个已注册的WebSocket隧道连接
+type tunnelConn struct {
+	id          string
+	key         string
+	conn        *websocket.Conn
+	connectedAt time.Time
+
+	// 最近一次发送或收到数据消息的时间 (UnixNano)，ping/pong 不计入，见 watchIdle
+	lastActivity atomic.Int64
+
+	// gorilla/websocket 不允许并发写入: 数据消息都经 outbound 由 writeLoop 逐条写入，
+	// 关闭帧和pong使用允许并发调用的 WriteControl
+	outbound   chan outboundMessage
+	stopWriter chan struct{}
+	stopOnce   sync.Once
+	writerDone chan struct{} // writeLoop 退出后关闭
+
+	// 已授予的公网绑定
+	bindingsMu sync.Mutex
+	bindings   []protocol.Binding
+
+	// 客户端声明支持的可选消息: MSG_TYPE_CANCEL、MSG_TYPE_TARGET_CHECK 和 MSG_TYPE_GOAWAY
+	cancelSupported      bool
+	targetCheckSupported bool
+	goAwaySupported      bool
+
+	// 已要求客户端迁移，不再为其分配新请求 (该key只剩迁移中的连接时除外)
+	draining atomic.Bool
+
+	// 握手时协商启用消息签名后发送和接收方向的签名状态，收发的每条消息都附加签名 (为nil则不签名)。
+	// authOut 只在 writeLoop 中使用，authIn 只在读取循环中使用
+	authOut *protocol.MessageAuth
+	authIn  *protocol.MessageAuth
+
+	// 握手时协商启用带序号的响应体数据块，以及该连接上校验失败的响应数
+	chunkSeq    bool
+	chunkErrors atomic.Int32
+
+	// 注册时协商的单条消息大小上限，读取限制和发送的请求消息都不超过它
+	maxFrameSize int
+
+	// 从该连接读入、尚未写给公网调用方的字节数，总用量达到上限时只暂停仍有积压的连接
+	frames *frameAccount
+
+	// 握手时协商启用请求头索引表后的编码器 (为nil则请求消息原样发送)，只在 writeLoop 中使用
+	headerEncoder *protocol.HeaderEncoder
+
+	// 该连接上违反响应消息顺序的次数，见 responseViolation
+	responseViolations atomic.Int32
+
+	// 握手时协商启用本地转发，以及该连接上进行中的本地请求 (本地请求ID → 取消函数)，见 startLocalRequest
+	localForward  bool
+	localMu       sync.Mutex
+	localRequests map[uint64]context.CancelFunc
+
+	// 握手时协商启用: 客户端可以用 MSG_TYPE_CANCEL 中止读取目标响应体失败的响应
+	responseAbort bool
+
+	// 负载均衡：客户端声明的权重、上报的目标服务状态和最近的请求结果
+	weight     int
+	targetDown atomic.Bool
+	recent     requestWindow
+}
+
+func newTunnelConn(key string, conn *websocket.Conn) *tunnelConn {
+	tc := &tunnelConn{
+		id:           fmt.Sprintf("c%d", atomic.AddUint64(&nextTunnelID, 1)),
+		key:          key,
+		conn:         conn,
+		connectedAt:  time.Now(),
+		maxFrameSize: protocol.DefaultMaxFrameSize,
+	}
+	tc.touch()
+	return tc
+}
+
+// touch 记录连接上的隧道活动: 分配请求、发送或收到数据消息
+func (t *tunnelConn) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// lastActive 返回最近一次隧道活动的时间，没有活动时为注册时间
+func (t *tunnelConn) lastActive() time.Time {
+	return time.Unix(0, t.lastActivity.Load())
+}
+
+// startWriter 按协商结果设置好连接后启动写入协程，queue 为写入队列的容量 (0为默认值)
+func (t *tunnelConn) startWriter(queue int) {
+	if queue <= 0 {
+		queue = defaultTunnelSendQueue
+	}
+	t.outbound = make(chan outboundMessage, queue)
+	t.stopWriter = make(chan struct{})
+	t.writerDone = make(chan struct{})
+	go t.writeLoop()
+}
+
+// closeWriter 读取循环退出时停止写入协程，队列中尚未写出的消息丢弃
+func (t *tunnelConn) closeWriter() {
+	if t.stopWriter != nil {
+		t.stopOnce.Do(func() { close(t.stopWriter) })
+	}
+}
+
+// writeLoop 是连接唯一的数据消息写入者。写入失败时关闭连接，读取循环随之退出并结束进行中的请求
+func (t *tunnelConn) writeLoop() {
+	defer close(t.writerDone)
+	for {
+		select {
+		case m := <-t.outbound:
+			if m.flushed != nil {
+				close(m.flushed)
+				continue
+			}
+			if err := t.write(m); err != nil {
+				logger.Warn("Failed to write to tunnel connection, closing",
+					"key", t.key,
+					"connection_id", t.id,
+					"message_id", m.msg.ID,
+					"message_type", m.msg.Type,
+					"error", err)
+				t.conn.Close()
+				return
+			}
+		case <-t.stopWriter:
+			return
+		}
+	}
+}
+
+// write 编码并写入一条消息。启用请求头索引表时在这里编码请求，保证编码器插入表项的顺序与客户端收到消息的顺序一致
+func (t *tunnelConn) write(m outboundMessage) error {
+	msg := m.msg
+	if m.request && t.headerEncoder != nil {
+		payload := t.headerEncoder.Encode(msg.Payload)
+		headerTableInputBytesCounter.Add(int64(len(msg.Payload)))
+		headerTableOutputBytesCounter.Add(int64(len(payload)))
+		msg.Payload = payload
+	}
+	data, err := protocol.SerializeTunnelMessage(msg)
+	if err != nil {
+		return err
+	}
+	if t.authOut != nil {
+		data = t.authOut.Sign(data)
+	}
+	return t.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// enqueue 把消息放入写入队列，不等待写出。队列已满时立即返回 errTunnelQueueFull 而不是阻塞调用方
+func (t *tunnelConn) enqueue(m outboundMessage) error {
+	select {
+	case <-t.writerDone:
+		return errTunnelClosed
+	default:
+	}
+	select {
+	case t.outbound <- m:
+		t.touch()
+		return nil
+	case <-t.writerDone:
+		return errTunnelClosed
+	default:
+		tunnelSendQueueFullCounter.Inc()
+		return errTunnelQueueFull
+	}
+}
+
+// enqueueWait 把消息放入写入队列，队列已满时等待直到有空位、连接关闭或 ctx 结束。
+// 用于本地请求的响应: 数据块不能像公网请求那样以503拒绝，只能等客户端读取
+func (t *tunnelConn) enqueueWait(ctx context.Context, m outboundMessage) error {
+	select {
+	case t.outbound <- m:
+		t.touch()
+		return nil
+	case <-t.writerDone:
+		return errTunnelClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush 等待之前入队的消息都写出，最多等待 timeout。用于在发送关闭帧之前送达取消等通知
+func (t *tunnelConn) flush(timeout time.Duration) {
+	if t.outbound == nil {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	flushed := make(chan struct{})
+	select {
+	case t.outbound <- outboundMessage{flushed: flushed}:
+	case <-t.writerDone:
+		return
+	case <-timer.C:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-t.writerDone:
+	case <-timer.C:
+	}
+}
+
+// sendTunnelMessage 发送一条控制消息 (绑定结果、取消、目标检查、迁移通知)
+func (t *tunnelConn) sendTunnelMessage(msg protocol.TunnelMessage) error {
+	return t.enqueue(outboundMessage{msg: msg})
+}
+
+// requestOverhead 发送请求消息时在负载之外可能增加的最大字节数
+func (t *tunnelConn) requestOverhead() int {
+	if t.headerEncoder != nil {
+		return protocol.MessageOverhead + protocol.HeaderTableOverhead
+	}
+	return protocol.MessageOverhead
+}
+
+// sendRequest 发送一条请求消息
+func (t *tunnelConn) sendRequest(msg protocol.TunnelMessage) error {
+	return t.enqueue(outboundMessage{msg: msg, request: true})
+}
+
+// grantedBindings 返回已授予绑定的副本
+func (t *tunnelConn) grantedBindings() []protocol.Binding {
+	t.bindingsMu.Lock()
+	defer t.bindingsMu.Unlock()
+	return append([]protocol.Binding(nil), t.bindings...)
+}
+
+// addBinding 记录已授予的绑定。客户端重复申请已持有的绑定时同样授予成功，这里忽略已记录的绑定
+func (t *tunnelConn) addBinding(b protocol.Binding) {
+	t.bindingsMu.Lock()
+	defer t.bindingsMu.Unlock()
+	for _, existing := range t.bindings {
+		if existing.Type == b.Type && existing.Port == b.Port && strings.EqualFold(existing.Host, b.Host) {
+			return
+		}
+	}
+	t.bindings = append(t.bindings, b)
+}
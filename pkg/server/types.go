@@ -2,10 +2,16 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"singleproxy/pkg/protocol"
 )
 
 // prefixedConn 包装连接以支持回放读取的前缀数据
@@ -63,13 +69,24 @@ func (l *singleConnListener) Addr() net.Addr {
 	return nil
 }
 
-// httpResponseWriter 实现http.ResponseWriter接口
+// errResponseFinished 请求处理结束后仍有写入，通常来自已超时或被放弃的 streamHandler
+var errResponseFinished = errors.New("response already finished")
+
+// httpResponseWriter 实现http.ResponseWriter接口。
+// 每个原始连接只处理一个请求，响应总是带 Connection: close，
+// 流水线发送的后续请求不会被读取，客户端需在新连接上重发
 type httpResponseWriter struct {
 	conn          net.Conn
+	reader        *bufio.Reader // 读取请求的缓冲，接管连接时其中已读入的数据随之交给调用方
 	header        http.Header
 	statusCode    int
 	headerWritten bool
 	hijacked      bool
+
+	// 写入可能来自处理请求的协程之外 (如隧道读循环)，mu 保证响应数据不交错，
+	// finish 之后的写入一律丢弃。finish 不等待 mu，避免被阻塞在慢连接上的写入卡住
+	mu       sync.Mutex
+	finished atomic.Bool
 }
 
 func (w *httpResponseWriter) Header() http.Header {
@@ -77,41 +94,71 @@ func (w *httpResponseWriter) Header() http.Header {
 }
 
 func (w *httpResponseWriter) WriteHeader(statusCode int) {
-	if w.headerWritten {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writeHeaderLocked(statusCode)
+}
+
+func (w *httpResponseWriter) writeHeaderLocked(statusCode int) {
+	if w.headerWritten || w.finished.Load() {
 		return
 	}
-	w.statusCode = statusCode
-	w.headerWritten = true
-
-	// 写入状态行
-	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
-
-	// 写入头部
-	for key, values := range w.header {
-		for _, value := range values {
-			fmt.Fprintf(w.conn, "%s: %s\r\n", key, value)
+	// 1xx 临时响应直接写出，之后仍可写最终响应
+	interim := statusCode >= 100 && statusCode <= 199 && statusCode != http.StatusSwitchingProtocols
+	if !interim {
+		w.statusCode = statusCode
+		w.headerWritten = true
+		if statusCode != http.StatusSwitchingProtocols {
+			w.header.Set("Connection", "close")
 		}
 	}
-	fmt.Fprintf(w.conn, "\r\n")
+
+	// 状态行和按名称排序的头部合并为一次写入
+	var buf bytes.Buffer
+	buf.WriteString(protocol.StatusLine(statusCode, ""))
+	w.header.Write(&buf)
+	buf.WriteString("\r\n")
+	w.conn.Write(buf.Bytes())
 }
 
 func (w *httpResponseWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.finished.Load() {
+		return 0, errResponseFinished
+	}
 	if !w.headerWritten {
-		w.WriteHeader(http.StatusOK)
+		w.writeHeaderLocked(http.StatusOK)
 	}
 	return w.conn.Write(data)
 }
 
+// finish 标记请求处理结束，之后的写入返回 errResponseFinished
+func (w *httpResponseWriter) finish() {
+	w.finished.Store(true)
+}
+
 // Hijacker 接口实现，用于WebSocket升级
 func (w *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if w.hijacked {
 		return nil, nil, fmt.Errorf("connection already hijacked")
 	}
 	w.hijacked = true
-	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+	reader := w.reader
+	if reader == nil {
+		reader = bufio.NewReader(w.conn)
+	}
+	return w.conn, bufio.NewReadWriter(reader, bufio.NewWriter(w.conn)), nil
 }
 
 // Flusher 接口实现，用于流式传输
+// SetReadDeadline 设置原始连接的读取期限，供 http.ResponseController 在读取请求体时使用
+func (w *httpResponseWriter) SetReadDeadline(t time.Time) error {
+	return w.conn.SetReadDeadline(t)
+}
+
 func (w *httpResponseWriter) Flush() {
 	// 对于TCP连接，数据会立即发送
 	// 这里我们可以添加一个空实现，因为底层的TCP连接会处理刷新
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPResponseWriterFinish(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	w := &httpResponseWriter{conn: server, header: make(http.Header)}
+
+	received := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		received <- string(data)
+	}()
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	w.finish()
+	// 请求结束后迟到的写入被丢弃，不会进入连接
+	if _, err := w.Write([]byte("stale")); err != errResponseFinished {
+		t.Errorf("Expected errResponseFinished, got %v", err)
+	}
+	server.Close()
+
+	got := <-received
+	if got != "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain\r\n\r\nhello" {
+		t.Errorf("Unexpected response %q", got)
+	}
+	if strings.Contains(got, "stale") {
+		t.Errorf("Stale write reached the connection")
+	}
+}
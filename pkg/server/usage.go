@@ -0,0 +1,507 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+const (
+	defaultUsageRetentionDays = 400
+	usageSaveInterval         = time.Minute
+	usageQueueSize            = 4096
+	usageDayLayout            = "2006-01-02"
+	usageMonthLayout          = "2006-01"
+)
+
+// usageLatencyBounds 延迟直方图各区间的上界，超过最后一个上界的请求计入末尾的溢出区间
+var usageLatencyBounds = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+var (
+	publicRequestsCounter = metrics.NewCounter("singleproxy_server_public_requests_total",
+		"Public requests forwarded to tunnel keys")
+	publicBytesInCounter = metrics.NewCounter("singleproxy_server_public_request_bytes_total",
+		"Request body bytes received from public clients")
+	publicBytesOutCounter = metrics.NewCounter("singleproxy_server_public_response_bytes_total",
+		"Response body bytes written to public clients")
+	usageDroppedCounter = metrics.NewCounter("singleproxy_server_usage_dropped_total",
+		"Request stats dropped because the usage aggregation queue was full")
+)
+
+// requestStats 单个公网请求的统计，同时用于指标和按天汇总的用量
+type requestStats struct {
+	key      string
+	method   string
+	path     string
+	start    time.Time
+	duration time.Duration
+	status   int // 0 表示未写出响应
+	aborted  bool
+	bytesIn  int64
+	bytesOut int64
+
+	// 以下字段只用于访问日志
+	clientIP   string
+	keySource  string
+	proxyError proxyErrorKind
+
+	tlsFingerprint string
+	scheme         string // 公网请求的协议，经可信代理时取自 X-Forwarded-Proto
+	clientCert     string // 客户端证书的主题
+	backend        string // X-Tunnel-Backend 指定的连接ID
+}
+
+// failed 5xx 响应和被中断的响应计为错误
+func (s requestStats) failed() bool {
+	return s.aborted || s.status == 0 || s.status >= 500
+}
+
+// recordRequest 更新指标并提交给用量汇总
+func (p *SinglePortProxy) recordRequest(s requestStats) {
+	publicRequestsCounter.Inc()
+	publicBytesInCounter.Add(s.bytesIn)
+	publicBytesOutCounter.Add(s.bytesOut)
+	responseSizeHistogram.Observe(p.labelKey(s.key), s.bytesOut)
+	p.topResponses.record(s.key, s.method, s.path, s.bytesOut)
+	p.usage.record(s)
+	p.accessLogs.record(s)
+}
+
+// usageBucket 一个key在一段时间内的用量
+type usageBucket struct {
+	Requests int64   `json:"requests"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+	Errors   int64   `json:"errors"`
+	Latency  []int64 `json:"latency"` // 各延迟区间的请求数，区间见 usageLatencyBounds
+}
+
+func (b *usageBucket) add(s requestStats) {
+	b.Requests++
+	b.BytesIn += s.bytesIn
+	b.BytesOut += s.bytesOut
+	if s.failed() {
+		b.Errors++
+	}
+	if len(b.Latency) != len(usageLatencyBounds)+1 {
+		b.Latency = append(b.Latency, make([]int64, len(usageLatencyBounds)+1-len(b.Latency))...)
+	}
+	i := sort.Search(len(usageLatencyBounds), func(i int) bool { return s.duration <= usageLatencyBounds[i] })
+	b.Latency[i]++
+}
+
+func (b *usageBucket) merge(o *usageBucket) {
+	b.Requests += o.Requests
+	b.BytesIn += o.BytesIn
+	b.BytesOut += o.BytesOut
+	b.Errors += o.Errors
+	for i, n := range o.Latency {
+		if i >= len(b.Latency) {
+			b.Latency = append(b.Latency, 0)
+		}
+		b.Latency[i] += n
+	}
+}
+
+// p95 按直方图估算第95百分位延迟，返回所在区间的上界
+func (b *usageBucket) p95() time.Duration {
+	var total int64
+	for _, n := range b.Latency {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	threshold := (total*95 + 99) / 100
+	var seen int64
+	for i, n := range b.Latency {
+		seen += n
+		if seen >= threshold && i < len(usageLatencyBounds) {
+			return usageLatencyBounds[i]
+		}
+	}
+	return usageLatencyBounds[len(usageLatencyBounds)-1]
+}
+
+// usagePoint 用量时间序列中的一个点
+type usagePoint struct {
+	Period       string  `json:"period"` // 2006-01-02 或 2006-01
+	Key          string  `json:"key"`
+	Requests     int64   `json:"requests"`
+	BytesIn      int64   `json:"bytes_in"`
+	BytesOut     int64   `json:"bytes_out"`
+	Errors       int64   `json:"errors"`
+	P95LatencyMs float64 `json:"p95_latency_ms"`
+}
+
+// usageState 持久化文件的内容
+type usageState struct {
+	Version int                                `json:"version"`
+	Days    map[string]map[string]*usageBucket `json:"days"` // key -> UTC日期 -> 用量
+}
+
+// usageRecorder 在后台将请求统计按 key 和 UTC 日期汇总，定期写入持久化文件
+type usageRecorder struct {
+	path      string
+	retention int
+	records   chan requestStats
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	now       func() time.Time
+
+	mu    sync.Mutex
+	days  map[string]map[string]*usageBucket
+	dirty bool
+}
+
+// newUsageRecorder 加载已有的用量并启动汇总协程，path 为空时只保存在内存
+func newUsageRecorder(path string, retentionDays int) *usageRecorder {
+	if retentionDays <= 0 {
+		retentionDays = defaultUsageRetentionDays
+	}
+	u := &usageRecorder{
+		path:      path,
+		retention: retentionDays,
+		records:   make(chan requestStats, usageQueueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		now:       time.Now,
+		days:      make(map[string]map[string]*usageBucket),
+	}
+	if path != "" {
+		if err := u.load(); err != nil {
+			logger.Error("Failed to load usage file, starting with empty usage",
+				"usage_file", path,
+				"error", err)
+		}
+	}
+	go u.run()
+	return u
+}
+
+// record 提交一条请求统计，队列已满时丢弃，不阻塞请求处理
+func (u *usageRecorder) record(s requestStats) {
+	select {
+	case u.records <- s:
+	default:
+		usageDroppedCounter.Inc()
+	}
+}
+
+func (u *usageRecorder) run() {
+	defer close(u.done)
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case s := <-u.records:
+			u.add(s)
+		case <-ticker.C:
+			u.prune()
+			u.saveIfDirty()
+		case <-u.stop:
+			for {
+				select {
+				case s := <-u.records:
+					u.add(s)
+				default:
+					u.prune()
+					u.saveIfDirty()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close 停止汇总协程并写入剩余的用量
+func (u *usageRecorder) close() {
+	u.closeOnce.Do(func() { close(u.stop) })
+	<-u.done
+}
+
+func (u *usageRecorder) add(s requestStats) {
+	day := s.start.UTC().Format(usageDayLayout)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	byDay := u.days[s.key]
+	if byDay == nil {
+		byDay = make(map[string]*usageBucket)
+		u.days[s.key] = byDay
+	}
+	b := byDay[day]
+	if b == nil {
+		b = &usageBucket{}
+		byDay[day] = b
+	}
+	b.add(s)
+	u.dirty = true
+}
+
+// prune 删除超出保留期的数据
+func (u *usageRecorder) prune() {
+	cutoff := u.now().UTC().AddDate(0, 0, -u.retention).Format(usageDayLayout)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, byDay := range u.days {
+		for day := range byDay {
+			if day < cutoff {
+				delete(byDay, day)
+				u.dirty = true
+			}
+		}
+		if len(byDay) == 0 {
+			delete(u.days, key)
+		}
+	}
+}
+
+func (u *usageRecorder) load() error {
+	data, err := os.ReadFile(u.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state usageState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for key, byDay := range state.Days {
+		if len(byDay) > 0 {
+			u.days[key] = byDay
+		}
+	}
+	return nil
+}
+
+func (u *usageRecorder) saveIfDirty() {
+	if u.path == "" {
+		return
+	}
+	u.mu.Lock()
+	if !u.dirty {
+		u.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(usageState{Version: 1, Days: u.days})
+	u.dirty = false
+	u.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(u.path, data)
+	}
+	if err != nil {
+		logger.Error("Failed to save usage file",
+			"usage_file", u.path,
+			"error", err)
+		u.mu.Lock()
+		u.dirty = true
+		u.mu.Unlock()
+	}
+}
+
+// writeFileAtomic 先写临时文件再重命名，避免进程中断时留下不完整的文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// series 返回 [from, to] 日期范围内的用量，interval 为 "month" 时按自然月合并。
+// allow 过滤调用方有权查看的key
+func (u *usageRecorder) series(allow func(key string) bool, from, to time.Time, interval string) []usagePoint {
+	first, last := from.UTC().Format(usageDayLayout), to.UTC().Format(usageDayLayout)
+	merged := make(map[[2]string]*usageBucket)
+
+	u.mu.Lock()
+	for key, byDay := range u.days {
+		if !allow(key) {
+			continue
+		}
+		for day, b := range byDay {
+			if day < first || day > last {
+				continue
+			}
+			period := day
+			if interval == "month" {
+				period = day[:len(usageMonthLayout)]
+			}
+			id := [2]string{period, key}
+			if merged[id] == nil {
+				merged[id] = &usageBucket{}
+			}
+			merged[id].merge(b)
+		}
+	}
+	u.mu.Unlock()
+
+	points := make([]usagePoint, 0, len(merged))
+	for id, b := range merged {
+		points = append(points, usagePoint{
+			Period:       id[0],
+			Key:          id[1],
+			Requests:     b.Requests,
+			BytesIn:      b.BytesIn,
+			BytesOut:     b.BytesOut,
+			Errors:       b.Errors,
+			P95LatencyMs: float64(b.p95()) / float64(time.Millisecond),
+		})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].Period != points[j].Period {
+			return points[i].Period < points[j].Period
+		}
+		return points[i].Key < points[j].Key
+	})
+	return points
+}
+
+// handleAdminUsage 查询按天或按月汇总的用量: GET /admin/usage?key=&from=&to=&interval=day|month&format=json|csv。
+// 日期为 UTC 的 2006-01-02，默认最近30天；未指定key时返回令牌有权查看的所有key
+func (p *SinglePortProxy) handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	to := p.usage.now().UTC()
+	from := to.AddDate(0, 0, -29)
+	for name, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(usageDayLayout, v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": name + " must be a date like 2006-01-02"})
+				return
+			}
+			*dst = t
+		}
+	}
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if interval != "day" && interval != "month" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "interval must be day or month"})
+		return
+	}
+
+	principal := adminPrincipalFrom(r)
+	allow := principal.allows
+	if key := query.Get("key"); key != "" {
+		if !authorizeKey(w, r, key) {
+			return
+		}
+		allow = func(k string) bool { return k == key }
+	}
+	points := p.usage.series(allow, from, to, interval)
+
+	if query.Get("format") != "csv" {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"from":     from.Format(usageDayLayout),
+			"to":       to.Format(usageDayLayout),
+			"interval": interval,
+			"usage":    points,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"period", "key", "requests", "bytes_in", "bytes_out", "errors", "p95_latency_ms"})
+	for _, pt := range points {
+		cw.Write([]string{
+			pt.Period,
+			pt.Key,
+			strconv.FormatInt(pt.Requests, 10),
+			strconv.FormatInt(pt.BytesIn, 10),
+			strconv.FormatInt(pt.BytesOut, 10),
+			strconv.FormatInt(pt.Errors, 10),
+			strconv.FormatFloat(pt.P95LatencyMs, 'f', -1, 64),
+		})
+	}
+	cw.Flush()
+}
+
+// usageWriter 记录写回公网用户的状态码和响应体字节数
+type usageWriter struct {
+	http.ResponseWriter
+	status     int
+	bytes      int64
+	aborted    bool
+	proxyError proxyErrorKind // 代理自身产生错误响应的原因
+}
+
+func (w *usageWriter) WriteHeader(status int) {
+	// 1xx 临时响应之后还有最终状态码
+	if w.status == 0 && (status < 100 || status > 199 || status == http.StatusSwitchingProtocols) {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *usageWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *usageWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack 只在超时中断响应时使用，因此同时标记为中断
+func (w *usageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.aborted = true
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+func (w *usageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody 记录读取的请求体字节数
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
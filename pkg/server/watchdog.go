@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/metrics"
+)
+
+// defaultWatchdogInterval 未配置 watchdog.interval 时的采样间隔
+const defaultWatchdogInterval = 30 * time.Second
+
+// watchdogGauges 看门狗每次采样更新的指标，按采样项名称索引
+var watchdogGauges = map[string]*metrics.Gauge{
+	"heap_bytes":      metrics.NewGauge("singleproxy_server_heap_alloc_bytes", "Bytes of live heap objects at the last watchdog sample"),
+	"sys_bytes":       metrics.NewGauge("singleproxy_server_sys_bytes", "Bytes of memory obtained from the OS at the last watchdog sample"),
+	"goroutines":      metrics.NewGauge("singleproxy_server_goroutines", "Goroutines at the last watchdog sample"),
+	"tunnel_keys":     metrics.NewGauge("singleproxy_server_tunnel_keys", "Keys with at least one WebSocket tunnel at the last watchdog sample"),
+	"http_tunnels":    metrics.NewGauge("singleproxy_server_http_tunnels", "HTTP long-poll tunnels at the last watchdog sample"),
+	"stream_handlers": metrics.NewGauge("singleproxy_server_stream_handlers", "Public requests waiting for a tunnel response at the last watchdog sample"),
+	"rate_limiters":   metrics.NewGauge("singleproxy_server_rate_limiters", "Per-key and per-IP rate limiters held in memory at the last watchdog sample"),
+}
+
+var (
+	watchdogExceededCounter = metrics.NewCounter("singleproxy_server_watchdog_threshold_exceeded_total",
+		"Watchdog samples where at least one value exceeded its soft or hard threshold")
+	watchdogHeapProfilesCounter = metrics.NewCounter("singleproxy_server_watchdog_heap_profiles_total",
+		"Heap profiles written by the watchdog after a hard threshold was crossed")
+)
+
+// watchdogValue 一项采样值，name 与 watchdogGauges 和阈值配置的字段名一致
+type watchdogValue struct {
+	name  string
+	value int64
+}
+
+// watchdog 定期采样内存和内部表的大小，超过阈值时记录快照或写入堆profile
+type watchdog struct {
+	interval     time.Duration
+	dir          string
+	freeOSMemory bool
+	soft, hard   map[string]int64
+	sample       func() []watchdogValue
+	now          func() time.Time
+
+	// 上次采样是否已超过硬阈值；回落到硬阈值以下之前不重复写入profile
+	hardExceeded bool
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newWatchdog 启动看门狗协程，未配置时返回nil
+func newWatchdog(cfg *config.WatchdogConfig, sample func() []watchdogValue) *watchdog {
+	if cfg == nil {
+		return nil
+	}
+	w := &watchdog{
+		interval:     time.Duration(cfg.Interval),
+		dir:          cfg.DataDir,
+		freeOSMemory: cfg.FreeOSMemory,
+		soft:         watchdogThresholds(cfg.Soft),
+		hard:         watchdogThresholds(cfg.Hard),
+		sample:       sample,
+		now:          time.Now,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if w.interval <= 0 {
+		w.interval = defaultWatchdogInterval
+	}
+	if w.dir == "" {
+		w.dir = filepath.Join(os.TempDir(), "singleproxy-profiles")
+	}
+	logger.Info("Memory watchdog started",
+		"interval", w.interval,
+		"data_dir", w.dir,
+		"free_os_memory", w.freeOSMemory)
+	go w.run()
+	return w
+}
+
+// watchdogThresholds 按采样项名称整理阈值，0 表示不检查
+func watchdogThresholds(t config.WatchdogThresholds) map[string]int64 {
+	return map[string]int64{
+		"heap_bytes":      t.HeapBytes,
+		"sys_bytes":       t.SysBytes,
+		"goroutines":      t.Goroutines,
+		"tunnel_keys":     t.TunnelKeys,
+		"http_tunnels":    t.HTTPTunnels,
+		"stream_handlers": t.StreamHandlers,
+		"rate_limiters":   t.RateLimiters,
+	}
+}
+
+func (w *watchdog) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// close 停止看门狗协程，w 为nil时不做任何事
+func (w *watchdog) close() {
+	if w == nil {
+		return
+	}
+	w.closeOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// check 采样一次: 更新指标，超过软阈值时输出快照，刚超过硬阈值时写入堆profile
+func (w *watchdog) check() {
+	values := w.sample()
+	var soft, hard []string
+	snapshot := make([]any, 0, 2*len(values)+4)
+	for _, v := range values {
+		if g := watchdogGauges[v.name]; g != nil {
+			g.Set(v.value)
+		}
+		snapshot = append(snapshot, v.name, v.value)
+		if limit := w.hard[v.name]; limit > 0 && v.value > limit {
+			hard = append(hard, v.name)
+		} else if limit := w.soft[v.name]; limit > 0 && v.value > limit {
+			soft = append(soft, v.name)
+		}
+	}
+
+	if len(soft) > 0 || len(hard) > 0 {
+		watchdogExceededCounter.Inc()
+		logger.Warn("Memory watchdog threshold exceeded",
+			append(snapshot, "soft_exceeded", soft, "hard_exceeded", hard)...)
+	}
+
+	crossed := len(hard) > 0 && !w.hardExceeded
+	w.hardExceeded = len(hard) > 0
+	if !crossed {
+		return
+	}
+	path, err := w.writeHeapProfile()
+	if err != nil {
+		logger.Error("Failed to write heap profile",
+			"data_dir", w.dir,
+			"error", err)
+	} else {
+		watchdogHeapProfilesCounter.Inc()
+		logger.Warn("Wrote heap profile after hard threshold was crossed",
+			"path", path,
+			"hard_exceeded", hard)
+	}
+	if w.freeOSMemory {
+		debug.FreeOSMemory()
+		logger.Info("Returned freed memory to the OS after hard threshold was crossed")
+	}
+}
+
+// writeHeapProfile 把堆profile写入数据目录，返回文件路径
+func (w *watchdog) writeHeapProfile() (string, error) {
+	if err := os.MkdirAll(w.dir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(w.dir, fmt.Sprintf("heap-%s.pprof", w.now().UTC().Format("20060102-150405")))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// watchdogSample 采样运行时内存、协程数和服务器内部表的大小
+func (p *SinglePortProxy) watchdogSample() []watchdogValue {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	p.connsMu.RLock()
+	tunnelKeys := len(p.clientConns)
+	p.connsMu.RUnlock()
+
+	p.httpTunnelMgr.mu.RLock()
+	httpTunnels := len(p.httpTunnelMgr.clients)
+	p.httpTunnelMgr.mu.RUnlock()
+
+	p.handlersMu.Lock()
+	streamHandlers := len(p.streamHandlers)
+	p.handlersMu.Unlock()
+
+	p.rateLimitMu.RLock()
+	limiters := len(p.keyLimiters) + len(p.ipLimiters)
+	p.rateLimitMu.RUnlock()
+
+	return []watchdogValue{
+		{"heap_bytes", int64(ms.HeapAlloc)},
+		{"sys_bytes", int64(ms.Sys)},
+		{"goroutines", int64(runtime.NumGoroutine())},
+		{"tunnel_keys", int64(tunnelKeys)},
+		{"http_tunnels", int64(httpTunnels)},
+		{"stream_handlers", int64(streamHandlers)},
+		{"rate_limiters", int64(limiters)},
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestWatchdogThresholds(t *testing.T) {
+	dir := t.TempDir()
+	var goroutines int64
+	w := &watchdog{
+		dir:  dir,
+		soft: watchdogThresholds(config.WatchdogThresholds{Goroutines: 10}),
+		hard: watchdogThresholds(config.WatchdogThresholds{Goroutines: 20}),
+		sample: func() []watchdogValue {
+			return []watchdogValue{{"goroutines", goroutines}, {"stream_handlers", 3}}
+		},
+		now: func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+	profiles := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Failed to read data dir: %v", err)
+		}
+		return len(entries)
+	}
+
+	// 软阈值只记录快照
+	goroutines = 15
+	soft := watchdogExceededCounter.Value()
+	w.check()
+	if watchdogExceededCounter.Value() != soft+1 || profiles() != 0 {
+		t.Errorf("Expected soft threshold to log without a profile")
+	}
+	if got := watchdogGauges["goroutines"].Value(); got != 15 {
+		t.Errorf("Expected goroutines gauge 15, got %d", got)
+	}
+
+	// 刚超过硬阈值时写入一次profile，持续超过时不重复写入
+	goroutines = 25
+	w.check()
+	w.check()
+	if profiles() != 1 {
+		t.Fatalf("Expected one heap profile, got %d", profiles())
+	}
+	if _, err := os.Stat(dir + "/heap-20260102-030405.pprof"); err != nil {
+		t.Errorf("Expected heap profile named by sample time: %v", err)
+	}
+
+	// 回落后再次超过时重新写入
+	goroutines = 5
+	w.check()
+	goroutines = 25
+	w.now = func() time.Time { return time.Date(2026, 1, 2, 4, 0, 0, 0, time.UTC) }
+	w.check()
+	if profiles() != 2 {
+		t.Errorf("Expected a second heap profile after recovery, got %d", profiles())
+	}
+}
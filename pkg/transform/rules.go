@@ -0,0 +1,220 @@
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"singleproxy/pkg/config"
+)
+
+// defaultContentTypes 未指定 content_types 时改写的文本类型
+var defaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-www-form-urlencoded",
+	"*+json",
+	"*+xml",
+}
+
+// FromConfig 根据配置创建内置改写规则
+func FromConfig(c *config.TransformConfig) (Transform, error) {
+	m := matcher{
+		request:      c.Direction == "request",
+		pathPrefix:   c.PathPrefix,
+		contentTypes: c.ContentTypes,
+	}
+	if len(m.contentTypes) == 0 {
+		m.contentTypes = defaultContentTypes
+	}
+	if c.From == "" {
+		return nil, fmt.Errorf("transform %q requires from", c.Type)
+	}
+
+	switch c.Type {
+	case "replace":
+		return &replaceRule{matcher: m, from: []byte(c.From), to: []byte(c.To)}, nil
+	case "regex":
+		re, err := regexp.Compile(c.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", c.From, err)
+		}
+		maxBody := c.MaxBodyBytes
+		if maxBody <= 0 {
+			maxBody = DefaultMaxBodyBytes
+		}
+		return &regexRule{matcher: m, re: re, to: []byte(c.To), maxBody: maxBody}, nil
+	case "url_rewrite":
+		return &urlRewriteRule{matcher: m, from: c.From, to: c.To}, nil
+	}
+	return nil, fmt.Errorf("unknown transform type %q", c.Type)
+}
+
+// matcher 内置规则共用的方向、路由和内容类型匹配
+type matcher struct {
+	request      bool
+	pathPrefix   string
+	contentTypes []string
+}
+
+func (m matcher) MatchRequest(r *http.Request) bool {
+	return m.request && m.route(r) && m.contentType(r.Header.Get("Content-Type"))
+}
+
+func (m matcher) MatchResponse(r *http.Request, header http.Header) bool {
+	return !m.request && m.route(r) && m.contentType(header.Get("Content-Type"))
+}
+
+func (m matcher) route(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, m.pathPrefix)
+}
+
+// contentType 按媒体类型匹配，支持 "text/*" 和 "*+json" 形式的通配
+func (m matcher) contentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range m.contentTypes {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == mediaType:
+			return true
+		case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")):
+			return true
+		case strings.HasPrefix(pattern, "*+") && strings.HasSuffix(mediaType, pattern[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// replaceRule 固定字符串替换，跨数据块边界的匹配同样会被替换
+type replaceRule struct {
+	matcher
+	from, to []byte
+}
+
+func (r *replaceRule) NewStage() Stage {
+	return &replaceStage{from: r.from, to: r.to}
+}
+
+type replaceStage struct {
+	from, to []byte
+	carry    []byte // 可能是下一块中匹配开头的尾部数据
+}
+
+func (s *replaceStage) Write(p []byte) []byte {
+	data := append(s.carry, p...)
+	// 末尾 len(from)-1 字节可能与后续数据组成匹配，暂不输出
+	cut := len(data) - (len(s.from) - 1)
+	var out []byte
+	i := 0
+	for i < cut {
+		j := bytes.Index(data[i:], s.from)
+		if j < 0 || i+j >= cut {
+			break
+		}
+		out = append(out, data[i:i+j]...)
+		out = append(out, s.to...)
+		i += j + len(s.from)
+	}
+	if i < cut {
+		out = append(out, data[i:cut]...)
+		i = cut
+	}
+	s.carry = append([]byte(nil), data[i:]...)
+	return out
+}
+
+func (s *replaceStage) Close() []byte {
+	out := bytes.ReplaceAll(s.carry, s.from, s.to)
+	s.carry = nil
+	return out
+}
+
+// regexRule 正则替换，需要缓冲完整消息体，超过 maxBody 时原样转发
+type regexRule struct {
+	matcher
+	re      *regexp.Regexp
+	to      []byte
+	maxBody int
+}
+
+func (r *regexRule) NewStage() Stage {
+	return &regexStage{re: r.re, to: r.to, maxBody: r.maxBody}
+}
+
+type regexStage struct {
+	re          *regexp.Regexp
+	to          []byte
+	maxBody     int
+	buf         bytes.Buffer
+	passthrough bool
+}
+
+func (s *regexStage) Write(p []byte) []byte {
+	if s.passthrough {
+		return p
+	}
+	if s.buf.Len()+len(p) > s.maxBody {
+		s.passthrough = true
+		out := append(s.buf.Bytes(), p...)
+		s.buf = bytes.Buffer{}
+		return out
+	}
+	s.buf.Write(p)
+	return nil
+}
+
+func (s *regexStage) Close() []byte {
+	if s.passthrough {
+		return nil
+	}
+	return s.re.ReplaceAll(s.buf.Bytes(), s.to)
+}
+
+// urlRewriteRule 将内部地址改写为公网地址。
+// 响应体中同时替换 JSON 转义形式 (http:\/\/host)，Location 等响应头按前缀改写
+type urlRewriteRule struct {
+	matcher
+	from, to string
+}
+
+func (r *urlRewriteRule) NewStage() Stage {
+	escape := func(s string) []byte { return []byte(strings.ReplaceAll(s, "/", `\/`)) }
+	return chain{
+		&replaceStage{from: []byte(r.from), to: []byte(r.to)},
+		&replaceStage{from: escape(r.from), to: escape(r.to)},
+	}
+}
+
+func (r *urlRewriteRule) RewriteHeader(req *http.Request, header http.Header) {
+	if r.request || !r.route(req) {
+		return
+	}
+	for _, name := range []string{"Location", "Content-Location"} {
+		if v := header.Get(name); strings.HasPrefix(v, r.from) {
+			header.Set(name, r.to+strings.TrimPrefix(v, r.from))
+		}
+	}
+}
+
+// chain 依次执行的多个阶段
+type chain []Stage
+
+func (c chain) Write(p []byte) []byte {
+	for _, st := range c {
+		p = st.Write(p)
+	}
+	return p
+}
+
+func (c chain) Close() []byte {
+	return finish(c, nil)
+}
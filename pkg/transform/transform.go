@@ -0,0 +1,212 @@
+// Package transform 在服务器转发时改写请求体和响应体。
+// 内置规则由配置文件按key声明，嵌入方也可以实现 Transform 并通过服务器注册自定义改写
+package transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxBodyBytes 需要缓冲完整消息体时的默认上限 (正则改写、gzip 响应)，超出后原样转发
+const DefaultMaxBodyBytes = 1 << 20
+
+// Transform 一个改写规则
+type Transform interface {
+	// MatchRequest 判断是否改写发往目标服务的请求体
+	MatchRequest(r *http.Request) bool
+	// MatchResponse 判断是否改写目标返回的响应体，r 为对应的公网请求
+	MatchResponse(r *http.Request, header http.Header) bool
+	// NewStage 为一个消息体创建改写状态
+	NewStage() Stage
+}
+
+// Stage 单个消息体的流式改写状态，数据块按顺序写入
+type Stage interface {
+	// Write 处理一段数据，返回可以立即发送的部分，其余部分可留待后续数据块一起处理
+	Write(p []byte) []byte
+	// Close 在消息体结束时返回剩余的数据
+	Close() []byte
+}
+
+// HeaderRewriter 可选接口，在响应头发出前改写响应头，不受响应体类型限制
+type HeaderRewriter interface {
+	RewriteHeader(r *http.Request, header http.Header)
+}
+
+// Pipeline 按顺序执行的一组改写规则，nil 表示不做改写
+type Pipeline struct {
+	transforms []Transform
+}
+
+// NewPipeline 创建改写流水线，没有规则时返回nil
+func NewPipeline(transforms ...Transform) *Pipeline {
+	if len(transforms) == 0 {
+		return nil
+	}
+	return &Pipeline{transforms: transforms}
+}
+
+// Response 为响应体创建改写流，并相应地修改即将发出的响应头。
+// 没有规则匹配、响应没有响应体，或编码/字符集无法处理时返回nil，响应体原样转发。
+// 206 分段响应改写后字节位置与完整对象不一致，总是原样转发
+func (p *Pipeline) Response(r *http.Request, status int, header http.Header) *Stream {
+	if p == nil {
+		return nil
+	}
+	for _, t := range p.transforms {
+		if hr, ok := t.(HeaderRewriter); ok {
+			hr.RewriteHeader(r, header)
+		}
+	}
+	if r.Method == http.MethodHead || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent {
+		return nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "identity" && encoding != "gzip" {
+		return nil
+	}
+	if !asciiCompatible(header.Get("Content-Type")) {
+		return nil
+	}
+	var stages []Stage
+	for _, t := range p.transforms {
+		if t.MatchResponse(r, header) {
+			stages = append(stages, t.NewStage())
+		}
+	}
+	if len(stages) == 0 {
+		return nil
+	}
+
+	// 改写后长度未知，改为分块或以关闭连接结束
+	header.Del("Content-Length")
+	// 改写后的内容不能按目标服务的字节位置续传：不再声明支持分段请求，
+	// 并将 ETag 降为弱校验，使带 If-Range 的续传请求拿到完整响应
+	header.Del("Accept-Ranges")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	return &Stream{stages: stages, gzip: encoding == "gzip", maxBuffer: DefaultMaxBodyBytes}
+}
+
+// Request 改写请求体并更新 Content-Length。
+// 请求体超过 DefaultMaxBodyBytes、带有 Content-Encoding 或字符集无法处理时保持不变
+func (p *Pipeline) Request(r *http.Request) error {
+	if p == nil || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	if r.Header.Get("Content-Encoding") != "" || !asciiCompatible(r.Header.Get("Content-Type")) {
+		return nil
+	}
+	var stages []Stage
+	for _, t := range p.transforms {
+		if t.MatchRequest(r) {
+			stages = append(stages, t.NewStage())
+		}
+	}
+	if len(stages) == 0 {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, DefaultMaxBodyBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > DefaultMaxBodyBytes {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil
+	}
+
+	body = finish(stages, body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// Stream 单个响应体的改写流
+type Stream struct {
+	stages      []Stage
+	gzip        bool
+	maxBuffer   int
+	buf         bytes.Buffer // gzip 响应需要缓冲完整的压缩数据
+	passthrough bool         // 超出缓冲上限后原样转发剩余数据
+}
+
+// Write 处理一段响应体，返回可以立即发送的数据
+func (s *Stream) Write(p []byte) []byte {
+	if s.passthrough {
+		return p
+	}
+	if !s.gzip {
+		for _, st := range s.stages {
+			p = st.Write(p)
+		}
+		return p
+	}
+	if s.buf.Len()+len(p) > s.maxBuffer {
+		s.passthrough = true
+		out := append(s.buf.Bytes(), p...)
+		s.buf = bytes.Buffer{}
+		return out
+	}
+	s.buf.Write(p)
+	return nil
+}
+
+// Close 在响应体结束时返回剩余的数据
+func (s *Stream) Close() []byte {
+	if s.passthrough {
+		return nil
+	}
+	if !s.gzip {
+		return finish(s.stages, nil)
+	}
+
+	// 解压、改写后重新压缩，数据损坏时原样发送
+	zr, err := gzip.NewReader(bytes.NewReader(s.buf.Bytes()))
+	if err != nil {
+		return s.buf.Bytes()
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		return s.buf.Bytes()
+	}
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	zw.Write(finish(s.stages, plain))
+	zw.Close()
+	return out.Bytes()
+}
+
+// finish 将最后一段数据依次送入各阶段并结束它们
+func finish(stages []Stage, p []byte) []byte {
+	for _, st := range stages {
+		p = append(st.Write(p), st.Close()...)
+	}
+	return p
+}
+
+// asciiCompatible 判断内容的字符集是否兼容ASCII，按字节改写 UTF-16 等编码会破坏内容
+func asciiCompatible(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	charset := strings.ToLower(params["charset"])
+	return !strings.HasPrefix(charset, "utf-16") && !strings.HasPrefix(charset, "utf-32") &&
+		!strings.HasPrefix(charset, "ucs-")
+}
@@ -0,0 +1,146 @@
+package transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+func mustRule(t *testing.T, c config.TransformConfig) Transform {
+	t.Helper()
+	rule, err := FromConfig(&c)
+	if err != nil {
+		t.Fatalf("FromConfig failed: %v", err)
+	}
+	return rule
+}
+
+// runResponse 按给定分块将响应体送入改写流，返回最终发出的响应体
+func runResponse(t *testing.T, p *Pipeline, header http.Header, chunks ...string) string {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/page", nil)
+	stream := p.Response(r, http.StatusOK, header)
+	if stream == nil {
+		return strings.Join(chunks, "")
+	}
+	var out []byte
+	for _, c := range chunks {
+		out = append(out, stream.Write([]byte(c))...)
+	}
+	return string(append(out, stream.Close()...))
+}
+
+func TestReplaceAcrossChunkBoundaries(t *testing.T) {
+	p := NewPipeline(mustRule(t, config.TransformConfig{Type: "replace", From: "</head>", To: "<script>x</script></head>"}))
+	header := http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Content-Length": {"40"}}
+
+	got := runResponse(t, p, header, "<html><head><title>t</title></he", "ad><body></", "head></body>")
+	want := "<html><head><title>t</title><script>x</script></head><body><script>x</script></head></body>"
+	if got != want {
+		t.Errorf("Unexpected body\n got: %s\nwant: %s", got, want)
+	}
+	if header.Get("Content-Length") != "" {
+		t.Errorf("Content-Length should be removed from transformed responses")
+	}
+}
+
+func TestResponseSkipsUnmatchedContent(t *testing.T) {
+	p := NewPipeline(mustRule(t, config.TransformConfig{Type: "replace", From: "a", To: "b"}))
+	for _, header := range []http.Header{
+		{"Content-Type": {"image/png"}},
+		{"Content-Type": {"text/plain; charset=utf-16"}},
+		{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if p.Response(r, http.StatusOK, header) != nil {
+			t.Errorf("Expected no transform for %v", header)
+		}
+	}
+	r := httptest.NewRequest("HEAD", "/", nil)
+	if p.Response(r, http.StatusOK, http.Header{"Content-Type": {"text/plain"}}) != nil {
+		t.Errorf("Expected no transform for HEAD responses")
+	}
+}
+
+func TestResponseRangeHandling(t *testing.T) {
+	p := NewPipeline(mustRule(t, config.TransformConfig{Type: "replace", From: "a", To: "b"}))
+	r := httptest.NewRequest("GET", "/", nil)
+	partial := http.Header{"Content-Type": {"text/plain"}, "Content-Range": {"bytes 0-9/100"}}
+	if p.Response(r, http.StatusPartialContent, partial) != nil {
+		t.Errorf("Expected 206 responses to pass through unchanged")
+	}
+
+	header := http.Header{"Content-Type": {"text/plain"}, "Accept-Ranges": {"bytes"}, "Etag": {`"v1"`}}
+	if p.Response(r, http.StatusOK, header) == nil {
+		t.Fatal("Expected transform for full response")
+	}
+	if header.Get("Accept-Ranges") != "" || header.Get("ETag") != `W/"v1"` {
+		t.Errorf("Expected range support to be withdrawn, got %v", header)
+	}
+}
+
+func TestRegexPassthroughOverLimit(t *testing.T) {
+	rule := mustRule(t, config.TransformConfig{Type: "regex", From: `v(\d+)`, To: "version-${1}", MaxBodyBytes: 16})
+	p := NewPipeline(rule)
+
+	small := runResponse(t, p, http.Header{"Content-Type": {"text/plain"}}, "v1 ", "v2")
+	if small != "version-1 version-2" {
+		t.Errorf("Unexpected regex result %q", small)
+	}
+	large := runResponse(t, p, http.Header{"Content-Type": {"text/plain"}}, "v1 0123456789", "v2 0123456789")
+	if large != "v1 0123456789v2 0123456789" {
+		t.Errorf("Expected oversized body to pass through unchanged, got %q", large)
+	}
+}
+
+func TestGzipResponseRoundTrip(t *testing.T) {
+	p := NewPipeline(mustRule(t, config.TransformConfig{Type: "replace", From: "internal", To: "public"}))
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("served by internal host"))
+	zw.Close()
+
+	data := compressed.String()
+	got := runResponse(t, p, http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}, data[:10], data[10:])
+	zr, err := gzip.NewReader(strings.NewReader(got))
+	if err != nil {
+		t.Fatalf("Transformed body is not gzip: %v", err)
+	}
+	plain, _ := io.ReadAll(zr)
+	if string(plain) != "served by public host" {
+		t.Errorf("Unexpected decompressed body %q", plain)
+	}
+}
+
+func TestURLRewrite(t *testing.T) {
+	p := NewPipeline(mustRule(t, config.TransformConfig{Type: "url_rewrite", From: "http://10.0.0.5:8080", To: "https://app.example.com"}))
+	header := http.Header{"Content-Type": {"application/json"}, "Location": {"http://10.0.0.5:8080/login?next=/"}}
+
+	got := runResponse(t, p, header, `{"a":"http://10.0.0.5:8080/x","b":"http:\/\/10.0.0.5:8080\/y"}`)
+	want := `{"a":"https://app.example.com/x","b":"https:\/\/app.example.com\/y"}`
+	if got != want {
+		t.Errorf("Unexpected body\n got: %s\nwant: %s", got, want)
+	}
+	if loc := header.Get("Location"); loc != "https://app.example.com/login?next=/" {
+		t.Errorf("Unexpected Location %q", loc)
+	}
+}
+
+func TestRequestTransform(t *testing.T) {
+	p := NewPipeline(mustRule(t, config.TransformConfig{Type: "replace", Direction: "request", From: "public", To: "internal-name"}))
+	r := httptest.NewRequest("POST", "/api", strings.NewReader(`{"host":"public"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if err := p.Request(r); err != nil {
+		t.Fatalf("Request transform failed: %v", err)
+	}
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != `{"host":"internal-name"}` || r.ContentLength != int64(len(body)) {
+		t.Errorf("Unexpected request body %q (length %d)", body, r.ContentLength)
+	}
+}
@@ -1,22 +1,88 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
-	"net"
+	"mime"
 	"net/http"
+	"net/netip"
+	"singleproxy/pkg/dnscache"
 	"singleproxy/pkg/logger"
 	"strings"
 	"time"
 )
 
-// ForwardToTarget 转发请求到目标服务器
+// 与目标服务之间使用的HTTP协议
+const (
+	TargetProtocolAuto = "auto" // https目标经ALPN协商，明文目标使用HTTP/1.1
+	TargetProtocolH1   = "h1"   // 只使用HTTP/1.1
+	TargetProtocolH2C  = "h2c"  // 明文HTTP/2 (prior knowledge)，所有请求复用同一连接
+)
+
+// targetTransports 按协议区分的转发到目标服务的共用连接池，目标主机名经DNS缓存解析
+var targetTransports = map[string]*http.Transport{
+	TargetProtocolAuto: newTargetTransport(nil),
+	TargetProtocolH1: newTargetTransport(func(p *http.Protocols) {
+		p.SetHTTP1(true)
+	}),
+	TargetProtocolH2C: newTargetTransport(func(p *http.Protocols) {
+		p.SetUnencryptedHTTP2(true)
+	}),
+}
+
+// targetTimeout 转发到目标服务的超时。普通请求限制整个请求，SSE 请求只限制等待响应头
+const targetTimeout = 30 * time.Second
+
+func newTargetTransport(protocols func(*http.Protocols)) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dnscache.DialContext
+	t.ResponseHeaderTimeout = targetTimeout
+	if protocols != nil {
+		t.Protocols = new(http.Protocols)
+		protocols(t.Protocols)
+	}
+	return t
+}
+
+// MaxTargetRedirects 跟随目标服务的重定向时最多跟随的次数，超过视为重定向循环
+const MaxTargetRedirects = 10
+
+// ErrTargetRedirectLoop 跟随目标服务的重定向超过 MaxTargetRedirects 次
+var ErrTargetRedirectLoop = errors.New("target redirect loop")
+
+// TargetCheckRedirect 返回转发到目标服务的 http.Client 使用的 CheckRedirect。
+// 不跟随时 3xx 响应原样返回给公网调用方；跟随时在私有网络内完成重定向，超过次数返回 ErrTargetRedirectLoop
+func TargetCheckRedirect(follow bool) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if !follow {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= MaxTargetRedirects {
+			return ErrTargetRedirectLoop
+		}
+		return nil
+	}
+}
+
+// ForwardToTarget 转发请求到目标服务器，目标服务的重定向原样返回
 func ForwardToTarget(req *http.Request, targetAddr string) (*http.Response, error) {
-	originalURL := req.URL.String()
+	return ForwardToTargetProtocol(req, targetAddr, TargetProtocolAuto, false)
+}
+
+// ForwardToTargetProtocol 使用指定协议转发请求到目标服务器，未知协议按 auto 处理。
+// followRedirects 为 false 时目标服务返回的 3xx 响应不跟随，原样返回
+func ForwardToTargetProtocol(req *http.Request, targetAddr, protocol string, followRedirects bool) (*http.Response, error) {
+	transport, ok := targetTransports[protocol]
+	if !ok {
+		transport = targetTransports[TargetProtocolAuto]
+	}
+	originalURL := SanitizeURL(req.URL)
 	startTime := time.Now()
 
 	logger.Debug("Starting request forwarding to target",
 		"original_url", originalURL,
 		"target_addr", targetAddr,
+		"target_protocol", protocol,
 		"method", req.Method,
 		"content_length", req.ContentLength,
 		"user_agent", req.Header.Get("User-Agent"))
@@ -25,7 +91,7 @@ func ForwardToTarget(req *http.Request, targetAddr string) (*http.Response, erro
 	req.URL.Host = targetAddr
 	req.RequestURI = ""
 
-	newURL := req.URL.String()
+	newURL := SanitizeURL(req.URL)
 	logger.Debug("Modified request URL for forwarding",
 		"original_url", originalURL,
 		"target_url", newURL,
@@ -51,12 +117,17 @@ func ForwardToTarget(req *http.Request, targetAddr string) (*http.Response, erro
 		"headers_removed", removedCount,
 		"remaining_headers", len(req.Header))
 
-	client := &http.Client{Timeout: 30 * time.Second}
+	// SSE 是长时间空闲的长连接，总超时会在事件间隔较长时掐断事件流
+	timeout := targetTimeout
+	if AcceptsEventStream(req.Header) {
+		timeout = 0
+	}
+	client := &http.Client{Timeout: timeout, Transport: transport, CheckRedirect: TargetCheckRedirect(followRedirects)}
 
 	logger.Debug("Sending request to target",
 		"target_url", newURL,
 		"method", req.Method,
-		"timeout", "30s")
+		"timeout", timeout)
 
 	resp, err := client.Do(req)
 	duration := time.Since(startTime)
@@ -75,32 +146,102 @@ func ForwardToTarget(req *http.Request, targetAddr string) (*http.Response, erro
 		"method", req.Method,
 		"status", resp.Status,
 		"status_code", resp.StatusCode,
+		"proto", resp.Proto,
 		"content_length", resp.ContentLength,
 		"duration", duration,
-		"response_headers", SanitizeHeaders(resp.Header))
+		"response_headers", LazyHeaders(resp.Header))
 
 	return resp, nil
 }
 
-// GetClientIP 获取客户端真实IP
+// IsEventStream 判断响应是否为SSE事件流 (Content-Type: text/event-stream)
+func IsEventStream(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// AcceptsEventStream 判断请求是否期望SSE事件流，浏览器的 EventSource 总会携带 Accept: text/event-stream
+func AcceptsEventStream(h http.Header) bool {
+	for _, v := range h.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// responseHopByHopHeaders 目标服务响应中只描述目标服务与转发客户端之间那一跳连接的头部
+var responseHopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection",
+	"TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// RemoveResponseHopByHop 移除目标服务响应中的逐跳头部，包括 Connection 中列出的头部，返回移除的个数。
+// HTTP/1.0 目标常带 Connection: keep-alive 和 Keep-Alive，原样转发给公网调用方会与服务器
+// 实际的分块或以关闭连接结束的输出方式矛盾
+func RemoveResponseHopByHop(h http.Header) int {
+	removed := 0
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && h.Get(name) != "" {
+				h.Del(name)
+				removed++
+			}
+		}
+	}
+	for _, name := range responseHopByHopHeaders {
+		if _, ok := h[name]; ok {
+			h.Del(name)
+			removed++
+		}
+	}
+	return removed
+}
+
+// ParseClientIP 解析客户端地址并返回规范形式，限速、访问控制和日志都以此作为同一客户端的标识。
+// 接受带端口 (1.2.3.4:80、[2001:db8::1]:443) 或方括号 ([2001:db8::1]) 的写法；
+// IPv4映射地址 (::ffff:1.2.3.4) 还原为IPv4，IPv6 zone (fe80::1%eth0) 被去掉
+func ParseClientIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap().WithZone(""), true
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// GetClientIP 获取客户端真实IP，返回 ParseClientIP 的规范形式。
+// X-Forwarded-For 只取第一个地址，头部中的地址无法解析时依次尝试 X-Real-IP 和连接地址
 func GetClientIP(r *http.Request) (string, error) {
 	// 尝试从 X-Forwarded-For 获取
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return xff, nil
+		first, _, _ := strings.Cut(xff, ",")
+		if addr, ok := ParseClientIP(first); ok {
+			return addr.String(), nil
+		}
 	}
 
 	// 尝试从 X-Real-IP 获取
 	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri, nil
+		if addr, ok := ParseClientIP(xri); ok {
+			return addr.String(), nil
+		}
 	}
 
 	// 从 RemoteAddr 获取
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse remote address: %v", err)
+	addr, ok := ParseClientIP(r.RemoteAddr)
+	if !ok {
+		return "", fmt.Errorf("failed to parse remote address: %q", r.RemoteAddr)
 	}
-
-	return ip, nil
+	return addr.String(), nil
 }
 
 // Min 返回两个整数中较小的值
@@ -110,18 +251,3 @@ func Min(a, b int) int {
 	}
 	return b
 }
-
-// SanitizeHeaders 清理HTTP头信息，移除敏感信息用于日志记录
-func SanitizeHeaders(headers http.Header) map[string][]string {
-	sanitized := make(map[string][]string)
-	for k, v := range headers {
-		key := strings.ToLower(k)
-		// 过滤敏感头信息
-		if key == "authorization" || key == "cookie" || key == "x-tunnel-key" {
-			sanitized[k] = []string{"[REDACTED]"}
-		} else {
-			sanitized[k] = v
-		}
-	}
-	return sanitized
-}
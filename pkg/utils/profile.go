@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"runtime/pprof"
+	"strconv"
+)
+
+// 协程的 pprof 标签，goroutine profile 中据此区分属于哪个key、哪个请求的协程
+const (
+	ProfileLabelKey       = "key"
+	ProfileLabelRequestID = "request_id"
+	ProfileLabelStage     = "stage" // 单个请求所处的阶段，如 wait、relay、forward、stream_body
+	ProfileLabelLoop      = "loop"  // 隧道连接上常驻的循环，如 read、write、keepalive
+)
+
+// RequestProfileLabels 返回处理单个请求的协程的标签
+func RequestProfileLabels(key string, requestID uint64, stage string) pprof.LabelSet {
+	return pprof.Labels(
+		ProfileLabelKey, key,
+		ProfileLabelRequestID, strconv.FormatUint(requestID, 10),
+		ProfileLabelStage, stage)
+}
+
+// LoopProfileLabels 返回隧道连接读写循环协程的标签
+func LoopProfileLabels(key, loop string) pprof.LabelSet {
+	return pprof.Labels(ProfileLabelKey, key, ProfileLabelLoop, loop)
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// 头部日志模式
+const (
+	LogHeadersNone     = "none"     // 不记录头部
+	LogHeadersRedacted = "redacted" // 记录头部，敏感头脱敏 (默认)
+	LogHeadersFull     = "full"     // 原样记录全部头部
+)
+
+const redactedValue = "[REDACTED]"
+
+// defaultSensitiveHeaders 是默认需要脱敏的头部 (小写)
+var defaultSensitiveHeaders = []string{"authorization", "cookie", "set-cookie", "x-tunnel-key", "proxy-authorization"}
+
+// sensitiveQueryParams 是记录URL时需要脱敏的查询参数 (小写)
+var sensitiveQueryParams = map[string]bool{
+	"token":        true,
+	"access_token": true,
+	"api_key":      true,
+	"apikey":       true,
+	"key":          true,
+	"password":     true,
+	"secret":       true,
+	"signature":    true,
+	"sig":          true,
+}
+
+// redactionPolicy 是当前生效的脱敏策略
+type redactionPolicy struct {
+	headers map[string]bool
+	mode    string
+}
+
+var currentPolicy atomic.Pointer[redactionPolicy]
+
+func init() {
+	ConfigureRedaction(nil, "")
+}
+
+// ConfigureRedaction 设置头部脱敏策略。changes 中的条目在默认列表上增加头部，
+// 以 "-" 开头的条目从列表中移除；mode 为 none、redacted 或 full，为空时使用 redacted
+func ConfigureRedaction(changes []string, mode string) {
+	headers := make(map[string]bool, len(defaultSensitiveHeaders)+len(changes))
+	for _, h := range defaultSensitiveHeaders {
+		headers[h] = true
+	}
+	for _, change := range changes {
+		change = strings.ToLower(strings.TrimSpace(change))
+		if name, ok := strings.CutPrefix(change, "-"); ok {
+			delete(headers, name)
+		} else if change != "" {
+			headers[strings.TrimPrefix(change, "+")] = true
+		}
+	}
+
+	switch mode {
+	case LogHeadersNone, LogHeadersFull:
+	default:
+		mode = LogHeadersRedacted
+	}
+	currentPolicy.Store(&redactionPolicy{headers: headers, mode: mode})
+}
+
+// IsSensitiveHeader 判断头部是否包含敏感信息，需要在日志和抓包中脱敏
+func IsSensitiveHeader(name string) bool {
+	return currentPolicy.Load().headers[strings.ToLower(name)]
+}
+
+// SanitizeHeaders 按当前策略处理HTTP头信息用于日志记录，
+// none 模式下返回 nil
+func SanitizeHeaders(headers http.Header) map[string][]string {
+	policy := currentPolicy.Load()
+	if policy.mode == LogHeadersNone {
+		return nil
+	}
+
+	sanitized := make(map[string][]string, len(headers))
+	for k, v := range headers {
+		// 过滤敏感头信息
+		if policy.mode == LogHeadersRedacted && policy.headers[strings.ToLower(k)] {
+			sanitized[k] = []string{redactedValue}
+		} else {
+			sanitized[k] = v
+		}
+	}
+	return sanitized
+}
+
+// lazyHeaders 延迟到日志实际输出时才构建脱敏后的头部
+type lazyHeaders struct {
+	headers http.Header
+}
+
+// LogValue 实现 slog.LogValuer
+func (l lazyHeaders) LogValue() slog.Value {
+	return slog.AnyValue(SanitizeHeaders(l.headers))
+}
+
+// LazyHeaders 返回一个日志值，只有在该级别日志被输出时才调用 SanitizeHeaders
+func LazyHeaders(headers http.Header) slog.LogValuer {
+	return lazyHeaders{headers: headers}
+}
+
+// SanitizeURL 返回用于日志记录的URL字符串，常见凭据类查询参数的值会被脱敏
+func SanitizeURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if u.RawQuery == "" && u.User == nil {
+		return u.String()
+	}
+
+	clone := *u
+	if clone.User != nil {
+		clone.User = url.User(clone.User.Username())
+	}
+	clone.RawQuery = sanitizeQuery(u.RawQuery)
+	return clone.String()
+}
+
+// sanitizeQuery 脱敏查询字符串中的敏感参数，保留其余参数的原始编码
+func sanitizeQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	parts := strings.Split(rawQuery, "&")
+	for i, part := range parts {
+		name, _, hasValue := strings.Cut(part, "=")
+		decoded, err := url.QueryUnescape(name)
+		if err != nil {
+			decoded = name
+		}
+		if hasValue && sensitiveQueryParams[strings.ToLower(decoded)] {
+			parts[i] = name + "=" + redactedValue
+		}
+	}
+	return strings.Join(parts, "&")
+}
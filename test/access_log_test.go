@@ -0,0 +1,98 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+type accessReport struct {
+	Key     string `json:"key"`
+	Entries []struct {
+		Key      string `json:"key"`
+		ClientIP string `json:"client_ip"`
+		Method   string `json:"method"`
+		Path     string `json:"path"`
+		Status   int    `json:"status"`
+	} `json:"entries"`
+}
+
+func TestPerKeyAccessLog(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "tenants", "tenant-a.log")
+	serverCfg := config.Config{
+		AccessLogRing: 10,
+		Keys:          map[string]*config.KeyConfig{"tenant-a": {AccessLogFile: logFile}},
+		AdminTokens: []*config.AdminTokenConfig{
+			{Name: "tenant-a", Token: "tenant-a-token-012345", Keys: []string{"tenant-a"}},
+			{Name: "tenant-b", Token: "tenant-b-token-012345", Keys: []string{"tenant-b"}},
+		},
+	}
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "ok")
+	}), serverCfg, config.Config{Key: "tenant-a"})
+
+	// 第一次请求之前不创建文件
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected access log to be created lazily, stat error: %v", err)
+	}
+	for _, path := range []string{"/one", "/two", "/missing"} {
+		keyedGet(t, publicURL+path, "tenant-a")
+	}
+
+	// 访问记录在响应写出后写入，轮询直到三条都已记录
+	var report accessReport
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		report = accessReport{}
+		if code := adminGet(t, publicURL, "/admin/keys/tenant-a/access?limit=2", "tenant-a-token-012345", &report); code != http.StatusOK {
+			t.Fatalf("Expected 200 from the access ring for a scoped token, got %d", code)
+		}
+		if len(report.Entries) == 2 && report.Entries[0].Path == "/missing" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the 2 newest entries, got %+v", report.Entries)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if e := report.Entries[0]; e.Status != http.StatusNotFound || e.Method != "GET" || e.Key != "tenant-a" || e.ClientIP == "" {
+		t.Errorf("Unexpected newest entry: %+v", e)
+	}
+	if report.Entries[1].Path != "/two" {
+		t.Errorf("Expected entries newest first, got %+v", report.Entries)
+	}
+	if code := adminGet(t, publicURL, "/admin/keys/tenant-a/access", "tenant-b-token-012345", nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for another tenant's token, got %d", code)
+	}
+
+	file, err := os.Open(logFile)
+	if err != nil {
+		t.Fatalf("Expected per-key access log file: %v", err)
+	}
+	defer file.Close()
+	var paths []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Expected one JSON entry per line, got %q: %v", scanner.Text(), err)
+		}
+		paths = append(paths, entry.Path)
+	}
+	if len(paths) != 3 || paths[0] != "/one" || paths[2] != "/missing" {
+		t.Errorf("Expected 3 entries in request order in the access log, got %v", paths)
+	}
+}
@@ -0,0 +1,295 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// startBalancedTunnel 启动服务器和多个连接到同一key的客户端，每个客户端的目标服务返回自己的名称
+func startBalancedTunnel(t *testing.T, kc *config.KeyConfig, names ...string) (string, map[string]*client.TunnelClient, *[]string) {
+	t.Helper()
+	return startWeightedTunnel(t, kc, nil, names...)
+}
+
+// startWeightedTunnel 同 startBalancedTunnel，客户端使用 weights 中配置的权重
+func startWeightedTunnel(t *testing.T, kc *config.KeyConfig, weights map[string]int, names ...string) (string, map[string]*client.TunnelClient, *[]string) {
+	t.Helper()
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:          "server",
+		AdminToken:    "admin-secret",
+		AccessLogRing: 20,
+		Keys:          map[string]*config.KeyConfig{"balanced": kc},
+	})
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	// 记录目标服务收到的 Cookie 头
+	var cookies []string
+	clients := make(map[string]*client.TunnelClient)
+	for _, name := range names {
+		name := name
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cookies = append(cookies, r.Header.Get("Cookie"))
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(target.Close)
+
+		tunnelClient, err := client.NewTunnelClient(&config.Config{
+			Mode:       "client",
+			Key:        "balanced",
+			ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+			TargetAddr: strings.TrimPrefix(target.URL, "http://"),
+			Weight:     weights[name],
+		})
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		go tunnelClient.Run()
+		t.Cleanup(tunnelClient.Stop)
+		clients[name] = tunnelClient
+		time.Sleep(150 * time.Millisecond)
+	}
+	return proxyServer.URL, clients, &cookies
+}
+
+func balancedGet(t *testing.T, httpClient *http.Client, url string, header map[string]string) (string, *http.Response) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("X-Tunnel-Key", "balanced")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body), resp
+}
+
+func TestRoundRobinAcrossClients(t *testing.T) {
+	publicURL, _, _ := startBalancedTunnel(t, &config.KeyConfig{Balance: "round_robin"}, "a", "b")
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		body, _ := balancedGet(t, http.DefaultClient, publicURL+"/", nil)
+		seen[body]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Errorf("Expected requests split evenly, got %v", seen)
+	}
+}
+
+func TestCookieAffinity(t *testing.T) {
+	publicURL, clients, cookies := startBalancedTunnel(t, &config.KeyConfig{Balance: "round_robin", Affinity: "cookie"}, "a", "b")
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+
+	pinned, resp := balancedGet(t, browser, publicURL+"/", nil)
+	if !strings.Contains(resp.Header.Get("Set-Cookie"), "singleproxy_backend=") {
+		t.Fatalf("Expected affinity cookie, got %q", resp.Header.Get("Set-Cookie"))
+	}
+	for i := 0; i < 5; i++ {
+		if body, _ := balancedGet(t, browser, publicURL+"/", map[string]string{"Cookie": "session=1"}); body != pinned {
+			t.Fatalf("Expected request %d to stay on %s, got %s", i, pinned, body)
+		}
+	}
+	for _, c := range *cookies {
+		if strings.Contains(c, "singleproxy_backend") {
+			t.Errorf("Affinity cookie should not be forwarded to the target, got %q", c)
+		}
+	}
+
+	// 伪造的cookie被忽略
+	if _, resp := balancedGet(t, http.DefaultClient, publicURL+"/", map[string]string{"Cookie": "singleproxy_backend=c1.forged"}); resp.Header.Get("Set-Cookie") == "" {
+		t.Errorf("Expected forged cookie to be replaced")
+	}
+
+	// 固定的连接断开后回退到其他连接并刷新cookie
+	clients[pinned].Stop()
+	time.Sleep(200 * time.Millisecond)
+	body, resp := balancedGet(t, browser, publicURL+"/", nil)
+	if body == pinned || resp.Header.Get("Set-Cookie") == "" {
+		t.Errorf("Expected fallback with refreshed cookie, got %s (Set-Cookie %q)", body, resp.Header.Get("Set-Cookie"))
+	}
+	if again, _ := balancedGet(t, browser, publicURL+"/", nil); again != body {
+		t.Errorf("Expected refreshed cookie to pin %s, got %s", body, again)
+	}
+}
+
+func TestIPHashAffinity(t *testing.T) {
+	publicURL, _, _ := startBalancedTunnel(t, &config.KeyConfig{Balance: "round_robin", Affinity: "ip_hash"}, "a", "b", "c")
+
+	backends := make(map[string]bool)
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4", "198.51.100.5", "198.51.100.6"} {
+		first, _ := balancedGet(t, http.DefaultClient, publicURL+"/", map[string]string{"X-Forwarded-For": ip})
+		for i := 0; i < 3; i++ {
+			if body, _ := balancedGet(t, http.DefaultClient, publicURL+"/", map[string]string{"X-Forwarded-For": ip + ", 10.0.0.1"}); body != first {
+				t.Errorf("Expected %s to stay on %s, got %s", ip, first, body)
+			}
+		}
+		backends[first] = true
+	}
+	if len(backends) < 2 {
+		t.Errorf("Expected client IPs to spread over backends, got %v", backends)
+	}
+}
+
+// backendHeader 以完整管理令牌指定处理请求的连接
+func backendHeader(id string) map[string]string {
+	return map[string]string{"X-Tunnel-Backend": id, "X-Tunnel-Backend-Token": "admin-secret"}
+}
+
+func TestBackendOverrideHeader(t *testing.T) {
+	publicURL, _, _ := startBalancedTunnel(t, &config.KeyConfig{Balance: "round_robin", Affinity: "ip_hash"}, "a", "b")
+
+	var tunnels adminTunnels
+	adminGet(t, publicURL, "/admin/tunnels", "admin-secret", &tunnels)
+	if len(tunnels.Tunnels) != 2 {
+		t.Fatalf("Expected 2 connections for the key, got %+v", tunnels.Tunnels)
+	}
+	// 每个连接ID固定到同一个客户端，两个ID对应不同的客户端
+	reached := make(map[string]string)
+	for _, tunnel := range tunnels.Tunnels {
+		first, _ := balancedGet(t, http.DefaultClient, publicURL+"/", backendHeader(tunnel.ID))
+		for j := 0; j < 3; j++ {
+			if body, _ := balancedGet(t, http.DefaultClient, publicURL+"/", backendHeader(tunnel.ID)); body != first {
+				t.Errorf("Expected override %s to stay on %s, got %s", tunnel.ID, first, body)
+			}
+		}
+		reached[first] = tunnel.ID
+	}
+	if len(reached) != 2 {
+		t.Errorf("Expected each connection ID to reach a different client, got %v", reached)
+	}
+
+	// 指定的连接不存在时返回404并说明原因
+	if body, resp := balancedGet(t, http.DefaultClient, publicURL+"/", backendHeader("missing")); resp.StatusCode != http.StatusNotFound ||
+		!strings.Contains(body, "not connected") {
+		t.Errorf("Expected 404 for an unknown backend, got %d %q", resp.StatusCode, body)
+	}
+	// 未出示令牌时忽略指定，照常负载均衡
+	if body, resp := balancedGet(t, http.DefaultClient, publicURL+"/", map[string]string{"X-Tunnel-Backend": "missing"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the override to be ignored without a token, got %d %q", resp.StatusCode, body)
+	}
+
+	// 指定的连接记录在访问记录中
+	var access struct {
+		Entries []struct {
+			Backend string `json:"backend"`
+			Status  int    `json:"status"`
+		} `json:"entries"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(access.Entries) < 10 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		adminGet(t, publicURL, "/admin/keys/balanced/access", "admin-secret", &access)
+	}
+	if len(access.Entries) < 10 || access.Entries[0].Backend != "" || access.Entries[1].Backend != "missing" ||
+		access.Entries[2].Backend != tunnels.Tunnels[1].ID {
+		t.Errorf("Expected access entries to record the requested backend, got %+v", access.Entries)
+	}
+}
+
+func TestWeightedBalance(t *testing.T) {
+	publicURL, _, _ := startWeightedTunnel(t, &config.KeyConfig{Balance: "weighted"}, map[string]int{"a": 3, "b": 1}, "a", "b")
+
+	seen := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		body, _ := balancedGet(t, http.DefaultClient, publicURL+"/", nil)
+		seen[body]++
+	}
+	if seen["a"] != 6 || seen["b"] != 2 {
+		t.Errorf("Expected 3:1 split, got %v", seen)
+	}
+
+	var tunnels struct {
+		Tunnels []struct {
+			Balance *struct {
+				Weight          int     `json:"weight"`
+				EffectiveWeight int     `json:"effective_weight"`
+				TargetHealthy   bool    `json:"target_healthy"`
+				Share           float64 `json:"share"`
+			} `json:"balance"`
+		} `json:"tunnels"`
+	}
+	adminGet(t, publicURL, "/admin/tunnels", "admin-secret", &tunnels)
+	shares := make(map[int]float64)
+	for _, tunnel := range tunnels.Tunnels {
+		if tunnel.Balance == nil || !tunnel.Balance.TargetHealthy || tunnel.Balance.EffectiveWeight != tunnel.Balance.Weight {
+			t.Fatalf("Unexpected balance info %+v", tunnel.Balance)
+		}
+		shares[tunnel.Balance.Weight] = tunnel.Balance.Share
+	}
+	if shares[3] != 0.75 || shares[1] != 0.25 {
+		t.Errorf("Expected shares 0.75/0.25, got %v", shares)
+	}
+}
+
+func TestUnreachableTargetExcluded(t *testing.T) {
+	publicURL, _, _ := startBalancedTunnel(t, &config.KeyConfig{Balance: "round_robin"}, "a")
+
+	// 第二个客户端的目标服务不可用
+	dead, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "balanced",
+		ServerAddr: strings.Replace(publicURL, "http://", "ws://", 1),
+		TargetAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	go dead.Run()
+	t.Cleanup(dead.Stop)
+	time.Sleep(150 * time.Millisecond)
+
+	// 转发失败后客户端上报目标服务不可用
+	var tunnels adminTunnels
+	adminGet(t, publicURL, "/admin/tunnels", "admin-secret", &tunnels)
+	failed := 0
+	for _, tunnel := range tunnels.Tunnels {
+		if _, resp := balancedGet(t, http.DefaultClient, publicURL+"/", backendHeader(tunnel.ID)); resp.StatusCode == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("Expected one request to fail with 502, got %d", failed)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		if body, _ := balancedGet(t, http.DefaultClient, publicURL+"/", nil); body != "a" {
+			t.Fatalf("Expected unreachable target to be skipped, got %q", body)
+		}
+	}
+
+	var health struct {
+		Tunnels []struct {
+			Balance struct {
+				TargetHealthy   bool `json:"target_healthy"`
+				EffectiveWeight int  `json:"effective_weight"`
+			} `json:"balance"`
+		} `json:"tunnels"`
+	}
+	adminGet(t, publicURL, "/admin/tunnels", "admin-secret", &health)
+	unhealthy := 0
+	for _, tunnel := range health.Tunnels {
+		if !tunnel.Balance.TargetHealthy && tunnel.Balance.EffectiveWeight == 0 {
+			unhealthy++
+		}
+	}
+	if unhealthy != 1 {
+		t.Errorf("Expected one unhealthy connection in admin API, got %+v", health.Tunnels)
+	}
+}
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+)
+
+func TestAutoKeyAllocation(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:          "server",
+		PublicBaseURL: "https://tunnel.example.com",
+	})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	wsURL := strings.Replace(ts.URL, "http://", "ws://", 1) + "/ws/?auto_key=1"
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to dial with auto key: %v", err)
+		}
+		defer conn.Close()
+
+		key := resp.Header.Get(protocol.HeaderTunnelKey)
+		if !regexp.MustCompile(`^[a-z]+-[a-z]+-\d{4}$`).MatchString(key) {
+			t.Errorf("Expected word-style key, got %q", key)
+		}
+		if seen[key] {
+			t.Errorf("Duplicate auto key allocated: %s", key)
+		}
+		seen[key] = true
+
+		if got := resp.Header.Get(protocol.HeaderPublicURL); got != "https://tunnel.example.com" {
+			t.Errorf("Expected public URL header, got %q", got)
+		}
+		if resp.Header.Get(protocol.HeaderKeyExpires) == "" {
+			t.Error("Expected expiry header for auto key")
+		}
+		if got := resp.Header.Get(protocol.HeaderRoute); got != protocol.RouteHeader {
+			t.Errorf("Expected header-based route, got %q", got)
+		}
+	}
+
+	// 不带 auto_key 的空key仍然被拒绝
+	_, resp, err := websocket.DefaultDialer.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/ws/", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for empty key without auto_key, got %v", resp)
+	}
+}
+
+func TestAutoKeyExpiry(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:          "server",
+		AutoKeyFormat: "hex",
+		AutoKeyTTL:    300 * time.Millisecond,
+	})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	base := strings.Replace(ts.URL, "http://", "ws://", 1)
+	conn, resp, err := websocket.DefaultDialer.Dial(base+"/ws/?auto_key=1", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial with auto key: %v", err)
+	}
+	defer conn.Close()
+
+	key := resp.Header.Get(protocol.HeaderTunnelKey)
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(key) {
+		t.Fatalf("Expected hex key, got %q", key)
+	}
+
+	// 到期后服务器主动关闭连接
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected normal close after expiry, got %v", err)
+	}
+
+	// 过期的key不能再注册
+	_, resp, err = websocket.DefaultDialer.Dial(base+"/ws/"+key, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected 410 for expired auto key, got %v", resp)
+	}
+}
+
+func TestClientAutoKeyServesTraffic(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("auto-key-ok"))
+	}))
+	defer targetServer.Close()
+
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server"})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+		TargetAddr: strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:        "default",
+		AutoKey:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	key := tunnelClient.Key()
+	if key == "" || key == "default" {
+		t.Fatalf("Expected server-assigned key, got %q", key)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	req, _ := http.NewRequest("GET", proxyServer.URL+"/", nil)
+	req.Header.Set("X-Tunnel-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request through auto key failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "auto-key-ok" {
+		t.Errorf("Expected target body, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestDefaultKeyRouteAdvertised(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server"})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/ws/default", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if got := resp.Header.Get(protocol.HeaderRoute); got != protocol.RouteDefault {
+		t.Errorf("Expected default route for the default key, got %q", got)
+	}
+	if got := resp.Header.Get(protocol.HeaderPublicURL); got != "" {
+		t.Errorf("Expected no public URL without public_base_url, got %q", got)
+	}
+}
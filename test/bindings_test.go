@@ -0,0 +1,224 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+)
+
+// freePort 返回一个当前空闲的TCP端口
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// adminGet 使用管理令牌请求管理API并解析JSON
+func adminGet(t *testing.T, baseURL, path, token string, out any) int {
+	t.Helper()
+	req, _ := http.NewRequest("GET", baseURL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Admin request %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Failed to decode admin response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+type adminTunnels struct {
+	Tunnels []struct {
+		ID       string   `json:"id"`
+		Key      string   `json:"key"`
+		Bindings []string `json:"bindings"`
+	} `json:"tunnels"`
+}
+
+func TestBindingsGrantedAndRouted(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "bound:%s", r.URL.Path)
+	}))
+	defer targetServer.Close()
+
+	port := freePort(t)
+	serverCfg := &config.Config{
+		Mode:       "server",
+		AdminToken: "secret",
+		Keys: map[string]*config.KeyConfig{
+			"bind-test": {
+				AllowedHosts: []string{"*.example.com"},
+				AllowedPorts: []string{fmt.Sprintf("%d-%d", port, port)},
+			},
+		},
+	}
+	proxy := server.NewSinglePortProxy(serverCfg)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	clientCfg := &config.Config{
+		Mode:       "client",
+		ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+		TargetAddr: strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:        "bind-test",
+		// 重复申请已持有的绑定同样授予成功，但不会重复记录
+		Bindings: []string{"host=app.example.com", fmt.Sprintf("port=%d", port),
+			"host=APP.example.com", fmt.Sprintf("port=%d", port)},
+	}
+	tunnelClient, err := client.NewTunnelClient(clientCfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// 主机名绑定: 不带 X-Tunnel-Key 也能路由到该key
+	req, _ := http.NewRequest("GET", proxyServer.URL+"/via-host", nil)
+	req.Host = "app.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Host-routed request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "bound:/via-host" {
+		t.Errorf("Expected host-routed body, got %d %q", resp.StatusCode, body)
+	}
+
+	// 端口绑定: 动态监听的端口上所有请求都路由到该key
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/via-port", port))
+	if err != nil {
+		t.Fatalf("Port-routed request failed: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "bound:/via-port" {
+		t.Errorf("Expected port-routed body, got %d %q", resp.StatusCode, body)
+	}
+
+	// 管理API中可见
+	var listing adminTunnels
+	if status := adminGet(t, proxyServer.URL, "/admin/tunnels", "secret", &listing); status != http.StatusOK {
+		t.Fatalf("Expected admin status 200, got %d", status)
+	}
+	if len(listing.Tunnels) != 1 || len(listing.Tunnels[0].Bindings) != 2 {
+		t.Errorf("Expected one tunnel with two bindings, got %+v", listing)
+	}
+
+	// 生效的路由表包含动态绑定
+	var routes server.RouteTable
+	if status := adminGet(t, proxyServer.URL, "/admin/routes", "secret", &routes); status != http.StatusOK {
+		t.Fatalf("Expected routes status 200, got %d", status)
+	}
+	if len(routes.Hosts) != 1 || routes.Hosts[0].Host != "app.example.com" || routes.Hosts[0].Source != "host_binding" {
+		t.Errorf("Expected host binding in route table, got %+v", routes.Hosts)
+	}
+	if n := len(routes.Listeners); n != 2 || routes.Listeners[1].Key != "bind-test" {
+		t.Errorf("Expected port binding listener in route table, got %+v", routes.Listeners)
+	}
+}
+
+func TestBindingsRefusedAndReleased(t *testing.T) {
+	serverCfg := &config.Config{
+		Mode:       "server",
+		AdminToken: "secret",
+		Keys: map[string]*config.KeyConfig{
+			"bind-refuse": {AllowedHosts: []string{"allowed.example.com"}},
+		},
+	}
+	proxy := server.NewSinglePortProxy(serverCfg)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	wsURL := strings.Replace(proxyServer.URL, "http://", "ws://", 1) + "/ws/bind-refuse"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+
+	payload, _ := protocol.EncodeBindRequest(protocol.BindRequest{Bindings: []protocol.Binding{
+		{Type: protocol.BindTypeHost, Host: "allowed.example.com"},
+		{Type: protocol.BindTypeHost, Host: "other.example.com"},
+		{Type: protocol.BindTypePort, Port: 2222},
+	}})
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: 7, Type: protocol.MSG_TYPE_BIND_REQ, Payload: payload})
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatalf("Failed to send bind request: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, raw, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read bind response: %v", err)
+	}
+	msg, _ := protocol.DeserializeTunnelMessage(raw)
+	if msg.Type != protocol.MSG_TYPE_BIND_RES || msg.ID != 7 {
+		t.Fatalf("Expected bind response for id 7, got type %d id %d", msg.Type, msg.ID)
+	}
+	resp, err := protocol.DecodeBindResponse(msg.Payload)
+	if err != nil {
+		t.Fatalf("Failed to decode bind response: %v", err)
+	}
+	if len(resp.Results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(resp.Results))
+	}
+	if !resp.Results[0].Granted {
+		t.Errorf("Expected allowed host to be granted: %+v", resp.Results[0])
+	}
+	for _, r := range resp.Results[1:] {
+		if r.Granted || r.Reason == "" {
+			t.Errorf("Expected binding to be refused with a reason: %+v", r)
+		}
+	}
+
+	// 断开后绑定被撤销，主机名不再路由到该key
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	var listing adminTunnels
+	adminGet(t, proxyServer.URL, "/admin/tunnels", "secret", &listing)
+	if len(listing.Tunnels) != 0 {
+		t.Errorf("Expected no tunnels after disconnect, got %+v", listing)
+	}
+
+	req := httptest.NewRequest("GET", "http://allowed.example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 after binding release, got %d", w.Code)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server", AdminToken: "secret"})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	if status := adminGet(t, ts.URL, "/admin/tunnels", "wrong", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong token, got %d", status)
+	}
+}
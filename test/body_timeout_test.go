@@ -0,0 +1,88 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// trickleUpload 声明 size 字节的请求体，每隔 interval 发送 step 字节，返回响应状态码
+func trickleUpload(t *testing.T, addr, key string, size, step int, interval time.Duration) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: slow.example\r\nX-Tunnel-Key: %s\r\nContent-Length: %d\r\n\r\n", key, size)
+
+	// 服务器提前回应时停止发送，写入错误同样说明服务器已放弃读取
+	go func() {
+		for sent := 0; sent < size; sent += step {
+			time.Sleep(interval)
+			if _, err := conn.Write([]byte(strings.Repeat("x", min(step, size-sent)))); err != nil {
+				return
+			}
+		}
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode
+}
+
+func TestSlowBodyRejected(t *testing.T) {
+	reached := make(chan struct{}, 1)
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached <- struct{}{}
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, n)
+	})
+	url, _ := startServerTunnel(t, target,
+		config.Config{ClientBodyReadTimeout: 300 * time.Millisecond},
+		config.Config{Key: "slow-body"})
+	addr := strings.TrimPrefix(url, "http://")
+
+	// 每秒只发送一个字节，期限内收不到 1KB
+	start := time.Now()
+	if status := trickleUpload(t, addr, "slow-body", 64*1024, 1, 100*time.Millisecond); status != http.StatusRequestTimeout {
+		t.Errorf("Expected 408 for a slow body, got %d", status)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the slow body to be rejected near the timeout, took %v", elapsed)
+	}
+	select {
+	case <-reached:
+		t.Error("Expected the slow request not to reach the target")
+	default:
+	}
+
+	// 持续有进度的慢速上传不受影响，总耗时可以超过期限
+	if status := trickleUpload(t, addr, "slow-body", 6*1024, 1024, 150*time.Millisecond); status != http.StatusOK {
+		t.Errorf("Expected a steady upload to succeed, got %d", status)
+	}
+}
+
+func TestSlowBodyRejectedOnListener(t *testing.T) {
+	// proxy.Start 自己监听端口，请求经前缀连接交给 HTTP 服务
+	addr := startFakeTunnel(t, config.Config{ClientBodyReadTimeout: 300 * time.Millisecond}, func(conn *websocket.Conn, id uint64) {
+		t.Errorf("Expected the slow request %d not to reach the tunnel", id)
+	})
+	if status := trickleUpload(t, addr, "abort-test", 64*1024, 1, 100*time.Millisecond); status != http.StatusRequestTimeout {
+		t.Errorf("Expected 408 for a slow body, got %d", status)
+	}
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+type abortEvent struct {
+	RequestID uint64 `json:"request_id"`
+	Reason    string `json:"reason"`
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// startAbortTarget 启动一个直到请求被取消才返回的目标服务，记录收到的请求ID和中止事件
+func startAbortTarget(t *testing.T, serverCfg config.Config) (string, chan string, chan abortEvent, chan struct{}) {
+	t.Helper()
+	requestIDs := make(chan string, 1)
+	events := make(chan abortEvent, 1)
+	canceled := make(chan struct{}, 1)
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tunnel-events/abort" {
+			var event abortEvent
+			json.NewDecoder(r.Body).Decode(&event)
+			events <- event
+			return
+		}
+		requestIDs <- r.Header.Get("X-Tunnel-Request-Id")
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(3 * time.Second):
+		}
+	}), serverCfg, config.Config{
+		Key:             "abort-test",
+		AbortWebhook:    "/tunnel-events/abort",
+		RequestIDHeader: "X-Tunnel-Request-Id",
+	})
+	return publicURL, requestIDs, events, canceled
+}
+
+func waitAbort(t *testing.T, requestIDs chan string, events chan abortEvent, canceled chan struct{}, reason string) {
+	t.Helper()
+	var requestID string
+	select {
+	case requestID = <-requestIDs:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Target never received the request")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected target request to be canceled")
+	}
+	select {
+	case event := <-events:
+		if strconv.FormatUint(event.RequestID, 10) != requestID || event.Reason != reason || event.Method != "GET" || event.URL != "/slow" {
+			t.Errorf("Unexpected abort event %+v (request id header %q)", event, requestID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected abort event to be posted to the target")
+	}
+}
+
+func TestAbortOnClientDisconnect(t *testing.T) {
+	publicURL, requestIDs, events, canceled := startAbortTarget(t, config.Config{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", publicURL+"/slow", nil)
+	req.Header.Set("X-Tunnel-Key", "abort-test")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected request to be aborted")
+	}
+	waitAbort(t, requestIDs, events, canceled, "client_disconnect")
+}
+
+func TestAbortOnTimeout(t *testing.T) {
+	publicURL, requestIDs, events, canceled := startAbortTarget(t, config.Config{ResponseHeaderTimeout: 300 * time.Millisecond})
+
+	resp, _ := keyedGet(t, publicURL+"/slow", "abort-test")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504, got %d", resp.StatusCode)
+	}
+	waitAbort(t, requestIDs, events, canceled, "timeout")
+}
+
+func TestAbortLargeDownloadMidStream(t *testing.T) {
+	stopped := make(chan int64, 1)
+	chunk := make([]byte, 32<<10)
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 持续写出响应体，直到写入失败或请求被取消
+		var written int64
+		defer func() { stopped <- written }()
+		for written < 1<<30 {
+			if _, err := w.Write(chunk); err != nil || r.Context().Err() != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			written += int64(len(chunk))
+		}
+	}), config.Config{}, config.Config{Key: "abort-test"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", publicURL+"/download", nil)
+	req.Header.Set("X-Tunnel-Key", "abort-test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if n, err := io.CopyN(io.Discard, resp.Body, 1<<20); err != nil {
+		t.Fatalf("Failed to read the first part of the download after %d bytes: %v", n, err)
+	}
+	// 公网调用方读到一半放弃下载
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case written := <-stopped:
+		if written >= 1<<30 {
+			t.Errorf("Expected the target to stop before writing the whole body, wrote %d bytes", written)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Target kept streaming after the public client aborted the download")
+	}
+}
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// adminDo 使用管理令牌发送带JSON body的管理API请求
+func adminDo(t *testing.T, method, url, token, body string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Admin request %s %s failed: %v", method, url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+type captureStatus struct {
+	Key          string `json:"key"`
+	Dir          string `json:"dir"`
+	MaxBytes     int64  `json:"max_bytes"`
+	WrittenBytes int64  `json:"written_bytes"`
+}
+
+func TestCaptureWritesRedactedFiles(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		io.WriteString(w, strings.Repeat("x", 200))
+	}))
+	defer targetServer.Close()
+
+	captureDir := t.TempDir()
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:       "server",
+		AdminToken: "secret",
+		CaptureDir: captureDir,
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+		TargetAddr: strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:        "capture-test",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	captureURL := proxyServer.URL + "/admin/keys/capture-test/capture"
+	if status := adminDo(t, "POST", captureURL, "wrong", `{}`); status != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without valid token, got %d", status)
+	}
+	if status := adminDo(t, "POST", captureURL, "secret", `{"duration":"1m","max_body_bytes":16}`); status != http.StatusCreated {
+		t.Fatalf("Expected 201 when starting capture, got %d", status)
+	}
+
+	req, _ := http.NewRequest("GET", proxyServer.URL+"/captured", nil)
+	req.Header.Set("X-Tunnel-Key", "capture-test")
+	req.Header.Set("Authorization", "Bearer top-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	var status captureStatus
+	if code := adminGet(t, proxyServer.URL, "/admin/keys/capture-test/capture", "secret", &status); code != http.StatusOK {
+		t.Fatalf("Expected capture status 200, got %d", code)
+	}
+	if status.WrittenBytes == 0 {
+		t.Errorf("Expected captured bytes, got %+v", status)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(captureDir, "capture-test", "*"))
+	var request, response string
+	for _, f := range files {
+		data, _ := os.ReadFile(f)
+		switch {
+		case strings.HasSuffix(f, "-request.http"):
+			request = string(data)
+		case strings.HasSuffix(f, "-response.http"):
+			response = string(data)
+		}
+	}
+	if !strings.Contains(request, "GET /captured") || strings.Contains(request, "top-secret") {
+		t.Errorf("Expected redacted request capture, got %q", request)
+	}
+	if strings.Contains(response, "session=abc") || !strings.HasSuffix(response, strings.Repeat("x", 16)) {
+		t.Errorf("Expected redacted and truncated response capture, got %q", response)
+	}
+
+	if code := adminDo(t, "DELETE", captureURL, "secret", ""); code != http.StatusOK {
+		t.Fatalf("Expected 200 when stopping capture, got %d", code)
+	}
+	if code := adminGet(t, proxyServer.URL, "/admin/keys/capture-test/capture", "secret", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 after capture stopped, got %d", code)
+	}
+}
+
+func TestCaptureRejectsInvalidParameters(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:       "server",
+		AdminToken: "secret",
+		CaptureDir: t.TempDir(),
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	captureURL := proxyServer.URL + "/admin/keys/k/capture"
+	if code := adminDo(t, "POST", captureURL, "secret", `{"duration":"soon"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid duration, got %d", code)
+	}
+	if code := adminDo(t, "POST", proxyServer.URL+"/admin/keys/../capture", "secret", `{}`); code == http.StatusCreated {
+		t.Errorf("Expected path traversal key to be rejected")
+	}
+
+	var status captureStatus
+	body, _ := json.Marshal(map[string]any{"duration": "1s", "max_bytes": 1})
+	if code := adminDo(t, "POST", captureURL, "secret", string(body)); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	if code := adminGet(t, proxyServer.URL, "/admin/keys/k/capture", "secret", &status); code != http.StatusOK || status.MaxBytes != 1 {
+		t.Errorf("Expected active capture with max_bytes=1, got %d %+v", code, status)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if code := adminGet(t, proxyServer.URL, "/admin/keys/k/capture", "secret", nil); code != http.StatusNotFound {
+		t.Errorf("Expected capture to stop after duration, got %d", code)
+	}
+}
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+
+	"github.com/gorilla/websocket"
+)
+
+// startChunkSeqTunnel 启动服务器并注册一个声明支持带序号数据块的假隧道，
+// 返回服务器地址和读取循环退出时的关闭错误
+func startChunkSeqTunnel(t *testing.T, respond func(conn *websocket.Conn, id uint64)) (string, <-chan error) {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server", ListenPort: strings.TrimPrefix(addr, "127.0.0.1:")})
+	go proxy.Start()
+	t.Cleanup(func() { proxy.Stop() })
+	time.Sleep(100 * time.Millisecond)
+
+	header := http.Header{protocol.HeaderFeatures: {protocol.FeatureChunkSeq}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws/chunk-seq", header)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if got := resp.Header.Get(protocol.HeaderServerFeatures); got != protocol.FeatureChunkSeq {
+		t.Fatalf("Expected server to confirm chunk_seq, got %q", got)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+			msg, err := protocol.DeserializeTunnelMessage(data)
+			if err != nil || msg.Type != protocol.MSG_TYPE_HTTP_REQ {
+				continue
+			}
+			respond(conn, msg.ID)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	return addr, closed
+}
+
+// chunkSeqHeader 原始连接的响应以关闭连接结束，声明长度后截断的响应才能被客户端识别
+const chunkSeqHeader = "HTTP/1.1 200 OK\r\nContent-Length: 11\r\nContent-Type: text/plain\r\n\r\n"
+
+func sendChunk(conn *websocket.Conn, id uint64, c protocol.ResponseChunk) {
+	sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, string(protocol.EncodeResponseChunk(c)))
+}
+
+func chunkSeqGet(t *testing.T, addr string) (string, error) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "http://"+addr+"/stream", nil)
+	req.Header.Set("X-Tunnel-Key", "chunk-seq")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestChunkSeqIntegrity(t *testing.T) {
+	cases := map[string][]protocol.ResponseChunk{
+		"valid": {
+			{Seq: 0, Data: []byte("hello ")},
+			{Seq: 1, Data: []byte("world")},
+			{Seq: 2, End: true, TotalLength: 11},
+		},
+		"gap": {
+			{Seq: 0, Data: []byte("hello ")},
+			{Seq: 2, Data: []byte("world")},
+			{Seq: 3, End: true, TotalLength: 11},
+		},
+		"length": {
+			{Seq: 0, Data: []byte("hello ")},
+			{Seq: 1, End: true, TotalLength: 11},
+		},
+	}
+	for name, chunks := range cases {
+		t.Run(name, func(t *testing.T) {
+			addr, _ := startChunkSeqTunnel(t, func(conn *websocket.Conn, id uint64) {
+				sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, chunkSeqHeader)
+				for _, c := range chunks {
+					sendChunk(conn, id, c)
+				}
+			})
+			body, err := chunkSeqGet(t, addr)
+			if name == "valid" {
+				if err != nil || body != "hello world" {
+					t.Errorf("Expected complete body, got %q (%v)", body, err)
+				}
+				return
+			}
+			// 响应头已发出，校验失败时中断连接，不能以完整的响应结束
+			if err == nil {
+				t.Errorf("Expected truncated response, got complete body %q", body)
+			}
+			if strings.Contains(body, "world") {
+				t.Errorf("Out-of-order chunk written to response: %q", body)
+			}
+		})
+	}
+}
+
+func TestChunkSeqRepeatedFailuresCloseTunnel(t *testing.T) {
+	addr, closed := startChunkSeqTunnel(t, func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, chunkSeqHeader)
+		sendChunk(conn, id, protocol.ResponseChunk{Seq: 1, Data: []byte("hello world")})
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := chunkSeqGet(t, addr); err == nil {
+			t.Errorf("Request %d: expected truncated response", i)
+		}
+	}
+	select {
+	case err := <-closed:
+		if !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+			t.Errorf("Expected protocol error close, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Tunnel was not closed after repeated integrity failures")
+	}
+}
+
+func TestChunkSeqEndToEnd(t *testing.T) {
+	body := strings.Repeat("0123456789", 10000)
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})
+	url, _ := startServerTunnel(t, target, config.Config{}, config.Config{Key: "chunk-e2e"})
+
+	resp, got := keyedGet(t, url+"/", "chunk-e2e")
+	if resp.StatusCode != http.StatusOK || got != body {
+		t.Errorf("Expected %d byte body, got %d %d bytes", len(body), resp.StatusCode, len(got))
+	}
+}
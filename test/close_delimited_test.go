@@ -0,0 +1,203 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+// http10Target 只会说 HTTP/1.0 的目标服务 (打印机、IPMI 管理卡)，respond 写出原始响应，
+// 返回 true 时保持连接读取下一个请求，否则关闭连接作为响应体的结束
+type http10Target struct {
+	addr  string
+	conns atomic.Int32
+}
+
+func startHTTP10Target(t *testing.T, respond func(w *bufio.Writer, req *http.Request) (keepAlive bool)) *http10Target {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	target := &http10Target{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			target.conns.Add(1)
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				w := bufio.NewWriter(conn)
+				for {
+					req, err := http.ReadRequest(r)
+					if err != nil {
+						return
+					}
+					io.Copy(io.Discard, req.Body)
+					keepAlive := respond(w, req)
+					w.Flush()
+					if !keepAlive {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return target
+}
+
+func TestCloseDelimitedTargetResponses(t *testing.T) {
+	large := strings.Repeat("0123456789abcdef", 16<<10) // 256KB，超过完整响应阈值，分块发送
+	tests := []struct {
+		name    string
+		respond func(w *bufio.Writer, req *http.Request) bool
+		body    string
+	}{
+		{
+			name: "http/1.0 close delimited",
+			respond: func(w *bufio.Writer, req *http.Request) bool {
+				io.WriteString(w, "HTTP/1.0 200 OK\r\nContent-Type: text/html\r\nServer: PrinterWeb/1.0\r\n\r\n<html>status: ready</html>")
+				return false
+			},
+			body: "<html>status: ready</html>",
+		},
+		{
+			name: "http/1.0 close delimited slow",
+			respond: func(w *bufio.Writer, req *http.Request) bool {
+				io.WriteString(w, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nfirst ")
+				w.Flush()
+				time.Sleep(100 * time.Millisecond)
+				io.WriteString(w, "second")
+				return false
+			},
+			body: "first second",
+		},
+		{
+			name: "http/1.0 close delimited large",
+			respond: func(w *bufio.Writer, req *http.Request) bool {
+				io.WriteString(w, "HTTP/1.0 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"+large)
+				return false
+			},
+			body: large,
+		},
+		{
+			name: "http/1.0 keep-alive without length",
+			respond: func(w *bufio.Writer, req *http.Request) bool {
+				// 声明 keep-alive 却不给长度，仍只能以关闭连接结束
+				io.WriteString(w, "HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nKeep-Alive: timeout=5\r\n\r\nipmi")
+				return false
+			},
+			body: "ipmi",
+		},
+		{
+			name: "http/1.1 connection close",
+			respond: func(w *bufio.Writer, req *http.Request) bool {
+				io.WriteString(w, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain\r\n\r\nlegacy")
+				return false
+			},
+			body: "legacy",
+		},
+	}
+
+	// 公网入口: net/http 服务器按调用方协议选择分块或关闭连接，服务器自己监听时总是以关闭连接结束；
+	// 两端合并数据块时以关闭连接结束的响应体同样要在 EOF 后立即结束
+	frontends := []struct {
+		name  string
+		start func(t *testing.T, targetAddr, key string) string
+	}{
+		{"net/http", func(t *testing.T, targetAddr, key string) string {
+			url, _ := startServerTunnel(t, nil, config.Config{}, config.Config{Key: key, TargetAddr: targetAddr})
+			return url
+		}},
+		{"raw listener", func(t *testing.T, targetAddr, key string) string {
+			url, _ := startServerTunnel(t, nil, config.Config{ListenPort: strconv.Itoa(freePort(t))}, config.Config{Key: key, TargetAddr: targetAddr})
+			return url
+		}},
+		{"coalescing", func(t *testing.T, targetAddr, key string) string {
+			url, _ := startServerTunnel(t, nil, config.Config{ChunkCoalesceBytes: 16384}, config.Config{Key: key, TargetAddr: targetAddr, ChunkCoalesceBytes: 16384})
+			return url
+		}},
+	}
+
+	for i, tt := range tests {
+		for _, fe := range frontends {
+			t.Run(tt.name+"/"+fe.name, func(t *testing.T) {
+				target := startHTTP10Target(t, tt.respond)
+				key := fmt.Sprintf("legacy-%d", i)
+				url := fe.start(t, target.addr, key)
+
+				// HTTP/1.1 调用方收到分块编码的响应，不会等到客户端超时
+				start := time.Now()
+				resp, body := keyedGet(t, url+"/status", key)
+				if elapsed := time.Since(start); elapsed > 3*time.Second {
+					t.Errorf("Expected the close-delimited response to end promptly, took %v", elapsed)
+				}
+				if resp.StatusCode != http.StatusOK || body != tt.body {
+					t.Errorf("Expected 200 with %d bytes, got %d with %d bytes %.60q", len(tt.body), resp.StatusCode, len(body), body)
+				}
+				for _, h := range []string{"Connection", "Keep-Alive"} {
+					if v := resp.Header.Get(h); v != "" {
+						t.Errorf("Expected hop-by-hop header %s to be removed, got %q", h, v)
+					}
+				}
+
+				// HTTP/1.0 调用方不认识分块编码，收到以关闭连接结束的响应
+				conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				fmt.Fprintf(conn, "GET /status HTTP/1.0\r\nX-Tunnel-Key: %s\r\n\r\n", key)
+				data, err := io.ReadAll(conn)
+				if err != nil {
+					t.Fatalf("Expected the server to close the HTTP/1.0 connection, got %v after %d bytes", err, len(data))
+				}
+				head, raw, _ := strings.Cut(string(data), "\r\n\r\n")
+				status, header, _ := strings.Cut(head, "\r\n")
+				if !strings.HasPrefix(status, "HTTP/1.") || !strings.Contains(status, "200") || raw != tt.body {
+					t.Errorf("Expected an HTTP/1.0 caller to get 200 with the body, got %q %.60q", status, raw)
+				}
+				if lower := strings.ToLower(header); strings.Contains(lower, "transfer-encoding") || strings.Contains(lower, "keep-alive") {
+					t.Errorf("Expected a close-delimited response without the target's hop-by-hop headers, got %q", header)
+				}
+			})
+		}
+	}
+}
+
+func TestHTTP10KeepAliveTarget(t *testing.T) {
+	target := startHTTP10Target(t, func(w *bufio.Writer, req *http.Request) bool {
+		body := "path=" + req.URL.Path
+		fmt.Fprintf(w, "HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		return true
+	})
+	url, _ := startServerTunnel(t, nil, config.Config{}, config.Config{Key: "legacy-keepalive", TargetAddr: target.addr})
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		if _, body := keyedGet(t, fmt.Sprintf("%s/page/%d", url, i), "legacy-keepalive"); body != fmt.Sprintf("path=/page/%d", i) {
+			t.Errorf("Request %d: unexpected body %q", i, body)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("Request %d: took %v", i, elapsed)
+		}
+	}
+	// 声明了长度的 HTTP/1.0 keep-alive 响应可以复用连接
+	if n := target.conns.Load(); n != 1 {
+		t.Errorf("Expected the keep-alive connection to be reused, got %d connections", n)
+	}
+}
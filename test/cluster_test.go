@@ -0,0 +1,176 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestClusterForwardsToPeer(t *testing.T) {
+	const token = "cluster-token-0123456789"
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "host=%s token=%q hop=%s", r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Cluster-Token"), r.Header.Get("X-Cluster-Hop"))
+	})
+	// 客户端连接到服务器B
+	peerURL, _ := startServerTunnel(t, target,
+		config.Config{ClusterToken: token},
+		config.Config{Key: "regional"})
+
+	// 服务器A没有该key的隧道，从B拉取key列表
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:                "server",
+		AdminToken:          "secret",
+		ClusterPeers:        []string{peerURL},
+		ClusterToken:        token,
+		ClusterSyncInterval: 50 * time.Millisecond,
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	defer proxy.Stop()
+
+	var resp *http.Response
+	var body string
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		req, _ := http.NewRequest("GET", proxyServer.URL+"/app", nil)
+		req.Header.Set("X-Tunnel-Key", "regional")
+		req.Host = "app.example.com"
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp, body = r, readBody(r)
+		if resp.StatusCode == http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// 原始主机名保留，集群令牌和转发标记不会转发给目标服务
+	if resp.StatusCode != http.StatusOK || body != `host=app.example.com token="" hop=` {
+		t.Fatalf("Expected request served by peer, got %d %q", resp.StatusCode, body)
+	}
+
+	var status struct {
+		Peers []struct {
+			Keys []string `json:"keys"`
+		} `json:"peers"`
+	}
+	if code := adminGet(t, proxyServer.URL, "/admin/cluster", "secret", &status); code != http.StatusOK {
+		t.Fatalf("Expected cluster status 200, got %d", code)
+	}
+	if len(status.Peers) != 1 || len(status.Peers[0].Keys) != 1 || status.Peers[0].Keys[0] != "regional" {
+		t.Errorf("Expected peer with key regional, got %+v", status)
+	}
+
+	// 已由其他服务器转发的请求不再转发
+	req, _ := http.NewRequest("GET", proxyServer.URL+"/app", nil)
+	req.Header.Set("X-Tunnel-Key", "regional")
+	req.Header.Set("X-Cluster-Hop", "1")
+	req.Header.Set("X-Cluster-Token", token)
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	readBody(r)
+	if r.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected forwarded request not to be forwarded again, got %d", r.StatusCode)
+	}
+
+	// 没有令牌时集群入口不可见
+	r, err = http.Get(peerURL + "/cluster/keys")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	readBody(r)
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without cluster token, got %d", r.StatusCode)
+	}
+}
+
+func TestClusterFallbackOnlyWithUnsentBody(t *testing.T) {
+	const token = "cluster-token-0123456789"
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "fallback:%s", b)
+	}))
+	defer mirror.Close()
+	// 拥有该key的服务器读完请求体后断开连接
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cluster/keys" {
+			fmt.Fprint(w, `{"keys":["regional"]}`)
+			return
+		}
+		io.ReadAll(r.Body)
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	defer peer.Close()
+
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:                "server",
+		AdminToken:          "secret",
+		ClusterPeers:        []string{peer.URL},
+		ClusterToken:        token,
+		ClusterSyncInterval: 200 * time.Millisecond,
+		Keys:                map[string]*config.KeyConfig{"regional": {FallbackUpstream: mirror.URL}},
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	defer proxy.Stop()
+
+	post := func() (int, string) {
+		req, _ := http.NewRequest("POST", proxyServer.URL+"/submit", strings.NewReader("payload"))
+		req.Header.Set("X-Tunnel-Key", "regional")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.StatusCode, readBody(resp)
+	}
+	waitForPeerKey := func() {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			var status struct {
+				Peers []struct {
+					Keys []string `json:"keys"`
+				} `json:"peers"`
+			}
+			adminGet(t, proxyServer.URL, "/admin/cluster", "secret", &status)
+			if len(status.Peers) == 1 && len(status.Peers[0].Keys) == 1 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Peer keys were not synced, got %+v", status)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// 请求体已发给该服务器，备用地址只能收到不完整的请求体，不回退
+	waitForPeerKey()
+	if status, body := post(); status != http.StatusBadGateway {
+		t.Errorf("Expected 502 after the body was sent to the peer, got %d %q", status, body)
+	}
+
+	// 连接该服务器失败时请求体还没有读取，完整地交给备用地址
+	waitForPeerKey()
+	peer.Close()
+	if status, body := post(); status != http.StatusOK || body != "fallback:payload" {
+		t.Errorf("Expected fallback to receive the full body, got %d %q", status, body)
+	}
+}
+
+// readBody 读取并关闭响应体
+func readBody(resp *http.Response) string {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestChunkCoalescingThroughTunnel(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: first\n\n")
+			flusher.Flush()
+			time.Sleep(1200 * time.Millisecond)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i := 0; i < 500; i++ {
+			fmt.Fprintf(w, "{\"line\":%d}\n", i)
+			flusher.Flush()
+		}
+	})
+	url, _ := startServerTunnel(t, target,
+		config.Config{ChunkCoalesceBytes: 16 << 10, ChunkCoalesceDelay: time.Second},
+		config.Config{Key: "coalesce", ChunkCoalesceBytes: 16 << 10, ChunkCoalesceDelay: time.Second})
+
+	// 逐行输出的响应合并后完整、有序
+	_, body := keyedGet(t, url+"/lines", "coalesce")
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if len(lines) != 500 || lines[0] != `{"line":0}` || lines[499] != `{"line":499}` {
+		t.Fatalf("Expected 500 ordered lines, got %d", len(lines))
+	}
+
+	// 事件流在客户端和服务器都不等待合并，第一条事件在等待时间到期之前送达
+	req, _ := http.NewRequest("GET", url+"/events", nil)
+	req.Header.Set("X-Tunnel-Key", "coalesce")
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: first\n" {
+		t.Fatalf("Expected first event, got %q (%v)", line, err)
+	}
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Errorf("Expected event stream to bypass coalescing, first event took %s", elapsed)
+	}
+}
@@ -0,0 +1,226 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/config"
+	v1 "singleproxy/pkg/protocol/testdata/v1"
+	"singleproxy/pkg/server"
+)
+
+// v1Tunnel 只使用冻结的 v1 编码收发消息的隧道客户端，代表没有升级的旧客户端
+type v1Tunnel struct {
+	addr string
+
+	mu         sync.Mutex
+	unexpected []uint8 // 收到的 v1 不认识的消息类型
+}
+
+// startV1Tunnel 启动当前版本的服务器 (启用了请求头索引表等需要协商的功能)，并以不声明任何功能的 v1 客户端注册隧道 v1-client。
+// respond 收到每个请求的ID和解析后的请求，用 v1 编码回复
+func startV1Tunnel(t *testing.T, respond func(conn *websocket.Conn, id uint64, req *http.Request)) *v1Tunnel {
+	t.Helper()
+	tun := &v1Tunnel{addr: fmt.Sprintf("127.0.0.1:%d", freePort(t))}
+	cfg := config.Config{Mode: "server", ListenPort: strings.TrimPrefix(tun.addr, "127.0.0.1:"), AdminToken: "admin-secret", HeaderTableSize: 16384}
+	proxy := server.NewSinglePortProxy(&cfg)
+	go proxy.Start()
+	t.Cleanup(func() { proxy.Stop() })
+	time.Sleep(100 * time.Millisecond)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+tun.addr+"/ws/v1-client", nil)
+	if err != nil {
+		t.Fatalf("Failed to register v1 tunnel: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			id, msgType, payload, err := v1.Decode(data)
+			if err != nil || msgType != v1.TypeHTTPReq {
+				tun.mu.Lock()
+				tun.unexpected = append(tun.unexpected, msgType)
+				tun.mu.Unlock()
+				continue
+			}
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
+			if err != nil {
+				t.Errorf("v1 client cannot parse request: %v", err)
+				continue
+			}
+			respond(conn, id, req)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	return tun
+}
+
+// unexpectedTypes 返回 v1 客户端收到的、它不认识的消息类型
+func (tun *v1Tunnel) unexpectedTypes() []uint8 {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	return append([]uint8(nil), tun.unexpected...)
+}
+
+// v1Respond 用 v1 编码发送响应头、数据块和结束标记
+func v1Respond(conn *websocket.Conn, id uint64, status string, header http.Header, chunks ...string) {
+	_ = conn.WriteMessage(websocket.BinaryMessage, v1.Encode(id, v1.TypeHTTPRes, v1.EncodeResponseHead(status, header)))
+	for _, chunk := range chunks {
+		_ = conn.WriteMessage(websocket.BinaryMessage, v1.Encode(id, v1.TypeHTTPResChunk, []byte(chunk)))
+	}
+	_ = conn.WriteMessage(websocket.BinaryMessage, v1.EncodeEnd(id))
+}
+
+// TestV1ClientCompatibility 当前服务器与 v1 客户端的兼容性矩阵。
+// 涉及协议的改动必须在这里增加用例，证明不声明新功能的旧客户端仍然可用
+func TestV1ClientCompatibility(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(conn *websocket.Conn, id uint64, req *http.Request)
+		request func(t *testing.T, url string)
+	}{
+		{
+			name: "streamed response",
+			respond: func(conn *websocket.Conn, id uint64, req *http.Request) {
+				v1Respond(conn, id, "200 OK", http.Header{"Content-Type": {"text/plain"}}, "hello ", "from ", "v1")
+			},
+			request: func(t *testing.T, url string) {
+				resp, body := keyedGet(t, url+"/stream", "v1-client")
+				if resp.StatusCode != http.StatusOK || body != "hello from v1" {
+					t.Errorf("Expected 200 %q, got %d %q", "hello from v1", resp.StatusCode, body)
+				}
+				if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+					t.Errorf("Expected Content-Type text/plain, got %q", ct)
+				}
+			},
+		},
+		{
+			name: "empty response",
+			respond: func(conn *websocket.Conn, id uint64, req *http.Request) {
+				v1Respond(conn, id, "204 No Content", http.Header{})
+			},
+			request: func(t *testing.T, url string) {
+				resp, _ := keyedGet(t, url+"/empty", "v1-client")
+				if resp.StatusCode != http.StatusNoContent {
+					t.Errorf("Expected 204, got %d", resp.StatusCode)
+				}
+			},
+		},
+		{
+			name: "request body inline",
+			respond: func(conn *websocket.Conn, id uint64, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				v1Respond(conn, id, "200 OK", http.Header{}, req.Method+" "+req.URL.RequestURI()+" "+string(body))
+			},
+			request: func(t *testing.T, url string) {
+				req, _ := http.NewRequest(http.MethodPost, url+"/submit?x=1", strings.NewReader("payload"))
+				req.Header.Set("X-Tunnel-Key", "v1-client")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Request failed: %v", err)
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				if string(body) != "POST /submit?x=1 payload" {
+					t.Errorf("Expected the v1 client to receive the full request, got %q", body)
+				}
+			},
+		},
+		{
+			name: "repeated headers",
+			respond: func(conn *websocket.Conn, id uint64, req *http.Request) {
+				v1Respond(conn, id, "200 OK", http.Header{}, req.UserAgent()+" "+req.Header.Get("Cookie"))
+			},
+			request: func(t *testing.T, url string) {
+				// 服务器启用了请求头索引表，未声明支持的客户端每次都收到原始头部
+				for i := 0; i < 3; i++ {
+					req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/page/%d", url, i), nil)
+					req.Header.Set("X-Tunnel-Key", "v1-client")
+					req.Header.Set("User-Agent", "browser/1.0")
+					req.Header.Set("Cookie", "session=abc")
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Fatalf("Request failed: %v", err)
+					}
+					body, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					if string(body) != "browser/1.0 session=abc" {
+						t.Errorf("Request %d: expected the v1 client to receive plain headers, got %q", i, body)
+					}
+				}
+			},
+		},
+		{
+			name: "public client disconnects",
+			respond: func(conn *websocket.Conn, id uint64, req *http.Request) {
+				// 不回复，等待公网用户断开
+			},
+			request: func(t *testing.T, url string) {
+				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				defer cancel()
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/slow", nil)
+				req.Header.Set("X-Tunnel-Key", "v1-client")
+				if resp, err := http.DefaultClient.Do(req); err == nil {
+					resp.Body.Close()
+					t.Fatal("Expected the request to be abandoned")
+				}
+				// 取消消息只发给声明了 FeatureCancel 的客户端
+				time.Sleep(300 * time.Millisecond)
+			},
+		},
+		{
+			name: "client-originated request without negotiation",
+			respond: func(conn *websocket.Conn, id uint64, req *http.Request) {
+				// 未声明 FeatureLocalForward 的客户端发来的本地请求按未知消息忽略，服务器不回复本地响应
+				local := "GET /ignored HTTP/1.1\r\nHost: localhost\r\nX-Tunnel-Key: v1-client\r\n\r\n"
+				_ = conn.WriteMessage(websocket.BinaryMessage, v1.Encode(1<<63|1, 13, []byte(local)))
+				v1Respond(conn, id, "200 OK", http.Header{}, "ok")
+			},
+			request: func(t *testing.T, url string) {
+				resp, body := keyedGet(t, url+"/normal", "v1-client")
+				if resp.StatusCode != http.StatusOK || body != "ok" {
+					t.Errorf("Expected 200 %q, got %d %q", "ok", resp.StatusCode, body)
+				}
+				time.Sleep(200 * time.Millisecond)
+			},
+		},
+		{
+			name: "drain",
+			respond: func(conn *websocket.Conn, id uint64, req *http.Request) {
+				v1Respond(conn, id, "200 OK", http.Header{})
+			},
+			request: func(t *testing.T, url string) {
+				// 迁移通知只发给声明了 FeatureGoAway 的客户端，旧客户端在宽限期结束时被关闭
+				status, out := postDrain(t, url, `{"grace": "200ms"}`)
+				if status != http.StatusAccepted || out["drained"] != float64(1) || out["notified"] != float64(0) {
+					t.Fatalf("Unexpected drain response %d %v", status, out)
+				}
+				time.Sleep(400 * time.Millisecond)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tun := startV1Tunnel(t, tc.respond)
+			tc.request(t, "http://"+tun.addr)
+			if types := tun.unexpectedTypes(); len(types) != 0 {
+				t.Errorf("Server sent message types unknown to v1 clients: %v", types)
+			}
+		})
+	}
+}
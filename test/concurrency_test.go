@@ -0,0 +1,147 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestRequestBurstDoesNotLeakGoroutines(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer targetServer.Close()
+
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server"})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+		TargetAddr: strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:        "burst-test",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	transport := &http.Transport{MaxIdleConnsPerHost: 50}
+	httpClient := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	baseline := runtime.NumGoroutine()
+
+	const total, workers = 1000, 50
+	jobs := make(chan struct{}, total)
+	for i := 0; i < total; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := 0
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				req, _ := http.NewRequest("GET", proxyServer.URL+"/burst", nil)
+				req.Header.Set("X-Tunnel-Key", "burst-test")
+				resp, err := httpClient.Do(req)
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				if err != nil || resp.StatusCode != http.StatusOK {
+					mu.Lock()
+					failures++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	transport.CloseIdleConnections()
+
+	if failures > 0 {
+		t.Errorf("Expected all %d requests to succeed, %d failed", total, failures)
+	}
+	if active := tunnelClient.ActiveRequests(); active != 0 {
+		t.Errorf("Expected no active requests after burst, got %d", active)
+	}
+
+	// 允许少量空闲连接相关的协程存在
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline+10 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline+10 {
+		t.Errorf("Goroutines did not return to baseline: baseline=%d now=%d", baseline, n)
+	}
+}
+
+func TestConcurrentRequestLimitRejects(t *testing.T) {
+	release := make(chan struct{})
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "slow")
+	}))
+	defer targetServer.Close()
+
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server"})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:                  "client",
+		ServerAddr:            strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+		TargetAddr:            strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:                   "limit-test",
+		MaxConcurrentRequests: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	get := func() int {
+		req, _ := http.NewRequest("GET", proxyServer.URL+"/", nil)
+		req.Header.Set("X-Tunnel-Key", "limit-test")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Request failed: %v", err)
+			return 0
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	first := make(chan int, 1)
+	go func() { first <- get() }()
+	time.Sleep(200 * time.Millisecond)
+
+	if status := get(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while at the concurrency limit, got %d", status)
+	}
+	close(release)
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("Expected first request to succeed, got %d", status)
+	}
+}
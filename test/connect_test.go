@@ -0,0 +1,213 @@
+package test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// startConnectProxy 启动服务器作为正向代理，分别以 net/http 服务器和服务器自己的监听器作为入口
+func startConnectProxy(t *testing.T, frontend string, cfg config.Config) string {
+	t.Helper()
+	cfg.Mode = "server"
+	if frontend == "net/http" {
+		proxyServer := httptest.NewServer(server.NewSinglePortProxy(&cfg))
+		t.Cleanup(proxyServer.Close)
+		return strings.TrimPrefix(proxyServer.URL, "http://")
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	cfg.ListenPort = strings.TrimPrefix(addr, "127.0.0.1:")
+	proxy := server.NewSinglePortProxy(&cfg)
+	go proxy.Start()
+	t.Cleanup(func() { proxy.Stop() })
+	time.Sleep(100 * time.Millisecond)
+	return addr
+}
+
+// rawConnect 发送 CONNECT 请求，返回连接和响应状态码
+func rawConnect(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+	}
+	return conn, reader, resp.StatusCode
+}
+
+// startEchoServer 启动一个原样返回数据的TCP服务，连接关闭时通知 closed
+func startEchoServer(t *testing.T) (addr string, closed chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	closed = make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return ln.Addr().String(), closed
+}
+
+func TestConnectProxyHTTPS(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "secure %s", r.URL.Path)
+	}))
+	t.Cleanup(target.Close)
+
+	for _, frontend := range []string{"net/http", "raw listener"} {
+		t.Run(frontend, func(t *testing.T) {
+			proxyAddr := startConnectProxy(t, frontend, config.Config{ProxyAllowCIDRs: []string{"127.0.0.1"}})
+			proxyURL, _ := url.Parse("http://" + proxyAddr)
+			// 与 curl -x http://proxy https://target 相同: 先 CONNECT，再在隧道内完成TLS握手
+			httpClient := &http.Client{
+				Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+				Timeout:   5 * time.Second,
+			}
+			t.Cleanup(httpClient.CloseIdleConnections)
+			for i := 0; i < 3; i++ {
+				resp, err := httpClient.Get(fmt.Sprintf("%s/page/%d", target.URL, i))
+				if err != nil {
+					t.Fatalf("Request through CONNECT failed: %v", err)
+				}
+				if body := readBody(resp); resp.StatusCode != http.StatusOK || body != fmt.Sprintf("secure /page/%d", i) {
+					t.Errorf("Expected the target response, got %d %q", resp.StatusCode, body)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectProxyRejections(t *testing.T) {
+	echoAddr, _ := startEchoServer(t)
+	for _, frontend := range []string{"net/http", "raw listener"} {
+		t.Run(frontend, func(t *testing.T) {
+			// 环回地址默认不允许访问
+			blocked := startConnectProxy(t, frontend, config.Config{})
+			if _, _, status := rawConnect(t, blocked, echoAddr); status != http.StatusForbidden {
+				t.Errorf("Expected 403 for a blocked destination, got %d", status)
+			}
+
+			proxyAddr := startConnectProxy(t, frontend, config.Config{ProxyAllowCIDRs: []string{"127.0.0.1"}, IPRateLimit: 1})
+			if _, _, status := rawConnect(t, proxyAddr, "127.0.0.1"); status != http.StatusBadRequest {
+				t.Errorf("Expected 400 for a target without port, got %d", status)
+			}
+			// 每秒1个、突发2个，第三个请求被限频
+			if _, _, status := rawConnect(t, proxyAddr, echoAddr); status != http.StatusOK {
+				t.Errorf("Expected 200, got %d", status)
+			}
+			if _, _, status := rawConnect(t, proxyAddr, echoAddr); status != http.StatusTooManyRequests {
+				t.Errorf("Expected 429 once the IP rate limit is exceeded, got %d", status)
+			}
+		})
+	}
+}
+
+func TestConnectProxyClose(t *testing.T) {
+	for _, frontend := range []string{"net/http", "raw listener"} {
+		t.Run(frontend, func(t *testing.T) {
+			echoAddr, targetClosed := startEchoServer(t)
+			proxyAddr := startConnectProxy(t, frontend, config.Config{ProxyAllowCIDRs: []string{"127.0.0.1"}, ConnectIdleTimeout: 300 * time.Millisecond})
+
+			// 数据双向转发，CONNECT 请求之后立即发送的数据也不会丢失
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nearly-", echoAddr, echoAddr)
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected 200 Connection Established, got %v %v", resp, err)
+			}
+			io.WriteString(conn, "hello")
+			got := make([]byte, len("early-hello"))
+			if _, err := io.ReadFull(reader, got); err != nil || string(got) != "early-hello" {
+				t.Fatalf("Expected the echoed data, got %q %v", got, err)
+			}
+
+			// 客户端断开时目标连接随之关闭
+			conn.Close()
+			select {
+			case <-targetClosed:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Expected the target connection to close after the client disconnected")
+			}
+
+			// 两个方向都空闲超过 -connect-idle-timeout 时关闭
+			idleConn, idleReader, status := rawConnect(t, proxyAddr, echoAddr)
+			if status != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", status)
+			}
+			start := time.Now()
+			if _, err := idleReader.ReadByte(); err != io.EOF {
+				t.Errorf("Expected EOF after the idle timeout, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+				t.Errorf("Expected the idle tunnel to close after about 300ms, took %v", elapsed)
+			}
+			idleConn.Close()
+		})
+	}
+}
+
+func TestConnectProxyTargetClose(t *testing.T) {
+	// 目标主动关闭时公网连接随之关闭
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "bye")
+		conn.Close()
+	}()
+
+	proxyAddr := startConnectProxy(t, "raw listener", config.Config{ProxyAllowCIDRs: []string{"127.0.0.1"}})
+	_, reader, status := rawConnect(t, proxyAddr, ln.Addr().String())
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil || string(data) != "bye" {
+		t.Errorf("Expected the target data followed by EOF, got %q %v", data, err)
+	}
+}
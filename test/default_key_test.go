@@ -0,0 +1,50 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+func TestDefaultKeyRouting(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		url, _ := startServerTunnel(t, target, config.Config{DefaultKey: "site"}, config.Config{Key: "site"})
+		if resp, body := keyedGet(t, url+"/", ""); resp.StatusCode != http.StatusOK || body != "ok" {
+			t.Errorf("Expected request to be routed to site, got %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		url, _ := startServerTunnel(t, target, config.Config{DefaultKey: config.DefaultKeyNone}, config.Config{Key: "default"})
+		if resp, _ := keyedGet(t, url+"/", ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 with default routing disabled, got %d", resp.StatusCode)
+		}
+		// 显式携带key的请求不受影响
+		if resp, body := keyedGet(t, url+"/", "default"); resp.StatusCode != http.StatusOK || body != "ok" {
+			t.Errorf("Expected explicit key to work, got %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("per host", func(t *testing.T) {
+		url, _ := startServerTunnel(t, target, config.Config{Hosts: map[string]*config.HostConfig{
+			"*.scan.example.com": {DefaultKey: config.DefaultKeyNone},
+			"www.example.com":    {DefaultKey: "site"},
+		}}, config.Config{Key: "default"})
+		if resp, _ := keyedGet(t, url+"/", "", "Host", "a.scan.example.com"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for host with default routing disabled, got %d", resp.StatusCode)
+		}
+		// 该主机名覆盖的默认key没有在线隧道
+		if resp, _ := keyedGet(t, url+"/", "", "Host", "www.example.com"); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected host default key to be used, got %d", resp.StatusCode)
+		}
+		if resp, body := keyedGet(t, url+"/", "", "Host", "other.example.com"); resp.StatusCode != http.StatusOK || body != "ok" {
+			t.Errorf("Expected global default key for other hosts, got %d %q", resp.StatusCode, body)
+		}
+	})
+}
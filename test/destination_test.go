@@ -0,0 +1,138 @@
+package test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// socksConnect 通过SOCKS5发起CONNECT并返回回复码
+func socksConnect(t *testing.T, proxyAddr string, ip net.IP, port int) byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Fatalf("Failed to read SOCKS5 greeting: %v", err)
+	}
+
+	req := append([]byte{0x05, 0x01, 0x00, 0x01}, ip.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	conn.Write(req)
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read SOCKS5 reply: %v", err)
+	}
+	return reply[1]
+}
+
+func TestProxyDestinationPolicy(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "internal")
+	}))
+	defer targetServer.Close()
+	targetPort := targetServer.Listener.Addr().(*net.TCPAddr).Port
+
+	blocked := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", AdminToken: "admin-secret"}))
+	defer blocked.Close()
+	allowed := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode:            "server",
+		ProxyAllowCIDRs: []string{"127.0.0.0/8"},
+	}))
+	defer allowed.Close()
+
+	tests := []struct {
+		name   string
+		base   string
+		host   string
+		status int
+	}{
+		{"loopback IP blocked", blocked.URL, "127.0.0.1", http.StatusForbidden},
+		{"hostname resolving to loopback blocked", blocked.URL, "localhost", http.StatusForbidden},
+		{"metadata address blocked", blocked.URL, "169.254.169.254", http.StatusForbidden},
+		{"allowlisted range", allowed.URL, "127.0.0.1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(fmt.Sprintf("%s/proxy/%s:%d/", tt.base, tt.host, targetPort))
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+
+	req, _ := http.NewRequest("GET", blocked.URL+"/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Metrics request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "singleproxy_server_proxy_blocked_total") ||
+		strings.Contains(string(body), "singleproxy_server_proxy_blocked_total 0\n") {
+		t.Errorf("Expected blocked counter to be incremented, got:\n%s", body)
+	}
+}
+
+func TestSOCKS5DestinationPolicy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	for _, tt := range []struct {
+		name  string
+		allow []string
+		reply byte
+	}{
+		{"default deny", nil, 0x02},
+		{"allowlisted", []string{"127.0.0.1"}, 0x00},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t)
+			proxy := server.NewSinglePortProxy(&config.Config{
+				Mode:            "server",
+				ListenPort:      fmt.Sprint(port),
+				ProxyAllowCIDRs: tt.allow,
+			})
+			go proxy.Start()
+			time.Sleep(100 * time.Millisecond)
+
+			reply := socksConnect(t, fmt.Sprintf("127.0.0.1:%d", port), net.IPv4(127, 0, 0, 1), targetPort)
+			if reply != tt.reply {
+				t.Errorf("Expected SOCKS5 reply %#x, got %#x", tt.reply, reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/dnscache"
+	"singleproxy/pkg/server"
+)
+
+func TestAdminDNSCache(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer targetServer.Close()
+	_, targetPort, _ := net.SplitHostPort(strings.TrimPrefix(targetServer.URL, "http://"))
+
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:            "server",
+		ProxyAllowCIDRs: []string{"127.0.0.0/8", "::1"},
+		AdminTokens: []*config.AdminTokenConfig{
+			{Name: "ops", Token: "ops-token-0123456789", Full: true},
+			{Name: "team-a", Token: "team-a-token-0123456", Keys: []string{"team-a-*"}},
+		},
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	dnscache.Default().Flush()
+
+	// 两次通过路径代理访问同一主机名，第二次命中缓存
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(fmt.Sprintf("%s/proxy/localhost:%s/", proxyServer.URL, targetPort))
+		if err != nil {
+			t.Fatalf("Proxy request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 through proxy, got %d", resp.StatusCode)
+		}
+	}
+
+	var stats dnscache.Stats
+	if code := adminGet(t, proxyServer.URL, "/admin/dns", "ops-token-0123456789", &stats); code != http.StatusOK {
+		t.Fatalf("Expected 200 from /admin/dns, got %d", code)
+	}
+	if stats.Entries < 1 || stats.Hits < 1 {
+		t.Errorf("Expected cached localhost entry with hits, got %+v", stats)
+	}
+
+	if code := adminDo(t, "POST", proxyServer.URL+"/admin/dns/flush", "team-a-token-0123456", ""); code != http.StatusForbidden {
+		t.Errorf("Scoped token should not flush the DNS cache, got %d", code)
+	}
+	if code := adminDo(t, "POST", proxyServer.URL+"/admin/dns/flush", "ops-token-0123456789", ""); code != http.StatusOK {
+		t.Errorf("Expected 200 flushing the DNS cache, got %d", code)
+	}
+	if n := dnscache.Default().Len(); n != 0 {
+		t.Errorf("Expected empty cache after flush, got %d entries", n)
+	}
+}
@@ -0,0 +1,149 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/doctor"
+	"singleproxy/pkg/server"
+)
+
+// writeTestCert 生成自签名证书和私钥文件
+func writeTestCert(t *testing.T, dir, name string, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// findResult 返回指定名称的检查结果
+func findResult(t *testing.T, report *doctor.Report, name string) doctor.Result {
+	t.Helper()
+	for _, res := range report.Results {
+		if res.Name == name {
+			return res
+		}
+	}
+	t.Fatalf("Check %q not found in report %+v", name, report.Results)
+	return doctor.Result{}
+}
+
+func TestDoctorServerChecks(t *testing.T) {
+	dir := t.TempDir()
+	certA, keyA := writeTestCert(t, dir, "a", time.Now().Add(365*24*time.Hour))
+	_, keyB := writeTestCert(t, dir, "b", time.Now().Add(365*24*time.Hour))
+	certSoon, keySoon := writeTestCert(t, dir, "soon", time.Now().Add(48*time.Hour))
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer busy.Close()
+	busyPort := fmt.Sprint(busy.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		name     string
+		cfg      config.Config
+		check    string
+		status   doctor.Status
+		contains string
+	}{
+		{"matching keypair", config.Config{CertFile: certA, KeyFile: keyA}, "tls", doctor.Pass, "matches"},
+		{"mismatched keypair", config.Config{CertFile: certA, KeyFile: keyB}, "tls", doctor.Fail, "cannot load"},
+		{"missing key file", config.Config{CertFile: certA}, "config", doctor.Fail, "-cert 和 -key-file"},
+		{"unreadable cert", config.Config{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyA}, "tls", doctor.Fail, "cannot load"},
+		{"expiring certificate", config.Config{CertFile: certSoon, KeyFile: keySoon}, "tls", doctor.Warn, "expires soon"},
+		{"port in use", config.Config{ListenPort: busyPort}, "listen_port", doctor.Fail, "cannot bind"},
+		{"short admin token", config.Config{AdminToken: "abc"}, "admin_token", doctor.Warn, "at least 16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Mode = "server"
+			if tt.cfg.ListenPort == "" {
+				tt.cfg.ListenPort = "0"
+			}
+			report := doctor.Run(&tt.cfg, doctor.Options{Network: true})
+			res := findResult(t, report, tt.check)
+			if res.Status != tt.status || !strings.Contains(res.Message, tt.contains) {
+				t.Errorf("Expected %s containing %q, got %s %q", tt.status, tt.contains, res.Status, res.Message)
+			}
+			if report.Failed() != (tt.status == doctor.Fail) {
+				t.Errorf("Unexpected Failed()=%v", report.Failed())
+			}
+		})
+	}
+}
+
+func TestDoctorClientChecks(t *testing.T) {
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server"}))
+	defer proxyServer.Close()
+	targetServer := httptest.NewServer(http.NotFoundHandler())
+	defer targetServer.Close()
+	wsURL := strings.Replace(proxyServer.URL, "http://", "ws://", 1)
+	targetAddr := strings.TrimPrefix(targetServer.URL, "http://")
+
+	report := doctor.Run(&config.Config{Mode: "client", ServerAddr: wsURL, TargetAddr: targetAddr, Key: "live"},
+		doctor.Options{Network: true, CheckKey: "doctor-test"})
+	for _, name := range []string{"server_addr", "server_tcp", "handshake", "clock", "target"} {
+		if res := findResult(t, report, name); res.Status != doctor.Pass {
+			t.Errorf("Expected %s to pass, got %s %q", name, res.Status, res.Message)
+		}
+	}
+	if report.Failed() {
+		t.Errorf("Expected healthy client config to pass")
+	}
+
+	// 目标未监听、服务器地址带 /ws、目标带 scheme
+	closedPort := freePort(t)
+	report = doctor.Run(&config.Config{
+		Mode:       "client",
+		ServerAddr: wsURL + "/ws",
+		TargetAddr: fmt.Sprintf("127.0.0.1:%d", closedPort),
+		Key:        "live",
+	}, doctor.Options{Network: true})
+	if res := findResult(t, report, "server_addr"); res.Status != doctor.Warn {
+		t.Errorf("Expected /ws path warning, got %s %q", res.Status, res.Message)
+	}
+	if res := findResult(t, report, "target"); res.Status != doctor.Fail {
+		t.Errorf("Expected closed target to fail, got %s %q", res.Status, res.Message)
+	}
+
+	report = doctor.Run(&config.Config{Mode: "client", ServerAddr: wsURL, TargetAddr: "http://localhost:8080", Key: "live"},
+		doctor.Options{})
+	if res := findResult(t, report, "config"); res.Status != doctor.Fail || !strings.Contains(res.Message, "-target") {
+		t.Errorf("Expected target with scheme to fail, got %s %q", res.Status, res.Message)
+	}
+}
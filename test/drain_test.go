@@ -0,0 +1,210 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// slowTarget 分两段返回响应体，两段之间间隔 delay
+func slowTarget(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "part1")
+		w.(http.Flusher).Flush()
+		time.Sleep(delay)
+		io.WriteString(w, "part2")
+	}))
+}
+
+// runDrainClient 以 Run 启动隧道客户端，测试结束时停止。redirectAllow 为客户端接受的重定向地址
+func runDrainClient(t *testing.T, serverURL, targetURL, key string, redirectAllow ...string) {
+	t.Helper()
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:          "client",
+		ServerAddr:    strings.Replace(serverURL, "http://", "ws://", 1),
+		TargetAddr:    strings.TrimPrefix(targetURL, "http://"),
+		Key:           key,
+		RedirectAllow: redirectAllow,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		tunnelClient.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		tunnelClient.Stop()
+		<-done
+	})
+}
+
+// waitForTunnels 等待服务器上已注册的隧道数达到 want
+func waitForTunnels(t *testing.T, baseURL string, want int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		var tunnels adminTunnels
+		adminGet(t, baseURL, "/admin/tunnels", "admin-secret", &tunnels)
+		if len(tunnels.Tunnels) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d tunnels on %s, got %d", want, baseURL, len(tunnels.Tunnels))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// postDrain 发送 POST /admin/drain 并解析响应
+func postDrain(t *testing.T, baseURL, body string) (int, map[string]any) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", baseURL+"/admin/drain", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Drain request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func TestDrainFinishesStreamsAndReconnectsElsewhere(t *testing.T) {
+	target := slowTarget(500 * time.Millisecond)
+	defer target.Close()
+
+	serverA := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", AdminToken: "admin-secret"}))
+	defer serverA.Close()
+	serverB := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", AdminToken: "admin-secret"}))
+	defer serverB.Close()
+
+	runDrainClient(t, serverA.URL, target.URL, "drain-app", "127.0.0.1")
+	waitForTunnels(t, serverA.URL, 1, 2*time.Second)
+
+	bodyCh := make(chan string, 1)
+	go func() {
+		resp, body := keyedGet(t, serverA.URL+"/slow", "drain-app")
+		bodyCh <- fmt.Sprintf("%d %s", resp.StatusCode, body)
+	}()
+	time.Sleep(150 * time.Millisecond)
+
+	reconnect := strings.Replace(serverB.URL, "http://", "ws://", 1)
+	status, out := postDrain(t, serverA.URL, fmt.Sprintf(`{"grace": "30s", "reconnect_to": %q}`, reconnect))
+	if status != http.StatusAccepted || out["drained"] != float64(1) || out["notified"] != float64(1) {
+		t.Fatalf("Unexpected drain response %d %v", status, out)
+	}
+
+	// 进行中的响应完整送达
+	select {
+	case body := <-bodyCh:
+		if body != "200 part1part2" {
+			t.Errorf("Expected the in-flight response to complete, got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("In-flight response did not complete")
+	}
+
+	// 客户端完成请求后主动断开，不等宽限期结束，随后连接备用地址
+	waitForTunnels(t, serverA.URL, 0, 2*time.Second)
+	waitForTunnels(t, serverB.URL, 1, 8*time.Second)
+	resp, body := keyedGet(t, serverB.URL+"/after", "drain-app")
+	if resp.StatusCode != http.StatusOK || body != "part1part2" {
+		t.Errorf("Expected requests to work through the new server, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestDrainRefusesRegistrations(t *testing.T) {
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", AdminToken: "admin-secret"}))
+	defer proxyServer.Close()
+	wsBase := strings.Replace(proxyServer.URL, "http://", "ws://", 1)
+
+	status, out := postDrain(t, proxyServer.URL, `{"key": "refused", "grace": "2s", "refuse_registrations": true}`)
+	if status != http.StatusAccepted || out["drained"] != float64(0) {
+		t.Fatalf("Unexpected drain response %d %v", status, out)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsBase+"/ws/refused", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected registration to be refused with 503, got %v", err)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "2" {
+		t.Errorf("Expected Retry-After 2, got %q", ra)
+	}
+	// 其他key不受影响
+	conn, _, err := websocket.DefaultDialer.Dial(wsBase+"/ws/other", nil)
+	if err != nil {
+		t.Fatalf("Expected other keys to register: %v", err)
+	}
+	conn.Close()
+
+	if status := adminDo(t, "DELETE", proxyServer.URL+"/admin/drain?key=refused", "admin-secret", ""); status != http.StatusOK {
+		t.Fatalf("Expected 200 lifting the drain, got %d", status)
+	}
+	conn, _, err = websocket.DefaultDialer.Dial(wsBase+"/ws/refused", nil)
+	if err != nil {
+		t.Fatalf("Expected registration after lifting the drain: %v", err)
+	}
+	conn.Close()
+
+	// 无效的参数被拒绝
+	if status, _ := postDrain(t, proxyServer.URL, `{"reconnect_to": "http://example.com"}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-WebSocket reconnect address, got %d", status)
+	}
+	if status, _ := postDrain(t, proxyServer.URL, `{"grace": "-1s"}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative grace, got %d", status)
+	}
+}
+
+func TestStopDrainsInFlightRequests(t *testing.T) {
+	target := slowTarget(500 * time.Millisecond)
+	defer target.Close()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:        "server",
+		ListenPort:  strings.TrimPrefix(addr, "127.0.0.1:"),
+		AdminToken:  "admin-secret",
+		DrainOnStop: 5 * time.Second,
+	})
+	go proxy.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	runDrainClient(t, "http://"+addr, target.URL, "stop-drain")
+	waitForTunnels(t, "http://"+addr, 1, 2*time.Second)
+
+	bodyCh := make(chan string, 1)
+	go func() {
+		resp, body := keyedGet(t, "http://"+addr+"/slow", "stop-drain")
+		bodyCh <- fmt.Sprintf("%d %s", resp.StatusCode, body)
+	}()
+	time.Sleep(150 * time.Millisecond)
+
+	start := time.Now()
+	proxy.Stop()
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Stop waited %v, expected it to return once the request finished", elapsed)
+	}
+	select {
+	case got := <-bodyCh:
+		if got != "200 part1part2" {
+			t.Errorf("Expected the in-flight response to complete, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("In-flight response did not complete")
+	}
+}
@@ -0,0 +1,81 @@
+package test
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// runClient 运行客户端直到 Run 返回，超时视为失败
+func runClient(t *testing.T, cfg config.Config) error {
+	t.Helper()
+	cfg.Mode = "client"
+	c, err := client.NewTunnelClient(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		c.Stop()
+		t.Fatal("Expected the client to stop retrying")
+		return nil
+	}
+}
+
+func TestClientStopsWhenRegistrationRejected(t *testing.T) {
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", KeyPattern: `^[a-z]+$`}))
+	t.Cleanup(proxyServer.Close)
+
+	// 不符合服务器key格式的注册返回400，重试不会成功
+	err := runClient(t, config.Config{
+		Key:        "rejected123",
+		ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+		TargetAddr: "127.0.0.1:1",
+	})
+	if !errors.Is(err, client.ErrRegistrationRejected) {
+		t.Errorf("Expected ErrRegistrationRejected, got %v", err)
+	}
+}
+
+func TestClientStopsAfterMaxReconnects(t *testing.T) {
+	err := runClient(t, config.Config{
+		Key:           "unreachable",
+		ServerAddr:    "ws://127.0.0.1:" + strconv.Itoa(freePort(t)),
+		TargetAddr:    "127.0.0.1:1",
+		MaxReconnects: 1,
+	})
+	if !errors.Is(err, client.ErrMaxReconnects) {
+		t.Errorf("Expected ErrMaxReconnects, got %v", err)
+	}
+}
+
+func TestServerStartReportsListenFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	err = server.NewSinglePortProxy(&config.Config{Mode: "server", ListenPort: port}).Start()
+	if !errors.Is(err, server.ErrListen) {
+		t.Errorf("Expected ErrListen for a port in use, got %v", err)
+	}
+
+	err = server.NewSinglePortProxy(&config.Config{Mode: "server", ListenPort: "0", CertFile: "/nonexistent.crt", KeyFile: "/nonexistent.key"}).Start()
+	if !errors.Is(err, server.ErrTLS) {
+		t.Errorf("Expected ErrTLS for missing certificates, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestFallbackUpstream(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "mirror %s key=%q fwd=%s", r.URL.Path, r.Header.Get("X-Tunnel-Key"), r.Header.Get("X-Forwarded-Host"))
+	}))
+	t.Cleanup(mirror.Close)
+	pageFile := filepath.Join(t.TempDir(), "offline.html")
+	os.WriteFile(pageFile, []byte("<h1>offline</h1>"), 0644)
+
+	// 端口已关闭的备用地址用于模拟备用地址不可用
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	proxy := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode: "server",
+		Keys: map[string]*config.KeyConfig{
+			"fb":           {FallbackUpstream: mirror.URL},
+			"fb-dead":      {FallbackUpstream: dead.URL},
+			"fb-dead-page": {FallbackUpstream: dead.URL, OfflinePage: pageFile},
+		},
+	}))
+	t.Cleanup(proxy.Close)
+
+	resp, body := keyedGet(t, proxy.URL+"/docs", "fb")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Served-By") != "fallback" {
+		t.Fatalf("Expected fallback response, got %d %q (X-Served-By=%q)", resp.StatusCode, body, resp.Header.Get("X-Served-By"))
+	}
+	if want := fmt.Sprintf("mirror /docs key=\"\" fwd=%s", proxy.Listener.Addr()); body != want {
+		t.Errorf("Expected %q, got %q", want, body)
+	}
+
+	// 备用地址不可用时按原有方式返回502或离线页面，之后暂停使用备用地址
+	for i := 0; i < 2; i++ {
+		if resp, _ := keyedGet(t, proxy.URL+"/", "fb-dead"); resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-Served-By") != "" {
+			t.Errorf("Expected 502 when fallback is unreachable, got %d", resp.StatusCode)
+		}
+	}
+	resp, body = keyedGet(t, proxy.URL+"/", "fb-dead-page", "Accept", "text/html")
+	if resp.StatusCode != http.StatusServiceUnavailable || body != "<h1>offline</h1>" {
+		t.Errorf("Expected offline page when fallback is unreachable, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestFallbackUpstreamTunnelPreferred(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "mirror")
+	}))
+	t.Cleanup(mirror.Close)
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tunnel")
+	})
+	url, _ := startServerTunnel(t, target,
+		config.Config{Keys: map[string]*config.KeyConfig{"fb-online": {FallbackUpstream: mirror.URL}}},
+		config.Config{Key: "fb-online"})
+
+	resp, body := keyedGet(t, url+"/", "fb-online")
+	if body != "tunnel" || resp.Header.Get("X-Served-By") != "" {
+		t.Errorf("Expected connected tunnel to be used, got %q (X-Served-By=%q)", body, resp.Header.Get("X-Served-By"))
+	}
+}
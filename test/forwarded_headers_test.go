@@ -0,0 +1,229 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+)
+
+// writeClientCA 生成一个CA和由它签发的客户端证书，返回CA文件路径和客户端证书
+func writeClientCA(t *testing.T, dir string) (string, tls.Certificate) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA", Organization: []string{"Example Corp"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1f2e3d),
+		Subject:      pkix.Name{CommonName: "device-042", OrganizationalUnit: []string{"Sensors"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTmpl, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+
+	caFile := filepath.Join(dir, "client-ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+	return caFile, tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+}
+
+// forwardedLines 从 echoHeadersTarget 的响应中取出协议和客户端证书头部
+func forwardedLines(body string) string {
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "X-Forwarded-Proto:") || strings.HasPrefix(line, "X-Forwarded-Ssl-Client-Cert:") || strings.HasPrefix(line, "X-Ssl-Client-") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// nginxFrontend 模拟在前面终止TLS的 nginx: 可选地验证客户端证书，以明文转发给 singleProxy，
+// 按 proxy_set_header 的常见写法传入协议和客户端证书
+func nginxFrontend(t *testing.T, upstream, caFile string) string {
+	t.Helper()
+	caPEM, _ := os.ReadFile(caFile)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+
+	frontend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequest(r.Method, upstream+r.URL.RequestURI(), r.Body)
+		req.Header = r.Header.Clone()
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-SSL-Client-Verify", "NONE")
+		if len(r.TLS.PeerCertificates) > 0 {
+			// $ssl_client_escaped_cert: 空格编码为 %20
+			escaped := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.TLS.PeerCertificates[0].Raw})))
+			req.Header.Set("X-Forwarded-Ssl-Client-Cert", strings.ReplaceAll(escaped, "+", "%20"))
+			req.Header.Set("X-SSL-Client-Verify", "SUCCESS")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	frontend.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	frontend.StartTLS()
+	t.Cleanup(frontend.Close)
+	return frontend.URL
+}
+
+// httpsText 以可选的客户端证书发送请求，返回响应体
+func httpsText(t *testing.T, url, key string, cert *tls.Certificate, header http.Header) string {
+	t.Helper()
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}
+	req, _ := http.NewRequest("GET", url+"/whoami", nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Tunnel-Key", key)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body := readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %q", resp.StatusCode, body)
+	}
+	return body
+}
+
+func TestForwardedHeadersDirectAndBehindProxy(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "default", time.Now().Add(24*time.Hour))
+	caFile, clientCert := writeClientCA(t, dir)
+	target := httptest.NewServer(echoHeadersTarget())
+	t.Cleanup(target.Close)
+
+	// 直接TLS: 本服务器终止TLS并验证客户端证书
+	directAddr := startTLSProxy(t, config.Config{CertFile: certFile, KeyFile: keyFile, TLSClientCA: caFile, ForwardedHeaders: true})
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "fwd-direct",
+		ServerAddr: "wss://" + directAddr,
+		TargetAddr: strings.TrimPrefix(target.URL, "http://"),
+		Insecure:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	direct := "https://" + directAddr
+
+	// 经 nginx: nginx 终止TLS后以明文转发，本服务器信任其传入的头部
+	upstream, _ := startServerTunnel(t, echoHeadersTarget(),
+		config.Config{ForwardedHeaders: true, TrustedProxies: []string{"127.0.0.1"}},
+		config.Config{Key: "fwd-proxied"})
+	proxied := nginxFrontend(t, upstream, caFile)
+
+	for _, tt := range []struct {
+		name string
+		cert *tls.Certificate
+		want []string
+	}{
+		{"without client certificate", nil, []string{"X-Forwarded-Proto: https", "X-Ssl-Client-Verify: NONE"}},
+		{"with client certificate", &clientCert, []string{"X-Forwarded-Proto: https", "X-Ssl-Client-Verify: SUCCESS",
+			"X-Ssl-Client-S-Dn: CN=device-042,OU=Sensors", "X-Ssl-Client-I-Dn: CN=Test Client CA,O=Example Corp", "X-Ssl-Client-Serial: 1F2E3D"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := forwardedLines(httpsText(t, direct, "fwd-direct", tt.cert, nil))
+			if behind := forwardedLines(httpsText(t, proxied, "fwd-proxied", tt.cert, nil)); behind != got {
+				t.Errorf("Expected identical forwarded headers\n direct: %q\n behind: %q", got, behind)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want+"\n") && !strings.HasSuffix(got, want) {
+					t.Errorf("Expected %q in forwarded headers %q", want, got)
+				}
+			}
+			if (tt.cert != nil) != strings.Contains(got, "X-Ssl-Client-Fingerprint: ") {
+				t.Errorf("Unexpected client certificate headers %q", got)
+			}
+		})
+	}
+
+	// 直接访问的调用方不能伪造协议和证书头部
+	spoofed := http.Header{
+		"X-Forwarded-Proto":           {"https"},
+		"X-Ssl-Client-Verify":         {"SUCCESS"},
+		"X-Ssl-Client-S-Dn":           {"CN=admin"},
+		"X-Forwarded-Ssl-Client-Cert": {"forged"},
+	}
+	if got := forwardedLines(httpsText(t, direct, "fwd-direct", nil, spoofed)); got != "X-Forwarded-Proto: https\nX-Ssl-Client-Verify: NONE" {
+		t.Errorf("Expected spoofed headers to be replaced, got %q", got)
+	}
+}
+
+func TestForwardedHeadersFromUntrustedSource(t *testing.T) {
+	// 可信代理不包含本机地址，请求自带的头部被移除
+	url, _ := startServerTunnel(t, echoHeadersTarget(),
+		config.Config{ForwardedHeaders: true, TrustedProxies: []string{"10.0.0.0/8"}, AdminToken: "admin-secret"},
+		config.Config{Key: "fwd-untrusted"})
+	before := metricValue(t, url, "admin-secret", "singleproxy_server_forwarded_headers_stripped_total")
+
+	req, _ := http.NewRequest("GET", url+"/whoami", nil)
+	req.Header.Set("X-Tunnel-Key", "fwd-untrusted")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-SSL-Client-S-DN", "CN=admin")
+	req.Header.Set("X-SSL-Client-Custom", "anything")
+	if got := forwardedLines(doText(t, req)); got != "X-Forwarded-Proto: http\nX-Ssl-Client-Verify: NONE" {
+		t.Errorf("Expected untrusted forwarded headers to be replaced, got %q", got)
+	}
+	if n := metricValue(t, url, "admin-secret", "singleproxy_server_forwarded_headers_stripped_total") - before; n != 1 {
+		t.Errorf("Expected one stripped request, got %d", n)
+	}
+
+	// 只配置可信代理而不设置头部时，仍然移除不可信来源的头部，其余头部原样转发
+	plain, _ := startServerTunnel(t, echoHeadersTarget(),
+		config.Config{TrustedProxies: []string{"10.0.0.0/8"}},
+		config.Config{Key: "fwd-strip-only"})
+	req, _ = http.NewRequest("GET", plain+"/whoami", nil)
+	req.Header.Set("X-Tunnel-Key", "fwd-strip-only")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if got := forwardedLines(doText(t, req)); got != "" {
+		t.Errorf("Expected the untrusted X-Forwarded-Proto to be removed, got %q", got)
+	}
+}
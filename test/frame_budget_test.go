@@ -0,0 +1,123 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// metricValue 从 /admin/metrics 读取一个不带标签的指标
+func metricValue(t *testing.T, baseURL, token, name string) int64 {
+	t.Helper()
+	req, _ := http.NewRequest("GET", baseURL+"/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Metrics request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	m := regexp.MustCompile(`(?m)^` + name + ` (-?\d+)$`).FindStringSubmatch(string(body))
+	if m == nil {
+		t.Fatalf("Metric %s not found in:\n%s", name, body)
+	}
+	n, _ := strconv.ParseInt(m[1], 10, 64)
+	return n
+}
+
+func TestBufferedFrameBackpressure(t *testing.T) {
+	const slowSize, fastSize = 32 << 20, 512 << 10
+	chunk := strings.Repeat("z", 32<<10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := fastSize
+		if r.URL.Path == "/slow" {
+			size = slowSize
+		}
+		for sent := 0; sent < size; sent += len(chunk) {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(target.Close)
+
+	// 上限只有1字节: 慢速连接持有未写出的数据时总用量一直超过上限，但只有积压的连接暂停读取
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode:                  "server",
+		AdminToken:            "admin-secret",
+		MaxBufferedFrameBytes: 1,
+	}))
+	t.Cleanup(proxyServer.Close)
+	for _, key := range []string{"frames-slow", "frames-fast"} {
+		c, err := client.NewTunnelClient(&config.Config{
+			Mode:       "client",
+			Key:        key,
+			ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+			TargetAddr: strings.TrimPrefix(target.URL, "http://"),
+		})
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		if err := c.Connect(); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// 公网调用方不读取响应，写出阻塞后服务器一直持有慢速隧道上的一条消息
+	slow, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer slow.Close()
+	fmt.Fprintf(slow, "GET /slow HTTP/1.1\r\nHost: slow.example\r\nX-Tunnel-Key: frames-slow\r\n\r\n")
+	time.Sleep(500 * time.Millisecond)
+	if buffered := metricValue(t, proxyServer.URL, "admin-secret", "singleproxy_server_buffered_frame_bytes"); buffered <= 0 {
+		t.Fatalf("Expected the slow caller to hold buffered frames, got %d bytes", buffered)
+	}
+
+	// 其他隧道没有积压，不受慢速调用方影响
+	req, _ := http.NewRequest("GET", proxyServer.URL+"/fast", nil)
+	req.Header.Set("X-Tunnel-Key", "frames-fast")
+	fastClient := &http.Client{Timeout: 5 * time.Second}
+	fastResp, err := fastClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected the fast tunnel to keep reading while the slow caller holds buffered frames: %v", err)
+	}
+	body, err := io.ReadAll(fastResp.Body)
+	fastResp.Body.Close()
+	if err != nil || len(body) != fastSize {
+		t.Errorf("Expected %d bytes for the fast response, got %d (%v)", fastSize, len(body), err)
+	}
+
+	// 慢速调用方开始读取后数据全部送达，用量回落
+	_ = slow.SetReadDeadline(time.Now().Add(20 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(slow), nil)
+	if err != nil {
+		t.Fatalf("Failed to read slow response: %v", err)
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if n != slowSize {
+		t.Errorf("Expected %d bytes for the slow response, got %d", slowSize, n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for metricValue(t, proxyServer.URL, "admin-secret", "singleproxy_server_buffered_frame_bytes") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected buffered frame bytes to return to 0")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
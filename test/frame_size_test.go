@@ -0,0 +1,118 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+
+	"github.com/gorilla/websocket"
+)
+
+func postSized(t *testing.T, url, key string, size int) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(bytes.Repeat([]byte("x"), size)))
+	req.Header.Set("X-Tunnel-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestNegotiatedFrameSize(t *testing.T) {
+	large := strings.Repeat("y", 512*1024)
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			io.WriteString(w, large)
+			return
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, n)
+	})
+	// 服务器的上限较小，协商结果为 256KB；客户端的完整响应阈值超过该上限
+	url, _ := startServerTunnel(t, target,
+		config.Config{MaxFrameSize: protocol.MinFrameSize},
+		config.Config{Key: "frames", FullResponseThreshold: 1 << 20})
+
+	// 超过上限的请求在发送前被拒绝，连接不受影响
+	if status, _ := postSized(t, url+"/upload", "frames", 300*1024); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a request over the frame size, got %d", status)
+	}
+	if status, body := postSized(t, url+"/upload", "frames", 100*1024); status != http.StatusOK || body != "102400" {
+		t.Errorf("Expected the tunnel to keep serving, got %d %q", status, body)
+	}
+
+	// 超过上限的完整响应改为分块发送
+	resp, body := keyedGet(t, url+"/large", "frames")
+	if resp.StatusCode != http.StatusOK || body != large {
+		t.Errorf("Expected %d byte response, got %d with %d bytes", len(large), resp.StatusCode, len(body))
+	}
+}
+
+func TestFrameSizeFallbackForOldClient(t *testing.T) {
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", MaxFrameSize: protocol.MinFrameSize}))
+	t.Cleanup(proxyServer.Close)
+
+	// 未声明上限的旧客户端不会收到协商结果，服务器仍按 10MB 发送和读取
+	conn, resp, err := websocket.DefaultDialer.Dial(strings.Replace(proxyServer.URL, "http://", "ws://", 1)+"/ws/old-frames", nil)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if got := resp.Header.Get(protocol.HeaderMaxFrameSize); got != "" {
+		t.Errorf("Expected no frame size for an old client, got %q", got)
+	}
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := protocol.DeserializeTunnelMessage(data)
+			if err != nil || msg.Type != protocol.MSG_TYPE_HTTP_REQ {
+				continue
+			}
+			sendTunnelMessage(conn, msg.ID, protocol.MSG_TYPE_HTTP_RES_FULL,
+				fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%d", len(fmt.Sprint(len(data))), len(data)))
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	status, body := postSized(t, proxyServer.URL+"/upload", "old-frames", 300*1024)
+	if status != http.StatusOK || body == "" {
+		t.Errorf("Expected the request to reach the old client, got %d %q", status, body)
+	}
+}
+
+func TestOversizedResponseFailsOnlyItsRequest(t *testing.T) {
+	var requests atomic.Int64
+	addr := startFakeTunnel(t, config.Config{ProxyErrorHeader: true}, func(conn *websocket.Conn, id uint64) {
+		if requests.Add(1) == 1 {
+			// 未声明上限的连接按 10MB 读取，超限的响应只结束它所属的请求
+			sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_FULL,
+				"HTTP/1.1 200 OK\r\n\r\n"+strings.Repeat("z", protocol.DefaultMaxFrameSize))
+			return
+		}
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_FULL, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+
+	resp, _ := keyedGet(t, "http://"+addr+"/large", "abort-test")
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-Proxy-Error") != "frame_too_large" {
+		t.Errorf("Expected 502 frame_too_large for the oversized response, got %d %q", resp.StatusCode, resp.Header.Get("X-Proxy-Error"))
+	}
+	if resp, body := keyedGet(t, "http://"+addr+"/small", "abort-test"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("Expected the tunnel to keep serving after the oversized message, got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+func TestSmallResponsePreservesContentLength(t *testing.T) {
+	const payload = `{"status":"ok","items":[1,2,3]}`
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "5")
+		if r.Method == http.MethodHead {
+			return
+		}
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Length", "31")
+			io.WriteString(w, payload)
+			return
+		}
+		io.WriteString(w, "hello")
+	}), config.Config{}, config.Config{Key: "full-test"})
+
+	resp, body := keyedGet(t, publicURL+"/json", "full-test")
+	if body != payload {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if resp.ContentLength != int64(len(payload)) || len(resp.TransferEncoding) != 0 {
+		t.Errorf("Expected Content-Length %d without chunking, got %d %v", len(payload), resp.ContentLength, resp.TransferEncoding)
+	}
+
+	// HEAD 响应保留目标的 Content-Length
+	req, _ := http.NewRequest("HEAD", publicURL+"/", nil)
+	req.Header.Set("X-Tunnel-Key", "full-test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HEAD request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 5 {
+		t.Errorf("Expected HEAD 200 with Content-Length 5, got %d %d", resp.StatusCode, resp.ContentLength)
+	}
+}
+
+func TestStreamingPathStillUsedWhenDisabledOrLarge(t *testing.T) {
+	large := strings.Repeat("L", 200*1024)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			io.WriteString(w, large)
+			return
+		}
+		io.WriteString(w, "small")
+	})
+
+	for _, threshold := range []int{0, -1} {
+		publicURL, _ := startServerTunnel(t, handler, config.Config{}, config.Config{Key: "stream-test", FullResponseThreshold: threshold})
+		for path, want := range map[string]string{"/large": large, "/small": "small"} {
+			if _, body := keyedGet(t, publicURL+path, "stream-test"); body != want {
+				t.Errorf("threshold=%d %s: expected %d bytes, got %d", threshold, path, len(want), len(body))
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+func TestHeaderLimitsThroughTunnel(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	get := func(url, key, cookie string) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", url+"/", nil)
+		req.Header.Set("X-Tunnel-Key", key)
+		req.Header.Set("Cookie", cookie)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("server", func(t *testing.T) {
+		url, _ := startServerTunnel(t, target, config.Config{MaxHeaderFieldBytes: 1024}, config.Config{Key: "header-limit"})
+		// "Cookie" 6 字节加值
+		if status := get(url, "header-limit", strings.Repeat("c", 1018)); status != http.StatusOK {
+			t.Errorf("Expected cookie at limit to pass, got %d", status)
+		}
+		if status := get(url, "header-limit", strings.Repeat("c", 1019)); status != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("Expected 431 for cookie over limit, got %d", status)
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		// 服务器使用默认限制，客户端配置更严格时同样拒绝
+		url, _ := startServerTunnel(t, target, config.Config{}, config.Config{Key: "header-limit-client", MaxHeaderFieldBytes: 512})
+		if status := get(url, "header-limit-client", strings.Repeat("c", 506)); status != http.StatusOK {
+			t.Errorf("Expected cookie at client limit to pass, got %d", status)
+		}
+		if status := get(url, "header-limit-client", strings.Repeat("c", 507)); status != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("Expected 431 from client, got %d", status)
+		}
+	})
+}
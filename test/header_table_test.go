@@ -0,0 +1,227 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+)
+
+// echoHeadersTarget 按名称排序返回请求头，用于比较经隧道还原后的头部
+func echoHeadersTarget() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var lines []string
+		for name, values := range r.Header {
+			if name == http.CanonicalHeaderKey(protocol.HeaderHop) {
+				// 实例ID每次启动随机生成，只有经过隧道的请求带有
+				continue
+			}
+			lines = append(lines, name+": "+strings.Join(values, " | "))
+		}
+		sort.Strings(lines)
+		fmt.Fprintf(w, "%s %s\n%s", r.Method, r.URL.RequestURI(), strings.Join(lines, "\n"))
+	})
+}
+
+// corpusOrigin 语料中 Referer 和 Origin 使用的公网地址，与实际发往的地址无关
+const corpusOrigin = "https://app.example.com"
+
+// headerCorpus 模拟一个隧道上的真实流量: 几个浏览器用户加载页面和静态资源、调用JSON接口，
+// 同一用户的 User-Agent、Cookie 和 Accept 系列头部重复出现，X-Request-Id 每次不同
+func headerCorpus(baseURL string) []*http.Request {
+	users := []struct {
+		agent, cookie, token, ip string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			"session=8f14e45fceea167a5a36dedd4bea2543; theme=dark; _ga=GA1.1.1234567890.1700000000", "eyJhbGciOiJIUzI1NiJ9.dXNlci0x.c2lnbmF0dXJl", "203.0.113.10"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+			"session=c9f0f895fb98ab9159f51fd0297e236d; lang=zh-CN", "eyJhbGciOiJIUzI1NiJ9.dXNlci0y.c2lnbmF0dXJl", "198.51.100.24"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0",
+			"session=45c48cce2e2d7fbdea1afc51c7c6ad26", "eyJhbGciOiJIUzI1NiJ9.dXNlci0z.c2lnbmF0dXJl", "192.0.2.77"},
+	}
+	assets := []string{"/static/app.js", "/static/vendor.js", "/static/app.css", "/static/logo.svg", "/favicon.ico"}
+	var reqs []*http.Request
+	n := 0
+	add := func(req *http.Request, ip string) {
+		n++
+		req.Header.Set("X-Forwarded-For", ip)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Request-Id", fmt.Sprintf("req-%08x", n*2654435761))
+		reqs = append(reqs, req)
+	}
+	for round := 0; round < 4; round++ {
+		for i, u := range users {
+			page, _ := http.NewRequest("GET", fmt.Sprintf("%s/orders?page=%d", baseURL, round+1), nil)
+			page.Header.Set("User-Agent", u.agent)
+			page.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+			page.Header.Set("Accept-Encoding", "gzip, deflate, br")
+			page.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en;q=0.8")
+			page.Header.Set("Cookie", u.cookie)
+			page.Header.Set("Upgrade-Insecure-Requests", "1")
+			add(page, u.ip)
+
+			for _, asset := range assets {
+				req, _ := http.NewRequest("GET", baseURL+asset, nil)
+				req.Header.Set("User-Agent", u.agent)
+				req.Header.Set("Accept", "*/*")
+				req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+				req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en;q=0.8")
+				req.Header.Set("Cookie", u.cookie)
+				req.Header.Set("Referer", fmt.Sprintf("%s/orders?page=%d", corpusOrigin, round+1))
+				req.Header.Set("If-None-Match", fmt.Sprintf(`W/"%x-%d"`, len(asset), i))
+				add(req, u.ip)
+			}
+
+			api, _ := http.NewRequest("POST", baseURL+"/api/v1/orders/search", strings.NewReader(fmt.Sprintf(`{"page":%d}`, round)))
+			api.Header.Set("User-Agent", u.agent)
+			api.Header.Set("Accept", "application/json")
+			api.Header.Set("Content-Type", "application/json")
+			api.Header.Set("Authorization", "Bearer "+u.token)
+			api.Header.Set("Origin", corpusOrigin)
+			api.Header.Set("Cookie", u.cookie)
+			add(api, u.ip)
+		}
+	}
+	return reqs
+}
+
+func TestHeaderTableThroughTunnel(t *testing.T) {
+	url, _ := startServerTunnel(t, echoHeadersTarget(),
+		config.Config{HeaderTableSize: 16384, AdminToken: "admin-secret"},
+		config.Config{Key: "header-table"})
+
+	inputBefore := metricValue(t, url, "admin-secret", "singleproxy_server_header_table_input_bytes_total")
+	outputBefore := metricValue(t, url, "admin-secret", "singleproxy_server_header_table_output_bytes_total")
+
+	// 同样的请求直接发给目标服务，得到期望的头部
+	direct := httptest.NewServer(echoHeadersTarget())
+	defer direct.Close()
+	corpus, expected := headerCorpus(url), headerCorpus(direct.URL)
+	for i, req := range corpus {
+		req.Header.Set("X-Tunnel-Key", "header-table")
+		expected[i].Header.Set("X-Tunnel-Key", "header-table")
+		got := doText(t, req)
+		want := doText(t, expected[i])
+		if got != want {
+			t.Fatalf("Request %d: headers differ after the tunnel\n got %q\nwant %q", i, got, want)
+		}
+	}
+
+	input := metricValue(t, url, "admin-secret", "singleproxy_server_header_table_input_bytes_total") - inputBefore
+	output := metricValue(t, url, "admin-secret", "singleproxy_server_header_table_output_bytes_total") - outputBefore
+	if input == 0 || output*2 > input {
+		t.Errorf("Expected the header table to at least halve request bytes, got %d of %d", output, input)
+	}
+}
+
+// doText 发送请求并返回响应体中与隧道无关的头部
+func doText(t *testing.T, req *http.Request) string {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var lines []string
+	for _, line := range strings.Split(string(body), "\n") {
+		// 隧道自身的头部在转发前被移除或改写，不参与比较
+		if !strings.HasPrefix(line, "X-Tunnel-") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestHeaderTableNegotiation(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		size int
+		want bool
+	}{
+		{"disabled on server", 0, false},
+		{"enabled on server", 4096, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			url, _ := startServerTunnel(t, echoPathTarget(), config.Config{HeaderTableSize: tt.size}, config.Config{Key: "negotiate"})
+			// 不论是否启用，请求都照常转发
+			for i := 0; i < 3; i++ {
+				if _, body := keyedGet(t, fmt.Sprintf("%s/n/%d", url, i), "negotiate"); body != fmt.Sprintf("path=/n/%d", i) {
+					t.Errorf("Unexpected response %q", body)
+				}
+			}
+
+			ws := "ws" + strings.TrimPrefix(url, "http") + "/ws/negotiate-probe"
+			header := http.Header{protocol.HeaderFeatures: {protocol.FeatureHeaderTable}}
+			header.Set(protocol.HeaderHeaderTableSize, "65536")
+			conn, resp, err := websocket.DefaultDialer.Dial(ws, header)
+			if err != nil {
+				t.Fatalf("Failed to register: %v", err)
+			}
+			defer conn.Close()
+			enabled := protocol.HasFeature(resp.Header.Get(protocol.HeaderServerFeatures), protocol.FeatureHeaderTable)
+			if enabled != tt.want {
+				t.Errorf("Expected header table enabled=%v, got features %q", tt.want, resp.Header.Get(protocol.HeaderServerFeatures))
+			}
+			if tt.want && resp.Header.Get(protocol.HeaderHeaderTableSize) != fmt.Sprint(tt.size) {
+				t.Errorf("Expected the negotiated size %d, got %q", tt.size, resp.Header.Get(protocol.HeaderHeaderTableSize))
+			}
+		})
+	}
+}
+
+// BenchmarkHeaderTable 比较真实请求流量在不启用和启用请求头索引表时每个请求占用的隧道字节数 (wire-bytes/req)。
+// 每次迭代相当于一条新的隧道连接发送整个语料，包括首次出现时的原文
+func BenchmarkHeaderTable(b *testing.B) {
+	var payloads [][]byte
+	for _, req := range headerCorpus(corpusOrigin) {
+		data, err := protocol.SerializeHTTPRequest(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		payloads = append(payloads, data)
+	}
+	wireSize := func(id int, payload []byte) int {
+		msg, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: uint64(id), Type: protocol.MSG_TYPE_HTTP_REQ, Payload: payload})
+		return len(msg)
+	}
+	plain := 0
+	for i, payload := range payloads {
+		plain += wireSize(i, payload)
+	}
+
+	b.Run("off", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for id, payload := range payloads {
+				wireSize(id, payload)
+			}
+		}
+		b.ReportMetric(float64(plain)/float64(len(payloads)), "wire-bytes/req")
+	})
+	for _, size := range []int{4096, 16384, protocol.MaxHeaderTableSize} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			total := 0
+			for i := 0; i < b.N; i++ {
+				enc, dec := protocol.NewHeaderEncoder(size), protocol.NewHeaderDecoder(size)
+				total = 0
+				for id, payload := range payloads {
+					encoded := enc.Encode(payload)
+					total += wireSize(id, encoded)
+					if _, err := dec.Decode(encoded); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(total)/float64(len(payloads)), "wire-bytes/req")
+			b.ReportMetric(100*(1-float64(total)/float64(plain)), "saved-%")
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestHTTPTunnelRequestBodyStream(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d %x", len(body), sha256.Sum256(body))
+	}))
+	t.Cleanup(target.Close)
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server"}))
+	t.Cleanup(proxyServer.Close)
+
+	httpClient, err := client.NewHTTPTunnelClient(&config.Config{
+		Mode:       "http-client",
+		ServerAddr: proxyServer.URL,
+		TargetAddr: strings.TrimPrefix(target.URL, "http://"),
+		Key:        "body-stream",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %v", err)
+	}
+	go httpClient.Run()
+	t.Cleanup(httpClient.Stop)
+	time.Sleep(200 * time.Millisecond)
+
+	post := func(body io.Reader) string {
+		t.Helper()
+		req, _ := http.NewRequest("POST", proxyServer.URL+"/upload", body)
+		req.Header.Set("X-Tunnel-Key", "body-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, data)
+		}
+		return string(data)
+	}
+	expect := func(body []byte) string {
+		return fmt.Sprintf("%d %x", len(body), sha256.Sum256(body))
+	}
+
+	small := []byte("small body")
+	if got := post(bytes.NewReader(small)); got != expect(small) {
+		t.Errorf("Small body: expected %q, got %q", expect(small), got)
+	}
+
+	// 超过内联大小的请求体经 body 端点流式传输
+	large := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	if got := post(bytes.NewReader(large)); got != expect(large) {
+		t.Errorf("Large body: expected %q, got %q", expect(large), got)
+	}
+
+	// 长度未知 (分块编码) 的请求体
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 16; i++ {
+			pw.Write(large[:len(large)/16])
+		}
+		pw.Close()
+	}()
+	want := expect(bytes.Repeat(large[:len(large)/16], 16))
+	if got := post(pr); got != want {
+		t.Errorf("Chunked body: expected %q, got %q", want, got)
+	}
+
+	// 请求体只能读取一次，公网请求结束后不再可用
+	resp, err := http.Get(proxyServer.URL + "/http-tunnel/body/body-stream/2")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for consumed body, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+// idempotentPost 发送带 Idempotency-Key 的请求，返回状态码、是否为重放和响应体
+func idempotentPost(t *testing.T, method, url, idemKey string) (int, bool, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(`{"amount":100}`))
+	req.Header.Set("X-Tunnel-Key", "payments")
+	if idemKey != "" {
+		req.Header.Set("Idempotency-Key", idemKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Request failed: %v", err)
+		return 0, false, ""
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Idempotent-Replayed") == "true", string(body)
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	var charges atomic.Int64
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := charges.Add(1)
+		time.Sleep(300 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"charge":%d}`, n)
+	})
+	url, _ := startServerTunnel(t, target,
+		config.Config{Keys: map[string]*config.KeyConfig{
+			"payments": {Idempotency: &config.IdempotencyConfig{Paths: []string{"/charges"}}},
+		}},
+		config.Config{Key: "payments"})
+
+	// 双击提交: 第二个请求在第一个仍在转发时到达，等待并重放第一次的响应
+	type result struct {
+		status   int
+		replayed bool
+		body     string
+	}
+	results := make([]result, 3)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 50 * time.Millisecond)
+			status, replayed, body := idempotentPost(t, "POST", url+"/charges", "order-1")
+			results[i] = result{status, replayed, body}
+		}()
+	}
+	wg.Wait()
+	if n := charges.Load(); n != 1 {
+		t.Fatalf("Expected one charge for duplicate submissions, got %d", n)
+	}
+	replays := 0
+	for _, res := range results {
+		if res.status != http.StatusCreated || res.body != `{"charge":1}` {
+			t.Errorf("Expected every submission to see the first response, got %+v", res)
+		}
+		if res.replayed {
+			replays++
+		}
+	}
+	if replays != 2 {
+		t.Errorf("Expected 2 replayed responses, got %d", replays)
+	}
+
+	// 之后的重试直接重放，不同的key、不在 paths 中的路径和 GET 照常转发
+	if status, replayed, body := idempotentPost(t, "POST", url+"/charges", "order-1"); status != http.StatusCreated || !replayed || body != `{"charge":1}` {
+		t.Errorf("Expected a later retry to replay, got %d %v %q", status, replayed, body)
+	}
+	if _, replayed, body := idempotentPost(t, "POST", url+"/charges", "order-2"); replayed || body != `{"charge":2}` {
+		t.Errorf("Expected a new Idempotency-Key to be forwarded, got %v %q", replayed, body)
+	}
+	if _, replayed, _ := idempotentPost(t, "POST", url+"/refunds", "order-1"); replayed {
+		t.Error("Expected paths outside idempotency.paths to be forwarded")
+	}
+	if _, replayed, _ := idempotentPost(t, "GET", url+"/charges", "order-1"); replayed {
+		t.Error("Expected GET requests to be forwarded")
+	}
+	if n := charges.Load(); n != 4 {
+		t.Errorf("Expected 4 forwarded requests, got %d", n)
+	}
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+
+	"github.com/gorilla/websocket"
+)
+
+// idleDial 完成注册握手后只发送 ping，返回读取结束时的错误
+func idleDial(t *testing.T, wsURL string) <-chan error {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to register %s: %v", wsURL, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for range ticker.C {
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)) != nil {
+				return
+			}
+		}
+	}()
+	return closed
+}
+
+func TestIdleTunnelClosed(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(targetServer.Close)
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode:          "server",
+		AdminToken:    "secret",
+		TunnelIdleMax: 500 * time.Millisecond,
+		Keys:          map[string]*config.KeyConfig{"idle-quiet": {AllowIdle: true}},
+	}))
+	t.Cleanup(proxyServer.Close)
+	wsBase := strings.Replace(proxyServer.URL, "http://", "ws://", 1) + "/ws/"
+
+	// 只发送 ping 的连接到期被关闭，设置了 allow_idle 的key不受影响
+	bot := idleDial(t, wsBase+"idle-bot")
+	quiet := idleDial(t, wsBase+"idle-quiet")
+
+	// 持续有请求的隧道不会被关闭
+	activeClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		ServerAddr: strings.TrimSuffix(wsBase, "/ws/"),
+		TargetAddr: strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:        "idle-active",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := activeClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	for deadline := time.Now().Add(1200 * time.Millisecond); time.Now().Before(deadline); {
+		keyedGet(t, proxyServer.URL+"/", "idle-active")
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	select {
+	case err := <-bot:
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != protocol.CloseReasonIdle {
+			t.Errorf("Expected the idle connection to be closed with 1000 %q, got %v", protocol.CloseReasonIdle, err)
+		}
+	default:
+		t.Error("Expected the idle connection to be closed")
+	}
+	select {
+	case err := <-quiet:
+		t.Errorf("Expected the allow_idle connection to stay open, got %v", err)
+	default:
+	}
+
+	var listing struct {
+		Tunnels []struct {
+			Key          string    `json:"key"`
+			ConnectedAt  time.Time `json:"connected_at"`
+			LastActivity time.Time `json:"last_activity"`
+		} `json:"tunnels"`
+	}
+	adminGet(t, proxyServer.URL, "/admin/tunnels", "secret", &listing)
+	keys := make(map[string]bool)
+	for _, tunnel := range listing.Tunnels {
+		keys[tunnel.Key] = true
+		if tunnel.Key == "idle-active" && time.Since(tunnel.LastActivity) > 500*time.Millisecond {
+			t.Errorf("Expected recent activity for the active tunnel, got %v (connected %v)", tunnel.LastActivity, tunnel.ConnectedAt)
+		}
+		if tunnel.Key == "idle-quiet" && tunnel.LastActivity.Sub(tunnel.ConnectedAt) > 100*time.Millisecond {
+			t.Errorf("Expected pings not to count as activity, got %v (connected %v)", tunnel.LastActivity, tunnel.ConnectedAt)
+		}
+	}
+	if keys["idle-bot"] || !keys["idle-quiet"] || !keys["idle-active"] {
+		t.Errorf("Expected only idle-quiet and idle-active to remain, got %v", keys)
+	}
+}
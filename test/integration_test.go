@@ -332,7 +332,7 @@ func TestProtocolMessage(t *testing.T) {
 	testPayload := []byte("Test message payload with some data")
 	
 	// 测试不同类型的消息
-	messageTypes := []uint8{
+	messageTypes := []protocol.MessageType{
 		protocol.MSG_TYPE_HTTP_REQ,
 		protocol.MSG_TYPE_HTTP_RES,
 		protocol.MSG_TYPE_HTTP_RES_CHUNK,
@@ -462,4 +462,41 @@ func BenchmarkEndToEndRequest(b *testing.B) {
 			resp.Body.Close()
 		}
 	})
-}
\ No newline at end of file
+}
+
+// BenchmarkEndToEndResponseSize 对比小响应合并为单条消息 (FullResponseThreshold 为0即默认64KB)
+// 与按响应头加数据块发送 (-1禁用合并) 时经隧道转发的开销
+func BenchmarkEndToEndResponseSize(b *testing.B) {
+	for _, size := range []int{64, 1 << 10, 16 << 10, 60 << 10} {
+		body := bytes.Repeat([]byte("b"), size)
+		target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		})
+		for _, mode := range []struct {
+			name      string
+			threshold int
+		}{
+			{"full", 0},
+			{"streamed", -1},
+		} {
+			b.Run(fmt.Sprintf("%s/%dB", mode.name, size), func(b *testing.B) {
+				tunnelKey := fmt.Sprintf("size-bench-%s-%d", mode.name, size)
+				proxyURL, _ := startServerTunnel(b, target,
+					config.Config{},
+					config.Config{Key: tunnelKey, FullResponseThreshold: mode.threshold})
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					req, _ := http.NewRequest("GET", proxyURL+"/bench", nil)
+					req.Header.Set("X-Tunnel-Key", tunnelKey)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						b.Fatalf("Request failed: %v", err)
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestEarlyHintsForwarded(t *testing.T) {
+	hintsReceived := make(chan struct{})
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+
+		// 公网用户收到 103 之后目标服务才发送最终响应
+		select {
+		case <-hintsReceived:
+			io.WriteString(w, "final")
+		case <-time.After(2 * time.Second):
+			io.WriteString(w, "hints not received")
+		}
+	}), config.Config{}, config.Config{Key: "hints-test"})
+
+	var interim []int
+	var links []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			interim = append(interim, code)
+			links = append(links, header.Get("Link"))
+			if code == http.StatusEarlyHints {
+				close(hintsReceived)
+			}
+			return nil
+		},
+	}
+	req, _ := http.NewRequest("GET", publicURL+"/", nil)
+	req.Header.Set("X-Tunnel-Key", "hints-test")
+	resp, err := http.DefaultClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if len(interim) != 1 || interim[0] != http.StatusEarlyHints || links[0] != "</style.css>; rel=preload; as=style" {
+		t.Fatalf("Expected one 103 with preload link, got %v %v", interim, links)
+	}
+	if string(body) != "final" {
+		t.Errorf("Expected final response after hints, got %q", body)
+	}
+	if resp.Header.Get("Link") != "" {
+		t.Errorf("Hint headers should not leak into the final response, got %q", resp.Header.Get("Link"))
+	}
+}
+
+func TestExpectContinueNotDuplicated(t *testing.T) {
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}), config.Config{}, config.Config{Key: "continue-test"})
+
+	var interim []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			interim = append(interim, code)
+			return nil
+		},
+	}
+	httpClient := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	defer httpClient.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", publicURL+"/", strings.NewReader("payload"))
+	req.Header.Set("X-Tunnel-Key", "continue-test")
+	req.Header.Set("Expect", "100-continue")
+	resp, err := httpClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if string(body) != "payload" || resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected response %d %q", resp.StatusCode, body)
+	}
+	if len(interim) != 1 || interim[0] != http.StatusContinue {
+		t.Errorf("Expected a single 100 Continue, got %v", interim)
+	}
+}
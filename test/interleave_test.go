@@ -0,0 +1,195 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/protocol/protocoltest"
+	"singleproxy/pkg/server"
+
+	"github.com/gorilla/websocket"
+)
+
+// interleaveSeed 固定的随机种子，失败时可以重现同一种交错顺序
+const interleaveSeed = 20240611
+
+// interleavedStream 假客户端为一个请求准备的响应和待发送的消息
+type interleavedStream struct {
+	id       uint64
+	body     []byte
+	withLen  bool // 响应头声明 Content-Length
+	full     bool // 以一条 MSG_TYPE_HTTP_RES_FULL 发送
+	messages []protocol.TunnelMessage
+}
+
+// buildInterleavedStream 按序号生成大小不一的响应，拆成随机大小的数据块
+func buildInterleavedStream(rng *rand.Rand, index int, id uint64, chunkSeq bool) *interleavedStream {
+	size := rng.Intn(256 << 10)
+	switch index % 10 {
+	case 3:
+		size = 0
+	case 7:
+		size = rng.Intn(64)
+	}
+	s := &interleavedStream{id: id, body: make([]byte, size), withLen: index%2 == 0, full: index%7 == 0}
+	rng.Read(s.body)
+
+	head := fmt.Sprintf("HTTP/1.1 200 OK\r\nX-Stream: %d\r\n", index)
+	if s.withLen || s.full {
+		head += fmt.Sprintf("Content-Length: %d\r\n", size)
+	}
+	head += "\r\n"
+	if s.full {
+		s.messages = []protocol.TunnelMessage{{ID: id, Type: protocol.MSG_TYPE_HTTP_RES_FULL, Payload: append([]byte(head), s.body...)}}
+		return s
+	}
+
+	s.messages = []protocol.TunnelMessage{{ID: id, Type: protocol.MSG_TYPE_HTTP_RES, Payload: []byte(head)}}
+	var seq uint32
+	for rest := s.body; len(rest) > 0; {
+		n := min(len(rest), 1+rng.Intn(32<<10))
+		payload := rest[:n]
+		if chunkSeq {
+			payload = protocol.EncodeResponseChunk(protocol.ResponseChunk{Seq: seq, Data: payload})
+			seq++
+		}
+		s.messages = append(s.messages, protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK, Payload: payload})
+		rest = rest[n:]
+	}
+	endPayload := []byte{}
+	if chunkSeq {
+		endPayload = protocol.EncodeResponseChunk(protocol.ResponseChunk{Seq: seq, End: true, TotalLength: int64(size)})
+	}
+	s.messages = append(s.messages, protocol.TunnelMessage{ID: id, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK, Payload: endPayload})
+	return s
+}
+
+// runInterleaveHarness 假客户端收齐 n 个公网请求后，按固定种子随机交错发送各个响应的消息，
+// 检查每个公网请求收到的响应与假客户端准备的逐字节一致
+func runInterleaveHarness(t *testing.T, n int, chunkSeq bool) {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server", ListenPort: strings.TrimPrefix(addr, "127.0.0.1:")})
+	go proxy.Start()
+	t.Cleanup(func() { proxy.Stop() })
+	time.Sleep(100 * time.Millisecond)
+
+	header := http.Header{}
+	if chunkSeq {
+		header.Set(protocol.HeaderFeatures, protocol.FeatureChunkSeq)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws/interleave", header)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	time.Sleep(100 * time.Millisecond)
+
+	type result struct {
+		status int
+		header http.Header
+		body   []byte
+		err    error
+	}
+	results := make([]result, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/stream/%d", addr, i), nil)
+			req.Header.Set("X-Tunnel-Key", "interleave")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			results[i] = result{resp.StatusCode, resp.Header, body, err}
+		}(i)
+	}
+
+	// 收齐全部请求后再开始发送，交错顺序只取决于种子
+	ids := make([]uint64, n)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for received := 0; received < n; {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Received %d of %d requests: %v", received, n, err)
+		}
+		msg, err := protocol.DeserializeTunnelMessage(data)
+		if err != nil || msg.Type != protocol.MSG_TYPE_HTTP_REQ {
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg.Payload)))
+		if err != nil {
+			t.Fatalf("Failed to parse tunneled request: %v", err)
+		}
+		var index int
+		fmt.Sscanf(req.URL.Path, "/stream/%d", &index)
+		ids[index] = msg.ID
+		received++
+	}
+
+	rng := rand.New(rand.NewSource(interleaveSeed))
+	streams := make([]*interleavedStream, n)
+	for i := range streams {
+		streams[i] = buildInterleavedStream(rng, i, ids[i], chunkSeq)
+	}
+	// 假客户端自身的消息流同样要满足约定，否则测的不是服务器
+	checker := protocoltest.NewChecker(chunkSeq)
+	pending := append([]*interleavedStream(nil), streams...)
+	for len(pending) > 0 {
+		k := rng.Intn(len(pending))
+		s := pending[k]
+		msg := s.messages[0]
+		if err := checker.Observe(msg); err != nil {
+			t.Fatalf("Harness produced an invalid stream: %v", err)
+		}
+		data, _ := protocol.SerializeTunnelMessage(msg)
+		if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		if s.messages = s.messages[1:]; len(s.messages) == 0 {
+			pending = append(pending[:k], pending[k+1:]...)
+		}
+	}
+	if err := checker.Finish(); err != nil {
+		t.Fatalf("Harness left a stream unfinished: %v", err)
+	}
+
+	wg.Wait()
+	for i, s := range streams {
+		res := results[i]
+		if res.err != nil || res.status != http.StatusOK {
+			t.Errorf("Stream %d: expected 200, got %d (%v)", i, res.status, res.err)
+			continue
+		}
+		if got := res.header.Get("X-Stream"); got != fmt.Sprint(i) {
+			t.Errorf("Stream %d: received the header of stream %s", i, got)
+		}
+		if !bytes.Equal(res.body, s.body) {
+			t.Errorf("Stream %d: body mismatch, expected %d bytes, got %d", i, len(s.body), len(res.body))
+		}
+	}
+}
+
+func TestInterleavedResponses(t *testing.T) {
+	// 50个大小不一的响应在同一条连接上交错到达，公网用户收到的响应逐字节一致
+	for _, chunkSeq := range []bool{true, false} {
+		t.Run(fmt.Sprintf("chunk_seq=%v", chunkSeq), func(t *testing.T) {
+			runInterleaveHarness(t, 50, chunkSeq)
+		})
+	}
+}
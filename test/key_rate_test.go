@@ -0,0 +1,130 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+// parallelGet 同时发出 n 个请求，模拟页面加载时并发请求静态资源，返回被限频的数量
+func parallelGet(t *testing.T, url, key string, n int) (limited int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", fmt.Sprintf("%s/static/%d.js", url, i), nil)
+			req.Header.Set("X-Tunnel-Key", key)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("Request %d failed: %v", i, err)
+				return
+			}
+			readBody(resp)
+			mu.Lock()
+			defer mu.Unlock()
+			switch resp.StatusCode {
+			case http.StatusOK:
+			case http.StatusTooManyRequests:
+				limited++
+			default:
+				t.Errorf("Request %d: unexpected status %d", i, resp.StatusCode)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return limited
+}
+
+func TestKeyRateBurstAndSmoothing(t *testing.T) {
+	tests := []struct {
+		name       string
+		server     config.Config
+		keyConfig  *config.KeyConfig
+		minLimited int
+		maxLimited int
+		maxElapsed time.Duration
+	}{
+		// 默认突发为速率的2倍，30个并发请求中约10个被拒绝
+		{name: "default burst", server: config.Config{KeyRateLimit: 10}, minLimited: 5, maxLimited: 15, maxElapsed: time.Second},
+		{name: "global burst", server: config.Config{KeyRateLimit: 10, KeyRateBurst: 30}, maxElapsed: time.Second},
+		{name: "per key burst", server: config.Config{KeyRateLimit: 10}, keyConfig: &config.KeyConfig{RateBurst: 30}, maxElapsed: time.Second},
+		// 超出突发的10个请求在1秒内陆续拿到令牌
+		{name: "smoothing", server: config.Config{KeyRateLimit: 10, KeyRateSmoothing: 1500 * time.Millisecond}, maxElapsed: 3 * time.Second},
+		{name: "per key smoothing", server: config.Config{KeyRateLimit: 10}, keyConfig: &config.KeyConfig{RateSmoothing: config.Duration(1500 * time.Millisecond)}, maxElapsed: 3 * time.Second},
+		// 等待上限只够吸收少数请求，其余不排队直接拒绝
+		{name: "short smoothing", server: config.Config{KeyRateLimit: 10, KeyRateSmoothing: 200 * time.Millisecond}, minLimited: 5, maxLimited: 9, maxElapsed: time.Second},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 直方图是全局的，每个用例使用不同的key
+			key := fmt.Sprintf("assets-%d", i)
+			tt.server.AdminToken = "admin-secret"
+			if tt.keyConfig != nil {
+				tt.server.Keys = map[string]*config.KeyConfig{key: tt.keyConfig}
+			}
+			url, _ := startServerTunnel(t, echoPathTarget(), tt.server, config.Config{Key: key})
+
+			start := time.Now()
+			limited := parallelGet(t, url, key, 30)
+			if elapsed := time.Since(start); elapsed > tt.maxElapsed {
+				t.Errorf("Expected the burst to finish within %v, took %v", tt.maxElapsed, elapsed)
+			}
+			if limited < tt.minLimited || limited > tt.maxLimited {
+				t.Errorf("Expected %d-%d requests to be rate limited, got %d", tt.minLimited, tt.maxLimited, limited)
+			}
+
+			if tt.server.KeyRateSmoothing == 0 && (tt.keyConfig == nil || tt.keyConfig.RateSmoothing == 0) {
+				return
+			}
+			waited := metricValue(t, url, "admin-secret", fmt.Sprintf(`singleproxy_server_key_rate_wait_milliseconds_count\{key="%s"\}`, key))
+			if waited < int64(30-limited) {
+				t.Errorf("Expected every admitted request to be recorded in the wait histogram, got %d of %d", waited, 30-limited)
+			}
+		})
+	}
+}
+
+func TestKeyRateSmoothingDoesNotBlockOtherKeys(t *testing.T) {
+	url, _ := startServerTunnel(t, echoPathTarget(),
+		config.Config{KeyRateLimit: 1, KeyRateBurst: 1, KeyRateSmoothing: 3 * time.Second},
+		config.Config{Key: "slow"})
+
+	keyedGet(t, url+"/first", "slow")
+	// 第二个请求需要排队约1秒
+	done := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", url+"/second", nil)
+		req.Header.Set("X-Tunnel-Key", "slow")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		readBody(resp)
+		done <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// 排队等待不持有共享锁，同一服务器上其他key的请求不受影响
+	start := time.Now()
+	keyedGet(t, url+"/x", "other")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected another key not to wait behind the smoothed one, took %v", elapsed)
+	}
+
+	select {
+	case status := <-done:
+		if status != http.StatusOK {
+			t.Errorf("Expected the queued request to be admitted, got %d", status)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the queued request to finish within the smoothing window")
+	}
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestInvalidTunnelKeysRejected(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server"})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	wsBase := strings.Replace(ts.URL, "http://", "ws://", 1)
+
+	invalid := []struct {
+		name string
+		path string
+	}{
+		{"unicode", "%E6%9C%8D%E5%8A%A1"},
+		{"percent-encoded separator", "a%2Fb"},
+		{"dots only", "..."},
+		{"oversized", strings.Repeat("k", 65)},
+	}
+
+	for _, tt := range invalid {
+		t.Run("ws "+tt.name, func(t *testing.T) {
+			_, resp, err := websocket.DefaultDialer.Dial(wsBase+"/ws/"+tt.path, nil)
+			if err == nil {
+				t.Fatalf("Expected registration with key %q to fail", tt.path)
+			}
+			if resp == nil || resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected 400 for key %q, got %v", tt.path, resp)
+			}
+		})
+
+		t.Run("http-tunnel "+tt.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+"/http-tunnel/register/"+tt.path, "application/json", nil)
+			if err != nil {
+				t.Fatalf("Register request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected 400 for key %q, got %d", tt.path, resp.StatusCode)
+			}
+		})
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+	req.Header.Set("X-Tunnel-Key", strings.Repeat("k", 1024))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Public request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for oversized X-Tunnel-Key, got %d", resp.StatusCode)
+	}
+
+	if _, err := client.NewTunnelClient(&config.Config{
+		ServerAddr: wsBase,
+		TargetAddr: "127.0.0.1:1",
+		Key:        "bad key",
+	}); err == nil {
+		t.Errorf("Expected client to reject invalid key locally")
+	}
+}
+
+func TestCustomKeyPatternAllowsLegacyKeys(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:       "server",
+		KeyPattern: `^[a-zA-Z0-9._:@-]{1,128}$`,
+	})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/ws/team@legacy:svc", nil)
+	if err != nil {
+		t.Fatalf("Expected custom pattern to accept legacy key: %v", err)
+	}
+	conn.Close()
+}
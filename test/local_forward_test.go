@@ -0,0 +1,138 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+)
+
+// startLocalForwardClient 以key dev 注册一个开启本地监听的客户端，目标服务只返回 "dev target"，
+// 等到本地监听可以转发请求后返回本地地址
+func startLocalForwardClient(t *testing.T, proxyURL string, cfg config.Config) string {
+	t.Helper()
+	devTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "dev target")
+	}))
+	t.Cleanup(devTarget.Close)
+
+	cfg.Mode = "client"
+	cfg.Key = "dev"
+	cfg.ServerAddr = strings.Replace(proxyURL, "http://", "ws://", 1)
+	cfg.TargetAddr = strings.TrimPrefix(devTarget.URL, "http://")
+	cfg.LocalListen = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	c, err := client.NewTunnelClient(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	go c.Run()
+	t.Cleanup(c.Stop)
+
+	localURL := "http://" + cfg.LocalListen
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(localURL + "/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return localURL
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Local listener not ready: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLocalListenerForwardsThroughTunnel(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 64<<10) // 1MB，拆成多个数据块
+	remote := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write(big)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Remote", "yes")
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+		}
+	})
+	proxyURL, _ := startServerTunnel(t, remote, config.Config{AdminToken: "admin-secret"}, config.Config{Key: "remote-app"})
+	localURL := startLocalForwardClient(t, proxyURL, config.Config{LocalKey: "remote-app", MaxFrameSize: 256 << 10})
+
+	// 未携带 X-Tunnel-Key 的本地请求路由到 -local-key
+	resp, err := http.Post(localURL+"/submit?x=1", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("Local request failed: %v", err)
+	}
+	if body := readBody(resp); resp.StatusCode != http.StatusOK || body != "POST /submit?x=1 payload" || resp.Header.Get("X-Remote") != "yes" {
+		t.Errorf("Expected the remote service response, got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	// 大于单条消息的响应分块送达
+	resp, err = http.Get(localURL + "/big")
+	if err != nil {
+		t.Fatalf("Local request failed: %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(got, big) {
+		t.Errorf("Expected %d bytes from the remote service, got %d", len(big), len(got))
+	}
+
+	// 显式携带的key优先
+	req, _ := http.NewRequest("GET", localURL+"/", nil)
+	req.Header.Set("X-Tunnel-Key", "dev")
+	if body := doText(t, req); body != "dev target" {
+		t.Errorf("Expected the explicit key to route to the dev tunnel, got %q", body)
+	}
+
+	// 请求体超过协商的消息上限时在本地拒绝
+	resp, err = http.Post(localURL+"/submit", "application/octet-stream", bytes.NewReader(make([]byte, 300<<10)))
+	if err != nil {
+		t.Fatalf("Local request failed: %v", err)
+	}
+	if readBody(resp); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body over the frame size, got %d", resp.StatusCode)
+	}
+
+	if n := metricValue(t, proxyURL, "admin-secret", `singleproxy_server_local_requests_total\{key="dev"\}`); n < 4 {
+		t.Errorf("Expected at least 4 local requests in metrics, got %d", n)
+	}
+}
+
+func TestLocalListenerCancelReachesTarget(t *testing.T) {
+	canceled := make(chan struct{})
+	remote := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(10 * time.Second):
+		}
+	})
+	proxyURL, _ := startServerTunnel(t, remote, config.Config{}, config.Config{Key: "remote-app"})
+	localURL := startLocalForwardClient(t, proxyURL, config.Config{})
+
+	// 本地调用方放弃请求后，取消经服务器传到远端客户端，目标服务的请求随之取消
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", localURL+"/slow", nil)
+	req.Header.Set("X-Tunnel-Key", "remote-app")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected the local request to be abandoned")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Target request was not canceled after the local caller gave up")
+	}
+}
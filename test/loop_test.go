@@ -0,0 +1,71 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+)
+
+func TestProxyLoopTerminates(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server", AdminToken: "admin-secret", ProxyErrorHeader: true})
+	var mu sync.Mutex
+	var hops []string // 每个到达服务器的公网请求携带的 X-SingleProxy-Hop
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(protocol.HeaderTunnelKey) == "loop" {
+			mu.Lock()
+			hops = append(hops, r.Header.Get(protocol.HeaderHop))
+			mu.Unlock()
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxyServer.Close)
+
+	// 客户端的目标地址就是服务器自己的公网地址，请求带着原来的 X-Tunnel-Key 回到同一个key
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "loop",
+		ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+		TargetAddr: strings.TrimPrefix(proxyServer.URL, "http://"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	req, _ := http.NewRequest("GET", proxyServer.URL+"/loop", nil)
+	req.Header.Set(protocol.HeaderTunnelKey, "loop")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("Looping request did not terminate: %v", err)
+	}
+	body := readBody(resp)
+	if resp.StatusCode != http.StatusLoopDetected || resp.Header.Get("X-Proxy-Error") != "loop_detected" {
+		t.Errorf("Expected 508 loop_detected, got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	var info struct {
+		InstanceID string `json:"instance_id"`
+	}
+	if status := adminGet(t, proxyServer.URL, "/admin/info", "admin-secret", &info); status != http.StatusOK || info.InstanceID == "" {
+		t.Fatalf("Expected the instance ID from /admin/info, got %d %+v", status, info)
+	}
+
+	// 请求只回到服务器一次: 第一次没有经过任何实例，第二次经过了本服务器和客户端
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hops) != 2 || hops[0] != "" || !strings.HasPrefix(hops[1], info.InstanceID+", ") {
+		t.Errorf("Expected the request to loop back exactly once through instance %s, got hops %q", info.InstanceID, hops)
+	}
+}
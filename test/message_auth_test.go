@@ -0,0 +1,214 @@
+package test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+)
+
+const testMessageAuthKey = "0123456789abcdef-shared"
+
+// sendSigned 以指定密钥签名并发送一条隧道消息
+func sendSigned(t *testing.T, conn *websocket.Conn, key string, msg protocol.TunnelMessage) {
+	t.Helper()
+	data, _ := protocol.SerializeTunnelMessage(msg)
+	if err := conn.WriteMessage(websocket.BinaryMessage, protocol.SignTunnelMessage([]byte(key), data)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+}
+
+func echoPathTarget() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	})
+}
+
+func TestMessageAuthInterop(t *testing.T) {
+	// 只有一端配置密钥时不签名，请求照常转发
+	for _, tt := range []struct {
+		name      string
+		serverKey string
+		clientKey string
+	}{
+		{"both", testMessageAuthKey, testMessageAuthKey},
+		{"server only", testMessageAuthKey, ""},
+		{"client only", "", testMessageAuthKey},
+	} {
+		key := "auth-" + strings.ReplaceAll(tt.name, " ", "-")
+		url, _ := startServerTunnel(t, echoPathTarget(),
+			config.Config{MessageAuthKey: tt.serverKey},
+			config.Config{Key: key, MessageAuthKey: tt.clientKey})
+		resp, body := keyedGet(t, url+"/signed", key)
+		if resp.StatusCode != http.StatusOK || body != "path=/signed" {
+			t.Errorf("%s: expected request to pass through, got %d %q", tt.name, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestMessageAuthMismatchedKeys(t *testing.T) {
+	url, _ := startServerTunnel(t, echoPathTarget(),
+		config.Config{MessageAuthKey: testMessageAuthKey, ResponseHeaderTimeout: 500 * time.Millisecond},
+		config.Config{Key: "auth-mismatch", MessageAuthKey: "another-shared-secret"})
+
+	// 客户端丢弃签名不匹配的请求，公网请求得不到响应
+	resp, _ := keyedGet(t, url+"/signed", "auth-mismatch")
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("Expected request with mismatched signing keys to fail")
+	}
+}
+
+func TestServerClosesOnInvalidSignature(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server", MessageAuthKey: testMessageAuthKey})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	header := http.Header{protocol.HeaderFeatures: {protocol.FeatureMessageAuth}}
+	conn, resp, err := websocket.DefaultDialer.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/ws/auth-test", header)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	defer conn.Close()
+	if got := resp.Header.Get(protocol.HeaderMessageAuth); got != protocol.MessageAuthHMACSHA256 {
+		t.Fatalf("Expected server to confirm message authentication, got %q", got)
+	}
+
+	// 正确签名的消息不计入失败，错误签名的消息达到上限后以协议错误关闭
+	sendSigned(t, conn, testMessageAuthKey, protocol.TunnelMessage{Type: protocol.MSG_TYPE_TARGET_HEALTH, Payload: []byte(protocol.TargetHealthUp)})
+	for i := 0; i < protocol.DefaultMaxAuthFailures; i++ {
+		sendSigned(t, conn, "wrong-key-wrong-key", protocol.TunnelMessage{Type: protocol.MSG_TYPE_TARGET_HEALTH, Payload: []byte(protocol.TargetHealthDown)})
+	}
+	expectProtocolErrorClose(t, conn)
+}
+
+func TestServerRejectsReplayedMessages(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server", MessageAuthKey: testMessageAuthKey})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	header := http.Header{protocol.HeaderFeatures: {protocol.FeatureMessageAuth + "," + protocol.FeatureMessageAuthSeq}}
+	conn, resp, err := websocket.DefaultDialer.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/ws/replay-test", header)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	defer conn.Close()
+	if got := resp.Header.Get(protocol.HeaderMessageAuth); got != protocol.MessageAuthHMACSHA256Seq {
+		t.Fatalf("Expected server to confirm message counters, got %q", got)
+	}
+	nonce, err := hex.DecodeString(resp.Header.Get(protocol.HeaderMessageAuthNonce))
+	if err != nil || len(nonce) != protocol.MessageAuthNonceSize {
+		t.Fatalf("Expected handshake nonce, got %q", resp.Header.Get(protocol.HeaderMessageAuthNonce))
+	}
+
+	// 第一次发送照常接受，之后原样重放的同一条消息都按签名失败计数，达到上限后以协议错误关闭
+	auth := protocol.NewMessageAuth([]byte(testMessageAuthKey), nonce, protocol.MessageAuthClientToServer)
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{Type: protocol.MSG_TYPE_TARGET_HEALTH, Payload: []byte(protocol.TargetHealthDown)})
+	signed := auth.Sign(data)
+	for i := 0; i <= protocol.DefaultMaxAuthFailures; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, signed); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	expectProtocolErrorClose(t, conn)
+}
+
+func TestClientClosesOnInvalidSignature(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	result := make(chan *websocket.Conn, 1)
+	features := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		features <- r.Header.Get(protocol.HeaderFeatures)
+		conn, err := upgrader.Upgrade(w, r, http.Header{protocol.HeaderMessageAuth: {protocol.MessageAuthHMACSHA256}})
+		if err != nil {
+			return
+		}
+		result <- conn
+	}))
+	defer ts.Close()
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:                   "client",
+		ServerAddr:             strings.Replace(ts.URL, "http://", "ws://", 1),
+		TargetAddr:             "127.0.0.1:1",
+		Key:                    "auth-test",
+		MessageAuthKey:         testMessageAuthKey,
+		MessageAuthMaxFailures: 2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if got := <-features; !protocol.HasFeature(got, protocol.FeatureMessageAuth) {
+		t.Errorf("Expected client to declare message authentication, got %q", got)
+	}
+
+	conn := <-result
+	defer conn.Close()
+	// 未签名的消息同样视为校验失败
+	for i := 0; i < 2; i++ {
+		data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: uint64(i + 1), Type: protocol.MSG_TYPE_CANCEL, Payload: []byte(protocol.CancelReasonTimeout)})
+		if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	expectProtocolErrorClose(t, conn)
+}
+
+// BenchmarkMessageAuth 消息签名和校验的开销
+func BenchmarkMessageAuth(b *testing.B) {
+	key := []byte(testMessageAuthKey)
+	for _, size := range []int{1 << 10, 32 << 10} {
+		data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: 1, Type: protocol.MSG_TYPE_HTTP_RES_CHUNK, Payload: make([]byte, size)})
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				signed := protocol.SignTunnelMessage(key, data[:len(data):len(data)])
+				if _, err := protocol.VerifyTunnelMessage(key, signed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMessageAuthEndToEnd 对比开启和关闭消息签名时经隧道转发请求的吞吐
+func BenchmarkMessageAuthEndToEnd(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		key  string
+	}{
+		{"unsigned", ""},
+		{"signed", testMessageAuthKey},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			tunnelKey := "auth-bench-" + tt.name
+			url, _ := startServerTunnel(b, echoPathTarget(),
+				config.Config{MessageAuthKey: tt.key},
+				config.Config{Key: tunnelKey, MessageAuthKey: tt.key})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req, _ := http.NewRequest("GET", url+"/bench", nil)
+				req.Header.Set("X-Tunnel-Key", tunnelKey)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					b.Fatalf("Request failed: %v", err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
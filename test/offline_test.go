@@ -0,0 +1,62 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestOfflinePage(t *testing.T) {
+	pageFile := filepath.Join(t.TempDir(), "offline.html")
+	page := `<html><body><h1>staging is offline</h1><img src="data:image/png;base64,iVBORw0KGgo="></body></html>`
+	if err := os.WriteFile(pageFile, []byte(page), 0644); err != nil {
+		t.Fatalf("Failed to write offline page: %v", err)
+	}
+	proxy := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode: "server",
+		Keys: map[string]*config.KeyConfig{
+			"branded":  {OfflinePage: pageFile},
+			"built-in": {OfflinePage: "default"},
+		},
+	}))
+	t.Cleanup(proxy.Close)
+
+	resp, body := keyedGet(t, proxy.URL+"/", "branded", "Accept", "text/html,application/xhtml+xml,*/*")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("Expected 503 with Retry-After, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if body != page || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("Expected configured page, got %q (%s)", body, resp.Header.Get("Content-Type"))
+	}
+
+	resp, body = keyedGet(t, proxy.URL+"/", "built-in")
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "<code>built-in</code>") {
+		t.Errorf("Expected default template with key name, got %d %q", resp.StatusCode, body)
+	}
+
+	// API调用方收到JSON错误
+	resp, body = keyedGet(t, proxy.URL+"/api", "branded", "Accept", "application/json")
+	var apiErr struct {
+		Error      string `json:"error"`
+		Key        string `json:"key"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.Unmarshal([]byte(body), &apiErr); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected JSON 503, got %d %q", resp.StatusCode, body)
+	}
+	if apiErr.Error != "tunnel_offline" || apiErr.Key != "branded" || apiErr.RetryAfter != 30 {
+		t.Errorf("Unexpected JSON error %+v", apiErr)
+	}
+
+	// 未配置离线页面的key保持原有的502
+	if resp, _ := keyedGet(t, proxy.URL+"/", "no-page"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 without offline page, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestWebSocketAllowedOrigins(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:             "server",
+		WSAllowedOrigins: []string{"https://*.example.com", "localhost"},
+	})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+	wsURL := strings.Replace(ts.URL, "http://", "ws://", 1) + "/ws/origin-test"
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://app.example.com", true},
+		{"http://app.example.com", false},
+		{"https://example.com.evil.net", false},
+		{"http://localhost:3000", true},
+		{"https://evil.net", false},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if tt.allowed {
+			if err != nil {
+				t.Errorf("Expected origin %q to be allowed, got %v", tt.origin, err)
+				continue
+			}
+			conn.Close()
+		} else if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			if conn != nil {
+				conn.Close()
+			}
+			t.Errorf("Expected origin %q to be rejected with 403, got %v", tt.origin, err)
+		}
+	}
+}
+
+func TestWebSocketBufferSizes(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("b", 256*1024)))
+	}))
+	defer targetServer.Close()
+
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:              "server",
+		WSReadBufferSize:  64 * 1024,
+		WSWriteBufferSize: 64 * 1024,
+	})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:              "client",
+		ServerAddr:        strings.Replace(ts.URL, "http://", "ws://", 1),
+		TargetAddr:        strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:               "buffer-test",
+		WSReadBufferSize:  64 * 1024,
+		WSWriteBufferSize: 64 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+	req.Header.Set("X-Tunnel-Key", "buffer-test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || len(body) != 256*1024 {
+		t.Errorf("Expected full 256KB body, got %d bytes (err=%v)", len(body), err)
+	}
+}
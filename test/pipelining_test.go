@@ -0,0 +1,80 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+)
+
+func TestPipelinedRequests(t *testing.T) {
+	var served atomic.Int32
+	addr := startFakeTunnel(t, config.Config{}, func(conn *websocket.Conn, id uint64) {
+		n := served.Add(1)
+		go func() {
+			sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n")
+			sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, fmt.Sprintf("response %d ", n))
+			time.Sleep(100 * time.Millisecond)
+			sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "done")
+			sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "")
+		}()
+	})
+
+	request := func(path string) string {
+		return fmt.Sprintf("GET %s HTTP/1.1\r\nHost: pipeline.example\r\nX-Tunnel-Key: abort-test\r\n\r\n", path)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// 两个请求一次发出，第二个请求在第一个响应流式传输期间已到达
+	io.WriteString(conn, request("/first")+request("/second"))
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read first response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "response 1 done" {
+		t.Errorf("Unexpected first response: %d %q", resp.StatusCode, body)
+	}
+	if !resp.Close {
+		t.Errorf("Expected Connection: close so the client resends the pipelined request")
+	}
+	// 第一个响应之后连接关闭，不会出现交错或多余的响应
+	if rest, _ := io.ReadAll(reader); len(rest) != 0 {
+		t.Errorf("Unexpected data after first response: %q", rest)
+	}
+	if n := served.Load(); n != 1 {
+		t.Errorf("Expected only the first pipelined request to be forwarded, got %d", n)
+	}
+
+	// 客户端在新连接上重发第二个请求
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn2.Close()
+	_ = conn2.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn2, request("/second"))
+	resp, err = http.ReadResponse(bufio.NewReader(conn2), nil)
+	if err != nil {
+		t.Fatalf("Failed to read second response: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "response 2 done" {
+		t.Errorf("Unexpected second response: %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+// goroutineLabels 返回当前 goroutine profile 中所有协程的标签行
+func goroutineLabels(t *testing.T) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "# labels: ") {
+			labels = append(labels, strings.TrimPrefix(line, "# labels: "))
+		}
+	}
+	return labels
+}
+
+// hasLabels 判断是否有协程同时带有全部标签
+func hasLabels(labels []string, want ...string) bool {
+	for _, l := range labels {
+		matched := true
+		for _, w := range want {
+			if !strings.Contains(l, w) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGoroutineProfileLabels(t *testing.T) {
+	release := make(chan struct{})
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "last")
+	})
+	url, _ := startServerTunnel(t, target, config.Config{AdminToken: "admin-secret"}, config.Config{Key: "pprof-app"})
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", url+"/slow", nil)
+		req.Header.Set("X-Tunnel-Key", "pprof-app")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{string(body), err}
+	}()
+
+	// 响应体发送到一半时，服务器等待响应的协程和客户端发送响应体的协程都带有key和请求ID
+	key := `"key":"pprof-app"`
+	want := [][]string{
+		{key, `"request_id":"`, `"stage":"wait"`},
+		{key, `"request_id":"`, `"stage":"stream_body"`},
+		{key, `"loop":"read"`},
+		{key, `"loop":"write"`},
+		{key, `"loop":"keepalive"`},
+	}
+	var labels []string
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		labels = goroutineLabels(t)
+		missing := false
+		for _, w := range want {
+			if !hasLabels(labels, w...) {
+				missing = true
+			}
+		}
+		if !missing {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, w := range want {
+		if !hasLabels(labels, w...) {
+			t.Errorf("Expected a goroutine labeled %v, got %v", w, labels)
+		}
+	}
+
+	// 管理接口返回同样带标签的文本 profile
+	req, _ := http.NewRequest("GET", url+"/admin/debug/goroutines?debug=1", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Admin request failed: %v", err)
+	}
+	if body := readBody(resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"stage":"wait"`) {
+		t.Errorf("Expected a labeled goroutine profile from the admin API, got %d %.300q", resp.StatusCode, body)
+	}
+
+	close(release)
+	select {
+	case res := <-done:
+		if res.err != nil || res.body != "first last" {
+			t.Errorf("Expected the full response, got %q %v", res.body, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the response")
+	}
+
+	// 请求结束后等待响应的协程清除标签
+	if hasLabels(goroutineLabels(t), key, `"stage":"wait"`) {
+		t.Error("Expected request labels to be cleared after the request")
+	}
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestProxyErrorHeader(t *testing.T) {
+	proxy := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode:             "server",
+		AdminToken:       "admin-secret",
+		ProxyErrorHeader: true,
+	}))
+	t.Cleanup(proxy.Close)
+
+	resp, _ := keyedGet(t, proxy.URL+"/", "missing-tunnel")
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-Proxy-Error") != "no_tunnel" {
+		t.Errorf("Expected 502 no_tunnel, got %d %q", resp.StatusCode, resp.Header.Get("X-Proxy-Error"))
+	}
+
+	req, _ := http.NewRequest("GET", proxy.URL+"/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	metricsResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Metrics request failed: %v", err)
+	}
+	body, _ := io.ReadAll(metricsResp.Body)
+	metricsResp.Body.Close()
+	if !strings.Contains(string(body), `singleproxy_server_proxy_errors_total{reason="no_tunnel"}`) {
+		t.Errorf("Expected labeled proxy error counter, got:\n%s", body)
+	}
+
+	// 默认不暴露原因
+	quiet := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server"}))
+	t.Cleanup(quiet.Close)
+	if resp, _ := keyedGet(t, quiet.URL+"/", "missing-tunnel"); resp.Header.Get("X-Proxy-Error") != "" {
+		t.Errorf("Expected no X-Proxy-Error header when disabled, got %q", resp.Header.Get("X-Proxy-Error"))
+	}
+}
+
+func TestProxyErrorTimeoutAndReplacedTunnel(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{ProxyErrorHeader: true, ResponseHeaderTimeout: 300 * time.Millisecond},
+		func(conn *websocket.Conn, id uint64) {})
+
+	resp, _ := keyedGet(t, "http://"+addr+"/", "abort-test")
+	if resp.StatusCode != http.StatusGatewayTimeout || resp.Header.Get("X-Proxy-Error") != "response_header_timeout" {
+		t.Errorf("Expected 504 response_header_timeout, got %d %q", resp.StatusCode, resp.Header.Get("X-Proxy-Error"))
+	}
+
+	// 等待响应时同一key注册了新连接，挂起的请求以 tunnel_replaced 结束而不是空的 200
+	type result struct {
+		status int
+		reason string
+	}
+	done := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+		req.Header.Set("X-Tunnel-Key", "abort-test")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- result{}
+			return
+		}
+		resp.Body.Close()
+		done <- result{resp.StatusCode, resp.Header.Get("X-Proxy-Error")}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	replacement, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws/abort-test", nil)
+	if err != nil {
+		t.Fatalf("Failed to register replacement tunnel: %v", err)
+	}
+	defer replacement.Close()
+
+	select {
+	case res := <-done:
+		if res.status != http.StatusBadGateway || res.reason != "tunnel_replaced" {
+			t.Errorf("Expected 502 tunnel_replaced, got %d %q", res.status, res.reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Pending request did not finish after the tunnel was replaced")
+	}
+}
+
+func TestTargetErrorThroughTunnel(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 返回响应前断开连接，客户端归类为读取目标响应失败
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	url, _ := startServerTunnel(t, target, config.Config{ProxyErrorHeader: true}, config.Config{Key: "target-error"})
+
+	resp, body := keyedGet(t, url+"/", "target-error")
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-Proxy-Error") != "target_read_failed" {
+		t.Errorf("Expected 502 target_read_failed, got %d %q", resp.StatusCode, resp.Header.Get("X-Proxy-Error"))
+	}
+	if resp.Header.Get("X-Target-Error") != "" || !strings.Contains(body, "Failed to read target response") {
+		t.Errorf("Expected the server's own error response, got %q %q", resp.Header.Get("X-Target-Error"), body)
+	}
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestRangeResumeThroughTunnel(t *testing.T) {
+	// 大文件走流式转发，小文件合并为单条消息
+	files := map[string][]byte{"/large.bin": make([]byte, 300*1024), "/small.bin": make([]byte, 10*1024)}
+	rng := rand.New(rand.NewSource(1))
+	for _, data := range files {
+		rng.Read(data)
+	}
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, r.URL.Path, modTime, bytes.NewReader(files[r.URL.Path]))
+	}), config.Config{}, config.Config{Key: "range-test"})
+
+	for path, data := range files {
+		split := len(data) / 3
+		first, head := keyedGet(t, publicURL+path, "range-test", "Range", fmt.Sprintf("bytes=0-%d", split-1))
+		if first.StatusCode != http.StatusPartialContent || first.Header.Get("Accept-Ranges") != "bytes" {
+			t.Fatalf("%s: expected 206 with Accept-Ranges, got %d %v", path, first.StatusCode, first.Header)
+		}
+		if cr := first.Header.Get("Content-Range"); cr != fmt.Sprintf("bytes 0-%d/%d", split-1, len(data)) {
+			t.Errorf("%s: unexpected Content-Range %q", path, cr)
+		}
+		if first.Header.Get("Content-Length") != strconv.Itoa(split) {
+			t.Errorf("%s: expected Content-Length %d, got %q", path, split, first.Header.Get("Content-Length"))
+		}
+
+		// 续传剩余部分，If-Range 与 ETag 一致
+		rest, tail := keyedGet(t, publicURL+path, "range-test",
+			"Range", fmt.Sprintf("bytes=%d-", split),
+			"If-Range", first.Header.Get("ETag"))
+		if rest.StatusCode != http.StatusPartialContent {
+			t.Fatalf("%s: expected 206 for resumed range, got %d", path, rest.StatusCode)
+		}
+		if head+tail != string(data) {
+			t.Errorf("%s: reassembled download does not match the original (%d+%d bytes)", path, len(head), len(tail))
+		}
+
+		// 校验不一致时返回完整对象
+		full, body := keyedGet(t, publicURL+path, "range-test",
+			"Range", fmt.Sprintf("bytes=%d-", split),
+			"If-Range", `"v0"`)
+		if full.StatusCode != http.StatusOK || body != string(data) {
+			t.Errorf("%s: expected full object for stale If-Range, got %d with %d bytes", path, full.StatusCode, len(body))
+		}
+	}
+
+	// 多段请求返回 multipart/byteranges
+	resp, body := keyedGet(t, publicURL+"/small.bin", "range-test", "Range", "bytes=0-9,100-109")
+	if resp.StatusCode != http.StatusPartialContent || !strings.Contains(body, string(files["/small.bin"][100:110])) {
+		t.Errorf("Expected multipart range response, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
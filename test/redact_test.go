@@ -0,0 +1,99 @@
+package test
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/utils"
+)
+
+func TestSanitizeHeadersCustomList(t *testing.T) {
+	defer utils.ConfigureRedaction(nil, "")
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret")
+	headers.Set("Cookie", "session=abc")
+	headers.Set("X-Api-Key", "k-123")
+	headers.Set("Accept", "text/html")
+
+	utils.ConfigureRedaction([]string{"X-Api-Key", "-cookie"}, "")
+	sanitized := utils.SanitizeHeaders(headers)
+	if sanitized["Authorization"][0] != "[REDACTED]" {
+		t.Errorf("Expected Authorization to stay redacted, got %v", sanitized["Authorization"])
+	}
+	if sanitized["X-Api-Key"][0] != "[REDACTED]" {
+		t.Errorf("Expected added header to be redacted, got %v", sanitized["X-Api-Key"])
+	}
+	if sanitized["Cookie"][0] != "session=abc" {
+		t.Errorf("Expected removed header to be logged as-is, got %v", sanitized["Cookie"])
+	}
+	if !utils.IsSensitiveHeader("x-api-key") || utils.IsSensitiveHeader("Cookie") {
+		t.Errorf("IsSensitiveHeader does not follow the configured list")
+	}
+
+	utils.ConfigureRedaction(nil, utils.LogHeadersNone)
+	if sanitized := utils.SanitizeHeaders(headers); sanitized != nil {
+		t.Errorf("Expected no headers in none mode, got %v", sanitized)
+	}
+
+	utils.ConfigureRedaction(nil, utils.LogHeadersFull)
+	if sanitized := utils.SanitizeHeaders(headers); sanitized["Authorization"][0] != "Bearer secret" {
+		t.Errorf("Expected headers unmodified in full mode, got %v", sanitized)
+	}
+	// full 模式只影响日志，抓包等仍按敏感列表脱敏
+	if !utils.IsSensitiveHeader("Authorization") {
+		t.Errorf("Expected Authorization to remain sensitive in full mode")
+	}
+}
+
+func TestLazyHeadersEvaluatedOnEmit(t *testing.T) {
+	defer utils.ConfigureRedaction(nil, "")
+	utils.ConfigureRedaction(nil, "")
+
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret")
+	lazy := utils.LazyHeaders(headers)
+
+	// 未启用的级别不产生输出
+	log.Debug("debug record", "headers", lazy)
+	if buf.Len() != 0 {
+		t.Fatalf("Expected no output for disabled level, got %q", buf.String())
+	}
+
+	// 值在输出时才计算，能看到创建之后加入的头部
+	headers.Set("X-Late", "yes")
+	log.Info("info record", "headers", lazy)
+	out := buf.String()
+	if !strings.Contains(out, "X-Late") || !strings.Contains(out, "[REDACTED]") || strings.Contains(out, "Bearer secret") {
+		t.Errorf("Unexpected lazy header output: %q", out)
+	}
+}
+
+func TestSanitizeURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"/path", "/path"},
+		{"/api?token=abc&page=2", "/api?token=[REDACTED]&page=2"},
+		{"/api?API_KEY=abc&q=a%20b", "/api?API_KEY=[REDACTED]&q=a%20b"},
+		{"http://user:pw@example.com/?access_token=x", "http://user@example.com/?access_token=[REDACTED]"},
+		{"/api?tokenized=1", "/api?tokenized=1"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.raw)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.raw, err)
+		}
+		if got := utils.SanitizeURL(u); got != tt.want {
+			t.Errorf("SanitizeURL(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
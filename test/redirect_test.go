@@ -0,0 +1,86 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestRedirectOverThreshold(t *testing.T) {
+	target := slowTarget(0)
+	defer target.Close()
+
+	serverB := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", AdminToken: "admin-secret"}))
+	defer serverB.Close()
+	serverA := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode:              "server",
+		AdminToken:        "admin-secret",
+		RedirectTo:        strings.Replace(serverB.URL, "http://", "ws://", 1),
+		RedirectThreshold: 1,
+	}))
+	defer serverA.Close()
+
+	// 未超过阈值的连接留在 A
+	runDrainClient(t, serverA.URL, target.URL, "first", "127.0.0.1")
+	waitForTunnels(t, serverA.URL, 1, 2*time.Second)
+
+	// 超过阈值后新注册的客户端被重定向到 B
+	runDrainClient(t, serverA.URL, target.URL, "second", "127.0.0.1")
+	waitForTunnels(t, serverB.URL, 1, 8*time.Second)
+	waitForTunnels(t, serverA.URL, 1, 2*time.Second)
+	if resp, body := keyedGet(t, serverB.URL+"/moved", "second"); resp.StatusCode != http.StatusOK || body != "part1part2" {
+		t.Errorf("Expected the redirected client to serve through B, got %d %q", resp.StatusCode, body)
+	}
+
+	// 不接受该地址的客户端留在 A，不会被反复断开
+	runDrainClient(t, serverA.URL, target.URL, "third")
+	waitForTunnels(t, serverA.URL, 2, 2*time.Second)
+	time.Sleep(3500 * time.Millisecond)
+	waitForTunnels(t, serverA.URL, 2, time.Second)
+	if resp, body := keyedGet(t, serverA.URL+"/stayed", "third"); resp.StatusCode != http.StatusOK || body != "part1part2" {
+		t.Errorf("Expected the client that rejected the redirect to keep serving, got %d %q", resp.StatusCode, body)
+	}
+
+	req, _ := http.NewRequest("GET", serverA.URL+"/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Metrics request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `singleproxy_server_redirects_total{reason="rebalance"}`) {
+		t.Errorf("Expected redirects to be counted, got:\n%s", body)
+	}
+}
+
+func TestRedirectFallsBackToConfiguredServer(t *testing.T) {
+	target := slowTarget(0)
+	defer target.Close()
+
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", AdminToken: "admin-secret"}))
+	defer proxyServer.Close()
+
+	runDrainClient(t, proxyServer.URL, target.URL, "fallback-app", "127.0.0.1")
+	waitForTunnels(t, proxyServer.URL, 1, 2*time.Second)
+
+	// 备用地址上没有服务器
+	dead := fmt.Sprintf("ws://127.0.0.1:%d", freePort(t))
+	status, out := postDrain(t, proxyServer.URL, fmt.Sprintf(`{"grace": "5s", "reconnect_to": %q}`, dead))
+	if status != http.StatusAccepted || out["notified"] != float64(1) {
+		t.Fatalf("Unexpected drain response %d %v", status, out)
+	}
+
+	waitForTunnels(t, proxyServer.URL, 0, 2*time.Second)
+	waitForTunnels(t, proxyServer.URL, 1, 8*time.Second)
+	if resp, body := keyedGet(t, proxyServer.URL+"/back", "fallback-app"); resp.StatusCode != http.StatusOK || body != "part1part2" {
+		t.Errorf("Expected the client to serve again after falling back, got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// dialRegistration 尝试注册隧道，返回握手响应的状态码
+func dialRegistration(t *testing.T, url string, header http.Header) int {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		conn.Close()
+		return http.StatusSwitchingProtocols
+	}
+	if resp == nil {
+		t.Fatalf("Registration dial failed: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestRegistrationListenerRole(t *testing.T) {
+	publicAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	regAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:               "server",
+		ListenPort:         strings.TrimPrefix(publicAddr, "127.0.0.1:"),
+		RegistrationListen: regAddr,
+		AdminToken:         "admin-secret",
+	})
+	go proxy.Start()
+	t.Cleanup(func() { proxy.Stop() })
+	time.Sleep(100 * time.Millisecond)
+
+	// 公网端口不暴露注册入口
+	if code := dialRegistration(t, "ws://"+publicAddr+"/ws/role-test", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for registration on public listener, got %d", code)
+	}
+	resp, err := http.Post("http://"+publicAddr+"/http-tunnel/register/role-test", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for HTTP tunnel registration on public listener, got %d", resp.StatusCode)
+	}
+
+	// 注册端口只提供注册入口
+	for _, path := range []string{"/", "/admin/tunnels"} {
+		resp, err := http.Get("http://" + regAddr + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s on registration listener, got %d", path, resp.StatusCode)
+		}
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "through vpn")
+	}))
+	t.Cleanup(target.Close)
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "role-test",
+		ServerAddr: "ws://" + regAddr,
+		TargetAddr: strings.TrimPrefix(target.URL, "http://"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect via registration listener: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if _, body := keyedGet(t, "http://"+publicAddr+"/", "role-test"); body != "through vpn" {
+		t.Errorf("Expected public traffic to reach the tunnel, got %q", body)
+	}
+}
+
+func TestRegistrationAllowedCIDRs(t *testing.T) {
+	denied := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode:                     "server",
+		RegistrationAllowedCIDRs: []string{"10.0.0.0/8"},
+	}))
+	t.Cleanup(denied.Close)
+	wsURL := strings.Replace(denied.URL, "http://", "ws://", 1) + "/ws/cidr-test"
+
+	// 直连地址不在允许网段内，伪造的转发头不能绕过检查
+	if code := dialRegistration(t, wsURL, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for direct address outside allowed CIDRs, got %d", code)
+	}
+	forwarded := http.Header{"X-Forwarded-For": {"10.1.2.3"}, "X-Real-Ip": {"10.1.2.3"}}
+	if code := dialRegistration(t, wsURL, forwarded); code != http.StatusNotFound {
+		t.Errorf("Expected forwarded address to be ignored, got %d", code)
+	}
+
+	allowed := httptest.NewServer(server.NewSinglePortProxy(&config.Config{
+		Mode:                     "server",
+		RegistrationAllowedCIDRs: []string{"10.0.0.0/8", "127.0.0.1"},
+	}))
+	t.Cleanup(allowed.Close)
+	if code := dialRegistration(t, strings.Replace(allowed.URL, "http://", "ws://", 1)+"/ws/cidr-test", nil); code != http.StatusSwitchingProtocols {
+		t.Errorf("Expected registration from allowed direct address to succeed, got %d", code)
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+)
+
+// dialTunnel 直接以WebSocket注册隧道，返回连接和握手响应
+func dialTunnel(t *testing.T, baseURL, key string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	wsURL := strings.Replace(baseURL, "http://", "ws://", 1) + "/ws/" + key
+	return websocket.DefaultDialer.Dial(wsURL, nil)
+}
+
+type limitsStatus struct {
+	MaxTunnelKeys int `json:"max_tunnel_keys"`
+	TunnelKeys    int `json:"tunnel_keys"`
+	ThrottledKeys []struct {
+		Key     string `json:"key"`
+		Strikes int    `json:"strikes"`
+	} `json:"throttled_keys"`
+}
+
+func TestMaxTunnelKeys(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:          "server",
+		AdminToken:    "admin-secret",
+		MaxTunnelKeys: 2,
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	for _, key := range []string{"key-a", "key-b"} {
+		conn, _, err := dialTunnel(t, proxyServer.URL, key)
+		if err != nil {
+			t.Fatalf("Registration of %s failed: %v", key, err)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	_, resp, err := dialTunnel(t, proxyServer.URL, "key-c")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 for key over limit, got %v %v", resp, err)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header on key limit rejection")
+	}
+
+	// 已注册的key重连不受上限影响
+	conn, _, err := dialTunnel(t, proxyServer.URL, "key-a")
+	if err != nil {
+		t.Fatalf("Reconnect of existing key failed: %v", err)
+	}
+	defer conn.Close()
+
+	var status limitsStatus
+	if code := adminGet(t, proxyServer.URL, "/admin/limits", "admin-secret", &status); code != http.StatusOK {
+		t.Fatalf("Expected 200 from /admin/limits, got %d", code)
+	}
+	if status.MaxTunnelKeys != 2 || status.TunnelKeys != 2 {
+		t.Errorf("Unexpected limits status %+v", status)
+	}
+}
+
+func TestRegistrationRateLimit(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:              "server",
+		AdminToken:        "admin-secret",
+		RegistrationRate:  1,
+		RegistrationBurst: 2,
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	// 突发额度内的重连不受影响
+	for i := 0; i < 2; i++ {
+		conn, _, err := dialTunnel(t, proxyServer.URL, "looping")
+		if err != nil {
+			t.Fatalf("Registration %d failed: %v", i, err)
+		}
+		conn.Close()
+	}
+
+	var waits []time.Duration
+	for i := 0; i < 2; i++ {
+		conn, _, err := dialTunnel(t, proxyServer.URL, "looping")
+		if err != nil {
+			t.Fatalf("Throttled registration should still upgrade: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err = conn.ReadMessage()
+		conn.Close()
+
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater {
+			t.Fatalf("Expected close 1013, got %v", err)
+		}
+		wait, ok := protocol.ParseRetryAfterReason(closeErr.Text)
+		if !ok || wait <= 0 {
+			t.Fatalf("Expected retry-after in close reason, got %q", closeErr.Text)
+		}
+		waits = append(waits, wait)
+	}
+	if waits[1] <= waits[0] {
+		t.Errorf("Expected increasing retry-after values, got %v", waits)
+	}
+
+	// 其他key不受影响
+	conn, _, err := dialTunnel(t, proxyServer.URL, "other")
+	if err != nil {
+		t.Fatalf("Registration of other key failed: %v", err)
+	}
+	conn.Close()
+
+	var status limitsStatus
+	adminGet(t, proxyServer.URL, "/admin/limits", "admin-secret", &status)
+	if len(status.ThrottledKeys) != 1 || status.ThrottledKeys[0].Key != "looping" || status.ThrottledKeys[0].Strikes != 2 {
+		t.Errorf("Unexpected throttled keys %+v", status.ThrottledKeys)
+	}
+}
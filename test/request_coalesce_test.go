@@ -0,0 +1,210 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+// concurrentGets 同时发出 n 个相同的请求，返回每个请求的状态码和响应体
+func concurrentGets(t *testing.T, url, key string, n int, header http.Header) (statuses []int, bodies []string) {
+	t.Helper()
+	statuses = make([]int, n)
+	bodies = make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", url, nil)
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			req.Header.Set("X-Tunnel-Key", key)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("Request %d failed: %v", i, err)
+				return
+			}
+			statuses[i], bodies[i] = resp.StatusCode, readBody(resp)
+		}(i)
+	}
+	wg.Wait()
+	return statuses, bodies
+}
+
+// slowCountingTarget 按路径计数的目标服务，模拟缓存过期后重新生成页面需要一段时间
+func slowCountingTarget(hits *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		time.Sleep(300 * time.Millisecond)
+		switch r.URL.Path {
+		case "/assets/large.bin":
+			w.Write([]byte(strings.Repeat("x", 4096)))
+		case "/assets/session":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(n)})
+			fmt.Fprintf(w, "session %d", n)
+		default:
+			fmt.Fprintf(w, "render %d %s %s", n, r.URL.RequestURI(), r.Header.Get("Accept-Language"))
+		}
+	})
+}
+
+func TestCoalesceIdenticalRequests(t *testing.T) {
+	var hits atomic.Int64
+	url, _ := startServerTunnel(t, slowCountingTarget(&hits),
+		config.Config{AdminToken: "admin-secret", Keys: map[string]*config.KeyConfig{
+			"web": {Coalesce: &config.CoalesceConfig{Paths: []string{"/assets"}, MaxBodyBytes: 1024}},
+		}},
+		config.Config{Key: "web"})
+
+	// 缓存过期时的10个相同请求只到达目标服务一次，全部收到同一个响应
+	statuses, bodies := concurrentGets(t, url+"/assets/app.js?v=1", "web", 10, nil)
+	if n := hits.Swap(0); n != 1 {
+		t.Fatalf("Expected one tunnel round trip for identical requests, got %d", n)
+	}
+	for i := range statuses {
+		if statuses[i] != http.StatusOK || bodies[i] != "render 1 /assets/app.js?v=1 " {
+			t.Errorf("Expected every request to see the shared response, got %d %q", statuses[i], bodies[i])
+		}
+	}
+	if n := metricValue(t, url, "admin-secret", `singleproxy_server_coalesced_requests_total\{key="web"\}`); n != 9 {
+		t.Errorf("Expected 9 coalesced requests, got %d", n)
+	}
+
+	// 区分请求的头部和查询参数不同时分别转发
+	var wg sync.WaitGroup
+	for _, tc := range []struct {
+		path string
+		lang string
+	}{{"/assets/app.js?v=1", "en"}, {"/assets/app.js?v=1", "zh"}, {"/assets/app.js?v=2", "en"}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, bodies := concurrentGets(t, url+tc.path, "web", 3, http.Header{"Accept-Language": {tc.lang}})
+			for _, body := range bodies {
+				if !strings.HasSuffix(body, tc.path+" "+tc.lang) {
+					t.Errorf("Expected the response for %s %s, got %q", tc.path, tc.lang, body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := hits.Swap(0); n != 3 {
+		t.Errorf("Expected one round trip per distinct request, got %d", n)
+	}
+
+	// 不在 paths 中的路径照常转发
+	concurrentGets(t, url+"/api/status", "web", 3, nil)
+	if n := hits.Swap(0); n != 3 {
+		t.Errorf("Expected paths outside coalesce.paths to be forwarded individually, got %d", n)
+	}
+}
+
+func TestCoalesceUnshareableResponses(t *testing.T) {
+	var hits atomic.Int64
+	url, _ := startServerTunnel(t, slowCountingTarget(&hits),
+		config.Config{AdminToken: "admin-secret", Keys: map[string]*config.KeyConfig{
+			"unshared": {Coalesce: &config.CoalesceConfig{MaxBodyBytes: 1024}},
+		}},
+		config.Config{Key: "unshared"})
+
+	for _, tc := range []struct {
+		path   string
+		reason string
+	}{{"/assets/large.bin", "too_large"}, {"/assets/session", "private"}} {
+		t.Run(tc.reason, func(t *testing.T) {
+			// 超过 max_body_bytes 或设置 Cookie 的响应不共享，等待的请求各自转发
+			statuses, bodies := concurrentGets(t, url+tc.path, "unshared", 5, nil)
+			if n := hits.Swap(0); n != 5 {
+				t.Errorf("Expected every request to be forwarded on its own, got %d round trips", n)
+			}
+			seen := make(map[string]bool)
+			for i := range statuses {
+				if statuses[i] != http.StatusOK || seen[bodies[i]] && tc.reason == "private" {
+					t.Errorf("Expected distinct successful responses, got %d %q", statuses[i], bodies[i])
+				}
+				seen[bodies[i]] = true
+			}
+			// 每种原因只在这里出现，计数从0开始
+			metric := fmt.Sprintf(`singleproxy_server_coalesce_fallbacks_total\{reason="%s"\}`, tc.reason)
+			if n := metricValue(t, url, "admin-secret", metric); n != 4 {
+				t.Errorf("Expected 4 fallbacks, got %d", n)
+			}
+		})
+	}
+}
+
+func TestCoalesceLeaderFailure(t *testing.T) {
+	var hits atomic.Int64
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		time.Sleep(300 * time.Millisecond)
+		if n == 1 {
+			// 第一个请求的目标连接中断
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	url, _ := startServerTunnel(t, target,
+		config.Config{AdminToken: "admin-secret", Keys: map[string]*config.KeyConfig{
+			"flaky": {Coalesce: &config.CoalesceConfig{}},
+		}},
+		config.Config{Key: "flaky"})
+
+	// 第一个请求失败时，等待的请求各自重新转发而不是一起失败
+	statuses, _ := concurrentGets(t, url+"/report", "flaky", 5, nil)
+	failed := 0
+	for _, status := range statuses {
+		if status != http.StatusOK {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected only the leader to fail, got statuses %v", statuses)
+	}
+	if n := hits.Load(); n != 5 {
+		t.Errorf("Expected the followers to retry independently, got %d round trips", n)
+	}
+	if n := metricValue(t, url, "admin-secret", `singleproxy_server_coalesce_fallbacks_total\{reason="leader_failed"\}`); n != 4 {
+		t.Errorf("Expected 4 leader_failed fallbacks, got %d", n)
+	}
+}
+
+func TestCoalesceSkipsBackendOverride(t *testing.T) {
+	var hits atomic.Int64
+	url, _ := startServerTunnel(t, slowCountingTarget(&hits),
+		config.Config{AdminToken: "admin-secret", Keys: map[string]*config.KeyConfig{
+			"pinned": {Coalesce: &config.CoalesceConfig{}},
+		}},
+		config.Config{Key: "pinned"})
+
+	// 第一个请求转发期间，指定了连接的相同请求不共享它的响应，而是由指定的连接处理 (这里不存在，返回404)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, body := keyedGet(t, url+"/page", "pinned"); resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected leader to succeed, got %d %q", resp.StatusCode, body)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	statuses, bodies := concurrentGets(t, url+"/page", "pinned", 3,
+		http.Header{"X-Tunnel-Backend": {"missing"}, "X-Tunnel-Backend-Token": {"admin-secret"}})
+	for i := range statuses {
+		if statuses[i] != http.StatusNotFound {
+			t.Errorf("Expected pinned request to bypass coalescing, got %d %q", statuses[i], bodies[i])
+		}
+	}
+	<-done
+	if n := hits.Load(); n != 1 {
+		t.Errorf("Expected only the leader to reach the target, got %d", n)
+	}
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+	"singleproxy/pkg/server"
+)
+
+// requestLogFields 每条请求完成日志必须包含的字段，与传输方式无关
+var requestLogFields = []string{"transport", "key", "request_id", "method", "path", "status", "duration", "bytes"}
+
+// readRequestLogs 读取JSON日志中消息为 msgs 之一的记录
+func readRequestLogs(t *testing.T, file string, msgs ...string) []map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	var records []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 1<<20), 1<<20)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if record["msg"] == msg {
+				records = append(records, record)
+			}
+		}
+	}
+	return records
+}
+
+func TestRequestLogSchemaAcrossTransports(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "requests.log")
+	if err := logger.InitLogger(&config.Config{LogLevel: "info", LogFormat: "json", LogFile: logFile}); err != nil {
+		t.Fatalf("Failed to init logger: %v", err)
+	}
+	t.Cleanup(func() {
+		logger.InitLogger(&config.Config{LogLevel: "info"})
+	})
+
+	large := strings.Repeat("x", 256*1024)
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			w.Write([]byte(large))
+			return
+		}
+		w.Write([]byte("small"))
+	})
+
+	// WebSocket: 小响应整条发送，大响应分块发送
+	wsURL, _ := startServerTunnel(t, target, config.Config{}, config.Config{Key: "log-ws"})
+	keyedGet(t, wsURL+"/small?q=1", "log-ws")
+	keyedGet(t, wsURL+"/large", "log-ws")
+
+	// HTTP 长轮询
+	targetServer := httptest.NewServer(target)
+	t.Cleanup(targetServer.Close)
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server"}))
+	t.Cleanup(proxyServer.Close)
+	httpClient, err := client.NewHTTPTunnelClient(&config.Config{
+		Mode:       "http-client",
+		ServerAddr: proxyServer.URL,
+		TargetAddr: strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:        "log-poll",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %v", err)
+	}
+	go httpClient.Run()
+	t.Cleanup(httpClient.Stop)
+	time.Sleep(200 * time.Millisecond)
+	keyedGet(t, proxyServer.URL+"/small", "log-poll")
+
+	// 服务器和客户端各记录一条完成日志: WebSocket 两个请求，长轮询一个请求
+	var records []map[string]any
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		records = readRequestLogs(t, logFile, "Request completed", "Response stream completed successfully")
+		if len(records) >= 6 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(records) != 6 {
+		t.Fatalf("Expected 6 request completion logs, got %d: %v", len(records), records)
+	}
+
+	seen := make(map[string]int)
+	for _, record := range records {
+		for _, field := range requestLogFields {
+			if _, ok := record[field]; !ok {
+				t.Errorf("Request log %q is missing field %q: %v", record["msg"], field, record)
+			}
+		}
+		for _, legacy := range []string{"id", "url", "tunnel_type", "bytes_out", "total_bytes", "status_code"} {
+			if _, ok := record[legacy]; ok {
+				t.Errorf("Request log %q still uses field %q: %v", record["msg"], legacy, record)
+			}
+		}
+		if record["method"] != "GET" || record["status"] != float64(http.StatusOK) {
+			t.Errorf("Unexpected method or status: %v", record)
+		}
+		wantBytes := float64(len("small"))
+		if record["path"] == "/large" {
+			wantBytes = float64(len(large))
+		}
+		if record["bytes"] != wantBytes {
+			t.Errorf("Expected bytes %v, got %v: %v", wantBytes, record["bytes"], record)
+		}
+		seen[record["transport"].(string)+" "+record["key"].(string)+" "+record["path"].(string)]++
+	}
+	want := map[string]int{
+		logger.TransportWebSocket + " log-ws /small":  2,
+		logger.TransportWebSocket + " log-ws /large":  2,
+		logger.TransportLongPoll + " log-poll /small": 2,
+	}
+	for k, n := range want {
+		if seen[k] != n {
+			t.Errorf("Expected %d logs for %q, got %d (all: %v)", n, k, seen[k], seen)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestRequestTimeoutHint(t *testing.T) {
+	seen := make(chan string, 1)
+	cancelled := make(chan struct{}, 1)
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get("X-Request-Timeout")
+		if r.URL.Path == "/fast" {
+			io.WriteString(w, "ok")
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	})
+	serverCfg := config.Config{RequestTimeoutMin: 100 * time.Millisecond, RequestTimeoutMax: 2 * time.Second}
+	url, _ := startServerTunnel(t, target, serverCfg, config.Config{Key: "deadline"})
+
+	get := func(path, timeout string) int {
+		req, _ := http.NewRequest("GET", url+path, nil)
+		req.Header.Set("X-Tunnel-Key", "deadline")
+		req.Header.Set("X-Request-Timeout", timeout)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// 调用方的超时替代默认的响应超时，目标服务的调用同时被取消
+	start := time.Now()
+	if status := get("/slow", "0.5"); status != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504, got %d", status)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected request timeout to apply, took %v", elapsed)
+	}
+	if v := <-seen; v != "0.5" {
+		t.Errorf("Expected forwarded timeout 0.5, got %q", v)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected target call to be cancelled at the request deadline")
+	}
+
+	// 超出上限的超时按上限转发
+	if status := get("/fast", "600"); status != http.StatusOK {
+		t.Errorf("Expected 200, got %d", status)
+	}
+	if v := <-seen; v != "2" {
+		t.Errorf("Expected timeout to be clamped to 2, got %q", v)
+	}
+}
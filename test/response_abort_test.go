@@ -0,0 +1,215 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+)
+
+// startFakeTunnel 启动使用原始监听路径的服务器，并注册一个由测试直接收发消息的隧道。
+// respond 收到每个请求的ID，负责发送响应消息
+func startFakeTunnel(t *testing.T, cfg config.Config, respond func(conn *websocket.Conn, id uint64)) string {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	cfg.Mode = "server"
+	cfg.ListenPort = strings.TrimPrefix(addr, "127.0.0.1:")
+	proxy := server.NewSinglePortProxy(&cfg)
+	go proxy.Start()
+	t.Cleanup(func() { proxy.Stop() })
+	time.Sleep(100 * time.Millisecond)
+	serveFakeTunnel(t, "ws://"+addr+"/ws/abort-test", respond)
+	return addr
+}
+
+// serveFakeTunnel 在 wsURL 注册隧道，把收到的每个请求ID交给 respond
+func serveFakeTunnel(t *testing.T, wsURL string, respond func(conn *websocket.Conn, id uint64)) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := protocol.DeserializeTunnelMessage(data)
+			if err != nil || msg.Type != protocol.MSG_TYPE_HTTP_REQ {
+				continue
+			}
+			respond(conn, msg.ID)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+}
+
+// fakeTunnelWriteMu 串行化假隧道上的写入: respond 可能在多个协程中回应不同的请求，
+// 而 gorilla/websocket 不允许并发写入
+var fakeTunnelWriteMu sync.Mutex
+
+// sendTunnelMessage 通过假隧道发送一条消息
+func sendTunnelMessage(conn *websocket.Conn, id uint64, msgType protocol.MessageType, payload string) {
+	data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: id, Type: msgType, Payload: []byte(payload)})
+	fakeTunnelWriteMu.Lock()
+	defer fakeTunnelWriteMu.Unlock()
+	_ = conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// rawExchange 发送请求并读取连接上的全部原始字节，直到服务器关闭连接
+func rawExchange(t *testing.T, addr string) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /stream HTTP/1.1\r\nHost: abort.example\r\nX-Tunnel-Key: abort-test\r\nConnection: close\r\n\r\n")
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read raw response: %v", err)
+	}
+	return data
+}
+
+const partialHeader = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+
+func TestTimeoutAfterHeadersAbortsConnection(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{ResponseTimeout: 500 * time.Millisecond}, func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, partialHeader)
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "partial body")
+	})
+
+	data := rawExchange(t, addr)
+	if n := bytes.Count(data, []byte("HTTP/1.1 ")); n != 1 {
+		t.Errorf("Expected exactly one status line, got %d in %q", n, data)
+	}
+	if !bytes.HasPrefix(data, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.HasSuffix(data, []byte("partial body")) {
+		t.Errorf("Expected truncated 200 response, got %q", data)
+	}
+	if bytes.Contains(data, []byte("Gateway Timeout")) {
+		t.Errorf("504 error page appended to streamed response: %q", data)
+	}
+}
+
+func TestTimeoutBeforeHeadersWrites504(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{ResponseHeaderTimeout: 300 * time.Millisecond}, func(*websocket.Conn, uint64) {})
+
+	data := rawExchange(t, addr)
+	if !bytes.HasPrefix(data, []byte("HTTP/1.1 504 Gateway Timeout\r\n")) {
+		t.Errorf("Expected 504 status line, got %q", data)
+	}
+}
+
+func TestDuplicateResponseHeaderIgnored(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{}, func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, partialHeader)
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, "HTTP/1.1 500 Internal Server Error\r\n\r\n")
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_FULL, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 3\r\n\r\nbad")
+	})
+
+	data := rawExchange(t, addr)
+	if n := bytes.Count(data, []byte("HTTP/1.1 ")); n != 1 {
+		t.Errorf("Expected exactly one status line, got %d in %q", n, data)
+	}
+	if string(data) != "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain\r\n\r\n" {
+		t.Errorf("Unexpected raw response %q", data)
+	}
+}
+
+func TestMalformedResponseHeaderWrites502(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{}, func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, "not an http response")
+	})
+
+	data := rawExchange(t, addr)
+	if !bytes.HasPrefix(data, []byte("HTTP/1.1 502 Bad Gateway\r\n")) {
+		t.Errorf("Expected 502 status line, got %q", data)
+	}
+}
+
+func TestChunkBeforeHeaderIsBuffered(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{}, func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "early ")
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, partialHeader)
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "body")
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "")
+	})
+
+	data := rawExchange(t, addr)
+	if string(data) != "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Type: text/plain\r\n\r\nearly body" {
+		t.Errorf("Expected buffered chunk after the header, got %q", data)
+	}
+}
+
+func TestChunkWithoutHeaderWrites502(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{}, func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "orphan body")
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "")
+	})
+
+	data := rawExchange(t, addr)
+	if !bytes.HasPrefix(data, []byte("HTTP/1.1 502 Bad Gateway\r\n")) || bytes.Contains(data, []byte("orphan body")) {
+		t.Errorf("Expected 502 without the orphan body, got %q", data)
+	}
+}
+
+func TestRepeatedResponseViolationsCloseTunnel(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{MaxResponseViolations: 2}, func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, partialHeader)
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, partialHeader)
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "")
+	})
+
+	for i := 0; i < 2; i++ {
+		if data := rawExchange(t, addr); !bytes.HasPrefix(data, []byte("HTTP/1.1 200 OK\r\n")) {
+			t.Fatalf("Request %d: expected the first header to be delivered, got %q", i, data)
+		}
+	}
+	// 第二次违规后隧道以协议错误关闭，该key不再有在线的隧道
+	time.Sleep(100 * time.Millisecond)
+	if data := rawExchange(t, addr); !bytes.HasPrefix(data, []byte("HTTP/1.1 502 Bad Gateway\r\n")) {
+		t.Errorf("Expected 502 after the tunnel was closed, got %q", data)
+	}
+}
+
+func TestResponseFromAnotherTunnelIgnored(t *testing.T) {
+	ids := make(chan uint64, 1)
+	var victim *websocket.Conn
+	addr := startFakeTunnel(t, config.Config{}, func(conn *websocket.Conn, id uint64) {
+		victim = conn
+		ids <- id
+	})
+	// 另一个key的隧道得知请求ID后抢先回应，服务器只接受转发该请求的连接发来的消息
+	intruder, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws/intruder", nil)
+	if err != nil {
+		t.Fatalf("Failed to register intruder tunnel: %v", err)
+	}
+	defer intruder.Close()
+	go func() {
+		id := <-ids
+		sendTunnelMessage(intruder, id, protocol.MSG_TYPE_HTTP_RES_FULL, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nhijack")
+		sendTunnelMessage(intruder, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "")
+		time.Sleep(200 * time.Millisecond)
+		sendTunnelMessage(victim, id, protocol.MSG_TYPE_HTTP_RES_FULL, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nlegit")
+	}()
+
+	data := rawExchange(t, addr)
+	if bytes.Contains(data, []byte("hijack")) || !bytes.HasSuffix(data, []byte("legit")) {
+		t.Errorf("Expected only the forwarding tunnel's response, got %q", data)
+	}
+}
@@ -0,0 +1,46 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	// 禁用小响应合并，响应头到达目标后立即转发
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}), config.Config{ResponseHeaderTimeout: 300 * time.Millisecond}, config.Config{Key: "timeout-test", FullResponseThreshold: -1})
+
+	start := time.Now()
+	resp, _ := keyedGet(t, publicURL+"/slow-header", "timeout-test")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Header timeout took %v", elapsed)
+	}
+}
+
+func TestSlowBodyOutlivesResponseHeaderTimeout(t *testing.T) {
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Second)
+		io.WriteString(w, "second")
+	}), config.Config{ResponseHeaderTimeout: 300 * time.Millisecond}, config.Config{Key: "timeout-test", FullResponseThreshold: -1})
+
+	resp, body := keyedGet(t, publicURL+"/slow-body", "timeout-test")
+	if resp.StatusCode != http.StatusOK || body != "first second" {
+		t.Errorf("Expected complete 200 response, got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:       "server",
+		DefaultKey: config.DefaultKeyNone,
+		AdminToken: "secret",
+		AdminTokens: []*config.AdminTokenConfig{
+			{Name: "team-a", Token: "team-a-token", Keys: []string{"app*"}},
+		},
+		Hosts: map[string]*config.HostConfig{
+			"app.example.com": {TunnelKey: "app"},
+		},
+		Keys: map[string]*config.KeyConfig{
+			"app": {SSE: true, FallbackUpstream: "https://mirror.example.com"},
+		},
+	})
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	var table server.RouteTable
+	if status := adminGet(t, proxyServer.URL, "/admin/routes", "secret", &table); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if table.DefaultKey != "" || len(table.Hosts) != 1 || table.Hosts[0].Key != "app" {
+		t.Errorf("Unexpected route table %+v", table)
+	}
+	if len(table.Keys) != 1 || table.Keys[0].FallbackUpstream != "https://mirror.example.com" ||
+		len(table.Keys[0].AdminTokens) != 1 {
+		t.Errorf("Expected app key settings, got %+v", table.Keys)
+	}
+
+	// 路由表包含全部主机名和key，只对完整权限的令牌开放
+	if status := adminGet(t, proxyServer.URL, "/admin/routes", "team-a-token", nil); status != http.StatusForbidden {
+		t.Errorf("Expected scoped token to be rejected, got %d", status)
+	}
+
+	var m server.RouteMatch
+	path := "/admin/routes?match=" + url.QueryEscape("GET https://app.example.com/events")
+	if status := adminGet(t, proxyServer.URL, path, "secret", &m); status != http.StatusOK {
+		t.Fatalf("Expected match status 200, got %d", status)
+	}
+	if m.Key != "app" || m.KeySource != "host_config" || m.ResponseTimeout != "none" {
+		t.Errorf("Unexpected match result %+v", m)
+	}
+
+	if status := adminGet(t, proxyServer.URL, "/admin/routes?match="+url.QueryEscape("GET /no-host"), "secret", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a match without host, got %d", status)
+	}
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+// writeScheduleConfig 写入只包含 sched-app 开放时段的配置文件
+func writeScheduleConfig(t *testing.T, path, window string) {
+	t.Helper()
+	yaml := fmt.Sprintf("server:\n  keys:\n    sched-app:\n      schedule:\n        timezone: UTC\n        windows: [%q]\n        affects_ready: true\n", window)
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduleClosedAndReload(t *testing.T) {
+	var reached atomic.Int64
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		io.WriteString(w, "ok")
+	})
+
+	// 两小时后开始的一小时时段，测试期间一直不开放
+	start := time.Now().UTC().Add(2 * time.Hour).Hour()
+	closedWindow := fmt.Sprintf("%02d:00-%02d:00", start, (start+1)%24)
+	configFile := filepath.Join(t.TempDir(), "singleproxy.yaml")
+	writeScheduleConfig(t, configFile, closedWindow)
+
+	url, _ := startServerTunnel(t, target,
+		config.Config{
+			AdminToken: "admin-secret",
+			ConfigFile: configFile,
+			Keys: map[string]*config.KeyConfig{
+				"sched-app": {Schedule: &config.ScheduleConfig{Timezone: "UTC", Windows: []string{closedWindow}, AffectsReady: true}},
+			},
+		},
+		config.Config{Key: "sched-app"})
+
+	// 时段外隧道照常注册，公网请求收到维护页面和下一次开放时间
+	resp, body := keyedGet(t, url+"/", "sched-app")
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "维护") {
+		t.Errorf("Expected 503 maintenance page outside the schedule, got %d %q", resp.StatusCode, body)
+	}
+	nextOpen, err := time.Parse(time.RFC3339, resp.Header.Get("X-Next-Open"))
+	if err != nil || nextOpen.UTC().Hour() != start || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected X-Next-Open at %02d:00 and Retry-After, got %q %q", start,
+			resp.Header.Get("X-Next-Open"), resp.Header.Get("Retry-After"))
+	}
+	if n := reached.Load(); n != 0 {
+		t.Errorf("Expected closed requests not to reach the target, got %d requests", n)
+	}
+
+	req, _ := http.NewRequest("GET", url+"/api", nil)
+	req.Header.Set("X-Tunnel-Key", "sched-app")
+	req.Header.Set("Accept", "application/json")
+	jsonResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := readBody(jsonResp); jsonResp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, `"schedule_closed"`) {
+		t.Errorf("Expected JSON 503 outside the schedule, got %d %q", jsonResp.StatusCode, body)
+	}
+
+	var schedules struct {
+		Schedules []struct {
+			Key      string     `json:"key"`
+			Open     bool       `json:"open"`
+			NextOpen *time.Time `json:"next_open"`
+		} `json:"schedules"`
+	}
+	if code := adminGet(t, url, "/admin/schedules", "admin-secret", &schedules); code != http.StatusOK ||
+		len(schedules.Schedules) != 1 || schedules.Schedules[0].Open || schedules.Schedules[0].NextOpen == nil {
+		t.Errorf("Expected sched-app to be closed with a next opening, got %d %+v", code, schedules)
+	}
+	if code := adminGet(t, url, "/admin/ready", "admin-secret", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready while an affects_ready key is closed, got %d", code)
+	}
+
+	// 不合法的开放时段不生效，保留原来的设置
+	writeScheduleConfig(t, configFile, "Mon-Fry 09:00-18:00")
+	if code := adminDo(t, "POST", url+"/admin/schedules/reload", "admin-secret", ""); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an invalid schedule, got %d", code)
+	}
+	if resp, _ := keyedGet(t, url+"/", "sched-app"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the previous schedule to stay in effect, got %d", resp.StatusCode)
+	}
+
+	// 重新加载全天开放的时段后无需重启即可转发
+	writeScheduleConfig(t, configFile, "00:00-24:00")
+	if code := adminDo(t, "POST", url+"/admin/schedules/reload", "admin-secret", ""); code != http.StatusOK {
+		t.Fatalf("Expected schedules to reload, got %d", code)
+	}
+	if resp, body := keyedGet(t, url+"/", "sched-app"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("Expected the tunnel to serve after reloading, got %d %q", resp.StatusCode, body)
+	}
+	if code := adminGet(t, url, "/admin/ready", "admin-secret", nil); code != http.StatusOK {
+		t.Errorf("Expected ready once the key is open, got %d", code)
+	}
+}
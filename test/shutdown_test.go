@@ -0,0 +1,101 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestServerStop(t *testing.T) {
+	port := freePort(t)
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server", ListenPort: fmt.Sprint(port)})
+	startErr := make(chan error, 1)
+	go func() { startErr <- proxy.Start() }()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/ws/stop-test", port), nil)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	if err := proxy.Stop(); err != nil {
+		t.Errorf("Stop returned error: %v", err)
+	}
+	select {
+	case err := <-startErr:
+		if err != nil {
+			t.Errorf("Expected Start to return nil after Stop, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Errorf("Expected tunnel to be closed with 1001, got %v", err)
+	}
+}
+
+func TestClientStop(t *testing.T) {
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server"}))
+	defer proxyServer.Close()
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1),
+		TargetAddr: "127.0.0.1:1",
+		Key:        "client-stop",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		tunnelClient.Run()
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	tunnelClient.Stop()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+
+	httpClient, err := client.NewHTTPTunnelClient(&config.Config{
+		Mode:       "http-client",
+		ServerAddr: proxyServer.URL,
+		TargetAddr: "127.0.0.1:1",
+		Key:        "http-client-stop",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %v", err)
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- httpClient.Run() }()
+	time.Sleep(200 * time.Millisecond)
+
+	// 长轮询正在进行时停止
+	httpClient.Stop()
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("Expected Run to return nil, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("HTTP client Run did not return after Stop")
+	}
+}
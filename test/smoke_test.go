@@ -0,0 +1,85 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/doctor"
+)
+
+func TestSmokeCommand(t *testing.T) {
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Request-Id", "echo-"+r.Header.Get("X-Request-Id"))
+		io.WriteString(w, "ok")
+	}), config.Config{AdminToken: "admin-secret"}, config.Config{Key: "smoke-test"})
+
+	report := doctor.Smoke(doctor.SmokeOptions{
+		Server:     publicURL,
+		Key:        "smoke-test",
+		Path:       "/healthz",
+		TunnelSide: true,
+		AdminToken: "admin-secret",
+	})
+	if report.Failed() {
+		var out strings.Builder
+		report.Write(&out)
+		t.Fatalf("Expected smoke test to pass:\n%s", out.String())
+	}
+	if res := findResult(t, report, "request"); !strings.Contains(res.Message, "200 OK (2 bytes)") {
+		t.Errorf("Unexpected request result %q", res.Message)
+	}
+	if res := findResult(t, report, "timing"); !strings.Contains(res.Message, "ttfb") {
+		t.Errorf("Unexpected timing result %q", res.Message)
+	}
+	if res := findResult(t, report, "request_id"); !strings.Contains(res.Message, "X-Request-Id echo-") {
+		t.Errorf("Expected echoed request ID, got %q", res.Message)
+	}
+	if res := findResult(t, report, "tunnel_side"); !strings.Contains(res.Message, "GET /healthz -> 200") {
+		t.Errorf("Unexpected tunnel side result %q", res.Message)
+	}
+
+	// 未连接的key返回 502
+	report = doctor.Smoke(doctor.SmokeOptions{Server: publicURL, Key: "missing-key", Timeout: 2 * time.Second})
+	if res := findResult(t, report, "request"); res.Status != doctor.Fail || !strings.Contains(res.Message, "502") {
+		t.Errorf("Expected failure for missing key, got %+v", report.Results)
+	}
+}
+
+func TestSmokeTunnelSideUnreachableTarget(t *testing.T) {
+	publicURL, _ := startServerTunnel(t, http.NotFoundHandler(), config.Config{AdminToken: "admin-secret"}, config.Config{Key: "smoke-live"})
+
+	// 另一个key的客户端目标服务不可用
+	deadClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "smoke-dead",
+		ServerAddr: strings.Replace(publicURL, "http://", "ws://", 1),
+		TargetAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	go deadClient.Run()
+	t.Cleanup(deadClient.Stop)
+	time.Sleep(150 * time.Millisecond)
+
+	report := doctor.Smoke(doctor.SmokeOptions{
+		Server:     publicURL,
+		Key:        "smoke-dead",
+		TunnelSide: true,
+		AdminToken: "admin-secret",
+	})
+	res := findResult(t, report, "tunnel_side")
+	if res.Status != doctor.Fail || !strings.Contains(res.Message, "cannot reach its target") {
+		t.Errorf("Expected tunnel side failure, got %+v", report.Results)
+	}
+}
@@ -0,0 +1,201 @@
+package test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// certDER 读取证书文件中的第一个证书
+func certDER(t *testing.T, certFile string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("Failed to read certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	return block.Bytes
+}
+
+// servedCert 以指定SNI握手并返回服务器出示的证书，握手失败时返回错误
+func servedCert(addr, serverName string) ([]byte, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Raw, nil
+}
+
+// startTLSProxy 以TLS启动服务器并返回监听地址
+func startTLSProxy(t *testing.T, cfg config.Config) string {
+	t.Helper()
+	port := freePort(t)
+	cfg.Mode = "server"
+	cfg.ListenPort = fmt.Sprint(port)
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	proxy := server.NewSinglePortProxy(&cfg)
+	go proxy.Start()
+	t.Cleanup(func() { proxy.Stop() })
+	time.Sleep(100 * time.Millisecond)
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+func TestSNICertificates(t *testing.T) {
+	dir := t.TempDir()
+	defCert, defKey := writeTestCert(t, dir, "default", time.Now().Add(24*time.Hour))
+	appCert, appKey := writeTestCert(t, dir, "app", time.Now().Add(24*time.Hour))
+	wildCert, wildKey := writeTestCert(t, dir, "wildcard", time.Now().Add(24*time.Hour))
+
+	addr := startTLSProxy(t, config.Config{
+		CertFile:   defCert,
+		KeyFile:    defKey,
+		AdminToken: "admin-secret",
+		Hosts: map[string]*config.HostConfig{
+			"App.Example.com": {TunnelKey: "app", CertFile: appCert, KeyFile: appKey},
+			"*.customer.test": {CertFile: wildCert, KeyFile: wildKey},
+		},
+	})
+
+	for _, tt := range []struct {
+		serverName string
+		certFile   string
+	}{
+		{"app.example.com", appCert},
+		{"APP.example.com", appCert},
+		{"shop.customer.test", wildCert},
+		{"a.b.customer.test", defCert},
+		{"unknown.example.org", defCert},
+		{"", defCert},
+	} {
+		got, err := servedCert(addr, tt.serverName)
+		if err != nil {
+			t.Errorf("%q: handshake failed: %v", tt.serverName, err)
+			continue
+		}
+		if !bytes.Equal(got, certDER(t, tt.certFile)) {
+			t.Errorf("%q: expected certificate from %s", tt.serverName, filepath.Base(tt.certFile))
+		}
+	}
+
+	// 续期后的证书通过管理API重新加载，无需重启
+	appCert, _ = writeTestCert(t, dir, "app", time.Now().Add(48*time.Hour))
+	httpsClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	req, _ := http.NewRequest("POST", "https://"+addr+"/admin/tls/reload", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := httpsClient.Do(req)
+	if err != nil {
+		t.Fatalf("Reload request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected reload to succeed, got %d %s", resp.StatusCode, body)
+	}
+	if got, err := servedCert(addr, "app.example.com"); err != nil || !bytes.Equal(got, certDER(t, appCert)) {
+		t.Errorf("Expected reloaded certificate for app.example.com (err=%v)", err)
+	}
+
+	// 证书文件损坏时重新加载失败，继续使用原有证书
+	os.WriteFile(appKey, []byte("broken"), 0600)
+	resp, err = httpsClient.Do(req)
+	if err != nil {
+		t.Fatalf("Reload request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected failed reload to return 422, got %d", resp.StatusCode)
+	}
+	if got, err := servedCert(addr, "app.example.com"); err != nil || !bytes.Equal(got, certDER(t, appCert)) {
+		t.Errorf("Expected previous certificate to stay in use after failed reload (err=%v)", err)
+	}
+}
+
+func TestSNIRejectUnknown(t *testing.T) {
+	dir := t.TempDir()
+	appCert, appKey := writeTestCert(t, dir, "app", time.Now().Add(24*time.Hour))
+
+	// 只配置主机名证书，未知SNI中止握手
+	addr := startTLSProxy(t, config.Config{
+		TLSUnknownSNI: "reject",
+		Hosts: map[string]*config.HostConfig{
+			"app.example.com": {CertFile: appCert, KeyFile: appKey},
+		},
+	})
+	if _, err := servedCert(addr, "app.example.com"); err != nil {
+		t.Errorf("Expected configured host to complete the handshake: %v", err)
+	}
+	if _, err := servedCert(addr, "other.example.com"); err == nil {
+		t.Errorf("Expected handshake for unknown server name to be aborted")
+	}
+	if _, err := servedCert(addr, ""); err == nil {
+		t.Errorf("Expected handshake without server name to be aborted")
+	}
+}
+
+func TestSNIHostRoute(t *testing.T) {
+	dir := t.TempDir()
+	defCert, defKey := writeTestCert(t, dir, "default", time.Now().Add(24*time.Hour))
+	appCert, appKey := writeTestCert(t, dir, "app", time.Now().Add(24*time.Hour))
+	addr := startTLSProxy(t, config.Config{
+		CertFile: defCert,
+		KeyFile:  defKey,
+		Hosts: map[string]*config.HostConfig{
+			"app.example.com": {TunnelKey: "sni-app", CertFile: appCert, KeyFile: appKey},
+		},
+	})
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "routed %s", r.URL.Path)
+	}))
+	t.Cleanup(target.Close)
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		Key:        "sni-app",
+		ServerAddr: "wss://" + addr,
+		TargetAddr: strings.TrimPrefix(target.URL, "http://"),
+		Insecure:   true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// 同一个主机名配置同时决定证书和隧道key
+	httpsClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "app.example.com", InsecureSkipVerify: true},
+	}}
+	req, _ := http.NewRequest("GET", "https://"+addr+"/hello", nil)
+	req.Host = "app.example.com"
+	resp, err := httpsClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "routed /hello" {
+		t.Errorf("Expected request routed by host config, got %d %q", resp.StatusCode, body)
+	}
+	if !bytes.Equal(resp.TLS.PeerCertificates[0].Raw, certDER(t, appCert)) {
+		t.Errorf("Expected certificate of app.example.com")
+	}
+}
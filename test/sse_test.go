@@ -0,0 +1,176 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// minuteEventTarget 每分钟发出一个事件的SSE服务
+func minuteEventTarget(contentType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			fmt.Fprintf(w, "id: %d\ndata: tick %d\n\n", i, i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// openEventStream 打开事件流并逐行读取，返回行通道和关闭函数
+func openEventStream(t *testing.T, url, key string) (*http.Response, <-chan string, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req.Header.Set("X-Tunnel-Key", key)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatalf("Request failed: %v", err)
+	}
+	lines := make(chan string, 64)
+	go func() {
+		defer close(lines)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return resp, lines, cancel
+}
+
+// readLinesFor 收集一段时间内读到的行，流结束时返回 closed 为 true
+func readLinesFor(lines <-chan string, d time.Duration) (got []string, closed bool) {
+	deadline := time.After(d)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return got, true
+			}
+			got = append(got, line)
+		case <-deadline:
+			return got, false
+		}
+	}
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	url, _ := startServerTunnel(t, minuteEventTarget("text/event-stream; charset=utf-8"), config.Config{
+		ResponseHeaderTimeout: 200 * time.Millisecond,
+		ResponseTimeout:       300 * time.Millisecond,
+		Keys: map[string]*config.KeyConfig{
+			"events": {SSEHeartbeat: config.Duration(100 * time.Millisecond)},
+		},
+	}, config.Config{Key: "events"})
+
+	resp, lines, cancel := openEventStream(t, url+"/events", "events")
+	defer cancel()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Accel-Buffering") != "no" {
+		t.Fatalf("Expected unbuffered event stream, got %d %q", resp.StatusCode, resp.Header.Get("X-Accel-Buffering"))
+	}
+
+	// 第一个事件之后下一分钟内没有数据，应收到心跳且不被 response_timeout 中断
+	got, closed := readLinesFor(lines, time.Second)
+	if closed {
+		t.Fatalf("Event stream was closed before the next event: %q", got)
+	}
+	if len(got) == 0 || got[0] != "id: 0" || got[1] != "data: tick 0" {
+		t.Fatalf("Expected first event, got %q", got)
+	}
+	keepalives := 0
+	for _, line := range got {
+		if line == ": keepalive" {
+			keepalives++
+		}
+	}
+	if keepalives < 3 {
+		t.Errorf("Expected keepalive comments while idle, got %q", got)
+	}
+}
+
+func TestSSEWithoutHeartbeat(t *testing.T) {
+	// 自动识别 text/event-stream，未配置心跳时只解除总超时
+	url, _ := startServerTunnel(t, minuteEventTarget("text/event-stream"), config.Config{
+		ResponseTimeout: 300 * time.Millisecond,
+	}, config.Config{Key: "events-plain"})
+
+	_, lines, cancel := openEventStream(t, url+"/events", "events-plain")
+	defer cancel()
+	got, closed := readLinesFor(lines, time.Second)
+	if closed {
+		t.Fatalf("Event stream was closed by the response timeout: %q", got)
+	}
+	for _, line := range got {
+		if strings.HasPrefix(line, ":") {
+			t.Errorf("Unexpected heartbeat without sse_heartbeat: %q", got)
+		}
+	}
+}
+
+func TestSSEKeyConfig(t *testing.T) {
+	// sse: true 的key即使响应类型不是 text/event-stream 也不受总超时限制
+	url, _ := startServerTunnel(t, minuteEventTarget("text/plain"), config.Config{
+		ResponseTimeout: 300 * time.Millisecond,
+		Keys: map[string]*config.KeyConfig{
+			"feed": {SSE: true},
+		},
+	}, config.Config{Key: "feed"})
+
+	_, lines, cancel := openEventStream(t, url+"/feed", "feed")
+	defer cancel()
+	if got, closed := readLinesFor(lines, time.Second); closed {
+		t.Fatalf("Stream for sse key was closed by the response timeout: %q", got)
+	}
+
+	// 普通流式响应仍然受总超时限制
+	plainURL, _ := startServerTunnel(t, minuteEventTarget("text/plain"), config.Config{
+		ResponseTimeout: 300 * time.Millisecond,
+	}, config.Config{Key: "plain"})
+	_, lines, cancel = openEventStream(t, plainURL+"/feed", "plain")
+	defer cancel()
+	if got, closed := readLinesFor(lines, 2*time.Second); !closed {
+		t.Errorf("Expected plain stream to be cut by the response timeout, got %q", got)
+	}
+}
+
+func TestSSETunnelClosed(t *testing.T) {
+	// 假隧道发出事件流的响应头和第一个事件后断开
+	addr := startFakeTunnel(t, config.Config{}, func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\n")
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "data: tick 0\n\n")
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+	})
+
+	_, lines, cancel := openEventStream(t, "http://"+addr+"/events", "abort-test")
+	defer cancel()
+
+	// 事件流不受总超时限制，隧道断开时应立即结束而不是一直挂起
+	got, closed := readLinesFor(lines, 2*time.Second)
+	if !closed {
+		t.Errorf("Expected event stream to end when the tunnel closed, got %q", got)
+	}
+	if len(got) == 0 || got[0] != "data: tick 0" {
+		t.Errorf("Expected first event before the tunnel closed, got %q", got)
+	}
+}
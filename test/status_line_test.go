@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+// statusTarget 按路径返回指定状态码，/empty 直接写出原因短语为空的状态行
+func statusTarget(t *testing.T) *httptest.Server {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			conn, buf, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Errorf("Failed to hijack: %v", err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 599 \r\nContent-Length: 5\r\nConnection: close\r\n\r\nempty")
+			buf.Flush()
+		case "/hints":
+			w.Header().Set("Link", "</app.js>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+			io.WriteString(w, "final")
+		default:
+			var code int
+			fmt.Sscanf(r.URL.Path, "/code/%d", &code)
+			w.WriteHeader(code)
+			io.WriteString(w, "body")
+		}
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+// rawStatusLines 发送请求并返回响应中的所有状态行 (包括 1xx 临时响应)
+func rawStatusLines(t *testing.T, addr, path, key string) []string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: status.example\r\nX-Tunnel-Key: %s\r\nConnection: close\r\n\r\n", path, key)
+
+	var lines []string
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(line, "HTTP/1.1 ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestStatusLinesOnRawListener(t *testing.T) {
+	target := statusTarget(t)
+	// 服务器自己监听端口，响应经 httpResponseWriter 写出
+	url, _ := startServerTunnel(t, nil, config.Config{ListenPort: strconv.Itoa(freePort(t))},
+		config.Config{Key: "status-raw", TargetAddr: strings.TrimPrefix(target.URL, "http://")})
+	addr := strings.TrimPrefix(url, "http://")
+
+	tests := []struct {
+		path  string
+		lines []string
+	}{
+		{"/code/418", []string{"HTTP/1.1 418 I'm a teapot\r\n"}},
+		{"/code/599", []string{"HTTP/1.1 599 Status\r\n"}},
+		{"/empty", []string{"HTTP/1.1 599 Status\r\n"}},
+		{"/hints", []string{"HTTP/1.1 103 Early Hints\r\n", "HTTP/1.1 200 OK\r\n"}},
+	}
+	for _, tt := range tests {
+		lines := rawStatusLines(t, addr, tt.path, "status-raw")
+		if strings.Join(lines, "") != strings.Join(tt.lines, "") {
+			t.Errorf("%s: expected status lines %q, got %q", tt.path, tt.lines, lines)
+		}
+	}
+}
+
+func TestStatusCodesThroughTunnel(t *testing.T) {
+	target := statusTarget(t)
+	url, _ := startServerTunnel(t, target.Config.Handler, config.Config{}, config.Config{Key: "status-std"})
+
+	for path, want := range map[string]int{"/code/418": 418, "/code/599": 599, "/empty": 599} {
+		resp, body := keyedGet(t, url+path, "status-std")
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected %d, got %d", path, want, resp.StatusCode)
+		}
+		if path == "/empty" && body != "empty" {
+			t.Errorf("%s: expected the body to survive the empty reason, got %q", path, body)
+		}
+	}
+}
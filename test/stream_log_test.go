@@ -0,0 +1,89 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/logger"
+)
+
+// streamLogBody 大响应体，按32KB读取时约产生128个数据块
+var streamLogBody = bytes.Repeat([]byte("0123456789abcdef"), 4<<20/16)
+
+func streamLogTarget() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(streamLogBody)
+	})
+}
+
+// useDebugLogger 将日志切换到调试级别并写入指定文件，测试结束后恢复
+func useDebugLogger(tb testing.TB, file string) {
+	tb.Helper()
+	if err := logger.InitLogger(&config.Config{LogLevel: "debug", LogFile: file}); err != nil {
+		tb.Fatalf("Failed to init logger: %v", err)
+	}
+	tb.Cleanup(func() {
+		logger.InitLogger(&config.Config{LogLevel: "info"})
+	})
+}
+
+func TestStreamDebugLogVolume(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "debug.log")
+	useDebugLogger(t, logFile)
+
+	url, _ := startServerTunnel(t, streamLogTarget(), config.Config{}, config.Config{Key: "stream-log"})
+	resp, body := keyedGet(t, url+"/large", "stream-log")
+	if resp.StatusCode != http.StatusOK || len(body) != len(streamLogBody) {
+		t.Fatalf("Unexpected response: status=%d size=%d", resp.StatusCode, len(body))
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	lines := strings.Split(string(data), "\n")
+	var chunkLines, completed int
+	for _, line := range lines {
+		if strings.Contains(line, "chunk") && !strings.Contains(line, "completed") {
+			chunkLines++
+		}
+		if strings.Contains(line, "Response stream completed successfully") {
+			completed++
+			if !strings.Contains(line, "chunks=") {
+				t.Errorf("Completion log should include chunk count: %s", line)
+			}
+		}
+	}
+	// 逐块日志已汇总，日志行数不再随数据块数量增长
+	if chunkLines > 10 {
+		t.Errorf("Expected aggregated chunk logs, got %d chunk lines", chunkLines)
+	}
+	if completed != 1 {
+		t.Errorf("Expected one stream completion log, got %d", completed)
+	}
+}
+
+// BenchmarkStreamDebugLogging 调试级别下流式传输大响应体的吞吐
+func BenchmarkStreamDebugLogging(b *testing.B) {
+	useDebugLogger(b, os.DevNull)
+
+	url, _ := startServerTunnel(b, streamLogTarget(), config.Config{}, config.Config{Key: "stream-log-bench"})
+	b.SetBytes(int64(len(streamLogBody)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("GET", url+"/large", nil)
+		req.Header.Set("X-Tunnel-Key", "stream-log-bench")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			b.Fatalf("Request failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
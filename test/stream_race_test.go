@@ -0,0 +1,91 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// TestTimeoutRacesWithChunkWrites 在极短的超时下并发发起流式请求，
+// 使超时清理与隧道数据块写入频繁交错。配合 -race 运行可发现处理函数返回后的写入
+func TestTimeoutRacesWithChunkWrites(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 部分请求延迟响应头，触发响应头超时
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(40 * time.Millisecond)
+		}
+		for i := 0; i < 20; i++ {
+			fmt.Fprintf(w, "chunk-%02d\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(3 * time.Millisecond)
+		}
+	}))
+	defer targetServer.Close()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:                  "server",
+		ListenPort:            strings.TrimPrefix(addr, "127.0.0.1:"),
+		ResponseHeaderTimeout: 20 * time.Millisecond,
+		ResponseTimeout:       30 * time.Millisecond,
+	})
+	go proxy.Start()
+	defer proxy.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:                  "client",
+		ServerAddr:            "ws://" + addr,
+		TargetAddr:            strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:                   "race-test",
+		FullResponseThreshold: -1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer tunnelClient.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := "/fast"
+			if i%2 == 0 {
+				path = "/slow"
+			}
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("Failed to dial: %v", err)
+				return
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: race.example\r\nX-Tunnel-Key: race-test\r\nConnection: close\r\n\r\n", path)
+			data, err := io.ReadAll(conn)
+			if err != nil {
+				t.Errorf("Failed to read response: %v", err)
+				return
+			}
+			if n := bytes.Count(data, []byte("HTTP/1.1 ")); n != 1 {
+				t.Errorf("Expected exactly one status line for %s, got %d in %q", path, n, data)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+// startProtocolTarget 启动同时支持 HTTP/1.1 和 h2c 的目标服务，返回监听地址。
+// 目标服务返回请求使用的协议和请求体
+func startProtocolTarget(tb testing.TB) string {
+	tb.Helper()
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Proto, body)
+	}))
+	target.Config.Protocols = new(http.Protocols)
+	target.Config.Protocols.SetHTTP1(true)
+	target.Config.Protocols.SetUnencryptedHTTP2(true)
+	target.Start()
+	tb.Cleanup(target.Close)
+	return strings.TrimPrefix(target.URL, "http://")
+}
+
+func protocolPost(tb testing.TB, url, key, body string) string {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("X-Tunnel-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tb.Errorf("Request failed: %v", err)
+		return ""
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return string(data)
+}
+
+func TestTargetProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		protocol string
+		want     string
+	}{
+		{"h1", "HTTP/1.1"},
+		{"h2c", "HTTP/2.0"},
+		{"auto", "HTTP/1.1"}, // 明文目标无法协商，auto 使用 HTTP/1.1
+	} {
+		// 客户端按 TargetProtocol 连接目标服务
+		publicURL, _ := startServerTunnel(t, nil, config.Config{},
+			config.Config{Key: "proto-" + tt.protocol, TargetAddr: startProtocolTarget(t), TargetProtocol: tt.protocol})
+		if body := protocolPost(t, publicURL+"/echo", "proto-"+tt.protocol, "payload"); body != tt.want+" payload" {
+			t.Errorf("%s: expected %q, got %q", tt.protocol, tt.want+" payload", body)
+		}
+	}
+}
+
+func TestTargetProtocolH2CConcurrent(t *testing.T) {
+	publicURL, _ := startServerTunnel(t, nil, config.Config{},
+		config.Config{Key: "proto-h2c", TargetAddr: startProtocolTarget(t), TargetProtocol: "h2c"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := fmt.Sprintf("HTTP/2.0 body-%d", i)
+			if body := protocolPost(t, publicURL+"/echo", "proto-h2c", fmt.Sprintf("body-%d", i)); body != want {
+				t.Errorf("Expected %q, got %q", want, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// BenchmarkTargetProtocol 比较64个并发隧道请求下 HTTP/1.1 与 h2c 到目标服务的吞吐
+func BenchmarkTargetProtocol(b *testing.B) {
+	for _, proto := range []string{"h1", "h2c"} {
+		b.Run(proto, func(b *testing.B) {
+			publicURL, _ := startServerTunnel(b, nil, config.Config{},
+				config.Config{Key: "proto-" + proto, TargetAddr: startProtocolTarget(b), TargetProtocol: proto})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < 64; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						protocolPost(b, publicURL+"/echo", "proto-"+proto, "payload")
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
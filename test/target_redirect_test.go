@@ -0,0 +1,105 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+// redirectTarget 返回相对、内部绝对地址和循环的重定向，internalURL 为私有网络内另一个服务的地址
+func redirectTarget(internalURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/relative":
+			http.Redirect(w, r, "/page?from=relative", http.StatusFound)
+		case "/absolute":
+			http.Redirect(w, r, "http://internal.local:8080/page?from=absolute", http.StatusFound)
+		case "/internal":
+			http.Redirect(w, r, internalURL+"/private", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			io.WriteString(w, "page "+r.URL.RawQuery)
+		}
+	})
+}
+
+func TestTargetRedirectPassthrough(t *testing.T) {
+	url, _ := startServerTunnel(t, redirectTarget("http://internal.invalid"), config.Config{},
+		config.Config{Key: "redirect-pass", TargetLocationRewrite: "http://internal.local:8080=https://app.example.com"})
+
+	tests := []struct {
+		path, location string
+	}{
+		// 相对地址由调用方按公网地址解析，不需要改写
+		{"/relative", "/page?from=relative"},
+		// 指向内部地址的绝对地址改写为公网地址，保留路径和查询参数
+		{"/absolute", "https://app.example.com/page?from=absolute"},
+		// 其他主机不匹配改写规则，原样返回
+		{"/internal", "http://internal.invalid/private"},
+	}
+	for _, tt := range tests {
+		resp, _ := keyedGet(t, url+tt.path, "redirect-pass")
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != tt.location {
+			t.Errorf("%s: expected 302 to %q, got %d to %q", tt.path, tt.location, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+
+	// 重定向循环由调用方自己发现，客户端只转发一次
+	if resp, _ := keyedGet(t, url+"/loop", "redirect-pass"); resp.StatusCode != http.StatusFound {
+		t.Errorf("Expected the loop redirect to pass through, got %d", resp.StatusCode)
+	}
+}
+
+func TestTargetRedirectFollowed(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "internal "+r.URL.Path)
+	}))
+	t.Cleanup(internal.Close)
+	url, _ := startServerTunnel(t, redirectTarget(internal.URL), config.Config{ProxyErrorHeader: true},
+		config.Config{Key: "redirect-follow", FollowTargetRedirects: true})
+
+	if resp, body := keyedGet(t, url+"/relative", "redirect-follow"); resp.StatusCode != http.StatusOK || body != "page from=relative" {
+		t.Errorf("Expected the relative redirect to be followed, got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := keyedGet(t, url+"/internal", "redirect-follow"); resp.StatusCode != http.StatusOK || body != "internal /private" {
+		t.Errorf("Expected the absolute redirect to be followed inside the private network, got %d %q", resp.StatusCode, body)
+	}
+
+	resp, _ := keyedGet(t, url+"/loop", "redirect-follow")
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-Proxy-Error") != "target_redirect_loop" {
+		t.Errorf("Expected 502 target_redirect_loop, got %d %q", resp.StatusCode, resp.Header.Get("X-Proxy-Error"))
+	}
+}
+
+func TestTargetRedirectPassthroughLongPoll(t *testing.T) {
+	targetServer := httptest.NewServer(redirectTarget("http://internal.invalid"))
+	t.Cleanup(targetServer.Close)
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server"}))
+	t.Cleanup(proxyServer.Close)
+	httpClient, err := client.NewHTTPTunnelClient(&config.Config{
+		Mode:                  "http-client",
+		ServerAddr:            proxyServer.URL,
+		TargetAddr:            strings.TrimPrefix(targetServer.URL, "http://"),
+		Key:                   "redirect-poll",
+		TargetLocationRewrite: "http://internal.local:8080=https://app.example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %v", err)
+	}
+	go httpClient.Run()
+	t.Cleanup(httpClient.Stop)
+	time.Sleep(200 * time.Millisecond)
+
+	resp, _ := keyedGet(t, proxyServer.URL+"/absolute", "redirect-poll")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://app.example.com/page?from=absolute" {
+		t.Errorf("Expected the long-poll client to pass the rewritten redirect through, got %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+)
+
+// httpsGet 以指定的TLS配置请求公网入口
+func httpsGet(addr, key string, tlsConfig *tls.Config) (*http.Response, error) {
+	tlsConfig.InsecureSkipVerify = true
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}
+	req, _ := http.NewRequest("GET", "https://"+addr+"/", nil)
+	req.Header.Set("X-Tunnel-Key", key)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestTLSFingerprintLoggedAndDenied(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "default", time.Now().Add(24*time.Hour))
+
+	// 访问记录中带上客户端的 JA3 指纹
+	addr := startTLSProxy(t, config.Config{CertFile: certFile, KeyFile: keyFile, AdminToken: "admin-secret", AccessLogRing: 10})
+	if _, err := httpsGet(addr, "fp-app", &tls.Config{}); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	// 访问记录在响应写出后写入，轮询直到已记录
+	var report struct {
+		Entries []struct {
+			TLSFingerprint string `json:"tls_fingerprint"`
+		} `json:"entries"`
+	}
+	httpsClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(report.Entries) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		req, _ := http.NewRequest("GET", "https://"+addr+"/admin/keys/fp-app/access", nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		resp, err := httpsClient.Do(req)
+		if err != nil {
+			t.Fatalf("Admin request failed: %v", err)
+		}
+		json.NewDecoder(resp.Body).Decode(&report)
+		resp.Body.Close()
+	}
+	if len(report.Entries) != 1 || len(report.Entries[0].TLSFingerprint) != 32 {
+		t.Fatalf("Expected an access entry with a JA3 fingerprint, got %+v", report)
+	}
+	fingerprint := report.Entries[0].TLSFingerprint
+
+	// 拒绝列表中的指纹在握手时被拒绝，其他TLS栈不受影响
+	denyAddr := startTLSProxy(t, config.Config{CertFile: certFile, KeyFile: keyFile, TLSFingerprintDeny: []string{fingerprint}})
+	if _, err := httpsGet(denyAddr, "fp-app", &tls.Config{}); err == nil {
+		t.Error("Expected the denied fingerprint to fail the handshake")
+	}
+	other := &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+	if resp, err := httpsGet(denyAddr, "fp-app", other); err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected a different TLS stack to reach routing, got %v %v", resp, err)
+	}
+}
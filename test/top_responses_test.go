@@ -0,0 +1,79 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"singleproxy/pkg/config"
+)
+
+func TestAdminTopResponses(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Write([]byte(strings.Repeat("x", size)))
+	})
+	url, _ := startServerTunnel(t, target, config.Config{
+		AdminToken: "admin-secret",
+		TopResponses: &config.TopResponsesConfig{
+			Rewrites: []*config.PathRewrite{{Pattern: `/[0-9]+$`, Replacement: "/:id"}},
+		},
+	}, config.Config{Key: "top-test"})
+
+	for _, path := range []string{
+		"/reports/1?size=50000",
+		"/reports/2?size=120000",
+		"/assets/app.js?size=3000",
+		"/health?size=2",
+	} {
+		if resp, _ := keyedGet(t, url+path, "top-test"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Request %s failed with %d", path, resp.StatusCode)
+		}
+	}
+
+	var result struct {
+		Responses []struct {
+			Method     string `json:"method"`
+			Path       string `json:"path"`
+			MaxBytes   int64  `json:"max_bytes"`
+			Requests   int64  `json:"requests"`
+			TotalBytes int64  `json:"total_bytes"`
+		} `json:"responses"`
+	}
+	if status := adminGet(t, url, "/admin/top-responses?key=top-test&limit=2", "admin-secret", &result); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if len(result.Responses) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", result.Responses)
+	}
+	first := result.Responses[0]
+	if first.Method != "GET" || first.Path != "/reports/:id" || first.MaxBytes != 120000 || first.Requests != 2 || first.TotalBytes != 170000 {
+		t.Errorf("Unexpected largest response entry: %+v", first)
+	}
+	if result.Responses[1].Path != "/assets/app.js" {
+		t.Errorf("Expected /assets/app.js second, got %+v", result.Responses[1])
+	}
+
+	if status := adminGet(t, url, "/admin/top-responses", "admin-secret", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 without key, got %d", status)
+	}
+
+	req, _ := http.NewRequest("GET", url+"/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Metrics request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`singleproxy_server_response_size_bytes_bucket{key="top-test",le="4096"} 2`,
+		`singleproxy_server_response_size_bytes_count{key="top-test"} 4`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
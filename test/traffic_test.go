@@ -0,0 +1,108 @@
+package test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTrafficPauseAndResume(t *testing.T) {
+	var reached atomic.Int64
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		io.WriteString(w, "ok")
+	})
+	url, _ := startServerTunnel(t, target,
+		config.Config{AdminToken: "admin-secret"},
+		config.Config{Key: "paused-app"})
+
+	if resp, body := keyedGet(t, url+"/", "paused-app"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("Expected the tunnel to serve before pausing, got %d %q", resp.StatusCode, body)
+	}
+
+	if code := adminDo(t, "PUT", url+"/admin/traffic", "admin-secret", `{"traffic_mode":"pause"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown traffic mode, got %d", code)
+	}
+	if code := adminDo(t, "PUT", url+"/admin/traffic", "admin-secret", `{"traffic_mode":"paused"}`); code != http.StatusOK {
+		t.Fatalf("Expected traffic to pause, got %d", code)
+	}
+
+	// 暂停期间公网请求收到暂停页面，不经过隧道
+	resp, body := keyedGet(t, url+"/", "paused-app")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" || !strings.Contains(body, "维护") {
+		t.Errorf("Expected 503 holding page while paused, got %d %q", resp.StatusCode, body)
+	}
+	if n := reached.Load(); n != 1 {
+		t.Errorf("Expected paused requests not to reach the target, got %d requests", n)
+	}
+
+	// 就绪检查反映暂停状态，管理API和隧道照常工作
+	var ready struct {
+		Ready       bool   `json:"ready"`
+		TrafficMode string `json:"traffic_mode"`
+	}
+	if code := adminGet(t, url, "/admin/ready", "admin-secret", &ready); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready while paused, got %d", code)
+	}
+	if code := adminGet(t, url, "/admin/traffic", "admin-secret", &ready); code != http.StatusOK || ready.TrafficMode != "paused" {
+		t.Errorf("Expected traffic mode paused, got %d %+v", code, ready)
+	}
+	var tunnels adminTunnels
+	if code := adminGet(t, url, "/admin/tunnels", "admin-secret", &tunnels); code != http.StatusOK || len(tunnels.Tunnels) != 1 {
+		t.Errorf("Expected the tunnel to stay registered while paused, got %d %+v", code, tunnels)
+	}
+	if paused := metricValue(t, url, "admin-secret", "singleproxy_server_traffic_paused"); paused < 1 {
+		t.Errorf("Expected the paused gauge to be set, got %d", paused)
+	}
+
+	// 恢复后同一条隧道继续服务，无需重连
+	if code := adminDo(t, "PUT", url+"/admin/traffic", "admin-secret", `{"traffic_mode":"normal"}`); code != http.StatusOK {
+		t.Fatalf("Expected traffic to resume, got %d", code)
+	}
+	if resp, body := keyedGet(t, url+"/", "paused-app"); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("Expected the tunnel to serve after resuming, got %d %q", resp.StatusCode, body)
+	}
+	if code := adminGet(t, url, "/admin/ready", "admin-secret", &ready); code != http.StatusOK || !ready.Ready {
+		t.Errorf("Expected ready after resuming, got %d %+v", code, ready)
+	}
+}
+
+func TestTrafficPausedOnListener(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{TrafficMode: "paused"}, func(conn *websocket.Conn, id uint64) {
+		t.Errorf("Expected request %d not to reach the tunnel while paused", id)
+	})
+
+	// 隧道在暂停期间照常注册 (startFakeTunnel 已完成注册)，SOCKS5 握手被拒绝
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[0] != 0x05 || reply[1] != 0xff {
+		t.Errorf("Expected SOCKS5 handshake to be refused, got %v %v", reply, err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	req.Header.Set("X-Tunnel-Key", "abort-test")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), `"traffic_paused"`) {
+		t.Errorf("Expected JSON 503 while paused, got %d %q", resp.StatusCode, body)
+	}
+}
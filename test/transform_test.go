@@ -0,0 +1,171 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+	"singleproxy/pkg/transform"
+)
+
+// startServerTunnel 使用指定的配置启动服务器和客户端，返回公网地址和服务器，测试结束时全部停止。
+// target 为nil时客户端连接 clientCfg.TargetAddr 上已在监听的目标服务；
+// serverCfg.ListenPort 非空时服务器自己监听该端口 (响应经 httpResponseWriter 写出)，否则经 httptest 服务
+func startServerTunnel(t testing.TB, target http.Handler, serverCfg, clientCfg config.Config) (string, *server.SinglePortProxy) {
+	t.Helper()
+	if target != nil {
+		targetServer := httptest.NewServer(target)
+		t.Cleanup(targetServer.Close)
+		clientCfg.TargetAddr = strings.TrimPrefix(targetServer.URL, "http://")
+	}
+
+	serverCfg.Mode = "server"
+	proxy := server.NewSinglePortProxy(&serverCfg)
+	var publicURL string
+	if serverCfg.ListenPort != "" {
+		go proxy.Start()
+		t.Cleanup(func() { proxy.Stop() })
+		time.Sleep(100 * time.Millisecond)
+		publicURL = "http://127.0.0.1:" + serverCfg.ListenPort
+	} else {
+		proxyServer := httptest.NewServer(proxy)
+		t.Cleanup(proxyServer.Close)
+		publicURL = proxyServer.URL
+	}
+
+	clientCfg.Mode = "client"
+	clientCfg.ServerAddr = strings.Replace(publicURL, "http://", "ws://", 1)
+	tunnelClient, err := client.NewTunnelClient(&clientCfg)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(tunnelClient.Stop)
+	time.Sleep(200 * time.Millisecond)
+	return publicURL, proxy
+}
+
+// keyedGet 以 GET 请求公网地址并读完响应体，key 非空时带上 X-Tunnel-Key，不跟随重定向。
+// header 为成对的请求头名和值，其中 Host 设置请求的主机名。请求失败或读取响应体出错时记为测试失败，
+// 返回状态码为0的空响应，因此也可以在后台协程中调用
+func keyedGet(t testing.TB, url, key string, header ...string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if key != "" {
+		req.Header.Set("X-Tunnel-Key", key)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i] == "Host" {
+			req.Host = header[i+1]
+		} else {
+			req.Header.Set(header[i], header[i+1])
+		}
+	}
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Errorf("Request %s failed: %v", url, err)
+		return &http.Response{Header: http.Header{}, Body: http.NoBody}, ""
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Failed to read response body from %s: %v", url, err)
+	}
+	return resp, string(body)
+}
+
+func TestResponseTransformThroughTunnel(t *testing.T) {
+	page := "<html><head><title>app</title></head><body>" + strings.Repeat("x", 4096) + "</body></html>"
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.URL.Path == "/logo.png" {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+		io.WriteString(w, page)
+	})
+	keys := map[string]*config.KeyConfig{"inject-test": {Transforms: []*config.TransformConfig{
+		{Type: "replace", From: "</head>", To: `<script src="/banner.js"></script></head>`},
+	}}}
+
+	// 小响应以单条消息发送，流式转发时逐块改写
+	for _, threshold := range []int{0, -1} {
+		publicURL, _ := startServerTunnel(t, target, config.Config{Keys: keys}, config.Config{Key: "inject-test", FullResponseThreshold: threshold})
+
+		resp, body := keyedGet(t, publicURL+"/", "inject-test")
+		if !strings.Contains(body, `<script src="/banner.js"></script></head>`) {
+			t.Errorf("threshold=%d: expected injected script, got %.80q", threshold, body)
+		}
+		if cl := resp.Header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(body)) {
+			t.Errorf("threshold=%d: Content-Length %s does not match body length %d", threshold, cl, len(body))
+		}
+
+		_, body = keyedGet(t, publicURL+"/logo.png", "inject-test")
+		if body != page {
+			t.Errorf("threshold=%d: non-matching content type should pass through unchanged", threshold)
+		}
+	}
+}
+
+func TestRequestTransformThroughTunnel(t *testing.T) {
+	publicURL, _ := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, strconv.FormatInt(r.ContentLength, 10)+" "+string(body))
+	}), config.Config{Keys: map[string]*config.KeyConfig{"request-test": {Transforms: []*config.TransformConfig{
+		{Type: "replace", Direction: "request", From: "app.example.com", To: "localhost:8080"},
+	}}}}, config.Config{Key: "request-test"})
+
+	req, _ := http.NewRequest("POST", publicURL+"/api", strings.NewReader(`{"callback":"https://app.example.com/cb"}`))
+	req.Header.Set("X-Tunnel-Key", "request-test")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	want := `{"callback":"https://localhost:8080/cb"}`
+	if string(body) != strconv.Itoa(len(want))+" "+want {
+		t.Errorf("Unexpected body seen by target: %s", body)
+	}
+}
+
+// upperTransform 将响应体转为大写的自定义规则
+type upperTransform struct{}
+
+func (upperTransform) MatchRequest(*http.Request) bool { return false }
+
+func (upperTransform) MatchResponse(r *http.Request, _ http.Header) bool {
+	return strings.HasPrefix(r.URL.Path, "/shout")
+}
+
+func (upperTransform) NewStage() transform.Stage { return upperStage{} }
+
+type upperStage struct{}
+
+func (upperStage) Write(p []byte) []byte { return []byte(strings.ToUpper(string(p))) }
+func (upperStage) Close() []byte         { return nil }
+
+func TestAddTransform(t *testing.T) {
+	publicURL, proxy := startServerTunnel(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}), config.Config{}, config.Config{Key: "custom-test"})
+	proxy.AddTransform("*", upperTransform{})
+
+	if _, body := keyedGet(t, publicURL+"/shout", "custom-test"); body != "HELLO" {
+		t.Errorf("Expected custom transform to apply, got %q", body)
+	}
+	if _, body := keyedGet(t, publicURL+"/quiet", "custom-test"); body != "hello" {
+		t.Errorf("Expected unmatched path to pass through, got %q", body)
+	}
+}
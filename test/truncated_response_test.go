@@ -0,0 +1,132 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+)
+
+// dropMidResponse 发出响应头和部分响应体后断开隧道
+func dropMidResponse(header string) func(conn *websocket.Conn, id uint64) {
+	return func(conn *websocket.Conn, id uint64) {
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES, header)
+		sendTunnelMessage(conn, id, protocol.MSG_TYPE_HTTP_RES_CHUNK, "partial body")
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}
+}
+
+func TestTunnelClosedMidResponseAborts(t *testing.T) {
+	addr := startFakeTunnel(t, config.Config{AdminToken: "admin-secret"},
+		dropMidResponse("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 100\r\n\r\n"))
+
+	// 隧道断开后立即结束，不等到响应超时；已收到的部分照常送达
+	start := time.Now()
+	data := rawExchange(t, addr)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected response to end when the tunnel closed, took %v", elapsed)
+	}
+	if !bytes.HasPrefix(data, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.HasSuffix(data, []byte("partial body")) {
+		t.Errorf("Expected truncated 200 response, got %q", data)
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Metrics request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `singleproxy_server_truncated_responses_total{key="abort-test"}`) {
+		t.Errorf("Expected truncated response counter for the key, got:\n%s", body)
+	}
+}
+
+func TestTruncatedChunkedResponse(t *testing.T) {
+	get := func(mode string) (*http.Response, []byte, error) {
+		proxy := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", TruncatedResponse: mode}))
+		t.Cleanup(proxy.Close)
+		serveFakeTunnel(t, strings.Replace(proxy.URL, "http://", "ws://", 1)+"/ws/abort-test",
+			dropMidResponse("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"))
+
+		// 需要区分读取响应体时的错误，直接发送请求
+		req, _ := http.NewRequest("GET", proxy.URL+"/stream", nil)
+		req.Header.Set("X-Tunnel-Key", "abort-test")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp, data, err
+	}
+
+	// 默认断开连接而不发送结束块，客户端读到意外的EOF
+	_, data, err := get("")
+	if !errors.Is(err, io.ErrUnexpectedEOF) || string(data) != "partial body" {
+		t.Errorf("Expected unexpected EOF after partial body, got %q %v", data, err)
+	}
+
+	// trailer 模式正常结束分块传输，由尾部字段说明截断原因
+	resp, data, err := get("trailer")
+	if err != nil || string(data) != "partial body" {
+		t.Errorf("Expected clean end after partial body, got %q %v", data, err)
+	}
+	if got := resp.Trailer.Get("X-Proxy-Error"); got != "tunnel_closed" {
+		t.Errorf("Expected X-Proxy-Error trailer tunnel_closed, got %q", got)
+	}
+}
+
+func TestTargetClosedMidBodyTruncates(t *testing.T) {
+	// 目标服务发出分块响应的第一块后断开，客户端读取响应体出错
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\nc\r\npartial body\r\n")
+		buf.Flush()
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	})
+	get := func(mode string) (*http.Response, []byte, error) {
+		publicURL, _ := startServerTunnel(t, target, config.Config{TruncatedResponse: mode},
+			config.Config{Key: "target-abort", FullResponseThreshold: -1})
+		req, _ := http.NewRequest("GET", publicURL+"/stream", nil)
+		req.Header.Set("X-Tunnel-Key", "target-abort")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp, data, err
+	}
+
+	// 响应不能以正常的结束块收尾，否则公网用户会把不完整的响应体当作完整响应
+	_, data, err := get("")
+	if !errors.Is(err, io.ErrUnexpectedEOF) || string(data) != "partial body" {
+		t.Errorf("Expected unexpected EOF after partial body, got %q %v", data, err)
+	}
+
+	resp, data, err := get("trailer")
+	if err != nil || string(data) != "partial body" {
+		t.Errorf("Expected clean end after partial body, got %q %v", data, err)
+	}
+	if got := resp.Trailer.Get("X-Proxy-Error"); got != "target_read_failed" {
+		t.Errorf("Expected X-Proxy-Error trailer target_read_failed, got %q", got)
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSimultaneousRequestsOnOneTunnel(t *testing.T) {
+	url, _ := startServerTunnel(t, echoPathTarget(), config.Config{}, config.Config{Key: "fanout"})
+
+	// 200个请求同时写入同一条隧道连接，由写入协程逐条发出
+	const n = 200
+	httpClient := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: n}, Timeout: 10 * time.Second}
+	t.Cleanup(httpClient.CloseIdleConnections)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", fmt.Sprintf("%s/item/%d", url, i), nil)
+			req.Header.Set("X-Tunnel-Key", "fanout")
+			<-start
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				t.Errorf("Request %d failed: %v", i, err)
+				return
+			}
+			if body := readBody(resp); resp.StatusCode != http.StatusOK || body != fmt.Sprintf("path=/item/%d", i) {
+				t.Errorf("Request %d: expected its own response, got %d %q", i, resp.StatusCode, body)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestTunnelSendQueueFull(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	proxy := server.NewSinglePortProxy(&config.Config{
+		Mode:                  "server",
+		ListenPort:            strings.TrimPrefix(addr, "127.0.0.1:"),
+		TunnelSendQueue:       2,
+		ResponseHeaderTimeout: 2 * time.Second,
+		AdminToken:            "admin-secret",
+	})
+	go proxy.Start()
+	t.Cleanup(func() { proxy.Stop() })
+	time.Sleep(100 * time.Millisecond)
+
+	// 客户端注册后不再读取，发送缓冲区写满后写入协程阻塞，请求在队列中堆积
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws/stalled", nil)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	time.Sleep(100 * time.Millisecond)
+
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	busy := make(chan time.Duration, 64)
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "http://"+addr+"/upload", bytes.NewReader(body))
+			req.Header.Set("X-Tunnel-Key", "stalled")
+			sent := time.Now()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return
+			}
+			if text := readBody(resp); resp.StatusCode == http.StatusServiceUnavailable && strings.Contains(text, "Tunnel client busy") {
+				busy <- time.Since(sent)
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+	close(busy)
+
+	rejected := 0
+	for elapsed := range busy {
+		rejected++
+		// 队列已满时立即拒绝，不等待客户端或响应超时
+		if elapsed > time.Second {
+			t.Errorf("Expected the busy response without waiting, took %v", elapsed)
+		}
+	}
+	if rejected == 0 {
+		t.Fatal("Expected requests to be rejected with 503 once the send queue was full")
+	}
+	if n := metricValue(t, "http://"+addr, "admin-secret", "singleproxy_server_tunnel_send_queue_full_total"); n < int64(rejected) {
+		t.Errorf("Expected at least %d rejected messages in metrics, got %d", rejected, n)
+	}
+}
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/protocol"
+	"singleproxy/pkg/server"
+)
+
+// sendUnknown 发送指定数量的未知类型消息
+func sendUnknown(t *testing.T, conn *websocket.Conn, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		data, _ := protocol.SerializeTunnelMessage(protocol.TunnelMessage{ID: uint64(i + 1), Type: 99, Payload: []byte("x")})
+		if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("Failed to send unknown message: %v", err)
+		}
+	}
+}
+
+// expectProtocolErrorClose 等待对端以协议错误关闭连接
+func expectProtocolErrorClose(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+			t.Errorf("Expected protocol error close, got %v", err)
+		}
+		return
+	}
+}
+
+func TestServerClosesAfterUnknownMessages(t *testing.T) {
+	proxy := server.NewSinglePortProxy(&config.Config{Mode: "server", MaxUnknownMessages: 3})
+	ts := httptest.NewServer(proxy)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/ws/unknown-test", nil)
+	if err != nil {
+		t.Fatalf("Failed to register tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	sendUnknown(t, conn, 3)
+	expectProtocolErrorClose(t, conn)
+}
+
+func TestClientClosesAfterUnknownMessages(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	result := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		result <- conn
+	}))
+	defer ts.Close()
+
+	tunnelClient, err := client.NewTunnelClient(&config.Config{
+		Mode:               "client",
+		ServerAddr:         strings.Replace(ts.URL, "http://", "ws://", 1),
+		TargetAddr:         "127.0.0.1:1",
+		Key:                "unknown-test",
+		MaxUnknownMessages: 2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := tunnelClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	conn := <-result
+	defer conn.Close()
+
+	sendUnknown(t, conn, 2)
+	expectProtocolErrorClose(t, conn)
+}
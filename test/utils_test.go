@@ -167,6 +167,70 @@ func TestGetClientIP_InvalidRemoteAddr(t *testing.T) {
 	}
 }
 
+func TestParseClientIP(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7:8080", "203.0.113.7"},
+		{" 203.0.113.7 ", "203.0.113.7"},
+		{"::ffff:203.0.113.7", "203.0.113.7"},
+		{"[::ffff:203.0.113.7]:443", "203.0.113.7"},
+		{"::ffff:cb00:7107", "203.0.113.7"},
+		{"2001:DB8:0:0::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:8080", "fe80::1"},
+		{"invalid-addr", ""},
+		{"2001:db8::1:443", "2001:db8::1:443"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		addr, ok := utils.ParseClientIP(tt.in)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("ParseClientIP(%q) = %s, expected failure", tt.in, addr)
+			}
+			continue
+		}
+		if !ok || addr.String() != tt.want {
+			t.Errorf("ParseClientIP(%q) = %s, %v, expected %s", tt.in, addr, ok, tt.want)
+		}
+	}
+}
+
+func TestGetClientIP_IPv6(t *testing.T) {
+	tests := []struct {
+		name       string
+		xff        string
+		realIP     string
+		remoteAddr string
+		want       string
+	}{
+		{"mapped remote addr", "", "", "[::ffff:198.51.100.9]:5000", "198.51.100.9"},
+		{"zoned remote addr", "", "", "[fe80::1%eth0]:5000", "fe80::1"},
+		{"first bracketed xff entry", "[2001:db8::7]:61000, 10.0.0.1", "", "10.0.0.2:80", "2001:db8::7"},
+		{"mapped xff entry", "::ffff:198.51.100.9", "", "10.0.0.2:80", "198.51.100.9"},
+		{"invalid xff falls back", "unknown", "[2001:db8::8]", "10.0.0.2:80", "2001:db8::8"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/test", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		ip, err := utils.GetClientIP(req)
+		if err != nil || ip != tt.want {
+			t.Errorf("%s: expected %s, got %q (%v)", tt.name, tt.want, ip, err)
+		}
+	}
+}
+
 func TestMin(t *testing.T) {
 	tests := []struct {
 		name     string
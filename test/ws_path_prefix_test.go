@@ -0,0 +1,78 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"singleproxy/pkg/client"
+	"singleproxy/pkg/config"
+	"singleproxy/pkg/server"
+)
+
+func TestWSPathPrefix(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "path="+r.URL.Path)
+	}))
+	t.Cleanup(target.Close)
+	targetAddr := strings.TrimPrefix(target.URL, "http://")
+
+	// 代理位于 nginx 的 /a/b/tunnel/ 下且路径原样转发
+	proxyServer := httptest.NewServer(server.NewSinglePortProxy(&config.Config{Mode: "server", WSPathPrefix: "a/b/tunnel/ws"}))
+	t.Cleanup(proxyServer.Close)
+
+	wsClient, err := client.NewTunnelClient(&config.Config{
+		Mode:       "client",
+		ServerAddr: strings.Replace(proxyServer.URL, "http://", "ws://", 1) + "/a/b/tunnel/",
+		TargetAddr: targetAddr,
+		Key:        "nested-ws",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if err := wsClient.Connect(); err != nil {
+		t.Fatalf("Failed to connect under nested prefix: %v", err)
+	}
+
+	httpClient, err := client.NewHTTPTunnelClient(&config.Config{
+		Mode:       "http-client",
+		ServerAddr: proxyServer.URL + "/a/b/tunnel",
+		TargetAddr: targetAddr,
+		Key:        "nested-poll",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %v", err)
+	}
+	go httpClient.Run()
+	t.Cleanup(httpClient.Stop)
+	time.Sleep(200 * time.Millisecond)
+
+	get := func(path, key string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", proxyServer.URL+path, nil)
+		req.Header.Set("X-Tunnel-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, key := range []string{"nested-ws", "nested-poll"} {
+		if status, body := get("/app", key); status != http.StatusOK || body != "path=/app" {
+			t.Errorf("%s: expected tunnel response, got %d %q", key, status, body)
+		}
+	}
+
+	// 默认前缀之外的 /ws/ 和 /http-tunnel/ 路径属于公网请求，转发给目标服务
+	for _, path := range []string{"/ws/nested-ws", "/api/ws/items", "/http-tunnel/poll/x"} {
+		if status, body := get(path, "nested-ws"); status != http.StatusOK || body != "path="+path {
+			t.Errorf("%s: expected public request to reach target, got %d %q", path, status, body)
+		}
+	}
+}